@@ -0,0 +1,304 @@
+// Command bench loads a collector with metric lines from many connections
+// at a set rate, reporting the throughput it achieved and the errors it
+// met, to size a collector before it takes production traffic.
+//
+//	bench -addr collector:4268 -conns 50 -rate 100000 -duration 1m
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	addr     = flag.String("addr", "localhost:4268", "address of the collector's listener")
+	network  = flag.String("network", "tcp", "tcp or udp, a datagram carries one line")
+	format   = flag.String("format", "tsv", "line format the listener takes: tsv, statsd, graphite or influx")
+	conns    = flag.Int("conns", 10, "concurrent connections")
+	rate     = flag.Int("rate", 10000, "lines per second across all connections, 0 to send as fast as the collector takes them")
+	duration = flag.Duration("duration", 30*time.Second, "how long to send for, the collector's answers are then waited for a second")
+	names    = flag.Int("names", 1000, "distinct metric names, picked with a Zipf distribution so a few are hot as in production")
+	hosts    = flag.Int("hosts", 50, "distinct values of the host tag, multiplying the series with -names")
+	token    = flag.String("token", "", "authenticate every connection with AUTH <token>")
+	reply    = flag.Bool("reply", true, "ask a TCP collector with REPLY BATCH what became of the lines, counting those rejected")
+)
+
+// counters are what the connections did, added up across all of them
+type counters struct {
+	sent, failed, accepted, rejected uint64
+	// connections that couldn't be opened or broke while sending
+	dialErrors, writeErrors uint64
+	// the first reason the collector gave for a rejection
+	reason atomic.Value
+}
+
+// tick is how often a connection writes out the lines due
+const tick = 10 * time.Millisecond
+
+func main() {
+	flag.Parse()
+	if *conns <= 0 || *rate < 0 || *names <= 0 || *hosts <= 0 {
+		fmt.Fprintln(os.Stderr, "bench: -conns, -names and -hosts must be positive and -rate 0 or more")
+		os.Exit(2)
+	}
+	if _, ok := generators[*format]; !ok {
+		fmt.Fprintf(os.Stderr, "bench: unknown -format %q\n", *format)
+		os.Exit(2)
+	}
+
+	var c counters
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			run(i, &c, stop)
+		}(i)
+	}
+
+	// a report line a second, then the totals once done or interrupted
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	ticker := time.NewTicker(time.Second)
+	deadline := time.After(*duration)
+	var last uint64
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			sent := atomic.LoadUint64(&c.sent)
+			fmt.Fprintf(os.Stderr, "(1 sec): Sent %d lines, rejected %d, write errors %d\n", sent-last, atomic.LoadUint64(&c.rejected), atomic.LoadUint64(&c.writeErrors))
+			last = sent
+		case <-deadline:
+			break loop
+		case <-sigc:
+			break loop
+		}
+	}
+	ticker.Stop()
+	elapsed := time.Since(start)
+	close(stop)
+	wg.Wait()
+	summary(os.Stdout, &c, elapsed)
+}
+
+// Writes the totals of the run
+func summary(w *os.File, c *counters, elapsed time.Duration) {
+	sent := atomic.LoadUint64(&c.sent)
+	fmt.Fprintf(w, "connections\t%d\n", *conns)
+	fmt.Fprintf(w, "elapsed\t%.3fs\n", elapsed.Seconds())
+	fmt.Fprintf(w, "lines sent\t%d\n", sent)
+	fmt.Fprintf(w, "throughput\t%.0f lines/s\n", float64(sent)/elapsed.Seconds())
+	if *rate > 0 {
+		fmt.Fprintf(w, "target\t%d lines/s\n", *rate)
+	}
+	fmt.Fprintf(w, "dial errors\t%d\n", atomic.LoadUint64(&c.dialErrors))
+	fmt.Fprintf(w, "write errors\t%d\n", atomic.LoadUint64(&c.writeErrors))
+	fmt.Fprintf(w, "lines lost to errors\t%d\n", atomic.LoadUint64(&c.failed))
+	if answered := atomic.LoadUint64(&c.accepted) + atomic.LoadUint64(&c.rejected); answered > 0 {
+		rejected := atomic.LoadUint64(&c.rejected)
+		fmt.Fprintf(w, "lines answered\t%d\n", answered)
+		fmt.Fprintf(w, "rejected\t%d (%.2f%%)\n", rejected, 100*float64(rejected)/float64(answered))
+		if reason, ok := c.reason.Load().(string); ok {
+			fmt.Fprintf(w, "first rejection\t%s\n", reason)
+		}
+	}
+}
+
+// Sends the connection's share of the rate until stopped, dialing again
+// after a failure
+func run(i int, c *counters, stop chan struct{}) {
+	gen := newGenerator(int64(i))
+	// the lines due each tick, the remainder carried over
+	perTick := float64(*rate) / float64(*conns) * tick.Seconds()
+	var due float64
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		conn, err := dial()
+		if err != nil {
+			atomic.AddUint64(&c.dialErrors, 1)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		answers := make(chan struct{})
+		go func() {
+			defer close(answers)
+			readAnswers(conn, c)
+		}()
+		w := newLineWriter(conn)
+		for err == nil {
+			select {
+			case <-stop:
+				w.Flush()
+				finish(conn, answers)
+				return
+			default:
+			}
+			n := 256
+			if *rate > 0 {
+				<-ticker.C
+				due += perTick
+				n = int(due)
+				due -= float64(n)
+			}
+			for j := 0; j < n && err == nil; j++ {
+				_, err = w.WriteString(gen.line(time.Now()))
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+			if err == nil {
+				atomic.AddUint64(&c.sent, uint64(n))
+			} else {
+				atomic.AddUint64(&c.failed, uint64(n))
+			}
+		}
+		atomic.AddUint64(&c.writeErrors, 1)
+		conn.Close()
+		<-answers
+	}
+}
+
+// lineWriter buffers the lines written to a stream, a datagram socket is
+// written a line at a time
+type lineWriter interface {
+	WriteString(s string) (int, error)
+	Flush() error
+}
+
+type datagramWriter struct {
+	net.Conn
+}
+
+func (d datagramWriter) WriteString(s string) (int, error) {
+	return d.Write([]byte(s))
+}
+
+func (datagramWriter) Flush() error { return nil }
+
+func newLineWriter(conn net.Conn) lineWriter {
+	if _, ok := conn.(net.PacketConn); ok {
+		return datagramWriter{conn}
+	}
+	return bufio.NewWriterSize(conn, 64*1024)
+}
+
+// Opens a connection and sends the commands of the handshake
+func dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(*network, *addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var handshake string
+	if *token != "" {
+		handshake += "AUTH " + *token + "\n"
+	}
+	if *reply && *network == "tcp" {
+		handshake += "REPLY BATCH\n"
+	}
+	if handshake != "" {
+		if _, err := conn.Write([]byte(handshake)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Gives the collector a second to answer the last lines, then hangs up
+func finish(conn net.Conn, answers chan struct{}) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	select {
+	case <-answers:
+	case <-time.After(time.Second):
+	}
+	conn.Close()
+	<-answers
+}
+
+// Counts the collector's answers to REPLY BATCH: "OK <n>" or
+// "ERR <rejected>/<n> <reason>"
+func readAnswers(conn net.Conn, c *counters) {
+	r := bufio.NewScanner(conn)
+	for r.Scan() {
+		fields := strings.Fields(r.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "OK":
+			n, _ := strconv.ParseUint(fields[1], 10, 64)
+			atomic.AddUint64(&c.accepted, n)
+		case "ERR":
+			rejected, total, ok := strings.Cut(fields[1], "/")
+			if !ok {
+				continue
+			}
+			bad, _ := strconv.ParseUint(rejected, 10, 64)
+			n, _ := strconv.ParseUint(total, 10, 64)
+			atomic.AddUint64(&c.rejected, bad)
+			atomic.AddUint64(&c.accepted, n-min(bad, n))
+			c.reason.CompareAndSwap(nil, strings.Join(fields[2:], " "))
+		}
+	}
+}
+
+// generator makes the lines of one connection
+type generator struct {
+	rand   *rand.Rand
+	names  *rand.Zipf
+	format func(name string, host int, value float64, now time.Time) string
+}
+
+func newGenerator(seed int64) *generator {
+	r := rand.New(rand.NewSource(seed))
+	return &generator{
+		rand:   r,
+		names:  rand.NewZipf(r, 1.1, 1, uint64(*names-1)),
+		format: generators[*format],
+	}
+}
+
+// Returns the next line, of a name picked by its Zipf distribution from a
+// host picked evenly
+func (g *generator) line(now time.Time) string {
+	name := "bench-metric-" + strconv.FormatUint(g.names.Uint64(), 10)
+	return g.format(name, g.rand.Intn(*hosts), g.rand.Float64()*100, now)
+}
+
+// generators write a line of each format, names are dashed so they are
+// valid in every one
+var generators = map[string]func(name string, host int, value float64, now time.Time) string{
+	"tsv": func(name string, host int, value float64, now time.Time) string {
+		return fmt.Sprintf("%s\t%.3f\t%d\tg\thost=bench-%d\n", name, value, now.Unix(), host)
+	},
+	"statsd": func(name string, host int, value float64, now time.Time) string {
+		return fmt.Sprintf("%s:%.3f|ms|#host:bench-%d\n", name, value, host)
+	},
+	"graphite": func(name string, host int, value float64, now time.Time) string {
+		return fmt.Sprintf("bench-%d.%s %.3f %d\n", host, name, value, now.Unix())
+	},
+	"influx": func(name string, host int, value float64, now time.Time) string {
+		return fmt.Sprintf("%s,host=bench-%d value=%.3f %d\n", name, host, value, now.UnixNano())
+	},
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"strings"
+
+	"github.com/jeffdupont/go-challenge/pkg/server"
+)
+
+// Returns every flag as resolved, for the admin API's /config/effective.
+// The collector is configured by flags alone, so each value is either its
+// default or was set on the command line.
+func effectiveSettings() map[string]server.ConfigSetting {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	settings := make(map[string]server.ConfigSetting)
+	flag.VisitAll(func(f *flag.Flag) {
+		s := server.ConfigSetting{Value: f.Value.String(), Source: "default", Default: f.DefValue}
+		if set[f.Name] {
+			s.Source = "flag"
+		}
+		if r, ok := f.Value.(redacter); ok {
+			s.Value = r.Redacted()
+		}
+		if secret(f.Name) {
+			if s.Value != "" {
+				s.Value = server.Redacted
+			}
+			if s.Default != "" {
+				s.Default = server.Redacted
+			}
+		}
+		settings[f.Name] = s
+	})
+	return settings
+}
+
+// Reports whether the flag holds a secret, or where one is kept
+func secret(name string) bool {
+	for _, word := range []string{"token", "password", "secret"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return strings.HasSuffix(name, "-key") || strings.HasSuffix(name, "-keys")
+}
+
+// redacter is a flag whose value holds secrets among what isn't, the
+// -listen and -sink URLs
+type redacter interface {
+	Redacted() string
+}
+
+// Returns the comma-joined URLs with the secrets they carry redacted: the
+// password of the userinfo, or the whole of it when the scheme takes a lone
+// token there, and the query params whose names say they are secrets
+func redactURLs(specs []string) string {
+	redacted := make([]string, len(specs))
+	for i, spec := range specs {
+		redacted[i] = spec
+		u, err := url.Parse(spec)
+		if err != nil {
+			continue
+		}
+		hidden := false
+		if u.User != nil {
+			_, ok := u.User.Password()
+			if !ok && u.Scheme == "nats" {
+				u.User = url.UserPassword("", "")
+			}
+			hidden = ok || u.Scheme == "nats"
+		}
+		q := u.Query()
+		for key := range q {
+			if secret(key) {
+				q.Set(key, "xxxxx")
+				u.RawQuery, hidden = q.Encode(), true
+			}
+		}
+		if hidden {
+			redacted[i] = u.Redacted()
+		}
+	}
+	return strings.Join(redacted, ",")
+}
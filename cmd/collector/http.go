@@ -0,0 +1,51 @@
+//go:build !minimal
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/jeffdupont/go-challenge/pkg/server"
+)
+
+// Starts the admin and ingest HTTP APIs that have an address, returning the
+// function shutting them down gracefully
+func serveHTTP(srv *server.Server, watchdog *server.Watchdog) func(ctx context.Context) {
+	var servers []*http.Server
+	add := func(name, addr string, h http.Handler) {
+		logger := slog.Default().With("server", name)
+		servers = append(servers, &http.Server{Addr: addr, Handler: h, ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn)})
+	}
+	if *adminAddr != "" {
+		add("admin", *adminAddr, server.NewAdminHandler(srv, watchdog))
+	}
+	if *httpAddr != "" {
+		add("http", *httpAddr, server.NewAPIHandler(srv, *requireAuth))
+	}
+	if *debugAddr != "" {
+		srv.PublishExpvars()
+		add("debug", *debugAddr, server.NewDebugHandler(*profiling))
+	}
+	for _, hs := range servers {
+		go func(hs *http.Server) {
+			if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+				fatalf("%s: %v", hs.Addr, err)
+			}
+		}(hs)
+	}
+
+	return func(ctx context.Context) {
+		var wg sync.WaitGroup
+		for _, hs := range servers {
+			wg.Add(1)
+			go func(hs *http.Server) {
+				defer wg.Done()
+				hs.Shutdown(ctx)
+			}(hs)
+		}
+		wg.Wait()
+	}
+}
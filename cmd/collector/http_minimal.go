@@ -0,0 +1,21 @@
+//go:build minimal
+
+// Built with -tags minimal the collector leaves out the HTTP APIs and TLS,
+// keeping TCP, unix and UDP ingest and the stdout report, for embedded and
+// edge deployments where binary size matters.
+
+package main
+
+import (
+	"context"
+
+	"github.com/jeffdupont/go-challenge/pkg/server"
+)
+
+// The HTTP APIs aren't built in, asking for one is an error
+func serveHTTP(srv *server.Server, watchdog *server.Watchdog) func(ctx context.Context) {
+	if *adminAddr != "" || *httpAddr != "" || *debugAddr != "" {
+		fatalf("HTTP: -admin-addr, -http-addr and -debug-addr are not available in minimal builds")
+	}
+	return func(context.Context) {}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jeffdupont/go-challenge/pkg/sink"
+)
+
+var (
+	logFormat = flag.String("log-format", "text", "format of the log on stderr, text or json. The stats report lines are written as they are")
+	logLevel  = flag.String("log-level", "info", "least severe log records kept: debug, info, warn or error. At debug every metric rejected is logged with its connection")
+	logOutput = flag.String("log-output", "stderr", "where the log goes: stderr, a file like file:///var/log/collector.log?max-size=10485760&keep=5 taking the rotation options of a file sink, syslog for the local daemon, syslog://host:514 or syslog+tcp://host:601 for a remote one, or journald. The reports stay on stdout and stderr")
+)
+
+// the log destination, closed once the collector shuts down
+var logCloser io.Closer
+
+// Sets the default logger from -log-format, -log-level and -log-output,
+// everything the collector and its packages log goes through it
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("-log-level %q is unknown, want debug, info, warn or error", *logLevel)
+	}
+	out, leveled, err := openLogOutput(*logOutput)
+	if err != nil {
+		return fmt.Errorf("-log-output: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if leveled != nil {
+		// syslog and journald stamp the records themselves
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+		out = &levelWriter{to: leveled}
+	}
+	var h slog.Handler
+	switch *logFormat {
+	case "text":
+		h = slog.NewTextHandler(out, opts)
+	case "json":
+		h = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("-log-format %q is unknown, want text or json", *logFormat)
+	}
+	if lw, ok := out.(*levelWriter); ok {
+		h = levelHandler{Handler: h, out: lw}
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// Closes the log destination, what is logged after goes to stderr
+func closeLogging() {
+	if logCloser == nil {
+		return
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	logCloser.Close()
+	logCloser = nil
+}
+
+// Logs the message at the error level and exits
+func fatalf(format string, args ...any) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// leveledWriter is a destination taking the severity of each record, like
+// syslog and journald
+type leveledWriter interface {
+	WriteLevel(level slog.Level, msg string) error
+}
+
+// Opens the destination of -log-output. Syslog and journald are returned
+// as a leveledWriter, the others as a writer.
+func openLogOutput(spec string) (io.Writer, leveledWriter, error) {
+	switch spec {
+	case "", "stderr":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return nil, nil, errors.New("stdout holds the report, log to stderr or elsewhere")
+	case "journald":
+		j, err := dialJournald(journaldSocket)
+		if err != nil {
+			return nil, nil, err
+		}
+		logCloser = j
+		return nil, j, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, nil, errors.New("want a path like file:///var/log/collector.log")
+		}
+		f, err := sink.OpenLogFile(path, u.Query())
+		if err != nil {
+			return nil, nil, err
+		}
+		logCloser = f
+		return f, nil, nil
+	case "syslog", "syslog+udp", "syslog+tcp":
+		network := strings.TrimPrefix(strings.TrimPrefix(u.Scheme, "syslog"), "+")
+		if u.Host == "" {
+			// the local daemon
+			network = ""
+		} else if network == "" {
+			network = "udp"
+		}
+		w, err := dialSyslog(network, u.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+		logCloser = w
+		return nil, w, nil
+	}
+	return nil, nil, fmt.Errorf("unknown destination %q, want stderr, file, syslog or journald", spec)
+}
+
+// levelWriter hands what the handler formats to a leveledWriter with the
+// level of the record being handled
+type levelWriter struct {
+	mu    sync.Mutex
+	level slog.Level
+	to    leveledWriter
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	return len(p), w.to.WriteLevel(w.level, strings.TrimSuffix(string(p), "\n"))
+}
+
+// levelHandler passes each record's level to the levelWriter its handler
+// writes to
+type levelHandler struct {
+	slog.Handler
+	out *levelWriter
+}
+
+func (h levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
+
+// the socket of journald's native protocol
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journald writes records to the journal over its native protocol, a
+// datagram of fields per record
+type journald struct {
+	conn net.Conn
+}
+
+func dialJournald(path string) (*journald, error) {
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return nil, err
+	}
+	return &journald{conn: conn}, nil
+}
+
+// WriteLevel sends the record with the syslog priority of its level
+func (j *journald) WriteLevel(level slog.Level, msg string) error {
+	var b []byte
+	b = journalField(b, "PRIORITY", fmt.Sprint(syslogSeverity(level)))
+	b = journalField(b, "SYSLOG_IDENTIFIER", "collector")
+	b = journalField(b, "MESSAGE", msg)
+	_, err := j.conn.Write(b)
+	return err
+}
+
+func (j *journald) Close() error {
+	return j.conn.Close()
+}
+
+// Appends a field of the native protocol, a value holding a newline is
+// written with its length
+func journalField(b []byte, key, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		return append(append(append(b, key...), '='), value+"\n"...)
+	}
+	b = append(append(b, key...), '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	return append(b, value+"\n"...)
+}
+
+// Returns the syslog severity of a level: debug 7, info 6, warning 4 and
+// error 3
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
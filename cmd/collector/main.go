@@ -0,0 +1,1066 @@
+// The admin and ingest APIs route with the method and wildcard patterns of
+// Go 1.22, which the GODEBUG defaults of a GOPATH build turn off
+//
+//go:debug httpmuxgo121=0
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/hll"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/server"
+	"github.com/jeffdupont/go-challenge/pkg/sink"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+	"github.com/jeffdupont/go-challenge/pkg/topk"
+)
+
+// Set when building a release, with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// those left empty are taken from what the Go toolchain embedded
+var version, commit, date string
+
+var (
+	listens listenFlags
+	lengths windowFlags
+	sinks   sinkFlags
+
+	addr       = flag.String("addr", ":4268", "plaintext TCP listen address (empty to disable)")
+	tlsAddr    = flag.String("tls-addr", ":4269", "TLS listen address, used when -tls-cert and -tls-key are set")
+	tlsCert    = flag.String("tls-cert", "", "PEM encoded certificate for the TLS listener")
+	tlsKey     = flag.String("tls-key", "", "PEM encoded private key for the TLS listener")
+	tlsCA      = flag.String("tls-client-ca", "", "PEM encoded CA bundle, when set clients must present a certificate signed by it")
+	proxyProto = flag.Bool("proxy-protocol", false, "expect a HAProxy PROXY protocol (v1 or v2) header on every connection")
+
+	httpAddr       = flag.String("http-addr", "", "HTTP listen address for the ingest API (empty to disable)")
+	adminAddr      = flag.String("admin-addr", "", "HTTP listen address for the admin API (empty to disable)")
+	telemetry      = flag.Bool("telemetry", false, "feed the collector's own connections, accepted and rejected lines, panics and flush durations to every window under the -reserved-prefix")
+	reservedPrefix = flag.String("reserved-prefix", server.TelemetryPrefix, "prefix of the names reserved for the collector's own metrics, clients' metrics under it are rejected as RESERVED so they can't be spoofed or clobbered (empty reserves none)")
+	debugAddr      = flag.String("debug-addr", "", "HTTP listen address serving the expvars at /debug/vars: rawCount, currentConnections, rejections and storeSize (empty to disable)")
+	profiling      = flag.Bool("pprof", false, "also serve the net/http/pprof CPU, heap and goroutine profiles at /debug/pprof/ on -debug-addr")
+	consoleAddr    = flag.String("console-addr", "", "TCP listen address for the text admin commands STATS, GET <name>, FLUSH, RESET, CONNS and MAXCONNS <n> (empty to disable)")
+	authTokens     = flag.String("auth-tokens", "", "file of tenant:token lines clients authenticate with using AUTH <token>, reloaded on SIGHUP. COLLECTOR_AUTH_TOKENS may hold more, comma separated")
+	requireAuth    = flag.Bool("require-auth", false, "close connections that send a metric before a valid AUTH token, and refuse the HTTP ingest API requests without an Authorization: Bearer token")
+	quarantineFile = flag.String("quarantine-file", "quarantine.tsv", "file capturing metrics from quarantined producers")
+	deadLetters    = flag.String("dead-letters", "", "file, or tcp://, udp:// or unix:// socket, recording every line rejected for not parsing, an invalid value or name or a stale timestamp as a JSON line with the raw line, the reason, the source address and the time (empty to disable)")
+
+	statsdAddr    = flag.String("statsd-addr", "", "TCP listen address accepting statsd lines (empty to disable)")
+	statsdUDPAddr = flag.String("statsd-udp-addr", "", "UDP listen address accepting statsd datagrams (empty to disable)")
+
+	encryptKeys = flag.String("encrypt-keys", "", "key file enabling AES-GCM encryption of files written to disk (empty to disable)")
+	decrypt     = flag.String("decrypt", "", "decrypt the given file to stdout using -encrypt-keys and exit, a -wal segment (.wal) as a JSON line for each metric")
+
+	importMapping = flag.String("import-mapping", "", "convert a statsd_exporter mapping config or telegraf statsd templates to -scrub-rules written to stdout and exit")
+
+	graphiteAddr = flag.String("graphite-addr", "", "TCP listen address accepting graphite plaintext lines (empty to disable)")
+	influxAddr   = flag.String("influx-addr", "", "TCP listen address accepting InfluxDB line protocol (empty to disable)")
+	protobufAddr = flag.String("protobuf-addr", "", "TCP listen address accepting length prefixed protobuf batches (empty to disable)")
+
+	clusterPeers = flag.String("cluster-peers", "", "comma separated host:port -cluster-addr of every collector of a cluster behind a load balancer, this one included. Each aggregates the names a consistent hash gives it and forwards the metrics of the others' names to them, so no window of a name is split between collectors. Every collector must be given the same list (empty to aggregate everything here)")
+	clusterSelf  = flag.String("cluster-self", "", "this collector's entry in -cluster-peers")
+	clusterAddr  = flag.String("cluster-addr", ":4270", "TCP listen address accepting the metrics forwarded by the other -cluster-peers, used with -cluster-peers")
+	clusterToken = flag.String("cluster-token", "", "token the metrics are forwarded to the other -cluster-peers with, for peers requiring AUTH")
+	clusterJoin  = flag.String("cluster-join", "", "comma separated host:port -cluster-addr of collectors to join a cluster through instead of a static -cluster-peers: the collectors gossip who is in it over UDP on the -cluster-addr port, the names of one that fails going to the others, and of one that joins to it")
+
+	replicate        = flag.String("replicate", "", "host:port of a standby collector's -standby-addr every metric accepted is streamed to, so it can take over with the same windows (empty to disable)")
+	replicateBacklog = flag.Int("replicate-backlog", 100000, "metrics held for a -replicate standby to catch up from after it reconnects, one further behind is told how many it lost")
+	replicateToken   = flag.String("replicate-token", "", "secret the primary presents to its standby, both must be given the same")
+	standbyAddr      = flag.String("standby-addr", "", "TCP listen address making this collector a hot standby: the metrics a -replicate primary streams to it are aggregated but its windows aren't reported until the primary has been silent for -standby-takeover (empty to disable)")
+	standbyTakeover  = flag.Duration("standby-takeover", 30*time.Second, "how long the primary may be silent before the -standby-addr standby takes over")
+
+	scrubFile  = flag.String("scrub-rules", "", "file of rules scrubbing PII from metric names, rewriting them with regexps (collapsing per-host suffixes, replacing dots) or mapping them to new names and tags, before they are stored or captured")
+	nameFilter = flag.String("name-filter", "", "file of \"allow <pattern>\" and \"deny <pattern>\" lines dropping metrics by their scrubbed name at ingest, a pattern being a glob or a /regexp/; the first rule matching decides and with allow rules only the names they match are kept. Reloaded on SIGHUP")
+
+	nameLower     = flag.Bool("name-lowercase", false, "lowercase metric names once scrubbed, so CPU-Load and cpu-load aggregate together")
+	nameSeparator = flag.String("name-separator", "", "replace the word separators - and _ in metric names with this one once scrubbed, - or _ (empty keeps them)")
+	nameTag       = flag.String("name-original-tag", "", "tag key the name as sent is kept under when -name-lowercase or -name-separator changed it, making each spelling a series of its own (empty keeps none)")
+	attribute     = flag.String("attribute", "", "comma separated sources every metric is tagged with, remote (the producer's address), token (the id of its AUTH token) and listener, so the report breaks each aggregate down by source (empty tags none)")
+
+	locales = flag.String("value-locales", "", "comma separated number locales (en, de, fr, ch) tried in order on values that aren't plain floats, e.g. de accepts 3,14 (empty for plain floats only)")
+
+	reusePort  = flag.Int("reuseport", 1, "number of SO_REUSEPORT sockets (Linux only) each listener opens, each with its own accept loop")
+	maxConns   = flag.Int("max-conns", server.MaxConnections, "default connection limit for each listener")
+	saturation = flag.String("saturation", "block", "what listeners do when the connection cap or store is saturated: block, reject or sample")
+	sampleRate = flag.Uint64("sample-rate", 10, "keep one in this many lines when the sample saturation policy kicks in")
+
+	errorBudget = flag.Int("error-budget", 0, "malformed lines a connection may send within -error-window, each logged and skipped, before it is closed (0 closes on the first)")
+	errorWindow = flag.Duration("error-window", time.Minute, "window over which -error-budget counts malformed lines")
+	allowCIDRs  = flag.String("allow", "", "comma separated networks (CIDRs or IP addresses) allowed to connect or send datagrams, empty for all")
+	denyCIDRs   = flag.String("deny", "", "comma separated networks (CIDRs or IP addresses) refused, even if -allow includes them")
+	maxPerHost  = flag.Int("max-conns-per-host", 0, "connections one IP address may hold at once across every listener (0 for no limit)")
+	connRate    = flag.Float64("conn-rate-limit", 0, "lines a second each connection may send, and each udp listener may receive (0 for no limit)")
+	globalRate  = flag.Float64("rate-limit", 0, "lines a second every listener together may ingest (0 for no limit)")
+	rateAction  = flag.String("rate-limit-action", "throttle", "what becomes of lines over -conn-rate-limit or -rate-limit: throttle (stop reading until they are within it), drop or disconnect")
+	acceptWait  = flag.Duration("accept-wait", 30*time.Second, "how long a connection over -max-conns waits its turn for a slot under the block -saturation policy before it is answered ERR BUSY and closed (0 to leave it in the kernel's backlog until there is one)")
+	idleTimeout = flag.Duration("idle-timeout", 0, "close connections that send no complete line for this long, freeing their slot for other clients (0 to never)")
+	namePunct   = flag.String("name-punct", "", "punctuation metric names may hold besides letters and digits, like -._:/, replacing each line format's own rules for names (empty keeps them, or is -._ when -name-unicode or -name-max-length replaces them)")
+	nameUnicode = flag.Bool("name-unicode", false, "allow the letters and digits of any script in metric names, replacing each line format's own rules for names")
+	nameMaxLen  = flag.Int("name-max-length", 0, "longest metric name in bytes, replacing each line format's own rules for names (0 keeps them, 64)")
+	batchDelim  = flag.String("batch-delimiter", "", "separator letting a line, or a datagram's, carry several metrics, each line taken whole or rejected whole when one of its metrics is bad, like ; (empty for a metric a line)")
+	maxLine     = flag.Int("max-line-length", server.DefaultMaxLineLength, "longest line in bytes a listener reads, longer lines are discarded, counted and treated as malformed (closing the connection unless -error-budget allows it)")
+
+	storeKind = flag.String("store", "sharded", "store implementation: sharded (mutex per shard) or channel (single goroutine)")
+	shards    = flag.Int("shards", store.DefaultShards, "independently locked shards the sharded store splits the metrics over, more lets more connections update at once")
+	shardHash = flag.String("hash", "fnv", "hash spreading metric names over the store shards: fnv, fnv1 or maphash")
+
+	workers     = flag.Int("workers", 0, "store updates are handed to this many workers, a metric always to the same one, freeing the connections to read on (0 to update on each connection's goroutine)")
+	workerQueue = flag.Int("worker-queue", 1024, "metrics each -workers worker queues before the connections feeding it wait")
+
+	ingressSize     = flag.Int("ingress-size", 0, "metrics the channel store's ingress channel buffers, so a slow flush doesn't hold up every connection at once (0 for unbuffered)")
+	ingressOverflow = flag.String("ingress-overflow", "block", "what the channel store does with a metric once its ingress channel is full: block, drop-newest or drop-oldest (counted in the stats report)")
+
+	maxNames          = flag.Int("max-names", 0, "distinct metric names each window may hold, so a client making up names can't take all the memory (0 for no limit). Hitting it is logged once a window, counted in the stats report and marks the window's emission partial for cardinality")
+	topK              = flag.Int("top-k", 0, "add #top lines naming this many of the window's heaviest metrics to every emission, found in bounded memory with a Space-Saving sketch (0 to disable)")
+	topBy             = flag.String("top-by", "count", "what -top-k ranks the metrics by: count, sum or mean")
+	cardinalityPolicy = flag.String("cardinality-policy", "reject", "what becomes of a metric of a new name once a window holds -max-names: reject (dropped), evict-lru (the name seen least recently is deleted from the window) or overflow (aggregated under the name overflow)")
+
+	metricTTL   = flag.Duration("metric-ttl", 0, "drop a metric not updated for this long from its window's store as the window is flushed, so a -sliding window stops reporting a series gone quiet and memory follows the active series (0 to keep them)")
+	metricFinal = flag.String("metric-ttl-final", "none", "what a metric expiring by -metric-ttl is reported with once more in the window it expires in: none, zero (a last observation of 0) or last (of the value it was last seen at)")
+
+	signKey = flag.String("sign-key", "", "key file used to sign each flush emission (empty to disable)")
+	signAlg = flag.String("sign-alg", "hmac", "flush signing algorithm: hmac or ed25519, signed as Ed25519ph over the SHA-512 of the emission")
+
+	integerNames = flag.String("integer-metrics", "", "comma separated name globs of metrics whose values are exact int64s, values with an i suffix always are")
+	rateNames    = flag.String("rate-metrics", "", "comma separated name globs of metrics whose values are the running totals of counters, reported as the per second rate they grew at since the window before; a counter going down was reset, or wrapped if it was near the 32 or 64 bit limit. The first window of a counter only sets where its rate starts")
+	uniqueNames  = flag.String("unique-metrics", "", "comma separated name globs of metrics whose values, like hashed user ids, are members of a set reported as its approximate distinct count, kept in a HyperLogLog sketch rather than member by member")
+	uniquePrec   = flag.Int("unique-precision", hll.DefaultPrecision, "precision of the -unique-metrics sketches: each takes 2^p bytes and is off by about 1.04/sqrt(2^p), from 4 to 18")
+
+	floatFormat    = flag.String("float-format", "auto", "how the values of the report and the text sinks (streams, graphite, statsd, prometheus) are written: auto (exponent only for very large or small values), fixed (never an exponent) or scientific, always with a '.' decimal point")
+	outputFormat   = flag.String("output-format", "text", "how report rows are written: text (tab separated columns), json (an object per metric with its window's start and end) or csv (the same columns under a header row)")
+	reportOrder    = flag.String("sort", "name", "the order of the report's rows: name, count (most updated first) or mean (highest first), both holding the whole window to sort it")
+	outputTemplate = flag.String("output-template", "", "a text/template each report row is written with, like '{{.Key}} {{format .Mean}} {{.Count}} {{.Start.Unix}}' (see server.ReportRow for the fields)")
+	templateFile   = flag.String("output-template-file", "", "file holding the -output-template")
+	csvDelimiter   = flag.String("csv-delimiter", ",", "the column delimiter of -output-format=csv, a single character or tab")
+	floatPrecision = flag.Int("float-precision", -1, "digits after the decimal point for fixed and scientific, significant digits for auto, -1 for the fewest that are exact")
+
+	percentiles = flag.String("percentiles", "", "comma separated percentiles to report per metric, like 50,95,99, estimated with a t-digest")
+	ewmaPeriods = flag.String("ewma", "", "comma separated periods of exponentially weighted moving averages of each metric's mean to report, like 1m,5m,15m")
+
+	anomalyThreshold = flag.Float64("anomaly-threshold", 0, "flag the windows whose value is this many standard deviations from the metric's trailing baseline, marking them in a last column of the report (0 to disable)")
+	anomalyBaseline  = flag.String("anomaly-baseline", "zscore", "the baseline -anomaly-threshold scores against: zscore (the mean and deviation of the last -anomaly-windows) or ewma (exponentially weighted over as many)")
+	anomalyWindows   = flag.Int("anomaly-windows", 20, "windows the -anomaly-threshold baseline covers, a metric is only flagged once seen in as many")
+
+	producerCounts = flag.String("producers", "none", "count the distinct producers (client identities or addresses) contributing to each window: none, window (a #producers line after the rows) or metric (also a column per metric)")
+
+	serializeErrors = flag.String("serialize-errors", "drop", "what a flush does with a record it can't write, like a name with a tab or invalid UTF-8: drop, sanitize or fail (abandon the rest of the emission)")
+
+	watchdogTimeout = flag.Duration("watchdog", 30*time.Second, "how long the store may take to answer the watchdog's heartbeat before it is reported stuck, with goroutine stacks dumped and /healthz failing (0 to disable)")
+	watchdogExit    = flag.Bool("watchdog-exit", false, "exit when the watchdog finds the store stuck, so a supervisor restarts the pipeline")
+
+	nonFinite = flag.String("non-finite", "reject", "what becomes of NaN and infinite values: reject the metric, clamp infinities to the largest finite value (NaN is still rejected) or accept them")
+	negative  = flag.String("negative", "accept", "what becomes of negative values: accept them, reject the metric or clamp them to 0")
+
+	maxAge  = flag.Duration("max-age", server.DefaultMaxAge, "metrics timestamped longer ago than this are dropped as stale")
+	maxSkew = flag.Duration("max-future-skew", 0, "how far ahead of the collector's clock a metric's timestamp may be, for clients with drifting clocks")
+
+	dedupSize = flag.Int("dedup", 0, "remember this many recent metrics and drop lines repeating one's name, tags, timestamp and value, as retrying clients send (0 to disable)")
+	dedupTTL  = flag.Duration("dedup-ttl", 0, "how long -dedup remembers a metric (0 for the longest -window)")
+
+	sessionTTL = flag.Duration("seq-session-ttl", server.DefaultSessionTTL, "how long the high-water mark of a client numbering its lines with SEQ is kept after its last line, replays are discarded until then (0 to disable SEQ)")
+
+	tenantSeries    = flag.Int("tenant-max-series", 0, "distinct series each tenant may have within -tenant-series-ttl, metrics adding more are refused (0 for no limit)")
+	tenantRate      = flag.Float64("tenant-max-rate", 0, "metrics (for the line formats, lines) per second each tenant may send, more are rejected as busy (0 for no limit)")
+	tenantQuotas    = flag.String("tenant-quotas", "", "comma separated quotas of tenants differing from -tenant-max-series and -tenant-max-rate, like acme:series=5000:rate=1000")
+	tenantSeriesTTL = flag.Duration("tenant-series-ttl", server.DefaultSeriesTTL, "how long a series a tenant stopped sending still counts against -tenant-max-series")
+
+	lateGrace = flag.Duration("late-grace", 0, "place metrics in windows by their own timestamps and keep each window this long after it ends, late metrics amend it and are reported under a #correction line (0 to window by arrival)")
+	walDir    = flag.String("wal", "", "directory of a write-ahead log every metric accepted is written to before it is aggregated, replayed into the windows on startup so a crash loses nothing not yet flushed (empty to disable, tumbling windows only)")
+	walSync   = flag.Duration("wal-sync", time.Second, "how often the write-ahead log is synced to disk, a crash of the machine rather than the process loses up to this much (0 to sync every metric)")
+	sliding   = flag.Int("sliding", 0, "make every -window a sliding window kept as this many sub-buckets and reported as each one ends, rather than a tumbling window reset on every flush (0 for tumbling)")
+
+	warmUpPeriod = flag.Duration("warmup", 0, "after startup, how long flushes are treated as incomplete windows (0 to disable)")
+	warmUpMode   = flag.String("warmup-mode", "suppress", "what happens to flushes during -warmup: suppress (discard them) or mark (write a #partial line first)")
+
+	readStdin = flag.Bool("stdin", false, "read metric lines piped to the standard input like a client's instead of listening, flushing the windows and exiting once it ends")
+
+	replayFile       = flag.String("replay", "", "file of metric lines (- for stdin) to feed through the pipeline instead of listening, reporting the windows and exiting at its end, for backfills and regression tests")
+	replayFormat     = flag.String("replay-format", "tsv", "the format of the -replay lines: tsv, statsd, graphite or influx")
+	replayTimestamps = flag.Bool("replay-timestamps", false, "flush the -replay windows by the metrics' timestamps, each ending on a multiple of its length, rather than once the file is read")
+
+	printVersion    = flag.Bool("version", false, "print the version, commit and build date and exit")
+	preflightOnly   = flag.Bool("preflight", false, "check the configuration, files and ports, then exit without starting")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long connections get to finish sending on SIGTERM or SIGINT before the final flush")
+)
+
+func main() {
+	flag.Var(&listens, "listen", "listener URL such as tcp://:4268?format=tsv&max-conns=10, udp://:8125?format=statsd, stdin://, file:///var/log/app.log to follow a file like tail -F or mqtt://broker:1883?topics=sensors/+/metrics to subscribe to an MQTT broker, may be repeated")
+	flag.Var(&sinks, "sink", "sink each window is flushed to, stdout (the default), stderr, file:///path (rotated with ?max-size=bytes or ?rotate=24h, &gzip=true), tcp://host:port, udp://host:port or unix:///path get the text report, graphite://host:port sends to carbon, influx://host:port?org=o&bucket=b writes to InfluxDB, prometheus://:9102 serves the last window for scraping, remote-write://host:port/api/v1/push pushes it to a Prometheus remote write endpoint, otlp://host:4318 exports it to an OpenTelemetry collector, statsd://host:8125 relays every metric accepted to a statsd daemon, kafka://host:9092/topic publishes it to Kafka, nats://host:4222 to NATS subjects, s3://bucket/prefix archives it to object storage, history:///path keeps it on disk for the admin API's /admin/history (?retention=168h, &rollups=5m:720h,1h:2160h downsamples it past the retention). May be repeated to flush to several")
+	flag.Var(&lengths, "window", "length of the collection window, the collection is flushed to the sinks at the end of each (default 30s). May be repeated or a comma separated list like 1m,5m,1h to track several windows side by side, each emission then starts with a #window line")
+	flag.Parse()
+	build := server.NewBuildInfo(version, commit, date)
+	if *printVersion {
+		fmt.Println("collector", build)
+		return
+	}
+	if err := setupLogging(); err != nil {
+		fatalf("Log: %v", err)
+	}
+
+	var keys *server.Keyring
+	if *encryptKeys != "" {
+		var err error
+		if keys, err = server.LoadKeyring(*encryptKeys); err != nil {
+			fatalf("Encryption: %v", err)
+		}
+	}
+	if *decrypt != "" {
+		if keys == nil {
+			fatalf("Decrypt: -encrypt-keys is required")
+		}
+		var err error
+		if strings.HasSuffix(*decrypt, ".wal") {
+			err = store.DumpSegment(*decrypt, keys, os.Stdout)
+		} else {
+			err = server.DecryptFile(keys, *decrypt, os.Stdout)
+		}
+		if err != nil {
+			fatalf("Decrypt: %v", err)
+		}
+		return
+	}
+
+	if *importMapping != "" {
+		data, err := os.ReadFile(*importMapping)
+		if err != nil {
+			fatalf("Import: %v", err)
+		}
+		rules, err := server.ImportMapping(data)
+		if err != nil {
+			fatalf("Import: %s: %v", *importMapping, err)
+		}
+		fmt.Println(strings.Join(rules, "\n"))
+		return
+	}
+
+	var scrubber server.ScrubRules
+	if *scrubFile != "" {
+		var err error
+		if scrubber, err = server.LoadScrubRules(*scrubFile); err != nil {
+			fatalf("Scrub: %v", err)
+		}
+	}
+
+	// how every listener reads values, what the stores keep and how the
+	// sinks write it
+	var parsing parser.Options
+	var storeOpts store.Options
+	var err error
+	if parsing.Locales, err = parser.ParseLocales(*locales); err != nil {
+		fatalf("Locales: %v", err)
+	}
+
+	reportFormat, err := server.ParseValueFormat(*floatFormat, *floatPrecision)
+	if err != nil {
+		fatalf("Format: %v", err)
+	}
+	output, err := server.ParseOutputFormat(*outputFormat)
+	if err != nil {
+		fatalf("Format: %v", err)
+	}
+	var rowTemplate *template.Template
+	if *outputTemplate != "" || *templateFile != "" {
+		text := *outputTemplate
+		if *templateFile != "" {
+			if text != "" {
+				fatalf("Format: -output-template and -output-template-file both set")
+			}
+			data, err := os.ReadFile(*templateFile)
+			if err != nil {
+				fatalf("Format: %v", err)
+			}
+			text = string(data)
+		}
+		if output != server.OutputText {
+			fatalf("Format: -output-template can't be used with -output-format=%s", output)
+		}
+		if rowTemplate, err = server.NewReportTemplate(text, reportFormat); err != nil {
+			fatalf("Format: %v", err)
+		}
+		output = server.OutputTemplate
+	}
+	order, err := store.ParseOrder(*reportOrder)
+	if err != nil {
+		fatalf("Sort: %v", err)
+	}
+	delimiter, err := server.ParseCSVDelimiter(*csvDelimiter)
+	if err != nil {
+		fatalf("Format: %v", err)
+	}
+
+	if storeOpts.Percentiles, err = store.ParsePercentiles(*percentiles); err != nil {
+		fatalf("Percentiles: %v", err)
+	}
+	producers, err := store.ParseProducerCounts(*producerCounts)
+	if err != nil {
+		fatalf("Producers: %v", err)
+	}
+	storeOpts.TrackProducers = producers != store.NoProducerCounts
+	periods, err := store.ParseEWMAPeriods(*ewmaPeriods)
+	if err != nil {
+		fatalf("EWMA: %v", err)
+	}
+	if parsing.IntegerMetrics, err = parser.ParseIntegerMetrics(*integerNames); err != nil {
+		fatalf("Integer metrics: %v", err)
+	}
+	if parsing.RateMetrics, err = parser.ParseRateMetrics(*rateNames); err != nil {
+		fatalf("Rate metrics: %v", err)
+	}
+	if parsing.UniqueMetrics, err = parser.ParseUniqueMetrics(*uniqueNames); err != nil {
+		fatalf("Unique metrics: %v", err)
+	}
+	store.UniquePrecision = *uniquePrec
+	if store.AnomalyBaseline, err = store.ParseBaseline(*anomalyBaseline); err != nil {
+		fatalf("Anomalies: %v", err)
+	}
+	store.AnomalyThreshold, store.AnomalyWindows = *anomalyThreshold, *anomalyWindows
+
+	var sig server.Signer
+	if *signKey != "" {
+		var err error
+		if sig, err = server.LoadSigner(*signAlg, *signKey); err != nil {
+			fatalf("Signing: %v", err)
+		}
+	}
+
+	if storeOpts.Hash, err = store.ParseHash(*shardHash); err != nil {
+		fatalf("Hash: %v", err)
+	}
+	if storeOpts.IngressOverflow, err = store.ParseOverflow(*ingressOverflow); err != nil {
+		fatalf("Store: %v", err)
+	}
+	storeOpts.IngressSize = *ingressSize
+	cardinality, err := store.ParseCardinalityPolicy(*cardinalityPolicy)
+	if err != nil {
+		fatalf("Store: %v", err)
+	}
+	final, err := store.ParseFinal(*metricFinal)
+	if err != nil {
+		fatalf("Store: %v", err)
+	}
+	storeOpts.Shards = *shards
+
+	// the windows, the report and the server go by one clock
+	clk := clock.Real
+
+	// initialize the main store db, one per window. Every metric goes to
+	// each of them.
+	if len(lengths) == 0 {
+		lengths = windowFlags{30 * time.Second}
+	}
+	var windows []*window
+	var tee store.Tee
+	snapshots := make(map[string]store.Snapshotter)
+	if *sliding < 0 {
+		fatalf("Store: -sliding must be 0 or more")
+	}
+	if *lateGrace < 0 || (*lateGrace > 0 && *sliding > 0) {
+		fatalf("Store: -late-grace must be 0 or more and only applies to tumbling windows")
+	}
+	if *maxNames < 0 || (*maxNames > 0 && (*sliding > 0 || *lateGrace > 0)) {
+		fatalf("Store: -max-names must be 0 or more and only applies to tumbling windows, not -sliding or -late-grace")
+	}
+	if *metricTTL < 0 || (*metricTTL > 0 && *lateGrace > 0) {
+		fatalf("Store: -metric-ttl must be 0 or more and doesn't apply to -late-grace windows")
+	}
+	for _, length := range lengths {
+		var agg store.Aggregator
+		every := length
+		if *sliding > 0 {
+			s := store.NewSliding(length, *sliding, storeOpts)
+			s.SetClock(clk)
+			agg = s
+			every = length / time.Duration(*sliding)
+		} else if *lateGrace > 0 {
+			wm := store.NewWatermarked(length, *lateGrace, storeOpts)
+			wm.SetClock(clk)
+			agg = wm
+		} else if agg, err = store.New(*storeKind, storeOpts); err != nil {
+			fatalf("Store: %v", err)
+		}
+		if s, ok := agg.(store.Snapshotter); ok {
+			snapshots[windowLabel(length)] = s
+		}
+		var expiry *store.Expiry
+		if *metricTTL > 0 {
+			expiry = store.NewExpiry(agg, *metricTTL, final)
+			expiry.SetClock(clk)
+			agg = expiry
+		}
+		var limit *store.Limit
+		if *maxNames > 0 {
+			label := windowLabel(length)
+			limit = store.NewLimit(agg, *maxNames, cardinality)
+			limit.OnHit = func(names int, policy store.CardinalityPolicy) {
+				slog.Warn("Cardinality: the window hit the limit of distinct names", "window", label, "names", names, "policy", policy.String())
+			}
+			agg = limit
+		}
+		windows = append(windows, newWindow(clk.Now(), length, every, agg, periods, len(parsing.RateMetrics) > 0))
+		windows[len(windows)-1].limit = limit
+		windows[len(windows)-1].expiry = expiry
+		tee = append(tee, agg)
+	}
+	windows[0].publish = true
+	var agg store.Aggregator = tee
+	if len(tee) == 1 {
+		agg = tee[0]
+	}
+	// the windows are flushed through the log, each from its own checkpoint
+	var wal *store.WAL
+	if *walDir != "" {
+		if *sliding > 0 || *lateGrace > 0 {
+			fatalf("WAL: -wal only applies to tumbling windows, not -sliding or -late-grace")
+		}
+		// a nil keyring isn't a nil Cipher
+		var walKeys store.Cipher
+		if keys != nil {
+			walKeys = keys
+		}
+		if wal, err = store.OpenWAL(*walDir, *walSync, agg, walKeys); err != nil {
+			fatalf("WAL: %v", err)
+		}
+		for _, w := range windows {
+			w.agg = wal.Window(windowLabel(w.length), w.agg)
+		}
+		n, err := wal.Replay()
+		if err != nil {
+			fatalf("WAL: %v", err)
+		}
+		if n > 0 {
+			slog.Info("WAL: replayed the metrics not flushed before the last exit", "metrics", n)
+		}
+		agg = wal
+	}
+	var pool *store.Pool
+	if *workers > 0 {
+		pool = store.NewPool(agg, *workers, *workerQueue, storeOpts.Hash)
+		agg = pool
+	}
+
+	srv := server.New(agg)
+	srv.Build = build
+	srv.Parsing = parsing
+	srv.Clock = clk
+	srv.Quarantine = server.NewQuarantine(*quarantineFile, keys)
+	if *deadLetters != "" {
+		if srv.DeadLetters, err = server.NewDeadLetters(*deadLetters, keys); err != nil {
+			fatalf("Dead letters: %v", err)
+		}
+	}
+	srv.Scrub = scrubber
+	srv.Normalize = server.NameNormalization{Lower: *nameLower, Separator: *nameSeparator, Tag: *nameTag}
+	if err := srv.Normalize.Check(); err != nil {
+		fatalf("Names: %v", err)
+	}
+	if srv.Attribution, err = server.ParseAttribution(*attribute); err != nil {
+		fatalf("Attribution: %v", err)
+	}
+	if *nameFilter != "" {
+		srv.Filter = server.NewNameFilter()
+		if _, err := srv.Filter.Load(*nameFilter); err != nil {
+			fatalf("Filter: %v", err)
+		}
+	}
+	var gossip *server.Gossip
+	if *clusterPeers != "" {
+		if srv.Cluster, err = server.NewCluster(*clusterSelf, strings.Split(*clusterPeers, ","), *clusterToken); err != nil {
+			fatalf("Cluster: %v", err)
+		}
+	} else if *clusterJoin != "" {
+		// the cluster starts as this collector alone, the others are
+		// gossiped
+		if srv.Cluster, err = server.NewCluster(*clusterSelf, []string{*clusterSelf}, *clusterToken); err != nil {
+			fatalf("Cluster: %v", err)
+		}
+		if gossip, err = server.NewGossip(srv.Cluster, *clusterAddr, strings.Split(*clusterJoin, ","), *clusterToken); err != nil {
+			fatalf("Cluster: %v", err)
+		}
+	}
+	if _, err := loadTokens(srv.Credentials); err != nil {
+		fatalf("Auth: %v", err)
+	}
+	srv.Settings = effectiveSettings()
+	srv.Snapshots = snapshots
+	// a metric deleted and sent again starts its averages afresh
+	srv.Forget = func(pattern string) int {
+		n := 0
+		for _, w := range windows {
+			n = max(n, w.forget(pattern))
+		}
+		return n
+	}
+	srv.SampleRate = *sampleRate
+	srv.MaxAge, srv.MaxSkew = *maxAge, *maxSkew
+	if srv.Values.NonFinite, err = server.ParseValueAction(*nonFinite); err != nil {
+		fatalf("Values: -non-finite %v", err)
+	}
+	if srv.Values.Negative, err = server.ParseValueAction(*negative); err != nil {
+		fatalf("Values: -negative %v", err)
+	}
+	allow, err := server.ParseCIDRs(*allowCIDRs)
+	if err != nil {
+		fatalf("Access: -allow %v", err)
+	}
+	deny, err := server.ParseCIDRs(*denyCIDRs)
+	if err != nil {
+		fatalf("Access: -deny %v", err)
+	}
+	if *globalRate > 0 {
+		srv.RateLimit = server.NewRateLimit(*globalRate)
+	}
+	if len(allow) > 0 || len(deny) > 0 || *maxPerHost > 0 {
+		srv.Access = server.NewAccess(allow, deny, *maxPerHost)
+	}
+	if *dedupSize > 0 {
+		ttl := *dedupTTL
+		if ttl == 0 {
+			for _, length := range lengths {
+				ttl = max(ttl, length)
+			}
+		}
+		srv.Dedup = server.NewDedup(*dedupSize, ttl)
+	}
+	def := server.Quota{Series: *tenantSeries, Rate: *tenantRate}
+	quotas, err := server.ParseQuotas(*tenantQuotas, def)
+	if err != nil {
+		fatalf("Tenants: -tenant-quotas %v", err)
+	}
+	srv.Tenants = server.NewTenantQuotas(def, quotas, *tenantSeriesTTL)
+	if *sessionTTL > 0 {
+		srv.Sessions = server.NewSessions(*sessionTTL)
+	} else {
+		srv.Sessions = nil
+	}
+	// metrics the windows would still take must not be dropped as stale
+	for _, length := range lengths {
+		if *lateGrace > 0 && srv.MaxAge < length+*lateGrace {
+			srv.MaxAge = length + *lateGrace
+		}
+	}
+
+	// establish the listeners, any number of them can run side by side and
+	// each gets its own connection limit
+	configs, err := listenerConfigs()
+	if err != nil {
+		fatalf("Listen: %v", err)
+	}
+	if len(configs) == 0 && *replayFile == "" {
+		fatalf("Listen: no listeners configured")
+	}
+	// a replay reads its file rather than listening
+	if *replayFile != "" {
+		configs = nil
+	}
+	if problems := preflight(configs); len(problems) > 0 {
+		for _, p := range problems {
+			slog.Error("Preflight: " + p)
+		}
+		fatalf("Preflight: %d problems, not starting", len(problems))
+	}
+	if *preflightOnly {
+		slog.Info("Preflight: ok")
+		return
+	}
+	for _, cfg := range configs {
+		if err := srv.Listen(cfg); err != nil {
+			fatalf("Listen: %s: %v", cfg, err)
+		}
+	}
+	defer srv.Close()
+	server.CloseUnusedSockets()
+
+	// the first windows after startup are incomplete
+	warmUp, err := server.NewWarmUp(*warmUpPeriod, *warmUpMode)
+	if err != nil {
+		fatalf("Warm-up: %v", err)
+	}
+
+	serializePolicy, err := server.ParseSerializePolicy(*serializeErrors)
+	if err != nil {
+		fatalf("Serialization: %v", err)
+	}
+	serializer := &server.Serializer{Policy: serializePolicy}
+
+	// streaming subscribers receive a copy of every flushed collection
+	subscribers := server.NewBroadcaster()
+	srv.Subscribers = subscribers
+	srv.Telemetry = *telemetry
+	srv.ReservedPrefix = *reservedPrefix
+
+	// the stdout report unless other sinks are configured
+	if len(sinks) == 0 {
+		sinks = sinkFlags{"stdout"}
+	}
+	var streams sink.Streams
+	var relays []sink.Relayer
+	fanout := &sink.Fanout{}
+	// every stream opened starts with the CSV report's columns
+	var header bytes.Buffer
+	if output == server.OutputCSV {
+		columns := csv.NewWriter(&header)
+		columns.Comma = delimiter
+		columns.Write(server.CSVHeader(storeOpts.Percentiles, periods, producers == store.MetricProducerCounts))
+		columns.Flush()
+	}
+	for _, spec := range sinks {
+		s, err := sink.Open(spec, sink.Options{FormatFloat: reportFormat.Format, Percentiles: storeOpts.Percentiles})
+		if err != nil {
+			fatalf("Sink: %v", err)
+		}
+		if stream, ok := s.(*sink.Stream); ok {
+			stream.Header = header.Bytes()
+			streams = append(streams, stream)
+		} else {
+			fanout.Add(spec, s)
+		}
+		if r, ok := s.(sink.Relayer); ok {
+			relays = append(relays, r)
+		}
+		if h, ok := s.(*sink.History); ok {
+			srv.History = h
+		}
+	}
+	if *topK > 0 {
+		by, err := topk.ParseBy(*topBy)
+		if err != nil {
+			fatalf("Top-K: %v", err)
+		}
+		// ten times the keys shown keeps the ranking accurate
+		for _, w := range windows {
+			w.top = topk.New(*topK*10, by)
+			relays = append(relays, w)
+		}
+	}
+	var replicator *server.Replicator
+	if *replicate != "" {
+		replicator = server.NewReplicator(*replicate, *replicateBacklog, *replicateToken)
+		relays = append(relays, replicator)
+	}
+	var standby *server.Standby
+	if *standbyAddr != "" {
+		// the primary's metrics were accepted there, they go straight to
+		// the windows
+		standby = server.NewStandby(*standbyTakeover, *replicateToken, func(m parser.Metric) {
+			srv.Store.Update(m)
+			if srv.Relay != nil {
+				srv.Relay(m)
+			}
+		})
+		if err := standby.Listen(*standbyAddr); err != nil {
+			fatalf("Standby: %v", err)
+		}
+		defer standby.Close()
+	}
+	if len(relays) > 0 {
+		srv.Relay = func(m parser.Metric) {
+			for _, r := range relays {
+				r.Relay(m)
+			}
+		}
+	}
+
+	// cancelled as the collector stops, everything it started winds down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flushCtx, cancelFlushes := context.WithCancel(ctx)
+	defer cancelFlushes()
+
+	rep := &reporter{
+		srv:         srv,
+		format:      reportFormat,
+		output:      output,
+		order:       order,
+		template:    rowTemplate,
+		delimiter:   delimiter,
+		percentiles: storeOpts.Percentiles,
+		ewmaColumns: len(periods),
+		serializer:  serializer,
+		sig:         sig,
+		warmUp:      warmUp,
+		standby:     standby,
+		subscribers: subscribers,
+		labels:      len(windows) > 1,
+		producers:   producers,
+		pool:        pool,
+		streams:     streams,
+		sinks:       fanout,
+		clock:       clk,
+		ctx:         flushCtx,
+	}
+	// flushed the windows for the last time, the sinks are done
+	closeSinks := func() {
+		if err := wal.Close(); err != nil {
+			slog.Error("WAL: close failed", "err", err)
+		}
+		for _, s := range streams {
+			s.Close()
+		}
+		if err := fanout.Close(); err != nil {
+			slog.Error("Sink: close failed", "err", err)
+		}
+	}
+
+	if *replayFile != "" {
+		// the warm-up goes by the wall clock, not the file's
+		rep.warmUp = nil
+		parse, _ := parser.Format(*replayFormat, parsing)
+		counts, err := replay(*replayFile, parse, srv, rep, windows, *replayTimestamps)
+		closeSinks()
+		slog.Info("Replay: done", "lines", counts.lines, "accepted", counts.accepted, "rejected", counts.rejected)
+		if err != nil {
+			fatalf("Replay: %v", err)
+		}
+		return
+	}
+
+	// report stats every 10 seconds and flush each window on its own ticker.
+	// SIGUSR1 flushes every window and reports now, SIGUSR2 only reports,
+	// the next report then covers the time since.
+	tickCtx, stopTickers := context.WithCancel(ctx)
+	flushc, dumpc := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	notifyOnDemand(flushc, dumpc)
+	var tickers sync.WaitGroup
+	tickers.Add(1)
+	go func() {
+		defer tickers.Done()
+		tickerRaw := clk.NewTicker(time.Second * 10)
+		for {
+			select {
+			case <-tickCtx.Done():
+				return
+			case <-flushc:
+				slog.Info("Signal: flushing every window now")
+				for _, w := range windows {
+					rep.flush(w, "signal")
+				}
+			case <-dumpc:
+			case <-tickerRaw.C:
+				srv.RecordTelemetry()
+			}
+			srv.Report(os.Stderr)
+			serializer.Report(os.Stderr)
+			fanout.Report(os.Stderr)
+			wal.Report(os.Stderr)
+			replicator.Report(os.Stderr)
+			gossip.Report(os.Stderr)
+			standby.Report(os.Stderr)
+			for _, w := range windows {
+				w.limit.Report(os.Stderr, windowLabel(w.length))
+				w.expiry.Report(os.Stderr, windowLabel(w.length))
+			}
+			if n, dropped, disconnects := subscribers.Lag(); n > 0 || disconnects > 0 {
+				fmt.Fprintf(os.Stderr, "(10 sec): Subscribers %d, dropped flushes %d, disconnected %d\n", n, dropped, disconnects)
+			}
+		}
+	}()
+	for _, w := range windows {
+		tickers.Add(1)
+		go func(w *window) {
+			defer tickers.Done()
+			// flushes show up in CPU profiles under their window
+			pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("stage", "flush", "window", windowLabel(w.length))))
+			tickerCollection := clk.NewTicker(w.every)
+			for {
+				select {
+				case <-tickCtx.Done():
+					return
+				case <-tickerCollection.C:
+					rep.flush(w)
+				}
+			}
+		}(w)
+	}
+
+	// make sure the store keeps taking metrics
+	var watchdog *server.Watchdog
+	if *watchdogTimeout > 0 {
+		watchdog = server.NewWatchdog(agg, *watchdogTimeout)
+		if *watchdogExit {
+			watchdog.OnStuck = func() {
+				fatalf("Watchdog: exiting so the pipeline is restarted")
+			}
+		}
+		go watchdog.Run(tickCtx.Done())
+	}
+
+	// the admin and ingest HTTP APIs, when configured
+	shutdownHTTP := serveHTTP(srv, watchdog)
+
+	// the text admin commands, when configured
+	var consoleListener net.Listener
+	if *consoleAddr != "" {
+		console := server.NewConsole(srv)
+		console.Flush = func() {
+			slog.Info("Console: flushing every window now")
+			for _, w := range windows {
+				rep.flush(w, "admin")
+			}
+		}
+		if consoleListener, err = net.Listen("tcp", *consoleAddr); err != nil {
+			fatalf("Console: %v", err)
+		}
+		go func() {
+			if err := console.Serve(consoleListener); err != nil {
+				fatalf("Console: %v", err)
+			}
+		}()
+	}
+
+	// cancelled once the connections had their time to drain, closing
+	// those still open
+	serveCtx, stopServing := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ServeContext(serveCtx)
+	}()
+
+	// SIGHUP reloads the tokens and the name filter, a bad file keeps what
+	// was loaded before
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	go func() {
+		for range hupc {
+			if n, err := loadTokens(srv.Credentials); err != nil {
+				slog.Error("Auth: reload failed, keeping the tokens loaded before", "err", err)
+			} else {
+				slog.Info("Auth: reloaded the tokens", "tokens", n)
+			}
+			if srv.Filter == nil {
+				continue
+			}
+			if n, err := srv.Filter.Load(*nameFilter); err != nil {
+				slog.Error("Filter: reload failed, keeping the rules loaded before", "err", err)
+			} else {
+				slog.Info("Filter: reloaded the rules", "rules", n)
+			}
+		}
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, server.ErrInputEnded) {
+			fatalf("Serve: %v", err)
+		}
+		slog.Info("Shutdown: " + err.Error())
+	case s := <-sigc:
+		slog.Info("Shutdown: draining connections", "signal", s.String())
+	}
+
+	// stop accepting, give the clients time to finish, then flush whatever
+	// the current windows have collected so it isn't lost
+	srv.Close()
+	if consoleListener != nil {
+		consoleListener.Close()
+	}
+	httpCtx, cancelHTTP := context.WithTimeout(ctx, *shutdownTimeout)
+	httpDone := make(chan struct{})
+	go func() {
+		shutdownHTTP(httpCtx)
+		close(httpDone)
+	}()
+	partial := []string{"shutdown"}
+	if n := srv.Drain(*shutdownTimeout); n > 0 {
+		slog.Warn("Shutdown: closed the connections still open", "connections", n, "after", *shutdownTimeout)
+		partial = append(partial, "drain")
+	}
+	stopServing()
+	replicator.Close()
+	gossip.Close()
+	srv.DeadLetters.Close()
+	if err := srv.Cluster.Close(); err != nil {
+		slog.Warn("Shutdown: metrics still queued for the cluster's peers were lost", "err", err)
+	}
+	<-httpDone
+	cancelHTTP()
+	stopTickers()
+	tickers.Wait()
+	pool.Sync()
+	// the sinks get as long again for the last flush before their
+	// requests are cancelled
+	time.AfterFunc(*shutdownTimeout, cancelFlushes)
+	for _, w := range windows {
+		if wm, ok := w.agg.(*store.Watermarked); ok {
+			wm.Seal()
+		}
+		rep.flush(w, partial...)
+	}
+	closeSinks()
+	slog.Info("Shutdown: complete")
+	closeLogging()
+}
+
+// Returns the address of the listener of the metrics forwarded by the
+// cluster's peers, empty when there is no cluster
+func clusterListen() string {
+	if *clusterPeers == "" && *clusterJoin == "" {
+		return ""
+	}
+	return *clusterAddr
+}
+
+// Returns the defaults every listener starts from
+func defaultListenerConfig(network, address string) server.ListenerConfig {
+	policy, _ := server.ParseSaturationPolicy(*saturation)
+	action, _ := server.ParseRateAction(*rateAction)
+	return server.ListenerConfig{
+		Network:       network,
+		Address:       address,
+		Format:        "tsv",
+		MaxConns:      *maxConns,
+		Saturation:    policy,
+		ProxyProtocol: *proxyProto,
+		ReusePort:     *reusePort,
+		ErrorBudget:   *errorBudget,
+		ErrorWindow:   *errorWindow,
+		MaxLineLength: *maxLine,
+		IdleTimeout:   *idleTimeout,
+		AcceptWait:    *acceptWait,
+		Names:         parser.NamePolicy{Punct: *namePunct, Unicode: *nameUnicode, MaxLength: *nameMaxLen},
+		Batch:         *batchDelim,
+		RequireAuth:   *requireAuth,
+		RateLimit:     *connRate,
+		RateAction:    action,
+	}
+}
+
+// Loads the tokens of the -auth-tokens file and the COLLECTOR_AUTH_TOKENS
+// environment variable, returning how many there are
+func loadTokens(creds *server.Credentials) (int, error) {
+	tokens, err := server.ParseTokens(os.Getenv("COLLECTOR_AUTH_TOKENS"))
+	if err != nil {
+		return 0, fmt.Errorf("COLLECTOR_AUTH_TOKENS: %v", err)
+	}
+	if *authTokens != "" {
+		data, err := os.ReadFile(*authTokens)
+		if err != nil {
+			return 0, err
+		}
+		fromFile, err := server.ParseTokens(string(data))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", *authTokens, err)
+		}
+		maps.Copy(tokens, fromFile)
+	}
+	creds.SetStatic(tokens)
+	return len(tokens), nil
+}
+
+// listenFlags collects the repeatable -listen flag
+type listenFlags []string
+
+func (f *listenFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listenFlags) Redacted() string {
+	return redactURLs(*f)
+}
+
+func (f *listenFlags) Set(spec string) error {
+	*f = append(*f, spec)
+	return nil
+}
+
+// sinkFlags collects the repeatable -sink flag
+type sinkFlags []string
+
+func (f *sinkFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *sinkFlags) Redacted() string {
+	return redactURLs(*f)
+}
+
+func (f *sinkFlags) Set(spec string) error {
+	*f = append(*f, spec)
+	return nil
+}
+
+// Builds the listener configs from every -listen flag plus the older single
+// purpose address flags. The default -addr listener is only opened when no
+// -listen flags are given or -addr is set explicitly.
+func listenerConfigs() ([]server.ListenerConfig, error) {
+	// the standard input takes the place of every listener, it is never
+	// idle or proxied
+	if *readStdin {
+		cfg := defaultListenerConfig("stdin", "")
+		cfg.ProxyProtocol, cfg.ReusePort, cfg.IdleTimeout = false, 1, 0
+		return []server.ListenerConfig{cfg}, nil
+	}
+	var configs []server.ListenerConfig
+	for _, spec := range listens {
+		cfg, err := server.ParseListenerConfig(spec, defaultListenerConfig("", ""))
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, cfg)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	legacy := func(network, address, format string) server.ListenerConfig {
+		cfg := defaultListenerConfig(network, address)
+		cfg.Format = format
+		return cfg
+	}
+	var legacyConfigs []server.ListenerConfig
+	if *addr != "" && (len(listens) == 0 || set["addr"]) {
+		legacyConfigs = append(legacyConfigs, legacy("tcp", *addr, "tsv"))
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		cfg := legacy("tls", *tlsAddr, "tsv")
+		cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile = *tlsCert, *tlsKey, *tlsCA
+		legacyConfigs = append(legacyConfigs, cfg)
+	}
+	for _, l := range []struct {
+		network, address, format string
+	}{
+		{"tcp", *statsdAddr, "statsd"},
+		{"udp", *statsdUDPAddr, "statsd"},
+		{"tcp", *graphiteAddr, "graphite"},
+		{"tcp", *influxAddr, "influx"},
+		{"tcp", *protobufAddr, "protobuf"},
+		{"tcp", clusterListen(), "peer"},
+	} {
+		if l.address != "" {
+			cfg := legacy(l.network, l.address, l.format)
+			if l.network == "udp" {
+				cfg.ProxyProtocol = false
+			}
+			// the peers connect directly, with the cluster token if any
+			if l.format == "peer" {
+				cfg.ProxyProtocol, cfg.RequireAuth = false, *clusterToken != ""
+			}
+			legacyConfigs = append(legacyConfigs, cfg)
+		}
+	}
+	for _, cfg := range legacyConfigs {
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return append(configs, legacyConfigs...), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/hll"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/server"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+	"github.com/jeffdupont/go-challenge/pkg/topk"
+)
+
+// preflight checks what would otherwise only go wrong once the collector is
+// running: flag combinations that can't work, files it will need to write
+// and HTTP ports that are taken. Every problem is returned, not just the
+// first, each saying which flag to change.
+func preflight(configs []server.ListenerConfig) []string {
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// config consistency
+	if *maxAge <= 0 {
+		add("-max-age %v must be positive or every metric is stale", *maxAge)
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"max-future-skew", *maxSkew},
+		{"warmup", *warmUpPeriod},
+		{"shutdown-timeout", *shutdownTimeout},
+		{"watchdog", *watchdogTimeout},
+		{"dedup-ttl", *dedupTTL},
+		{"seq-session-ttl", *sessionTTL},
+		{"idle-timeout", *idleTimeout},
+		{"accept-wait", *acceptWait},
+		{"tenant-series-ttl", *tenantSeriesTTL},
+	} {
+		if d.value < 0 {
+			add("-%s %v must not be negative", d.name, d.value)
+		}
+	}
+	if *telemetry && *reservedPrefix == "" {
+		add("-telemetry needs a -reserved-prefix, or clients could write over the collector's own metrics")
+	}
+	if *watchdogExit && *watchdogTimeout == 0 {
+		add("-watchdog-exit needs the watchdog, set -watchdog above 0")
+	}
+	if *profiling && *debugAddr == "" {
+		add("-pprof serves the profiles on the debug listener, set -debug-addr")
+	}
+	if *maxConns < 1 {
+		add("-max-conns %d must be at least 1", *maxConns)
+	}
+	if *maxPerHost < 0 {
+		add("-max-conns-per-host %d must not be negative", *maxPerHost)
+	}
+	if *tenantSeries < 0 || *tenantRate < 0 {
+		add("-tenant-max-series %d and -tenant-max-rate %v must not be negative", *tenantSeries, *tenantRate)
+	}
+	if *connRate < 0 || *globalRate < 0 {
+		add("-conn-rate-limit %v and -rate-limit %v must not be negative", *connRate, *globalRate)
+	}
+	if _, err := server.ParseRateAction(*rateAction); err != nil {
+		add("-rate-limit-action: %v", err)
+	}
+	if err := (server.NameNormalization{Separator: *nameSeparator, Tag: *nameTag}).Check(); err != nil {
+		add("-name-separator or -name-original-tag: %v", err)
+	}
+	if _, err := server.ParseAttribution(*attribute); err != nil {
+		add("-attribute: %v", err)
+	}
+	if *errorBudget < 0 {
+		add("-error-budget %d must not be negative", *errorBudget)
+	}
+	if *maxLine < 1 {
+		add("-max-line-length %d must be at least 1", *maxLine)
+	}
+	if *errorWindow <= 0 {
+		add("-error-window %v must be positive", *errorWindow)
+	}
+	if *shards < 1 {
+		add("-shards %d must be at least 1", *shards)
+	}
+	if *workers < 0 || *workerQueue < 0 {
+		add("-workers %d and -worker-queue %d must not be negative", *workers, *workerQueue)
+	}
+	if *ingressSize < 0 {
+		add("-ingress-size %d must not be negative", *ingressSize)
+	}
+	if *ingressOverflow != "block" && *ingressSize <= 0 {
+		add("-ingress-overflow %s needs a buffered channel, set -ingress-size above 0", *ingressOverflow)
+	}
+	if *uniquePrec < hll.MinPrecision || *uniquePrec > hll.MaxPrecision {
+		add("-unique-precision %d must be from %d to %d", *uniquePrec, hll.MinPrecision, hll.MaxPrecision)
+	}
+	if *anomalyThreshold < 0 || *anomalyWindows < 2 {
+		add("-anomaly-threshold %v must not be negative and -anomaly-windows %d must be at least 2", *anomalyThreshold, *anomalyWindows)
+	}
+	if _, err := store.ParseBaseline(*anomalyBaseline); err != nil {
+		add("-anomaly-baseline: %v", err)
+	}
+	if *topK < 0 {
+		add("-top-k %d must not be negative", *topK)
+	}
+	if _, err := topk.ParseBy(*topBy); err != nil {
+		add("-top-by: %v", err)
+	}
+	if *metricTTL < 0 {
+		add("-metric-ttl %s must not be negative", *metricTTL)
+	}
+	if _, err := store.ParseFinal(*metricFinal); err != nil {
+		add("-metric-ttl-final: %v", err)
+	}
+	if *clusterPeers != "" && !slices.Contains(strings.Split(*clusterPeers, ","), *clusterSelf) {
+		add("-cluster-self %q must be one of the -cluster-peers", *clusterSelf)
+	}
+	if *clusterJoin != "" && (*clusterPeers != "" || *clusterSelf == "") {
+		add("-cluster-join wants a -cluster-self and no -cluster-peers")
+	}
+	if *replicateBacklog < 1 || *standbyTakeover <= 0 {
+		add("-replicate-backlog %d and -standby-takeover %s must be positive", *replicateBacklog, *standbyTakeover)
+	}
+	if *dedupSize < 0 {
+		add("-dedup %d must not be negative", *dedupSize)
+	}
+	if *sampleRate == 0 {
+		add("-sample-rate must be at least 1")
+	}
+	if *replayFile != "" && *readStdin {
+		add("-replay and -stdin both take the place of the listeners, give one")
+	}
+	if *replayFile != "" {
+		if _, ok := parser.Formats[*replayFormat]; !ok {
+			add("-replay-format %q is unknown, want tsv, statsd, graphite or influx", *replayFormat)
+		}
+		if *replayFile != "-" {
+			if f, err := os.Open(*replayFile); err != nil {
+				add("-replay %s can't be read: %v", *replayFile, err)
+			} else {
+				f.Close()
+			}
+		}
+	}
+	seen := make(map[time.Duration]bool)
+	for _, length := range lengths {
+		if seen[length] {
+			add("-window %s is given twice", windowLabel(length))
+		}
+		seen[length] = true
+		if *sliding > 0 && length < time.Duration(*sliding)*time.Millisecond {
+			add("-window %s is too short for %d -sliding sub-buckets, each must be at least 1ms", windowLabel(length), *sliding)
+		}
+	}
+
+	// two listeners can't share an address
+	bound := make(map[string]bool)
+	for _, cfg := range configs {
+		network := cfg.Network
+		if network == "tls" {
+			network = "tcp"
+		}
+		if bound[network+" "+cfg.Address] {
+			add("%s is configured twice, give each listener its own address", cfg)
+		}
+		bound[network+" "+cfg.Address] = true
+	}
+
+	// the HTTP servers and the console only bind once everything else has
+	// started
+	for _, h := range []struct{ flag, address string }{{"admin-addr", *adminAddr}, {"http-addr", *httpAddr}, {"console-addr", *consoleAddr}, {"debug-addr", *debugAddr}} {
+		if h.address == "" {
+			continue
+		}
+		if bound["tcp "+h.address] {
+			add("-%s %s is also a metrics listener", h.flag, h.address)
+			continue
+		}
+		bound["tcp "+h.address] = true
+		if err := checkPort(h.address); err != nil {
+			add("-%s %s can't be bound: %v", h.flag, h.address, err)
+		}
+	}
+
+	// producers can only be quarantined through the admin API, the capture
+	// file is written from then on
+	if *adminAddr != "" {
+		if err := checkWritable(*quarantineFile); err != nil {
+			add("-quarantine-file %s is not writable: %v", *quarantineFile, err)
+		}
+	}
+	if *deadLetters != "" && !strings.Contains(*deadLetters, "://") {
+		if err := checkWritable(*deadLetters); err != nil {
+			add("-dead-letters %s is not writable: %v", *deadLetters, err)
+		}
+	}
+	return problems
+}
+
+// Binds the address and lets it go again
+func checkPort(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// Opens the file for appending, creating it if need be, and removes it
+// again if it wasn't there before
+func checkWritable(path string) error {
+	_, err := os.Stat(path)
+	existed := !errors.Is(err, fs.ErrNotExist)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if !existed {
+		os.Remove(path)
+	}
+	return nil
+}
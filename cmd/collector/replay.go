@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/server"
+)
+
+// replayCounts tallies the lines of a replay
+type replayCounts struct {
+	lines, accepted, rejected int
+}
+
+// Feeds the metric lines of the file, - for stdin, through the server as
+// if a client sent them, then flushes every window once more for what is
+// left, marked partial for replay. A file that can't be read to its end is
+// reported up to the error.
+//
+// The timestamps are checked against the latest one read rather than the
+// wall clock, so a backfill isn't dropped as stale. By arrival, the windows
+// are only flushed at the end. By timestamp, each window is flushed as the
+// file's time passes its end, the windows ending on multiples of their
+// length; metrics older than the window being filled go into it, and
+// windows nothing fell into are skipped.
+func replay(path string, parse parser.Func, srv *server.Server, rep *reporter, windows []*window, byTime bool) (replayCounts, error) {
+	var counts replayCounts
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return counts, err
+		}
+		defer f.Close()
+		in = f
+	}
+	var latest, at time.Time
+	srv.Clock = clock.Func(func() time.Time { return latest })
+	if byTime {
+		rep.clock = clock.Func(func() time.Time { return at })
+	}
+	// the end of the window each is filling, by timestamp
+	ends := make([]time.Time, len(windows))
+
+	lines := bufio.NewScanner(in)
+	lines.Buffer(nil, *maxLine)
+	for lines.Scan() {
+		counts.lines++
+		line := strings.TrimRight(lines.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		metrics, err := parse(line)
+		if err != nil {
+			slog.Warn("line rejected", "path", path, "line", counts.lines, "err", err)
+			counts.rejected++
+			continue
+		}
+		for i := range metrics {
+			m := &metrics[i]
+			if m.Time.After(latest) {
+				latest = m.Time
+			}
+			for j, w := range windows {
+				if byTime && ends[j].IsZero() {
+					ends[j] = latest.Truncate(w.every).Add(w.every)
+					w.lastFlush, w.full = ends[j].Add(-w.every), ends[j].Add(w.length-w.every)
+				} else if byTime && !latest.Before(ends[j]) {
+					at = ends[j]
+					rep.flush(w)
+					ends[j] = latest.Truncate(w.every).Add(w.every)
+				}
+			}
+			if err := srv.Ingest(m, "replay"); err != nil {
+				counts.rejected++
+				continue
+			}
+			counts.accepted++
+		}
+	}
+	// what was read before an error is still reported
+	err := lines.Err()
+	if err != nil {
+		err = fmt.Errorf("%s:%d: %v", path, counts.lines+1, err)
+	}
+	for j, w := range windows {
+		if at = ends[j]; at.IsZero() {
+			at = time.Now()
+		}
+		rep.flush(w, "replay")
+	}
+	return counts, err
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// There are no user signals, windows are only flushed on their tickers
+func notifyOnDemand(flush, dump chan<- os.Signal) {}
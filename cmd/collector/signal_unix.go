@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Relays SIGUSR1, flushing every window now, and SIGUSR2, dumping the
+// counters now
+func notifyOnDemand(flush, dump chan<- os.Signal) {
+	signal.Notify(flush, syscall.SIGUSR1)
+	signal.Notify(dump, syscall.SIGUSR2)
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// syslog is only there on unix
+func dialSyslog(network, addr string) (interface {
+	leveledWriter
+	io.Closer
+}, error) {
+	return nil, errors.New("syslog is not available on this system")
+}
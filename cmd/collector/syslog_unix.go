@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+// syslogWriter writes records to syslog at the severity of their level
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+// Dials the syslog daemon at the address, the local one when network is
+// empty
+func dialSyslog(network, addr string) (syslogWriter, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, "collector")
+	return syslogWriter{w}, err
+}
+
+func (w syslogWriter) WriteLevel(level slog.Level, msg string) error {
+	switch syslogSeverity(level) {
+	case 3:
+		return w.Err(msg)
+	case 4:
+		return w.Warning(msg)
+	case 6:
+		return w.Info(msg)
+	}
+	return w.Debug(msg)
+}
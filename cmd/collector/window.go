@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/server"
+	"github.com/jeffdupont/go-challenge/pkg/sink"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+	"github.com/jeffdupont/go-challenge/pkg/topk"
+)
+
+// windowFlags collects the repeatable -window flag, each value may also be a
+// comma separated list
+type windowFlags []time.Duration
+
+func (f *windowFlags) String() string {
+	labels := make([]string, len(*f))
+	for i, d := range *f {
+		labels[i] = windowLabel(d)
+	}
+	return strings.Join(labels, ",")
+}
+
+func (f *windowFlags) Set(list string) error {
+	for _, s := range strings.Split(list, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s: want a positive duration", s)
+		}
+		*f = append(*f, d)
+	}
+	return nil
+}
+
+// Writes a window length the way people do, 1m rather than 1m0s
+func windowLabel(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// window is one aggregation window. Each has its own store, fed every
+// metric, and is flushed on its own ticker. A tumbling window is flushed
+// once per length, a sliding one as each of its sub-buckets ends.
+type window struct {
+	length time.Duration
+	every  time.Duration
+	agg    store.Aggregator
+	ewma   *store.EWMA
+	// the baselines of -anomaly-threshold, nil when off
+	anomalies *store.Anomalies
+	// the last values of the -rate-metrics counters, nil when none
+	rates *store.Rates
+	// holds the window to -max-names, nil for no limit
+	limit *store.Limit
+	// drops the metrics unseen for -metric-ttl, nil to keep them
+	expiry *store.Expiry
+	// the heaviest metrics of the window for -top-k, nil when off
+	topMu sync.Mutex
+	top   *topk.Sketch
+	// only the first window is published to the streaming subscribers
+	publish bool
+
+	lastFlush time.Time
+	// the first flush of a tumbling window, or any before a sliding window
+	// has been running for its length, only covers part of it
+	first bool
+	full  time.Time
+	// the server's shed count at the last flush
+	shedAt uint64
+	// why it was flushed on demand since its last tick, signal or admin;
+	// the next flush only covers the rest of the window
+	cut string
+}
+
+// Returns a window whose first flush is due every after now, keeping the
+// rates of the -rate-metrics when there are any
+func newWindow(now time.Time, length, every time.Duration, agg store.Aggregator, periods []time.Duration, rates bool) *window {
+	w := &window{length: length, every: every, agg: agg, lastFlush: now, first: true, full: now.Add(length)}
+	if len(periods) > 0 {
+		w.ewma = store.NewEWMA(periods)
+	}
+	w.anomalies = store.NewAnomalies(every)
+	if rates {
+		w.rates = store.NewRates(every)
+	}
+	return w
+}
+
+// Forgets the averages, baselines and rates kept of the metrics matching
+// the pattern, returning how many metrics the most of them was kept for
+func (w *window) forget(pattern string) int {
+	return max(w.ewma.Forget(pattern), w.anomalies.Forget(pattern), w.rates.Forget(pattern))
+}
+
+// Relay adds the metric the store accepted to the window's top-K sketch
+func (w *window) Relay(m parser.Metric) {
+	w.topMu.Lock()
+	w.top.Add(m.Key(), uint64(max(m.Count, 1)), m.Value)
+	w.topMu.Unlock()
+}
+
+// Returns the heaviest metrics of the window and starts counting afresh,
+// none without a sketch
+func (w *window) takeTop() []topk.Entry {
+	if w.top == nil {
+		return nil
+	}
+	w.topMu.Lock()
+	defer w.topMu.Unlock()
+	top := w.top.Top(*topK)
+	w.top.Reset()
+	return top
+}
+
+// reporter writes the flushes of every window to the sinks, one at a time
+// so the emissions of windows ending together don't interleave
+type reporter struct {
+	mu     sync.Mutex
+	srv    *server.Server
+	format server.ValueFormat
+	output server.OutputFormat
+	order  store.Order
+	// the number of the last flush
+	seq uint64
+	// the time flushes are stamped with, the file's during a replay
+	clock clock.Clock
+	// handed to the sinks with every window, cancelling their requests
+	// once the last flush at shutdown runs out of time
+	ctx context.Context
+	// the rows of -output-template
+	template *template.Template
+	// the -percentiles of the rows
+	percentiles []float64
+	// the CSV report's delimiter and number of EWMA columns
+	delimiter   rune
+	ewmaColumns int
+	serializer  *server.Serializer
+	sig         server.Signer
+	warmUp      *server.WarmUp
+	// the primary reports the windows while this is its standby
+	standby     *server.Standby
+	subscribers *server.Broadcaster
+	// start each emission with a #window line, only done when there are
+	// several windows
+	labels bool
+	// end the rows with a #producers line, and with metric also add a
+	// column counting each metric's producers
+	producers store.ProducerCounts
+	// the workers updating the windows, nil when the connections do
+	pool *store.Pool
+
+	// the text report is written to the streams, the aggregates handed to
+	// the other sinks
+	streams sink.Streams
+	sinks   *sink.Fanout
+}
+
+// Flushes the window to the sinks, the streams getting the text report.
+//
+// The text report's columns are name, value, min, max, sum, count and
+// standard deviation, then one per -percentiles, one per -ewma period,
+// with -producers=metric the producer count and with -anomaly-threshold
+// anomaly=<score> or -. The value is the mean unless
+// the metric has a type saying otherwise, see parser.Type. -output-template
+// writes each row with a text/template instead.
+//
+// the collection is streamed out in name order a chunk at a time so a
+// long window with millions of series is never copied out whole, -sort
+// by count or mean holds it to sort it first. Corrections stay in name
+// order.
+//
+// every emission starts with a #flush line of its number, counting up from
+// 1 as the collector runs, and the window's start and end.
+//
+// an emission covering an incomplete window has a #partial line next
+// listing why, reasons are added to those passed in. A flush on SIGUSR1 is
+// partial for signal, one asked for on the console for admin, and so is the
+// window's next flush. With
+// -output-format=json or csv the rows carry the window instead, see
+// server.ReportRow.
+func (r *reporter) flush(w *window, partial ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// a panic loses this emission but not the next
+	defer r.srv.Isolate("flush of the "+windowLabel(w.length)+" window", nil)
+
+	started := time.Now()
+	// the updates the workers still hold belong in this window
+	r.pool.Sync()
+	now := r.clock.Now()
+	top := w.takeTop()
+	last := w.lastFlush
+	elapsed := now.Sub(last)
+	w.lastFlush = now
+	if w.first || (w.every < w.length && now.Before(w.full)) {
+		partial = append(partial, "startup")
+		w.first = false
+	}
+	cut := w.cut
+	w.cut = ""
+	for _, reason := range []string{"signal", "admin"} {
+		if slices.Contains(partial, reason) {
+			w.cut = reason
+		}
+	}
+	if cut != "" && w.cut == "" {
+		partial = append(partial, cut)
+	}
+	if shed := r.srv.Shed(); shed > w.shedAt {
+		partial = append(partial, "overload")
+		w.shedAt = shed
+	}
+	if w.limit != nil && w.limit.Hit() {
+		partial = append(partial, "cardinality")
+	}
+	warming := r.warmUp.Active(now)
+	if warming {
+		partial = append(partial, "warmup")
+	}
+	if warming && !r.warmUp.Mark {
+		// the counters still start their rates from here
+		n := len(w.rates.Convert(w.agg.Flush(), elapsed))
+		slog.Info("Warm-up: suppressed the report", "metrics", n)
+		return
+	}
+	if r.standby.Active() {
+		n := len(w.rates.Convert(w.agg.Flush(), elapsed))
+		slog.Debug("Standby: the primary reports the window", "metrics", n)
+		return
+	}
+
+	out := bufio.NewWriter(r.streams)
+	emission := server.NewSignedWriter(out, r.sig)
+	report := len(r.streams) > 0
+	// the rows of a template are lines like the text report's
+	text := r.output == server.OutputText || r.output == server.OutputTemplate
+	r.seq++
+	// a tumbling window holds what came since the last flush, however late
+	// or early this one is, a sliding window the length before now
+	win := sink.Window{Start: last, End: now, Partial: partial, Seq: r.seq, Flushed: now, Context: r.ctx}
+	if w.every < w.length {
+		win.Start = now.Add(-w.length)
+	}
+	// event time windows are reported on their own bounds, the newest that
+	// ended as the emission and any before it as corrections
+	var source store.SortedFlusher = w.agg
+	var missed []store.ClosedWindow
+	if wm, ok := w.agg.(*store.Watermarked); ok {
+		closed := wm.CloseWindows()
+		last := store.ClosedWindow{End: now.Truncate(w.length)}
+		last.Start = last.End.Add(-w.length)
+		if len(closed) > 0 {
+			missed, last = closed[:len(closed)-1], closed[len(closed)-1]
+		}
+		source, win.Start, win.End = last, last.Start, last.End
+	}
+	if r.labels {
+		win.Label = windowLabel(w.length)
+	}
+	if report && text {
+		fmt.Fprintf(emission, "#flush\t%d\t%s\t%s\n", win.Seq, win.Start.UTC().Format(time.RFC3339Nano), win.End.UTC().Format(time.RFC3339Nano))
+	}
+	if r.labels && report && text {
+		fmt.Fprintf(emission, "#window\t%s\n", windowLabel(w.length))
+	}
+	if len(partial) > 0 && report && text {
+		server.WritePartial(emission, partial...)
+	}
+	var failed error
+	producers := make(map[string]struct{})
+	flushed := 0
+	store.FlushOrdered(source, r.order, store.DefaultChunkSize, func(chunk []parser.Metric) {
+		chunk = w.rates.Convert(chunk, elapsed)
+		flushed += len(chunk)
+		if r.producers != store.NoProducerCounts {
+			for _, m := range chunk {
+				for p := range m.Producers {
+					producers[p] = struct{}{}
+				}
+			}
+		}
+		// the sinks get the chunk first, the report's serializer may rename
+		// metrics in place
+		r.sinks.Flush(win, chunk)
+		if w.publish {
+			r.subscribers.Publish(append([]parser.Metric(nil), chunk...))
+		}
+		if report && failed == nil {
+			failed = r.write(emission, w, win, chunk, elapsed, now)
+		}
+	})
+	if err := r.sinks.End(win); err != nil {
+		slog.Error("Sink: the rest of the window is lost", "err", err)
+	}
+	// a sudden drop in producers shows even when the means look normal
+	if r.producers != store.NoProducerCounts && report && failed == nil {
+		fmt.Fprintf(emission, "#producers\t%d\n", len(producers))
+	}
+	// the metrics dominating the window's traffic, with how much of the
+	// count or sum may have been missed for each
+	if report && failed == nil {
+		for i, e := range top {
+			fmt.Fprintf(emission, "#top\t%s\t%d\t%s\t%s\t%s\n", *topBy, i+1, e.Key, strconv.FormatFloat(e.Value, 'g', -1, 64), strconv.FormatFloat(e.Error, 'g', -1, 64))
+		}
+	}
+	// late metrics amending windows already reported follow, each window
+	// under a #correction line with its start, after any window that ended
+	// unreported before the newest. They carry no EWMA columns, the
+	// averages only move as windows close.
+	var current time.Time
+	var corrected sink.Window
+	correct := func(start, end time.Time, chunk []parser.Metric) {
+		if !start.Equal(current) {
+			if !current.IsZero() {
+				r.endCorrection(corrected)
+			}
+			current = start
+			corrected = sink.Window{Start: start, End: end, Correction: true, Label: win.Label, Seq: win.Seq, Flushed: now, Context: r.ctx}
+			if report && failed == nil && text {
+				fmt.Fprintf(emission, "#correction\t%s\n", start.UTC().Format(time.RFC3339))
+			}
+		}
+		r.sinks.Flush(corrected, chunk)
+		if report && failed == nil {
+			failed = r.write(emission, nil, corrected, chunk, elapsed, now)
+		}
+	}
+	for _, m := range missed {
+		store.FlushOrdered(m, r.order, store.DefaultChunkSize, func(chunk []parser.Metric) {
+			correct(m.Start, m.End, chunk)
+		})
+	}
+	if c, ok := w.agg.(store.Corrector); ok {
+		c.Corrections(store.DefaultChunkSize, func(window time.Time, chunk []parser.Metric) {
+			correct(window, window.Add(w.length), chunk)
+		})
+	}
+	if !current.IsZero() {
+		r.endCorrection(corrected)
+	}
+	if wm, ok := w.agg.(*store.Watermarked); ok {
+		if n := wm.Late(); n > 0 {
+			slog.Warn("Late: dropped metrics past the window's grace period", "metrics", n, "window", windowLabel(w.length))
+		}
+	}
+	if failed != nil {
+		slog.Error("Flush: the rest of the window is lost", "err", failed)
+		fmt.Fprintf(emission, "#failed\t%v\n", failed)
+	}
+	emission.Close()
+	out.Flush()
+	for _, s := range r.streams {
+		if err := s.End(win); err != nil {
+			slog.Error("Sink: the rest of the window is lost", "sink", s.String(), "err", err)
+		}
+	}
+	if w.ewma != nil {
+		w.ewma.Prune(now)
+	}
+	w.anomalies.Prune(now)
+	w.rates.Prune(now)
+	r.srv.Flushed(windowLabel(w.length), now, time.Since(started), flushed, partial)
+}
+
+func (r *reporter) endCorrection(w sink.Window) {
+	if err := r.sinks.End(w); err != nil {
+		slog.Error("Sink: the rest of the correction is lost", "err", err)
+	}
+}
+
+// Writes a row per metric in the chunk, the EWMA columns are only added and
+// moved on for a window
+func (r *reporter) write(emission *server.SignedWriter, w *window, win sink.Window, chunk []parser.Metric, elapsed time.Duration, now time.Time) error {
+	var records *csv.Writer
+	if r.output == server.OutputCSV {
+		records = csv.NewWriter(emission)
+		records.Comma = r.delimiter
+		defer records.Flush()
+	}
+	for i := range chunk {
+		ok, err := r.serializer.Prepare(&chunk[i])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		m := chunk[i]
+		if r.output != server.OutputText {
+			row := server.ReportRow{Metric: m, Window: win.Label, Start: win.Start, End: win.End, Seq: win.Seq, Flushed: win.Flushed,
+				Partial: win.Partial, Correction: win.Correction, Percentiles: r.percentiles, Producers: -1}
+			if w != nil && w.ewma != nil {
+				row.EWMA = w.ewma.Update(m.Key(), m.Mean, elapsed, now)
+			}
+			if r.producers == store.MetricProducerCounts {
+				row.Producers = len(m.Producers)
+			}
+			if w != nil && w.anomalies != nil {
+				row.Anomaly = w.anomalies.Check(m.Key(), row.Value(), now)
+			}
+			if records != nil {
+				records.Write(row.Record(r.format, r.ewmaColumns))
+				continue
+			}
+			if r.template != nil {
+				if err := r.template.Execute(emission, row); err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			emission.Write(append(b, '\n'))
+			continue
+		}
+		cols := []any{m.Key(),
+			"\t", r.format.Value(m),
+			"\t", r.format.Format(m.Min),
+			"\t", r.format.Format(m.Max),
+			"\t", r.format.Sum(m),
+			"\t", m.Count,
+			"\t", r.format.Format(m.Stddev())}
+		for _, p := range r.percentiles {
+			cols = append(cols, "\t", r.format.Format(m.Quantile(p/100)))
+		}
+		if w != nil && w.ewma != nil {
+			for _, v := range w.ewma.Update(m.Key(), m.Mean, elapsed, now) {
+				cols = append(cols, "\t", r.format.Format(v))
+			}
+		}
+		if r.producers == store.MetricProducerCounts {
+			cols = append(cols, "\t", len(m.Producers))
+		}
+		// a window straying from the metric's baseline is marked with its
+		// score, the others with -
+		if w != nil && w.anomalies != nil {
+			if score := w.anomalies.Check(m.Key(), server.ReportRow{Metric: m}.Value(), now); score != 0 {
+				cols = append(cols, "\t", "anomaly="+r.format.Format(score))
+			} else {
+				cols = append(cols, "\t", "-")
+			}
+		}
+		fmt.Fprintln(emission, cols...)
+	}
+	return nil
+}
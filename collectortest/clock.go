@@ -0,0 +1,20 @@
+package collectortest
+
+import (
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+)
+
+// Clock is a manually advanced clock, the clock package's Manual. Time only
+// moves when Advance or Set is called, which fires any timers and tickers
+// that came due along the way.
+type Clock = clock.Manual
+
+// Ticker mirrors time.Ticker for a Clock
+type Ticker = clock.Ticker
+
+// NewClock returns a clock stopped at start
+func NewClock(start time.Time) *Clock {
+	return clock.NewManual(start)
+}
@@ -0,0 +1,70 @@
+package collectortest
+
+import (
+	"bufio"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	l := NewListener("collector:4268")
+	accepted := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- err.Error()
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		accepted <- conn.RemoteAddr().String() + " " + line
+	}()
+
+	conn, err := l.DialFrom("10.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("DialFrom(); got error %v", err)
+	}
+	conn.Write([]byte("asdf\t1\t2016-01-01T00:00:00Z\n"))
+	if got, want := <-accepted, "10.0.0.1:5000 asdf\t1\t2016-01-01T00:00:00Z\n"; got != want {
+		t.Errorf("Accept(); got %q, want %q", got, want)
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Errorf("Accept() after Close; got nil error")
+	}
+	if _, err := l.Dial(); err == nil {
+		t.Errorf("Dial() after Close; got nil error")
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewClock(start)
+	ticker := c.NewTicker(10 * time.Second)
+	after := c.After(25 * time.Second)
+
+	c.Advance(10 * time.Second)
+	if got := <-ticker.C; !got.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("tick; got %v, want %v", got, start.Add(10*time.Second))
+	}
+
+	c.Advance(20 * time.Second)
+	if got := <-after; !got.Equal(start.Add(25 * time.Second)) {
+		t.Errorf("After(); got %v, want %v", got, start.Add(25*time.Second))
+	}
+	// only the latest tick is buffered, like time.Ticker
+	if got := <-ticker.C; !got.Equal(start.Add(20 * time.Second)) {
+		t.Errorf("tick; got %v, want %v", got, start.Add(20*time.Second))
+	}
+	if got := c.Since(start); got != 30*time.Second {
+		t.Errorf("Since(); got %v, want %v", got, 30*time.Second)
+	}
+
+	ticker.Stop()
+	c.Advance(time.Minute)
+	select {
+	case <-ticker.C:
+		t.Errorf("tick after Stop")
+	default:
+	}
+}
@@ -0,0 +1,86 @@
+// Package collectortest provides an in-memory network and a manually driven
+// clock for testing code that embeds or talks to the collector, without real
+// sockets or waiting on wall clock tickers.
+package collectortest
+
+import (
+	"net"
+	"sync"
+)
+
+// Addr is a fake network address
+type Addr string
+
+func (a Addr) Network() string { return "collectortest" }
+func (a Addr) String() string  { return string(a) }
+
+// Listener is an in-memory net.Listener. Connections are created with Dial
+// and handed to whoever is blocked in Accept.
+type Listener struct {
+	addr  Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewListener returns a listener reporting addr as its address
+func NewListener(addr string) *Listener {
+	return &Listener{
+		addr:  Addr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for the next call to Dial
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close makes any blocked and future Accept and Dial calls fail
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the listener's fake address
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial connects to the listener from a fixed client address
+func (l *Listener) Dial() (net.Conn, error) {
+	return l.DialFrom("192.0.2.1:40000")
+}
+
+// DialFrom connects to the listener with the server side reporting remote as
+// the client's address, handy for testing per-IP behavior. It blocks until
+// the connection is accepted.
+func (l *Listener) DialFrom(remote string) (net.Conn, error) {
+	client, server := net.Pipe()
+	conn := &Conn{Conn: server, local: l.addr, remote: Addr(remote)}
+	select {
+	case l.conns <- conn:
+		return &Conn{Conn: client, local: Addr(remote), remote: l.addr}, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// Conn is one end of an in-memory connection with configurable addresses.
+// Writes block until the other end reads, just like net.Pipe.
+type Conn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,366 @@
+// Package client sends metrics to a collector over its tsv line protocol.
+// Lines are batched on a pool of connections, a broken connection is dialed
+// again after a backoff, and with Async the sending goroutine never waits
+// on the network.
+//
+//	c, err := client.New(client.Config{Addr: "collector:4268"})
+//	...
+//	c.Send("requests", 1, time.Now())
+//	defer c.Close()
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+var (
+	// ErrUnavailable is returned while the collector can't be reached and
+	// the backoff before dialing it again isn't over
+	ErrUnavailable = errors.New("client: collector unavailable")
+	// ErrBufferFull is returned by an Async client whose buffer is full,
+	// the metric is dropped
+	ErrBufferFull = errors.New("client: buffer full, metric dropped")
+	// ErrClosed is returned once the client is closed
+	ErrClosed = errors.New("client: closed")
+)
+
+// Config configures a Client, the zero values take the defaults
+type Config struct {
+	// the collector's tsv listener, like collector:4268
+	Addr string
+	// tcp (the default) or unix
+	Network string
+	// connections the metrics are spread over (default 1)
+	Conns int
+	// lines written to a connection at once (default 100), a batch not
+	// full is written every FlushInterval (default 100ms)
+	BatchSize     int
+	FlushInterval time.Duration
+	// authenticate every connection with AUTH <token>
+	Token       string
+	DialTimeout time.Duration
+	// the first wait before dialing a collector that failed, doubled on
+	// every failure in a row up to MaxBackoff (default 100ms and 10s)
+	MinBackoff, MaxBackoff time.Duration
+	// Send only queues the metric, up to Buffer lines (default 10000).
+	// The queue is written out in the background and kept while the
+	// collector is down, Send returns ErrBufferFull once it is full.
+	Async  bool
+	Buffer int
+}
+
+// Client sends metrics to a collector, safe for concurrent use
+type Client struct {
+	cfg   Config
+	conns []*conn
+	next  atomic.Uint64
+	// the lines of an Async client waiting to be written
+	queue chan []byte
+
+	done   chan struct{}
+	wg     sync.WaitGroup
+	closed atomic.Bool
+}
+
+// New returns a client of the collector, the connections are dialed on the
+// first metric sent
+func New(cfg Config) (*Client, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("client: no address")
+	}
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if cfg.Conns <= 0 {
+		cfg.Conns = 1
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 100 * time.Millisecond
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(10*time.Second, cfg.MinBackoff)
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 10000
+	}
+	c := &Client{cfg: cfg, done: make(chan struct{})}
+	for i := 0; i < cfg.Conns; i++ {
+		c.conns = append(c.conns, &conn{cfg: &c.cfg, now: time.Now})
+	}
+	if cfg.Async {
+		c.queue = make(chan []byte, cfg.Buffer)
+		for _, cn := range c.conns {
+			c.wg.Add(1)
+			go c.drain(cn)
+		}
+	}
+	c.wg.Add(1)
+	go c.flusher()
+	return c, nil
+}
+
+// Send sends a metric of the value at t. The name must be one the
+// collector takes, letters, digits and dashes.
+func (c *Client) Send(name string, value float64, t time.Time) error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	line, err := formatLine(name, value, t)
+	if err != nil {
+		return err
+	}
+	return c.send(line)
+}
+
+// SendMetric sends a metric of any type with its tags as a JSON line, the
+// listener takes those along with tsv. A set's members are sent a line
+// each. A name with dots or underscores is only taken by a peer listener.
+func (c *Client) SendMetric(m parser.Metric) error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	lines, err := formatJSON(m)
+	if err != nil {
+		return err
+	}
+	return c.send(lines)
+}
+
+// Queues or writes the lines
+func (c *Client) send(line []byte) error {
+	if c.queue != nil {
+		select {
+		case c.queue <- line:
+			return nil
+		default:
+			return ErrBufferFull
+		}
+	}
+	return c.pick().write(line)
+}
+
+// Returns the next connection of the pool
+func (c *Client) pick() *conn {
+	return c.conns[int(c.next.Add(1)%uint64(len(c.conns)))]
+}
+
+// Flush writes out the lines batched so far. The lines of an Async client
+// still queued are left to the background.
+func (c *Client) Flush() error {
+	var errs []error
+	for _, cn := range c.conns {
+		errs = append(errs, cn.flush())
+	}
+	return errors.Join(errs...)
+}
+
+// Close writes out what is batched and, for an Async client, what is still
+// queued as long as the collector takes it, then closes the connections
+func (c *Client) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+	close(c.done)
+	c.wg.Wait()
+	var errs []error
+	for _, cn := range c.conns {
+		errs = append(errs, cn.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Writes the batches every FlushInterval until closed
+func (c *Client) flusher() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.Flush()
+		}
+	}
+}
+
+// Writes the queued lines to the connection. A line the collector can't
+// take yet is tried again after the backoff, holding up the queue.
+func (c *Client) drain(cn *conn) {
+	defer c.wg.Done()
+	for {
+		var line []byte
+		select {
+		case line = <-c.queue:
+		case <-c.done:
+			// what is left is written while the collector takes it
+			for {
+				select {
+				case line = <-c.queue:
+					if cn.write(line) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+		for cn.write(line) != nil {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(cn.wait()):
+			}
+		}
+	}
+}
+
+// Formats the tsv line of a metric, its time in epoch milliseconds
+func formatLine(name string, value float64, t time.Time) ([]byte, error) {
+	if name == "" || !parser.ValidateName(name) {
+		return nil, fmt.Errorf("client: %w %q", parser.ErrInvalidName, name)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("client: the value of %s is %v", name, value)
+	}
+	b := make([]byte, 0, len(name)+40)
+	b = append(b, name...)
+	b = append(b, '\t')
+	b = strconv.AppendFloat(b, value, 'g', -1, 64)
+	b = append(b, '\t')
+	b = strconv.AppendInt(b, t.UnixMilli(), 10)
+	return append(b, '\n'), nil
+}
+
+// Formats the JSON lines of a metric
+func formatJSON(m parser.Metric) ([]byte, error) {
+	b, err := parser.AppendPeer(nil, m)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	return b, nil
+}
+
+// conn is one connection of the pool and the batch being filled for it
+type conn struct {
+	cfg *Config
+	now func() time.Time
+
+	mu      sync.Mutex
+	c       net.Conn
+	w       *bufio.Writer
+	pending int
+	// the wait before dialing again, and until when
+	backoff time.Duration
+	until   time.Time
+	err     error
+}
+
+// Adds the line to the batch, writing the batch once full. A line that
+// can't be written is lost along with the rest of its batch.
+func (cn *conn) write(line []byte) error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if err := cn.dial(); err != nil {
+		return err
+	}
+	cn.w.Write(line)
+	if cn.pending++; cn.pending < cn.cfg.BatchSize {
+		return nil
+	}
+	return cn.flushLocked()
+}
+
+func (cn *conn) flush() error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.flushLocked()
+}
+
+func (cn *conn) flushLocked() error {
+	if cn.c == nil || cn.pending == 0 {
+		return nil
+	}
+	cn.pending = 0
+	if err := cn.w.Flush(); err != nil {
+		cn.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Dials the collector unless connected or waiting out the backoff
+func (cn *conn) dial() error {
+	if cn.c != nil {
+		return nil
+	}
+	if cn.now().Before(cn.until) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, cn.err)
+	}
+	c, err := net.DialTimeout(cn.cfg.Network, cn.cfg.Addr, cn.cfg.DialTimeout)
+	if err == nil && cn.cfg.Token != "" {
+		if _, err = c.Write([]byte("AUTH " + cn.cfg.Token + "\n")); err != nil {
+			c.Close()
+		}
+	}
+	if err != nil {
+		cn.fail(err)
+		return err
+	}
+	cn.c, cn.backoff = c, 0
+	if cn.w == nil {
+		cn.w = bufio.NewWriterSize(c, 64*1024)
+	} else {
+		cn.w.Reset(c)
+	}
+	return nil
+}
+
+// Drops the connection and starts the backoff, doubling it from the last
+// failure in a row
+func (cn *conn) fail(err error) {
+	if cn.c != nil {
+		cn.c.Close()
+		cn.c = nil
+	}
+	cn.pending = 0
+	cn.backoff = min(max(cn.backoff*2, cn.cfg.MinBackoff), cn.cfg.MaxBackoff)
+	cn.until, cn.err = cn.now().Add(cn.backoff), err
+}
+
+// Returns how long until the connection may be dialed again
+func (cn *conn) wait() time.Duration {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return max(cn.until.Sub(cn.now()), time.Millisecond)
+}
+
+func (cn *conn) close() error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	err := cn.flushLocked()
+	if cn.c != nil {
+		err = errors.Join(err, cn.c.Close())
+		cn.c = nil
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// collector accepts connections and hands over every line read
+type collector struct {
+	l     net.Listener
+	lines chan string
+	conns chan net.Conn
+}
+
+func newCollector(t *testing.T) *collector {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{l: l, lines: make(chan string, 100), conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.conns <- conn
+			go func() {
+				r := bufio.NewScanner(conn)
+				for r.Scan() {
+					c.lines <- r.Text()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return c
+}
+
+// Returns the next line read, failing after a few seconds
+func (c *collector) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case line := <-c.lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("no line read")
+		return ""
+	}
+}
+
+func TestSend(t *testing.T) {
+	coll := newCollector(t)
+	c, err := New(Config{Addr: coll.l.Addr().String(), BatchSize: 2, FlushInterval: time.Hour, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	at := time.UnixMilli(1714564800250)
+	if err := c.Send("cpu-load", 0.75, at); err != nil {
+		t.Fatalf("Send(); got error %v", err)
+	}
+	// a full batch is written without waiting for the interval
+	c.Send("requests", 3, at)
+	for _, want := range []string{"AUTH secret", "cpu-load\t0.75\t1714564800250", "requests\t3\t1714564800250"} {
+		if got := coll.next(t); got != want {
+			t.Errorf("line; got %q, want %q", got, want)
+		}
+	}
+	c.Send("requests", 4, at)
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush(); got error %v", err)
+	}
+	if got := coll.next(t); got != "requests\t4\t1714564800250" {
+		t.Errorf("line after Flush(); got %q", got)
+	}
+
+	for _, name := range []string{"", "cpu.load", "-cpu"} {
+		if err := c.Send(name, 1, at); err == nil {
+			t.Errorf("Send(%q); got nil error", name)
+		}
+	}
+	if err := c.Send("cpu", math.NaN(), at); err == nil {
+		t.Error("Send(NaN); got nil error")
+	}
+}
+
+func TestSendReconnects(t *testing.T) {
+	coll := newCollector(t)
+	c, _ := New(Config{Addr: coll.l.Addr().String(), BatchSize: 1, MinBackoff: time.Millisecond})
+	defer c.Close()
+
+	c.Send("a", 1, time.Now())
+	coll.next(t)
+	// the collector hangs up, the next writes fail until the client dials
+	// again
+	(<-coll.conns).Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := c.Send("b", 1, time.Now()); err == nil {
+			select {
+			case line := <-coll.lines:
+				if !strings.HasPrefix(line, "b\t") {
+					t.Errorf("line after reconnecting; got %q", line)
+				}
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no line read after the collector hung up")
+		}
+	}
+}
+
+func TestSendUnavailable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	c, _ := New(Config{Addr: addr, MinBackoff: time.Hour})
+	defer c.Close()
+	if err := c.Send("a", 1, time.Now()); err == nil || errors.Is(err, ErrUnavailable) {
+		t.Errorf("Send() to nothing; got %v, want the dial error", err)
+	}
+	// the backoff isn't over, no dial is tried
+	if err := c.Send("a", 1, time.Now()); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Send() again; got %v, want ErrUnavailable", err)
+	}
+}
+
+func TestAsync(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	// the collector is down, the lines wait in the buffer
+	c, _ := New(Config{Addr: addr, Async: true, Buffer: 2, BatchSize: 1, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	defer c.Close()
+	c.Send("a", 1, time.UnixMilli(1))
+	c.Send("b", 2, time.UnixMilli(2))
+	c.Send("c", 3, time.UnixMilli(3))
+	var full bool
+	for i := 0; i < 3 && !full; i++ {
+		full = errors.Is(c.Send("d", 4, time.UnixMilli(4)), ErrBufferFull)
+	}
+	if !full {
+		t.Error("Send() with the buffer full; want ErrBufferFull")
+	}
+
+	// once the collector is back the buffer is written out
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("the address was taken meanwhile: %v", err)
+	}
+	defer l.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewScanner(conn)
+	if !r.Scan() || !strings.Contains("abcd", r.Text()[:1]) {
+		t.Errorf("line once back; got %q, want a buffered line", r.Text())
+	}
+}
+
+func TestClose(t *testing.T) {
+	coll := newCollector(t)
+	c, _ := New(Config{Addr: coll.l.Addr().String(), Async: true, FlushInterval: time.Hour})
+	c.Send("a", 1, time.UnixMilli(1))
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close(); got error %v", err)
+	}
+	// what was queued is written out on the way
+	if got := coll.next(t); got != "a\t1\t1" {
+		t.Errorf("line; got %q", got)
+	}
+	if err := c.Send("a", 1, time.Now()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Send() after Close(); got %v, want ErrClosed", err)
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	for _, m := range []parser.Metric{
+		{Name: "api.requests", Type: parser.Counter, Value: 2.5, Tags: "host=a,region=eu", Time: at},
+		{Name: "bytes", Integer: true, IntValue: 1 << 60, Value: 1 << 60, Time: at},
+		{Name: "users", Type: parser.Set, Members: map[string]struct{}{"u1": {}}, Time: at},
+	} {
+		line, err := formatJSON(m)
+		if err != nil {
+			t.Fatalf("formatJSON(%s); got error %v", m.Name, err)
+		}
+		got, err := parser.ParsePeer(strings.TrimSuffix(string(line), "\n"))
+		if err != nil {
+			t.Fatalf("ParsePeer(%s); got error %v", line, err)
+		}
+		if got.Name != m.Name || got.Type != m.Type || got.Tags != m.Tags || !got.Time.Equal(at) || (m.Type != parser.Set && got.Value != m.Value) || len(got.Members) != len(m.Members) {
+			t.Errorf("formatJSON(%s) read back as %+v", m.Name, got)
+		}
+	}
+	if _, err := formatJSON(parser.Metric{Name: "cpu", Value: math.NaN()}); err == nil {
+		t.Error("formatJSON() of NaN; want an error")
+	}
+}
@@ -0,0 +1,149 @@
+// Package clock is the time the collector goes by: the wall clock, or in
+// tests a Manual one moved by hand so the windows, staleness checks and
+// tickers run without waiting on real time
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and ticks
+type Clock interface {
+	Now() time.Time
+	// returns a ticker sending the time every d, like time.NewTicker
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Ticker delivers the ticks of a Clock on C. Like a time.Ticker, a tick is
+// dropped when the one before hasn't been received yet.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns the ticker off, C is not closed
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+// Func is a clock reading the time from a function, like one following the
+// timestamps of a replayed file. Its tickers tick by the wall clock.
+type Func func() time.Time
+
+func (f Func) Now() time.Time {
+	return f()
+}
+
+func (Func) NewTicker(d time.Duration) *Ticker {
+	return Real.NewTicker(d)
+}
+
+// Manual is a clock standing still until Advance or Set moves it, firing
+// the tickers and timers that fall due on the way
+type Manual struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers map[*manualTicker]bool
+}
+
+// a ticker, or with every 0 the timer of an After
+type manualTicker struct {
+	c     chan time.Time
+	every time.Duration
+	next  time.Time
+}
+
+// Returns a Manual clock set at t
+func NewManual(t time.Time) *Manual {
+	return &Manual{now: t, tickers: make(map[*manualTicker]bool)}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// Since returns the time passed on the clock since t
+func (m *Manual) Since(t time.Time) time.Duration {
+	return m.Now().Sub(t)
+}
+
+// After returns a channel receiving the clock's time once d has passed on
+// it, like time.After
+func (m *Manual) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &manualTicker{c: make(chan time.Time, 1), next: m.now.Add(d)}
+	if d <= 0 {
+		t.c <- m.now
+		return t.c
+	}
+	m.tickers[t] = true
+	return t.c
+}
+
+func (m *Manual) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &manualTicker{c: make(chan time.Time, 1), every: d, next: m.now.Add(d)}
+	m.tickers[t] = true
+	return &Ticker{C: t.c, stop: func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.tickers, t)
+	}}
+}
+
+// Advance moves the clock forward by d. Every ticker due by then ticks
+// once with the time it was due, however many of its intervals passed.
+func (m *Manual) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(m.now.Add(d))
+}
+
+// Set moves the clock to t like Advance. Moving it back only changes Now.
+func (m *Manual) Set(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(t)
+}
+
+func (m *Manual) set(now time.Time) {
+	m.now = now
+	for t := range m.tickers {
+		if t.next.After(now) {
+			continue
+		}
+		select {
+		case t.c <- t.next:
+		default:
+		}
+		if t.every == 0 {
+			delete(m.tickers, t)
+			continue
+		}
+		for !t.next.After(now) {
+			t.next = t.next.Add(t.every)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManual(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)
+	c := NewManual(start)
+	ticker := c.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	c.Advance(5 * time.Second)
+	if got := c.Now(); !got.Equal(start.Add(5 * time.Second)) {
+		t.Errorf("Now() after Advance(5s); got %v", got)
+	}
+	select {
+	case <-ticker.C:
+		t.Error("ticked before the interval passed")
+	default:
+	}
+
+	c.Advance(5 * time.Second)
+	if got := <-ticker.C; !got.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("tick; got %v, want the time it was due", got)
+	}
+
+	// intervals passed at once tick once, like a time.Ticker falling behind
+	c.Advance(35 * time.Second)
+	if got := <-ticker.C; !got.Equal(start.Add(20 * time.Second)) {
+		t.Errorf("tick after Advance(35s); got %v, want the first one due", got)
+	}
+	c.Advance(5 * time.Second)
+	if got := <-ticker.C; !got.Equal(start.Add(50 * time.Second)) {
+		t.Errorf("next tick; got %v, want 50s in", got)
+	}
+
+	ticker.Stop()
+	c.Advance(time.Minute)
+	select {
+	case <-ticker.C:
+		t.Error("ticked after Stop")
+	default:
+	}
+}
+
+func TestManualSet(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)
+	c := NewManual(start)
+	after := c.After(time.Minute)
+
+	// back in time only moves Now
+	c.Set(start.Add(-time.Hour))
+	select {
+	case <-after:
+		t.Error("After() fired going back")
+	default:
+	}
+	c.Set(start.Add(2 * time.Minute))
+	if got := <-after; !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("After(); got %v, want the time it was due", got)
+	}
+	if got := c.Since(start); got != 2*time.Minute {
+		t.Errorf("Since(); got %v, want 2m", got)
+	}
+}
@@ -0,0 +1,142 @@
+// Package hll counts the distinct members of a set approximately in fixed
+// memory with HyperLogLog (Flajolet et al.), falling back to linear counting
+// while the set is small. A sketch of precision p takes 2^p bytes and is off
+// by about 1.04/sqrt(2^p), 0.8% at the default.
+package hll
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// DefaultPrecision keeps 16384 registers
+	DefaultPrecision = 14
+	MinPrecision     = 4
+	MaxPrecision     = 18
+)
+
+// Sketch is a HyperLogLog sketch. It is not safe for concurrent use.
+type Sketch struct {
+	p         uint8
+	registers []uint8
+}
+
+// Returns an empty sketch of the precision, clamped to MinPrecision and
+// MaxPrecision
+func New(precision int) *Sketch {
+	precision = min(max(precision, MinPrecision), MaxPrecision)
+	return &Sketch{p: uint8(precision), registers: make([]uint8, 1<<precision)}
+}
+
+// Hashes the member with FNV-1a, mixed by murmur3's finalizer so every bit
+// depends on every byte. The hash doesn't change across processes, sketches
+// restored from a snapshot merge with new ones.
+func hash(member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add adds a member to the set
+func (s *Sketch) Add(member string) {
+	x := hash(member)
+	i := x >> (64 - s.p)
+	// the leading zeros of the rest of the hash, a sentinel bit stops the
+	// count at its length
+	rho := uint8(bits.LeadingZeros64(x<<s.p|1<<(s.p-1))) + 1
+	if rho > s.registers[i] {
+		s.registers[i] = rho
+	}
+}
+
+// Merge adds the members of o to the set. A sketch of a different precision
+// leaves the union at the lower one.
+func (s *Sketch) Merge(o *Sketch) {
+	if o.p > s.p {
+		o = o.reduce(s.p)
+	} else if o.p < s.p {
+		*s = *s.reduce(o.p)
+	}
+	for i, r := range o.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+// Returns a copy of the sketch at the lower precision p, the index bits
+// dropped go back to the front of the rest of the hash
+func (s *Sketch) reduce(p uint8) *Sketch {
+	r := New(int(p))
+	shift := s.p - p
+	for i, reg := range s.registers {
+		if reg == 0 {
+			continue
+		}
+		low := uint64(i) & (1<<shift - 1)
+		rho := reg + shift
+		if low != 0 {
+			rho = uint8(bits.LeadingZeros64(low<<(64-shift))) + 1
+		}
+		if j := i >> shift; rho > r.registers[j] {
+			r.registers[j] = rho
+		}
+	}
+	return r
+}
+
+// Clone returns a copy of the sketch
+func (s *Sketch) Clone() *Sketch {
+	return &Sketch{p: s.p, registers: append([]uint8(nil), s.registers...)}
+}
+
+// Count estimates how many distinct members were added
+func (s *Sketch) Count() uint64 {
+	m := float64(len(s.registers))
+	var sum float64
+	zeros := 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	switch m {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// MarshalBinary encodes the sketch as its precision followed by its
+// registers
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	return append([]byte{s.p}, s.registers...), nil
+}
+
+// UnmarshalBinary restores a sketch encoded by MarshalBinary
+func (s *Sketch) UnmarshalBinary(b []byte) error {
+	if len(b) < 1 || b[0] < MinPrecision || b[0] > MaxPrecision || len(b) != 1+1<<b[0] {
+		return errors.New("hll: malformed encoding")
+	}
+	*s = Sketch{p: b[0], registers: append([]uint8(nil), b[1:]...)}
+	return nil
+}
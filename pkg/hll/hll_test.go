@@ -0,0 +1,70 @@
+package hll
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000, 1000000} {
+		s := New(DefaultPrecision)
+		for i := 0; i < n; i++ {
+			// every member twice, the repeats don't count
+			s.Add(fmt.Sprintf("user-%d", i))
+			s.Add(fmt.Sprintf("user-%d", i))
+		}
+		got := float64(s.Count())
+		if math.Abs(got-float64(n)) > 0.03*float64(n)+1 {
+			t.Errorf("Count() of %d members; got %v", n, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, all := New(12), New(12), New(12)
+	for i := 0; i < 50000; i++ {
+		member := fmt.Sprintf("user-%d", i)
+		all.Add(member)
+		if i%2 == 0 {
+			a.Add(member)
+		} else {
+			b.Add(member)
+		}
+	}
+	a.Merge(b)
+	if a.Count() != all.Count() {
+		t.Errorf("Count() of the union; got %d, want %d", a.Count(), all.Count())
+	}
+
+	// a sketch of a higher precision is reduced to the lower one as if it
+	// had been built there
+	high := New(14)
+	for i := 0; i < 50000; i++ {
+		high.Add(fmt.Sprintf("user-%d", i))
+	}
+	low := New(12)
+	low.Merge(high)
+	if low.Count() != all.Count() {
+		t.Errorf("Count() merging precision 14 into 12; got %d, want %d", low.Count(), all.Count())
+	}
+	high.Merge(New(12))
+	if high.p != 12 || high.Count() != all.Count() {
+		t.Errorf("Count() merging precision 12 into 14; got %d at %d, want %d at 12", high.Count(), high.p, all.Count())
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	s := New(10)
+	for i := 0; i < 1000; i++ {
+		s.Add(fmt.Sprint(i))
+	}
+	b, _ := s.MarshalBinary()
+	var got Sketch
+	if err := got.UnmarshalBinary(b); err != nil || got.Count() != s.Count() {
+		t.Errorf("UnmarshalBinary(); got %d, %v, want %d", got.Count(), err, s.Count())
+	}
+	if err := got.UnmarshalBinary(b[:100]); err == nil {
+		t.Error("UnmarshalBinary(truncated); got nil error")
+	}
+}
@@ -0,0 +1,33 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Batch returns a parser of lines carrying several metrics separated by the
+// delimiter, each parsed by parse, so a sender pays the framing of one line
+// for many. A line is taken whole or not at all: the first metric that
+// doesn't parse rejects it. Empty metrics, like after a trailing delimiter,
+// are skipped.
+func Batch(parse Func, delim string) Func {
+	return func(line string) ([]Metric, error) {
+		var metrics []Metric
+		for n := 1; line != ""; n++ {
+			part, rest, _ := strings.Cut(line, delim)
+			line = rest
+			if part == "" {
+				continue
+			}
+			ms, err := parse(part)
+			if err != nil {
+				return nil, fmt.Errorf("metric %d of the batch: %w", n, err)
+			}
+			metrics = append(metrics, ms...)
+		}
+		if len(metrics) == 0 {
+			return nil, ErrMissingValues
+		}
+		return metrics, nil
+	}
+}
@@ -0,0 +1,25 @@
+package parser
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	parse := Batch(Formats["statsd"], ";")
+	metrics, err := parse("hits:1|c;latency:250|ms;;users:bob|s;")
+	if err != nil || len(metrics) != 3 {
+		t.Fatalf("Batch(); got %v, %v, want 3 metrics", metrics, err)
+	}
+	if metrics[0].Name != "hits" || metrics[1].Type != Timer || metrics[2].Type != Set {
+		t.Errorf("Batch(); got %+v", metrics)
+	}
+
+	// one bad metric rejects the line
+	if metrics, err := parse("hits:1|c;latency:fast|ms"); !errors.Is(err, ErrInvalidValue) || metrics != nil {
+		t.Errorf("Batch() with a bad value; got %v, %v, want the line rejected", metrics, err)
+	}
+	if _, err := parse(";;"); !errors.Is(err, ErrMissingValues) {
+		t.Errorf("Batch() of nothing; got %v, want %v", err, ErrMissingValues)
+	}
+}
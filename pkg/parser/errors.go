@@ -0,0 +1,23 @@
+package parser
+
+import "errors"
+
+// The kinds of input the parsers reject. The errors returned wrap one of
+// these with the detail, branch on them with errors.Is rather than on the
+// message.
+var (
+	// a field the format requires is absent or empty
+	ErrMissingValues = errors.New("invalid input: missing values")
+	// the metric name is empty, too long or has characters it can't have
+	ErrInvalidName = errors.New("invalid input: name")
+	// the value doesn't parse as the number the metric needs
+	ErrInvalidValue = errors.New("invalid input: value")
+	// the timestamp isn't in the format's layout
+	ErrInvalidTime = errors.New("invalid input: time")
+	// the type field names no known metric type
+	ErrUnknownType = errors.New("invalid input: unknown type")
+	// the line or frame doesn't follow the format's syntax
+	ErrMalformed = errors.New("invalid input: malformed")
+	// the line or frame is bigger than allowed
+	ErrTooLong = errors.New("invalid input: too long")
+)
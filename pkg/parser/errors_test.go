@@ -0,0 +1,34 @@
+package parser
+
+import (
+	"errors"
+	"testing"
+)
+
+type errorTestCase struct {
+	input string
+	parse Func
+	want  error
+}
+
+var errorTestCases = []errorTestCase{
+	{"asdf\t1", Single(ParseDefault), ErrMissingValues},
+	{"-asdf\t1\t2016-01-01T00:00:00Z", Single(ParseDefault), ErrInvalidName},
+	{"asdf\tx\t2016-01-01T00:00:00Z", Single(ParseDefault), ErrInvalidValue},
+	{"asdf\t1\tyesterday", Single(ParseDefault), ErrInvalidTime},
+	{"asdf\t1\t2016-01-01T00:00:00Z\tq", Single(ParseDefault), ErrUnknownType},
+	{`{"name":`, Single(ParseDefault), ErrMalformed},
+	{"api.requests:1|q", Single(ParseStatsd), ErrUnknownType},
+	{"api.requests:1|c|@2", Single(ParseStatsd), ErrInvalidValue},
+	{"cpu.load 1.5 yesterday", Single(ParseGraphite), ErrInvalidTime},
+	{"cpu,host usage=1", ParseInflux, ErrMalformed},
+}
+
+func TestErrors(t *testing.T) {
+	for _, tc := range errorTestCases {
+		_, err := tc.parse(tc.input)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("parse(%s); got %v, want %v", tc.input, err, tc.want)
+		}
+	}
+}
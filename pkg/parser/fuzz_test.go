@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// The lines every fuzz target starts from, the rest of the seed corpus is
+// under testdata/fuzz
+var fuzzLines = []string{
+	"cpu-load\t0.75\t2024-05-01T12:00:00Z",
+	"cpu-load\t0.75\t1714564800250\tg\thost=a,region=eu",
+	"visitors\tuser-1\t1714564800\ts",
+	"latency\t12.5\t2024-05-01T14:00:00+02:00\tms",
+	"a.b.c:1|c|@0.5|#host:a",
+	"servers.web-1.cpu 0.75 1714564800",
+	"cpu,host=a value=0.75,idle=3i 1714564800000000000",
+	"",
+	"\t\t",
+	"cpu\x00load\t1\t1714564800",
+	"cpü\t1\t1714564800",
+	strings.Repeat("a", 65) + "\t1\t1714564800",
+}
+
+// Every format must turn any line into metrics or an error, never a panic,
+// and the tsv format must only accept names ValidateName does
+func FuzzParseMetric(f *testing.F) {
+	for _, line := range fuzzLines {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		for format, parse := range Formats {
+			metrics, err := parse(line)
+			if err != nil && metrics != nil {
+				t.Errorf("%s %q; got metrics along with error %v", format, line, err)
+			}
+		}
+		m, err := ParseTSV(line)
+		if err != nil {
+			return
+		}
+		if !ValidateName(m.Name) || m.Count != 1 || m.Time.IsZero() {
+			t.Errorf("ParseTSV(%q); got %+v, want a valid name, a count of 1 and a time", line, m)
+		}
+		var into Metric
+		if err := ParseTSVInto(&into, line); err != nil || into.Name != m.Name || math.Float64bits(into.Value) != math.Float64bits(m.Value) || !into.Time.Equal(m.Time) {
+			t.Errorf("ParseTSVInto(%q); got %+v, %v, want what ParseTSV returns", line, into, err)
+		}
+	})
+}
+
+// A name ValidateName accepts is at most 64 bytes of ASCII letters, digits
+// and dashes, not starting with a dash; the dotted names also take dots and
+// underscores
+func FuzzValidateName(f *testing.F) {
+	for _, name := range []string{"cpu-load", "-cpu", "cpu.load", "cpu_load", ".cpu", "cpü", "cpu\x00", "cpu load", strings.Repeat("a", 64), strings.Repeat("a", 65), "\xff"} {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		check := func(fn string, valid bool, allowed func(r rune) bool) {
+			if !valid {
+				return
+			}
+			if len(name) > 64 || !utf8.ValidString(name) || strings.HasPrefix(name, "-") || strings.HasPrefix(name, ".") {
+				t.Errorf("%s(%q); got valid", fn, name)
+			}
+			for _, r := range name {
+				if r >= utf8.RuneSelf || !allowed(r) {
+					t.Errorf("%s(%q); got valid with %q", fn, name, r)
+				}
+			}
+		}
+		alnum := func(r rune) bool {
+			return r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '-'
+		}
+		check("ValidateName", ValidateName(name), alnum)
+		check("ValidateDottedName", ValidateDottedName(name), func(r rune) bool {
+			return alnum(r) || r == '.' || r == '_'
+		})
+		if ValidateName(name) && name != "" && !ValidateDottedName(name) {
+			t.Errorf("ValidateDottedName(%q); got invalid, want every valid name to be a valid dotted one", name)
+		}
+	})
+}
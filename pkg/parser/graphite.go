@@ -0,0 +1,47 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse a graphite plaintext line: <metric.path> <value> <unix timestamp>
+//
+// Like carbon, a timestamp of -1 means the time the line was received.
+func ParseGraphite(line string) (*Metric, error) {
+	return parseGraphite(line, rules{valid: ValidateDottedName})
+}
+
+func parseGraphite(line string, r rules) (*Metric, error) {
+	data := strings.Fields(line)
+	if len(data) != 3 {
+		return nil, ErrMissingValues
+	}
+
+	name := data[0]
+	if !r.valid(name) {
+		return nil, ErrInvalidName
+	}
+
+	m := &Metric{Name: name, Count: 1}
+	if err := setValue(m, data[1], r); err != nil {
+		return nil, err
+	}
+
+	epoch, err := strconv.ParseFloat(data[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w not unix epoch", ErrInvalidTime)
+	}
+	t := time.Now().UTC()
+	if epoch != -1 {
+		sec, frac := math.Modf(epoch)
+		t = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	}
+
+	m.Time = t
+
+	return m, nil
+}
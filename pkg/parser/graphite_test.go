@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+type graphiteTestCase struct {
+	input  string
+	name   string
+	value  float64
+	time   time.Time
+	hasErr bool
+}
+
+var graphiteTestCases = []graphiteTestCase{
+	{"servers.web-1.cpu 0.75 1451606400", "servers.web-1.cpu", 0.75, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), false},
+	{"servers.web-1.cpu  12   1451606400.5", "servers.web-1.cpu", 12, time.Date(2016, 1, 1, 0, 0, 0, 5e8, time.UTC), false},
+	{"servers.web-1.cpu 0.75", "", 0, time.Time{}, true},
+	{"servers.web-1.cpu x 1451606400", "", 0, time.Time{}, true},
+	{"servers.web-1.cpu 1 2016-01-01T00:00:00Z", "", 0, time.Time{}, true},
+	{".servers 1 1451606400", "", 0, time.Time{}, true},
+}
+
+func TestParseGraphite(t *testing.T) {
+	for _, tc := range graphiteTestCases {
+		m, err := ParseGraphite(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("parseGraphite(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m.Name != tc.name || m.Value != tc.value || !m.Time.Equal(tc.time) {
+			t.Errorf("parseGraphite(%s); got %s %v %v, want %s %v %v", tc.input, m.Name, m.Value, m.Time, tc.name, tc.value, tc.time)
+		}
+	}
+
+	// -1 stamps the line with the receive time
+	m, err := ParseGraphite("servers.web-1.cpu 1 -1")
+	if err != nil || time.Since(m.Time) > time.Second {
+		t.Errorf("parseGraphite(-1); got %v %v, want the current time", m, err)
+	}
+}
@@ -0,0 +1,157 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse an InfluxDB line protocol line:
+//
+//	<measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [<unix nanoseconds>]
+//
+// Every numeric or boolean field becomes its own metric named
+// <measurement>.<field>, string fields are skipped. Every metric of the line
+// carries its tags.
+func ParseInflux(line string) ([]Metric, error) {
+	return parseInflux(line, rules{valid: ValidateDottedName})
+}
+
+func parseInflux(line string, r rules) ([]Metric, error) {
+	sections := splitUnescaped(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, ErrMissingValues
+	}
+
+	series := splitUnescaped(sections[0], ',')
+	measurement := unescapeInflux(series[0])
+	var pairs [][2]string
+	for _, tag := range series[1:] {
+		kv := splitUnescaped(tag, '=')
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%w tag %q", ErrMalformed, tag)
+		}
+		pairs = append(pairs, [2]string{unescapeInflux(kv[0]), unescapeInflux(kv[1])})
+	}
+	tags, err := CanonicalTags(pairs)
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.Now().UTC()
+	if len(sections) == 3 {
+		ns, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w not unix nanoseconds", ErrInvalidTime)
+		}
+		t = time.Unix(0, ns).UTC()
+	}
+
+	var metrics []Metric
+	for _, field := range splitUnescaped(sections[1], ',') {
+		kv := splitUnescaped(field, '=')
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("%w field %q", ErrMalformed, field)
+		}
+		v, ok, err := influxValue(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		name := measurement + "." + unescapeInflux(kv[0])
+		if !r.valid(name) {
+			return nil, ErrInvalidName
+		}
+		m := Metric{Name: name, Value: v, Mean: v, Time: t, Count: 1, Tags: tags}
+		if i, ok := influxInt(kv[1]); ok {
+			m.SetInt(i)
+		}
+		metrics = append(metrics, m)
+	}
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("%w, no numeric fields", ErrMissingValues)
+	}
+	return metrics, nil
+}
+
+// Converts a field value to a float. ok is false for string fields which
+// can't be aggregated.
+func influxValue(s string) (v float64, ok bool, err error) {
+	switch {
+	case s[0] == '"':
+		return 0, false, nil
+	case s == "t" || s == "T" || s == "true" || s == "True" || s == "TRUE":
+		return 1, true, nil
+	case s == "f" || s == "F" || s == "false" || s == "False" || s == "FALSE":
+		return 0, true, nil
+	case strings.HasSuffix(s, "i"):
+		i, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%w not integer", ErrInvalidValue)
+		}
+		return float64(i), true, nil
+	case strings.HasSuffix(s, "u"):
+		u, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%w not unsigned", ErrInvalidValue)
+		}
+		return float64(u), true, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w not float", ErrInvalidValue)
+	}
+	return f, true, nil
+}
+
+// Returns the exact value of integer and unsigned fields that fit an int64
+func influxInt(s string) (int64, bool) {
+	switch {
+	case strings.HasSuffix(s, "i"):
+		i, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return i, err == nil
+	case strings.HasSuffix(s, "u"):
+		i, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// Splits on sep unless it is escaped with a backslash or inside a double
+// quoted string field
+func splitUnescaped(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Removes the backslash escapes from measurement, tag and field names
+func unescapeInflux(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
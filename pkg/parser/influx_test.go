@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+type influxTestCase struct {
+	input  string
+	names  []string
+	values []float64
+	hasErr bool
+}
+
+var influxTestCases = []influxTestCase{
+	{
+		"cpu,host=web-1,region=us-east usage_user=12.5,usage_idle=80i 1451606400000000000",
+		[]string{"cpu.usage_user", "cpu.usage_idle"},
+		[]float64{12.5, 80},
+		false,
+	},
+	{
+		`disk,path=/var\ log free=1024u,healthy=t,label="a, b=c"`,
+		[]string{"disk.free", "disk.healthy"},
+		[]float64{1024, 1},
+		false,
+	},
+	{"cpu usage=1", []string{"cpu.usage"}, []float64{1}, false},
+	{`cpu label="only strings"`, nil, nil, true},
+	{"cpu", nil, nil, true},
+	{"cpu usage=", nil, nil, true},
+	{"cpu usage=abc", nil, nil, true},
+	{"cpu usage=1 yesterday", nil, nil, true},
+	{"cpu,host usage=1", nil, nil, true},
+	{"cpu usage!=1", nil, nil, true},
+}
+
+func TestParseInflux(t *testing.T) {
+	for _, tc := range influxTestCases {
+		metrics, err := ParseInflux(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("parseInflux(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if len(metrics) != len(tc.names) {
+			t.Errorf("parseInflux(%s); got %d metrics, want %d", tc.input, len(metrics), len(tc.names))
+			continue
+		}
+		for i, m := range metrics {
+			if m.Name != tc.names[i] || m.Value != tc.values[i] {
+				t.Errorf("parseInflux(%s)[%d]; got %s %v, want %s %v", tc.input, i, m.Name, m.Value, tc.names[i], tc.values[i])
+			}
+		}
+	}
+
+	metrics, _ := ParseInflux("cpu usage=1 1451606400000000001")
+	if want := time.Date(2016, 1, 1, 0, 0, 0, 1, time.UTC); !metrics[0].Time.Equal(want) {
+		t.Errorf("parseInflux() time; got %v, want %v", metrics[0].Time, want)
+	}
+}
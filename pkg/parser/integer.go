@@ -0,0 +1,66 @@
+package parser
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Parses the comma separated -integer-metrics globs
+func ParseIntegerMetrics(list string) ([]string, error) {
+	return parseGlobs(list)
+}
+
+func parseGlobs(list string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a value field into m. A value with an i suffix, like influx's
+// integer fields, or any value of a metric matching -integer-metrics is an
+// exact int64. Everything else is a float.
+func setValue(m *Metric, s string, r rules) error {
+	integer := strings.HasSuffix(s, "i")
+	if integer || matchesAny(r.IntegerMetrics, m.Name) {
+		i, err := strconv.ParseInt(strings.TrimSuffix(s, "i"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w not integer", ErrInvalidValue)
+		}
+		m.SetInt(i)
+		return nil
+	}
+	v, err := parseValue(s, r.Locales)
+	if err != nil {
+		return fmt.Errorf("%w not float", ErrInvalidValue)
+	}
+	m.Value, m.Mean = v, v
+	return nil
+}
+
+// Makes m an integer metric holding i
+func (m *Metric) SetInt(i int64) {
+	m.Integer = true
+	m.IntValue = i
+	m.Value = float64(i)
+	m.Mean = m.Value
+}
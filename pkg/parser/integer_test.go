@@ -0,0 +1,41 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIntegerMetrics(t *testing.T) {
+	integers, _ := ParseIntegerMetrics("bytes-*")
+	parse, _ := Format("tsv", Options{IntegerMetrics: integers})
+	now := time.Now().UTC().Format(ISO8601Format)
+
+	// float64 can't hold 2^53+1, the integer path must
+	big := "9007199254740993"
+	cases := []struct {
+		line    string
+		integer bool
+		err     bool
+	}{
+		{"rx\t" + big + "i\t" + now, true, false},
+		{"bytes-rx\t" + big + "\t" + now, true, false},
+		{"bytes-rx\t1.5\t" + now, false, true},
+		{`{"name":"bytes-rx","value":` + big + `,"time":"` + now + `"}`, true, false},
+		{"rx\t1.5i\t" + now, false, true},
+		{"rx\t1.5\t" + now, false, false},
+	}
+	for _, tc := range cases {
+		metrics, err := parse(tc.line)
+		if (err != nil) != tc.err {
+			t.Errorf("parse(%s); got error %v, want error %v", tc.line, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m := metrics[0]; m.Integer != tc.integer || (m.Integer && m.IntValue != 9007199254740993) {
+			t.Errorf("parse(%s); got integer %v %d", tc.line, m.Integer, m.IntValue)
+		}
+	}
+
+}
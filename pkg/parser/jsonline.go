@@ -0,0 +1,180 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonMetric is the wire form of a JSON input line
+type jsonMetric struct {
+	Name   string            `json:"name"`
+	Value  json.RawMessage   `json:"value"`
+	Time   json.RawMessage   `json:"time"`
+	Type   string            `json:"type,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	Weight int               `json:"weight,omitempty"`
+	// who sent a metric a peer forwarded
+	Producer string `json:"producer,omitempty"`
+	Client   string `json:"client,omitempty"`
+}
+
+// Parse a JSON input line: {"name":"...","value":1.5,"time":"2006-01-02T15:04:05Z"}
+// with the time in any form ParseTime accepts, as a string or a number, and an optional "type" and "weight" as in ParseTSV and "tags" object of string values.
+// The value of a set is a string.
+func ParseJSON(line string) (*Metric, error) {
+	return parseJSON(line, rules{valid: ValidateName}, false)
+}
+
+// Parses the JSON line of a metric forwarded by another collector of a
+// cluster, whose name may be any a listener's format or NamePolicy allows
+func ParsePeer(line string) (*Metric, error) {
+	return parseJSON(line, rules{valid: validPeerName}, true)
+}
+
+// Appends the JSON lines ParsePeer reads of a metric, its time to the
+// nanosecond and who sent it. A set's members are a line each.
+func AppendPeer(b []byte, m Metric) ([]byte, error) {
+	if !validPeerName(m.Name) {
+		return b, fmt.Errorf("%w %q", ErrInvalidName, m.Name)
+	}
+	jm := jsonMetric{Name: m.Name, Time: json.RawMessage(strconv.Quote(m.Time.UTC().Format(time.RFC3339Nano))), Producer: m.Producer, Client: m.Client}
+	if m.Type != Untyped {
+		jm.Type = m.Type.String()
+	}
+	if m.Weight > 1 {
+		jm.Weight = m.Weight
+	}
+	if m.Tags != "" {
+		jm.Tags = make(map[string]string)
+		for _, kv := range strings.Split(m.Tags, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			jm.Tags[k] = v
+		}
+	}
+	var values []json.RawMessage
+	switch {
+	case m.Type == Set:
+		for member := range m.Members {
+			v, _ := json.Marshal(member)
+			values = append(values, v)
+		}
+	case m.Integer:
+		values = append(values, strconv.AppendInt(nil, m.IntValue, 10))
+	case math.IsNaN(m.Value) || math.IsInf(m.Value, 0):
+		return b, fmt.Errorf("%w the value of %s is %v", ErrInvalidValue, m.Name, m.Value)
+	default:
+		values = append(values, strconv.AppendFloat(nil, m.Value, 'g', -1, 64))
+	}
+	for _, v := range values {
+		jm.Value = v
+		line, err := json.Marshal(jm)
+		if err != nil {
+			return b, err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	return b, nil
+}
+
+// Only a peer's line is taken at its word on who sent the metric
+func parseJSON(line string, r rules, peer bool) (*Metric, error) {
+	var jm jsonMetric
+	if err := json.Unmarshal([]byte(line), &jm); err != nil {
+		return nil, fmt.Errorf("%w json", ErrMalformed)
+	}
+	if jm.Name == "" || len(jm.Value) == 0 || string(jm.Value) == "null" || len(jm.Time) == 0 || string(jm.Time) == "null" {
+		return nil, ErrMissingValues
+	}
+
+	if !r.valid(jm.Name) {
+		return nil, ErrInvalidName
+	}
+
+	typ, err := ParseType(jm.Type)
+	if err != nil {
+		return nil, err
+	}
+	if jm.Weight < 0 || jm.Weight > 1 && typ == Set {
+		return nil, fmt.Errorf("%w weight %d", ErrInvalidValue, jm.Weight)
+	}
+	m := &Metric{Name: jm.Name, Count: 1, Type: typ, Weight: jm.Weight}
+	if peer {
+		m.Producer, m.Client = jm.Producer, jm.Client
+	}
+	if len(jm.Tags) > 0 {
+		pairs := make([][2]string, 0, len(jm.Tags))
+		for k, v := range jm.Tags {
+			pairs = append(pairs, [2]string{k, v})
+		}
+		if m.Tags, err = CanonicalTags(pairs); err != nil {
+			return nil, err
+		}
+	}
+	if typ == Set {
+		var member string
+		if err := json.Unmarshal(jm.Value, &member); err != nil {
+			return nil, fmt.Errorf("%w not a string set member", ErrInvalidValue)
+		}
+		if err := setTypedValue(m, member, r); err != nil {
+			return nil, err
+		}
+	} else {
+		// the number is kept as text so integers don't pass through a float
+		if jm.Value[0] == '"' {
+			return nil, fmt.Errorf("%w not float", ErrInvalidValue)
+		}
+		if err := setValue(m, string(jm.Value), r); err != nil {
+			return nil, err
+		}
+	}
+
+	// a string or an epoch number
+	when := string(jm.Time)
+	if jm.Time[0] == '"' {
+		if err := json.Unmarshal(jm.Time, &when); err != nil {
+			return nil, fmt.Errorf("%w not a string", ErrInvalidTime)
+		}
+	}
+	t, err := ParseTime(when)
+	if err != nil {
+		return nil, err
+	}
+	m.Time = t
+
+	return m, nil
+}
+
+// Parses either a tab separated or a JSON line. Metric names can never start
+// with '{' so the format is detected from the first byte of each line,
+// letting scripts send JSON to the default listener without extra config.
+func ParseDefault(line string) (*Metric, error) {
+	if len(line) > 0 && line[0] == '{' {
+		return ParseJSON(line)
+	}
+	return ParseTSV(line)
+}
+
+// ParseDefault as a Func, a tsv line is parsed straight into the slice
+// returned rather than copied there
+func parseDefaultLine(line string) ([]Metric, error) {
+	return parseDefaultNames(line, rules{valid: ValidateName})
+}
+
+func parseDefaultNames(line string, r rules) ([]Metric, error) {
+	if len(line) > 0 && line[0] == '{' {
+		m, err := parseJSON(line, r, false)
+		if err != nil {
+			return nil, err
+		}
+		return []Metric{*m}, nil
+	}
+	metrics := make([]Metric, 1)
+	if err := parseTSVInto(&metrics[0], line, r); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
@@ -0,0 +1,56 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type jsonTestCase struct {
+	input  string
+	name   string
+	value  float64
+	hasErr bool
+}
+
+var jsonTestCases = []jsonTestCase{
+	{`{"name":"asdf","value":1.5,"time":"2016-01-01T00:00:00Z"}`, "asdf", 1.5, false},
+	{`{"time":"2016-01-01T00:00:00Z","value":0,"name":"asdf-asdf"}`, "asdf-asdf", 0, false},
+	{"asdf\t2\t2016-01-01T00:00:00Z", "asdf", 2, false},
+	{`{"name":"asdf","time":"2016-01-01T00:00:00Z"}`, "", 0, true},
+	{`{"name":"-asdf","value":1,"time":"2016-01-01T00:00:00Z"}`, "", 0, true},
+	{`{"name":"asdf","value":"1","time":"2016-01-01T00:00:00Z"}`, "", 0, true},
+	{`{"name":"asdf","value":1,"time":"yesterday"}`, "", 0, true},
+	{`{"name":"asdf"`, "", 0, true},
+}
+
+func TestParseJSON(t *testing.T) {
+	for _, tc := range jsonTestCases {
+		m, err := ParseDefault(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("parseDefault(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m.Name != tc.name || m.Value != tc.value {
+			t.Errorf("parseDefault(%s); got %s %v, want %s %v", tc.input, m.Name, m.Value, tc.name, tc.value)
+		}
+	}
+}
+
+func TestPeerProducer(t *testing.T) {
+	b, err := AppendPeer(nil, Metric{Name: "cpu", Value: 1, Time: time.Unix(1714564800, 0), Producer: "web-1", Client: "web-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(b))
+	if m, err := ParsePeer(line); err != nil || m.Producer != "web-1" || m.Client != "web-1" {
+		t.Errorf("ParsePeer(%s); got %+v, %v, want it sent by web-1", line, m, err)
+	}
+	// anyone but a peer is taken for who sent the line
+	if m, err := ParseJSON(line); err != nil || m.Producer != "" || m.Client != "" {
+		t.Errorf("ParseJSON(%s); got %+v, %v, want no producer", line, m, err)
+	}
+}
@@ -0,0 +1,109 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Locale is how a region writes numbers: the decimal separator and
+// the separators allowed between groups of thousands
+type Locale struct {
+	decimal string
+	groups  []string
+}
+
+// The locales -value-locales can name
+var numberLocales = map[string]Locale{
+	// 1,234.5
+	"en": {decimal: ".", groups: []string{","}},
+	// 1.234,5, also right for most of continental Europe and South America
+	"de": {decimal: ",", groups: []string{"."}},
+	// 1 234,5 with a plain, no-break or narrow no-break space
+	"fr": {decimal: ",", groups: []string{" ", "\u00a0", "\u202f"}},
+	// 1'234.5
+	"ch": {decimal: ".", groups: []string{"'", "’"}},
+}
+
+// Parses a comma separated list of locale names
+func ParseLocales(list string) ([]Locale, error) {
+	var locales []Locale
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		loc, ok := numberLocales[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown number locale %q, want en, de, fr or ch", name)
+		}
+		locales = append(locales, loc)
+	}
+	return locales, nil
+}
+
+// Parses a metric value, falling back to the locales. The first
+// locale the value is well formed in wins, so with "en,de" 1,234 is a
+// thousand and 3,14 is pi.
+func parseValue(s string, locales []Locale) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		return v, nil
+	}
+	for _, loc := range locales {
+		if v, ok := loc.parse(s); ok {
+			return v, nil
+		}
+	}
+	return 0, err
+}
+
+// Parses a number written in the locale. Group separators must split the
+// integer part into threes so a stray separator is not silently dropped.
+func (loc Locale) parse(s string) (float64, bool) {
+	sign := ""
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		sign, s = s[:1], s[1:]
+	}
+	integer, fraction, hasDecimal := strings.Cut(s, loc.decimal)
+	if hasDecimal && (fraction == "" || !allDigits(fraction)) {
+		return 0, false
+	}
+
+	digits := integer
+	for _, sep := range loc.groups {
+		if !strings.Contains(integer, sep) {
+			continue
+		}
+		groups := strings.Split(integer, sep)
+		if len(groups[0]) < 1 || len(groups[0]) > 3 {
+			return 0, false
+		}
+		for _, g := range groups[1:] {
+			if len(g) != 3 {
+				return 0, false
+			}
+		}
+		digits = strings.Join(groups, "")
+		break
+	}
+	if digits == "" || !allDigits(digits) {
+		return 0, false
+	}
+
+	normalized := sign + digits
+	if hasDecimal {
+		normalized += "." + fraction
+	}
+	v, err := strconv.ParseFloat(normalized, 64)
+	return v, err == nil
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
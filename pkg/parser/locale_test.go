@@ -0,0 +1,43 @@
+package parser
+
+import "testing"
+
+type parseValueTestCase struct {
+	locales string
+	input   string
+	want    float64
+	err     bool
+}
+
+var parseValueTestCases = []parseValueTestCase{
+	{"", "3.14", 3.14, false},
+	{"", "3,14", 0, true},
+	{"de", "3,14", 3.14, false},
+	{"de", "-1.234,5", -1234.5, false},
+	{"de", "1.23,5", 0, true},
+	{"en", "1,234,567.5", 1234567.5, false},
+	{"en", "12,34", 0, true},
+	{"en,de", "1,234", 1234, false},
+	{"de,en", "1,234", 1.234, false},
+	{"en,de", "3,14", 3.14, false},
+	{"fr", "1 234,5", 1234.5, false},
+	{"fr", "1 234,", 0, true},
+	{"ch", "1'234.5", 1234.5, false},
+	{"ch", "1'2'34", 0, true},
+}
+
+func TestParseValue(t *testing.T) {
+	for _, tc := range parseValueTestCases {
+		locales, err := ParseLocales(tc.locales)
+		if err != nil {
+			t.Fatalf("parseNumberLocales(%s); got error %v", tc.locales, err)
+		}
+		got, err := parseValue(tc.input, locales)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("parseValue(%s) with locales %q; got %v, %v, want %v", tc.input, tc.locales, got, err, tc.want)
+		}
+	}
+	if _, err := ParseLocales("en,xx"); err == nil {
+		t.Errorf("parseNumberLocales(en,xx); got no error")
+	}
+}
@@ -0,0 +1,293 @@
+// Package parser turns the supported wire formats into metrics
+package parser
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/jeffdupont/go-challenge/pkg/hll"
+	"github.com/jeffdupont/go-challenge/pkg/tdigest"
+)
+
+// ISO8601Format is the timestamp layout of tsv and JSON lines
+const ISO8601Format = "2006-01-02T15:04:05Z"
+
+// Metric represents the parsed input data and keeps track of the count and
+// mean value of all metrics in the current collection and the last
+// timestamp inserted
+type Metric struct {
+	Name string
+	// the sum of every value in the collection
+	Value float64
+	Mean  float64
+	Time  time.Time
+	Count int
+	// the samples of the value a producer aggregated before sending it, the
+	// store folds it in as that many, 0 or 1 for a single sample
+	Weight int
+	Min    float64
+	Max    float64
+	// sum of squared deviations from the mean, see Stddev
+	M2 float64
+	// the rounding error of Value not yet folded into it, carried so long
+	// windows of small values still sum to double precision
+	Compensation float64
+	// common name of the client certificate that submitted the metric
+	Client string
+	// integer metrics also keep their running total as an exact int64,
+	// float64 loses precision past 2^53
+	Integer  bool
+	IntValue int64
+	// quantile sketch of the values, only kept when percentiles are reported
+	Digest *tdigest.TDigest
+	// how the values are aggregated, see Type
+	Type Type
+	// the value received last, by timestamp, reported for gauges
+	Last float64
+	// the distinct members of a set
+	Members map[string]struct{}
+	// a set of a -unique-metrics name, the store folds its members into the
+	// Uniques sketch rather than keeping them
+	Unique  bool
+	Uniques *hll.Sketch
+	// the values are the running total of a -rate-metrics counter,
+	// aggregated as a gauge and reported as the rate it grew at
+	Cumulative bool
+	// dimensions in the canonical form of CanonicalTags, see Key
+	Tags string
+	// the client identity, or failing that the address, that sent the metric
+	Producer string
+	// the tenant that sent the metric, stored as its tenant tag
+	Tenant string
+	// the distinct producers of the metric in the collection, only kept when
+	// the store counts them
+	Producers map[string]struct{}
+}
+
+// Returns how many distinct members a set has, estimated once they are
+// folded into a sketch
+func (m Metric) Cardinality() int {
+	if m.Uniques != nil {
+		return int(m.Uniques.Count())
+	}
+	return len(m.Members)
+}
+
+// Returns the population standard deviation of the values collected
+func (m Metric) Stddev() float64 {
+	if m.Count < 2 {
+		return 0
+	}
+	return math.Sqrt(m.M2 / float64(m.Count))
+}
+
+// Estimates the q quantile of the values collected, NaN when no digest was
+// kept for the metric
+func (m Metric) Quantile(q float64) float64 {
+	if m.Digest == nil {
+		return math.NaN()
+	}
+	return m.Digest.Quantile(q)
+}
+
+// Make sure the name contains only valid characters
+func ValidateName(str string) bool {
+	if len(str) > 64 {
+		slog.Debug("invalid input: name too long", "length", len(str))
+		return false
+	}
+	for i, r := range str {
+		// Make sure that the '-' is not the first char in the string
+		if i == 0 && r == '-' {
+			return false
+		}
+		// Using the ASCII values, we can determine if each rune is valid. We first
+		// check to see if it is outside the given ranges for 0-9, A-Z, and a-z
+		// and then finally make sure that it's not '-'
+		if !(r >= '0' && r <= '9') && !(r >= 'A' && r <= 'Z') && !(r >= 'a' && r <= 'z') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Like ValidateName but also allows the '.' and '_' separators that statsd
+// and graphite use for their hierarchical names
+func ValidateDottedName(str string) bool {
+	if len(str) == 0 || len(str) > 64 {
+		return false
+	}
+	for i, r := range str {
+		if i == 0 && (r == '-' || r == '.') {
+			return false
+		}
+		if !(r >= '0' && r <= '9') && !(r >= 'A' && r <= 'Z') && !(r >= 'a' && r <= 'z') &&
+			r != '-' && r != '.' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// Func turns a single input line into one or more metrics, each
+// listener is configured with the one matching the format its clients send
+type Func func(line string) ([]Metric, error)
+
+// Adapts a parser that produces exactly one metric per line
+func Single(parse func(string) (*Metric, error)) Func {
+	return func(line string) ([]Metric, error) {
+		m, err := parse(line)
+		if err != nil {
+			return nil, err
+		}
+		return []Metric{*m}, nil
+	}
+}
+
+// Bytes parses a line held in a buffer the caller goes on to reuse, like a
+// connection's read buffer, without copying the line first. The line is
+// parsed in place and only what the metrics keep of it, like their names
+// and tags, is copied out.
+func (parse Func) Bytes(line []byte) ([]Metric, error) {
+	metrics, err := parse(unsafe.String(unsafe.SliceData(line), len(line)))
+	for i := range metrics {
+		metrics[i].detach()
+	}
+	return metrics, err
+}
+
+// Copies the strings the metric may share with the line it was parsed from
+func (m *Metric) detach() {
+	m.Name, m.Tags = strings.Clone(m.Name), strings.Clone(m.Tags)
+	m.Producer, m.Client = strings.Clone(m.Producer), strings.Clone(m.Client)
+	if m.Members != nil {
+		members := make(map[string]struct{}, len(m.Members))
+		for member := range m.Members {
+			members[strings.Clone(member)] = struct{}{}
+		}
+		m.Members = members
+	}
+}
+
+// Parse the input line: <name>\t<value>[\t<weight>]\t<time>[\t<type>][\t<tags>]
+//
+// The optional weight is the number of samples a pre-aggregated value is
+// the mean of, told from a timestamp by the timestamp after it. The
+// optional type is a statsd type (c, g, ms, s) or its name. The value of a
+// set is its member and may be any text without tabs, a set isn't weighted.
+// Tags are key=value[,key=value...] and can be told from a type by the '='.
+func ParseTSV(line string) (*Metric, error) {
+	m := &Metric{}
+	if err := ParseTSVInto(m, line); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ParseTSV into a metric the caller provides, overwriting it. The fields
+// are scanned in place and the name is a slice of the line, so a valid line
+// with an untagged, non-set value and an ISO8601 Zulu or epoch timestamp
+// costs no allocations.
+func ParseTSVInto(m *Metric, line string) error {
+	return parseTSVInto(m, line, rules{valid: ValidateName})
+}
+
+func parseTSVInto(m *Metric, line string, r rules) error {
+	var data [6]string
+	n := 0
+	for {
+		if n == len(data) {
+			return ErrMissingValues
+		}
+		i := strings.IndexByte(line, '\t')
+		if i < 0 {
+			data[n] = line
+			n++
+			break
+		}
+		data[n], line = line[:i], line[i+1:]
+		n++
+	}
+	if n < 3 {
+		return ErrMissingValues
+	}
+
+	// validate name
+	name := data[0]
+	if !r.valid(name) {
+		return ErrInvalidName
+	}
+
+	// a weight is followed by the timestamp, where a type or tags would be.
+	// Timestamps start with a digit, types never do and tags have a '='.
+	when, rest := data[2], data[3:n]
+	var t time.Time
+	if n > 3 && data[3] != "" && data[3][0] >= '0' && data[3][0] <= '9' && strings.IndexByte(data[3], '=') < 0 {
+		var err error
+		if t, err = ParseTime(data[3]); err != nil {
+			return err
+		}
+		when, rest = "", data[4:n]
+	}
+
+	// validate value
+	*m = Metric{Name: name, Count: 1}
+	if when == "" {
+		w, err := strconv.Atoi(data[2])
+		if err != nil || w < 1 {
+			return fmt.Errorf("%w weight %q", ErrInvalidValue, data[2])
+		}
+		m.Weight = w
+	}
+	for i, f := range rest {
+		if strings.IndexByte(f, '=') >= 0 && m.Tags == "" {
+			tags, err := ParseTags(f)
+			if err != nil {
+				return err
+			}
+			m.Tags = tags
+			continue
+		}
+		// the type comes before the tags
+		if i > 0 {
+			return fmt.Errorf("%w field %q", ErrMalformed, f)
+		}
+		t, err := ParseType(f)
+		if err != nil {
+			return err
+		}
+		m.Type = t
+	}
+	if err := setTypedValue(m, data[1], r); err != nil {
+		return err
+	}
+	if m.Type == Set && m.Weight > 1 {
+		return fmt.Errorf("%w a set's member can't be weighted", ErrInvalidValue)
+	}
+
+	// validate time
+	if when != "" {
+		var err error
+		if t, err = ParseTime(when); err != nil {
+			return err
+		}
+	}
+	m.Time = t
+
+	return nil
+}
+
+// The line formats a listener can be configured with
+var Formats = map[string]Func{
+	"tsv":      parseDefaultLine,
+	"statsd":   Single(ParseStatsd),
+	"graphite": Single(ParseGraphite),
+	"influx":   ParseInflux,
+	"syslog":   ParseSyslog,
+	"peer":     Single(ParsePeer),
+}
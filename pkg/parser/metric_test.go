@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTSVInto(t *testing.T) {
+	m := Metric{Tags: "stale=true", Count: 7, Members: map[string]struct{}{"a": {}}}
+	if err := ParseTSVInto(&m, "cpu-load\t0.75\t2024-05-01T12:00:00Z\tg"); err != nil {
+		t.Fatalf("ParseTSVInto(); got error %v", err)
+	}
+	want := Metric{Name: "cpu-load", Value: 0.75, Mean: 0.75, Count: 1, Type: Gauge, Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	if m.Name != want.Name || m.Value != want.Value || m.Mean != want.Mean || m.Count != 1 || m.Type != Gauge || !m.Time.Equal(want.Time) || m.Tags != "" || m.Members != nil {
+		t.Errorf("ParseTSVInto(); got %+v, want %+v", m, want)
+	}
+	for _, line := range []string{
+		"cpu-load\t0.75",
+		"cpu-load\t0.75\t2024-05-01T12:00:00Z\tg\ta=b\tc=d",
+		"cpu-load\t0.75\t2024-05-01T12:00:00Z\ta=b\tg",
+		"cpu-load\t0.75\t0\t2024-05-01T12:00:00Z",
+		"cpu-load\t0.75\t2.5\t2024-05-01T12:00:00Z",
+		"users\tbob\t3\t2024-05-01T12:00:00Z\ts",
+	} {
+		if err := ParseTSVInto(&m, line); err == nil {
+			t.Errorf("ParseTSVInto(%q); got nil error", line)
+		}
+	}
+}
+
+func TestParseTSVWeight(t *testing.T) {
+	var m Metric
+	for _, line := range []string{
+		"latency\t0.25\t40\t2024-05-01T12:00:00Z\tms\thost=a",
+		"latency\t0.25\t40\t1714564800\tms\thost=a",
+	} {
+		if err := ParseTSVInto(&m, line); err != nil {
+			t.Fatalf("ParseTSVInto(%q); got error %v", line, err)
+		}
+		if m.Value != 0.25 || m.Count != 1 || m.Weight != 40 || m.Type != Timer || m.Tags != "host=a" || m.Time.Unix() != 1714564800 {
+			t.Errorf("ParseTSVInto(%q); got %+v, want 0.25 weighted 40", line, m)
+		}
+	}
+	// the third field of an unweighted line is still its time
+	if err := ParseTSVInto(&m, "latency\t0.25\t1714564800\tms"); err != nil || m.Weight != 0 || m.Time.Unix() != 1714564800 {
+		t.Errorf("ParseTSVInto() unweighted; got %+v, %v", m, err)
+	}
+
+	b, err := AppendPeer(nil, Metric{Name: "latency", Value: 0.25, Weight: 40, Time: time.Unix(1714564800, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ParsePeer(string(b[:len(b)-1])); err != nil || p.Weight != 40 || p.Value != 0.25 {
+		t.Errorf("ParsePeer(%s); got %+v, %v", b, p, err)
+	}
+}
+
+func TestFuncBytes(t *testing.T) {
+	buf := []byte("users\tbob\t2024-05-01T12:00:00Z\ts\thost=a;cpu\t1\t2024-05-01T12:00:00Z")
+	metrics, err := Batch(Formats["tsv"], ";").Bytes(buf)
+	if err != nil || len(metrics) != 2 {
+		t.Fatalf("Bytes(); got %v, %v", metrics, err)
+	}
+	// the buffer is reused for the next line, the metrics keep their own
+	// copies
+	for i := range buf {
+		buf[i] = 'x'
+	}
+	if m := metrics[0]; m.Name != "users" || m.Tags != "host=a" || len(m.Members) != 1 {
+		t.Errorf("Bytes() then the buffer reused; got %+v", m)
+	} else if _, ok := m.Members["bob"]; !ok {
+		t.Errorf("Bytes() then the buffer reused; got members %v", m.Members)
+	}
+	if metrics[1].Name != "cpu" {
+		t.Errorf("Bytes() then the buffer reused; got %q, want cpu", metrics[1].Name)
+	}
+}
+
+// A line must parse in well under a microsecond, without allocating, for a
+// connection to keep up with a million lines a second
+func BenchmarkParseTSVInto(b *testing.B) {
+	b.ReportAllocs()
+	var m Metric
+	for i := 0; i < b.N; i++ {
+		if err := ParseTSVInto(&m, "cpu-load\t0.75\t2024-05-01T12:00:00Z"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseTSVIntoEpoch(b *testing.B) {
+	b.ReportAllocs()
+	var m Metric
+	for i := 0; i < b.N; i++ {
+		if err := ParseTSVInto(&m, "cpu-load\t0.75\t1714564800250\tms"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The tsv listener's Func, which has to hand back a slice
+func BenchmarkFormatTSV(b *testing.B) {
+	b.ReportAllocs()
+	parse := Formats["tsv"]
+	for i := 0; i < b.N; i++ {
+		if _, err := parse("cpu-load\t0.75\t2024-05-01T12:00:00Z"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxNameLength is the longest name a NamePolicy may allow
+const MaxNameLength = 1024
+
+// NamePolicy is what the names of a listener's metrics may be made of, in
+// place of the rules of its format. The zero NamePolicy keeps those.
+type NamePolicy struct {
+	// the punctuation allowed besides letters and digits, "-._" when empty.
+	// A name never starts with '-' or '.'.
+	Punct string
+	// letters and digits of any script, by unicode.IsLetter and
+	// unicode.IsDigit, rather than only ASCII ones
+	Unicode bool
+	// the longest name in bytes, 0 for 64
+	MaxLength int
+}
+
+// IsZero reports whether the policy keeps the format's rules
+func (p NamePolicy) IsZero() bool {
+	return p == NamePolicy{}
+}
+
+// Check returns an error if the policy allows spaces or control characters,
+// which no line format could carry, or names too long
+func (p NamePolicy) Check() error {
+	for _, r := range p.Punct {
+		if !unicode.IsPunct(r) && !unicode.IsSymbol(r) {
+			return fmt.Errorf("name punctuation %q isn't punctuation", r)
+		}
+	}
+	if p.MaxLength < 0 || p.MaxLength > MaxNameLength {
+		return fmt.Errorf("name max length must be between 1 and %d", MaxNameLength)
+	}
+	return nil
+}
+
+// Valid reports whether the policy allows the name
+func (p NamePolicy) Valid(name string) bool {
+	maxLength, punct := p.MaxLength, p.Punct
+	if maxLength == 0 {
+		maxLength = 64
+	}
+	if punct == "" {
+		punct = "-._"
+	}
+	if name == "" || len(name) > maxLength || !utf8.ValidString(name) {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case i == 0 && (r == '-' || r == '.'):
+			return false
+		case r >= '0' && r <= '9', r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z':
+		case p.Unicode && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		case strings.ContainsRune(punct, r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether the name is one a peer may forward, one that some
+// NamePolicy allows
+func validPeerName(name string) bool {
+	if name == "" || len(name) > MaxNameLength || !utf8.ValidString(name) || name[0] == '-' || name[0] == '.' {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Options are how the lines of a listener are read beyond their format.
+// The zero Options keep the format's own rules.
+type Options struct {
+	// the names allowed, the format's own rules when zero
+	Names NamePolicy
+	// tried in order on values that don't parse as a plain float, empty
+	// means values must be plain floats
+	Locales []Locale
+	// the -integer-metrics name globs whose values are always parsed as
+	// integers
+	IntegerMetrics []string
+	// the -unique-metrics name globs whose untyped values are members of a
+	// set counted approximately, see Metric.Unique
+	UniqueMetrics []string
+	// the -rate-metrics name globs whose untyped values are cumulative
+	// counters, see Metric.Cumulative
+	RateMetrics []string
+}
+
+// IsZero reports whether the options keep the format's rules
+func (o Options) IsZero() bool {
+	return o.Names.IsZero() && len(o.Locales) == 0 && len(o.IntegerMetrics) == 0 &&
+		len(o.UniqueMetrics) == 0 && len(o.RateMetrics) == 0
+}
+
+// rules are the options a parser goes by, with the check of the names
+// settled
+type rules struct {
+	Options
+	valid func(string) bool
+}
+
+// Returns the rules of the options, names being checked by valid when the
+// policy is zero
+func (o Options) rules(valid func(string) bool) rules {
+	if !o.Names.IsZero() {
+		valid = o.Names.Valid
+	}
+	return rules{Options: o, valid: valid}
+}
+
+// Format returns the parser of the format going by the options, the
+// format's own when they are zero. False if there is no such line format.
+func Format(format string, o Options) (Func, bool) {
+	if o.IsZero() {
+		parse, ok := Formats[format]
+		return parse, ok
+	}
+	switch format {
+	case "tsv":
+		r := o.rules(ValidateName)
+		return func(line string) ([]Metric, error) { return parseDefaultNames(line, r) }, true
+	case "statsd":
+		r := o.rules(ValidateDottedName)
+		return Single(func(line string) (*Metric, error) { return parseStatsd(line, r) }), true
+	case "graphite":
+		r := o.rules(ValidateDottedName)
+		return Single(func(line string) (*Metric, error) { return parseGraphite(line, r) }), true
+	case "influx":
+		r := o.rules(ValidateDottedName)
+		return func(line string) ([]Metric, error) { return parseInflux(line, r) }, true
+	case "syslog":
+		return SyslogFormat(nil, o), true
+	case "peer":
+		// the names were checked and the values read where they came in
+		return Formats[format], true
+	}
+	return nil, false
+}
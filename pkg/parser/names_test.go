@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNamePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy NamePolicy
+		name   string
+		want   bool
+	}{
+		{NamePolicy{Unicode: true}, "température.cpu_0", true},
+		{NamePolicy{Unicode: true}, "温度", true},
+		{NamePolicy{}, "温度", false},
+		{NamePolicy{Punct: ":/"}, "http:/status", true},
+		{NamePolicy{Punct: ":/"}, "cpu.load", false},
+		{NamePolicy{Unicode: true}, "-cpu", false},
+		{NamePolicy{Unicode: true}, ".cpu", false},
+		{NamePolicy{Unicode: true}, "cpu load", false},
+		{NamePolicy{MaxLength: 100}, strings.Repeat("a", 100), true},
+		{NamePolicy{MaxLength: 100}, strings.Repeat("a", 101), false},
+		{NamePolicy{Unicode: true}, strings.Repeat("a", 65), false},
+	} {
+		if got := tc.policy.Valid(tc.name); got != tc.want {
+			t.Errorf("%+v.Valid(%q); got %v, want %v", tc.policy, tc.name, got, tc.want)
+		}
+	}
+
+	for _, bad := range []NamePolicy{{Punct: " "}, {Punct: "a"}, {MaxLength: MaxNameLength + 1}} {
+		if bad.Check() == nil {
+			t.Errorf("%+v.Check(); want an error", bad)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	policy := NamePolicy{Unicode: true, Punct: "-._:"}
+	for format, line := range map[string]string{
+		"tsv":      "cpu:température\t1\t2024-05-01T12:00:00Z",
+		"statsd":   "cpu:température:1|c",
+		"graphite": "cpu:température 1 1714564800",
+		"influx":   "cpu:température value=1 1714564800000000000",
+	} {
+		parse, ok := Format(format, Options{Names: policy})
+		if !ok {
+			t.Fatalf("Format(%s); got no parser", format)
+		}
+		if _, err := parse(line); format != "statsd" && err != nil {
+			t.Errorf("%s with the policy: %q; got error %v", format, line, err)
+		}
+		// the format's own rules turn the name away
+		if _, err := Formats[format](line); !errors.Is(err, ErrInvalidName) && format != "statsd" {
+			t.Errorf("%s: %q; got error %v, want an invalid name", format, line, err)
+		}
+	}
+	// statsd's name ends at the first colon
+	parse, _ := Format("statsd", Options{Names: policy})
+	if m, err := parse("température:1|c"); err != nil || m[0].Name != "température" {
+		t.Errorf("statsd with the policy; got %v, %v", m, err)
+	}
+	if _, ok := Format("protobuf", Options{Names: policy}); ok {
+		t.Error("Format(protobuf); want no line parser")
+	}
+
+	// a peer forwards whatever name a policy allowed
+	b, err := AppendPeer(nil, Metric{Name: "cpu:température", Type: Gauge, Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := ParsePeer(strings.TrimSpace(string(b))); err != nil || m.Name != "cpu:température" {
+		t.Errorf("ParsePeer(%s); got %v, %v", b, m, err)
+	}
+}
@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Largest frame a protobuf client may send, anything bigger is treated as a
+// corrupt length prefix rather than allocated
+const maxFrameSize = 4 << 20
+
+// Protobuf wire types used by proto/metrics.proto
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Reads varint length prefixed MetricBatch frames until the stream ends,
+// calling fn with every metric. The frame buffer is reused between frames and
+// metrics are decoded straight from it.
+func ReadBatches(r *bufio.Reader, fn func(Metric)) error {
+	var frame []byte
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		if size > maxFrameSize {
+			return fmt.Errorf("%w, frame of %d bytes exceeds %d", ErrTooLong, size, maxFrameSize)
+		}
+		if cap(frame) < int(size) {
+			frame = make([]byte, size)
+		}
+		frame = frame[:size]
+		if _, err := io.ReadFull(r, frame); err != nil {
+			// a frame cut short is corruption, not a clean end of stream
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := decodeBatch(frame, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// Decodes a MetricBatch, validating each metric before it is passed to fn.
+// A bad metric rejects the rest of the batch.
+func decodeBatch(b []byte, fn func(Metric)) error {
+	for len(b) > 0 {
+		field, wire, n := protoTag(b)
+		if n <= 0 {
+			return errMalformedFrame
+		}
+		b = b[n:]
+		if field != 1 || wire != wireBytes {
+			if n = protoSkip(b, wire); n < 0 {
+				return errMalformedFrame
+			}
+			b = b[n:]
+			continue
+		}
+
+		msg, n := protoBytes(b)
+		if n <= 0 {
+			return errMalformedFrame
+		}
+		b = b[n:]
+		m, err := decodeMetric(msg)
+		if err != nil {
+			return err
+		}
+		fn(m)
+	}
+	return nil
+}
+
+var errMalformedFrame = fmt.Errorf("%w protobuf frame", ErrMalformed)
+
+func decodeMetric(b []byte) (Metric, error) {
+	var (
+		name    []byte
+		value   float64
+		nanos   int64
+		hasTime bool
+	)
+	for len(b) > 0 {
+		field, wire, n := protoTag(b)
+		if n <= 0 {
+			return Metric{}, errMalformedFrame
+		}
+		b = b[n:]
+		switch {
+		case field == 1 && wire == wireBytes:
+			name, n = protoBytes(b)
+		case field == 2 && wire == wireFixed64:
+			if n = 8; len(b) < n {
+				return Metric{}, errMalformedFrame
+			}
+			value = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		case field == 3 && wire == wireVarint:
+			var v uint64
+			v, n = binary.Uvarint(b)
+			nanos, hasTime = int64(v), true
+		default:
+			n = protoSkip(b, wire)
+		}
+		if n <= 0 {
+			return Metric{}, errMalformedFrame
+		}
+		b = b[n:]
+	}
+
+	if len(name) == 0 || !hasTime {
+		return Metric{}, ErrMissingValues
+	}
+	if !ValidateName(string(name)) {
+		return Metric{}, ErrInvalidName
+	}
+	t := time.Unix(0, nanos).UTC()
+	return Metric{Name: string(name), Value: value, Mean: value, Time: t, Count: 1}, nil
+}
+
+// Returns the field number and wire type of the tag at the start of b along
+// with its length, which is <= 0 if it is malformed
+func protoTag(b []byte) (field uint64, wire int, n int) {
+	v, n := binary.Uvarint(b)
+	return v >> 3, int(v & 7), n
+}
+
+// Returns the length delimited value at the start of b and the number of
+// bytes it took up, or n <= 0 if it is malformed
+func protoBytes(b []byte) ([]byte, int) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || size > uint64(len(b)-n) {
+		return nil, -1
+	}
+	return b[n : n+int(size)], n + int(size)
+}
+
+// Returns how many bytes the value of the given wire type takes up, or -1
+func protoSkip(b []byte, wire int) int {
+	switch wire {
+	case wireVarint:
+		_, n := binary.Uvarint(b)
+		return n
+	case wireFixed64:
+		if len(b) < 8 {
+			return -1
+		}
+		return 8
+	case wireBytes:
+		_, n := protoBytes(b)
+		return n
+	case wireFixed32:
+		if len(b) < 4 {
+			return -1
+		}
+		return 4
+	}
+	return -1
+}
+
+// Appends the metrics as a varint length prefixed MetricBatch frame
+func AppendBatchFrame(b []byte, metrics []Metric) []byte {
+	var batch []byte
+	for _, m := range metrics {
+		var msg []byte
+		msg = binary.AppendUvarint(msg, 1<<3|wireBytes)
+		msg = binary.AppendUvarint(msg, uint64(len(m.Name)))
+		msg = append(msg, m.Name...)
+		msg = binary.AppendUvarint(msg, 2<<3|wireFixed64)
+		msg = binary.LittleEndian.AppendUint64(msg, math.Float64bits(m.Value))
+		msg = binary.AppendUvarint(msg, 3<<3|wireVarint)
+		msg = binary.AppendUvarint(msg, uint64(m.Time.UnixNano()))
+
+		batch = binary.AppendUvarint(batch, 1<<3|wireBytes)
+		batch = binary.AppendUvarint(batch, uint64(len(msg)))
+		batch = append(batch, msg...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(batch)))
+	return append(b, batch...)
+}
@@ -0,0 +1,51 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadBatches(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 1, time.UTC)
+	want := []Metric{
+		{Name: "asdf", Value: 1.5, Time: now},
+		{Name: "asdf-asdf", Value: -2, Time: now.Add(time.Second)},
+	}
+	stream := AppendBatchFrame(nil, want[:1])
+	stream = AppendBatchFrame(stream, want[1:])
+
+	var got []Metric
+	err := ReadBatches(bufio.NewReader(bytes.NewReader(stream)), func(m Metric) {
+		got = append(got, m)
+	})
+	if err != io.EOF {
+		t.Errorf("readBatches(); got error %v, want EOF", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("readBatches(); got %d metrics, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || got[i].Value != want[i].Value || !got[i].Time.Equal(want[i].Time) {
+			t.Errorf("readBatches()[%d]; got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadBatchesInvalid(t *testing.T) {
+	valid := AppendBatchFrame(nil, []Metric{{Name: "asdf", Value: 1, Time: time.Now()}})
+	cases := map[string][]byte{
+		"truncated frame": valid[:len(valid)-1],
+		"bad name":        AppendBatchFrame(nil, []Metric{{Name: "-asdf", Value: 1, Time: time.Now()}}),
+		"oversized frame": {0xff, 0xff, 0xff, 0x7f},
+		"garbage":         {0x03, 0x0a, 0xff, 0x01},
+	}
+	for desc, input := range cases {
+		err := ReadBatches(bufio.NewReader(bytes.NewReader(input)), func(Metric) {})
+		if err == nil || err == io.EOF {
+			t.Errorf("readBatches(%s); got %v, want an error", desc, err)
+		}
+	}
+}
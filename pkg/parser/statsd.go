@@ -0,0 +1,80 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse a statsd line: <name>:<value>|<type>[|@<sample rate>][|#<key>:<value>,...]
+//
+// statsd has no timestamps so the metric is stamped with the time it was
+// received. Counters are scaled up by their sample rate so the reported mean
+// reflects what the client actually counted.
+func ParseStatsd(line string) (*Metric, error) {
+	return parseStatsd(line, rules{valid: ValidateDottedName})
+}
+
+func parseStatsd(line string, r rules) (*Metric, error) {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return nil, ErrMissingValues
+	}
+	name := line[:colon]
+	if !r.valid(name) {
+		return nil, ErrInvalidName
+	}
+
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w, no type", ErrMissingValues)
+	}
+
+	rate := 1.0
+	var tags [][2]string
+	for _, f := range fields[2:] {
+		if strings.HasPrefix(f, "@") {
+			r, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return nil, fmt.Errorf("%w not a sample rate", ErrInvalidValue)
+			}
+			rate = r
+		}
+		// dogstatsd style #key:value tags, those without a value are
+		// accepted but not kept
+		if strings.HasPrefix(f, "#") {
+			for _, t := range strings.Split(f[1:], ",") {
+				if k, v, ok := strings.Cut(t, ":"); ok {
+					tags = append(tags, [2]string{k, v})
+				}
+			}
+		}
+	}
+	canonical, err := CanonicalTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	typ, err := ParseType(fields[1])
+	if err != nil || len(fields[1]) > 2 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, fields[1])
+	}
+	m := &Metric{Name: name, Time: time.Now().UTC(), Count: 1, Type: typ, Tags: canonical}
+	if typ == Set {
+		if err := setTypedValue(m, fields[0], r); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	v, err := parseValue(fields[0], r.Locales)
+	if err != nil {
+		return nil, fmt.Errorf("%w not float", ErrInvalidValue)
+	}
+	if typ == Counter {
+		v = v / rate
+	}
+	m.Value, m.Mean = v, v
+	return m, nil
+}
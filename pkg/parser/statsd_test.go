@@ -0,0 +1,42 @@
+package parser
+
+import "testing"
+
+type statsdTestCase struct {
+	input  string
+	name   string
+	value  float64
+	hasErr bool
+}
+
+var statsdTestCases = []statsdTestCase{
+	{"api.requests:1|c", "api.requests", 1, false},
+	{"api.requests:1|c|@0.1", "api.requests", 10, false},
+	{"queue_depth:42|g", "queue_depth", 42, false},
+	{"queue_depth:-3|g|#env:prod", "queue_depth", -3, false},
+	{"db.query-time:320|ms|@0.5", "db.query-time", 320, false},
+	{"users:asdf|s", "users", 1, false},
+	{"api.requests:1|counter", "", 0, true},
+	{"api.requests:1", "", 0, true},
+	{"api.requests:x|c", "", 0, true},
+	{"api.requests:1|c|@2", "", 0, true},
+	{"-api:1|c", "", 0, true},
+	{"api requests:1|c", "", 0, true},
+	{"api.requests:1|q", "", 0, true},
+}
+
+func TestParseStatsd(t *testing.T) {
+	for _, tc := range statsdTestCases {
+		m, err := ParseStatsd(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("parseStatsd(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m.Name != tc.name || m.Value != tc.value {
+			t.Errorf("parseStatsd(%s); got %s %v, want %s %v", tc.input, m.Name, m.Value, tc.name, tc.value)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse an RFC 5424 syslog message, one a line:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+//
+// Every structured data element with the id metric, or metric@ an
+// enterprise number, is a metric of its name and value params, its time
+// param or else the message's TIMESTAMP, and its other params as tags:
+//
+//	<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [metric@32473 name="cpu.load" value="1.5" core="0"]
+//
+// A message whose TIMESTAMP is "-" is taken as received. A message without
+// metric elements is rejected, see SyslogFormat for taking its metric from
+// the text.
+func ParseSyslog(line string) ([]Metric, error) {
+	return parseSyslog(line, nil, rules{valid: ValidateDottedName})
+}
+
+// SyslogFormat returns the parser of syslog messages that also matches the
+// pattern, when it isn't nil, against the text of those without metric
+// elements. Its name and value groups are the metric's, a time group its
+// timestamp and any other named group a tag. The metrics are read by the
+// options.
+func SyslogFormat(pattern *regexp.Regexp, o Options) Func {
+	r := o.rules(ValidateDottedName)
+	return func(line string) ([]Metric, error) { return parseSyslog(line, pattern, r) }
+}
+
+// CheckSyslogPattern returns an error unless the pattern has the name and
+// value groups SyslogFormat needs
+func CheckSyslogPattern(pattern *regexp.Regexp) error {
+	groups := pattern.SubexpNames()
+	for _, want := range []string{"name", "value"} {
+		if pattern.SubexpIndex(want) < 0 {
+			return fmt.Errorf("syslog pattern %q has no (?P<%s>...) group", pattern, want)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, group := range groups[1:] {
+		if group != "" && seen[group] {
+			return fmt.Errorf("syslog pattern %q repeats the group %s", pattern, group)
+		}
+		seen[group] = true
+	}
+	return nil
+}
+
+func parseSyslog(line string, pattern *regexp.Regexp, r rules) ([]Metric, error) {
+	// the priority, then the version
+	end := strings.IndexByte(line, '>')
+	if len(line) < 3 || line[0] != '<' || end < 2 || end > 4 {
+		return nil, fmt.Errorf("%w syslog priority", ErrMalformed)
+	}
+	if pri, err := strconv.Atoi(line[1:end]); err != nil || pri > 191 {
+		return nil, fmt.Errorf("%w syslog priority", ErrMalformed)
+	}
+	fields := strings.SplitN(line[end+1:], " ", 7)
+	if len(fields) < 7 || fields[0] != "1" {
+		return nil, fmt.Errorf("%w, not an RFC 5424 syslog message", ErrMalformed)
+	}
+	when := time.Now().UTC()
+	if fields[1] != "-" {
+		t, err := ParseTime(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		when = t
+	}
+
+	var metrics []Metric
+	sd := fields[6]
+	if strings.HasPrefix(sd, "-") {
+		sd = sd[1:]
+	} else {
+		for strings.HasPrefix(sd, "[") {
+			id, params, rest, err := syslogElement(sd)
+			if err != nil {
+				return nil, err
+			}
+			sd = rest
+			if id == "metric" || strings.HasPrefix(id, "metric@") {
+				m, err := syslogMetric(params, when, r)
+				if err != nil {
+					return nil, err
+				}
+				metrics = append(metrics, m)
+			}
+		}
+		if sd == fields[6] {
+			return nil, fmt.Errorf("%w syslog structured data", ErrMalformed)
+		}
+	}
+	if sd != "" && sd[0] != ' ' {
+		return nil, fmt.Errorf("%w syslog structured data", ErrMalformed)
+	}
+	if len(metrics) > 0 {
+		return metrics, nil
+	}
+
+	if pattern == nil {
+		return nil, fmt.Errorf("%w, a syslog message without metric elements", ErrMissingValues)
+	}
+	msg := strings.TrimPrefix(strings.TrimPrefix(sd, " "), "\ufeff")
+	match := pattern.FindStringSubmatch(msg)
+	if match == nil {
+		return nil, fmt.Errorf("%w, the syslog message doesn't match the pattern", ErrMissingValues)
+	}
+	var params [][2]string
+	for i, group := range pattern.SubexpNames() {
+		if group != "" && i > 0 {
+			params = append(params, [2]string{group, match[i]})
+		}
+	}
+	m, err := syslogMetric(params, when, r)
+	if err != nil {
+		return nil, err
+	}
+	return []Metric{m}, nil
+}
+
+// Splits the structured data element at the start of sd into its id and
+// params, returning what follows it
+func syslogElement(sd string) (id string, params [][2]string, rest string, err error) {
+	malformed := fmt.Errorf("%w syslog structured data", ErrMalformed)
+	sd = sd[1:]
+	end := strings.IndexAny(sd, " ]")
+	if end <= 0 {
+		return "", nil, "", malformed
+	}
+	id, sd = sd[:end], sd[end:]
+	for {
+		if strings.HasPrefix(sd, "]") {
+			return id, params, sd[1:], nil
+		}
+		// a param is name="value", its value escaping '"', '\' and ']'
+		name, value, ok := strings.Cut(strings.TrimPrefix(sd, " "), `="`)
+		if !ok || name == "" || strings.ContainsAny(name, ` ="]`) {
+			return "", nil, "", malformed
+		}
+		var b strings.Builder
+		i := 0
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' && i+1 < len(value) && strings.IndexByte(`"\]`, value[i+1]) >= 0 {
+				i++
+			}
+			b.WriteByte(value[i])
+		}
+		if i == len(value) {
+			return "", nil, "", malformed
+		}
+		params = append(params, [2]string{name, b.String()})
+		sd = value[i+1:]
+	}
+}
+
+// Makes the metric of the params, name, value and time, the others being
+// its tags
+func syslogMetric(params [][2]string, when time.Time, r rules) (Metric, error) {
+	m := Metric{Count: 1, Time: when}
+	var value string
+	var tags [][2]string
+	for _, p := range params {
+		switch p[0] {
+		case "name":
+			m.Name = p[1]
+		case "value":
+			value = p[1]
+		case "time":
+			t, err := ParseTime(p[1])
+			if err != nil {
+				return Metric{}, err
+			}
+			m.Time = t
+		default:
+			// a group of the pattern may not have matched
+			if p[1] != "" {
+				tags = append(tags, p)
+			}
+		}
+	}
+	if m.Name == "" || value == "" {
+		return Metric{}, ErrMissingValues
+	}
+	if !r.valid(m.Name) {
+		return Metric{}, ErrInvalidName
+	}
+	if err := setValue(&m, value, r); err != nil {
+		return Metric{}, err
+	}
+	var err error
+	if m.Tags, err = CanonicalTags(tags); err != nil {
+		return Metric{}, err
+	}
+	return m, nil
+}
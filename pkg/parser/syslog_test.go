@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+type syslogTestCase struct {
+	input  string
+	keys   []string
+	value  float64
+	time   time.Time
+	hasErr bool
+}
+
+var syslogTestCases = []syslogTestCase{
+	{
+		`<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [metric@32473 name="cpu.load" value="1.5" core="0"]`,
+		[]string{"cpu.load{core=0}"}, 1.5, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false,
+	},
+	{
+		`<134>1 2024-05-01T12:00:00.5Z fw1 snmpd 12 ID47 [origin ip="10.0.0.1"][metric name="if.in" value="7" time="2024-05-01T11:00:00Z"][metric name="if.out" value="8" if="eth\]0"] link stats`,
+		[]string{"if.in", "if.out{if=eth]0}"}, 7, time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), false,
+	},
+	{`<134>1 2024-05-01T12:00:00Z fw1 snmpd - - - cpu.load=1.5`, nil, 0, time.Time{}, true},
+	{`<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [metric name="cpu load" value="1"]`, nil, 0, time.Time{}, true},
+	{`<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [metric name="cpu" value="x"]`, nil, 0, time.Time{}, true},
+	{`<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [metric name="cpu" value="1"`, nil, 0, time.Time{}, true},
+	{`<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [metric name="cpu" value="1"]x`, nil, 0, time.Time{}, true},
+	{`<134>1 yesterday fw1 snmpd - - [metric name="cpu" value="1"]`, nil, 0, time.Time{}, true},
+	{`<134>May  1 12:00:00 fw1 snmpd: cpu.load=1.5`, nil, 0, time.Time{}, true},
+	{`<999>1 2024-05-01T12:00:00Z fw1 snmpd - - -`, nil, 0, time.Time{}, true},
+}
+
+func TestParseSyslog(t *testing.T) {
+	for _, tc := range syslogTestCases {
+		metrics, err := ParseSyslog(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("ParseSyslog(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(metrics) != len(tc.keys) {
+			t.Errorf("ParseSyslog(%s); got %d metrics, want %d", tc.input, len(metrics), len(tc.keys))
+			continue
+		}
+		for i, m := range metrics {
+			if m.Key() != tc.keys[i] {
+				t.Errorf("ParseSyslog(%s); got %s, want %s", tc.input, m.Key(), tc.keys[i])
+			}
+		}
+		if m := metrics[0]; m.Value != tc.value || !m.Time.Equal(tc.time) {
+			t.Errorf("ParseSyslog(%s); got %v %v, want %v %v", tc.input, m.Value, m.Time, tc.value, tc.time)
+		}
+	}
+
+	// the nil timestamp stamps the message with the receive time
+	metrics, err := ParseSyslog(`<134>1 - fw1 snmpd - - [metric name="cpu" value="1"]`)
+	if err != nil || time.Since(metrics[0].Time) > time.Second {
+		t.Errorf("ParseSyslog(-); got %v %v, want the current time", metrics, err)
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	pattern := regexp.MustCompile(`(?P<name>[a-z.]+)=(?P<value>[0-9.]+)(?: on (?P<iface>\w+))?`)
+	if err := CheckSyslogPattern(pattern); err != nil {
+		t.Fatalf("CheckSyslogPattern(); got error %v", err)
+	}
+	parse := SyslogFormat(pattern, Options{})
+	for input, want := range map[string]string{
+		"<134>1 2024-05-01T12:00:00Z fw1 snmpd - - - \ufeffcpu.load=1.5":              "cpu.load",
+		"<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [origin ip=\"x\"] if.in=3 on eth0": "if.in{iface=eth0}",
+		// metric elements are taken over the text
+		"<134>1 2024-05-01T12:00:00Z fw1 snmpd - - [metric name=\"mem\" value=\"2\"] cpu.load=1.5": "mem",
+	} {
+		metrics, err := parse(input)
+		if err != nil || len(metrics) != 1 || metrics[0].Key() != want {
+			t.Errorf("SyslogFormat()(%s); got %v %v, want %s", input, metrics, err, want)
+		}
+	}
+	if _, err := parse("<134>1 2024-05-01T12:00:00Z fw1 snmpd - - - link down"); err == nil {
+		t.Error("SyslogFormat() of a message not matching; got nil error")
+	}
+
+	for _, bad := range []string{`(?P<name>\S+)`, `(?P<name>\S+) (?P<value>\S+) (?P<value>\S+)`} {
+		if err := CheckSyslogPattern(regexp.MustCompile(bad)); err == nil {
+			t.Errorf("CheckSyslogPattern(%s); got nil error", bad)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Key is what the store keys a metric on: its name, followed by its tags in
+// braces when it has any, like latency{region=us-east}
+func (m Metric) Key() string {
+	if m.Tags == "" {
+		return m.Name
+	}
+	return m.Name + "{" + m.Tags + "}"
+}
+
+// Parses a key=value[,key=value...] tag field into its canonical form
+func ParseTags(s string) (string, error) {
+	var pairs [][2]string
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return "", fmt.Errorf("%w tag %q", ErrMalformed, kv)
+		}
+		pairs = append(pairs, [2]string{k, v})
+	}
+	return CanonicalTags(pairs)
+}
+
+// Returns the tags sorted by key and joined as key=value pairs with commas,
+// so the same tagset always makes the same Key whatever order it was sent
+// in. Keys and values must be non-empty and free of the separators, each key
+// may only appear once.
+func CanonicalTags(pairs [][2]string) (string, error) {
+	if len(pairs) == 0 {
+		return "", nil
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	var b strings.Builder
+	for i, p := range pairs {
+		if !validTag(p[0]) || !validTag(p[1]) {
+			return "", fmt.Errorf("%w tag %q", ErrMalformed, p[0]+"="+p[1])
+		}
+		if i > 0 {
+			if p[0] == pairs[i-1][0] {
+				return "", fmt.Errorf("%w tag, %q repeated", ErrMalformed, p[0])
+			}
+			b.WriteByte(',')
+		}
+		b.WriteString(p[0])
+		b.WriteByte('=')
+		b.WriteString(p[1])
+	}
+	return b.String(), nil
+}
+
+// Returns the canonical tags with the key set to the value, replacing any
+// value the tags already had for it
+func SetTag(tags, key, value string) (string, error) {
+	pairs := [][2]string{{key, value}}
+	if tags != "" {
+		for _, kv := range strings.Split(tags, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			if k != key {
+				pairs = append(pairs, [2]string{k, v})
+			}
+		}
+	}
+	return CanonicalTags(pairs)
+}
+
+func validTag(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f || strings.ContainsRune(",={}", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package parser
+
+import "testing"
+
+type tagsTestCase struct {
+	input  string
+	parse  Func
+	key    string
+	hasErr bool
+}
+
+var tagsTestCases = []tagsTestCase{
+	{"latency\t12\t2016-01-01T00:00:00Z\tregion=us-east", Single(ParseDefault), "latency{region=us-east}", false},
+	{"latency\t12\t2016-01-01T00:00:00Z\tms\tregion=us-east,host=a", Single(ParseDefault), "latency{host=a,region=us-east}", false},
+	{"latency\t12\t2016-01-01T00:00:00Z\tregion=us-east\tms", Single(ParseDefault), "", true},
+	{"latency\t12\t2016-01-01T00:00:00Z\tregion=us-east,region=eu", Single(ParseDefault), "", true},
+	{"latency\t12\t2016-01-01T00:00:00Z\tregion=", Single(ParseDefault), "", true},
+	{"latency\t12\t2016-01-01T00:00:00Z\tregion={a}", Single(ParseDefault), "", true},
+	{`{"name":"latency","value":12,"time":"2016-01-01T00:00:00Z","tags":{"region":"us-east","host":"a"}}`, Single(ParseDefault), "latency{host=a,region=us-east}", false},
+	{"latency:12|ms|#region:us-east,canary", Single(ParseStatsd), "latency{region=us-east}", false},
+	{"latency,region=us-east,host=a value=12", ParseInflux, "latency.value{host=a,region=us-east}", false},
+}
+
+func TestTags(t *testing.T) {
+	for _, tc := range tagsTestCases {
+		ms, err := tc.parse(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("parse(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := ms[0].Key(); got != tc.key {
+			t.Errorf("parse(%s).Key(); got %s, want %s", tc.input, got, tc.key)
+		}
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	for _, tc := range []struct{ tags, want string }{
+		{"", "tenant=acme"},
+		{"region=eu", "region=eu,tenant=acme"},
+		{"host=a,tenant=globex", "host=a,tenant=acme"},
+	} {
+		if got, err := SetTag(tc.tags, "tenant", "acme"); err != nil || got != tc.want {
+			t.Errorf("SetTag(%s); got %s %v, want %s", tc.tags, got, err, tc.want)
+		}
+	}
+	if _, err := SetTag("", "tenant", "a=b"); err == nil {
+		t.Errorf("SetTag(a=b); got nil error")
+	}
+}
@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Epoch timestamps from this many on are taken as milliseconds. As seconds
+// it would be the year 5138, as milliseconds it is early 1973.
+const epochMillis = 1e11
+
+// The ISO8601 layouts with a numeric offset, extended and basic
+var offsetFormats = []string{"2006-01-02T15:04:05-07:00", "2006-01-02T15:04:05-0700"}
+
+// ParseTime reads the timestamp field of the tsv and JSON formats, detecting
+// its form from the field itself: ISO8601 Zulu time or with a numeric
+// offset, with or without fractional seconds, or unix epoch seconds or
+// milliseconds, as an integer or with a fraction. Times are always returned
+// in UTC.
+//
+//	2024-05-01T12:00:00Z
+//	2024-05-01T12:00:00.250Z
+//	2024-05-01T14:00:00+02:00 or 2024-05-01T14:00:00+0200
+//	1714564800 or 1714564800.25
+//	1714564800250
+func ParseTime(s string) (time.Time, error) {
+	if t, ok := parseEpoch(s); ok {
+		return t, nil
+	}
+	if t, ok := parseZulu(s); ok {
+		return t, nil
+	}
+	// fractional seconds are accepted after the seconds even though the
+	// layouts have none
+	if t, err := time.Parse(ISO8601Format, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range offsetFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w not iso8601 or unix epoch", ErrInvalidTime)
+}
+
+// Parses the common 2006-01-02T15:04:05Z form by hand, time.Parse is the
+// slowest part of a tsv line. Anything else, fractional seconds included,
+// is left to time.Parse.
+func parseZulu(s string) (time.Time, bool) {
+	if len(s) != len(ISO8601Format) || s[4] != '-' || s[7] != '-' || s[10] != 'T' || s[13] != ':' || s[16] != ':' || s[19] != 'Z' {
+		return time.Time{}, false
+	}
+	num := func(from, to int) int {
+		n := 0
+		for i := from; i < to; i++ {
+			if s[i] < '0' || s[i] > '9' {
+				return -1
+			}
+			n = n*10 + int(s[i]-'0')
+		}
+		return n
+	}
+	year, month, day := num(0, 4), num(5, 7), num(8, 10)
+	hour, minute, sec := num(11, 13), num(14, 16), num(17, 19)
+	if year < 0 || month < 1 || month > 12 || day < 1 || hour < 0 || hour > 23 || minute < 0 || minute > 59 || sec < 0 || sec > 59 {
+		return time.Time{}, false
+	}
+	// the last day of the month, time.Date would roll over past it
+	if day > time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day() {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, sec, 0, time.UTC), true
+}
+
+// Parses epoch seconds or milliseconds without going through a float, which
+// would lose the sub-millisecond part of current times
+func parseEpoch(s string) (time.Time, bool) {
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 9 || !digits(whole) || !digits(frac) {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	// the fraction in nanoseconds, or in nanoseconds of a millisecond
+	nanos, _ := strconv.ParseInt((frac + "000000000")[:9], 10, 64)
+	if n >= epochMillis {
+		return time.UnixMilli(n).Add(time.Duration(nanos / 1e3)).UTC(), true
+	}
+	return time.Unix(n, nanos).UTC(), true
+}
+
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
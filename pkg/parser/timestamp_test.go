@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+type timeTestCase struct {
+	input  string
+	want   time.Time
+	hasErr bool
+}
+
+var timeTestCases = []timeTestCase{
+	{"2024-05-01T12:00:00Z", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	{"2024-05-01T12:00:00.250Z", time.Date(2024, 5, 1, 12, 0, 0, 250e6, time.UTC), false},
+	{"2024-05-01T12:00:00.000000001Z", time.Date(2024, 5, 1, 12, 0, 0, 1, time.UTC), false},
+	{"1714564800", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	{"1714564800.25", time.Date(2024, 5, 1, 12, 0, 0, 250e6, time.UTC), false},
+	{"1714564800250", time.Date(2024, 5, 1, 12, 0, 0, 250e6, time.UTC), false},
+	{"1714564800250.5", time.Date(2024, 5, 1, 12, 0, 0, 250500e3, time.UTC), false},
+	{"0", time.Unix(0, 0).UTC(), false},
+	{"", time.Time{}, true},
+	{"-1714564800", time.Time{}, true},
+	{"1714564800.", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	{"1.7e9", time.Time{}, true},
+	{"1714564800.1234567890", time.Time{}, true},
+	{"2024-05-01T14:00:00+02:00", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	{"2024-05-01T14:00:00+0200", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	{"2024-05-01T06:15:00.5-05:45", time.Date(2024, 5, 1, 12, 0, 0, 500e6, time.UTC), false},
+	{"2024-05-01T12:00:00-00:00", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	{"2024-05-02T02:00:00+14:00", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	{"2024-04-30T23:00:00-13:00", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+	// US spring forward, 02:30 never happens on the New York clock but the
+	// offset makes it unambiguous
+	{"2024-03-10T01:59:59-05:00", time.Date(2024, 3, 10, 6, 59, 59, 0, time.UTC), false},
+	{"2024-03-10T03:00:00-04:00", time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC), false},
+	{"2024-03-10T02:30:00-05:00", time.Date(2024, 3, 10, 7, 30, 0, 0, time.UTC), false},
+	// US fall back, 01:30 happens twice and the offset says which
+	{"2024-11-03T01:30:00-04:00", time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC), false},
+	{"2024-11-03T01:30:00-05:00", time.Date(2024, 11, 3, 6, 30, 0, 0, time.UTC), false},
+	// EU changes at 01:00 UTC in both directions
+	{"2024-03-31T01:59:59+01:00", time.Date(2024, 3, 31, 0, 59, 59, 0, time.UTC), false},
+	{"2024-03-31T03:00:00+02:00", time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC), false},
+	{"2024-10-27T02:30:00+02:00", time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC), false},
+	{"2024-10-27T02:30:00+01:00", time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC), false},
+	// southern hemisphere, Sydney falls back in April
+	{"2024-04-07T02:30:00+11:00", time.Date(2024, 4, 6, 15, 30, 0, 0, time.UTC), false},
+	{"2024-04-07T02:30:00+10:00", time.Date(2024, 4, 6, 16, 30, 0, 0, time.UTC), false},
+	// across midnight and the year end
+	{"2024-01-01T01:00:00+03:00", time.Date(2023, 12, 31, 22, 0, 0, 0, time.UTC), false},
+	{"2024-05-01T12:00:00+2:00", time.Time{}, true},
+	{"2024-05-01T12:00:00+02", time.Time{}, true},
+	{"2024-05-01T12:00:00+25:00", time.Time{}, true},
+	{"2024-05-01 12:00:00", time.Time{}, true},
+	{"2024-02-29T12:00:00Z", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), false},
+	{"2023-02-29T12:00:00Z", time.Time{}, true},
+	{"2024-04-31T12:00:00Z", time.Time{}, true},
+	{"2024-13-01T12:00:00Z", time.Time{}, true},
+	{"2024-05-01T24:00:00Z", time.Time{}, true},
+	{"2024-05-01T12:00:60Z", time.Time{}, true},
+	{"2024-05-01T12:0a:00Z", time.Time{}, true},
+	{"yesterday", time.Time{}, true},
+}
+
+func TestParseTime(t *testing.T) {
+	for _, tc := range timeTestCases {
+		got, err := ParseTime(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("ParseTime(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if err == nil && (!got.Equal(tc.want) || got.Location() != time.UTC) {
+			t.Errorf("ParseTime(%s); got %v, want %v", tc.input, got, tc.want)
+		}
+	}
+
+	m, err := ParseJSON(`{"name":"asdf","value":1,"time":1714564800250}`)
+	if err != nil || !m.Time.Equal(time.Date(2024, 5, 1, 12, 0, 0, 250e6, time.UTC)) {
+		t.Errorf("ParseJSON(epoch millis); got %v %v", m, err)
+	}
+}
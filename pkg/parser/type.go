@@ -0,0 +1,89 @@
+package parser
+
+import "fmt"
+
+// Type says how a metric's observations are aggregated over a window and
+// which value the report leads with
+type Type uint8
+
+const (
+	// no type given, reported by its mean like a timer
+	Untyped Type = iota
+	// summed, the report leads with the total for the window
+	Counter
+	// a level, the report leads with the last value received
+	Gauge
+	// a distribution, the report leads with the mean and percentiles are
+	// estimated when configured
+	Timer
+	// distinct members, the report leads with how many were seen
+	Set
+)
+
+// Parses a type field, either a statsd type or its name. An empty field is
+// Untyped.
+func ParseType(s string) (Type, error) {
+	switch s {
+	case "":
+		return Untyped, nil
+	case "c", "counter":
+		return Counter, nil
+	case "g", "gauge":
+		return Gauge, nil
+	case "ms", "h", "d", "timer":
+		return Timer, nil
+	case "s", "set":
+		return Set, nil
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownType, s)
+}
+
+func (t Type) String() string {
+	switch t {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Timer:
+		return "timer"
+	case Set:
+		return "set"
+	}
+	return "untyped"
+}
+
+// Reports whether the spread of the values means anything, only then is a
+// quantile sketch worth keeping
+func (t Type) Distribution() bool {
+	return t == Untyped || t == Timer
+}
+
+// Parses the comma separated -unique-metrics globs
+func ParseUniqueMetrics(list string) ([]string, error) {
+	return parseGlobs(list)
+}
+
+// Parses the comma separated -rate-metrics globs
+func ParseRateMetrics(list string) ([]string, error) {
+	return parseGlobs(list)
+}
+
+// Parses a value field into m according to its type. The member of a set is
+// kept as text and counts as a single observation of 1.
+func setTypedValue(m *Metric, s string, r rules) error {
+	unique := (m.Type == Untyped || m.Type == Set) && matchesAny(r.UniqueMetrics, m.Name)
+	if m.Type != Set && !unique {
+		// a counter's last value is what its rate is taken from
+		if (m.Type == Untyped || m.Type == Gauge) && matchesAny(r.RateMetrics, m.Name) {
+			m.Type, m.Cumulative = Gauge, true
+		}
+		return setValue(m, s, r)
+	}
+	if s == "" {
+		return ErrMissingValues
+	}
+	m.Type, m.Unique = Set, unique
+	m.Members = map[string]struct{}{s: {}}
+	m.Value, m.Mean = 1, 1
+	return nil
+}
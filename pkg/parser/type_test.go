@@ -0,0 +1,97 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+type typeTestCase struct {
+	input  string
+	typ    Type
+	value  float64
+	member string
+	hasErr bool
+}
+
+var typeTestCases = []typeTestCase{
+	{"asdf\t1.5\t2016-01-01T00:00:00Z", Untyped, 1.5, "", false},
+	{"asdf\t3\t2016-01-01T00:00:00Z\tc", Counter, 3, "", false},
+	{"asdf\t3\t2016-01-01T00:00:00Z\tgauge", Gauge, 3, "", false},
+	{"asdf\t320\t2016-01-01T00:00:00Z\tms", Timer, 320, "", false},
+	{"asdf\tuser-42\t2016-01-01T00:00:00Z\ts", Set, 1, "user-42", false},
+	{"asdf\t\t2016-01-01T00:00:00Z\tset", Untyped, 0, "", true},
+	{"asdf\t3\t2016-01-01T00:00:00Z\tq", Untyped, 0, "", true},
+	{`{"name":"asdf","value":3,"time":"2016-01-01T00:00:00Z","type":"counter"}`, Counter, 3, "", false},
+	{`{"name":"asdf","value":"user-42","time":"2016-01-01T00:00:00Z","type":"set"}`, Set, 1, "user-42", false},
+	{`{"name":"asdf","value":42,"time":"2016-01-01T00:00:00Z","type":"set"}`, Untyped, 0, "", true},
+	{`{"name":"asdf","value":"42","time":"2016-01-01T00:00:00Z","type":"gauge"}`, Untyped, 0, "", true},
+}
+
+func TestParseTyped(t *testing.T) {
+	for _, tc := range typeTestCases {
+		m, err := ParseDefault(tc.input)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("ParseDefault(%s); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := m.Members[tc.member]; m.Type != tc.typ || m.Value != tc.value || (tc.member != "" && !ok) {
+			t.Errorf("ParseDefault(%s); got %v %v %v, want %v %v %s", tc.input, m.Type, m.Value, m.Members, tc.typ, tc.value, tc.member)
+		}
+	}
+}
+
+func TestUniqueMetrics(t *testing.T) {
+	unique, _ := ParseUniqueMetrics("active-*")
+	opts := Options{UniqueMetrics: unique}
+	cases := []struct {
+		line   string
+		unique bool
+		typ    Type
+	}{
+		{"active-users\t9f86d081884c7d65\t1714564800", true, Set},
+		{"active-users:9f86d081884c7d65|s", true, Set},
+		// a typed value of a unique name stays what it says
+		{"active-users\t3\t1714564800\tg", false, Gauge},
+		{"users\t3\t1714564800", false, Untyped},
+	}
+	for _, tc := range cases {
+		parse, _ := Format("tsv", opts)
+		if strings.Contains(tc.line, "|") {
+			parse, _ = Format("statsd", opts)
+		}
+		metrics, err := parse(tc.line)
+		if err != nil {
+			t.Errorf("parse(%s); got error %v", tc.line, err)
+			continue
+		}
+		m := metrics[0]
+		if m.Unique != tc.unique || m.Type != tc.typ {
+			t.Errorf("parse(%s); got %v unique %v, want %v unique %v", tc.line, m.Type, m.Unique, tc.typ, tc.unique)
+		}
+		if _, ok := m.Members["9f86d081884c7d65"]; tc.unique && !ok {
+			t.Errorf("parse(%s); got members %v", tc.line, m.Members)
+		}
+	}
+}
+
+func TestRateMetrics(t *testing.T) {
+	rates, _ := ParseRateMetrics("*-total")
+	parse, _ := Format("tsv", Options{RateMetrics: rates})
+	for line, cumulative := range map[string]bool{
+		"bytes-total\t123456\t1714564800":    true,
+		"bytes-total\t123456\t1714564800\tc": false,
+		"bytes\t123456\t1714564800":          false,
+	} {
+		metrics, err := parse(line)
+		if err != nil {
+			t.Errorf("parse(%s); got error %v", line, err)
+			continue
+		}
+		if m := metrics[0]; m.Cumulative != cumulative || (cumulative && m.Type != Gauge) {
+			t.Errorf("parse(%s); got %v %v, want cumulative %v", line, m.Type, m.Cumulative, cumulative)
+		}
+	}
+}
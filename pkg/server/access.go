@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Access decides which hosts may connect. A host in a denied network is
+// always turned away, and when any networks are allowed a host must be in
+// one of them. Each host may also hold only so many connections at once, so
+// one noisy host can't take every slot of a listener. Addresses that aren't
+// IPs, like those of unix socket clients, are always let in.
+type Access struct {
+	allow, deny []*net.IPNet
+	// connections per host, 0 for no limit
+	perHost int
+
+	mu    sync.Mutex
+	conns map[string]int
+	// connections and datagrams refused since the last report
+	denied, overCap uint64
+}
+
+// Returns the Access for the allowed and denied networks and the per host
+// connection cap
+func NewAccess(allow, deny []*net.IPNet, perHost int) *Access {
+	return &Access{allow: allow, deny: deny, perHost: perHost, conns: make(map[string]int)}
+}
+
+// Parses a comma separated list of networks in CIDR notation, a bare IP
+// address is a network of its own
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%s: want a CIDR like 10.0.0.0/8 or an IP address", s)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: want a CIDR like 10.0.0.0/8 or an IP address", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Reports whether the host may send at all. A nil Access allows everyone.
+func (a *Access) allowed(host string) bool {
+	ip := net.ParseIP(host)
+	if a == nil || ip == nil {
+		return true
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			atomic.AddUint64(&a.denied, 1)
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	atomic.AddUint64(&a.denied, 1)
+	return false
+}
+
+// Admits a connection from the host, returning the function to call once it
+// is closed. ErrDenied is returned if the host may not connect and
+// ErrTooManyFromHost if it already holds its share of connections.
+func (a *Access) admit(host string) (release func(), err error) {
+	if !a.allowed(host) {
+		return nil, ErrDenied
+	}
+	if a == nil || a.perHost == 0 || net.ParseIP(host) == nil {
+		return func() {}, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conns[host] >= a.perHost {
+		atomic.AddUint64(&a.overCap, 1)
+		return nil, ErrTooManyFromHost
+	}
+	a.conns[host]++
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.conns[host]--; a.conns[host] == 0 {
+			delete(a.conns, host)
+		}
+	}, nil
+}
+
+// Returns how many connections or datagrams were refused since the last
+// call, by the network lists and by the per host cap
+func (a *Access) Refused() (denied, overCap uint64) {
+	if a == nil {
+		return 0, 0
+	}
+	return atomic.SwapUint64(&a.denied, 0), atomic.SwapUint64(&a.overCap, 0)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAccess(t *testing.T) {
+	if _, err := ParseCIDRs("10.0.0.0/8,bogus"); err == nil {
+		t.Errorf("ParseCIDRs(bogus); got nil error")
+	}
+	allow, err := ParseCIDRs("10.0.0.0/8, 192.168.1.5, ::1")
+	if err != nil || len(allow) != 3 {
+		t.Fatalf("ParseCIDRs(); got %v %v", allow, err)
+	}
+	deny, _ := ParseCIDRs("10.9.0.0/16")
+	a := NewAccess(allow, deny, 2)
+
+	for host, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"10.9.0.1":    false,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"::1":         true,
+		// unix socket clients have no IP
+		"@": true,
+	} {
+		if got := a.allowed(host); got != want {
+			t.Errorf("allowed(%s); got %v, want %v", host, got, want)
+		}
+	}
+
+	// two connections per host
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := a.admit("10.1.2.3")
+		if err != nil {
+			t.Fatalf("admit(%d); got error %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := a.admit("10.1.2.3"); !errors.Is(err, ErrBusy) {
+		t.Errorf("admit() over the cap; got error %v, want ErrBusy", err)
+	}
+	if _, err := a.admit("10.1.2.4"); err != nil {
+		t.Errorf("admit() from another host; got error %v", err)
+	}
+	releases[0]()
+	if _, err := a.admit("10.1.2.3"); err != nil {
+		t.Errorf("admit() after a release; got error %v", err)
+	}
+	if _, err := a.admit("10.9.0.1"); err != ErrDenied {
+		t.Errorf("admit() denied; got error %v, want ErrDenied", err)
+	}
+	if denied, overCap := a.Refused(); denied != 3 || overCap != 1 {
+		t.Errorf("Refused(); got %d denied %d over the cap, want 3 and 1", denied, overCap)
+	}
+
+	var open *Access
+	if release, err := open.admit("10.9.0.1"); err != nil || release == nil {
+		t.Errorf("nil Access admit(); got error %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Control commands a client may send before its first metric line. None of
+// them can be mistaken for a metric in any of the line formats.
+//
+//	ACK <n>             confirm progress every n lines, see acker
+//	ID [id]             learn or set the connection's correlation ID
+//	SEQ <id>            number every line within the session, see Sessions
+//	HINTS               take rebalancing hints, see connTracker.rebalance
+//	REPLY [LINE|BATCH]  learn what became of each line, see replier
+//	AUTH <token>        authenticate as the token's tenant, see Credentials
+func parseCommand(line string) (cmd string, args []string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	switch fields[0] {
+	case "ACK", "ID", "SEQ", "HINTS", "REPLY", "AUTH":
+		return fields[0], fields[1:], true
+	}
+	return "", nil, false
+}
+
+// acker implements the ACK mode. Every line read from the connection gets the
+// next sequence number, and once it has been applied the server writes
+// "ACK <seq>\n" back every n lines, or sooner when the client stops sending
+// so that a producer waiting on its last few lines isn't left hanging. A
+// producer can then drop everything up to the acknowledged sequence number
+// from its retry buffer. After an ID command the correlation ID follows the
+// sequence number.
+type acker struct {
+	conn  net.Conn
+	every uint64
+	seq   uint64
+	acked uint64
+	id    string
+}
+
+// Handles the ACK command, returning the acker for the connection
+func newAcker(conn net.Conn, args []string) (*acker, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("invalid command: ACK takes one argument")
+	}
+	n, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("invalid command: ACK interval must be a positive integer")
+	}
+	return &acker{conn: conn, every: n}, nil
+}
+
+// Records that the next line has been applied. idle reports that no more
+// input is buffered, in which case anything outstanding is acknowledged.
+func (a *acker) applied(idle bool) error {
+	a.seq++
+	if a.seq-a.acked < a.every && !idle {
+		return nil
+	}
+	a.acked = a.seq
+	a.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	defer a.conn.SetWriteDeadline(time.Time{})
+	if a.id != "" {
+		_, err := fmt.Fprintf(a.conn, "ACK %d %s\n", a.seq, a.id)
+		return err
+	}
+	_, err := fmt.Fprintf(a.conn, "ACK %d\n", a.seq)
+	return err
+}
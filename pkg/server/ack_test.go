@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestAcker(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := newAcker(server, []string{"0"}); err == nil {
+		t.Errorf("newAcker(0); got nil error")
+	}
+	a, err := newAcker(server, []string{"3"})
+	if err != nil {
+		t.Fatalf("newAcker(3); got error %v", err)
+	}
+
+	acks := make(chan string, 3)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(acks)
+				return
+			}
+			acks <- line
+		}
+	}()
+
+	// every third line is acknowledged, plus whatever is left when idle
+	for i, idle := range []bool{false, false, false, false, true} {
+		if err := a.applied(idle); err != nil {
+			t.Fatalf("applied(%d); got error %v", i, err)
+		}
+	}
+	// after an ID command the correlation ID follows
+	a.id = "batch-42"
+	for i := 0; i < 3; i++ {
+		if err := a.applied(false); err != nil {
+			t.Fatalf("applied(%d); got error %v", i, err)
+		}
+	}
+	for _, want := range []string{"ACK 3\n", "ACK 5\n", "ACK 8 batch-42\n"} {
+		if got := <-acks; got != want {
+			t.Errorf("ack; got %q, want %q", got, want)
+		}
+	}
+}
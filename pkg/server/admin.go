@@ -0,0 +1,403 @@
+//go:build !minimal
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// adminServer exposes the operational actions that change server state
+type adminServer struct {
+	server      *Server
+	store       store.Aggregator
+	quarantine  *Quarantine
+	credentials *Credentials
+	watchdog    *Watchdog
+}
+
+// Builds the admin routes for the server, the watchdog may be nil
+func NewAdminHandler(s *Server, wd *Watchdog) http.Handler {
+	a := &adminServer{server: s, store: s.Store, quarantine: s.Quarantine, credentials: s.Credentials, watchdog: wd}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", a.healthz)
+	mux.HandleFunc("GET /readyz", a.readyz)
+	mux.HandleFunc("GET /status", a.status)
+	mux.HandleFunc("GET /config/effective", a.effectiveConfig)
+	mux.HandleFunc("DELETE /admin/metrics/{name}", a.deleteMetric)
+	mux.HandleFunc("DELETE /admin/metrics", a.deleteMetrics)
+	mux.HandleFunc("POST /admin/rebalance", a.rebalance)
+	mux.HandleFunc("PUT /admin/max-conns", a.maxConns)
+	mux.HandleFunc("GET /admin/history", a.history)
+	mux.HandleFunc("GET /admin/snapshot/{window}", a.snapshot)
+	mux.HandleFunc("PUT /admin/snapshot/{window}", a.restore)
+	mux.HandleFunc("GET /admin/quarantine", a.listQuarantine)
+	mux.HandleFunc("PUT /admin/quarantine/{producer}", a.addQuarantine)
+	mux.HandleFunc("DELETE /admin/quarantine/{producer}", a.removeQuarantine)
+	mux.HandleFunc("GET /admin/tenants", a.listTenants)
+	mux.HandleFunc("PUT /admin/tenants/{tenant}", a.enableTenant)
+	mux.HandleFunc("DELETE /admin/tenants/{tenant}", a.disableTenant)
+	mux.HandleFunc("POST /admin/tenants/{tenant}/tokens", a.addToken)
+	mux.HandleFunc("DELETE /admin/tenants/{tenant}/tokens/{id}", a.retireToken)
+	return mux
+}
+
+// DELETE /admin/metrics/{name} removes a single metric. The name is taken
+// as it is, whatever the listeners' name policies let in, glob characters
+// included.
+func (a *adminServer) deleteMetric(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing metric name"})
+		return
+	}
+	a.remove(w, globLiteral.Replace(name))
+}
+
+// Escapes the characters path.Match gives a meaning to
+var globLiteral = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// DELETE /admin/metrics?pattern=<glob> removes every metric matching the glob
+func (a *adminServer) deleteMetrics(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "pattern is required"})
+		return
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	a.remove(w, pattern)
+}
+
+// Removes the metrics from the window in progress, what the windows keep of
+// them across flushes and the history, answering how many of each there were
+func (a *adminServer) remove(w http.ResponseWriter, pattern string) {
+	deleted := map[string]int{"deleted": a.store.Remove(pattern)}
+	if a.server.Forget != nil {
+		deleted["derived"] = a.server.Forget(pattern)
+	}
+	if a.server.History != nil {
+		n, err := a.server.History.Delete(pattern)
+		deleted["history_records"] = n
+		if err != nil {
+			slog.Warn("admin: deleting from the history failed", "pattern", pattern, "err", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "deleted": deleted})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, deleted)
+}
+
+// POST /admin/rebalance?fraction=<0-1>&to=<addr> asks a fraction (default
+// all) of the connections taking hints to reconnect, to the given address or
+// wherever they connected to before
+func (a *adminServer) rebalance(w http.ResponseWriter, r *http.Request) {
+	fraction := 1.0
+	if f := r.URL.Query().Get("fraction"); f != "" {
+		var err error
+		if fraction, err = strconv.ParseFloat(f, 64); err != nil || !(fraction > 0 && fraction <= 1) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "fraction must be above 0 and at most 1"})
+			return
+		}
+	}
+	to := r.URL.Query().Get("to")
+	if to != "" {
+		if _, _, err := net.SplitHostPort(to); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "to must be host:port"})
+			return
+		}
+	}
+	n := a.server.Rebalance(fraction, to)
+	slog.Info("admin: asked connections to reconnect", "connections", n, "to", to)
+	writeJSON(w, http.StatusOK, map[string]int{"hinted": n})
+}
+
+// PUT /admin/max-conns?n=<conns>&listener=<name> changes how many
+// connections the listener, every one without it, handles at once. Answers
+// the listeners changed and their cap before.
+func (a *adminServer) maxConns(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "n must be a number of connections"})
+		return
+	}
+	changed, err := a.server.SetMaxConns(r.URL.Query().Get("listener"), n)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"max_conns": n, "previous": changed})
+}
+
+// GET /admin/history?from=<time>&to=<time>&pattern=<glob> streams the
+// records of the windows kept on disk that started in the span, as JSON
+// lines. The times are RFC 3339, to defaults to now and from to an hour
+// before it, the pattern to every metric.
+func (a *adminServer) history(w http.ResponseWriter, r *http.Request) {
+	if a.server.History == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no history sink"})
+		return
+	}
+	q := r.URL.Query()
+	to := time.Now()
+	if s := q.Get("to"); s != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "to must be an RFC 3339 time"})
+			return
+		}
+	}
+	from := to.Add(-time.Hour)
+	if s := q.Get("from"); s != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from must be an RFC 3339 time"})
+			return
+		}
+	}
+	pattern := q.Get("pattern")
+	if _, err := path.Match(pattern, ""); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	out := bufio.NewWriter(w)
+	err := a.server.History.Query(from, to, pattern, func(record []byte) error {
+		out.Write(record)
+		return out.WriteByte('\n')
+	})
+	out.Flush()
+	if err != nil {
+		// the status is already sent, the body ends short
+		slog.Warn("admin: history query failed", "err", err)
+	}
+}
+
+// Returns the store of the window named in the path, answering 404 when it
+// can't be snapshotted
+func (a *adminServer) snapshotter(w http.ResponseWriter, r *http.Request) store.Snapshotter {
+	s := a.server.Snapshots[r.PathValue("window")]
+	if s == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no window " + r.PathValue("window") + " to snapshot"})
+	}
+	return s
+}
+
+// GET /admin/snapshot/{window} writes the state of the window in progress,
+// to PUT back after a restart or into another host
+func (a *adminServer) snapshot(w http.ResponseWriter, r *http.Request) {
+	s := a.snapshotter(w, r)
+	if s == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	out := bufio.NewWriter(w)
+	err := s.WriteSnapshot(out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		// the status is already sent, the body ends short
+		slog.Warn("admin: snapshot failed", "window", r.PathValue("window"), "err", err)
+	}
+}
+
+// PUT /admin/snapshot/{window} merges a snapshot into the window in
+// progress
+func (a *adminServer) restore(w http.ResponseWriter, r *http.Request) {
+	s := a.snapshotter(w, r)
+	if s == nil {
+		return
+	}
+	n, err := s.Restore(bufio.NewReader(r.Body))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "restored": n})
+		return
+	}
+	slog.Info("admin: restored a snapshot", "window", r.PathValue("window"), "metrics", n)
+	writeJSON(w, http.StatusOK, map[string]int{"restored": n})
+}
+
+// GET /admin/quarantine lists the quarantined producers and when they were
+// flagged
+func (a *adminServer) listQuarantine(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.quarantine.list())
+}
+
+// PUT /admin/quarantine/{producer} starts diverting the producer's metrics,
+// identified by IP address, client certificate CN or token id as listed by
+// GET /admin/tenants, to the capture file
+func (a *adminServer) addQuarantine(w http.ResponseWriter, r *http.Request) {
+	producer := r.PathValue("producer")
+	status := http.StatusOK
+	if a.quarantine.add(producer) {
+		status = http.StatusCreated
+		slog.Info("admin: quarantined", "producer", producer)
+	}
+	writeJSON(w, status, map[string]string{"quarantined": producer})
+}
+
+// DELETE /admin/quarantine/{producer} resumes aggregating the producer
+func (a *adminServer) removeQuarantine(w http.ResponseWriter, r *http.Request) {
+	producer := r.PathValue("producer")
+	if !a.quarantine.remove(producer) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "producer not quarantined"})
+		return
+	}
+	slog.Info("admin: released", "producer", producer)
+	writeJSON(w, http.StatusOK, map[string]string{"released": producer})
+}
+
+// GET /admin/tenants lists the tenants, their token ids and whether they are
+// disabled
+func (a *adminServer) listTenants(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.credentials.list())
+}
+
+// PUT /admin/tenants/{tenant} re-enables a disabled tenant
+func (a *adminServer) enableTenant(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	if !a.credentials.Enable(tenant) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown tenant"})
+		return
+	}
+	slog.Info("admin: enabled tenant", "tenant", tenant)
+	writeJSON(w, http.StatusOK, map[string]string{"enabled": tenant})
+}
+
+// DELETE /admin/tenants/{tenant}?grace=<duration> soft deletes the tenant,
+// its tokens keep working for the grace period (default none), after which
+// the tenant is forgotten
+func (a *adminServer) disableTenant(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	var grace time.Duration
+	if g := r.URL.Query().Get("grace"); g != "" {
+		var err error
+		if grace, err = time.ParseDuration(g); err != nil || grace < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "grace must be a duration like 10m"})
+			return
+		}
+	}
+	if !a.credentials.Disable(tenant, grace) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown tenant"})
+		return
+	}
+	slog.Info("admin: disabled tenant", "tenant", tenant, "grace", grace)
+	writeJSON(w, http.StatusOK, map[string]string{"disabled": tenant, "grace": grace.String()})
+}
+
+// POST /admin/tenants/{tenant}/tokens adds a token to the tenant, creating
+// it if need be. The body may give the token as {"token":"..."}, otherwise
+// one is generated. The token is only ever shown in this response. A
+// tenant can hold two tokens so they can be rotated, adding a third
+// retires the oldest.
+func (a *adminServer) addToken(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	if !validTenant(tenant) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid tenant name"})
+		return
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "malformed json"})
+			return
+		}
+	}
+	if body.Token == "" {
+		body.Token = GenerateToken()
+	}
+	resp := map[string]string{"tenant": tenant, "token": body.Token, "id": TokenID(body.Token)}
+	if retired := a.credentials.AddToken(tenant, body.Token); retired != "" {
+		resp["retired"] = retired
+	}
+	slog.Info("admin: added token", "tenant", tenant, "token", resp["id"])
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// DELETE /admin/tenants/{tenant}/tokens/{id} retires one of the tenant's
+// tokens, once every producer has moved to the other
+func (a *adminServer) retireToken(w http.ResponseWriter, r *http.Request) {
+	tenant, id := r.PathValue("tenant"), r.PathValue("id")
+	if !a.credentials.RetireToken(tenant, id) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown token"})
+		return
+	}
+	slog.Info("admin: retired token", "tenant", tenant, "token", id)
+	writeJSON(w, http.StatusOK, map[string]string{"retired": id})
+}
+
+// GET /config/effective returns every setting as resolved, with secrets
+// redacted by whoever filled in Server.Settings, and the limits in force
+func (a *adminServer) effectiveConfig(w http.ResponseWriter, r *http.Request) {
+	settings := a.server.Settings
+	if settings == nil {
+		settings = map[string]ConfigSetting{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"settings": settings,
+		"limits":   a.server.limits(),
+		"as_of":    time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// GET /healthz answers 503 while the watchdog finds the store stuck
+func (a *adminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if a.watchdog == nil {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+	healthy, beat := a.watchdog.Healthy()
+	body := map[string]string{"status": "ok", "heartbeat": beat.UTC().Format(parser.ISO8601Format)}
+	if !healthy {
+		body["status"] = "stuck"
+		writeJSON(w, http.StatusServiceUnavailable, body)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// GET /status returns the status document, the totals since startup and
+// the state of the pipeline
+func (a *adminServer) status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, a.server.status())
+}
+
+// GET /readyz answers 503 while the server isn't accepting connections, its
+// ingress is saturated or the watchdog finds the store stuck, so a load
+// balancer sends the clients elsewhere, see Server.Ready
+func (a *adminServer) readyz(w http.ResponseWriter, r *http.Request) {
+	ready, reason := a.server.Ready()
+	if ready && a.watchdog != nil {
+		if healthy, _ := a.watchdog.Healthy(); !healthy {
+			ready, reason = false, "store stuck"
+		}
+	}
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "reason": reason})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// Encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
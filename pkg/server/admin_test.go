@@ -0,0 +1,251 @@
+//go:build !minimal
+
+// the test binary routes the admin and API handlers as the collector does,
+// see cmd/collector
+//
+//go:debug httpmuxgo121=0
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestAdminTenants(t *testing.T) {
+	s := New(&fullStore{})
+	admin := NewAdminHandler(s, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do("POST", "/admin/tenants/acme/tokens", `{"token":"secret"}`); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), TokenID("secret")) {
+		t.Errorf("POST /admin/tenants/acme/tokens; got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/admin/tenants/acme/tokens", ""); rec.Code != http.StatusCreated {
+		t.Errorf("POST /admin/tenants/acme/tokens generated; got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("GET", "/admin/tenants", ""); !strings.Contains(rec.Body.String(), `"tenant":"acme"`) {
+		t.Errorf("GET /admin/tenants; got %s", rec.Body)
+	}
+	if rec := do("DELETE", "/admin/tenants/acme?grace=soon", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("DELETE /admin/tenants/acme?grace=soon; got %d, want 400", rec.Code)
+	}
+	if rec := do("DELETE", "/admin/tenants/acme?grace=1h", ""); rec.Code != http.StatusOK {
+		t.Errorf("DELETE /admin/tenants/acme?grace=1h; got %d, want 200", rec.Code)
+	}
+	if rec := do("DELETE", "/admin/tenants/nobody", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE /admin/tenants/nobody; got %d, want 404", rec.Code)
+	}
+	if rec := do("DELETE", "/admin/tenants/acme/tokens/"+TokenID("secret"), ""); rec.Code != http.StatusOK {
+		t.Errorf("DELETE the secret token; got %d, want 200", rec.Code)
+	}
+	if rec := do("PUT", "/admin/tenants/acme", ""); rec.Code != http.StatusOK {
+		t.Errorf("PUT /admin/tenants/acme; got %d, want 200", rec.Code)
+	}
+}
+
+// fakeHistory holds a record for each hour of 2024-01-02
+type fakeHistory struct{}
+
+func (fakeHistory) Query(from, to time.Time, pattern string, fn func(record []byte) error) error {
+	for h := 0; h < 24; h++ {
+		start := time.Date(2024, 1, 2, h, 0, 0, 0, time.UTC)
+		if !start.Before(from) && start.Before(to) {
+			fn([]byte(`{"name":"` + pattern + `","start":"` + start.Format(time.RFC3339) + `"}`))
+		}
+	}
+	return nil
+}
+
+// Answers a day's records deleted, one an hour, deleting nothing
+func (fakeHistory) Delete(pattern string) (int, error) {
+	return 24, nil
+}
+
+func TestAdminHistory(t *testing.T) {
+	s := New(&fullStore{})
+	admin := NewAdminHandler(s, nil)
+	do := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+	if rec := do("/admin/history"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/history without a history; got %d, want 404", rec.Code)
+	}
+
+	s.History = fakeHistory{}
+	rec := do("/admin/history?to=2024-01-02T12:00:00Z&pattern=cpu*")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || len(lines) != 1 || !strings.Contains(lines[0], `"cpu*"`) || !strings.Contains(lines[0], "T11:00:00Z") {
+		t.Errorf("GET /admin/history; got %d %q, want the hour before to", rec.Code, lines)
+	}
+	if rec := do("/admin/history?from=2024-01-02T00:00:00Z&to=2024-01-03T00:00:00Z"); strings.Count(rec.Body.String(), "\n") != 24 {
+		t.Errorf("GET /admin/history for the day; got %q", rec.Body)
+	}
+	// deleting a metric deletes its history and what the windows keep of it
+	var forgotten string
+	s.Forget = func(pattern string) int {
+		forgotten = pattern
+		return 2
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/metrics/cpu", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"history_records":24`) {
+		t.Errorf("DELETE /admin/metrics/cpu; got %d %s, want the history's records deleted", rec.Code, rec.Body)
+	}
+	if forgotten != "cpu" || !strings.Contains(rec.Body.String(), `"derived":2`) {
+		t.Errorf("DELETE /admin/metrics/cpu; got %s forgetting %q, want cpu's derived state forgotten", rec.Body, forgotten)
+	}
+	for _, target := range []string{"/admin/history?from=yesterday", "/admin/history?to=1", "/admin/history?pattern=["} {
+		if rec := do(target); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s; got %d, want 400", target, rec.Code)
+		}
+	}
+}
+
+func TestAdminDeleteMetric(t *testing.T) {
+	agg := store.NewStore(store.Options{Shards: 2})
+	for _, name := range []string{"cpu.load", "cpu.load.1m", "rate:*", "rate:5m"} {
+		agg.Update(parser.Metric{Name: name, Value: 1})
+	}
+	admin := NewAdminHandler(New(agg), nil)
+	// a name the listeners' policies let in is taken literally
+	for _, name := range []string{"cpu.load", "rate:*"} {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/admin/metrics/"+url.PathEscape(name), nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deleted":1`) {
+			t.Errorf("DELETE /admin/metrics/%s; got %d %s, want it alone deleted", name, rec.Code, rec.Body)
+		}
+	}
+	if got := agg.Snapshot(); len(got) != 2 {
+		t.Errorf("left %v; want cpu.load.1m and rate:5m", got)
+	}
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	from, to := store.NewStore(store.Options{Shards: 2}), store.NewStore(store.Options{Shards: 2})
+	from.Update(parser.Metric{Name: "cpu", Value: 1})
+	from.Update(parser.Metric{Name: "cpu", Value: 3})
+	s := New(&fullStore{})
+	s.Snapshots = map[string]store.Snapshotter{"1m": from, "5m": to}
+	admin := NewAdminHandler(s, nil)
+	do := func(method, target string, body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		return rec
+	}
+
+	rec := do("GET", "/admin/snapshot/1m", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/snapshot/1m; got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("PUT", "/admin/snapshot/5m", rec.Body.Bytes()); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"restored":1`) {
+		t.Errorf("PUT /admin/snapshot/5m; got %d %s", rec.Code, rec.Body)
+	}
+	if got := to.Snapshot(); len(got) != 1 || got[0].Count != 2 || got[0].Value != 4 {
+		t.Errorf("the 5m window after the restore; got %+v", got)
+	}
+	if rec := do("PUT", "/admin/snapshot/5m", []byte("junk")); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT /admin/snapshot/5m of junk; got %d, want 400", rec.Code)
+	}
+	if rec := do("GET", "/admin/snapshot/1h", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/snapshot/1h; got %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	s := New(store.NewPool(store.NewStore(store.Options{Shards: 4}), 2, 8, nil))
+	now := time.Now()
+	s.Ingest(&parser.Metric{Name: "cpu", Value: 1, Time: now}, "test")
+	s.Ingest(&parser.Metric{Name: "cpu", Value: 1, Time: now.Add(-time.Hour)}, "test")
+	// what the report counted stays in the totals
+	s.Report(io.Discard)
+	s.Ingest(&parser.Metric{Name: "mem", Value: 1, Time: now}, "test")
+	s.Flushed("30s", now, time.Millisecond, 2, []string{"startup"})
+
+	rec := httptest.NewRecorder()
+	NewAdminHandler(s, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var got struct {
+		Lines struct {
+			Accepted uint64
+			Rejected map[string]uint64
+		}
+		Ingress *struct{ Capacity int }
+		Series  int
+		Flushes map[string]struct {
+			Metrics int
+			Partial []string
+		}
+		Build   struct{ Go string }
+		Runtime struct {
+			Goroutines int
+			HeapAlloc  uint64 `json:"heap_alloc_bytes"`
+		}
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Build.Go != runtime.Version() {
+		t.Errorf("build %+v; want the Go version", got.Build)
+	}
+	if got.Runtime.Goroutines == 0 || got.Runtime.HeapAlloc == 0 {
+		t.Errorf("runtime %+v; want the goroutines and heap", got.Runtime)
+	}
+	if got.Lines.Accepted != 2 || got.Lines.Rejected["too_old"] != 1 {
+		t.Errorf("lines %+v; want 2 accepted, 1 too old", got.Lines)
+	}
+	if got.Ingress == nil || got.Ingress.Capacity != 16 {
+		t.Errorf("ingress %+v; want the capacity of the pool's queues", got.Ingress)
+	}
+	if got.Series != 2 {
+		t.Errorf("series %d; want 2", got.Series)
+	}
+	if f := got.Flushes["30s"]; f.Metrics != 2 || len(f.Partial) != 1 {
+		t.Errorf("flushes %+v; want the 30s window's", got.Flushes)
+	}
+}
+
+func TestAdminReadyz(t *testing.T) {
+	s := New(store.NewPool(store.NewStore(store.Options{Shards: 4}), 1, 10, nil))
+	admin := NewAdminHandler(s, nil)
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("before Serve; got %d, want 503", code)
+	}
+	s.serving.Store(true)
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("serving; got %d, want 200", code)
+	}
+	s.saturation.reject()
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("right after shedding a line; got %d, want 503", code)
+	}
+	atomic.StoreInt64(&s.saturation.lastShed, time.Now().Add(-ReadyShedWindow).UnixNano())
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("once the shedding stopped; got %d, want 200", code)
+	}
+	s.Close()
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("after Close; got %d, want 503", code)
+	}
+}
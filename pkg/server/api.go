@@ -0,0 +1,504 @@
+//go:build !minimal
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Uploads that see no activity for this long are discarded
+const uploadIdleTimeout = time.Hour
+
+// apiServer is the HTTP API for producers that can't hold a TCP connection
+// open, it feeds the same ingest path as the listeners
+type apiServer struct {
+	server *Server
+	// requests that ingest need a bearer token
+	requireAuth bool
+
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+// Builds the API routes. With requireAuth the requests that ingest or
+// validate lines must carry a bearer token, as connections must send AUTH.
+func NewAPIHandler(s *Server, requireAuth bool) http.Handler {
+	a := &apiServer{server: s, requireAuth: requireAuth, uploads: make(map[string]*upload)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/ingest", profiled("ingest", a.authorized(a.ingest)))
+	mux.HandleFunc("POST /api/v1/validate", a.authorized(a.validate))
+	mux.HandleFunc("POST /api/v1/uploads", a.authorized(a.createUpload))
+	mux.HandleFunc("HEAD /api/v1/uploads/{id}", a.authorized(a.uploadOffset))
+	mux.HandleFunc("GET /api/v1/uploads/{id}", a.authorized(a.uploadStatus))
+	mux.HandleFunc("PATCH /api/v1/uploads/{id}", profiled("ingest", a.authorized(a.appendUpload)))
+	mux.HandleFunc("DELETE /api/v1/uploads/{id}", a.authorized(a.finishUpload))
+	mux.HandleFunc("GET /api/v1/metrics", a.metrics)
+	mux.HandleFunc("GET /api/v1/metrics/{name}", a.metrics)
+	mux.HandleFunc("GET /api/v1/subscribe", a.subscribe)
+	return mux
+}
+
+// Labels the requests a handler serves as the HTTP listener in the stage
+func profiled(stage string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pprof.Do(r.Context(), pprof.Labels("listener", "http", "stage", stage), func(context.Context) {
+			h(w, r)
+		})
+	}
+}
+
+// apiClient is who sent a request: its address, and the tenant and the id
+// of the bearer token it authenticated with, if any
+type apiClient struct {
+	host, tenant, token string
+}
+
+// Wraps a handler with the checks a connection goes through. The host must
+// be let in by the Access lists and hold no more than its share of requests
+// at once, and with requireAuth must send the token of a tenant as
+//
+//	Authorization: Bearer <token>
+//
+// A valid token puts the lines in its tenant whether or not one is
+// required, an invalid one is always refused.
+func (a *apiServer) authorized(h func(http.ResponseWriter, *http.Request, apiClient)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := apiClient{host: remoteHost(r)}
+		release, err := a.server.Access.admit(c.host)
+		if errors.Is(err, ErrDenied) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+			return
+		}
+		defer release()
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token = strings.TrimSpace(token)
+		if ok {
+			tenant, valid := a.server.Credentials.Authenticate(token)
+			ok = valid
+			c.tenant, c.token = tenant, TokenID(token)
+		} else {
+			ok = !a.requireAuth
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": ErrUnauthenticated.Error()})
+			return
+		}
+		h(w, r, c)
+	}
+}
+
+// lineCounts tallies the lines fed through the API
+type lineCounts struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+// Parses and ingests a single line, bad lines are counted and skipped
+// rather than failing the whole request. With a batch delimiter the line
+// may carry several metrics separated by it and is taken whole or not at
+// all.
+func (a *apiServer) ingestLine(line, batch string, c apiClient, counts *lineCounts) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	parse := parseFormat("tsv", a.server.Parsing)
+	if batch != "" {
+		parse = parser.Batch(parse, batch)
+	}
+	metrics, err := parse(line)
+	if err != nil {
+		a.server.countMalformed(err)
+		counts.Rejected++
+		return
+	}
+	if batch != "" && len(metrics) > 1 {
+		if err := a.server.checkBatch(metrics, parser.NamePolicy{}); err != nil {
+			counts.Rejected++
+			return
+		}
+	}
+	in := &intake{policy: SaturateBlock, dropped: &a.server.saturation, listener: "api", token: c.token}
+	for i := range metrics {
+		metrics[i].Tenant = c.tenant
+		a.server.ingest(&metrics[i], c.host, in)
+	}
+	counts.Accepted++
+}
+
+// POST /api/v1/ingest takes a body of metric lines in one go, with
+// ?batch=<delimiter> each line may carry several metrics separated by it
+// and is taken whole or not at all
+func (a *apiServer) ingest(w http.ResponseWriter, r *http.Request, c apiClient) {
+	var counts lineCounts
+	batch := r.URL.Query().Get("batch")
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		a.ingestLine(scanner.Text(), batch, c, &counts)
+	}
+	if err := scanner.Err(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "counts": counts})
+		return
+	}
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// aggregate is a metric of the window in progress as the query API
+// returns it
+type aggregate struct {
+	Name  string            `json:"name"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Type  string            `json:"type"`
+	Count int               `json:"count"`
+	Mean  jsonNumber        `json:"mean"`
+	Min   jsonNumber        `json:"min"`
+	Max   jsonNumber        `json:"max"`
+	// the latest timestamp aggregated
+	Time time.Time `json:"time"`
+}
+
+func newAggregate(m parser.Metric) aggregate {
+	agg := aggregate{
+		Name: m.Name, Type: m.Type.String(), Count: m.Count,
+		Mean: floatNumber(m.Mean), Min: floatNumber(m.Min), Max: floatNumber(m.Max), Time: m.Time.UTC(),
+	}
+	if m.Tags != "" {
+		agg.Tags = make(map[string]string)
+		for _, kv := range strings.Split(m.Tags, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			agg.Tags[k] = v
+		}
+	}
+	return agg
+}
+
+// GET /api/v1/metrics returns what the window in progress holds so far,
+// the first window when there are several, ordered by key.
+// GET /api/v1/metrics/{name} only returns the metrics of the name, one per
+// tag set, and 404 when there are none.
+func (a *apiServer) metrics(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	aggregates := []aggregate{}
+	metrics := a.server.Store.Snapshot()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Key() < metrics[j].Key() })
+	for _, m := range metrics {
+		if name != "" && m.Name != name {
+			continue
+		}
+		aggregates = append(aggregates, newAggregate(m))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if name != "" && len(aggregates) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown metric"})
+		return
+	}
+	writeJSON(w, http.StatusOK, aggregates)
+}
+
+// GET /api/v1/subscribe?pattern=<glob>&buffer=<flushes>&policy=<policy>
+// streams every metric the first window flushes from then on as server-sent
+// events, one metric event per metric, optionally only those whose name or
+// key matches the glob. A subscriber too slow for the flushes loses them as
+// its policy says, drop-oldest by default, and is closed for disconnect.
+func (a *apiServer) subscribe(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pattern := q.Get("pattern")
+	if _, err := path.Match(pattern, ""); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	size := DefaultSubscriberBuffer
+	if v := q.Get("buffer"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size < 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "buffer must be a positive number of flushes"})
+			return
+		}
+	}
+	policy, err := parseDropPolicy(q.Get("policy"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if a.server.Subscribers == nil || !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no flushes are published"})
+		return
+	}
+
+	sub := a.server.Subscribers.subscribe("sse "+remoteHost(r), size, policy)
+	defer a.server.Subscribers.unsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case batch, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			for _, m := range batch {
+				if !subscribed(pattern, m) {
+					continue
+				}
+				data, _ := json.Marshal(newAggregate(m))
+				if _, err := fmt.Fprintf(w, "event: metric\ndata: %s\n\n", data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// upload is a resumable upload of a large metric file. Lines are ingested as
+// soon as they are complete, the trailing partial line is held until the
+// next chunk arrives.
+type upload struct {
+	mu sync.Mutex
+	id string
+	// the tenant that started it, the only one that may go on with it
+	tenant  string
+	offset  int64
+	length  int64 // -1 until the client declares it
+	partial []byte
+	counts  lineCounts
+	touched time.Time
+	done    bool
+}
+
+// The protocol follows the core of tus (https://tus.io):
+//
+//	POST   /api/v1/uploads        start an upload, optionally declaring Upload-Length
+//	HEAD   /api/v1/uploads/{id}   Upload-Offset says how much has been received
+//	PATCH  /api/v1/uploads/{id}   append the body at Upload-Offset
+//	DELETE /api/v1/uploads/{id}   finish early, ingesting any trailing partial line
+//
+// A client whose connection drops asks for the offset and resumes from there.
+func (a *apiServer) createUpload(w http.ResponseWriter, r *http.Request, c apiClient) {
+	u := &upload{id: newUploadID(), tenant: c.tenant, length: -1, touched: time.Now()}
+	if v := r.Header.Get("Upload-Length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid Upload-Length"})
+			return
+		}
+		u.length = n
+	}
+
+	a.mu.Lock()
+	a.expireUploads()
+	a.uploads[u.id] = u
+	a.mu.Unlock()
+
+	w.Header().Set("Location", "/api/v1/uploads/"+u.id)
+	w.Header().Set("Upload-Offset", "0")
+	writeJSON(w, http.StatusCreated, map[string]string{"id": u.id})
+}
+
+// Drops idle uploads, a.mu must be held
+func (a *apiServer) expireUploads() {
+	for id, u := range a.uploads {
+		u.mu.Lock()
+		idle := time.Since(u.touched) > uploadIdleTimeout
+		u.mu.Unlock()
+		if idle {
+			delete(a.uploads, id)
+		}
+	}
+}
+
+// Returns the upload of the request's id, nil when there is none the
+// client's tenant started
+func (a *apiServer) lookupUpload(w http.ResponseWriter, r *http.Request, c apiClient) *upload {
+	a.mu.Lock()
+	u := a.uploads[r.PathValue("id")]
+	a.mu.Unlock()
+	if u != nil && u.tenant != c.tenant {
+		u = nil
+	}
+	if u == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown upload"})
+	}
+	return u
+}
+
+func (a *apiServer) uploadOffset(w http.ResponseWriter, r *http.Request, c apiClient) {
+	u := a.lookupUpload(w, r, c)
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.setHeaders(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *apiServer) uploadStatus(w http.ResponseWriter, r *http.Request, c apiClient) {
+	u := a.lookupUpload(w, r, c)
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.setHeaders(w)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":     u.id,
+		"offset": u.offset,
+		"length": u.length,
+		"done":   u.done,
+		"counts": u.counts,
+	})
+}
+
+func (a *apiServer) appendUpload(w http.ResponseWriter, r *http.Request, c apiClient) {
+	u := a.lookupUpload(w, r, c)
+	if u == nil {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing or invalid Upload-Offset"})
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.touched = time.Now()
+	if u.done {
+		writeJSON(w, http.StatusGone, map[string]string{"error": "upload already finished"})
+		return
+	}
+	if offset != u.offset {
+		// the client is out of sync, it needs to HEAD and resume
+		u.setHeaders(w)
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("offset %d does not match %d", offset, u.offset)})
+		return
+	}
+
+	// progress is kept as the body is read so a dropped connection only
+	// loses what never arrived
+	body := io.Reader(r.Body)
+	if u.length >= 0 {
+		body = io.LimitReader(r.Body, u.length-u.offset+1)
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if u.length >= 0 && u.offset+int64(n) > u.length {
+			u.write(a, buf[:u.length-u.offset], c)
+			u.finish(a, c)
+			u.setHeaders(w)
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "body exceeds Upload-Length"})
+			return
+		}
+		u.write(a, buf[:n], c)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				slog.Warn("upload interrupted", "upload", u.id, "remote", c.host, "err", err)
+			}
+			return
+		}
+	}
+
+	if u.length >= 0 && u.offset == u.length {
+		u.finish(a, c)
+	}
+	u.setHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiServer) finishUpload(w http.ResponseWriter, r *http.Request, c apiClient) {
+	u := a.lookupUpload(w, r, c)
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.finish(a, c)
+	counts := u.counts
+	u.mu.Unlock()
+
+	a.mu.Lock()
+	delete(a.uploads, u.id)
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, counts)
+}
+
+// Ingests every complete line in the chunk, u.mu must be held
+func (u *upload) write(a *apiServer, chunk []byte, c apiClient) {
+	u.offset += int64(len(chunk))
+	data := append(u.partial, chunk...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		a.ingestLine(string(data[:i]), "", c, &u.counts)
+		data = data[i+1:]
+	}
+	u.partial = append([]byte(nil), data...)
+}
+
+// Ingests the trailing partial line, u.mu must be held
+func (u *upload) finish(a *apiServer, c apiClient) {
+	if u.done {
+		return
+	}
+	u.done = true
+	a.ingestLine(string(u.partial), "", c, &u.counts)
+	u.partial = nil
+}
+
+func (u *upload) setHeaders(w http.ResponseWriter) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	if u.length >= 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.length, 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func newUploadID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Returns the IP address of the HTTP client
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,269 @@
+//go:build !minimal
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestResumableUpload(t *testing.T) {
+	store := store.NewStore(store.Options{})
+	srv := httptest.NewServer(NewAPIHandler(New(store), false))
+	defer srv.Close()
+
+	now := time.Now().UTC().Add(-time.Second).Format(parser.ISO8601Format)
+	body := fmt.Sprintf("foo\t1\t%s\nfoo\t3\t%s\nbad line\nbar\t5\t%s", now, now, now)
+
+	do := func(method, url, offset, data string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+url, strings.NewReader(data))
+		if offset != "" {
+			req.Header.Set("Upload-Offset", offset)
+		}
+		if method == http.MethodPost {
+			req.Header.Set("Upload-Length", fmt.Sprint(len(body)))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/api/v1/uploads", "", "")
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || loc == "" {
+		t.Fatalf("create upload; got %d %q", resp.StatusCode, loc)
+	}
+
+	// the first chunk ends mid line
+	split := len(body) / 2
+	if resp := do(http.MethodPatch, loc, "0", body[:split]); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("first chunk; got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodHead, loc, "", ""); resp.Header.Get("Upload-Offset") != fmt.Sprint(split) {
+		t.Errorf("offset; got %s, want %d", resp.Header.Get("Upload-Offset"), split)
+	}
+	if resp := do(http.MethodPatch, loc, "0", body); resp.StatusCode != http.StatusConflict {
+		t.Errorf("stale offset; got %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if resp := do(http.MethodPatch, loc, fmt.Sprint(split), body[split:]); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("second chunk; got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodPatch, loc, fmt.Sprint(len(body)), "x"); resp.StatusCode != http.StatusGone {
+		t.Errorf("patch after completion; got %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+
+	got := map[string]float64{}
+	for _, m := range store.Flush() {
+		got[m.Name] = m.Mean
+	}
+	if len(got) != 2 || got["foo"] != 2 || got["bar"] != 5 {
+		t.Errorf("flush; got %v, want foo 2 and bar 5", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	store := store.NewStore(store.Options{})
+	srv := httptest.NewServer(NewAPIHandler(New(store), false))
+	defer srv.Close()
+
+	now := time.Now().UTC().Add(-time.Second).Format(parser.ISO8601Format)
+	old := time.Now().UTC().Add(-time.Hour).Format(parser.ISO8601Format)
+	body := fmt.Sprintf("foo\t1\t%s\n\nbad line\nfoo\t2\t%s\n", now, old)
+	resp, err := http.Post(srv.URL+"/api/v1/validate", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Counts lineCounts   `json:"counts"`
+		Lines  []lineResult `json:"lines"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Counts != (lineCounts{Accepted: 1, Rejected: 2}) || len(got.Lines) != 3 {
+		t.Fatalf("validate; got %+v", got)
+	}
+	if l := got.Lines[0]; !l.Accepted || len(l.Metrics) != 1 || l.Metrics[0].Key != "foo" {
+		t.Errorf("line 1; got %+v, want foo accepted", l)
+	}
+	if l := got.Lines[1]; l.Line != 3 || l.Accepted || l.Error == "" {
+		t.Errorf("line 3; got %+v, want a parse error", l)
+	}
+	if l := got.Lines[2]; l.Accepted || !strings.Contains(l.Error, "max age") {
+		t.Errorf("line 4; got %+v, want too old", l)
+	}
+	// nothing reaches the store
+	if n := len(store.Flush()); n != 0 {
+		t.Errorf("flush; got %d metrics, want none", n)
+	}
+
+	resp, err = http.Post(srv.URL+"/api/v1/validate?format=csv", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("validate csv; got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestMetricsQuery(t *testing.T) {
+	store := store.NewStore(store.Options{})
+	srv := httptest.NewServer(NewAPIHandler(New(store), false))
+	defer srv.Close()
+
+	at := time.Now().UTC().Add(-time.Second).Truncate(time.Second)
+	now := at.Format(parser.ISO8601Format)
+	body := fmt.Sprintf("foo\t1\t%s\nfoo\t3\t%s\nbar\t5\t%s\n", now, now, now)
+	resp, err := http.Post(srv.URL+"/api/v1/ingest", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	type aggregate struct {
+		Name           string
+		Count          int
+		Mean, Min, Max float64
+		Time           time.Time
+	}
+	get := func(url string, want int) []aggregate {
+		resp, err := http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("GET %s; got %d, want %d", url, resp.StatusCode, want)
+		}
+		var got []aggregate
+		json.NewDecoder(resp.Body).Decode(&got)
+		return got
+	}
+	if got := get("/api/v1/metrics", http.StatusOK); len(got) != 2 || got[0].Name != "bar" || got[1].Name != "foo" {
+		t.Fatalf("metrics; got %+v, want bar and foo", got)
+	}
+	got := get("/api/v1/metrics/foo", http.StatusOK)
+	if len(got) != 1 || got[0].Count != 2 || got[0].Mean != 2 || got[0].Min != 1 || got[0].Max != 3 || !got[0].Time.Equal(at) {
+		t.Errorf("foo; got %+v", got)
+	}
+	get("/api/v1/metrics/baz", http.StatusNotFound)
+	// querying leaves the window in place
+	if n := len(store.Flush()); n != 2 {
+		t.Errorf("flush; got %d metrics, want 2", n)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := New(store.NewStore(store.Options{}))
+	s.Subscribers = NewBroadcaster()
+	srv := httptest.NewServer(NewAPIHandler(s, false))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/subscribe?pattern=foo*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("subscribe; got %d %s", resp.StatusCode, ct)
+	}
+	s.Subscribers.Publish([]parser.Metric{{Name: "bar", Count: 1}, {Name: "foo", Tags: "host=a", Count: 2, Mean: 1.5}})
+
+	lines := bufio.NewScanner(resp.Body)
+	var events []string
+	for lines.Scan() && len(events) < 1 {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	var got struct {
+		Name  string
+		Tags  map[string]string
+		Count int
+		Mean  float64
+	}
+	if len(events) != 1 || json.Unmarshal([]byte(events[0]), &got) != nil || got.Name != "foo" || got.Tags["host"] != "a" || got.Count != 2 || got.Mean != 1.5 {
+		t.Errorf("events %q; want foo alone", events)
+	}
+
+	for _, bad := range []string{"?pattern=[", "?buffer=0", "?policy=never"} {
+		resp, err := http.Get(srv.URL + "/api/v1/subscribe" + bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("subscribe%s; got %d, want %d", bad, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	agg := store.NewStore(store.Options{})
+	s := New(agg)
+	s.Credentials.AddToken("acme", "secret")
+	srv := httptest.NewServer(NewAPIHandler(s, true))
+	defer srv.Close()
+
+	now := time.Now().UTC().Add(-time.Second).Format(parser.ISO8601Format)
+	post := func(url, token string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+url, strings.NewReader("cpu\t1\t"+now+"\n"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, url := range []string{"/api/v1/ingest", "/api/v1/validate", "/api/v1/uploads"} {
+		for _, token := range []string{"", "wrong"} {
+			if code := post(url, token); code != http.StatusUnauthorized {
+				t.Errorf("POST %s with token %q; got %d, want %d", url, token, code, http.StatusUnauthorized)
+			}
+		}
+	}
+	if code := post("/api/v1/ingest", "secret"); code != http.StatusOK {
+		t.Fatalf("POST /api/v1/ingest; got %d, want %d", code, http.StatusOK)
+	}
+	if got := agg.Flush(); len(got) != 1 || got[0].Key() != "cpu{tenant=acme}" {
+		t.Errorf("flush; got %v, want cpu of the tenant acme", got)
+	}
+
+	// another tenant can't go on with the upload
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/uploads", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	s.Credentials.AddToken("other", "other-secret")
+	req, _ = http.NewRequest(http.MethodHead, srv.URL+resp.Header.Get("Location"), nil)
+	req.Header.Set("Authorization", "Bearer other-secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD the upload of another tenant; got %v %v, want %d", resp, err, http.StatusNotFound)
+	}
+
+	s.Access = NewAccess(nil, []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}, 0)
+	if code := post("/api/v1/ingest", "secret"); code != http.StatusForbidden {
+		t.Errorf("POST /api/v1/ingest from a denied host; got %d, want %d", code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Attribution tags every metric accepted with where it came from, so the
+// series of each source aggregate apart and the report breaks every
+// aggregate down by source, a row for each. A tag the producer sent under
+// the same key is replaced. The zero Attribution tags nothing.
+type Attribution struct {
+	// the producer's address, the path of a tailed file or the topic of an
+	// MQTT message, as the remote tag
+	Remote bool
+	// the id of the AUTH token the connection sent, see TokenID, as the
+	// token tag
+	Token bool
+	// the listener the metric came in on, like tcp://:4268, as the
+	// listener tag
+	Listener bool
+}
+
+// Parses the -attribute flag, a comma-separated list of remote, token and
+// listener
+func ParseAttribution(list string) (Attribution, error) {
+	var a Attribution
+	if list == "" {
+		return a, nil
+	}
+	for _, source := range strings.Split(list, ",") {
+		switch strings.TrimSpace(source) {
+		case "remote":
+			a.Remote = true
+		case "token":
+			a.Token = true
+		case "listener":
+			a.Listener = true
+		default:
+			return a, fmt.Errorf("unknown source %q, want remote, token or listener", source)
+		}
+	}
+	return a, nil
+}
+
+// Tags the metric with its sources. A source too long for a tag value, or
+// unknown, is left out.
+func (a Attribution) apply(m *parser.Metric, host string, in *intake) {
+	for _, source := range [...]struct {
+		on         bool
+		key, value string
+	}{
+		{a.Remote, "remote", host},
+		{a.Token, "token", in.token},
+		{a.Listener, "listener", in.listener},
+	} {
+		if !source.on || source.value == "" {
+			continue
+		}
+		if tags, err := parser.SetTag(m.Tags, source.key, source.value); err == nil {
+			m.Tags = tags
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestParseAttribution(t *testing.T) {
+	for list, want := range map[string]Attribution{
+		"":                       {},
+		"remote":                 {Remote: true},
+		"remote, token,listener": {Remote: true, Token: true, Listener: true},
+	} {
+		if got, err := ParseAttribution(list); err != nil || got != want {
+			t.Errorf("ParseAttribution(%q); got %+v %v, want %+v", list, got, err, want)
+		}
+	}
+	if _, err := ParseAttribution("remote,port"); err == nil {
+		t.Error("ParseAttribution(remote,port); got nil error")
+	}
+}
+
+func TestAttribution(t *testing.T) {
+	agg := store.NewStore(store.Options{Shards: 4})
+	s := New(agg)
+	s.Attribution = Attribution{Remote: true, Token: true, Listener: true}
+	s.Credentials.AddToken("acme", "secret")
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 1, ReusePort: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	conn, err := net.Dial("tcp", s.listeners[0].acceptors[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the remote tag the producer sent is replaced
+	fmt.Fprintf(conn, "AUTH secret\ncpu\t1\t%d\tremote=spoofed\n", time.Now().Unix())
+	conn.Close()
+
+	tags, _ := parser.CanonicalTags([][2]string{{"remote", "127.0.0.1"}, {"token", TokenID("secret")},
+		{"listener", "tcp://127.0.0.1:0"}, {"tenant", "acme"}})
+	want := "cpu{" + tags + "}"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snapshot := agg.Snapshot()
+		if len(snapshot) == 1 && snapshot[0].Key() == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stored %v; want %s", snapshot, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a source that isn't known, the token of a connection without AUTH, is
+	// left out
+	m := parser.Metric{Name: "mem", Tags: "remote=10.0.0.1"}
+	s.Attribution.apply(&m, "10.0.0.2", &intake{listener: "tcp://:4268"})
+	if m.Tags != "listener=tcp://:4268,remote=10.0.0.2" {
+		t.Errorf("apply(); got tags %s", m.Tags)
+	}
+}
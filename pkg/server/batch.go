@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Checks every metric of a line of a batch listener before any of it is
+// ingested, so a line is taken whole or not at all. The first metric
+// ingest would reject for its name, value or time rejects the line and is
+// counted as ingest would count it. What would be dropped, by the filter or
+// a scrub rule, doesn't. Rewritten names are checked against the names
+// policy of the listener.
+func (s *Server) checkBatch(metrics []parser.Metric, names parser.NamePolicy) error {
+	now := s.now()
+	for i, m := range metrics {
+		name := m.Name
+		s.Scrub.apply(&m)
+		if m.Name == "" {
+			continue
+		}
+		var err error
+		switch {
+		case m.Name != name && !names.Valid(m.Name):
+			err = ErrRewrittenName
+		default:
+			s.Normalize.apply(&m)
+			if s.reserved(m.Name) {
+				err = ErrReservedName
+			}
+		}
+		if err == nil && !s.Filter.allowed(m.Name) {
+			continue
+		}
+		if err == nil {
+			_, err = s.Values.apply(&m)
+		}
+		if err == nil {
+			err = s.checkTime(m.Time, now)
+		}
+		if err != nil {
+			s.countRejected(err)
+			return fmt.Errorf("metric %d of the batch: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Counts a metric checkBatch rejected as ingest counts it
+func (s *Server) countRejected(err error) {
+	switch {
+	case errors.Is(err, ErrTooOld):
+		atomic.AddUint64(&s.tooOld, 1)
+	case errors.Is(err, ErrTooNew):
+		atomic.AddUint64(&s.tooNew, 1)
+	case errors.Is(err, ErrNotFinite):
+		atomic.AddUint64(&s.values.nonFinite, 1)
+	case errors.Is(err, ErrNegative):
+		atomic.AddUint64(&s.values.negative, 1)
+	default:
+		atomic.AddUint64(&s.lines.badName, 1)
+	}
+}
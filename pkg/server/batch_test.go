@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestBatch(t *testing.T) {
+	agg := store.NewStore(store.Options{Shards: 4})
+	s := New(agg)
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 1, ReusePort: 1, Batch: ";"}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	conn, err := net.Dial("tcp", s.listeners[0].acceptors[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	now := time.Now().Unix()
+	fmt.Fprintf(conn, "REPLY\ncpu\t1\t%d;mem\t2\t%d;disk\t3\t%d\n", now, now, now)
+	fmt.Fprintf(conn, "net\t1\t%d;swap\t2\t%d\n", now, now-3600)
+	fmt.Fprintf(conn, "load\t1\t%d;load average\t2\t%d\n", now, now)
+	answers := bufio.NewScanner(conn)
+	for _, want := range []string{"OK", "ERR STALE", "ERR INVALID"} {
+		if !answers.Scan() || answers.Text()[:len(want)] != want {
+			t.Errorf("got %q, want %q", answers.Text(), want)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, m := range agg.Snapshot() {
+		names[m.Name] = true
+	}
+	if len(names) != 3 || !names["cpu"] || !names["mem"] || !names["disk"] {
+		t.Errorf("stored %v; want only the metrics of the first line", names)
+	}
+	if s.tooOld != 1 {
+		t.Errorf("stale %d; want the rejected batch counted once", s.tooOld)
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// dropPolicy decides what happens to a flush when a subscriber's buffer is
+// already full. Publishing never blocks so a slow subscriber can only ever
+// hurt itself, never the flush path or the other subscribers.
+type dropPolicy int
+
+const (
+	// discard the oldest buffered flush to make room for the new one
+	dropOldest dropPolicy = iota
+	// discard the new flush and keep what is already buffered
+	dropNewest
+	// close the subscription, the consumer is expected to reconnect
+	dropDisconnect
+)
+
+// Parses the textual form of a drop policy as used in configuration
+func parseDropPolicy(s string) (dropPolicy, error) {
+	switch s {
+	case "", "drop-oldest":
+		return dropOldest, nil
+	case "drop-newest":
+		return dropNewest, nil
+	case "disconnect":
+		return dropDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown drop policy %q", s)
+}
+
+func (p dropPolicy) String() string {
+	switch p {
+	case dropNewest:
+		return "drop-newest"
+	case dropDisconnect:
+		return "disconnect"
+	}
+	return "drop-oldest"
+}
+
+// How many flushes a subscriber of the API or the console buffers unless it
+// asks for another size
+const DefaultSubscriberBuffer = 16
+
+// Returns whether the metric's name or key matches the path.Match pattern
+// a subscriber filters by, every metric does when it is empty
+func subscribed(pattern string, m parser.Metric) bool {
+	if pattern == "" {
+		return true
+	}
+	if ok, _ := path.Match(pattern, m.Name); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, m.Key())
+	return ok
+}
+
+// subscriber receives every flushed collection on C until it unsubscribes or
+// is disconnected by its drop policy, in which case C is closed
+type subscriber struct {
+	C      chan []parser.Metric
+	name   string
+	policy dropPolicy
+
+	delivered uint64
+	dropped   uint64
+	closed    bool
+}
+
+// subscriberStats is a point in time view of a subscriber's lag
+type subscriberStats struct {
+	name      string
+	policy    dropPolicy
+	queued    int
+	capacity  int
+	delivered uint64
+	dropped   uint64
+}
+
+// Broadcaster fans each flush out to all of the streaming subscribers
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+	// subscribers removed by their drop policy
+	disconnects uint64
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: make(map[*subscriber]struct{})}
+}
+
+// Registers a new subscriber buffering up to size flushes
+func (b *Broadcaster) subscribe(name string, size int, policy dropPolicy) *subscriber {
+	if size < 1 {
+		size = 1
+	}
+	s := &subscriber{
+		C:      make(chan []parser.Metric, size),
+		name:   name,
+		policy: policy,
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Removes the subscriber and closes its channel, safe to call more than once
+func (b *Broadcaster) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(s)
+}
+
+func (b *Broadcaster) remove(s *subscriber) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(b.subs, s)
+	close(s.C)
+}
+
+// Hands the flushed collection to every subscriber without ever blocking
+func (b *Broadcaster) Publish(batch []parser.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		select {
+		case s.C <- batch:
+			s.delivered++
+			continue
+		default:
+		}
+
+		// the subscriber's buffer is full
+		s.dropped++
+		switch s.policy {
+		case dropOldest:
+			select {
+			case <-s.C:
+			default:
+			}
+			select {
+			case s.C <- batch:
+				s.delivered++
+			default:
+			}
+		case dropDisconnect:
+			b.disconnects++
+			b.remove(s)
+		}
+	}
+}
+
+// Returns the lag metrics for every active subscriber
+func (b *Broadcaster) stats() []subscriberStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := make([]subscriberStats, 0, len(b.subs))
+	for s := range b.subs {
+		stats = append(stats, subscriberStats{
+			name:      s.name,
+			policy:    s.policy,
+			queued:    len(s.C),
+			capacity:  cap(s.C),
+			delivered: s.delivered,
+			dropped:   s.dropped,
+		})
+	}
+	return stats
+}
+
+// Sums the drops across active subscribers along with the number of
+// subscribers that were disconnected for falling behind
+func (b *Broadcaster) Lag() (subscribers int, dropped, disconnects uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		dropped += s.dropped
+	}
+	return len(b.subs), dropped, b.disconnects
+}
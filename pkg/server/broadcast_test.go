@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestBroadcastDropPolicies(t *testing.T) {
+	b := NewBroadcaster()
+	oldest := b.subscribe("oldest", 2, dropOldest)
+	newest := b.subscribe("newest", 2, dropNewest)
+	disc := b.subscribe("disconnect", 2, dropDisconnect)
+
+	for i := 1; i <= 3; i++ {
+		b.Publish([]parser.Metric{{Name: "m", Value: float64(i)}})
+	}
+
+	if got := (<-oldest.C)[0].Value; got != 2 {
+		t.Errorf("drop-oldest first flush; got %v, want %v", got, 2)
+	}
+	if got := (<-newest.C)[0].Value; got != 1 {
+		t.Errorf("drop-newest first flush; got %v, want %v", got, 1)
+	}
+	<-disc.C
+	<-disc.C
+	if _, ok := <-disc.C; ok {
+		t.Errorf("disconnect subscriber still open after overflow")
+	}
+
+	n, dropped, disconnects := b.Lag()
+	if n != 2 || dropped != 2 || disconnects != 1 {
+		t.Errorf("lag(); got %d, %d, %d, want 2, 2, 1", n, dropped, disconnects)
+	}
+
+	// unsubscribing after a disconnect must not panic
+	b.unsubscribe(disc)
+	b.unsubscribe(oldest)
+}
@@ -0,0 +1,28 @@
+package server
+
+import "time"
+
+// errorBudget is how many malformed lines one connection may send within a
+// window before it is closed. A single bad line in a batch of thousands then
+// costs only itself, while a client sending nothing but garbage is still cut
+// off.
+type errorBudget struct {
+	limit  int
+	window time.Duration
+	// when the errors still inside the window happened, oldest first
+	spent []time.Time
+}
+
+// Records a malformed line at now, reporting whether the budget is exhausted
+// and the connection should be closed
+func (b *errorBudget) exhausted(now time.Time) bool {
+	if b.limit == 0 {
+		return true
+	}
+	keep := 0
+	for keep < len(b.spent) && now.Sub(b.spent[keep]) >= b.window {
+		keep++
+	}
+	b.spent = append(b.spent[keep:], now)
+	return len(b.spent) > b.limit
+}
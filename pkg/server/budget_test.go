@@ -0,0 +1,25 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErrorBudget(t *testing.T) {
+	now := time.Now()
+	strict := errorBudget{}
+	if !strict.exhausted(now) {
+		t.Errorf("exhausted() with no budget; got false")
+	}
+
+	b := errorBudget{limit: 2, window: time.Minute}
+	for i, want := range []bool{false, false, true} {
+		if got := b.exhausted(now.Add(time.Duration(i) * time.Second)); got != want {
+			t.Errorf("exhausted(%d); got %v, want %v", i, got, want)
+		}
+	}
+	// the errors age out of the window
+	if b.exhausted(now.Add(time.Minute + 2*time.Second)) {
+		t.Errorf("exhausted() a window later; got true")
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// BuildInfo identifies the binary, shown by -version and the status
+// document
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+	Go      string `json:"go"`
+}
+
+// Returns the build info of the version, commit and date injected with
+// -ldflags, any left empty being taken from what the Go toolchain embedded:
+// the main module's version and the VCS revision and time
+func NewBuildInfo(version, commit, date string) BuildInfo {
+	b := BuildInfo{Version: version, Commit: commit, Date: date, Go: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	if b.Version == "" && info.Main.Version != "(devel)" {
+		b.Version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && b.Commit == "":
+			b.Commit = setting.Value
+		case setting.Key == "vcs.time" && b.Date == "":
+			b.Date = setting.Value
+		}
+	}
+	return b
+}
+
+// Returns the build info as the -version line, "unknown" standing in for
+// what isn't known
+func (b BuildInfo) String() string {
+	or := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	return or(b.Version) + " (commit " + or(b.Commit) + ", built " + or(b.Date) + ", " + b.Go + ")"
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jeffdupont/go-challenge/pkg/client"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// the points each collector has on the ring, enough for the names to spread
+// within a few percent of evenly
+const clusterPoints = 128
+
+// Cluster spreads the metric names over the collectors behind a load
+// balancer, each owning the names hashing onto its arcs of a consistent hash
+// ring. A metric whose name a peer owns is forwarded to the peer's listener
+// of the peer format rather than aggregated, so every name is aggregated by
+// one collector and its mean isn't split between them. Adding or removing
+// a collector only moves the names of its arcs. Every collector must be
+// given the same peers, or find them by Gossip.
+type Cluster struct {
+	self, token string
+
+	mu   sync.RWMutex
+	ring []ringPoint
+	// the peers' clients and counters, by address
+	peers map[string]*clusterPeer
+}
+
+type ringPoint struct {
+	hash uint32
+	peer string
+}
+
+type clusterPeer struct {
+	client interface {
+		SendMetric(m parser.Metric) error
+		Close() error
+	}
+	forwarded, failed atomic.Uint64
+}
+
+// Returns the cluster of the peers, host:port addresses of their peer
+// listeners, self being this collector's among them. The peers are sent
+// the metrics they own in the background, authenticating with the token
+// when it isn't empty.
+func NewCluster(self string, peers []string, token string) (*Cluster, error) {
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		if seen[peer] {
+			return nil, fmt.Errorf("peer %s given twice", peer)
+		}
+		seen[peer] = true
+	}
+	if !seen[self] {
+		return nil, fmt.Errorf("this collector's address %s is not among the peers", self)
+	}
+	c := &Cluster{self: self, token: token}
+	if err := c.setPeers(peers); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Authenticate reports whether the token is the one the collectors of the
+// cluster forward with
+func (c *Cluster) Authenticate(token string) bool {
+	return c != nil && c.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1
+}
+
+// Rebuilds the ring of the peers, self among them. The clients of the peers
+// kept carry on, those of the peers gone send what is queued for them in
+// the background.
+func (c *Cluster) setPeers(peers []string) error {
+	var ring []ringPoint
+	clients := make(map[string]*clusterPeer)
+	c.mu.RLock()
+	old := c.peers
+	c.mu.RUnlock()
+	for _, peer := range peers {
+		for i := 0; i < clusterPoints; i++ {
+			ring = append(ring, ringPoint{hash: ringHash(peer + "#" + strconv.Itoa(i)), peer: peer})
+		}
+		if peer == c.self {
+			continue
+		}
+		if p, ok := old[peer]; ok {
+			clients[peer] = p
+			continue
+		}
+		cl, err := client.New(client.Config{Addr: peer, Token: c.token, Async: true})
+		if err != nil {
+			for addr, p := range clients {
+				if _, ok := old[addr]; !ok {
+					p.client.Close()
+				}
+			}
+			return err
+		}
+		clients[peer] = &clusterPeer{client: cl}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].peer < ring[j].peer
+	})
+	c.mu.Lock()
+	c.ring, c.peers = ring, clients
+	c.mu.Unlock()
+	for addr, p := range old {
+		if _, ok := clients[addr]; !ok {
+			go p.client.Close()
+		}
+	}
+	return nil
+}
+
+// FNV-1a, the same in every collector whatever -hash the stores use
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Owner returns the address of the collector aggregating the name, the one
+// of the first point of the ring at or after its hash
+func (c *Cluster) Owner(name string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.owner(name)
+}
+
+func (c *Cluster) owner(name string) string {
+	h := ringHash(name)
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.ring[i].peer
+}
+
+// Forwards the metric to its owner, false if this collector owns it. A nil
+// Cluster owns everything. ErrBusy is returned when the owner's queue is
+// full or the owner can't be reached.
+func (c *Cluster) forward(m parser.Metric) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	owner := c.owner(m.Name)
+	if owner == c.self {
+		return false, nil
+	}
+	p := c.peers[owner]
+	if err := p.client.SendMetric(m); err != nil {
+		p.failed.Add(1)
+		if errors.Is(err, client.ErrBufferFull) || errors.Is(err, client.ErrUnavailable) {
+			return true, fmt.Errorf("%w: forwarding to %s: %v", ErrBusy, owner, err)
+		}
+		return true, err
+	}
+	p.forwarded.Add(1)
+	return true, nil
+}
+
+// Report writes what was forwarded to each peer since the last report
+func (c *Cluster) Report(w io.Writer) {
+	if c == nil {
+		return
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	addrs := make([]string, 0, len(c.peers))
+	for addr := range c.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var parts []string
+	for _, addr := range addrs {
+		p := c.peers[addr]
+		forwarded, failed := p.forwarded.Swap(0), p.failed.Swap(0)
+		if forwarded > 0 || failed > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d (failed %d)", addr, forwarded, failed))
+		}
+	}
+	if len(parts) > 0 {
+		fmt.Fprintf(w, "(10 sec): Cluster forwarded to %s\n", strings.Join(parts, ", "))
+	}
+}
+
+// Close sends what is still queued for the peers while they take it
+func (c *Cluster) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for _, p := range c.peers {
+		errs = append(errs, p.client.Close())
+	}
+	return errors.Join(errs...)
+}
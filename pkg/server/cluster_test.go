@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// peerClient records what a peer was forwarded
+type peerClient struct {
+	names []string
+}
+
+func (p *peerClient) SendMetric(m parser.Metric) error {
+	p.names = append(p.names, m.Name)
+	return nil
+}
+
+func (p *peerClient) Close() error { return nil }
+
+func TestClusterOwner(t *testing.T) {
+	peers := []string{"a:4270", "b:4270", "c:4270"}
+	three, err := NewCluster("a:4270", peers, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer three.Close()
+	two, err := NewCluster("a:4270", peers[:2], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer two.Close()
+
+	owned := make(map[string]int)
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("metric-%d", i)
+		owner := three.Owner(name)
+		owned[owner]++
+		if after := two.Owner(name); after != owner {
+			if owner != "c:4270" {
+				t.Errorf("Owner(%s) moved from %s to %s when c left", name, owner, after)
+			}
+			moved++
+		}
+	}
+	for _, peer := range peers {
+		if owned[peer] < 500 {
+			t.Errorf("names owned by %s; got %d of 3000, want about a third", peer, owned[peer])
+		}
+	}
+	if moved != owned["c:4270"] {
+		t.Errorf("names moved when c left; got %d, want c's %d", moved, owned["c:4270"])
+	}
+
+	for _, bad := range [][]string{{"b:4270"}, {"a:4270", "a:4270"}} {
+		if c, err := NewCluster("a:4270", bad, ""); err == nil {
+			c.Close()
+			t.Errorf("NewCluster(a, %v); want an error", bad)
+		}
+	}
+}
+
+func TestIngestForwarded(t *testing.T) {
+	c, err := NewCluster("a:4270", []string{"a:4270", "b:4270"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	b := &peerClient{}
+	c.peers["b:4270"].client = b
+	st := &fullStore{}
+	s := New(st)
+	s.Cluster = c
+
+	var mine []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("cpu-%d", i)
+		if c.Owner(name) == "a:4270" {
+			mine = append(mine, name)
+		}
+		m := parser.Metric{Name: name, Value: 1, Count: 1, Time: time.Now()}
+		if err := s.Ingest(&m, "test"); err != nil {
+			t.Errorf("Ingest(%s); got error %v", name, err)
+		}
+	}
+	if st.updates != len(mine) || len(b.names) != 20-len(mine) {
+		t.Errorf("store updates %d and forwarded %v; want the %d names owned here stored and the rest forwarded", st.updates, b.names, len(mine))
+	}
+
+	// what a peer forwarded is aggregated whoever owns it
+	m := parser.Metric{Name: b.names[0], Value: 1, Count: 1, Time: time.Now()}
+	if err := s.ingest(&m, "a", &intake{policy: SaturateBlock, dropped: &s.saturation, peer: true}); err != nil || st.updates != len(mine)+1 {
+		t.Errorf("ingest() from a peer; got %v and %d store updates, want it stored", err, st.updates)
+	}
+
+	var report bytes.Buffer
+	s.Cluster.Report(&report)
+	if want := fmt.Sprintf("Cluster forwarded to b:4270 %d (failed 0)", len(b.names)); !strings.Contains(report.String(), want) {
+		t.Errorf("Report(); got %q, want %q", report.String(), want)
+	}
+}
+
+func TestClusterAuthenticate(t *testing.T) {
+	c, err := NewCluster("a:4270", []string{"a:4270"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Authenticate("secret") || c.Authenticate("guess") {
+		t.Error("Authenticate(); want only the cluster token")
+	}
+	var none *Cluster
+	if none.Authenticate("") {
+		t.Error("Authenticate() without a cluster; want refused")
+	}
+}
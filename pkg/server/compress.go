@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/snappy"
+	"github.com/jeffdupont/go-challenge/pkg/zstd"
+)
+
+// DefaultMaxLineLength is the longest line a listener reads, in bytes
+const DefaultMaxLineLength = 64 * 1024
+
+// The first two bytes of every gzip stream (RFC 1952), they can never start
+// a valid metric line so they double as the negotiation signal, as do the
+// magic bytes of zstd frames and snappy framed streams
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// The buffers of finished connections are reused by new ones, so clients
+// that connect for a handful of lines don't each cost a fresh 4KB reader, or
+// a decompressor's far larger state
+var (
+	readerPool = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+	gzipPool   sync.Pool
+	zstdPool   = sync.Pool{New: func() any { return zstd.NewReader(nil) }}
+	snappyPool = sync.Pool{New: func() any { return snappy.NewReader(nil) }}
+	// lines too long for the reader's buffer are put together in these
+	linePool = sync.Pool{New: func() any { return new([]byte) }}
+)
+
+func getReader(r io.Reader) *bufio.Reader {
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(r)
+	return reader
+}
+
+// Returns the reader to the pool, it must not be used after
+func putReader(reader *bufio.Reader) {
+	reader.Reset(nil)
+	readerPool.Put(reader)
+}
+
+func getLineBuffer() *[]byte {
+	return linePool.Get().(*[]byte)
+}
+
+// Returns the line buffer to the pool unless it grew past the default line
+// limit, one outsized line shouldn't pin its memory for good
+func putLineBuffer(buf *[]byte) {
+	if cap(*buf) <= DefaultMaxLineLength {
+		linePool.Put(buf)
+	}
+}
+
+// Returns a buffered reader for the connection's metric lines, and the
+// function handing its buffers back once the connection is done with it.
+// Clients that open the stream with the magic bytes of gzip, zstd or the
+// snappy framing format are transparently decompressed, everyone else is
+// read as plain text.
+func newLineReader(r io.Reader) (*bufio.Reader, func(), error) {
+	reader := getReader(r)
+	if _, err := reader.Peek(1); err != nil {
+		// let the caller surface any read error on its first line
+		return reader, func() { putReader(reader) }, nil
+	}
+
+	var src io.Reader
+	var release func()
+	switch {
+	case hasMagic(reader, gzipMagic):
+		gz, _ := gzipPool.Get().(*gzip.Reader)
+		var err error
+		if gz == nil {
+			gz, err = gzip.NewReader(reader)
+		} else {
+			err = gz.Reset(reader)
+		}
+		if err != nil {
+			putReader(reader)
+			return nil, nil, err
+		}
+		src, release = gz, func() { gzipPool.Put(gz) }
+	case hasMagic(reader, zstd.Magic):
+		z := zstdPool.Get().(*zstd.Reader)
+		z.Reset(reader)
+		src, release = z, func() {
+			z.Reset(nil)
+			zstdPool.Put(z)
+		}
+	case hasMagic(reader, snappy.StreamMagic):
+		z := snappyPool.Get().(*snappy.Reader)
+		z.Reset(reader)
+		src, release = z, func() {
+			z.Reset(nil)
+			snappyPool.Put(z)
+		}
+	default:
+		return reader, func() { putReader(reader) }, nil
+	}
+	inflated := getReader(src)
+	return inflated, func() {
+		putReader(inflated)
+		release()
+		putReader(reader)
+	}, nil
+}
+
+// Returns whether the stream starts with the magic bytes, peeking no further
+// than they match so a short plain line isn't held up waiting for more
+func hasMagic(r *bufio.Reader, magic []byte) bool {
+	for n := 1; n <= len(magic); n++ {
+		b, err := r.Peek(n)
+		if err != nil || b[n-1] != magic[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the next line including its '\n'. A line of more than max bytes is
+// read to its end but not kept, so a client that never sends a newline can't
+// grow the buffer without bound, and an error wrapping parser.ErrTooLong is
+// returned in its place.
+//
+// The line is only valid until the next read. Most lines are returned
+// straight from the reader's buffer, those that don't fit in it are put
+// together in buf.
+func readLine(r *bufio.Reader, max int, buf *[]byte) ([]byte, error) {
+	chunk, err := r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		n := len(chunk)
+		if err == nil {
+			n--
+		}
+		if n <= max {
+			return chunk, err
+		}
+		if err == nil {
+			return nil, fmt.Errorf("%w, line of %d bytes exceeds %d", parser.ErrTooLong, n, max)
+		}
+		return nil, err
+	}
+
+	line := (*buf)[:0]
+	defer func() {
+		// keep whatever the buffer grew to for the next long line
+		if cap(line) > cap(*buf) {
+			*buf = line[:0]
+		}
+	}()
+	n := 0
+	for {
+		n += len(chunk)
+		if err == nil {
+			n--
+		}
+		if n <= max {
+			line = append(line, chunk...)
+		}
+		if err != bufio.ErrBufferFull {
+			break
+		}
+		chunk, err = r.ReadSlice('\n')
+	}
+	if err == nil && n > max {
+		return nil, fmt.Errorf("%w, line of %d bytes exceeds %d", parser.ErrTooLong, n, max)
+	}
+	return line, err
+}
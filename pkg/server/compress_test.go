@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/snappy"
+)
+
+func TestLineReaderCompressed(t *testing.T) {
+	lines := "asdf\t1\t2016-01-01T00:00:00Z\nqwer\t2\t2016-01-01T00:00:00Z\n"
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	io.WriteString(gz, lines)
+	gz.Close()
+	var framed bytes.Buffer
+	sw := snappy.NewWriter(&framed)
+	io.WriteString(sw, lines)
+	sw.Close()
+	// the lines as the zstd command compresses them
+	zstd := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x68, 0x35, 0x01, 0x00, 0xf0, 0x61, 0x73,
+		0x64, 0x66, 0x09, 0x31, 0x09, 0x32, 0x30, 0x31, 0x36, 0x2d, 0x30, 0x31,
+		0x2d, 0x30, 0x31, 0x54, 0x30, 0x30, 0x3a, 0x5a, 0x0a, 0x71, 0x77, 0x65,
+		0x72, 0x09, 0x32, 0x09, 0x02, 0x00, 0x3f, 0xff, 0xb4, 0x75, 0x4c, 0x36,
+		0x28, 0xbe, 0x64,
+	}
+
+	for _, input := range [][]byte{[]byte(lines), compressed.Bytes(), zstd, framed.Bytes()} {
+		// twice, the second time with the pooled readers of the first
+		for i := 0; i < 2; i++ {
+			r, release, err := newLineReader(bytes.NewReader(input))
+			if err != nil {
+				t.Fatalf("newLineReader(); got error %v", err)
+			}
+			got, _ := io.ReadAll(r)
+			release()
+			if string(got) != lines {
+				t.Errorf("newLineReader(); got %q, want %q", got, lines)
+			}
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	// a small buffer so long lines span several reads
+	r := bufio.NewReaderSize(strings.NewReader("short\n"+long+"\n"+long[:20]+"\nlast"), 16)
+	var buf []byte
+	for _, want := range []struct {
+		line    string
+		tooLong bool
+	}{{"short\n", false}, {"", true}, {long[:20] + "\n", false}} {
+		got, err := readLine(r, 20, &buf)
+		if errors.Is(err, parser.ErrTooLong) != want.tooLong || (err != nil && !want.tooLong) {
+			t.Errorf("readLine(); got error %v, want too long %v", err, want.tooLong)
+		}
+		if string(got) != want.line {
+			t.Errorf("readLine(); got %q, want %q", got, want.line)
+		}
+	}
+	if got, err := readLine(r, 20, &buf); string(got) != "last" || err != io.EOF {
+		t.Errorf("readLine() at the end; got %q %v, want last and EOF", got, err)
+	}
+}
+
+// A short-lived connection sending a few lines, its buffers come from the
+// pools once they are warm
+func BenchmarkShortConnection(b *testing.B) {
+	b.ReportAllocs()
+	lines := strings.Repeat("asdf\t1\t2016-01-01T00:00:00Z\n", 10)
+	for i := 0; i < b.N; i++ {
+		r, release, _ := newLineReader(strings.NewReader(lines))
+		buf := getLineBuffer()
+		for {
+			if _, err := readLine(r, DefaultMaxLineLength, buf); err != nil {
+				break
+			}
+		}
+		putLineBuffer(buf)
+		release()
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+// ConfigSetting is one resolved setting of the running process
+type ConfigSetting struct {
+	Value string `json:"value"`
+	// where the value came from, default or flag
+	Source  string `json:"source"`
+	Default string `json:"default"`
+}
+
+// Redacted stands in for the value of a secret setting
+const Redacted = "[redacted]"
+
+// listenerLimits are the limits a listener actually runs with
+type listenerLimits struct {
+	Listener   string `json:"listener"`
+	Format     string `json:"format"`
+	MaxConns   int    `json:"max_conns"`
+	Saturation string `json:"saturation"`
+	Sockets    int    `json:"sockets"`
+	MaxLine    int    `json:"max_line_length"`
+	// how long connections may go without a complete line
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	// how long a connection waits for a slot before it is turned away
+	AcceptWait string `json:"accept_wait,omitempty"`
+	// lines a second per connection and what happens to those over it
+	RateLimit  float64 `json:"rate_limit,omitempty"`
+	RateAction string  `json:"rate_action"`
+	// malformed lines skipped within the window before a connection closes
+	ErrorBudget int    `json:"error_budget,omitempty"`
+	ErrorWindow string `json:"error_window,omitempty"`
+}
+
+// effectiveLimits are the limits in force, which settings only imply. The
+// max age, for one, is raised to cover a -late-grace window.
+type effectiveLimits struct {
+	MaxAge        string           `json:"max_age"`
+	MaxFutureSkew string           `json:"max_future_skew"`
+	SampleRate    uint64           `json:"sample_rate"`
+	DedupSize     int              `json:"dedup_size,omitempty"`
+	DedupTTL      string           `json:"dedup_ttl,omitempty"`
+	RateLimit     float64          `json:"rate_limit,omitempty"`
+	Listeners     []listenerLimits `json:"listeners"`
+}
+
+func (s *Server) limits() effectiveLimits {
+	limits := effectiveLimits{
+		MaxAge:        s.MaxAge.String(),
+		MaxFutureSkew: s.MaxSkew.String(),
+		SampleRate:    s.SampleRate,
+		Listeners:     []listenerLimits{},
+	}
+	if s.RateLimit != nil {
+		limits.RateLimit = s.RateLimit.bucket.rate
+	}
+	if s.Dedup != nil {
+		limits.DedupSize, limits.DedupTTL = s.Dedup.size, s.Dedup.ttl.String()
+	}
+	for _, l := range s.listeners {
+		ll := listenerLimits{
+			Listener:   l.name,
+			Format:     l.format,
+			MaxConns:   l.slots.cap(),
+			Saturation: l.saturation.String(),
+			Sockets:    len(l.acceptors) + len(l.packets),
+			MaxLine:    l.maxLine,
+			RateLimit:  l.rateLimit,
+			RateAction: l.rateAction.String(),
+		}
+		if l.idleTimeout > 0 {
+			ll.IdleTimeout = l.idleTimeout.String()
+		}
+		if l.acceptWait > 0 {
+			ll.AcceptWait = l.acceptWait.String()
+		}
+		if l.errorBudget > 0 {
+			ll.ErrorBudget, ll.ErrorWindow = l.errorBudget, l.errorWindow.String()
+		}
+		limits.Listeners = append(limits.Listeners, ll)
+	}
+	return limits
+}
@@ -0,0 +1,46 @@
+//go:build !minimal
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	s := New(&fullStore{})
+	s.Dedup = NewDedup(100, time.Minute)
+	s.Settings = map[string]ConfigSetting{
+		"max-age":  {Value: "1m0s", Source: "default", Default: "1m0s"},
+		"sign-key": {Value: Redacted, Source: "flag"},
+	}
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "statsd", MaxConns: 7, ReusePort: 1}); err != nil {
+		t.Fatalf("Listen(); got error %v", err)
+	}
+	defer s.Close()
+
+	rec := httptest.NewRecorder()
+	NewAdminHandler(s, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/config/effective", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /config/effective; got %d %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Settings map[string]ConfigSetting `json:"settings"`
+		Limits   effectiveLimits          `json:"limits"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /config/effective; got %v decoding %s", err, rec.Body)
+	}
+	if got.Settings["sign-key"].Value != Redacted || got.Settings["max-age"].Source != "default" {
+		t.Errorf("GET /config/effective settings; got %v", got.Settings)
+	}
+	if got.Limits.MaxAge != "1m0s" || got.Limits.DedupSize != 100 || len(got.Limits.Listeners) != 1 {
+		t.Fatalf("GET /config/effective limits; got %+v", got.Limits)
+	}
+	if l := got.Limits.Listeners[0]; l.Format != "statsd" || l.MaxConns != 7 || l.Sockets != 1 {
+		t.Errorf("GET /config/effective listener; got %+v", l)
+	}
+}
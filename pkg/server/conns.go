@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// connStats counts the connections of every listener: those opened and
+// closed since the last report, the most open at once since the last report
+// and since startup, and those open by remote host
+type connStats struct {
+	opened, closed uint64
+
+	mu                 sync.Mutex
+	active, peak, most int64
+	hosts              map[string]int
+}
+
+// Counts a connection from the host opened on the listener
+func (c *connStats) open(l *listener, host string) {
+	atomic.AddUint64(&c.opened, 1)
+	raisePeak(&l.stats.peak, atomic.AddInt64(&l.stats.active, 1))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]int)
+	}
+	c.hosts[host]++
+	c.active++
+	c.peak = max(c.peak, c.active)
+	c.most = max(c.most, c.active)
+}
+
+// Counts the connection from the host closed
+func (c *connStats) close(l *listener, host string) {
+	atomic.AddUint64(&c.closed, 1)
+	atomic.AddInt64(&l.stats.active, -1)
+	atomic.AddUint64(&l.stats.closed, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts[host]--; c.hosts[host] <= 0 {
+		delete(c.hosts, host)
+	}
+	c.active--
+}
+
+// Raises the peak to n if it is higher
+func raisePeak(peak *int64, n int64) {
+	for {
+		p := atomic.LoadInt64(peak)
+		if n <= p || atomic.CompareAndSwapInt64(peak, p, n) {
+			return
+		}
+	}
+}
+
+// Returns the connections open by remote host, and the most open at once
+// since startup
+func (c *connStats) byHost() (map[string]int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hosts := make(map[string]int, len(c.hosts))
+	for host, n := range c.hosts {
+		hosts[host] = n
+	}
+	return hosts, c.most
+}
+
+// Writes the connections opened and closed since the last report, those open
+// and the hosts holding the most of them
+func (c *connStats) report(w io.Writer) {
+	opened, closed := atomic.SwapUint64(&c.opened, 0), atomic.SwapUint64(&c.closed, 0)
+	c.mu.Lock()
+	active, peak := c.active, c.peak
+	c.peak = c.active
+	type hostConns struct {
+		host string
+		n    int
+	}
+	hosts := make([]hostConns, 0, len(c.hosts))
+	for host, n := range c.hosts {
+		hosts = append(hosts, hostConns{host, n})
+	}
+	c.mu.Unlock()
+	if opened == 0 && closed == 0 && active == 0 {
+		return
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].n != hosts[j].n {
+			return hosts[i].n > hosts[j].n
+		}
+		return hosts[i].host < hosts[j].host
+	})
+	top := make([]string, 0, 5)
+	for _, h := range hosts[:min(len(hosts), 5)] {
+		top = append(top, fmt.Sprintf("%s %d", h.host, h.n))
+	}
+	fmt.Fprintf(w, "(10 sec): Connections opened %d, closed %d, active %d, peak %d, from %d hosts (%s)\n", opened, closed, active, peak, len(hosts), strings.Join(top, ", "))
+}
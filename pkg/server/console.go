@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Console is the text admin protocol, served on a port of its own like
+// statsd's admin interface. A client sends a command per line and each
+// answer ends with a line of END, or is a single OK, DELETED or ERROR line:
+//
+//	STATS        the counters since startup
+//	GET <name>   the metrics of the name the window in progress holds
+//	FLUSH        flushes every window now
+//	RESET        discards what the windows hold so far
+//	CONNS        the connections being handled
+//	MAXCONNS <n> [listener]
+//	             sets how many connections the listener, or every one,
+//	             handles at once, answering OK with the listeners changed
+//	SUBSCRIBE [glob]
+//	             streams the metrics the first window flushes from then on,
+//	             those whose name or key matches the glob when given, in
+//	             the form of GET; the connection takes no more commands
+//	QUIT         closes the connection
+type Console struct {
+	server *Server
+	// flushes every window, nil answers FLUSH with an error
+	Flush   func()
+	started time.Time
+}
+
+// Returns the console of the server
+func NewConsole(s *Server) *Console {
+	return &Console{server: s, started: time.Now()}
+}
+
+// Serve answers the commands of every connection accepted until the
+// listener is closed. Other accept failures are logged and retried, backing
+// off while they last.
+func (c *Console) Serve(l net.Listener) error {
+	retry := time.Duration(0)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			retry = min(max(2*retry, acceptRetryMin), acceptRetryMax)
+			slog.Warn("console: accept failed", "err", err, "retry", retry)
+			time.Sleep(retry)
+			continue
+		}
+		retry = 0
+		go c.handle(conn)
+	}
+}
+
+func (c *Console) handle(conn net.Conn) {
+	defer conn.Close()
+	defer c.server.Isolate("console ("+conn.RemoteAddr().String()+")", nil)
+	lines := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for lines.Scan() {
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(lines.Text()), " ")
+		if strings.EqualFold(cmd, "QUIT") {
+			return
+		}
+		if strings.EqualFold(cmd, "SUBSCRIBE") {
+			c.subscribe(conn, w, strings.TrimSpace(arg))
+			return
+		}
+		c.command(w, strings.ToUpper(cmd), strings.TrimSpace(arg))
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// Writes the answer to the command
+func (c *Console) command(w io.Writer, cmd, arg string) {
+	s := c.server
+	switch cmd {
+	case "":
+		return
+	case "STATS":
+		fmt.Fprintf(w, "uptime: %d\n", int(time.Since(c.started).Seconds()))
+		fmt.Fprintf(w, "metrics: %d\n", len(s.Store.Snapshot()))
+		for _, l := range s.listeners {
+			fmt.Fprintf(w, "listener %s: connections %d active %d total\n", l.name,
+				atomic.LoadInt64(&l.stats.active), atomic.LoadUint64(&l.stats.connections))
+		}
+		fmt.Fprintf(w, "shed: %d\n", s.Shed())
+		fmt.Fprintf(w, "panics: %d\n", s.Panics())
+	case "GET":
+		if arg == "" {
+			fmt.Fprintf(w, "ERROR GET takes a metric name\n")
+			return
+		}
+		var found []string
+		for _, m := range s.Store.Snapshot() {
+			if m.Name != arg {
+				continue
+			}
+			found = append(found, consoleLine(m))
+		}
+		if len(found) == 0 {
+			fmt.Fprintf(w, "ERROR unknown metric\n")
+			return
+		}
+		sort.Strings(found)
+		for _, line := range found {
+			io.WriteString(w, line)
+		}
+	case "FLUSH":
+		if c.Flush == nil {
+			fmt.Fprintf(w, "ERROR flushing is not available\n")
+			return
+		}
+		c.Flush()
+		fmt.Fprintf(w, "OK\n")
+		return
+	case "RESET":
+		n := s.Store.Remove("*")
+		slog.Info("console: discarded the windows' metrics", "metrics", n)
+		fmt.Fprintf(w, "DELETED %d\n", n)
+		return
+	case "MAXCONNS":
+		n, name, _ := strings.Cut(arg, " ")
+		conns, err := strconv.Atoi(n)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR MAXCONNS takes a number of connections\n")
+			return
+		}
+		changed, err := s.SetMaxConns(strings.TrimSpace(name), conns)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR %v\n", err)
+			return
+		}
+		fmt.Fprintf(w, "OK %d\n", len(changed))
+		return
+	case "CONNS":
+		conns := s.inflight.list()
+		sort.Slice(conns, func(i, j int) bool { return conns[i][0] < conns[j][0] })
+		for _, conn := range conns {
+			fmt.Fprintf(w, "%s -> %s\n", conn[0], conn[1])
+		}
+	default:
+		fmt.Fprintf(w, "ERROR unknown command %q\n", cmd)
+		return
+	}
+	fmt.Fprintf(w, "END\n")
+}
+
+// Streams the flushes to the connection until the client closes it, or its
+// subscription is closed for falling behind
+func (c *Console) subscribe(conn net.Conn, w *bufio.Writer, pattern string) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		fmt.Fprintf(w, "ERROR %v\n", err)
+		w.Flush()
+		return
+	}
+	b := c.server.Subscribers
+	if b == nil {
+		fmt.Fprintf(w, "ERROR no flushes are published\n")
+		w.Flush()
+		return
+	}
+	sub := b.subscribe("console "+conn.RemoteAddr().String(), DefaultSubscriberBuffer, dropOldest)
+	defer b.unsubscribe(sub)
+	// whatever the client sends now is ignored, its end ends the stream
+	go func() {
+		io.Copy(io.Discard, conn)
+		b.unsubscribe(sub)
+	}()
+	fmt.Fprintf(w, "OK\n")
+	if w.Flush() != nil {
+		return
+	}
+	for batch := range sub.C {
+		for _, m := range batch {
+			if subscribed(pattern, m) {
+				io.WriteString(w, consoleLine(m))
+			}
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// Returns the line of the metric in the answer to GET
+func consoleLine(m parser.Metric) string {
+	return fmt.Sprintf("%s %s count %d mean %s min %s max %s time %s\n", m.Key(), m.Type, m.Count,
+		formatFloat(m.Mean), formatFloat(m.Min), formatFloat(m.Max), m.Time.UTC().Format(time.RFC3339Nano))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
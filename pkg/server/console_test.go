@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestConsole(t *testing.T) {
+	agg := store.NewStore(store.Options{})
+	srv := New(agg)
+	at := time.Now().UTC().Truncate(time.Second)
+	for _, v := range []float64{1, 3} {
+		srv.Ingest(&parser.Metric{Name: "foo", Value: v, Time: at}, "test")
+	}
+	srv.Ingest(&parser.Metric{Name: "bar", Value: 5, Time: at}, "test")
+
+	console := NewConsole(srv)
+	flushed := 0
+	console.Flush = func() { flushed++ }
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go console.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	answers := bufio.NewScanner(conn)
+	// sends the command and returns the lines of its answer
+	do := func(cmd string) []string {
+		fmt.Fprintf(conn, "%s\n", cmd)
+		var lines []string
+		for answers.Scan() {
+			line := answers.Text()
+			if line == "END" {
+				return lines
+			}
+			lines = append(lines, line)
+			if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "DELETED") || strings.HasPrefix(line, "ERROR") {
+				return lines
+			}
+		}
+		t.Fatalf("%s: the connection ended", cmd)
+		return nil
+	}
+
+	if got := do("stats"); len(got) < 2 || got[1] != "metrics: 2" {
+		t.Errorf("STATS; got %q, want metrics: 2", got)
+	}
+	want := fmt.Sprintf("foo untyped count 2 mean 2 min 1 max 3 time %s", at.Format(time.RFC3339Nano))
+	if got := do("GET foo"); len(got) != 1 || got[0] != want {
+		t.Errorf("GET foo; got %q, want %q", got, want)
+	}
+	if got := do("GET baz"); len(got) != 1 || !strings.HasPrefix(got[0], "ERROR") {
+		t.Errorf("GET baz; got %q, want an error", got)
+	}
+	if got := do("FLUSH"); len(got) != 1 || got[0] != "OK" || flushed != 1 {
+		t.Errorf("FLUSH; got %q and %d flushes", got, flushed)
+	}
+	if got := do("RESET"); len(got) != 1 || got[0] != "DELETED 2" {
+		t.Errorf("RESET; got %q, want DELETED 2", got)
+	}
+	if n := len(agg.Snapshot()); n != 0 {
+		t.Errorf("%d metrics left after RESET", n)
+	}
+	if got := do("CONNS"); len(got) != 0 {
+		t.Errorf("CONNS; got %q, the console isn't a metrics connection", got)
+	}
+	if got := do("MAXCONNS 5"); len(got) != 1 || !strings.HasPrefix(got[0], "ERROR") {
+		t.Errorf("MAXCONNS 5 without listeners; got %q, want an error", got)
+	}
+	if err := srv.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 1, ReusePort: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if got := do("MAXCONNS 5"); len(got) != 1 || got[0] != "OK 1" || srv.limits().Listeners[0].MaxConns != 5 {
+		t.Errorf("MAXCONNS 5; got %q and a cap of %d, want OK 1 and 5", got, srv.limits().Listeners[0].MaxConns)
+	}
+	if got := do("MAXCONNS none"); len(got) != 1 || !strings.HasPrefix(got[0], "ERROR") {
+		t.Errorf("MAXCONNS none; got %q, want an error", got)
+	}
+	if got := do("NOPE"); len(got) != 1 || !strings.HasPrefix(got[0], "ERROR") {
+		t.Errorf("NOPE; got %q, want an error", got)
+	}
+	if got := do("SUBSCRIBE ["); len(got) != 1 || !strings.HasPrefix(got[0], "ERROR") {
+		t.Errorf("SUBSCRIBE [; got %q, want an error", got)
+	}
+	fmt.Fprintf(conn, "QUIT\n")
+	if answers.Scan() {
+		t.Errorf("QUIT; got %q, want the connection closed", answers.Text())
+	}
+}
+
+func TestConsoleSubscribe(t *testing.T) {
+	srv := New(store.NewStore(store.Options{}))
+	srv.Subscribers = NewBroadcaster()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewConsole(srv).Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers := bufio.NewScanner(conn)
+	fmt.Fprintf(conn, "SUBSCRIBE foo\n")
+	if !answers.Scan() || answers.Text() != "OK" {
+		t.Fatalf("SUBSCRIBE; got %q, want OK", answers.Text())
+	}
+	at := time.Unix(0, 0).UTC()
+	srv.Subscribers.Publish([]parser.Metric{{Name: "bar", Count: 1, Time: at}, {Name: "foo", Count: 1, Mean: 2, Min: 2, Max: 2, Time: at}})
+	want := "foo untyped count 1 mean 2 min 2 max 2 time 1970-01-01T00:00:00Z"
+	if !answers.Scan() || answers.Text() != want {
+		t.Errorf("streamed %q, want %q", answers.Text(), want)
+	}
+
+	// the client going away ends the subscription
+	conn.Close()
+	for i := 0; ; i++ {
+		if n, _, _ := srv.Subscribers.Lag(); n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("still subscribed after the client closed the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingListener fails its accepts with EMFILE, then as closed
+type failingListener struct {
+	net.Listener
+	failures int
+}
+
+func (f *failingListener) Accept() (net.Conn, error) {
+	if f.failures == 0 {
+		return nil, net.ErrClosed
+	}
+	f.failures--
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+}
+
+func TestConsoleAcceptFailure(t *testing.T) {
+	l := &failingListener{failures: 3}
+	if err := NewConsole(New(store.NewStore(store.Options{Shards: 2}))).Serve(l); err != nil || l.failures != 0 {
+		t.Errorf("Serve(); got %v with %d failures left, want the failures retried until closed", err, l.failures)
+	}
+}
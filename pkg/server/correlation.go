@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// Correlation IDs name a connection or datagram in everything logged or
+// written back about it, so one producer's complaint can be traced by ID
+// rather than by lining up timestamps. The prefix is random per process so
+// IDs from restarts and from several collectors don't collide.
+var (
+	correlationPrefix = func() string {
+		b := make([]byte, 4)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}()
+	correlationSeq uint64
+)
+
+// Returns a new correlation ID, unique within the process
+func newCorrelationID() string {
+	return correlationPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&correlationSeq, 1), 10)
+}
+
+// Handles the ID command. Without an argument the connection keeps the ID
+// it was given, with one the producer's own ID replaces it. Either way the
+// ID is written back and from then on ends every ACK and ERR BUSY answer.
+func correlationCommand(id string, args []string) (string, error) {
+	switch {
+	case len(args) > 1:
+		return "", fmt.Errorf("invalid command: ID takes at most one argument")
+	case len(args) == 1 && !validCorrelationID(args[0]):
+		return "", fmt.Errorf("invalid command: ID must be up to 64 letters, digits or ._:-")
+	case len(args) == 1:
+		return args[0], nil
+	}
+	return id, nil
+}
+
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+type correlationTestCase struct {
+	args []string
+	id   string
+	ok   bool
+}
+
+var correlationTestCases = []correlationTestCase{
+	{nil, "given", true},
+	{[]string{"batch-42"}, "batch-42", true},
+	{[]string{"host1:job.7_a"}, "host1:job.7_a", true},
+	{[]string{"a", "b"}, "", false},
+	{[]string{"bad/id"}, "", false},
+	{[]string{strings.Repeat("x", 65)}, "", false},
+}
+
+func TestCorrelationCommand(t *testing.T) {
+	for _, tc := range correlationTestCases {
+		id, err := correlationCommand("given", tc.args)
+		if (err == nil) != tc.ok || id != tc.id {
+			t.Errorf("correlationCommand(%v); got %q %v, want %q ok %v", tc.args, id, err, tc.id, tc.ok)
+		}
+	}
+
+	a, b := newCorrelationID(), newCorrelationID()
+	if a == b || !validCorrelationID(a) || !strings.HasPrefix(b, correlationPrefix+"-") {
+		t.Errorf("newCorrelationID(); got %q and %q, want distinct valid IDs", a, b)
+	}
+}
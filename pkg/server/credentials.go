@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxTenantTokens is how many tokens a tenant can have active at once, two
+// so a new one can be rolled out to every producer before the old one is
+// retired
+const MaxTenantTokens = 2
+
+// Credentials maps client tokens to the tenants they belong to. Only the
+// SHA-256 of each token is kept, tokens are shown once when added. A
+// disabled tenant's tokens keep working until its grace period ends so
+// producers can be moved off it without losing data.
+type Credentials struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantCredentials
+	byToken map[[sha256.Size]byte]string
+	// tokens loaded from the -auth-tokens file and the environment, to
+	// their tenants, replaced whole on every reload
+	static map[[sha256.Size]byte]string
+	now    func() time.Time
+}
+
+type tenantCredentials struct {
+	// oldest first
+	tokens [][sha256.Size]byte
+	// zero while the tenant is enabled
+	disabledUntil time.Time
+}
+
+// TenantStatus is what the admin API shows of a tenant
+type TenantStatus struct {
+	Tenant string `json:"tenant"`
+	// ids of the active tokens, oldest first, see TokenID
+	Tokens []string `json:"tokens"`
+	// set once the tenant is disabled, its tokens stop working then
+	DisabledUntil *time.Time `json:"disabled_until,omitempty"`
+}
+
+// Returns an empty set of credentials
+func NewCredentials() *Credentials {
+	return &Credentials{
+		tenants: make(map[string]*tenantCredentials),
+		byToken: make(map[[sha256.Size]byte]string),
+		now:     time.Now,
+	}
+}
+
+// TokenID identifies a token without revealing it, the first 12 hex
+// characters of its SHA-256
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Returns a new random token
+func GenerateToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Authenticate returns the tenant the token belongs to, false if it belongs
+// to none or the tenant's grace period is over
+func (c *Credentials) Authenticate(token string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum := sha256.Sum256([]byte(token))
+	name, ok := c.byToken[sum]
+	if !ok {
+		name, ok = c.static[sum]
+		return name, ok
+	}
+	t := c.tenants[name]
+	if !t.disabledUntil.IsZero() && !c.now().Before(t.disabledUntil) {
+		return "", false
+	}
+	return name, true
+}
+
+// Tells a client its AUTH token was missing or not valid
+func writeAuthError(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ERR AUTH\n"))
+	conn.SetWriteDeadline(time.Time{})
+}
+
+// SetStatic replaces the tokens loaded from files and the environment,
+// token to tenant, leaving those added through the admin API alone
+func (c *Credentials) SetStatic(tokens map[string]string) {
+	static := make(map[[sha256.Size]byte]string, len(tokens))
+	for token, tenant := range tokens {
+		static[sha256.Sum256([]byte(token))] = tenant
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.static = static
+}
+
+// Parses token entries, tenant:token, one per line or separated by commas.
+// Blank lines and lines starting with # are skipped.
+func ParseTokens(text string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			tenant, token, ok := strings.Cut(entry, ":")
+			if entry == "" {
+				continue
+			}
+			if !ok || tenant == "" || token == "" {
+				return nil, fmt.Errorf("%q: want tenant:token", entry)
+			}
+			if !validTenant(tenant) {
+				return nil, fmt.Errorf("%q: the tenant must be a valid tag value", entry)
+			}
+			tokens[token] = tenant
+		}
+	}
+	return tokens, nil
+}
+
+// AddToken gives the tenant another token, creating the tenant if need be.
+// A tenant already holding MaxTenantTokens loses its oldest one, which is
+// returned by id. Adding a token another tenant holds moves it.
+func (c *Credentials) AddToken(tenant, token string) (retired string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum := sha256.Sum256([]byte(token))
+	if owner, ok := c.byToken[sum]; ok {
+		c.removeToken(owner, sum)
+	}
+	t := c.tenants[tenant]
+	if t == nil {
+		t = &tenantCredentials{}
+		c.tenants[tenant] = t
+	}
+	if len(t.tokens) >= MaxTenantTokens {
+		oldest := t.tokens[0]
+		c.removeToken(tenant, oldest)
+		retired = hex.EncodeToString(oldest[:6])
+	}
+	t.tokens = append(t.tokens, sum)
+	c.byToken[sum] = tenant
+	return retired
+}
+
+// RetireToken removes the tenant's token with the id, false if it has none
+func (c *Credentials) RetireToken(tenant, id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.tenants[tenant]
+	if t == nil {
+		return false
+	}
+	for _, sum := range t.tokens {
+		if hex.EncodeToString(sum[:6]) == id {
+			c.removeToken(tenant, sum)
+			return true
+		}
+	}
+	return false
+}
+
+// The caller holds the lock
+func (c *Credentials) removeToken(tenant string, sum [sha256.Size]byte) {
+	delete(c.byToken, sum)
+	t := c.tenants[tenant]
+	for i, s := range t.tokens {
+		if s == sum {
+			t.tokens = append(t.tokens[:i], t.tokens[i+1:]...)
+			break
+		}
+	}
+}
+
+// Disable soft deletes the tenant, its tokens stop working once grace has
+// passed. Disabling an already disabled tenant moves the deadline. Returns
+// false for an unknown tenant.
+func (c *Credentials) Disable(tenant string, grace time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.tenants[tenant]
+	if t == nil {
+		return false
+	}
+	t.disabledUntil = c.now().Add(grace)
+	return true
+}
+
+// Enable undoes Disable, returns false for an unknown tenant
+func (c *Credentials) Enable(tenant string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.tenants[tenant]
+	if t == nil {
+		return false
+	}
+	t.disabledUntil = time.Time{}
+	return true
+}
+
+// Purge forgets the tenants whose grace period is over along with their
+// tokens, returning how many there were
+func (c *Credentials) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for name, t := range c.tenants {
+		if !t.disabledUntil.IsZero() && !c.now().Before(t.disabledUntil) {
+			for _, sum := range t.tokens {
+				delete(c.byToken, sum)
+			}
+			delete(c.tenants, name)
+			n++
+		}
+	}
+	return n
+}
+
+// Lists every tenant by name
+func (c *Credentials) list() []TenantStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statuses := make([]TenantStatus, 0, len(c.tenants))
+	for name, t := range c.tenants {
+		st := TenantStatus{Tenant: name, Tokens: []string{}}
+		for _, sum := range t.tokens {
+			st.Tokens = append(st.Tokens, hex.EncodeToString(sum[:6]))
+		}
+		if !t.disabledUntil.IsZero() {
+			until := t.disabledUntil
+			st.DisabledUntil = &until
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Tenant < statuses[j].Tenant })
+	return statuses
+}
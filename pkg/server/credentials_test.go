@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCredentials(t *testing.T) {
+	c := NewCredentials()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.AddToken("acme", "old")
+	if retired := c.AddToken("acme", "new"); retired != "" {
+		t.Errorf("AddToken(acme, new); got %s retired, want none with two tokens", retired)
+	}
+	for _, token := range []string{"old", "new"} {
+		if tenant, ok := c.Authenticate(token); !ok || tenant != "acme" {
+			t.Errorf("Authenticate(%s); got %s %v, want acme", token, tenant, ok)
+		}
+	}
+	// a third token retires the oldest
+	if retired := c.AddToken("acme", "newest"); retired != TokenID("old") {
+		t.Errorf("AddToken(acme, newest); got %s retired, want %s", retired, TokenID("old"))
+	}
+	if _, ok := c.Authenticate("old"); ok {
+		t.Errorf("Authenticate(old) after rotation; got ok, want rejected")
+	}
+	if !c.RetireToken("acme", TokenID("new")) {
+		t.Errorf("RetireToken(acme, new); got false, want true")
+	}
+	if _, ok := c.Authenticate("new"); ok {
+		t.Errorf("Authenticate(new) once retired; got ok, want rejected")
+	}
+
+	// the grace period keeps the tokens working for a while
+	c.Disable("acme", time.Minute)
+	if _, ok := c.Authenticate("newest"); !ok {
+		t.Errorf("Authenticate(newest) in the grace period; got rejected, want ok")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Authenticate("newest"); ok {
+		t.Errorf("Authenticate(newest) after the grace period; got ok, want rejected")
+	}
+	c.Enable("acme")
+	if _, ok := c.Authenticate("newest"); !ok {
+		t.Errorf("Authenticate(newest) re-enabled; got rejected, want ok")
+	}
+	c.Disable("acme", 0)
+	if n := c.Purge(); n != 1 || len(c.list()) != 0 {
+		t.Errorf("Purge(); got %d purged %d left, want the tenant gone", n, len(c.list()))
+	}
+}
+
+func TestStaticTokens(t *testing.T) {
+	tokens, err := ParseTokens("# ops\nacme:s3cret\n\nglobex:abc, initech:def\n")
+	if err != nil {
+		t.Fatalf("ParseTokens(); got error %v", err)
+	}
+	want := map[string]string{"s3cret": "acme", "abc": "globex", "def": "initech"}
+	if len(tokens) != len(want) {
+		t.Fatalf("ParseTokens(); got %v, want %v", tokens, want)
+	}
+	for token, tenant := range want {
+		if tokens[token] != tenant {
+			t.Errorf("ParseTokens(); got %s for %s, want %s", tokens[token], token, tenant)
+		}
+	}
+	for _, text := range []string{"acme", "acme:", ":s3cret"} {
+		if _, err := ParseTokens(text); err == nil {
+			t.Errorf("ParseTokens(%q); got nil error", text)
+		}
+	}
+
+	c := NewCredentials()
+	c.SetStatic(tokens)
+	if tenant, ok := c.Authenticate("abc"); !ok || tenant != "globex" {
+		t.Errorf("Authenticate(abc); got %s %v, want globex", tenant, ok)
+	}
+	// a reload replaces the tokens loaded before
+	c.SetStatic(map[string]string{"xyz": "globex"})
+	if _, ok := c.Authenticate("abc"); ok {
+		t.Errorf("Authenticate(abc) after reload; got ok, want rejected")
+	}
+	if tenant, ok := c.Authenticate("xyz"); !ok || tenant != "globex" {
+		t.Errorf("Authenticate(xyz) after reload; got %s %v, want globex", tenant, ok)
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// the records queued for the dead-letter output, more are lost while it
+// can't keep up
+const deadLetterQueue = 4096
+
+// DeadLetters records the lines rejected for not parsing, an invalid value
+// or name, or a stale timestamp, so their producers can be found and fixed.
+// Each is written as a JSON line with the raw line, why it was rejected,
+// where it came from and when, to a file or a socket. Lines turned away
+// because the collector is busy or a tenant over quota aren't the
+// producer's fault, they aren't recorded.
+type DeadLetters struct {
+	target string
+	keys   *Keyring
+	open   func() (io.WriteCloser, error)
+	queue  chan []byte
+	// held to queue, closed once Close stops the queue
+	closing sync.RWMutex
+	closed  bool
+
+	// the records since the last report by reason, and those lost
+	mu      sync.Mutex
+	reasons map[string]uint64
+	lost    atomic.Uint64
+
+	done chan struct{}
+}
+
+// deadLetter is a line as recorded
+type deadLetter struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error"`
+	Listener string    `json:"listener,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Line     string    `json:"line"`
+}
+
+// Returns the dead letters written to the target: a file appended to, or a
+// socket given as tcp://host:port, udp://host:port or unix:///path, a
+// record a datagram over UDP. The file is only created once a line is
+// rejected. When keys is set every record is encrypted, see Keyring.Seal.
+func NewDeadLetters(target string, keys *Keyring) (*DeadLetters, error) {
+	d := &DeadLetters{target: target, keys: keys, queue: make(chan []byte, deadLetterQueue),
+		reasons: make(map[string]uint64), done: make(chan struct{})}
+	network, addr, ok := strings.Cut(target, "://")
+	switch {
+	case !ok:
+		d.open = func() (io.WriteCloser, error) {
+			return os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		}
+	case network == "tcp" || network == "udp" || network == "unix":
+		if addr == "" {
+			return nil, fmt.Errorf("dead letters to %s want an address", target)
+		}
+		d.open = func() (io.WriteCloser, error) {
+			return net.DialTimeout(network, addr, 5*time.Second)
+		}
+	default:
+		return nil, fmt.Errorf("dead letters to %s, want a file or a tcp://, udp:// or unix:// address", target)
+	}
+	go d.run()
+	return d, nil
+}
+
+// Returns the reason a line rejected with err is recorded for, empty when
+// it isn't. A line that didn't parse is malformed.
+func deadLetterReason(err error, parsed bool) string {
+	switch {
+	case err == nil, errors.Is(err, ErrBusy), errors.Is(err, ErrOverQuota):
+		return ""
+	case errors.Is(err, parser.ErrTooLong):
+		return "too_long"
+	case errors.Is(err, ErrTooOld):
+		return "too_old"
+	case errors.Is(err, ErrTooNew):
+		return "too_new"
+	case errors.Is(err, ErrNotFinite):
+		return "not_finite"
+	case errors.Is(err, ErrNegative):
+		return "negative"
+	case errors.Is(err, ErrReservedName):
+		return "reserved"
+	case !parsed:
+		return "malformed"
+	}
+	return "invalid"
+}
+
+// Queues the line rejected with err for the output, parsed when it was a
+// metric of it the server turned away. A nil DeadLetters records nothing.
+func (d *DeadLetters) record(line string, err error, parsed bool, listener, remote string) {
+	if d == nil {
+		return
+	}
+	reason := deadLetterReason(err, parsed)
+	if reason == "" {
+		return
+	}
+	b, jerr := json.Marshal(deadLetter{Time: time.Now().UTC(), Reason: reason, Error: err.Error(),
+		Listener: listener, Remote: remote, Line: line})
+	if jerr != nil {
+		return
+	}
+	b = append(b, '\n')
+	if d.keys != nil {
+		b = d.keys.Seal(b)
+	}
+	d.closing.RLock()
+	defer d.closing.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.queue <- b:
+		d.mu.Lock()
+		d.reasons[reason]++
+		d.mu.Unlock()
+	default:
+		d.lost.Add(1)
+	}
+}
+
+// Writes the records queued until closed, opening the output again after
+// it fails. A record that can't be written is lost.
+func (d *DeadLetters) run() {
+	defer close(d.done)
+	var w io.WriteCloser
+	var failed time.Time
+	for b := range d.queue {
+		if w == nil {
+			// don't try to open the output for every record while it is down
+			if time.Since(failed) < time.Second {
+				d.lost.Add(1)
+				continue
+			}
+			var err error
+			if w, err = d.open(); err != nil {
+				slog.Warn("Dead letters: the output can't be opened", "target", d.target, "err", err)
+				failed = time.Now()
+				d.lost.Add(1)
+				continue
+			}
+		}
+		if _, err := w.Write(b); err != nil {
+			slog.Warn("Dead letters: the output failed", "target", d.target, "err", err)
+			w.Close()
+			w, failed = nil, time.Now()
+			d.lost.Add(1)
+		}
+	}
+	if w != nil {
+		w.Close()
+	}
+}
+
+// Report writes the lines recorded since the last report by reason
+func (d *DeadLetters) Report(w io.Writer) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	reasons := d.reasons
+	d.reasons = make(map[string]uint64)
+	d.mu.Unlock()
+	lost := d.lost.Swap(0)
+	if len(reasons) == 0 && lost == 0 {
+		return
+	}
+	var total uint64
+	parts := make([]string, 0, len(reasons))
+	for reason, n := range reasons {
+		total += n
+		parts = append(parts, fmt.Sprintf("%s %d", reason, n))
+	}
+	sort.Strings(parts)
+	fmt.Fprintf(w, "(10 sec): Dead letters recorded %d (%s), lost %d\n", total, strings.Join(parts, ", "), lost)
+}
+
+// Close writes what is queued and closes the output, the lines rejected
+// after aren't recorded
+func (d *DeadLetters) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.closing.Lock()
+	if d.closed {
+		d.closing.Unlock()
+		return nil
+	}
+	d.closed = true
+	close(d.queue)
+	d.closing.Unlock()
+	<-d.done
+	return nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterReason(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		parsed bool
+		want   string
+	}{
+		{fmt.Errorf("no colon"), false, "malformed"},
+		{ErrTooOld, true, "too_old"},
+		{ErrTooNew, true, "too_new"},
+		{ErrNotFinite, true, "not_finite"},
+		{ErrReservedName, true, "reserved"},
+		{ErrRateExceeded, false, ""},
+		{ErrTooManySeries, true, ""},
+	} {
+		if got := deadLetterReason(tc.err, tc.parsed); got != tc.want {
+			t.Errorf("deadLetterReason(%v); got %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.ndjson")
+	d, err := NewDeadLetters(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(&fullStore{})
+	s.DeadLetters = d
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 1, ReusePort: 1}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.listeners[0].acceptors[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "REPLY\ngarbage\ncpu\t1\t%d\nmem\t1\t%d\n", time.Now().Unix(), time.Now().Add(-time.Hour).Unix())
+	// the answers say every line was handled
+	answers := bufio.NewScanner(conn)
+	for i := 0; i < 3 && answers.Scan(); i++ {
+	}
+	conn.Close()
+
+	var report bytes.Buffer
+	s.DeadLetters.Report(&report)
+	d.Close()
+	b, _ := os.ReadFile(path)
+	var reasons []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var rec deadLetter
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("dead letter %q: %v", line, err)
+		}
+		if rec.Listener == "" || !strings.HasPrefix(rec.Remote, "127.0.0.1:") || rec.Time.IsZero() || rec.Error == "" {
+			t.Errorf("dead letter %+v; want its listener, source, time and error", rec)
+		}
+		reasons = append(reasons, rec.Reason+" "+rec.Line)
+	}
+	if got := strings.Join(reasons, "; "); !strings.HasPrefix(got, "malformed garbage; too_old mem\t1\t") || len(reasons) != 2 {
+		t.Errorf("dead letters; got %q, want the malformed and the stale line", got)
+	}
+	if want := "Dead letters recorded 2 (malformed 1, too_old 1), lost 0"; !strings.Contains(report.String(), want) {
+		t.Errorf("Report(); got %q, want %q", report.String(), want)
+	}
+
+	if _, err := NewDeadLetters("http://example.com", nil); err == nil {
+		t.Error("NewDeadLetters(http://); want an error")
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Dedup suppresses lines a client sent again after a retry, so their values
+// are counted once. A metric is a duplicate when one with the same key,
+// timestamp and value was seen within the TTL. Only the most recent Size
+// metrics are remembered, the oldest are forgotten first.
+//
+// Formats without a client timestamp, like statsd, are stamped on arrival so
+// their lines never match.
+type Dedup struct {
+	mu   sync.Mutex
+	size int
+	ttl  time.Duration
+	// the remembered metrics oldest first, and by identity
+	order *list.List
+	seen  map[string]*list.Element
+	now   func() time.Time
+	// duplicates suppressed since the last report
+	dropped uint64
+}
+
+type dedupEntry struct {
+	id   string
+	when time.Time
+}
+
+// Returns a Dedup remembering up to size metrics for ttl
+func NewDedup(size int, ttl time.Duration) *Dedup {
+	return &Dedup{size: size, ttl: ttl, order: list.New(), seen: make(map[string]*list.Element), now: time.Now}
+}
+
+// Returns what makes the metric the same line again: its key, its
+// timestamp and a hash of its value
+func dedupID(m *parser.Metric) string {
+	var b strings.Builder
+	b.WriteString(m.Key())
+	b.WriteByte(0)
+	b.WriteString(strconv.FormatInt(m.Time.UnixNano(), 36))
+	b.WriteByte(0)
+	if m.Integer {
+		b.WriteString(strconv.FormatInt(m.IntValue, 36))
+	} else {
+		b.WriteString(strconv.FormatUint(math.Float64bits(m.Value), 36))
+	}
+	// a set's value is its member
+	for member := range m.Members {
+		b.WriteByte(0)
+		b.WriteString(member)
+	}
+	return b.String()
+}
+
+// Reports whether the metric is a duplicate, remembering it if not. A nil
+// Dedup sees no duplicates.
+func (d *Dedup) duplicate(m *parser.Metric) bool {
+	if d == nil {
+		return false
+	}
+	id := dedupID(m)
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// forget what has expired
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(*dedupEntry).when) >= d.ttl; e = d.order.Front() {
+		d.evict(e)
+	}
+	if _, ok := d.seen[id]; ok {
+		atomic.AddUint64(&d.dropped, 1)
+		return true
+	}
+	// and make room
+	if d.order.Len() >= d.size {
+		d.evict(d.order.Front())
+	}
+	d.seen[id] = d.order.PushBack(&dedupEntry{id: id, when: now})
+	return false
+}
+
+// Forgets the entry, d.mu must be held
+func (d *Dedup) evict(e *list.Element) {
+	d.order.Remove(e)
+	delete(d.seen, e.Value.(*dedupEntry).id)
+}
+
+// Forgets the metric, its delivery failed so the retry must get through
+func (d *Dedup) forget(m *parser.Metric) {
+	if d == nil {
+		return
+	}
+	id := dedupID(m)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.seen[id]; ok {
+		d.evict(e)
+	}
+}
+
+// Returns how many duplicates were suppressed since the last call
+func (d *Dedup) Dropped() uint64 {
+	if d == nil {
+		return 0
+	}
+	return atomic.SwapUint64(&d.dropped, 0)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestDedup(t *testing.T) {
+	now := time.Now()
+	d := NewDedup(3, time.Minute)
+	d.now = func() time.Time { return now }
+	at := now.Truncate(time.Second)
+
+	cpu := parser.Metric{Name: "cpu", Value: 1.5, Time: at}
+	if d.duplicate(&cpu) {
+		t.Errorf("duplicate(cpu); got true the first time")
+	}
+	if again := cpu; !d.duplicate(&again) {
+		t.Errorf("duplicate(cpu) retried; got false")
+	}
+	for _, m := range []parser.Metric{
+		{Name: "cpu", Value: 2, Time: at},
+		{Name: "cpu", Value: 1.5, Time: at.Add(time.Second)},
+		{Name: "cpu", Value: 1.5, Time: at, Tags: "host=a"},
+	} {
+		if d.duplicate(&m) {
+			t.Errorf("duplicate(%v); got true for a different metric", m)
+		}
+	}
+	// the first cpu no longer fits
+	if !d.duplicate(&parser.Metric{Name: "cpu", Value: 2, Time: at}) {
+		t.Errorf("duplicate(cpu 2) retried; got false")
+	}
+	if d.duplicate(&cpu) {
+		t.Errorf("duplicate(cpu) past the size; got true")
+	}
+	if n := d.Dropped(); n != 2 {
+		t.Errorf("Dropped(); got %d, want 2", n)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if d.duplicate(&cpu) {
+		t.Errorf("duplicate(cpu) past the TTL; got true")
+	}
+	d.forget(&cpu)
+	if d.duplicate(&cpu) {
+		t.Errorf("duplicate(cpu) after forget; got true")
+	}
+
+	users := parser.Metric{Name: "users", Value: 1, Time: at, Members: map[string]struct{}{"a": {}}}
+	other := parser.Metric{Name: "users", Value: 1, Time: at, Members: map[string]struct{}{"b": {}}}
+	if d.duplicate(&users) || d.duplicate(&other) {
+		t.Errorf("duplicate(users); got true for a different member")
+	}
+
+	var off *Dedup
+	if off.duplicate(&cpu) || off.Dropped() != 0 {
+		t.Errorf("nil Dedup; got a duplicate")
+	}
+}
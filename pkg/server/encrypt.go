@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Keyring holds the AES-256-GCM keys used to encrypt data at rest. The first
+// key in the file is active and used for every new record, the rest are kept
+// so records written before a rotation can still be read.
+//
+// The key file has one key per line as "<id> <base64 32 byte key>", blank
+// lines and lines starting with '#' are ignored. To rotate, add the new key
+// at the top and restart.
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// Reads the keyring from the key file
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption keys: %v", err)
+	}
+	defer f.Close()
+
+	kr := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return nil, fmt.Errorf("%s:%d: expected \"<id> <base64 key>\"", path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key must be 32 bytes of base64", path, n)
+		}
+		if err := kr.add(fields[0], key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if kr.active == "" {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return kr, nil
+}
+
+// Adds a key, the first key added becomes the active one
+func (kr *Keyring) add(id string, key []byte) error {
+	if _, ok := kr.aeads[id]; ok {
+		return fmt.Errorf("duplicate key id %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	kr.aeads[id] = aead
+	if kr.active == "" {
+		kr.active = id
+	}
+	return nil
+}
+
+// Seal encrypts the plaintext into a self describing record:
+//
+//	[1 byte key id length][key id][nonce][4 byte big endian length][ciphertext]
+//
+// The key id is authenticated along with the ciphertext.
+func (kr *Keyring) Seal(plaintext []byte) []byte {
+	aead := kr.aeads[kr.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	record := make([]byte, 0, 1+len(kr.active)+len(nonce)+4+len(plaintext)+aead.Overhead())
+	record = append(record, byte(len(kr.active)))
+	record = append(record, kr.active...)
+	record = append(record, nonce...)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(plaintext)+aead.Overhead()))
+	return aead.Seal(record, nonce, plaintext, []byte(kr.active))
+}
+
+// Open reads the next record written by Seal and returns its plaintext, io.EOF
+// is returned once there are no more records
+func (kr *Keyring) Open(r *bufio.Reader) ([]byte, error) {
+	idLen, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, unexpected(err)
+	}
+	aead, ok := kr.aeads[string(id)]
+	if !ok {
+		return nil, fmt.Errorf("record encrypted with unknown key %q", id)
+	}
+
+	header := make([]byte, aead.NonceSize()+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, unexpected(err)
+	}
+	nonce := header[:aead.NonceSize()]
+	ciphertext := make([]byte, binary.BigEndian.Uint32(header[aead.NonceSize():]))
+	if _, err := io.ReadFull(r, ciphertext); err != nil {
+		return nil, unexpected(err)
+	}
+	return aead.Open(nil, nonce, ciphertext, id)
+}
+
+// A record cut short is corruption, not a clean end of file
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Decrypts every record in the file to w, used by the -decrypt mode so
+// operators can inspect encrypted captures
+func DecryptFile(kr *Keyring, path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		plaintext, err := kr.Open(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	old := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	old.add("2016-01", bytes.Repeat([]byte{1}, 32))
+
+	var file bytes.Buffer
+	file.Write(old.Seal([]byte("before rotation\n")))
+
+	// the new key goes first, the old one is kept for reading
+	rotated := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	rotated.add("2016-02", bytes.Repeat([]byte{2}, 32))
+	rotated.add("2016-01", bytes.Repeat([]byte{1}, 32))
+	file.Write(rotated.Seal([]byte("after rotation\n")))
+
+	r := bufio.NewReader(bytes.NewReader(file.Bytes()))
+	for _, want := range []string{"before rotation\n", "after rotation\n"} {
+		got, err := rotated.Open(r)
+		if err != nil || string(got) != want {
+			t.Errorf("open(); got %q %v, want %q", got, err, want)
+		}
+	}
+	if _, err := rotated.Open(r); err != io.EOF {
+		t.Errorf("open() at end; got %v, want EOF", err)
+	}
+
+	// the old keyring has never seen the new key
+	r = bufio.NewReader(bytes.NewReader(file.Bytes()))
+	old.Open(r)
+	if _, err := old.Open(r); err == nil {
+		t.Errorf("open() with unknown key; got nil error")
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// The reasons the server turns a metric away, branch on them with errors.Is
+var (
+	// the store can't keep up and the saturation policy dropped the metric
+	ErrBusy = errors.New("server busy")
+	// the connection was admitted over the cap and the metric was not
+	// among those sampled
+	ErrTooManyConnections = fmt.Errorf("%w: too many connections", ErrBusy)
+	// the host already holds as many connections as it may
+	ErrTooManyFromHost = fmt.Errorf("%w: too many connections from the host", ErrBusy)
+	// the connection gave no valid AUTH token
+	ErrUnauthenticated = errors.New("not authenticated")
+	// the host is in a denied network, or in none of the allowed ones
+	ErrDenied = errors.New("host not allowed")
+	// the line is over the connection's or the global rate limit
+	ErrRateExceeded = fmt.Errorf("%w: over the rate limit", ErrBusy)
+	// the tenant is over one of its quotas
+	ErrOverQuota = errors.New("tenant over quota")
+	// the tenant sent faster than its rate, the metric may be resent later
+	ErrRateLimited = fmt.Errorf("%w: %w: over the rate limit", ErrBusy, ErrOverQuota)
+	// the tenant already has as many series as it may
+	ErrTooManySeries = fmt.Errorf("%w: too many series", ErrOverQuota)
+	// the value is NaN or infinite, or negative, and the value policy
+	// rejects it
+	ErrNotFinite = fmt.Errorf("%w not finite", parser.ErrInvalidValue)
+	ErrNegative  = fmt.Errorf("%w negative", parser.ErrInvalidValue)
+	// the metric's timestamp is outside the window the server accepts
+	ErrStaleTimestamp = errors.New("timestamp outside the accepted window")
+	// the timestamp is older than the max age, or further ahead than the
+	// max future skew
+	ErrTooOld = fmt.Errorf("%w: older than the max age", ErrStaleTimestamp)
+	ErrTooNew = fmt.Errorf("%w: ahead by more than the max future skew", ErrStaleTimestamp)
+	// the name is under the prefix reserved for the collector's own metrics
+	ErrReservedName = errors.New("name reserved for the collector's own metrics")
+	// the scrub rules rewrote the name into one no line format could
+	// carry, like one with spaces
+	ErrRewrittenName = fmt.Errorf("%w after the scrub rules", parser.ErrInvalidName)
+)
@@ -0,0 +1,58 @@
+//go:build !minimal
+
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// the server whose counters the expvars show
+	expvarServer  atomic.Pointer[Server]
+	publishExpvar sync.Once
+)
+
+// PublishExpvars publishes the server's counters as expvars: rawCount, the
+// lines accepted since startup, currentConnections, rejections, the lines
+// rejected since startup by reason, and storeSize, the series the window
+// in progress holds. They show the last server published.
+func (s *Server) PublishExpvars() {
+	expvarServer.Store(s)
+	publishExpvar.Do(func() {
+		expvar.Publish("rawCount", expvar.Func(func() any {
+			return expvarServer.Load().lineTotals().Accepted
+		}))
+		expvar.Publish("currentConnections", expvar.Func(func() any {
+			var n int64
+			for _, l := range expvarServer.Load().listeners {
+				n += atomic.LoadInt64(&l.stats.active)
+			}
+			return n
+		}))
+		expvar.Publish("rejections", expvar.Func(func() any {
+			return expvarServer.Load().lineTotals().Rejected
+		}))
+		expvar.Publish("storeSize", expvar.Func(func() any {
+			return len(expvarServer.Load().Store.Snapshot())
+		}))
+	})
+}
+
+// Builds the debug routes, the expvars at /debug/vars and, when profiling,
+// the net/http/pprof profiles at /debug/pprof/
+func NewDebugHandler(profiling bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	if profiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
@@ -0,0 +1,48 @@
+//go:build !minimal
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestExpvars(t *testing.T) {
+	s := New(store.NewStore(store.Options{Shards: 4}))
+	s.PublishExpvars()
+	now := time.Now()
+	s.Ingest(&parser.Metric{Name: "cpu", Value: 1, Time: now}, "test")
+	s.Ingest(&parser.Metric{Name: "mem", Value: 1, Time: now}, "test")
+	s.Ingest(&parser.Metric{Name: "cpu", Value: 1, Time: now.Add(time.Hour)}, "test")
+
+	rec := httptest.NewRecorder()
+	NewDebugHandler(false).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	var got struct {
+		RawCount           uint64            `json:"rawCount"`
+		CurrentConnections int64             `json:"currentConnections"`
+		Rejections         map[string]uint64 `json:"rejections"`
+		StoreSize          int               `json:"storeSize"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RawCount != 2 || got.Rejections["too_new"] != 1 || got.StoreSize != 2 || got.CurrentConnections != 0 {
+		t.Errorf("expvars %+v; want 2 accepted, 1 too new, 2 series", got)
+	}
+}
+
+func TestDebugProfiling(t *testing.T) {
+	for _, profiling := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		NewDebugHandler(profiling).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+		if got := rec.Code == http.StatusOK; got != profiling {
+			t.Errorf("profiling %v; got %d for the goroutine profile", profiling, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// NameFilter drops metrics by name at ingest, before they take up room in
+// the store or show in the reports. Its rules are replaced whole by Load,
+// safely while metrics are being ingested.
+type NameFilter struct {
+	rules atomic.Pointer[filterRules]
+}
+
+type filterRules struct {
+	rules []*filterRule
+	// there are allow rules, a name none matches is dropped
+	allowlist bool
+	// names dropped for matching no allow rule
+	unmatched uint64
+}
+
+// filterRule allows or denies the names matching a glob or a regexp
+type filterRule struct {
+	// the rule as written, naming it in the report
+	text  string
+	allow bool
+	glob  string
+	re    *regexp.Regexp
+	// names the rule dropped since the last report
+	dropped uint64
+}
+
+// Returns a filter without rules, dropping nothing
+func NewNameFilter() *NameFilter {
+	return &NameFilter{}
+}
+
+// Load replaces the rules with those of the file, returning how many it
+// holds. A file that doesn't parse leaves the rules in place. One rule per
+// line:
+//
+//	allow <pattern>
+//	deny <pattern>
+//
+// A pattern is a glob as path.Match takes it, like tmp.*, or a regexp
+// between slashes, like /^test-[0-9]+$/. The first rule matching the name,
+// as the scrub rules left it, decides. A name no rule matches is kept,
+// unless there are allow rules: then only the names they allow are. Blank
+// lines and '#' comments are ignored.
+func (f *NameFilter) Load(file string) (int, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	rules, err := parseFilterRules(fh)
+	if err != nil {
+		return 0, fmt.Errorf("%s:%v", file, err)
+	}
+	f.rules.Store(rules)
+	return len(rules.rules), nil
+}
+
+func parseFilterRules(r io.Reader) (*filterRules, error) {
+	rules := &filterRules{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("%d: expected \"allow <pattern>\" or \"deny <pattern>\"", n)
+		}
+		rule := &filterRule{text: line, allow: fields[0] == "allow"}
+		pattern := fields[1]
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%d: %v", n, err)
+			}
+			rule.re = re
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%d: %v", n, err)
+		} else {
+			rule.glob = pattern
+		}
+		rules.allowlist = rules.allowlist || rule.allow
+		rules.rules = append(rules.rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func (rule *filterRule) matches(name string) bool {
+	if rule.re != nil {
+		return rule.re.MatchString(name)
+	}
+	ok, _ := path.Match(rule.glob, name)
+	return ok
+}
+
+// Reports whether the name is kept, counting it against the rule that
+// dropped it. A nil filter keeps everything.
+func (f *NameFilter) allowed(name string) bool {
+	if f == nil {
+		return true
+	}
+	rules := f.rules.Load()
+	if rules == nil {
+		return true
+	}
+	for _, rule := range rules.rules {
+		if rule.matches(name) {
+			if !rule.allow {
+				atomic.AddUint64(&rule.dropped, 1)
+			}
+			return rule.allow
+		}
+	}
+	if rules.allowlist {
+		atomic.AddUint64(&rules.unmatched, 1)
+		return false
+	}
+	return true
+}
+
+// Writes the names dropped since the last report, by rule
+func (f *NameFilter) Report(w io.Writer) {
+	if f == nil {
+		return
+	}
+	rules := f.rules.Load()
+	if rules == nil {
+		return
+	}
+	var total uint64
+	var by []string
+	for _, rule := range rules.rules {
+		if n := atomic.SwapUint64(&rule.dropped, 0); n > 0 {
+			total += n
+			by = append(by, fmt.Sprintf("%q %d", rule.text, n))
+		}
+	}
+	if n := atomic.SwapUint64(&rules.unmatched, 0); n > 0 {
+		total += n
+		by = append(by, fmt.Sprintf("allowed by no rule %d", n))
+	}
+	if total > 0 {
+		fmt.Fprintf(w, "(10 sec): Filtered by name %d, %s\n", total, strings.Join(by, ", "))
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestNameFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.rules")
+	os.WriteFile(path, []byte(`# junk from the load tests
+deny tmp.*
+deny /^test-[0-9]+$/
+`), 0600)
+
+	f := NewNameFilter()
+	if n, err := f.Load(path); err != nil || n != 2 {
+		t.Fatalf("Load(); got %d, %v, want 2 rules", n, err)
+	}
+	tests := map[string]bool{
+		"tmp.cpu":    false,
+		"test-12":    false,
+		"test-12a":   true,
+		"api-errors": true,
+	}
+	for name, want := range tests {
+		if got := f.allowed(name); got != want {
+			t.Errorf("allowed(%s); got %v, want %v", name, got, want)
+		}
+	}
+	var report bytes.Buffer
+	f.Report(&report)
+	if got := report.String(); got != "(10 sec): Filtered by name 2, \"deny tmp.*\" 1, \"deny /^test-[0-9]+$/\" 1\n" {
+		t.Errorf("Report(); got %q", got)
+	}
+	report.Reset()
+	if f.Report(&report); report.Len() != 0 {
+		t.Errorf("Report() again; got %q, want nothing", report.String())
+	}
+
+	// with allow rules only the names they match are kept
+	os.WriteFile(path, []byte("deny api-debug*\nallow api-*\n"), 0600)
+	if _, err := f.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"api-errors": true, "api-debug-x": false, "cpu": false} {
+		if got := f.allowed(name); got != want {
+			t.Errorf("allowed(%s) with allow rules; got %v, want %v", name, got, want)
+		}
+	}
+	f.Report(&report)
+	if !strings.Contains(report.String(), "allowed by no rule 1") {
+		t.Errorf("Report() with allow rules; got %q", report.String())
+	}
+
+	// a bad file keeps the rules loaded before
+	for _, bad := range []string{"drop cpu\n", "deny /[/\n", "deny [\n"} {
+		os.WriteFile(path, []byte(bad), 0600)
+		if _, err := f.Load(path); err == nil {
+			t.Errorf("Load(%q); got nil error", bad)
+		}
+	}
+	if !f.allowed("api-errors") {
+		t.Error("allowed(api-errors) after a failed Load(); got false")
+	}
+
+	var nilFilter *NameFilter
+	if !nilFilter.allowed("tmp.cpu") {
+		t.Error("allowed() of a nil filter; got false")
+	}
+}
+
+func TestIngestFiltered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.rules")
+	os.WriteFile(path, []byte("deny tmp-*\n"), 0600)
+	st := &fullStore{}
+	s := New(st)
+	s.Filter = NewNameFilter()
+	if _, err := s.Filter.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"tmp-cpu", "cpu"} {
+		m := parser.Metric{Name: name, Value: 1, Count: 1, Time: time.Now()}
+		if err := s.Ingest(&m, "test"); err != nil {
+			t.Errorf("Ingest(%s); got error %v", name, err)
+		}
+	}
+	if st.updates != 1 {
+		t.Errorf("store updates; got %d, want the one name not filtered", st.updates)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// ValueFormat is how float values are written in the flush report and the
+// text sinks. JSON outputs don't use it, encoding/json always writes the
+// shortest representation that round trips exactly. strconv never looks at
+// the locale, the decimal point is always '.'.
+type ValueFormat struct {
+	verb byte
+	// digits after the decimal point for fixed and scientific, significant
+	// digits for auto, -1 for the fewest digits that round trip exactly
+	precision int
+}
+
+// Parses the -float-format and -float-precision flags
+func ParseValueFormat(name string, precision int) (ValueFormat, error) {
+	if precision < -1 {
+		return ValueFormat{}, fmt.Errorf("precision must be -1 or more, got %d", precision)
+	}
+	switch name {
+	case "auto":
+		return ValueFormat{verb: 'g', precision: precision}, nil
+	case "fixed":
+		return ValueFormat{verb: 'f', precision: precision}, nil
+	case "scientific":
+		return ValueFormat{verb: 'e', precision: precision}, nil
+	}
+	return ValueFormat{}, fmt.Errorf("unknown float format %q, want auto, fixed or scientific", name)
+}
+
+// Formats the value a metric's type leads with: the total of a counter, the
+// last level of a gauge, the number of distinct members of a set and the
+// mean of anything else
+func (f ValueFormat) Value(m parser.Metric) string {
+	switch m.Type {
+	case parser.Counter:
+		return f.Sum(m)
+	case parser.Gauge:
+		return f.Format(m.Last)
+	case parser.Set:
+		return strconv.Itoa(m.Cardinality())
+	}
+	return f.Mean(m)
+}
+
+// Formats a metric's mean. Integer means that divide evenly are written
+// exactly, beyond 2^53 a float64 can't hold them.
+func (f ValueFormat) Mean(m parser.Metric) string {
+	if m.Integer && m.Count > 0 && m.IntValue%int64(m.Count) == 0 {
+		return strconv.FormatInt(m.IntValue/int64(m.Count), 10)
+	}
+	return f.Format(m.Mean)
+}
+
+// Formats a metric's sum, exactly for integer metrics
+func (f ValueFormat) Sum(m parser.Metric) string {
+	if m.Integer {
+		return strconv.FormatInt(m.IntValue, 10)
+	}
+	return f.Format(m.Value)
+}
+
+func (f ValueFormat) Format(v float64) string {
+	return strconv.FormatFloat(v, f.verb, f.precision, 64)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+type valueFormatTestCase struct {
+	format    string
+	precision int
+	value     float64
+	want      string
+}
+
+var valueFormatTestCases = []valueFormatTestCase{
+	{"auto", -1, 3.5, "3.5"},
+	{"auto", -1, 1e21, "1e+21"},
+	{"auto", 3, 3.14159, "3.14"},
+	{"fixed", -1, 1e21, "1000000000000000000000"},
+	{"fixed", -1, 9007199254740993, "9007199254740992"},
+	{"fixed", 2, 1.0 / 3, "0.33"},
+	{"auto", -1, 10.0 / 3, "3.3333333333333335"},
+	{"fixed", 3, 10.0 / 3, "3.333"},
+	{"fixed", 2, 1e-7, "0.00"},
+	{"fixed", 0, 2.5, "2"},
+	{"scientific", 3, 123456, "1.235e+05"},
+}
+
+func TestValueFormat(t *testing.T) {
+	for _, tc := range valueFormatTestCases {
+		f, err := ParseValueFormat(tc.format, tc.precision)
+		if err != nil {
+			t.Fatalf("parseValueFormat(%s, %d); got error %v", tc.format, tc.precision, err)
+		}
+		if got := f.Format(tc.value); got != tc.want {
+			t.Errorf("format(%v) as %s/%d; got %s, want %s", tc.value, tc.format, tc.precision, got, tc.want)
+		}
+	}
+	if _, err := ParseValueFormat("hex", -1); err == nil {
+		t.Errorf("parseValueFormat(hex); got no error")
+	}
+	if _, err := ParseValueFormat("fixed", -2); err == nil {
+		t.Errorf("parseValueFormat(fixed, -2); got no error")
+	}
+}
+
+type valueTestCase struct {
+	metric parser.Metric
+	want   string
+}
+
+var valueTestCases = []valueTestCase{
+	{parser.Metric{Value: 6, Mean: 2, Count: 3, Last: 1}, "2"},
+	{parser.Metric{Type: parser.Timer, Value: 6, Mean: 2, Count: 3, Last: 1}, "2"},
+	{parser.Metric{Type: parser.Counter, Value: 6, Mean: 2, Count: 3, Last: 1}, "6"},
+	{parser.Metric{Type: parser.Gauge, Value: 6, Mean: 2, Count: 3, Last: 1}, "1"},
+	{parser.Metric{Type: parser.Set, Value: 3, Mean: 1, Count: 3, Members: map[string]struct{}{"a": {}, "b": {}}}, "2"},
+}
+
+func TestValue(t *testing.T) {
+	f, _ := ParseValueFormat("auto", -1)
+	for _, tc := range valueTestCases {
+		if got := f.Value(tc.metric); got != tc.want {
+			t.Errorf("Value(%v); got %s, want %s", tc.metric.Type, got, tc.want)
+		}
+	}
+}
+
+func TestIntegerMean(t *testing.T) {
+	f, _ := ParseValueFormat("auto", -1)
+	m := parser.Metric{Count: 1}
+	m.SetInt(9007199254740993)
+	if got := f.Mean(m); got != "9007199254740993" {
+		t.Errorf("mean(%d); got %s, want it exact", m.IntValue, got)
+	}
+	m.SetInt(3)
+	m.Count, m.Mean = 2, 1.5
+	if got := f.Mean(m); got != "1.5" {
+		t.Errorf("mean(3/2); got %s, want 1.5", got)
+	}
+}
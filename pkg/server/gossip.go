@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// how often a collector gossips its members to a few of them
+	gossipInterval = time.Second
+	// how long a member's heartbeat may stand still before it is taken for
+	// failed and its names given to the others
+	gossipFailAfter = 10 * time.Second
+)
+
+// the members gossiped to every round
+const gossipFanout = 3
+
+// Gossip finds the collectors of a Cluster and those that fail, rather than
+// every collector being given them all. Each collector beats a heartbeat
+// and every gossipInterval sends the members it knows, with their last
+// heartbeats, to a few of them over UDP on the port of its peer listener.
+// Whatever a member heard of last spreads to all of them in a few rounds; a
+// member whose heartbeat hasn't moved for gossipFailAfter has failed. The
+// ring is rebuilt from the live members whenever they change.
+type Gossip struct {
+	cluster *Cluster
+	seeds   []string
+	token   string
+	conn    net.PacketConn
+	now     func() time.Time
+
+	mu      sync.Mutex
+	members map[string]*gossipMember
+	// the collectors that joined and left since the last report
+	joined, left []string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// gossipMember is a member as gossiped. A collector's heartbeat counts up
+// from its incarnation, the time it started, so one restarting isn't taken
+// for its old self.
+type gossipMember struct {
+	Addr        string `json:"addr"`
+	Incarnation int64  `json:"inc"`
+	Beat        uint64 `json:"beat"`
+
+	heard time.Time
+	alive bool
+}
+
+type gossipMessage struct {
+	Token   string         `json:"token,omitempty"`
+	Members []gossipMember `json:"members"`
+}
+
+// Returns whether the member's heartbeat is after o's
+func (m *gossipMember) after(o *gossipMember) bool {
+	if m.Incarnation != o.Incarnation {
+		return m.Incarnation > o.Incarnation
+	}
+	return m.Beat > o.Beat
+}
+
+// Starts gossiping the membership of the cluster on the UDP address, joining
+// it through the seeds, host:port peer addresses of any of its collectors.
+// Collectors gossiping without the token are ignored when it isn't empty.
+func NewGossip(c *Cluster, addr string, seeds []string, token string) (*Gossip, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &Gossip{cluster: c, token: token, conn: conn, now: time.Now,
+		members: make(map[string]*gossipMember), done: make(chan struct{})}
+	for _, seed := range seeds {
+		if seed != c.self {
+			g.seeds = append(g.seeds, seed)
+		}
+	}
+	now := g.now()
+	g.members[c.self] = &gossipMember{Addr: c.self, Incarnation: now.UnixNano(), heard: now, alive: true}
+	g.wg.Add(2)
+	go g.receive()
+	go g.run()
+	return g, nil
+}
+
+// Beats the heartbeat and gossips every gossipInterval until closed
+func (g *Gossip) run() {
+	defer g.wg.Done()
+	tick := time.NewTicker(gossipInterval)
+	defer tick.Stop()
+	for {
+		g.round()
+		select {
+		case <-g.done:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// A round of gossip: beats the heartbeat, fails the members silent for too
+// long and sends the live ones to a few of them, to the seeds while none is
+// known
+func (g *Gossip) round() {
+	g.mu.Lock()
+	now := g.now()
+	self := g.members[g.cluster.self]
+	self.Beat++
+	self.heard = now
+	changed := false
+	msg := gossipMessage{Token: g.token}
+	var targets []string
+	for addr, m := range g.members {
+		switch {
+		case m.alive && now.Sub(m.heard) > gossipFailAfter:
+			m.alive = false
+			g.left = append(g.left, addr)
+			changed = true
+			slog.Warn("Cluster: a collector has failed", "peer", addr, "silent", now.Sub(m.heard).Round(time.Second))
+		case !m.alive && now.Sub(m.heard) > 10*gossipFailAfter:
+			// by now no member gossips its old heartbeat
+			delete(g.members, addr)
+		}
+		if m.alive {
+			msg.Members = append(msg.Members, *m)
+			if addr != g.cluster.self {
+				targets = append(targets, addr)
+			}
+		}
+	}
+	if changed {
+		g.rebuild()
+	}
+	g.mu.Unlock()
+
+	if len(targets) == 0 {
+		targets = slices.Clone(g.seeds)
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	for _, addr := range targets[:min(len(targets), gossipFanout)] {
+		if to, err := net.ResolveUDPAddr("udp", addr); err == nil {
+			g.conn.WriteTo(b, to)
+		}
+	}
+}
+
+// Merges the members gossiped to this collector until closed
+func (g *Gossip) receive() {
+	defer g.wg.Done()
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-g.done:
+				return
+			default:
+			}
+			continue
+		}
+		var msg gossipMessage
+		if json.Unmarshal(buf[:n], &msg) != nil || msg.Token != g.token {
+			slog.Debug("Cluster: ignored gossip", "from", from.String())
+			continue
+		}
+		g.merge(msg.Members)
+	}
+}
+
+// Takes the heartbeats gossiped that are later than those known, bringing
+// back to life the members heard of again
+func (g *Gossip) merge(members []gossipMember) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	changed := false
+	for _, m := range members {
+		if m.Addr == "" || m.Addr == g.cluster.self {
+			continue
+		}
+		known, ok := g.members[m.Addr]
+		if ok && !m.after(known) {
+			continue
+		}
+		if !ok || !known.alive {
+			g.joined = append(g.joined, m.Addr)
+			changed = true
+			slog.Info("Cluster: a collector has joined", "peer", m.Addr)
+		}
+		m.heard, m.alive = now, true
+		g.members[m.Addr] = &m
+	}
+	if changed {
+		g.rebuild()
+	}
+}
+
+// Rebuilds the cluster's ring from the live members, with g.mu held
+func (g *Gossip) rebuild() {
+	if err := g.cluster.setPeers(g.alive()); err != nil {
+		slog.Error("Cluster: the ring wasn't rebuilt", "err", err)
+	}
+}
+
+// Members returns the addresses of the live collectors, this one included,
+// sorted
+func (g *Gossip) Members() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.alive()
+}
+
+// with g.mu held
+func (g *Gossip) alive() []string {
+	var peers []string
+	for addr, m := range g.members {
+		if m.alive {
+			peers = append(peers, addr)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Report writes the collectors that joined and left since the last report
+func (g *Gossip) Report(w io.Writer) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	joined, left := g.joined, g.left
+	g.joined, g.left = nil, nil
+	g.mu.Unlock()
+	if len(joined) == 0 && len(left) == 0 {
+		return
+	}
+	n := len(g.Members())
+	slices.Sort(joined)
+	slices.Sort(left)
+	fmt.Fprintf(w, "(10 sec): Cluster membership changed, joined [%s], left [%s], %d collectors\n", strings.Join(joined, " "), strings.Join(left, " "), n)
+}
+
+// Close stops gossiping, the other collectors take this one for failed
+func (g *Gossip) Close() error {
+	if g == nil {
+		return nil
+	}
+	close(g.done)
+	err := g.conn.Close()
+	g.wg.Wait()
+	return err
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a free UDP address on the loopback
+func freeUDP(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestGossip(t *testing.T) {
+	defer func(interval, failAfter time.Duration) {
+		gossipInterval, gossipFailAfter = interval, failAfter
+	}(gossipInterval, gossipFailAfter)
+	gossipInterval, gossipFailAfter = 10*time.Millisecond, 300*time.Millisecond
+
+	addrs := []string{freeUDP(t), freeUDP(t), freeUDP(t)}
+	var gossips []*Gossip
+	for i, addr := range addrs {
+		c, err := NewCluster(addr, []string{addr}, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// every collector joins through the first
+		g, err := NewGossip(c, addr, addrs[:1], "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			defer g.Close()
+		}
+		gossips = append(gossips, g)
+	}
+	want := sortedCopy(addrs)
+	waitMembers := func(g *Gossip, want []string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !slices.Equal(g.Members(), want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := g.Members(); !slices.Equal(got, want) {
+			t.Fatalf("Members() of %s; got %v, want %v", g.cluster.self, got, want)
+		}
+	}
+	for _, g := range gossips {
+		waitMembers(g, want)
+	}
+	// the rings agree on the owners
+	for _, name := range []string{"cpu", "mem", "disk", "net"} {
+		if a, b := gossips[1].cluster.Owner(name), gossips[2].cluster.Owner(name); a != b {
+			t.Errorf("Owner(%s); got %s and %s", name, a, b)
+		}
+	}
+
+	// the first fails, its names go to the others
+	gossips[0].Close()
+	rest := sortedCopy(addrs[1:])
+	waitMembers(gossips[1], rest)
+	waitMembers(gossips[2], rest)
+	for _, name := range []string{"cpu", "mem", "disk", "net"} {
+		if owner := gossips[1].cluster.Owner(name); owner == addrs[0] {
+			t.Errorf("Owner(%s) is the failed %s", name, owner)
+		}
+	}
+	var report bytes.Buffer
+	gossips[1].Report(&report)
+	if !strings.Contains(report.String(), "left ["+addrs[0]+"], 2 collectors") {
+		t.Errorf("Report(); got %q, want %s left", report.String(), addrs[0])
+	}
+}
+
+func TestGossipToken(t *testing.T) {
+	defer func(interval time.Duration) { gossipInterval = interval }(gossipInterval)
+	gossipInterval = 10 * time.Millisecond
+
+	a, b := freeUDP(t), freeUDP(t)
+	ca, _ := NewCluster(a, []string{a}, "secret")
+	defer ca.Close()
+	cb, _ := NewCluster(b, []string{b}, "other")
+	defer cb.Close()
+	ga, err := NewGossip(ca, a, []string{b}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ga.Close()
+	gb, err := NewGossip(cb, b, []string{a}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gb.Close()
+	time.Sleep(200 * time.Millisecond)
+	if got := ga.Members(); !slices.Equal(got, []string{a}) {
+		t.Errorf("Members() with another token gossiping; got %v, want only %s", got, a)
+	}
+}
+
+func sortedCopy(s []string) []string {
+	s = slices.Clone(s)
+	slices.Sort(s)
+	return s
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Returns when a connection that must send within idle has to have done so,
+// the drain deadline if that comes sooner
+func (t *connTracker) readDeadline(idle time.Duration) time.Time {
+	deadline := time.Now().Add(idle)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.deadline.IsZero() && t.deadline.Before(deadline) {
+		return t.deadline
+	}
+	return deadline
+}
+
+// Reports whether the connections are being drained
+func (t *connTracker) draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.deadline.IsZero()
+}
+
+// idleReader moves the connection's read deadline on before every read, so
+// a protobuf stream, which has no lines, is only closed when it sends
+// nothing at all for the idle timeout
+type idleReader struct {
+	conn    net.Conn
+	idle    time.Duration
+	tracker *connTracker
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(r.tracker.readDeadline(r.idle))
+	return r.conn.Read(p)
+}
+
+// Reports whether the connection failed with err because it was idle for
+// longer than the listener allows rather than because of a drain, counting
+// it if so
+func (s *Server) idleTimedOut(l *listener, err error) bool {
+	if l.idleTimeout == 0 || !errors.Is(err, os.ErrDeadlineExceeded) || s.inflight.draining() {
+		return false
+	}
+	atomic.AddUint64(&s.idleClosed, 1)
+	return true
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	s := New(&fullStore{})
+	l := &listener{idleTimeout: 20 * time.Millisecond}
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// a silent client runs into the deadline
+	r := idleReader{conn: server, idle: l.idleTimeout, tracker: &s.inflight}
+	start := time.Now()
+	_, err := r.Read(make([]byte, 1))
+	if !s.idleTimedOut(l, err) {
+		t.Errorf("Read() from a silent client; got error %v, want an idle timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < l.idleTimeout {
+		t.Errorf("Read(); returned after %v, before the idle timeout", elapsed)
+	}
+	if s.idleTimedOut(&listener{}, err) {
+		t.Errorf("idleTimedOut() without an idle timeout; got true")
+	}
+	if s.idleClosed != 1 {
+		t.Errorf("idleClosed; got %d, want 1", s.idleClosed)
+	}
+
+	// a drain deadline sooner than the idle timeout wins and isn't counted
+	s.inflight.deadline = time.Now().Add(time.Millisecond)
+	if d := s.inflight.readDeadline(time.Hour); !d.Equal(s.inflight.deadline) {
+		t.Errorf("readDeadline() while draining; got %v, want the drain deadline", d)
+	}
+	_, err = r.Read(make([]byte, 1))
+	if s.idleTimedOut(l, err) {
+		t.Errorf("idleTimedOut() while draining; got true")
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// stageLabels are the pprof label sets a connection or packet goroutine
+// switches between as a line moves through the pipeline, so CPU profiles
+// attribute time to the listener, tenant and stage. They are built once per
+// goroutine since switching between built sets doesn't allocate.
+type stageLabels struct {
+	read, parse, ingest context.Context
+}
+
+// Builds the label sets for a goroutine serving the listener, the tenant is
+// left off until it is known
+func newStageLabels(listener, tenant string) stageLabels {
+	at := func(stage string) context.Context {
+		labels := []string{"listener", listener, "stage", stage}
+		if tenant != "" {
+			labels = append(labels, "tenant", tenant)
+		}
+		return pprof.WithLabels(context.Background(), pprof.Labels(labels...))
+	}
+	return stageLabels{read: at("read"), parse: at("parse"), ingest: at("ingest")}
+}
+
+// Labels the calling goroutine as being in the stage
+func enterStage(stage context.Context) {
+	pprof.SetGoroutineLabels(stage)
+}
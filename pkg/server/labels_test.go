@@ -0,0 +1,22 @@
+package server
+
+import (
+	"runtime/pprof"
+	"testing"
+)
+
+func TestStageLabels(t *testing.T) {
+	stages := newStageLabels("statsd", "acme")
+	if v, _ := pprof.Label(stages.parse, "stage"); v != "parse" {
+		t.Errorf("newStageLabels(); parse stage labelled %q", v)
+	}
+	if v, _ := pprof.Label(stages.ingest, "listener"); v != "statsd" {
+		t.Errorf("newStageLabels(); listener labelled %q, want statsd", v)
+	}
+	if v, _ := pprof.Label(stages.read, "tenant"); v != "acme" {
+		t.Errorf("newStageLabels(); tenant labelled %q, want acme", v)
+	}
+	if _, ok := pprof.Label(newStageLabels("default", "").read, "tenant"); ok {
+		t.Errorf("newStageLabels() without a tenant; got a tenant label")
+	}
+}
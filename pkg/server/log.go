@@ -0,0 +1,25 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+)
+
+// The server logs through log/slog's default logger, the collector sets its
+// handler and level. Everything logged about a connection or a datagram
+// carries its correlation ID as conn and its remote address as remote.
+
+// Returns the logger of a connection
+func connLogger(id string, remote net.Addr) *slog.Logger {
+	return slog.With("conn", id, "remote", remote.String())
+}
+
+// Logs the end of a connection, a client hanging up is no warning
+func logTermination(logger *slog.Logger, err error) {
+	if err == io.EOF {
+		logger.Info("client terminated", "reason", "EOF")
+		return
+	}
+	logger.Warn("client terminated", "err", err)
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ImportMapping converts the mapping config of another statsd aggregator
+// into rules in the format of LoadScrubRules, so a team replacing it keeps
+// its metric names. Either a statsd_exporter mapping file (YAML with a
+// mappings list) or the templates of a telegraf statsd input (TOML) is
+// accepted, detected from the content. What has no equivalent here, like
+// timer and histogram options, is left out with a comment saying so.
+func ImportMapping(data []byte) ([]string, error) {
+	text := string(data)
+	if regexp.MustCompile(`(?m)^\s*templates\s*=`).MatchString(text) {
+		return importTelegraf(text)
+	}
+	return importStatsdExporter(text)
+}
+
+// statsdMapping is one entry of a statsd_exporter mappings list
+type statsdMapping struct {
+	line      int
+	match     string
+	matchType string
+	name      string
+	action    string
+	labels    [][2]string
+	skipped   []string
+}
+
+// Converts a statsd_exporter mapping file. Only the subset of YAML these
+// files are written in is understood: a top level mappings list of maps
+// with scalar values and a labels map.
+func importStatsdExporter(text string) ([]string, error) {
+	var mappings []*statsdMapping
+	var notes []string
+	var cur *statsdMapping
+	inMappings, inLabels := false, false
+	itemIndent := 0
+	for n, raw := range strings.Split(text, "\n") {
+		line := stripYAMLComment(raw)
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		item := strings.HasPrefix(trimmed, "- ")
+		if indent == 0 && !(item && inMappings) {
+			key, _, _ := strings.Cut(trimmed, ":")
+			inMappings, cur = key == "mappings", nil
+			if !inMappings {
+				notes = append(notes, fmt.Sprintf("# line %d: top level %q is not supported, skipped", n+1, key))
+			}
+			continue
+		}
+		if !inMappings {
+			continue
+		}
+		if item && (cur == nil || indent < itemIndent) {
+			cur = &statsdMapping{line: n + 1}
+			mappings = append(mappings, cur)
+			itemIndent = indent + 2
+			trimmed, indent, inLabels = strings.TrimSpace(trimmed[2:]), itemIndent, false
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: expected a list of mappings", n+1)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			// the items of a list option, already noted as skipped
+			continue
+		}
+		key, value = strings.TrimSpace(key), yamlScalar(value)
+		if indent > itemIndent {
+			if inLabels {
+				cur.labels = append(cur.labels, [2]string{key, value})
+			}
+			continue
+		}
+		inLabels = false
+		switch key {
+		case "match":
+			cur.match = value
+		case "match_type":
+			cur.matchType = value
+		case "name":
+			cur.name = value
+		case "action":
+			cur.action = value
+		case "labels":
+			inLabels = true
+		default:
+			cur.skipped = append(cur.skipped, key)
+		}
+	}
+
+	rules := append([]string{"# imported from a statsd_exporter mapping config"}, notes...)
+	for _, m := range mappings {
+		converted, err := m.rules()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, converted...)
+	}
+	return rules, nil
+}
+
+// Returns the rules doing what the mapping does
+func (m *statsdMapping) rules() ([]string, error) {
+	if m.match == "" {
+		return nil, fmt.Errorf("line %d: mapping without a match", m.line)
+	}
+	var rules []string
+	for _, key := range m.skipped {
+		rules = append(rules, fmt.Sprintf("# %s: %s is not supported, skipped", m.match, key))
+	}
+	var pattern string
+	switch m.matchType {
+	case "", "glob":
+		pattern = "^" + globPattern(m.match, "([^.]*)") + "$"
+	case "regex":
+		pattern = m.match
+	default:
+		return nil, fmt.Errorf("line %d: unknown match_type %q", m.line, m.matchType)
+	}
+	if strings.ContainsAny(pattern, " \t") {
+		return append(rules, fmt.Sprintf("# %s: patterns with spaces can't be written as rules, skipped", m.match)), nil
+	}
+
+	switch {
+	case m.action == "drop":
+		if m.matchType == "regex" {
+			pattern = "^.*(?:" + pattern + ").*$"
+		}
+		return append(rules, "replace "+pattern), nil
+	case m.action != "" && m.action != "map":
+		return nil, fmt.Errorf("line %d: unknown action %q", m.line, m.action)
+	case m.name == "":
+		return nil, fmt.Errorf("line %d: mapping of %s without a name", m.line, m.match)
+	}
+
+	var tags []string
+	for _, l := range m.labels {
+		if strings.ContainsAny(l[0]+l[1], " \t,=") || l[0] == "" {
+			rules = append(rules, fmt.Sprintf("# %s: label %s can't be written as a tag, skipped", m.match, l[0]))
+			continue
+		}
+		tags = append(tags, l[0]+"="+bracedRefs(l[1]))
+	}
+	rule := "map " + pattern + " " + bracedRefs(m.name)
+	if len(tags) > 0 {
+		rule += " " + strings.Join(tags, ",")
+	}
+	return append(rules, rule), nil
+}
+
+// Converts the templates of a telegraf statsd input. Each template is
+// [filter] template [tags], the template naming each dot separated part of
+// a metric name as measurement, field, a tag key or nothing, left empty or
+// as *. Measurement parts, then field parts, are joined with _ into the
+// name. Greedy parts like field* have no equivalent and are skipped.
+func importTelegraf(text string) ([]string, error) {
+	at := regexp.MustCompile(`(?m)^\s*templates\s*=\s*\[`).FindStringIndex(text)
+	if at == nil {
+		return nil, fmt.Errorf("templates is not a list")
+	}
+	start := at[1]
+	end := strings.Index(text[start:], "]")
+	if end < 0 {
+		return nil, fmt.Errorf("templates list is not closed")
+	}
+	rules := []string{"# imported from telegraf statsd templates"}
+	for _, quoted := range regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'[^']*'`).FindAllString(text[start:start+end], -1) {
+		t := yamlScalar(quoted)
+		rule, err := telegrafTemplate(t)
+		if err != nil {
+			rules = append(rules, fmt.Sprintf("# %s: %v, skipped", t, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func telegrafTemplate(t string) (string, error) {
+	var filter, template, defaults string
+	switch fields := strings.Fields(t); {
+	case len(fields) == 1:
+		template = fields[0]
+	case len(fields) == 2 && strings.Contains(fields[1], "="):
+		template, defaults = fields[0], fields[1]
+	case len(fields) == 2:
+		filter, template = fields[0], fields[1]
+	case len(fields) == 3:
+		filter, template, defaults = fields[0], fields[1], fields[2]
+	default:
+		return "", fmt.Errorf("not [filter] template [tags]")
+	}
+	var filterParts []string
+	if filter != "" {
+		filterParts = strings.Split(filter, ".")
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	var measurement, field, tags []string
+	parts := strings.Split(template, ".")
+	for i, p := range parts {
+		if i > 0 {
+			pattern.WriteString(`\.`)
+		}
+		component := "[^.]+"
+		if i < len(filterParts) {
+			component = globPattern(filterParts[i], "[^.]*")
+		}
+		if p == "" || p == "*" {
+			pattern.WriteString("(?:" + component + ")")
+			continue
+		}
+		if strings.HasSuffix(p, "*") {
+			return "", fmt.Errorf("greedy parts like %s are not supported", p)
+		}
+		pattern.WriteString("(" + component + ")")
+		ref := "${" + strconv.Itoa(len(measurement)+len(field)+len(tags)+1) + "}"
+		switch p {
+		case "measurement":
+			measurement = append(measurement, ref)
+		case "field":
+			field = append(field, ref)
+		default:
+			tags = append(tags, p+"="+ref)
+		}
+	}
+	for i := len(parts); i < len(filterParts); i++ {
+		pattern.WriteString(`\.` + globPattern(filterParts[i], "[^.]*"))
+	}
+	// parts past the template are ignored
+	pattern.WriteString(`(?:\..*)?$`)
+	if len(measurement) == 0 {
+		return "", fmt.Errorf("no measurement part")
+	}
+
+	name := strings.Join(measurement, "_")
+	if len(field) > 0 {
+		name += "_" + strings.Join(field, "_")
+	}
+	if defaults != "" {
+		tags = append(tags, strings.Split(defaults, ",")...)
+	}
+	rule := "map " + pattern.String() + " " + name
+	if len(tags) > 0 {
+		rule += " " + strings.Join(tags, ",")
+	}
+	return rule, nil
+}
+
+// Turns a dot separated glob into a regexp, star matching within a part
+func globPattern(glob, star string) string {
+	pieces := strings.Split(glob, "*")
+	for i := range pieces {
+		pieces[i] = regexp.QuoteMeta(pieces[i])
+	}
+	return strings.Join(pieces, star)
+}
+
+// Rewrites $1 as ${1} so a reference followed by a letter or _ still means
+// the capture group
+var bareRef = regexp.MustCompile(`\$([0-9]+)`)
+
+func bracedRefs(template string) string {
+	return bareRef.ReplaceAllString(template, "$${$1}")
+}
+
+// Drops a YAML comment from the line, a # outside quotes after a space
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Returns the value of a plain or quoted YAML scalar
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if v, err := strconv.Unquote(s); err == nil {
+			return v
+		}
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+const statsdExporterMapping = `# statsd_exporter mapping
+defaults:
+  observer_type: histogram
+mappings:
+- match: "test.dispatcher.*.*.*"
+  name: "dispatcher_events_total"
+  labels:
+    processor: "$1"
+    action: "$2"
+    outcome: "$3"
+    job: "test_dispatcher"
+- match: "*.signup.*.*"
+  name: "signup_$1_total" # a comment
+  labels:
+    provider: "$2"
+  buckets: [0.1, 1]
+- match: '(.*)\.(.*)--(.*)\.status\.(.*)\.count'
+  match_type: regex
+  name: "request_total"
+  labels:
+    service: "$1"
+    code: "$4"
+- match: "noisy.*"
+  action: drop
+  name: "dropped"
+`
+
+const telegrafTemplates = `[[inputs.statsd]]
+  service_address = ":8125"
+  templates = [
+    "cpu.* measurement.host.field",
+    "measurement.measurement.region",
+    "api.*.* measurement.service.field.* env=prod",
+    "measurement.field*",
+  ]
+`
+
+func TestImportMapping(t *testing.T) {
+	rules, err := ImportMapping([]byte(statsdExporterMapping))
+	if err != nil {
+		t.Fatalf("ImportMapping(statsd_exporter); got error %v", err)
+	}
+	want := []string{
+		"# imported from a statsd_exporter mapping config",
+		`# line 2: top level "defaults" is not supported, skipped`,
+		`map ^test\.dispatcher\.([^.]*)\.([^.]*)\.([^.]*)$ dispatcher_events_total processor=${1},action=${2},outcome=${3},job=test_dispatcher`,
+		"# *.signup.*.*: buckets is not supported, skipped",
+		`map ^([^.]*)\.signup\.([^.]*)\.([^.]*)$ signup_${1}_total provider=${2}`,
+		`map (.*)\.(.*)--(.*)\.status\.(.*)\.count request_total service=${1},code=${4}`,
+		`replace ^noisy\.([^.]*)$`,
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ImportMapping(statsd_exporter); got\n%s\nwant\n%s", strings.Join(rules, "\n"), strings.Join(want, "\n"))
+	}
+
+	if rules, err = ImportMapping([]byte(telegrafTemplates)); err != nil {
+		t.Fatalf("ImportMapping(telegraf); got error %v", err)
+	}
+	want = []string{
+		"# imported from telegraf statsd templates",
+		`map ^(cpu)\.([^.]*)\.([^.]+)(?:\..*)?$ ${1}_${3} host=${2}`,
+		`map ^([^.]+)\.([^.]+)\.([^.]+)(?:\..*)?$ ${1}_${2} region=${3}`,
+		`map ^(api)\.([^.]*)\.([^.]*)\.(?:[^.]+)(?:\..*)?$ ${1}_${3} service=${2},env=prod`,
+		"# measurement.field*: greedy parts like field* are not supported, skipped",
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("ImportMapping(telegraf); got\n%s\nwant\n%s", strings.Join(rules, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the imported rules load and map as the original config would
+	rules, _ = ImportMapping([]byte(statsdExporterMapping))
+	path := filepath.Join(t.TempDir(), "imported.rules")
+	os.WriteFile(path, []byte(strings.Join(rules, "\n")), 0600)
+	loaded, err := LoadScrubRules(path)
+	if err != nil {
+		t.Fatalf("LoadScrubRules(imported); got error %v", err)
+	}
+	for input, want := range map[string]string{
+		"test.dispatcher.w1.ok.done":    "dispatcher_events_total{action=ok,job=test_dispatcher,outcome=done,processor=w1}",
+		"web.signup.google.x":           "signup_web_total{provider=google}",
+		"auth.api--v2.status.500.count": "request_total{code=500,service=auth}",
+		"noisy.thing":                   "",
+		"unmapped.metric":               "unmapped.metric",
+	} {
+		m := parser.Metric{Name: input}
+		if loaded.apply(&m); m.Name != "" && m.Key() != want || m.Name == "" && want != "" {
+			t.Errorf("apply(%s); got %q, want %q", input, m.Key(), want)
+		}
+	}
+
+	if _, err := ImportMapping([]byte("mappings:\n- name: x\n")); err == nil {
+		t.Errorf("ImportMapping(no match); got nil error")
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+var (
+	// how long the broker has to answer, and how often it is pinged to keep
+	// a quiet connection open
+	mqttTimeout   = 10 * time.Second
+	mqttKeepAlive = 30 * time.Second
+	// the wait before connecting again once the broker is lost, doubling up
+	// to the max while it stays down
+	mqttRetryMin, mqttRetryMax = time.Second, time.Minute
+)
+
+// the largest message taken, bigger ones are skipped like a line too long
+const mqttMaxPacket = 1 << 20
+
+// the MQTT 3.1.1 control packets a subscriber sends and receives
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttDisconnect  = 14
+	mqttSubscribeID = 1
+)
+
+// mqttSubscriber is an MQTT 3.1.1 client of a broker, subscribed to the
+// topics of an mqtt listener. Every message is lines of the listener's
+// format. At QoS 1 a message is acknowledged once its lines are ingested,
+// and with a client id the broker keeps the session, queueing what is
+// published while the collector is away.
+type mqttSubscriber struct {
+	addr     string
+	user     string
+	password string
+	clientID string
+	// the broker keeps the subscriptions and queued messages of the client
+	// id across connections
+	persistent bool
+	topics     []string
+	qos        byte
+
+	// held to write, and to swap the connection
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	buf  []byte
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newMQTTSubscriber(cfg ListenerConfig) *mqttSubscriber {
+	m := &mqttSubscriber{addr: cfg.Address, user: cfg.User, password: cfg.Password, clientID: cfg.ClientID,
+		persistent: cfg.ClientID != "" && cfg.QoS > 0, topics: strings.Split(cfg.Topics, ","), qos: byte(cfg.QoS), done: make(chan struct{})}
+	if m.clientID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		m.clientID = "collector-" + hex.EncodeToString(id)
+	}
+	return m
+}
+
+// Connects to the broker and subscribes to the topics, the broker's
+// answer to the subscription is read along with the messages
+func (m *mqttSubscriber) connect() error {
+	conn, err := net.DialTimeout("tcp", m.addr, mqttTimeout)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	select {
+	case <-m.done:
+		m.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	default:
+	}
+	m.conn = conn
+	if m.r == nil {
+		m.r = bufio.NewReader(conn)
+	} else {
+		m.r.Reset(conn)
+	}
+	m.mu.Unlock()
+
+	var flags byte
+	body := mqttString(nil, "MQTT")
+	if m.user != "" {
+		flags |= 0x80
+		if m.password != "" {
+			flags |= 0x40
+		}
+	}
+	if !m.persistent {
+		flags |= 0x02
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = mqttString(body, m.clientID)
+	if flags&0x80 != 0 {
+		body = mqttString(body, m.user)
+	}
+	if flags&0x40 != 0 {
+		body = mqttString(body, m.password)
+	}
+	if err := m.write(mqttConnect<<4, body); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(mqttTimeout))
+	kind, b, err := m.read()
+	if err != nil {
+		return err
+	}
+	if kind>>4 != mqttConnAck || len(b) != 2 {
+		return fmt.Errorf("the broker answered CONNECT with packet type %d", kind>>4)
+	}
+	if b[1] != 0 {
+		return fmt.Errorf("the broker refused the connection, %s", mqttRefusal(b[1]))
+	}
+
+	body = binary.BigEndian.AppendUint16(nil, mqttSubscribeID)
+	for _, topic := range m.topics {
+		body = append(mqttString(body, topic), m.qos)
+	}
+	return m.write(mqttSubscribe<<4|0x02, body)
+}
+
+// Returns whether the topic filter is one a broker takes: '+' stands for a
+// whole level, '#' for the last level and those below it
+func validTopicFilter(topic string) bool {
+	if topic == "" || len(topic) > 65535 || strings.ContainsRune(topic, 0) {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && level != "+" && level != "#" {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns why the broker refused a connection
+func mqttRefusal(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client id rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("code %d", code)
+}
+
+// Appends the string with its length
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// Writes a packet of the first byte and body
+func (m *mqttSubscriber) write(first byte, body []byte) error {
+	packet := []byte{first}
+	for n := len(body); ; {
+		b := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return net.ErrClosed
+	}
+	m.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := m.conn.Write(packet)
+	return err
+}
+
+// Reads a packet, returning its first byte and its body, valid until the
+// next read. The body of one over mqttMaxPacket is skipped and
+// parser.ErrTooLong returned along with its first byte.
+func (m *mqttSubscriber) read() (byte, []byte, error) {
+	first, err := m.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := 0
+	for shift := 0; ; shift += 7 {
+		b, err := m.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if shift == 21 && b&0x80 != 0 {
+			return 0, nil, errors.New("malformed packet length")
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if n > mqttMaxPacket {
+		if _, err := m.r.Discard(n); err != nil {
+			return 0, nil, err
+		}
+		return first, nil, fmt.Errorf("%w, message of %d bytes exceeds %d", parser.ErrTooLong, n, mqttMaxPacket)
+	}
+	if cap(m.buf) < n {
+		m.buf = make([]byte, n)
+	}
+	m.buf = m.buf[:n]
+	if _, err := io.ReadFull(m.r, m.buf); err != nil {
+		return 0, nil, err
+	}
+	return first, m.buf, nil
+}
+
+// Hands every message of the topics to handle until the connection fails,
+// acknowledging those sent at QoS 1 once handled. The broker is pinged
+// while it is quiet, and given up on when it doesn't answer.
+func (m *mqttSubscriber) receive(handle func(topic string, payload []byte, err error)) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		tick := time.NewTicker(mqttKeepAlive / 2)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				m.write(mqttPingReq<<4, nil)
+			}
+		}
+	}()
+
+	for {
+		m.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive))
+		first, b, err := m.read()
+		if errors.Is(err, parser.ErrTooLong) && first>>4 == mqttPublish {
+			// its packet id was skipped with it, at QoS 1 the message can't
+			// be acknowledged
+			handle("", nil, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		switch first >> 4 {
+		case mqttPublish:
+			qos := first >> 1 & 3
+			if len(b) < 2 {
+				return errors.New("malformed PUBLISH")
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			if qos > 1 || len(b) < 2+n+2*int(qos) {
+				return errors.New("malformed PUBLISH")
+			}
+			topic, payload := string(b[2:2+n]), b[2+n:]
+			var id []byte
+			if qos == 1 {
+				id, payload = payload[:2], payload[2:]
+			}
+			handle(topic, payload, nil)
+			if qos == 1 {
+				if err := m.write(mqttPubAck<<4, id); err != nil {
+					return err
+				}
+			}
+		case mqttSubAck:
+			if len(b) != 2+len(m.topics) {
+				return errors.New("malformed SUBACK")
+			}
+			for i, code := range b[2:] {
+				if code == 0x80 {
+					slog.Warn("mqtt: the broker refused a subscription", "broker", m.addr, "topic", m.topics[i])
+				}
+			}
+		case mqttPingResp:
+		default:
+			return fmt.Errorf("unexpected packet type %d", first>>4)
+		}
+	}
+}
+
+// Closes the connection to the broker, saying goodbye while the subscriber
+// isn't closed
+func (m *mqttSubscriber) disconnect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		m.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+		m.conn.Write([]byte{mqttDisconnect << 4, 0})
+		m.conn.Close()
+		m.conn = nil
+	}
+}
+
+// Close stops the subscriber, its connection is closed at once
+func (m *mqttSubscriber) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		m.mu.Lock()
+		if m.conn != nil {
+			m.conn.Close()
+		}
+		m.mu.Unlock()
+	})
+	return nil
+}
+
+// Ingests the messages of the subscriber's topics until the listener is
+// closed, connecting again whenever the broker is lost. Like a tailed
+// file's, bad lines only cost themselves.
+func (s *Server) serveMQTT(l *listener, m *mqttSubscriber) error {
+	in := s.intake(l, false)
+	lim := s.limiter(l)
+	stages := newStageLabels(l.name, "")
+	var wait time.Duration
+	for {
+		err := m.connect()
+		if err == nil {
+			slog.Info("mqtt: subscribed", "broker", m.addr, "topics", strings.Join(m.topics, " "))
+			wait = 0
+			err = m.receive(func(topic string, payload []byte, err error) {
+				if err != nil {
+					atomic.AddUint64(&s.tooLong, 1)
+					s.DeadLetters.record("", err, false, l.name, m.addr)
+					return
+				}
+				s.mqttMessage(l, in, lim, topic, payload, stages)
+			})
+		}
+		m.disconnect()
+		select {
+		case <-m.done:
+			return net.ErrClosed
+		default:
+		}
+		wait = min(max(2*wait, mqttRetryMin), mqttRetryMax)
+		slog.Warn("mqtt: lost the broker", "broker", m.addr, "err", err, "retry", wait)
+		select {
+		case <-m.done:
+			return net.ErrClosed
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Ingests the lines of a message published to the topic
+func (s *Server) mqttMessage(l *listener, in *intake, lim *limiter, topic string, payload []byte, stages stageLabels) {
+	atomic.AddUint64(&s.lines.read, uint64(len(payload)))
+	for len(payload) > 0 {
+		enterStage(stages.read)
+		var b []byte
+		b, payload, _ = bytes.Cut(payload, []byte{'\n'})
+		line := string(b)
+		if len(line) > l.maxLine {
+			err := fmt.Errorf("%w, line of %d bytes exceeds %d", parser.ErrTooLong, len(line), l.maxLine)
+			atomic.AddUint64(&s.tooLong, 1)
+			s.DeadLetters.record(line, err, false, l.name, topic)
+			continue
+		}
+		s.sourceLine(l, in, lim, line, topic, stages)
+	}
+}
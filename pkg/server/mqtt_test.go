@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// Reads a packet as a broker, returning its first byte and body
+func readMQTTPacket(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	first, err := r.ReadByte()
+	if err != nil {
+		t.Fatalf("broker read; got error %v", err)
+	}
+	n := 0
+	for shift := 0; ; shift += 7 {
+		b, _ := r.ReadByte()
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("broker read; got error %v", err)
+	}
+	return first, body
+}
+
+// Publishes the payload to the topic, with the packet id at QoS 1
+func publishMQTT(conn net.Conn, topic, payload string, id uint16) {
+	first := byte(mqttPublish << 4)
+	body := mqttString(nil, topic)
+	if id != 0 {
+		first |= 1 << 1
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+	conn.Write(append([]byte{first, byte(len(body))}, body...))
+}
+
+func TestMQTT(t *testing.T) {
+	defer func(min time.Duration) { mqttRetryMin = min }(mqttRetryMin)
+	mqttRetryMin = time.Millisecond
+	broker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	agg := store.NewStore(store.Options{Shards: 4})
+	s := New(agg)
+	cfg, err := ParseListenerConfig("mqtt://edge:secret@"+broker.Addr().String()+"?topics=sensors/%2B,edge/%23&qos=1&client-id=c1",
+		ListenerConfig{Format: "tsv", MaxConns: 1, ReusePort: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	now := time.Now().Unix()
+	// the second connection is the subscriber's after the broker dropped
+	// the first
+	for round := 0; round < 2; round++ {
+		conn, err := broker.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		first, body := readMQTTPacket(t, r)
+		// a persistent session, as the user with the password
+		if first != mqttConnect<<4 || body[7] != 0xc0 || string(body[len(body)-18:]) != "\x00\x02c1\x00\x04edge\x00\x06secret" {
+			t.Fatalf("CONNECT; got %x %q", first, body)
+		}
+		conn.Write([]byte{mqttConnAck << 4, 2, 0, 0})
+		first, body = readMQTTPacket(t, r)
+		if want := "\x00\x01\x00\x09sensors/+\x01\x00\x06edge/#\x01"; first != mqttSubscribe<<4|2 || string(body) != want {
+			t.Fatalf("SUBSCRIBE; got %x %q, want %q", first, body, want)
+		}
+		conn.Write([]byte{mqttSubAck << 4, 4, 0, 1, 1, 1})
+
+		publishMQTT(conn, "sensors/a", fmt.Sprintf("cpu%d\t1\t%d\nmem%d\t2\t%d\n", round, now, round, now), 0)
+		publishMQTT(conn, "edge/b", fmt.Sprintf("disk%d\t3\t%d\nnot a metric", round, now), 7)
+		if first, body = readMQTTPacket(t, r); first != mqttPubAck<<4 || string(body) != "\x00\x07" {
+			t.Errorf("PUBACK; got %x %q", first, body)
+		}
+		conn.Close()
+	}
+
+	names := make(map[string]bool)
+	for _, m := range agg.Snapshot() {
+		names[m.Name] = true
+	}
+	for _, name := range []string{"cpu0", "mem0", "disk0", "cpu1", "mem1", "disk1"} {
+		if !names[name] {
+			t.Errorf("stored %v; want %s", names, name)
+		}
+	}
+}
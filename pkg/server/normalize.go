@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// NameNormalization folds the spellings of a name emitters disagree on,
+// CPU-Load and cpu_load, into one so they aggregate together. It applies
+// to the scrubbed name, before the store key is formed.
+type NameNormalization struct {
+	// lowercases the name
+	Lower bool
+	// replaces the word separators '-' and '_' with this one, empty keeps
+	// them. Dots are the name's hierarchy and are kept, as is a name's
+	// leading character.
+	Separator string
+	// the tag key the name as sent is kept under when normalizing changed
+	// it, empty keeps none. The spellings are then series of their own, the
+	// tag dropped when the name is too long for a tag value.
+	Tag string
+}
+
+// Check returns an error if the separator isn't '-' or '_' or the tag
+// isn't a valid tag key
+func (n NameNormalization) Check() error {
+	if n.Separator != "" && n.Separator != "-" && n.Separator != "_" {
+		return fmt.Errorf("name separator %q, want - or _", n.Separator)
+	}
+	if n.Tag != "" {
+		if _, err := parser.CanonicalTags([][2]string{{n.Tag, "x"}}); err != nil {
+			return fmt.Errorf("name tag: %v", err)
+		}
+	}
+	return nil
+}
+
+// Normalizes the metric's name in place, tagging it with the name as sent
+// when it changed
+func (n NameNormalization) apply(m *parser.Metric) {
+	name := m.Name
+	if n.Lower {
+		name = strings.ToLower(name)
+	}
+	if n.Separator != "" && len(name) > 1 {
+		name = name[:1] + strings.NewReplacer("-", n.Separator, "_", n.Separator).Replace(name[1:])
+	}
+	if name == m.Name {
+		return
+	}
+	if n.Tag != "" {
+		if tags, err := parser.SetTag(m.Tags, n.Tag, m.Name); err == nil {
+			m.Tags = tags
+		}
+	}
+	m.Name = name
+}
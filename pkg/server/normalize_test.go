@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestNameNormalization(t *testing.T) {
+	for _, tc := range []struct {
+		n          NameNormalization
+		name, tags string
+		want, tag  string
+	}{
+		{NameNormalization{}, "CPU-Load", "", "CPU-Load", ""},
+		{NameNormalization{Lower: true}, "CPU-Load", "", "cpu-load", ""},
+		{NameNormalization{Separator: "_"}, "api.req-count_total", "", "api.req_count_total", ""},
+		{NameNormalization{Lower: true, Separator: "-"}, "_CPU_Load", "", "_cpu-load", ""},
+		{NameNormalization{Lower: true, Tag: "name"}, "CPU-Load", "host=a", "cpu-load", "host=a,name=CPU-Load"},
+		{NameNormalization{Lower: true, Tag: "name"}, "cpu-load", "host=a", "cpu-load", "host=a"},
+	} {
+		m := parser.Metric{Name: tc.name, Tags: tc.tags}
+		tc.n.apply(&m)
+		if m.Name != tc.want || m.Tags != tc.tag {
+			t.Errorf("%+v on %q; got %q %q, want %q %q", tc.n, tc.name, m.Name, m.Tags, tc.want, tc.tag)
+		}
+	}
+
+	for _, bad := range []NameNormalization{{Separator: "."}, {Tag: "a=b"}} {
+		if bad.Check() == nil {
+			t.Errorf("%+v.Check(); want an error", bad)
+		}
+	}
+}
+
+func TestIngestNormalized(t *testing.T) {
+	agg := store.NewStore(store.Options{})
+	s := New(agg)
+	s.Normalize = NameNormalization{Lower: true, Separator: "-"}
+	for _, name := range []string{"CPU-Load", "cpu_load", "Cpu-Load"} {
+		if err := s.Ingest(&parser.Metric{Name: name, Value: 1, Count: 1, Time: time.Now()}, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := agg.Snapshot(); len(got) != 1 || got[0].Name != "cpu-load" || got[0].Count != 3 {
+		t.Errorf("got %v, want the three aggregated as cpu-load", got)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Isolate stops a panic in a packet, tailed line, MQTT message or sink from
+// taking the whole server down with it. The panic is logged with its stack and
+// counted, then cleanup, if any, releases what the panicking code held. It
+// must be deferred directly:
+//
+//	defer s.Isolate("file (/var/log/app.log)", nil)
+func (s *Server) Isolate(what string, cleanup func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	s.isolated(slog.With("in", what), r, cleanup)
+}
+
+// isolateConn is Isolate for a connection handler, the panic is logged with
+// the connection's ID and remote address
+func (s *Server) isolateConn(logger *slog.Logger, cleanup func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	s.isolated(logger, r, cleanup)
+}
+
+// Counts and logs a recovered panic, then runs the cleanup
+func (s *Server) isolated(logger *slog.Logger, r any, cleanup func()) {
+	atomic.AddUint64(&s.panics, 1)
+	logger.Error("panic", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+	if cleanup != nil {
+		cleanup()
+	}
+}
+
+// Returns how many panics have been isolated since startup
+func (s *Server) Panics() uint64 {
+	return atomic.LoadUint64(&s.panics)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestIsolate(t *testing.T) {
+	s := New(&fullStore{})
+	cleaned := false
+	func() {
+		defer s.Isolate("test", func() { cleaned = true })
+		var m map[string]int
+		m["boom"]++
+	}()
+	if !cleaned || s.Panics() != 1 {
+		t.Errorf("Isolate(); got cleaned %v panics %d, want the cleanup run and 1 panic", cleaned, s.Panics())
+	}
+
+	var buf bytes.Buffer
+	s.Report(&buf)
+	if !strings.Contains(buf.String(), "Panics 1,") {
+		t.Errorf("Report(); got %q, want the panic reported", buf.String())
+	}
+	buf.Reset()
+	s.Report(&buf)
+	if strings.Contains(buf.String(), "Panics") {
+		t.Errorf("Report() again; got %q, want the panic reported only once", buf.String())
+	}
+}
+
+// panicStore panics on every update
+type panicStore struct {
+	fullStore
+}
+
+func (p *panicStore) Update(m parser.Metric)         { panic("boom") }
+func (p *panicStore) TryUpdate(m parser.Metric) bool { panic("boom") }
+
+func TestConnectionPanic(t *testing.T) {
+	s := New(&panicStore{})
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "statsd", MaxConns: 1, ReusePort: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+	addr := s.listeners[0].acceptors[0].Addr().String()
+
+	// with a single slot, the second connection is only handled once the
+	// first one's panic released it
+	for i := 1; i <= 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("a.b:1|c\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("connection %d; want it closed after the panic", i)
+		}
+		conn.Close()
+		if got := s.Panics(); got != uint64(i) {
+			t.Errorf("connection %d; got %d panics, want %d", i, got, i)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a client has to send the PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// The 12 byte signature that starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener wraps a listener sitting behind HAProxy (or anything else
+// speaking the PROXY protocol) so the accepted connections report the
+// original client address instead of the proxy's.
+type proxyListener struct {
+	net.Listener
+}
+
+// Accept wraps the connection, the header itself is read lazily on first use
+// so a slow client can't stall the accept loop
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn strips the PROXY protocol header from the stream and overrides
+// the addresses with the ones it carried
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	src    net.Addr
+	dst    net.Addr
+	err    error
+	// the read deadline set by the connection's user, such as the TLS
+	// handshake's, put back once the header is read
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		header := time.Now().Add(proxyHeaderTimeout)
+		if !c.deadline.IsZero() && c.deadline.Before(header) {
+			header = c.deadline
+		}
+		c.Conn.SetReadDeadline(header)
+		c.mu.Unlock()
+		c.src, c.dst, c.err = readProxyHeader(c.reader)
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+		if c.err != nil {
+			c.err = fmt.Errorf("proxy protocol: %v", c.err)
+		}
+	})
+}
+
+// SetDeadline records the read deadline to put back after the header
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline records the deadline to put back after the header
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header when one was sent
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client originally connected to
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Reads a v1 or v2 PROXY protocol header. Nil addresses are returned for
+// LOCAL/UNKNOWN connections (e.g. proxy health checks) which means the real
+// socket addresses should be used.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if sig, err := r.Peek(6); err != nil || string(sig) != "PROXY " {
+		return nil, nil, fmt.Errorf("missing header")
+	}
+	return readProxyV1(r)
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// the spec caps the v1 header at 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("v1 header not terminated")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header")
+	}
+	src, err := proxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func proxyAddr(host, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	command := header[12] & 0xf
+	family := header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections are initiated by the proxy itself
+	if command == 0 {
+		return nil, nil, nil
+	}
+	if command != 1 {
+		return nil, nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	var size int
+	switch family >> 4 {
+	case 1: // AF_INET
+		size = net.IPv4len
+	case 2: // AF_INET6
+		size = net.IPv6len
+	default:
+		// AF_UNIX and AF_UNSPEC carry nothing we can use as an IP
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("v2 address block too short")
+	}
+	srcIP := net.IP(body[:size])
+	dstIP := net.IP(body[size : 2*size])
+	srcPort := int(binary.BigEndian.Uint16(body[2*size:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*size+2:]))
+
+	// anything past the addresses is TLVs which we don't need
+	if family&0xf == 2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+type proxyTestCase struct {
+	input  []byte
+	src    string
+	dst    string
+	hasErr bool
+}
+
+var proxyTestCases = []proxyTestCase{
+	{
+		[]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nasdf"),
+		"192.168.0.1:56324",
+		"192.168.0.11:443",
+		false,
+	},
+	{
+		[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1000 4268\r\nasdf"),
+		"[2001:db8::1]:1000",
+		"[2001:db8::2]:4268",
+		false,
+	},
+	{
+		[]byte("PROXY UNKNOWN\r\nasdf"),
+		"",
+		"",
+		false,
+	},
+	{
+		append(append([]byte{}, proxyV2Signature...),
+			0x21, 0x11, 0x00, 0x0c,
+			10, 0, 0, 1,
+			10, 0, 0, 2,
+			0x1f, 0x90, 0x10, 0xac,
+			'a', 's', 'd', 'f'),
+		"10.0.0.1:8080",
+		"10.0.0.2:4268",
+		false,
+	},
+	{
+		append(append([]byte{}, proxyV2Signature...),
+			0x20, 0x00, 0x00, 0x00,
+			'a', 's', 'd', 'f'),
+		"",
+		"",
+		false,
+	},
+	{
+		[]byte("asdf\t1\t2016-01-01T00:00:00Z\n"),
+		"",
+		"",
+		true,
+	},
+	{
+		[]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n"),
+		"",
+		"",
+		true,
+	},
+}
+
+func TestProxyHeader(t *testing.T) {
+	for _, tc := range proxyTestCases {
+		r := bufio.NewReader(bytes.NewReader(tc.input))
+		src, dst, err := readProxyHeader(r)
+		if (err != nil) != tc.hasErr {
+			t.Errorf("readProxyHeader(%q); got error %v, want error %v", tc.input, err, tc.hasErr)
+			continue
+		}
+		if tc.hasErr {
+			continue
+		}
+		if got := addrString(src); got != tc.src {
+			t.Errorf("readProxyHeader(%q) src; got %v, want %v", tc.input, got, tc.src)
+		}
+		if got := addrString(dst); got != tc.dst {
+			t.Errorf("readProxyHeader(%q) dst; got %v, want %v", tc.input, got, tc.dst)
+		}
+		// the payload after the header must be left untouched
+		if rest, _ := io.ReadAll(r); string(rest) != "asdf" {
+			t.Errorf("readProxyHeader(%q) payload; got %q, want %q", tc.input, rest, "asdf")
+		}
+	}
+}
+
+func addrString(a interface{ String() string }) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestProxyConnKeepsDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &proxyConn{Conn: server, reader: bufio.NewReader(server)}
+	defer conn.Close()
+	// a handshake deadline set before the header is read outlives it
+	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	go client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read() past the deadline; got %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read() past the deadline still blocked")
+	}
+	if got := addrString(conn.RemoteAddr()); got != "192.168.0.1:56324" {
+		t.Errorf("RemoteAddr(); got %v, want 192.168.0.1:56324", got)
+	}
+}
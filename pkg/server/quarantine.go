@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Quarantine tracks producers (by IP address, client certificate CN or the
+// id of their AUTH token) that are under investigation. Their metrics are still accepted from the wire but
+// are written to the capture file instead of being aggregated, so dashboards
+// stay clean without throwing the evidence away.
+type Quarantine struct {
+	mu        sync.RWMutex
+	producers map[string]time.Time
+	capture   *captureFile
+}
+
+func NewQuarantine(capturePath string, keys *Keyring) *Quarantine {
+	return &Quarantine{
+		producers: make(map[string]time.Time),
+		capture:   &captureFile{path: capturePath, keys: keys},
+	}
+}
+
+// Flags the producer, returns false if it was already quarantined
+func (q *Quarantine) add(producer string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.producers[producer]; ok {
+		return false
+	}
+	q.producers[producer] = time.Now().UTC()
+	return true
+}
+
+// Releases the producer, returns false if it wasn't quarantined
+func (q *Quarantine) remove(producer string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.producers[producer]; !ok {
+		return false
+	}
+	delete(q.producers, producer)
+	return true
+}
+
+// Reports whether any of the identities belong to a quarantined producer
+func (q *Quarantine) contains(ids ...string) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if len(q.producers) == 0 {
+		return false
+	}
+	for _, id := range ids {
+		if _, ok := q.producers[id]; ok && id != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the quarantined producers and when they were flagged
+func (q *Quarantine) list() map[string]time.Time {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	list := make(map[string]time.Time, len(q.producers))
+	for p, t := range q.producers {
+		list[p] = t
+	}
+	return list
+}
+
+// Strips the port from a remote address so producers can be flagged by IP
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// captureFile appends quarantined metrics to disk. The file is only created
+// once something is actually captured. When keys is set every line is
+// written as an encrypted record, see Keyring.Seal.
+type captureFile struct {
+	mu   sync.Mutex
+	path string
+	keys *Keyring
+	f    *os.File
+}
+
+// Appends the metric along with who sent it and when it was received
+func (c *captureFile) write(producer string, m parser.Metric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		c.f = f
+	}
+	line := []byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n",
+		time.Now().UTC().Format(parser.ISO8601Format),
+		producer,
+		m.Key(),
+		strconv.FormatFloat(m.Value, 'g', -1, 64),
+		m.Time.Format(parser.ISO8601Format)))
+	if c.keys != nil {
+		line = c.keys.Seal(line)
+	}
+	_, err := c.f.Write(line)
+	return err
+}
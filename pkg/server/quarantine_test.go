@@ -0,0 +1,61 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestQuarantine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.tsv")
+	q := NewQuarantine(path, nil)
+
+	if !q.add("10.0.0.1") || q.add("10.0.0.1") {
+		t.Errorf("add(10.0.0.1); want true then false")
+	}
+	if !q.contains("", "10.0.0.1") {
+		t.Errorf("contains(10.0.0.1); got false, want true")
+	}
+	if q.contains("", "10.0.0.2") {
+		t.Errorf("contains(10.0.0.2); got true, want false")
+	}
+
+	m := parser.Metric{Name: "asdf", Value: 1.5, Time: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := q.capture.write("10.0.0.1", m); err != nil {
+		t.Fatalf("capture.write(); got error %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	if want := "\t10.0.0.1\tasdf\t1.5\t2016-01-01T00:00:00Z\n"; !strings.HasSuffix(string(b), want) {
+		t.Errorf("capture file; got %q, want suffix %q", b, want)
+	}
+
+	if !q.remove("10.0.0.1") || q.contains("10.0.0.1") {
+		t.Errorf("remove(10.0.0.1); producer still quarantined")
+	}
+}
+
+func TestQuarantineToken(t *testing.T) {
+	store := &fullStore{}
+	s := New(store)
+	s.Quarantine = NewQuarantine(filepath.Join(t.TempDir(), "capture.tsv"), nil)
+	token := TokenID("secret")
+	s.Quarantine.add(token)
+
+	// the same host sending under another token is still aggregated
+	for _, tc := range []struct {
+		token   string
+		updates int
+	}{{token, 0}, {TokenID("other"), 1}} {
+		in := &intake{policy: SaturateBlock, dropped: &saturationStats{}, token: tc.token}
+		if err := s.ingest(&parser.Metric{Name: "cpu", Value: 1, Count: 1, Time: time.Now()}, "10.0.0.1", in); err != nil {
+			t.Fatalf("ingest(); got %v", err)
+		}
+		if store.updates != tc.updates {
+			t.Errorf("ingest() with token %s; got %d updates, want %d", tc.token, store.updates, tc.updates)
+		}
+	}
+}
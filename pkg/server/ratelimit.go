@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateAction decides what happens to lines over a rate limit
+type RateAction int
+
+const (
+	// hold off reading until the line is within the rate, slowing the
+	// client down through TCP back pressure (the default)
+	RateThrottle RateAction = iota
+	// discard the line
+	RateDrop
+	// close the connection
+	RateDisconnect
+)
+
+// Parses the textual form of a rate action as used in configuration
+func ParseRateAction(s string) (RateAction, error) {
+	switch s {
+	case "", "throttle":
+		return RateThrottle, nil
+	case "drop":
+		return RateDrop, nil
+	case "disconnect":
+		return RateDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown rate limit action %q, want throttle, drop or disconnect", s)
+}
+
+func (a RateAction) String() string {
+	switch a {
+	case RateDrop:
+		return "drop"
+	case RateDisconnect:
+		return "disconnect"
+	}
+	return "throttle"
+}
+
+// tokenBucket lets through rate events a second, with bursts of up to a
+// second's worth, or one event when the rate is below one a second. The
+// caller serializes access.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	filled time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: max(rate, 1), filled: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.tokens+now.Sub(b.filled).Seconds()*b.rate, max(b.rate, 1))
+	b.filled = now
+}
+
+// Takes a token if one is left at now
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Takes a token whether or not one is left, returning how long to wait until
+// it would have been. Waiters queue up behind each other.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// RateLimit caps the lines a second every listener together ingests
+type RateLimit struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+}
+
+// Returns the limit letting through rate lines a second
+func NewRateLimit(rate float64) *RateLimit {
+	return &RateLimit{bucket: newTokenBucket(rate, time.Now())}
+}
+
+// rateStats count the lines the rate limits held up or turned away
+type rateStats struct {
+	throttled, dropped, disconnected uint64
+}
+
+// limiter holds one connection, or one packet listener, to its own rate and
+// the global one
+type limiter struct {
+	// nil when the connection has no limit of its own
+	conn   *tokenBucket
+	global *RateLimit
+	action RateAction
+	stats  *rateStats
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// Returns the limiter for a connection on the listener, nil if nothing limits
+// it
+func (s *Server) limiter(l *listener) *limiter {
+	if l.rateLimit == 0 && s.RateLimit == nil {
+		return nil
+	}
+	lim := &limiter{global: s.RateLimit, action: l.rateAction, stats: &s.rates, now: time.Now, sleep: time.Sleep}
+	if l.rateLimit > 0 {
+		lim.conn = newTokenBucket(l.rateLimit, lim.now())
+	}
+	return lim
+}
+
+// Charges a line to the limits. When over one, the throttle action waits
+// until the line is within it and returns nil, drop and disconnect return
+// ErrRateExceeded and the caller discards the line or closes the connection.
+func (lim *limiter) allow() error {
+	if lim == nil {
+		return nil
+	}
+	now := lim.now()
+	if lim.action == RateThrottle {
+		var wait time.Duration
+		if lim.conn != nil {
+			wait = lim.conn.reserve(now)
+		}
+		if lim.global != nil {
+			lim.global.mu.Lock()
+			wait = max(wait, lim.global.bucket.reserve(now))
+			lim.global.mu.Unlock()
+		}
+		if wait > 0 {
+			atomic.AddUint64(&lim.stats.throttled, 1)
+			lim.sleep(wait)
+		}
+		return nil
+	}
+
+	ok := lim.conn == nil || lim.conn.take(now)
+	if ok && lim.global != nil {
+		lim.global.mu.Lock()
+		ok = lim.global.bucket.take(now)
+		lim.global.mu.Unlock()
+	}
+	if ok {
+		return nil
+	}
+	if lim.action == RateDisconnect {
+		atomic.AddUint64(&lim.stats.disconnected, 1)
+	} else {
+		atomic.AddUint64(&lim.stats.dropped, 1)
+	}
+	return ErrRateExceeded
+}
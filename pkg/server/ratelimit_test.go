@@ -0,0 +1,67 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	for _, s := range []string{"", "throttle", "drop", "disconnect"} {
+		if _, err := ParseRateAction(s); err != nil {
+			t.Errorf("ParseRateAction(%s); got error %v", s, err)
+		}
+	}
+	if _, err := ParseRateAction("slow"); err == nil {
+		t.Errorf("ParseRateAction(slow); got nil error")
+	}
+
+	now := time.Now()
+	var slept time.Duration
+	var stats rateStats
+	newLimiter := func(conn, global float64, action RateAction) *limiter {
+		lim := &limiter{action: action, stats: &stats, now: func() time.Time { return now }, sleep: func(d time.Duration) { slept += d }}
+		if conn > 0 {
+			lim.conn = newTokenBucket(conn, now)
+		}
+		if global > 0 {
+			lim.global = &RateLimit{bucket: newTokenBucket(global, now)}
+		}
+		return lim
+	}
+
+	// a burst of a second's worth goes straight through, the next line waits
+	// its turn
+	throttle := newLimiter(2, 0, RateThrottle)
+	for i := 0; i < 4; i++ {
+		if err := throttle.allow(); err != nil {
+			t.Fatalf("allow() throttled; got error %v", err)
+		}
+	}
+	if slept != 1500*time.Millisecond || stats.throttled != 2 {
+		t.Errorf("allow() throttled; got %v slept over %d lines, want 1.5s over 2", slept, stats.throttled)
+	}
+
+	// the global limit applies on top of the connection's
+	drop := newLimiter(10, 1, RateDrop)
+	if err := drop.allow(); err != nil {
+		t.Errorf("allow() first line; got error %v", err)
+	}
+	if err := drop.allow(); err != ErrRateExceeded || stats.dropped != 1 {
+		t.Errorf("allow() over the global limit; got %v with %d dropped, want ErrRateExceeded", err, stats.dropped)
+	}
+	now = now.Add(time.Second)
+	if err := drop.allow(); err != nil {
+		t.Errorf("allow() a second later; got error %v", err)
+	}
+
+	disconnect := newLimiter(1, 0, RateDisconnect)
+	disconnect.allow()
+	if err := disconnect.allow(); err != ErrRateExceeded || stats.disconnected != 1 {
+		t.Errorf("allow() over the connection's limit; got %v with %d disconnected, want ErrRateExceeded", err, stats.disconnected)
+	}
+
+	var none *limiter
+	if err := none.allow(); err != nil {
+		t.Errorf("allow() without limits; got error %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// ReadyShedWindow is how long after a saturation policy last shed a line
+// the server still reports itself not ready
+var ReadyShedWindow = 10 * time.Second
+
+// the share of the ingress queues that may fill up before the server
+// reports itself not ready
+const readyBacklog = 0.9
+
+// Ready returns whether the server is accepting connections and its ingress
+// keeps up, and why not when it isn't: it isn't serving yet or was closed,
+// the queues ahead of the store are nearly full, or a saturation policy
+// shed lines within ReadyShedWindow.
+func (s *Server) Ready() (bool, string) {
+	if !s.serving.Load() {
+		return false, "not accepting connections"
+	}
+	if b, ok := s.Store.(store.Backlogger); ok {
+		if queued, capacity := b.Backlog(); capacity > 0 && float64(queued) >= readyBacklog*float64(capacity) {
+			return false, fmt.Sprintf("ingress saturated, %d of %d queued", queued, capacity)
+		}
+	}
+	if last := atomic.LoadInt64(&s.saturation.lastShed); last > 0 && time.Since(time.Unix(0, last)) < ReadyShedWindow {
+		return false, "saturated, lines shed within " + ReadyShedWindow.String()
+	}
+	return true, ""
+}
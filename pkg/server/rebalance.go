@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// Rebalancing hints let connections be moved without hard drops. A client
+// sending HINTS during the handshake promises to read "RECONNECT [addr]\n"
+// from the connection and, once it has, to finish the line it is writing,
+// close the connection and connect again: to addr when given, otherwise to
+// wherever it connected to before, such as a load balancer now favouring
+// another node. Clients that didn't send HINTS are never hinted.
+
+// Marks the connection as taking rebalancing hints
+func (t *connTracker) hintable(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hints == nil {
+		t.hints = make(map[net.Conn]struct{})
+	}
+	t.hints[conn] = struct{}{}
+}
+
+// Asks the given fraction of the connections taking hints, at least one if
+// there are any, to reconnect to addr. Each is hinted only once. Returns how
+// many were asked.
+func (t *connTracker) rebalance(fraction float64, addr string) int {
+	t.mu.Lock()
+	n := int(math.Ceil(fraction * float64(len(t.hints))))
+	var conns []net.Conn
+	for conn := range t.hints {
+		if len(conns) == n {
+			break
+		}
+		conns = append(conns, conn)
+		delete(t.hints, conn)
+	}
+	t.mu.Unlock()
+
+	hint := "RECONNECT\n"
+	if addr != "" {
+		hint = fmt.Sprintf("RECONNECT %s\n", addr)
+	}
+	for _, conn := range conns {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(hint))
+		conn.SetWriteDeadline(time.Time{})
+	}
+	return len(conns)
+}
+
+// Rebalance asks the given fraction, between 0 and 1, of the connections
+// taking hints to reconnect, to addr if it isn't empty. Returns how many
+// were asked.
+func (s *Server) Rebalance(fraction float64, addr string) int {
+	return s.inflight.rebalance(fraction, addr)
+}
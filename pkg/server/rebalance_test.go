@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestRebalance(t *testing.T) {
+	var tracker connTracker
+	var clients []*bufio.Reader
+	for i := 0; i < 4; i++ {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+		tracker.add(server)
+		defer tracker.done(server)
+		// only the first three take hints
+		if i < 3 {
+			tracker.hintable(server)
+		}
+		clients = append(clients, bufio.NewReader(client))
+	}
+
+	hints := make(chan string, 4)
+	for _, r := range clients {
+		go func(r *bufio.Reader) {
+			if line, err := r.ReadString('\n'); err == nil {
+				hints <- line
+			}
+		}(r)
+	}
+
+	if n := tracker.rebalance(0.5, "10.0.0.2:4268"); n != 2 {
+		t.Errorf("rebalance(0.5); got %d hinted, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-hints; got != "RECONNECT 10.0.0.2:4268\n" {
+			t.Errorf("hint; got %q", got)
+		}
+	}
+	// those already hinted aren't asked twice
+	if n := tracker.rebalance(1, ""); n != 1 {
+		t.Errorf("rebalance(1); got %d hinted, want 1", n)
+	}
+	if got := <-hints; got != "RECONNECT\n" {
+		t.Errorf("hint; got %q", got)
+	}
+	if n := tracker.rebalance(1, ""); n != 0 {
+		t.Errorf("rebalance(1) again; got %d hinted, want 0", n)
+	}
+}
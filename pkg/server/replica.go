@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// The replication protocol, lines over TCP. The primary opens with
+//
+//	REPLICATE <epoch> [token]
+//
+// the epoch naming the run of the primary its numbers count from. The
+// standby answers FROM <n>, the number of the first metric it doesn't have,
+// or PROMOTED once it has taken over. The primary then sends the metrics as
+// <n>\t<JSON line of parser.ParsePeer>, GAP <n> when the metrics before n
+// are no longer held, and PING every second it has nothing to send.
+
+// how long a replication connection may go without a line, or a write take,
+// before it is given up
+const replicaTimeout = 10 * time.Second
+
+// ErrPromoted is returned by the replication to a standby that has taken
+// over from this collector
+var ErrPromoted = errors.New("the standby has taken over")
+
+// Replicator streams every metric the collector accepts to a standby
+// collector, see Standby, so the standby holds the same windows and can take
+// over without losing them. The metrics are numbered and the last backlog
+// of them held: a standby reconnecting is sent the ones after the last it
+// got, one further behind than the backlog is told how many it lost.
+type Replicator struct {
+	addr, token string
+	epoch       string
+	dial        func() (net.Conn, error)
+
+	mu sync.Mutex
+	// the lines of the metrics held, the one numbered n at n%len(lines)
+	lines [][]byte
+	// the number of the next metric, and of the next one sent
+	next, sent uint64
+	notify     chan struct{}
+
+	relayed, lost atomic.Uint64
+	connected     atomic.Bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Returns a Replicator streaming to the standby at addr, holding backlog
+// metrics for it to catch up from, and starts connecting to it
+func NewReplicator(addr string, backlog int, token string) *Replicator {
+	epoch := make([]byte, 8)
+	rand.Read(epoch)
+	r := &Replicator{addr: addr, token: token, epoch: hex.EncodeToString(epoch),
+		lines: make([][]byte, max(backlog, 1)), next: 1, sent: 1,
+		notify: make(chan struct{}, 1), done: make(chan struct{})}
+	r.dial = func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, replicaTimeout)
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// Relay numbers the metric just accepted and queues it for the standby
+func (r *Replicator) Relay(m parser.Metric) {
+	line, err := parser.AppendPeer(nil, m)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.lines[r.next%uint64(len(r.lines))] = line
+	r.next++
+	r.mu.Unlock()
+	r.relayed.Add(1)
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the lines of the metrics from the number from on, up to limit of
+// them, and the first number still held when from no longer is
+func (r *Replicator) since(from uint64, limit int) (lines [][]byte, oldest uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	oldest = min(from, r.next)
+	if held := uint64(len(r.lines)); r.next > held && from < r.next-held {
+		oldest = r.next - held
+	}
+	for n := oldest; n < r.next && len(lines) < limit; n++ {
+		lines = append(lines, r.lines[n%uint64(len(r.lines))])
+	}
+	r.sent = oldest + uint64(len(lines))
+	return lines, oldest
+}
+
+// Connects to the standby again and again, waiting longer after every
+// failure in a row, until closed
+func (r *Replicator) run() {
+	defer r.wg.Done()
+	wait := 100 * time.Millisecond
+	for {
+		err := r.stream()
+		if r.connected.Swap(false) {
+			wait = 100 * time.Millisecond
+		}
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		if errors.Is(err, ErrPromoted) {
+			slog.Error("Replication: the standby has taken over, stopped replicating to it", "addr", r.addr)
+			return
+		}
+		slog.Warn("Replication: lost the standby", "addr", r.addr, "err", err, "retry", wait)
+		select {
+		case <-r.done:
+			return
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, 10*time.Second)
+	}
+}
+
+// Streams the metrics to the standby over one connection, from the first
+// one it doesn't have. Once closed what is held is still sent.
+func (r *Replicator) stream() error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replicaTimeout))
+	if _, err := fmt.Fprintf(conn, "REPLICATE %s %s\n", r.epoch, r.token); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var from uint64
+	switch reply = strings.TrimSpace(reply); {
+	case reply == "PROMOTED":
+		return ErrPromoted
+	case strings.HasPrefix(reply, "FROM "):
+		if from, err = strconv.ParseUint(reply[5:], 10, 64); err != nil {
+			return fmt.Errorf("bad reply %q", reply)
+		}
+	default:
+		return fmt.Errorf("bad reply %q", reply)
+	}
+	r.connected.Store(true)
+	slog.Info("Replication: streaming to the standby", "addr", r.addr, "from", from)
+
+	w := bufio.NewWriter(conn)
+	ping := time.NewTicker(time.Second)
+	defer ping.Stop()
+	closing := false
+	for {
+		lines, oldest := r.since(from, 1000)
+		if oldest > from {
+			fmt.Fprintf(w, "GAP %d\n", oldest)
+			r.lost.Add(oldest - from)
+		}
+		for i, line := range lines {
+			// a set's members are a line each under its number
+			for _, l := range strings.Split(strings.TrimSuffix(string(line), "\n"), "\n") {
+				w.WriteString(strconv.FormatUint(oldest+uint64(i), 10))
+				w.WriteByte('\t')
+				w.WriteString(l)
+				w.WriteByte('\n')
+			}
+		}
+		from = oldest + uint64(len(lines))
+		if len(lines) == 0 {
+			if closing {
+				return w.Flush()
+			}
+			select {
+			case <-r.notify:
+			case <-ping.C:
+				w.WriteString("PING\n")
+			case <-r.done:
+				closing = true
+			}
+		}
+		conn.SetDeadline(time.Now().Add(replicaTimeout))
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// Report writes what was streamed to the standby since the last report
+func (r *Replicator) Report(w io.Writer) {
+	if r == nil {
+		return
+	}
+	relayed, lost := r.relayed.Swap(0), r.lost.Swap(0)
+	r.mu.Lock()
+	behind := r.next - r.sent
+	r.mu.Unlock()
+	state := "connected"
+	if !r.connected.Load() {
+		state = "not connected"
+	}
+	if relayed > 0 || lost > 0 || behind > 0 {
+		fmt.Fprintf(w, "(10 sec): Replicated %d metrics to the standby %s (%s), behind %d, lost %d\n", relayed, r.addr, state, behind, lost)
+	}
+}
+
+// Close sends the standby what it hasn't got while it is connected, then
+// stops
+func (r *Replicator) Close() error {
+	if r == nil {
+		return nil
+	}
+	close(r.done)
+	r.wg.Wait()
+	return nil
+}
+
+// Standby is the other end of a Replicator: a collector aggregating the
+// metrics a primary streams to it into its own windows without reporting
+// them, see Active, until the primary has been silent for the takeover and
+// it takes over. Once it has, the primary is turned away.
+type Standby struct {
+	takeover time.Duration
+	token    string
+	deliver  func(m parser.Metric)
+	now      func() time.Time
+
+	// the primary's epoch, the number of the next metric expected from it
+	// and when it was last heard from
+	mu    sync.Mutex
+	epoch string
+	next  uint64
+	heard time.Time
+
+	promoted       atomic.Bool
+	received, lost atomic.Uint64
+	listener       net.Listener
+	done           chan struct{}
+}
+
+// Returns a Standby handing the primary's metrics to deliver, taking over
+// once the primary has been silent for takeover. A primary must present
+// the token when it isn't empty.
+func NewStandby(takeover time.Duration, token string, deliver func(m parser.Metric)) *Standby {
+	return &Standby{takeover: takeover, token: token, deliver: deliver, now: time.Now, done: make(chan struct{})}
+}
+
+// Listen accepts the primary's connections on the TCP address and starts
+// waiting for it to go silent
+func (s *Standby) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	s.heard = s.now()
+	go s.accept()
+	go s.watch()
+	return nil
+}
+
+func (s *Standby) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// Takes over once the primary has been silent for the takeover
+func (s *Standby) watch() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+		}
+		s.mu.Lock()
+		silent := s.now().Sub(s.heard)
+		s.mu.Unlock()
+		if silent >= s.takeover {
+			s.Promote()
+			return
+		}
+	}
+}
+
+// Serves a connection of the primary
+func (s *Standby) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(replicaTimeout))
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(nil, 1<<20)
+	if !lines.Scan() {
+		return
+	}
+	fields := strings.Fields(lines.Text())
+	if len(fields) < 2 || fields[0] != "REPLICATE" || (s.token != "" && (len(fields) < 3 || fields[2] != s.token)) {
+		slog.Warn("Replication: turned away a connection that isn't the primary's", "remote", conn.RemoteAddr().String())
+		return
+	}
+	if s.promoted.Load() {
+		fmt.Fprintf(conn, "PROMOTED\n")
+		return
+	}
+	s.mu.Lock()
+	if fields[1] != s.epoch {
+		// a primary run afresh numbers from 1
+		s.epoch, s.next = fields[1], 1
+	}
+	from := s.next
+	s.heard = s.now()
+	s.mu.Unlock()
+	if _, err := fmt.Fprintf(conn, "FROM %d\n", from); err != nil {
+		return
+	}
+	slog.Info("Replication: the primary is streaming", "remote", conn.RemoteAddr().String(), "from", from)
+	for lines.Scan() {
+		conn.SetDeadline(time.Now().Add(replicaTimeout))
+		if s.promoted.Load() {
+			return
+		}
+		s.apply(fields[1], lines.Text())
+	}
+}
+
+// Applies a line of the primary of the epoch
+func (s *Standby) apply(epoch, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heard = s.now()
+	if epoch != s.epoch {
+		return
+	}
+	if n, ok := strings.CutPrefix(line, "GAP "); ok {
+		if gap, err := strconv.ParseUint(n, 10, 64); err == nil && gap > s.next {
+			slog.Warn("Replication: the primary no longer held metrics the standby missed", "lost", gap-s.next)
+			s.lost.Add(gap - s.next)
+			s.next = gap
+		}
+		return
+	}
+	num, text, ok := strings.Cut(line, "\t")
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	// the members of a set share their number
+	if err != nil || n+1 < s.next {
+		return
+	}
+	m, err := parser.ParsePeer(text)
+	if err != nil {
+		return
+	}
+	s.next = n + 1
+	s.received.Add(1)
+	s.deliver(*m)
+}
+
+// Active reports whether the collector is still a standby, its windows
+// being the primary's to report. A nil Standby isn't.
+func (s *Standby) Active() bool {
+	return s != nil && !s.promoted.Load()
+}
+
+// Promote takes over from the primary, the windows are reported from now
+// on
+func (s *Standby) Promote() {
+	if s.promoted.CompareAndSwap(false, true) {
+		slog.Warn("Replication: the primary has gone silent, taking over", "after", s.takeover)
+	}
+}
+
+// Report writes what the primary streamed since the last report
+func (s *Standby) Report(w io.Writer) {
+	if s == nil {
+		return
+	}
+	received, lost := s.received.Swap(0), s.lost.Swap(0)
+	if received > 0 || lost > 0 {
+		fmt.Fprintf(w, "(10 sec): Standby received %d metrics from the primary, lost %d\n", received, lost)
+	}
+}
+
+// Close stops listening to the primary
+func (s *Standby) Close() error {
+	if s == nil || s.listener == nil {
+		return nil
+	}
+	close(s.done)
+	return s.listener.Close()
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// standbyNames records the names a standby delivered
+type standbyNames struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *standbyNames) deliver(m parser.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = append(s.names, m.Name)
+}
+
+func (s *standbyNames) get() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.names...)
+}
+
+func TestReplicate(t *testing.T) {
+	got := &standbyNames{}
+	standby := NewStandby(time.Minute, "secret", got.deliver)
+	if err := standby.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+
+	r := NewReplicator(standby.listener.Addr().String(), 100, "secret")
+	for _, name := range []string{"a", "b", "c"} {
+		r.Relay(parser.Metric{Name: name, Type: parser.Counter, Value: 1, Time: time.Now()})
+	}
+	// closing sends what the standby hasn't got
+	r.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got.get()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if names := got.get(); strings.Join(names, ",") != "a,b,c" {
+		t.Errorf("standby got %v, want [a b c]", names)
+	}
+	if !standby.Active() {
+		t.Error("standby took over while the primary streamed")
+	}
+}
+
+func TestReplicatorBacklog(t *testing.T) {
+	r := NewReplicator("127.0.0.1:1", 2, "")
+	defer r.Close()
+	for i := 1; i <= 5; i++ {
+		r.Relay(parser.Metric{Name: fmt.Sprintf("m%d", i), Type: parser.Gauge, Value: float64(i), Time: time.Now()})
+	}
+	lines, oldest := r.since(1, 10)
+	if oldest != 4 || len(lines) != 2 || !strings.Contains(string(lines[0]), `"m4"`) {
+		t.Errorf("since(1); got %d lines from %d, want m4 and m5 from 4", len(lines), oldest)
+	}
+	if lines, oldest := r.since(6, 10); oldest != 6 || len(lines) != 0 {
+		t.Errorf("since(6); got %d lines from %d, want none", len(lines), oldest)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	got := &standbyNames{}
+	standby := NewStandby(time.Minute, "", got.deliver)
+	if err := standby.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+
+	// connects as the primary, returning the standby's reply
+	connect := func(epoch string) (net.Conn, string) {
+		conn, err := net.Dial("tcp", standby.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "REPLICATE %s\n", epoch)
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn, strings.TrimSpace(reply)
+	}
+	line := func(n int, name string) string {
+		b, _ := parser.AppendPeer(nil, parser.Metric{Name: name, Type: parser.Counter, Value: 1, Time: time.Now()})
+		return fmt.Sprintf("%d\t%s", n, b)
+	}
+
+	conn, reply := connect("e1")
+	if reply != "FROM 1" {
+		t.Fatalf("first connection; got %q, want FROM 1", reply)
+	}
+	fmt.Fprintf(conn, "%s%s\nGAP 4\n%s", line(1, "a"), line(2, "b"), line(4, "d"))
+	conn.Close()
+
+	// reconnecting carries on after the last metric received
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got.get()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, reply = connect("e1")
+	conn.Close()
+	if reply != "FROM 5" {
+		t.Errorf("reconnection; got %q, want FROM 5", reply)
+	}
+	if names := got.get(); strings.Join(names, ",") != "a,b,d" {
+		t.Errorf("standby got %v, want [a b d]", names)
+	}
+	if lost := standby.lost.Load(); lost != 1 {
+		t.Errorf("lost; got %d, want 1", lost)
+	}
+
+	// a primary run afresh starts over
+	conn, reply = connect("e2")
+	conn.Close()
+	if reply != "FROM 1" {
+		t.Errorf("new epoch; got %q, want FROM 1", reply)
+	}
+
+	standby.Promote()
+	if standby.Active() {
+		t.Error("promoted standby still active")
+	}
+	conn, reply = connect("e2")
+	conn.Close()
+	if reply != "PROMOTED" {
+		t.Errorf("after promotion; got %q, want PROMOTED", reply)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// replier implements the REPLY mode, telling the client what became of its
+// lines. Per line the server writes "OK\n" or "ERR <reason>\n", the reason
+// being STALE, BUSY, QUOTA, RESERVED or INVALID followed by what is wrong with the line. Per
+// batch it answers once the client stops sending, "OK <n>\n" when all n
+// lines since the last answer were accepted, otherwise "ERR <rejected>/<n>
+// <reason>\n" with the reason of the first line rejected. A line that
+// doesn't parse is answered rather than dropping the connection.
+type replier struct {
+	conn  net.Conn
+	batch bool
+	// lines since the last answer in batch mode, how many were rejected and
+	// why the first of them was
+	lines, rejected int
+	reason          string
+}
+
+// Handles the REPLY command, returning the replier for the connection
+func newReplier(conn net.Conn, args []string) (*replier, error) {
+	switch {
+	case len(args) == 0, len(args) == 1 && args[0] == "LINE":
+		return &replier{conn: conn}, nil
+	case len(args) == 1 && args[0] == "BATCH":
+		return &replier{conn: conn, batch: true}, nil
+	}
+	return nil, fmt.Errorf("invalid command: REPLY takes LINE or BATCH")
+}
+
+// Returns the reason given for a line rejected with err
+func replyReason(err error) string {
+	switch {
+	case errors.Is(err, ErrStaleTimestamp):
+		return "STALE"
+	case errors.Is(err, ErrBusy):
+		return "BUSY"
+	case errors.Is(err, ErrOverQuota):
+		return "QUOTA"
+	case errors.Is(err, ErrReservedName):
+		return "RESERVED"
+	}
+	// keep the answer on one line
+	return "INVALID " + strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// Records what became of the next line, err is nil if it was accepted.
+// idle reports that no more input is buffered, which ends a batch.
+func (r *replier) result(err error, idle bool) error {
+	if !r.batch {
+		if err != nil {
+			return r.write("ERR " + replyReason(err) + "\n")
+		}
+		return r.write("OK\n")
+	}
+
+	r.lines++
+	if err != nil {
+		if r.rejected == 0 {
+			r.reason = replyReason(err)
+		}
+		r.rejected++
+	}
+	if !idle {
+		return nil
+	}
+	answer := fmt.Sprintf("OK %d\n", r.lines)
+	if r.rejected > 0 {
+		answer = fmt.Sprintf("ERR %d/%d %s\n", r.rejected, r.lines, r.reason)
+	}
+	r.lines, r.rejected = 0, 0
+	return r.write(answer)
+}
+
+func (r *replier) write(answer string) error {
+	r.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	defer r.conn.SetWriteDeadline(time.Time{})
+	_, err := r.conn.Write([]byte(answer))
+	return err
+}
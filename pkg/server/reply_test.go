@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestReplier(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	for _, args := range [][]string{{"line"}, {"LINE", "BATCH"}} {
+		if _, err := newReplier(server, args); err == nil {
+			t.Errorf("newReplier(%q); got nil error", args)
+		}
+	}
+	line, err := newReplier(server, nil)
+	if err != nil {
+		t.Fatalf("newReplier(); got error %v", err)
+	}
+	batch, err := newReplier(server, []string{"BATCH"})
+	if err != nil {
+		t.Fatalf("newReplier(BATCH); got error %v", err)
+	}
+
+	answers := make(chan string, 7)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(answers)
+				return
+			}
+			answers <- line
+		}
+	}()
+
+	invalid := fmt.Errorf("%w: %q\nis not a number", parser.ErrInvalidValue, "x")
+	for _, rejected := range []error{nil, ErrStaleTimestamp, ErrTooManyConnections, ErrTooManySeries, invalid} {
+		if err := line.result(rejected, false); err != nil {
+			t.Fatalf("result(%v); got error %v", rejected, err)
+		}
+	}
+	// a batch is answered once the client stops sending
+	for i, rejected := range []error{nil, nil, nil, ErrBusy, ErrStaleTimestamp} {
+		if err := batch.result(rejected, i == 2 || i == 4); err != nil {
+			t.Fatalf("result(%d); got error %v", i, err)
+		}
+	}
+	for _, want := range []string{
+		"OK\n",
+		"ERR STALE\n",
+		"ERR BUSY\n",
+		"ERR QUOTA\n",
+		"ERR INVALID invalid input: value: \"x\" is not a number\n",
+		"OK 3\n",
+		"ERR 2/2 BUSY\n",
+	} {
+		if got := <-answers; got != want {
+			t.Errorf("answer; got %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// OutputFormat is how the flush report writes its rows
+type OutputFormat int
+
+const (
+	// tab separated columns (the default)
+	OutputText OutputFormat = iota
+	// a JSON object per line, see ReportRow
+	OutputJSON
+	// comma separated values under a header, see ReportRow.Record
+	OutputCSV
+	// a user's text/template, see NewReportTemplate
+	OutputTemplate
+)
+
+// Parses the -output-format flag
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch s {
+	case "", "text":
+		return OutputText, nil
+	case "json":
+		return OutputJSON, nil
+	case "csv":
+		return OutputCSV, nil
+	}
+	return 0, fmt.Errorf("unknown output format %q, want text, json or csv", s)
+}
+
+func (f OutputFormat) String() string {
+	switch f {
+	case OutputJSON:
+		return "json"
+	case OutputCSV:
+		return "csv"
+	case OutputTemplate:
+		return "template"
+	}
+	return "text"
+}
+
+// Parses the -csv-delimiter flag, a single character other than a quote or
+// a line break
+func ParseCSVDelimiter(s string) (rune, error) {
+	if s == `\t` || s == "tab" {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("csv delimiter must be a single character other than a quote or a line break, got %q", s)
+	}
+	return r, nil
+}
+
+// ReportRow is a metric's line of the report with -output-format=json or
+// csv. Each row carries the window it covers, so the #flush, #window,
+// #partial and #correction lines of the text report are left out; the
+// trailers, like #producers and the signature, still start with '#'.
+type ReportRow struct {
+	Metric parser.Metric
+	// the window's label, only set when there are several windows
+	Window     string
+	Start, End time.Time
+	// the flush's number and time, see sink.Window
+	Seq        uint64
+	Flushed    time.Time
+	Partial    []string
+	Correction bool
+	// the -percentiles reported of the metric's digest
+	Percentiles []float64
+	// the moving averages of the -ewma periods, in order
+	EWMA []float64
+	// the metric's producer count, -1 when not counted
+	Producers int
+	// how many standard deviations the value strayed from its baseline,
+	// 0 unless flagged by -anomaly-threshold
+	Anomaly float64
+}
+
+type jsonRow struct {
+	Name        string                `json:"name"`
+	Tags        map[string]string     `json:"tags,omitempty"`
+	Window      string                `json:"window,omitempty"`
+	Seq         uint64                `json:"seq"`
+	Start       time.Time             `json:"start"`
+	End         time.Time             `json:"end"`
+	Flushed     time.Time             `json:"flushed"`
+	Partial     []string              `json:"partial,omitempty"`
+	Correction  bool                  `json:"correction,omitempty"`
+	Value       jsonNumber            `json:"value"`
+	Mean        jsonNumber            `json:"mean"`
+	Min         jsonNumber            `json:"min"`
+	Max         jsonNumber            `json:"max"`
+	Sum         jsonNumber            `json:"sum"`
+	Count       int                   `json:"count"`
+	Stddev      jsonNumber            `json:"stddev"`
+	Percentiles map[string]jsonNumber `json:"percentiles,omitempty"`
+	EWMA        []jsonNumber          `json:"ewma,omitempty"`
+	Producers   *int                  `json:"producers,omitempty"`
+	Anomaly     jsonNumber            `json:"anomaly,omitempty"`
+}
+
+// MarshalJSON writes the value the metric's type leads with as value, like
+// the text report's first column. Integer sums and means are exact, values
+// JSON can't hold, like the percentiles of a metric without a digest, are
+// null.
+func (r ReportRow) MarshalJSON() ([]byte, error) {
+	m := r.Metric
+	row := jsonRow{
+		Name: m.Name, Window: r.Window, Seq: r.Seq, Start: r.Start.UTC(), End: r.End.UTC(), Flushed: r.Flushed.UTC(),
+		Partial: r.Partial, Correction: r.Correction,
+		Min: floatNumber(m.Min), Max: floatNumber(m.Max), Count: m.Count,
+		Stddev: floatNumber(m.Stddev()),
+	}
+	if m.Tags != "" {
+		row.Tags = make(map[string]string)
+		for _, kv := range strings.Split(m.Tags, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			row.Tags[k] = v
+		}
+	}
+	if m.Integer {
+		row.Sum = jsonNumber(strconv.FormatInt(m.IntValue, 10))
+	} else {
+		row.Sum = floatNumber(m.Value)
+	}
+	if m.Integer && m.Count > 0 && m.IntValue%int64(m.Count) == 0 {
+		row.Mean = jsonNumber(strconv.FormatInt(m.IntValue/int64(m.Count), 10))
+	} else {
+		row.Mean = floatNumber(m.Mean)
+	}
+	switch m.Type {
+	case parser.Counter:
+		row.Value = row.Sum
+	case parser.Gauge:
+		row.Value = floatNumber(m.Last)
+	case parser.Set:
+		row.Value = jsonNumber(strconv.Itoa(m.Cardinality()))
+	default:
+		row.Value = row.Mean
+	}
+	if len(r.Percentiles) > 0 {
+		row.Percentiles = make(map[string]jsonNumber, len(r.Percentiles))
+		for _, p := range r.Percentiles {
+			row.Percentiles["p"+strconv.FormatFloat(p, 'f', -1, 64)] = floatNumber(m.Quantile(p / 100))
+		}
+	}
+	for _, v := range r.EWMA {
+		row.EWMA = append(row.EWMA, floatNumber(v))
+	}
+	if r.Producers >= 0 {
+		row.Producers = &r.Producers
+	}
+	if r.Anomaly != 0 {
+		row.Anomaly = floatNumber(r.Anomaly)
+	}
+	return json.Marshal(row)
+}
+
+// Returns the columns of the CSV report, the percentile and EWMA ones
+// following the -percentiles and -ewma flags, producers only when counted
+// per metric and anomaly only with -anomaly-threshold
+func CSVHeader(percentiles []float64, ewma []time.Duration, producers bool) []string {
+	header := []string{"name", "tags", "window", "seq", "start", "end", "flushed", "partial", "correction",
+		"value", "min", "max", "sum", "count", "stddev"}
+	for _, p := range percentiles {
+		header = append(header, "p"+strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	for _, d := range ewma {
+		header = append(header, "ewma_"+d.String())
+	}
+	if producers {
+		header = append(header, "producers")
+	}
+	if store.AnomalyThreshold > 0 {
+		header = append(header, "anomaly")
+	}
+	return header
+}
+
+// Record returns the row's CSV record in the order of CSVHeader, with
+// values written in the format. The EWMA columns are left empty for rows
+// without averages, like corrections.
+func (r ReportRow) Record(f ValueFormat, ewma int) []string {
+	m := r.Metric
+	record := []string{m.Name, m.Tags, r.Window, strconv.FormatUint(r.Seq, 10),
+		r.Start.UTC().Format(time.RFC3339Nano), r.End.UTC().Format(time.RFC3339Nano), r.Flushed.UTC().Format(time.RFC3339Nano),
+		strings.Join(r.Partial, ","), strconv.FormatBool(r.Correction),
+		f.Value(m), f.Format(m.Min), f.Format(m.Max), f.Sum(m), strconv.Itoa(m.Count), f.Format(m.Stddev())}
+	for _, p := range r.Percentiles {
+		record = append(record, f.Format(m.Quantile(p/100)))
+	}
+	for i := 0; i < ewma; i++ {
+		if i < len(r.EWMA) {
+			record = append(record, f.Format(r.EWMA[i]))
+		} else {
+			record = append(record, "")
+		}
+	}
+	if r.Producers >= 0 {
+		record = append(record, strconv.Itoa(r.Producers))
+	}
+	if store.AnomalyThreshold > 0 {
+		record = append(record, anomalyColumn(f, r.Anomaly))
+	}
+	return record
+}
+
+// Returns the anomaly column of a row, empty unless it was flagged
+func anomalyColumn(f ValueFormat, score float64) string {
+	if score == 0 {
+		return ""
+	}
+	return f.Format(score)
+}
+
+// NewReportTemplate parses the text/template a row of the report is written
+// with, executed on a ReportRow. The metric is reached through the row's
+// methods, like {{.Key}} {{.Mean}} {{.Count}} {{.Start.Unix}}, and the
+// format function writes a value the way -float-format does. A line break
+// follows each row unless the template ends with one.
+func NewReportTemplate(text string, f ValueFormat) (*template.Template, error) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return template.New("report").Funcs(template.FuncMap{"format": f.Format}).Parse(text)
+}
+
+func (r ReportRow) Name() string { return r.Metric.Name }
+
+func (r ReportRow) Tags() string { return r.Metric.Tags }
+
+// Key is the name followed by any tags in braces, the text report's first
+// column
+func (r ReportRow) Key() string { return r.Metric.Key() }
+
+// Value is the value the metric's type leads with, see ValueFormat.Value
+func (r ReportRow) Value() float64 {
+	switch r.Metric.Type {
+	case parser.Counter:
+		return r.Metric.Value
+	case parser.Gauge:
+		return r.Metric.Last
+	case parser.Set:
+		return float64(r.Metric.Cardinality())
+	}
+	return r.Metric.Mean
+}
+
+func (r ReportRow) Mean() float64   { return r.Metric.Mean }
+func (r ReportRow) Min() float64    { return r.Metric.Min }
+func (r ReportRow) Max() float64    { return r.Metric.Max }
+func (r ReportRow) Sum() float64    { return r.Metric.Value }
+func (r ReportRow) Count() int      { return r.Metric.Count }
+func (r ReportRow) Stddev() float64 { return r.Metric.Stddev() }
+
+// Percentile estimates the p percentile, NaN without a digest
+func (r ReportRow) Percentile(p float64) float64 { return r.Metric.Quantile(p / 100) }
+
+// jsonNumber is a number literal written as is, or null
+type jsonNumber string
+
+func (n jsonNumber) MarshalJSON() ([]byte, error) { return []byte(n), nil }
+
+// Returns the shortest literal that round trips, null for NaN and the
+// infinities
+func floatNumber(v float64) jsonNumber {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "null"
+	}
+	return jsonNumber(strconv.FormatFloat(v, 'g', -1, 64))
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestReportRow(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)
+	row := ReportRow{
+		Metric: parser.Metric{Name: "requests", Tags: "host=a,dc=x", Type: parser.Counter, Integer: true,
+			IntValue: 9007199254740993, Value: 9007199254740993, Count: 3, Min: 1, Max: 2},
+		Start: start, End: start.Add(time.Minute), Seq: 7, Flushed: start.Add(time.Minute), Partial: []string{"startup"}, Producers: -1,
+		Percentiles: []float64{99.9},
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"requests","tags":{"dc":"x","host":"a"},"seq":7,"start":"2024-01-02T15:04:00Z","end":"2024-01-02T15:05:00Z",` +
+		`"flushed":"2024-01-02T15:05:00Z",` +
+		`"partial":["startup"],"value":9007199254740993,"mean":3002399751580331,"min":1,"max":2,"sum":9007199254740993,` +
+		`"count":3,"stddev":0,"percentiles":{"p99.9":null}}`
+	if string(b) != want {
+		t.Errorf("json.Marshal(row);\n got %s\nwant %s", b, want)
+	}
+
+	row = ReportRow{Metric: parser.Metric{Name: "level", Type: parser.Gauge, Last: 4, Mean: 2.5, Count: 2},
+		Window: "1m", Correction: true, EWMA: []float64{1.5}, Producers: 2}
+	var got map[string]any
+	b, _ = json.Marshal(row)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s); got error %v", b, err)
+	}
+	if got["value"] != 4.0 || got["mean"] != 2.5 || got["window"] != "1m" || got["correction"] != true || got["producers"] != 2.0 {
+		t.Errorf("gauge row %s", b)
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	if f, err := ParseOutputFormat("json"); err != nil || f != OutputJSON {
+		t.Errorf("ParseOutputFormat(json); got %v, %v", f, err)
+	}
+	if _, err := ParseOutputFormat("xml"); err == nil {
+		t.Errorf("ParseOutputFormat(xml); got no error")
+	}
+}
+
+func TestReportRowRecord(t *testing.T) {
+	header := CSVHeader([]float64{50}, []time.Duration{time.Minute, 5 * time.Minute}, true)
+	if got := strings.Join(header, ","); got != "name,tags,window,seq,start,end,flushed,partial,correction,value,min,max,sum,count,stddev,p50,ewma_1m0s,ewma_5m0s,producers" {
+		t.Errorf("CSVHeader(); got %s", got)
+	}
+	f, _ := ParseValueFormat("fixed", 1)
+	start := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)
+	row := ReportRow{Metric: parser.Metric{Name: "cpu", Tags: "dc=x,host=a", Value: 3, Mean: 1.5, Min: 1, Max: 2, Count: 2},
+		Start: start, End: start.Add(time.Minute), Seq: 2, Flushed: start.Add(90 * time.Second), Partial: []string{"startup", "warmup"}, Correction: true, Percentiles: []float64{50}, Producers: 4}
+	record := row.Record(f, 2)
+	if len(record) != len(header) {
+		t.Fatalf("Record(); got %d columns, want %d", len(record), len(header))
+	}
+	if got := strings.Join(record, "|"); got != "cpu|dc=x,host=a||2|2024-01-02T15:04:00Z|2024-01-02T15:05:00Z|2024-01-02T15:05:30Z|startup,warmup|true|1.5|1.0|2.0|3.0|2|0.0|NaN|||4" {
+		t.Errorf("Record(); got %s", got)
+	}
+}
+
+func TestParseCSVDelimiter(t *testing.T) {
+	for s, want := range map[string]rune{",": ',', ";": ';', "tab": '\t', `\t`: '\t', "|": '|'} {
+		if got, err := ParseCSVDelimiter(s); err != nil || got != want {
+			t.Errorf("ParseCSVDelimiter(%q); got %q, %v, want %q", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", ";;", `"`, "\n"} {
+		if _, err := ParseCSVDelimiter(s); err == nil {
+			t.Errorf("ParseCSVDelimiter(%q); got no error", s)
+		}
+	}
+}
+
+func TestReportTemplate(t *testing.T) {
+	f, _ := ParseValueFormat("fixed", 2)
+	tmpl, err := NewReportTemplate(`{{.Key}} {{format .Mean}} {{.Count}} {{printf "%g" .Value}} {{.Start.Unix}}`, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	row := ReportRow{Metric: parser.Metric{Name: "hits", Tags: "host=a", Type: parser.Counter, Value: 6, Mean: 1.5, Count: 4},
+		Start: time.Unix(1700000000, 0)}
+	if err := tmpl.Execute(&b, row); err != nil {
+		t.Fatal(err)
+	}
+	if want := "hits{host=a} 1.50 4 6 1700000000\n"; b.String() != want {
+		t.Errorf("template; got %q, want %q", b.String(), want)
+	}
+	if _, err := NewReportTemplate("{{.Mean", f); err == nil {
+		t.Errorf("NewReportTemplate with a syntax error; got no error")
+	}
+}
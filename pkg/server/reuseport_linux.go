@@ -0,0 +1,22 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package server
+
+import "syscall"
+
+// SO_REUSEPORT, which package syscall doesn't export for linux. The value is
+// the same on every architecture except mips, which goes without.
+const soReusePort = 0xf
+
+// Sets SO_REUSEPORT so several sockets can bind the same address and the
+// kernel spreads incoming connections across their accept loops
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
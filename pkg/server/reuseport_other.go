@@ -0,0 +1,13 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SO_REUSEPORT load balancing is only supported on Linux
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("reuseport is only supported on linux")
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// SaturationPolicy decides what a listener does when the connection cap is
+// reached or the store can't keep up with the lines coming in
+type SaturationPolicy int
+
+const (
+	// wait for room, applying back pressure to clients (the default)
+	SaturateBlock SaturationPolicy = iota
+	// turn the connection or line away with an ERR BUSY response
+	SaturateReject
+	// keep going but only keep one in every -sample-rate lines
+	SaturateSample
+)
+
+// Parses the textual form of a saturation policy as used in configuration
+func ParseSaturationPolicy(s string) (SaturationPolicy, error) {
+	switch s {
+	case "", "block":
+		return SaturateBlock, nil
+	case "reject":
+		return SaturateReject, nil
+	case "sample":
+		return SaturateSample, nil
+	}
+	return 0, fmt.Errorf("unknown saturation policy %q, want block, reject or sample", s)
+}
+
+func (p SaturationPolicy) String() string {
+	switch p {
+	case SaturateReject:
+		return "reject"
+	case SaturateSample:
+		return "sample"
+	}
+	return "block"
+}
+
+// Written to clients turned away by the reject policy
+const busyResponse = "ERR BUSY\n"
+
+// saturationStats count what the saturation policies turned away
+type saturationStats struct {
+	// connections and lines turned away by the reject policy
+	busyRejected uint64
+	// lines dropped by the sample policy
+	sampleDropped uint64
+	// both of the above, never reset, the report uses it to mark the
+	// windows that are missing lines
+	shed uint64
+	// when the last of them was turned away, in Unix nanoseconds
+	lastShed int64
+}
+
+func (st *saturationStats) reject() {
+	atomic.AddUint64(&st.busyRejected, 1)
+	atomic.AddUint64(&st.shed, 1)
+	atomic.StoreInt64(&st.lastShed, time.Now().UnixNano())
+}
+
+func (st *saturationStats) drop() {
+	atomic.AddUint64(&st.sampleDropped, 1)
+	atomic.AddUint64(&st.shed, 1)
+	atomic.StoreInt64(&st.lastShed, time.Now().UnixNano())
+}
+
+// intake applies a listener's saturation policy to a single connection
+type intake struct {
+	policy SaturationPolicy
+	// keep one in every rate lines while sampling
+	rate uint64
+	// the connection was admitted over the cap, sample everything
+	overCap bool
+	seen    uint64
+	// the listener's counters
+	stats *listenerStats
+	// the server's counters
+	dropped *saturationStats
+	// the metrics were forwarded by a peer of the cluster
+	peer bool
+	// the listener the metrics came in on, and the id of the AUTH token its
+	// connection sent, see Attribution
+	listener, token string
+	// the listener's name policy, the names the scrubber rewrites are
+	// checked against it
+	names parser.NamePolicy
+}
+
+// Hands the metric to the store. ErrBusy is returned when the store is
+// saturated and the policy says to reject or drop the metric,
+// ErrTooManyConnections when the connection is over the cap and the metric
+// was not sampled.
+func (in *intake) deliver(agg store.Aggregator, m parser.Metric) error {
+	in.seen++
+	sampled := in.rate <= 1 || in.seen%in.rate == 0
+	if in.overCap && !sampled {
+		in.dropped.drop()
+		return ErrTooManyConnections
+	}
+
+	if in.policy == SaturateBlock || agg.TryUpdate(m) {
+		if in.policy == SaturateBlock {
+			agg.Update(m)
+		}
+		return nil
+	}
+
+	// the store is saturated
+	if in.policy == SaturateReject {
+		in.dropped.reject()
+		return ErrBusy
+	}
+	if !sampled {
+		in.dropped.drop()
+		return ErrBusy
+	}
+	agg.Update(m)
+	return nil
+}
+
+// Tells a client it was turned away without letting a client that never
+// reads stall the handler. id, if the client has taken part in correlation
+// with the ID command, follows the answer.
+func writeBusy(conn net.Conn, id string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if id != "" {
+		fmt.Fprintf(conn, "ERR BUSY %s\n", id)
+	} else {
+		conn.Write([]byte(busyResponse))
+	}
+	conn.SetWriteDeadline(time.Time{})
+}
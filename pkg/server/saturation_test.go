@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// fullStore is an Aggregator whose queue is always full
+type fullStore struct {
+	updates int
+}
+
+func (f *fullStore) Update(m parser.Metric)                         { f.updates++ }
+func (f *fullStore) TryUpdate(m parser.Metric) bool                 { return false }
+func (f *fullStore) Snapshot() []parser.Metric                      { return nil }
+func (f *fullStore) Flush() []parser.Metric                         { return nil }
+func (f *fullStore) FlushSorted(size int, fn func([]parser.Metric)) {}
+func (f *fullStore) Remove(pattern string) int                      { return 0 }
+func (f *fullStore) Ping()                                          {}
+
+func TestIntakeDeliver(t *testing.T) {
+	cases := []struct {
+		in      intake
+		updates int
+	}{
+		{intake{policy: SaturateBlock, rate: 10}, 100},
+		{intake{policy: SaturateReject, rate: 10}, 0},
+		{intake{policy: SaturateSample, rate: 10}, 10},
+		{intake{policy: SaturateBlock, rate: 10, overCap: true}, 10},
+	}
+	for _, tc := range cases {
+		store := &fullStore{}
+		tc.in.dropped = &saturationStats{}
+		busy := 0
+		for i := 0; i < 100; i++ {
+			if err := tc.in.deliver(store, parser.Metric{Name: "asdf"}); errors.Is(err, ErrBusy) {
+				busy++
+			}
+		}
+		if store.updates != tc.updates || busy != 100-tc.updates {
+			t.Errorf("deliver(%v, over cap %v); got %d updates %d busy, want %d updates", tc.in.policy, tc.in.overCap, store.updates, busy, tc.updates)
+		}
+		if shed := tc.in.dropped.shed; shed != uint64(busy) {
+			t.Errorf("deliver(%v, over cap %v); got %d shed, want %d", tc.in.policy, tc.in.overCap, shed, busy)
+		}
+	}
+}
+
+func TestIngestErrors(t *testing.T) {
+	s := New(&fullStore{})
+	in := &intake{policy: SaturateReject, rate: 10, dropped: &saturationStats{}}
+	if err := s.ingest(&parser.Metric{Name: "asdf", Time: time.Now().Add(-time.Hour)}, "host", in); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("ingest(an hour old); got %v, want %v", err, ErrStaleTimestamp)
+	}
+	if err := s.ingest(&parser.Metric{Name: "asdf", Time: time.Now().Add(time.Second)}, "host", in); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("ingest(a second ahead); got %v, want %v", err, ErrStaleTimestamp)
+	}
+	s.MaxAge, s.MaxSkew = 2*time.Hour, 5*time.Second
+	if err := s.ingest(&parser.Metric{Name: "asdf", Time: time.Now().Add(time.Second)}, "host", in); errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("ingest(a second ahead) with skew; got %v, want it accepted", err)
+	}
+	if err := s.ingest(&parser.Metric{Name: "asdf", Time: time.Now().Add(-time.Hour)}, "host", in); errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("ingest(an hour old) with a max age of 2h; got %v, want it accepted", err)
+	}
+	if s.tooOld != 1 || s.tooNew != 1 {
+		t.Errorf("ingest(); got %d too old %d too new, want 1 of each", s.tooOld, s.tooNew)
+	}
+	s.MaxAge, s.MaxSkew = DefaultMaxAge, 0
+	if err := s.ingest(&parser.Metric{Name: "asdf", Time: time.Now()}, "host", in); !errors.Is(err, ErrBusy) {
+		t.Errorf("ingest(saturated); got %v, want %v", err, ErrBusy)
+	}
+	in.overCap = true
+	if err := s.ingest(&parser.Metric{Name: "asdf", Time: time.Now()}, "host", in); !errors.Is(err, ErrTooManyConnections) || !errors.Is(err, ErrBusy) {
+		t.Errorf("ingest(over the cap); got %v, want %v", err, ErrTooManyConnections)
+	}
+
+	// a replay checks the timestamps against its own clock, and waits for
+	// the store
+	replayed := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	s = New(&fullStore{})
+	s.Clock = clock.Func(func() time.Time { return replayed })
+	if err := s.Ingest(&parser.Metric{Name: "asdf", Time: replayed.Add(-time.Second)}, "replay"); err != nil {
+		t.Errorf("Ingest(a second before the replay clock); got %v", err)
+	}
+	if err := s.Ingest(&parser.Metric{Name: "asdf", Time: replayed.Add(-time.Hour)}, "replay"); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("Ingest(an hour before the replay clock); got %v, want %v", err, ErrStaleTimestamp)
+	}
+	if n := s.Store.(*fullStore).updates; n != 1 {
+		t.Errorf("Ingest(); got %d updates, want 1", n)
+	}
+}
+
+func TestSlotsOrder(t *testing.T) {
+	sl := newSlots(1)
+	if !sl.tryAcquire() || sl.tryAcquire() {
+		t.Fatal("tryAcquire(); want the one slot then none")
+	}
+	// the waiters are given the slot in the order they came
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			if sl.acquire(context.Background(), 0) {
+				order <- i
+			}
+		}(i)
+		for sl.waiting() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for want := 0; want < 3; want++ {
+		sl.release()
+		if got := <-order; got != want {
+			t.Errorf("slot %d went to waiter %d", want, got)
+		}
+	}
+
+	// a wait that times out leaves the slot to those behind it
+	if sl.acquire(context.Background(), 10*time.Millisecond) {
+		t.Error("acquire(10ms) with the slot held; got it")
+	}
+	if sl.waiting() != 0 {
+		t.Errorf("waiting() after the timeout; got %d, want 0", sl.waiting())
+	}
+	sl.release()
+	if !sl.tryAcquire() {
+		t.Error("tryAcquire() after the release; want the slot")
+	}
+}
+
+func TestAcceptWait(t *testing.T) {
+	s := New(&fullStore{})
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 1, ReusePort: 1, AcceptWait: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+	addr := s.listeners[0].acceptors[0].Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	for s.status().Connections != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// the second waits for the slot the first holds, then is turned away
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answer, _ := bufio.NewReader(second).ReadString('\n')
+	if answer != busyResponse {
+		t.Errorf("connection over the cap; got %q, want %q", answer, busyResponse)
+	}
+
+	// one arriving while the slot is held gets it once the first is done
+	third, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	for s.listeners[0].slots.waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	first.Close()
+	for s.status().Connections != 1 || s.listeners[0].slots.waiting() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSlotsResize(t *testing.T) {
+	sl := newSlots(1)
+	sl.tryAcquire()
+	granted := make(chan bool)
+	go func() { granted <- sl.acquire(context.Background(), 0) }()
+	for sl.waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// raising the cap lets the waiter in
+	if old := sl.resize(2); old != 1 || !<-granted {
+		t.Fatalf("resize(2); got %d before, want 1 and the waiter let in", old)
+	}
+	// lowering it below those held takes the slots away as they are done
+	sl.resize(1)
+	sl.release()
+	if sl.tryAcquire() {
+		t.Error("tryAcquire() with the one slot still held; got a slot")
+	}
+	sl.release()
+	if !sl.tryAcquire() {
+		t.Error("tryAcquire() once both were done; want the slot")
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// scrubRule rewrites the parts of a metric name matching pattern, either
+// with a fixed replacement or with a hash of the matched text. A mapping
+// rule instead renames the whole metric and tags it.
+type scrubRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	hash        bool
+	mapping     bool
+	// tag keys and value templates added by a mapping
+	tags [][2]string
+}
+
+// ScrubRules removes accidental PII (emails, user ids, ...) from metric
+// names before they are stored, captured or sent anywhere
+type ScrubRules []scrubRule
+
+// Loads the rules file, one rule per line in order of application:
+//
+//	replace <regexp> [<replacement>]
+//	hash <regexp>
+//	map <regexp> <name> [<key>=<value>,...]
+//
+// Replacements may refer to capture groups as $1. Hashed matches become the
+// first 12 hex characters of their SHA-256 so series stay distinct without
+// revealing the original value. A map rule matching the name replaces it
+// and adds the tags, where the name and values may refer to capture groups
+// too, and later map rules are skipped: the first mapping wins, as in a
+// statsd mapping config. Tags left empty are not added. A name rewritten
+// to nothing is dropped, one rewritten to anything but letters, digits,
+// '-', '.' and '_' is rejected. Blank lines and '#' comments are ignored.
+//
+// Besides scrubbing, the rules normalize the names emitters got wrong:
+// "replace \.web-[0-9]+$" collapses per-host suffixes and "replace \. _"
+// replaces dots.
+func LoadScrubRules(path string) (ScrubRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading scrub rules: %v", err)
+	}
+	defer f.Close()
+
+	var rules ScrubRules
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var rule scrubRule
+		switch {
+		case fields[0] == "replace" && (len(fields) == 2 || len(fields) == 3):
+			if len(fields) == 3 {
+				rule.replacement = fields[2]
+			}
+		case fields[0] == "hash" && len(fields) == 2:
+			rule.hash = true
+		case fields[0] == "map" && (len(fields) == 3 || len(fields) == 4):
+			rule.mapping, rule.replacement = true, fields[2]
+			if len(fields) == 4 {
+				for _, kv := range strings.Split(fields[3], ",") {
+					k, v, ok := strings.Cut(kv, "=")
+					if !ok || k == "" {
+						return nil, fmt.Errorf("%s:%d: tag %q is not key=value", path, n, kv)
+					}
+					rule.tags = append(rule.tags, [2]string{k, v})
+				}
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: expected \"replace <regexp> [<replacement>]\", \"hash <regexp>\" or \"map <regexp> <name> [<tags>]\"", path, n)
+		}
+		if rule.pattern, err = regexp.Compile(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// Applies every rule in order to the metric's name, the first matching map
+// rule also tags it
+func (rules ScrubRules) apply(m *parser.Metric) {
+	mapped := false
+	for _, rule := range rules {
+		switch {
+		case rule.hash:
+			m.Name = rule.pattern.ReplaceAllStringFunc(m.Name, scrubHash)
+		case rule.mapping:
+			if !mapped {
+				mapped = rule.mapTo(m)
+			}
+		default:
+			m.Name = rule.pattern.ReplaceAllString(m.Name, rule.replacement)
+		}
+	}
+}
+
+// Renames and tags the metric if the rule matches its name. Tags it
+// already has are overridden by the rule's.
+func (rule scrubRule) mapTo(m *parser.Metric) bool {
+	match := rule.pattern.FindStringSubmatchIndex(m.Name)
+	if match == nil {
+		return false
+	}
+	expand := func(template string) string {
+		return string(rule.pattern.ExpandString(nil, template, m.Name, match))
+	}
+	tags := make(map[string]string)
+	if m.Tags != "" {
+		for _, kv := range strings.Split(m.Tags, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			tags[k] = v
+		}
+	}
+	for _, t := range rule.tags {
+		if v := expand(t[1]); v != "" {
+			tags[t[0]] = v
+		}
+	}
+	pairs := make([][2]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, [2]string{k, v})
+	}
+	// a value the capture made unusable as a tag loses the mapping's tags
+	if canonical, err := parser.CanonicalTags(pairs); err == nil {
+		m.Tags = canonical
+	}
+	m.Name = expand(rule.replacement)
+	return true
+}
+
+func scrubHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestScrubRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scrub.rules")
+	os.WriteFile(path, []byte(`# strip customer ids, hash anything that looks like a user
+replace cust-[0-9]+ cust
+replace ^(api)-v[0-9]+ $1
+hash user-[a-z]+
+`), 0600)
+
+	rules, err := LoadScrubRules(path)
+	if err != nil {
+		t.Fatalf("loadScrubRules(); got error %v", err)
+	}
+
+	tests := map[string]string{
+		"login-cust-1234":    "login-cust",
+		"api-v2-latency":     "api-latency",
+		"visits-user-alice":  "visits-" + scrubHash("user-alice"),
+		"checkout-time":      "checkout-time",
+		"cust-9-user-bob-v1": "cust-" + scrubHash("user-bob") + "-v1",
+	}
+	for input, want := range tests {
+		m := parser.Metric{Name: input}
+		if rules.apply(&m); m.Name != want {
+			t.Errorf("apply(%s); got %v, want %v", input, m.Name, want)
+		}
+	}
+
+	os.WriteFile(path, []byte(`map ^test\.dispatcher\.([^.]+)\.([^.]+)$ dispatcher_${2}_total processor=$1,job=dispatcher
+map ^test\.(.*)$ other
+replace ^drop\..*$
+`), 0600)
+	if rules, err = LoadScrubRules(path); err != nil {
+		t.Fatalf("loadScrubRules(map); got error %v", err)
+	}
+	mapTests := []struct{ input, tags, name, wantTags string }{
+		{"test.dispatcher.worker1.ok", "", "dispatcher_ok_total", "job=dispatcher,processor=worker1"},
+		{"test.dispatcher.worker1.ok", "job=x,region=eu", "dispatcher_ok_total", "job=dispatcher,processor=worker1,region=eu"},
+		{"test.misc", "region=eu", "other", "region=eu"},
+		{"drop.me", "", "", ""},
+		{"unmapped", "", "unmapped", ""},
+	}
+	for _, tc := range mapTests {
+		m := parser.Metric{Name: tc.input, Tags: tc.tags}
+		if rules.apply(&m); m.Name != tc.name || m.Tags != tc.wantTags {
+			t.Errorf("apply(%s{%s}); got %s{%s}, want %s{%s}", tc.input, tc.tags, m.Name, m.Tags, tc.name, tc.wantTags)
+		}
+	}
+
+	os.WriteFile(path, []byte("redact [a-z]+\n"), 0600)
+	if _, err := LoadScrubRules(path); err == nil {
+		t.Errorf("loadScrubRules(unknown action); got nil error")
+	}
+}
+
+func TestScrubRewrittenName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scrub.rules")
+	os.WriteFile(path, []byte(`replace \.web-[0-9]+$
+replace \. _
+replace ^bad- bad:
+`), 0600)
+	rules, err := LoadScrubRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(&fullStore{})
+	s.Scrub = rules
+	now := time.Now()
+
+	m := parser.Metric{Name: "api.latency.web-12", Value: 1, Count: 1, Time: now}
+	if err := s.Ingest(&m, "test"); err != nil || m.Name != "api_latency" {
+		t.Errorf("Ingest(api.latency.web-12); got %s, %v, want api_latency", m.Name, err)
+	}
+	// a rule may not write what no line format can carry
+	m = parser.Metric{Name: "bad-name", Value: 1, Count: 1, Time: now}
+	if err := s.Ingest(&m, "test"); !errors.Is(err, ErrRewrittenName) || !errors.Is(err, parser.ErrInvalidName) {
+		t.Errorf("Ingest(bad-name); got %v, want %v", err, ErrRewrittenName)
+	}
+	// unless the listener's names may carry it
+	in := &intake{policy: SaturateBlock, dropped: &saturationStats{}, names: parser.NamePolicy{Punct: "-._:"}}
+	m = parser.Metric{Name: "bad-name", Value: 1, Count: 1, Time: now}
+	if err := s.ingest(&m, "test", in); err != nil || m.Name != "bad:name" {
+		t.Errorf("ingest(bad-name) with ':' allowed; got %s, %v, want bad:name", m.Name, err)
+	}
+	if err := s.checkBatch([]parser.Metric{{Name: "bad-name", Value: 1, Count: 1, Time: now}}, in.names); err != nil {
+		t.Errorf("checkBatch(bad-name) with ':' allowed; got %v", err)
+	}
+}
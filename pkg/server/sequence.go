@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSessionTTL is how long a sequence session is remembered after its
+// last line
+const DefaultSessionTTL = 10 * time.Minute
+
+// How far past the contiguous high-water mark a session's lines may run
+// ahead before the connection is dropped
+const maxSequenceGap = 1024
+
+// Sessions holds the sequence sessions of the SEQ mode. After "SEQ <session>"
+// every line a client sends is prefixed with a sequence number, starting at
+// 1, and the session's high-water mark survives reconnects. A line whose
+// number was already applied is a replay and discarded, so a client library
+// can resend everything not yet acknowledged and still have each line
+// counted exactly once. Sessions are per client identity and forgotten TTL
+// after their last line.
+type Sessions struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*seqSession
+	now      func() time.Time
+	// replayed lines discarded since the last report
+	replayed uint64
+}
+
+type seqSession struct {
+	mu sync.Mutex
+	// the highest sequence number up to which every line was applied, and
+	// those applied beyond it
+	contiguous uint64
+	ahead      map[uint64]empty
+	last       time.Time
+}
+
+// Returns Sessions remembering each session for ttl after its last line
+func NewSessions(ttl time.Duration) *Sessions {
+	return &Sessions{ttl: ttl, sessions: make(map[string]*seqSession), now: time.Now}
+}
+
+// Returns the session of the client, creating it if need be
+func (s *Sessions) session(client, id string) *seqSession {
+	key := client + "\x00" + id
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = &seqSession{ahead: make(map[uint64]empty)}
+		s.sessions[key] = sess
+	}
+	sess.mu.Lock()
+	sess.last = s.now()
+	sess.mu.Unlock()
+	return sess
+}
+
+// Purge forgets the sessions idle for longer than the TTL, returning how
+// many there were
+func (s *Sessions) Purge() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, sess := range s.sessions {
+		sess.mu.Lock()
+		idle := s.now().Sub(sess.last) >= s.ttl
+		sess.mu.Unlock()
+		if idle {
+			delete(s.sessions, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Returns how many replayed lines were discarded since the last call
+func (s *Sessions) Replayed() uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.SwapUint64(&s.replayed, 0)
+}
+
+// Applies the line numbered seq unless it already was. The session is held
+// while apply runs so two connections resuming one session can't both apply
+// a line. A line turned away as busy isn't recorded, the client must resend
+// it.
+func (sess *seqSession) apply(seq uint64, now time.Time, apply func() error) (replay bool, err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.last = now
+	if _, ok := sess.ahead[seq]; ok || seq <= sess.contiguous {
+		return true, nil
+	}
+	if seq-sess.contiguous > maxSequenceGap {
+		return false, fmt.Errorf("invalid sequence: %d is more than %d past %d", seq, maxSequenceGap, sess.contiguous)
+	}
+	if err := apply(); errors.Is(err, ErrBusy) {
+		return false, err
+	}
+	sess.ahead[seq] = empty{}
+	for {
+		if _, ok := sess.ahead[sess.contiguous+1]; !ok {
+			break
+		}
+		sess.contiguous++
+		delete(sess.ahead, sess.contiguous)
+	}
+	return false, nil
+}
+
+// Returns the session's high-water mark
+func (sess *seqSession) mark() uint64 {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.contiguous
+}
+
+// sequencer implements the SEQ mode for one connection. Once the client
+// stops sending the server writes "SEQ <n>\n" back, n being the highest
+// sequence number up to which every line was applied, so the client can
+// drop those lines from its retry buffer. After an ID command the
+// correlation ID follows the number.
+type sequencer struct {
+	conn     net.Conn
+	sessions *Sessions
+	session  *seqSession
+	id       string
+	// whether lines arrived since the last acknowledgement
+	pending bool
+}
+
+// Handles the SEQ command, returning the sequencer for the connection
+func newSequencer(conn net.Conn, sessions *Sessions, client string, args []string) (*sequencer, error) {
+	if sessions == nil {
+		return nil, fmt.Errorf("invalid command: SEQ is disabled")
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("invalid command: SEQ takes one argument")
+	}
+	if !validCorrelationID(args[0]) {
+		return nil, fmt.Errorf("invalid command: SEQ session must be up to 64 letters, digits or ._:-")
+	}
+	return &sequencer{conn: conn, sessions: sessions, session: sessions.session(client, args[0])}, nil
+}
+
+// Splits the sequence number off the line
+func splitSequence(line []byte) (uint64, []byte, error) {
+	num, rest, ok := bytes.Cut(line, []byte(" "))
+	seq, err := strconv.ParseUint(string(num), 10, 64)
+	if !ok || err != nil || seq == 0 {
+		return 0, nil, fmt.Errorf("invalid sequence: line must start with a positive sequence number")
+	}
+	return seq, rest, nil
+}
+
+// Applies the line unless it is a replay
+func (q *sequencer) apply(seq uint64, apply func() error) error {
+	q.pending = true
+	replay, err := q.session.apply(seq, q.sessions.now(), apply)
+	if replay {
+		atomic.AddUint64(&q.sessions.replayed, 1)
+	}
+	return err
+}
+
+// Acknowledges the high-water mark if lines arrived since the last time and
+// idle reports that no more input is buffered
+func (q *sequencer) flush(idle bool) error {
+	if !q.pending || !idle {
+		return nil
+	}
+	q.pending = false
+	q.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	defer q.conn.SetWriteDeadline(time.Time{})
+	if q.id != "" {
+		_, err := fmt.Fprintf(q.conn, "SEQ %d %s\n", q.session.mark(), q.id)
+		return err
+	}
+	_, err := fmt.Fprintf(q.conn, "SEQ %d\n", q.session.mark())
+	return err
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSequence(t *testing.T) {
+	now := time.Now()
+	sessions := NewSessions(time.Minute)
+	sessions.now = func() time.Time { return now }
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	for _, args := range [][]string{nil, {"a", "b"}, {"bad session"}} {
+		if _, err := newSequencer(server, sessions, "", args); err == nil {
+			t.Errorf("newSequencer(%q); got nil error", args)
+		}
+	}
+	if _, err := newSequencer(server, nil, "", []string{"s1"}); err == nil {
+		t.Errorf("newSequencer() disabled; got nil error")
+	}
+	q, err := newSequencer(server, sessions, "", []string{"s1"})
+	if err != nil {
+		t.Fatalf("newSequencer(s1); got error %v", err)
+	}
+
+	for _, line := range []string{"cpu 1", "0 cpu", "-1 cpu", "x cpu"} {
+		if _, _, err := splitSequence([]byte(line)); err == nil {
+			t.Errorf("splitSequence(%q); got nil error", line)
+		}
+	}
+	if n, rest, err := splitSequence([]byte("12 cpu\t1")); err != nil || n != 12 || string(rest) != "cpu\t1" {
+		t.Errorf("splitSequence(12 cpu); got %d %q %v", n, rest, err)
+	}
+
+	acks := make(chan string, 3)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(acks)
+				return
+			}
+			acks <- line
+		}
+	}()
+
+	applied := 0
+	apply := func() error { applied++; return nil }
+	// 3 is missing so only 2 is acknowledged, and replays are discarded
+	for _, n := range []uint64{1, 2, 4, 2, 4} {
+		if err := q.apply(n, apply); err != nil {
+			t.Fatalf("apply(%d); got error %v", n, err)
+		}
+	}
+	if err := q.flush(true); err != nil {
+		t.Fatalf("flush(); got error %v", err)
+	}
+	// a busy line isn't recorded, it must be resent
+	if err := q.apply(3, func() error { return ErrBusy }); err != ErrBusy {
+		t.Errorf("apply(3) busy; got error %v, want ErrBusy", err)
+	}
+	if err := q.flush(false); err != nil {
+		t.Fatalf("flush(false); got error %v", err)
+	}
+	if q.session.mark() != 2 {
+		t.Errorf("mark() after busy; got %d, want 2", q.session.mark())
+	}
+
+	// a reconnect resumes the session
+	q, err = newSequencer(server, sessions, "", []string{"s1"})
+	if err != nil {
+		t.Fatalf("newSequencer(s1) again; got error %v", err)
+	}
+	q.id = "batch-42"
+	if err := q.apply(3, apply); err != nil {
+		t.Fatalf("apply(3); got error %v", err)
+	}
+	if err := q.flush(true); err != nil {
+		t.Fatalf("flush(); got error %v", err)
+	}
+	if err := q.apply(maxSequenceGap+5, apply); err == nil {
+		t.Errorf("apply() past the gap; got nil error")
+	}
+	for _, want := range []string{"SEQ 2\n", "SEQ 4 batch-42\n"} {
+		if got := <-acks; got != want {
+			t.Errorf("ack; got %q, want %q", got, want)
+		}
+	}
+	if applied != 4 {
+		t.Errorf("applied %d lines, want 4", applied)
+	}
+	if n := sessions.Replayed(); n != 2 {
+		t.Errorf("Replayed(); got %d, want 2", n)
+	}
+
+	// sessions are per client and forgotten once idle
+	if other := sessions.session("client-b", "s1"); other.mark() != 0 {
+		t.Errorf("mark() of another client's session; got %d, want 0", other.mark())
+	}
+	now = now.Add(2 * time.Minute)
+	if n := sessions.Purge(); n != 2 {
+		t.Errorf("Purge(); got %d, want 2", n)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// SerializePolicy decides what a flush does with a record that can't be
+// written out as is, like a name a scrub rule gave a tab or invalid UTF-8
+type SerializePolicy int
+
+const (
+	// leave the record out of the emission (the default)
+	SerializeDrop SerializePolicy = iota
+	// replace the offending characters with '_' and write it
+	SerializeSanitize
+	// stop the emission at the record, the rest of the window is lost
+	SerializeFail
+)
+
+// Parses the textual form of a serialization policy as used in configuration
+func ParseSerializePolicy(s string) (SerializePolicy, error) {
+	switch s {
+	case "", "drop":
+		return SerializeDrop, nil
+	case "sanitize":
+		return SerializeSanitize, nil
+	case "fail":
+		return SerializeFail, nil
+	}
+	return 0, fmt.Errorf("unknown serialization policy %q, want drop, sanitize or fail", s)
+}
+
+func (p SerializePolicy) String() string {
+	switch p {
+	case SerializeSanitize:
+		return "sanitize"
+	case SerializeFail:
+		return "fail"
+	}
+	return "drop"
+}
+
+// Serializer applies the policy to each record of a flush and counts what
+// it had to do
+type Serializer struct {
+	Policy    SerializePolicy
+	dropped   uint64
+	sanitized uint64
+	failed    uint64
+}
+
+// Checks the record can be written as a line of the report. It returns
+// false if the record must be skipped, or an error when the policy is to
+// fail the flush.
+func (s *Serializer) Prepare(m *parser.Metric) (bool, error) {
+	if validField(m.Name) && validField(m.Tags) {
+		return true, nil
+	}
+	switch s.Policy {
+	case SerializeSanitize:
+		atomic.AddUint64(&s.sanitized, 1)
+		m.Name, m.Tags = sanitizeField(m.Name), sanitizeField(m.Tags)
+		return true, nil
+	case SerializeFail:
+		atomic.AddUint64(&s.failed, 1)
+		return false, fmt.Errorf("can't serialize metric %q", m.Key())
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return false, nil
+}
+
+// Writes the stats report line and starts counting afresh
+func (s *Serializer) Report(w io.Writer) {
+	dropped, sanitized, failed := atomic.SwapUint64(&s.dropped, 0), atomic.SwapUint64(&s.sanitized, 0), atomic.SwapUint64(&s.failed, 0)
+	if dropped > 0 || sanitized > 0 || failed > 0 {
+		fmt.Fprintf(w, "(10 sec): Unserializable records dropped %d, sanitized %d, failed flushes %d\n", dropped, sanitized, failed)
+	}
+}
+
+// A field must be valid UTF-8 without control characters, which includes
+// the tab and newline separators of the report
+func validField(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	return strings.IndexFunc(s, unicode.IsControl) < 0
+}
+
+func sanitizeField(s string) string {
+	s = strings.ToValidUTF8(s, "_")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
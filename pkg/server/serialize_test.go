@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+type serializeTestCase struct {
+	policy SerializePolicy
+	name   string
+	want   string
+	ok     bool
+	err    bool
+}
+
+var serializeTestCases = []serializeTestCase{
+	{SerializeDrop, "cpu", "cpu", true, false},
+	{SerializeDrop, "cpu\tidle", "cpu\tidle", false, false},
+	{SerializeSanitize, "cpu\tidle", "cpu_idle", true, false},
+	{SerializeSanitize, "cpu\xffidle\n", "cpu_idle_", true, false},
+	{SerializeFail, "cpu\xff", "cpu\xff", false, true},
+	{SerializeFail, "cpu", "cpu", true, false},
+}
+
+func TestSerializer(t *testing.T) {
+	for _, tc := range serializeTestCases {
+		s := &Serializer{Policy: tc.policy}
+		m := parser.Metric{Name: tc.name}
+		ok, err := s.Prepare(&m)
+		if ok != tc.ok || (err != nil) != tc.err || m.Name != tc.want {
+			t.Errorf("Prepare(%v, %q); got %v, %v, %q, want %v, error %v, %q", tc.policy, tc.name, ok, err, m.Name, tc.ok, tc.err, tc.want)
+		}
+	}
+
+	s := &Serializer{}
+	s.Prepare(&parser.Metric{Name: "a\nb"})
+	var buf bytes.Buffer
+	s.Report(&buf)
+	if want := "(10 sec): Unserializable records dropped 1, sanitized 0, failed flushes 0\n"; buf.String() != want {
+		t.Errorf("Report(); got %q, want %q", buf.String(), want)
+	}
+
+	if p, err := ParseSerializePolicy("sanitize"); p != SerializeSanitize || err != nil {
+		t.Errorf("ParseSerializePolicy(sanitize); got %v, %v", p, err)
+	}
+	if _, err := ParseSerializePolicy("ignore"); err == nil {
+		t.Errorf("ParseSerializePolicy(ignore); got nil, want an error")
+	}
+}
@@ -0,0 +1,1065 @@
+// Package server accepts metrics over the network and feeds them to a store
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// The default connection limit for each listener
+const MaxConnections = 10
+
+// How long a listener waits to accept again after a failure like running
+// out of file descriptors, doubling up to the max while it keeps failing
+const (
+	acceptRetryMin = 5 * time.Millisecond
+	acceptRetryMax = time.Second
+)
+
+// Server accepts metrics on any number of listeners and hands them through
+// scrubbing, quarantine and the saturation policies to the store
+type Server struct {
+	Store store.Aggregator
+	// producers whose metrics are captured rather than aggregated
+	Quarantine *Quarantine
+	// rewrites applied to every metric name before anything else sees it
+	Scrub ScrubRules
+	// folds the spellings of the scrubbed names into one
+	Normalize NameNormalization
+	// tags the metrics with where they came from
+	Attribution Attribution
+	// the names kept or dropped once scrubbed, nil keeps all
+	Filter *NameFilter
+	// forwards the metrics of the names other collectors own to them, nil
+	// aggregates everything here
+	Cluster *Cluster
+	// keep one in this many lines when the sample saturation policy kicks in
+	SampleRate uint64
+	// the tenants clients authenticate as
+	Credentials *Credentials
+	// what becomes of NaN, infinite and negative values
+	Values ValuePolicy
+	// how every listener and the API read values, each listener checking
+	// names by its own policy
+	Parsing parser.Options
+	// metrics timestamped more than MaxAge ago or more than MaxSkew ahead
+	// are dropped as stale
+	MaxAge  time.Duration
+	MaxSkew time.Duration
+	// lines retried by clients are only counted once when set
+	Dedup *Dedup
+	// keeps each tenant's metrics apart and to its quotas
+	Tenants *TenantQuotas
+	// the sessions of clients numbering their lines, nil disables SEQ
+	Sessions *Sessions
+	// the lines a second every listener together may ingest, nil for no
+	// limit
+	RateLimit *RateLimit
+	// the hosts that may connect and how many connections each may hold,
+	// nil lets everyone in
+	Access *Access
+	// the process's resolved configuration, shown by the admin API
+	Settings map[string]ConfigSetting
+	// when set, is handed every metric the store accepted, from the
+	// goroutine of its connection
+	Relay func(m parser.Metric)
+	// the windows kept on disk, queried by the admin API, nil when none are
+	History History
+	// when set, forgets what the windows keep of the metrics matching the
+	// pattern across flushes, like their averages, as they are deleted.
+	// Returns how many metrics it was kept for.
+	Forget func(pattern string) int
+	// the time metrics' timestamps are checked against, nil for the wall
+	// clock. A replay moves it along with the file.
+	Clock clock.Clock
+	// the stores of the windows by label, written out and restored by the
+	// admin API, a window missing can't be
+	Snapshots map[string]store.Snapshotter
+	// the flushes of the first window, streamed to the subscribers of the
+	// API and the console, nil when nothing publishes them
+	Subscribers *Broadcaster
+	// feeds the server's own counters to the store under the
+	// ReservedPrefix, see RecordTelemetry
+	Telemetry bool
+	// clients' metrics named under it are rejected with ErrReservedName, so
+	// the server's own can't be spoofed or clobbered, whether or not it
+	// records them. Empty reserves nothing.
+	ReservedPrefix string
+	// records the lines rejected, nil when nothing does
+	DeadLetters *DeadLetters
+	// the binary serving, shown by the status document
+	Build BuildInfo
+
+	listeners []*listener
+	// the connections being handled, drained on shutdown
+	inflight connTracker
+	// the connections opened and closed, and open by host
+	conns connStats
+	// records ingested since the last report
+	records    uint64
+	saturation saturationStats
+	// panics isolated since startup, and as of the last report
+	panics         uint64
+	panicsReported uint64
+	// stale records since the last report
+	tooOld, tooNew uint64
+	// lines discarded for being over the length limit since the last report
+	tooLong uint64
+	// connections closed for being idle since the last report
+	idleClosed uint64
+	// lines held up or turned away by the rate limits since the last report
+	rates rateStats
+	// values rejected or clamped since the last report
+	values valueStats
+	// lines that didn't parse since startup, only the status document
+	// shows them, the stderr report has the lines themselves
+	malformed uint64
+	// lines rejected by what was wrong with them, and the bytes of the
+	// lines read, since the last report
+	lines lineStats
+	// the report's counters since startup, and the windows' last flushes,
+	// for the status document
+	started time.Time
+	totals  statusTotals
+	flushes flushes
+	// the totals last fed as the server's own metrics
+	telemetry telemetry
+	// set while the listeners are being served, until Close
+	serving atomic.Bool
+}
+
+// History is a store of past windows, like the history sink
+type History interface {
+	// calls fn with the JSON record of each metric whose window started
+	// from from until to and whose name matches the path.Match pattern
+	Query(from, to time.Time, pattern string, fn func(record []byte) error) error
+	// removes the records of the metrics whose name or key matches the
+	// path.Match pattern, returning how many there were
+	Delete(pattern string) (int, error)
+}
+
+// DefaultMaxAge is how old a metric's timestamp may be before it is dropped
+const DefaultMaxAge = 60 * time.Second
+
+// Returns a server feeding the store, with nothing quarantined or scrubbed,
+// no future timestamps accepted and the names under TelemetryPrefix
+// reserved
+func New(store store.Aggregator) *Server {
+	return &Server{
+		Store:          store,
+		Quarantine:     NewQuarantine("", nil),
+		Credentials:    NewCredentials(),
+		Tenants:        NewTenantQuotas(Quota{}, nil, DefaultSeriesTTL),
+		Sessions:       NewSessions(DefaultSessionTTL),
+		Values:         DefaultValuePolicy,
+		SampleRate:     10,
+		MaxAge:         DefaultMaxAge,
+		ReservedPrefix: TelemetryPrefix,
+		Build:          NewBuildInfo("", "", ""),
+		started:        time.Now(),
+	}
+}
+
+// Returns the time by the server's clock
+func (s *Server) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+// Opens the endpoint described by the config, it is served once Serve is
+// called
+func (s *Server) Listen(cfg ListenerConfig) error {
+	l, err := cfg.listen(s.Parsing)
+	if err != nil {
+		return err
+	}
+	s.listeners = append(s.listeners, l)
+	return nil
+}
+
+// Serves every listener until one of them fails or they are closed, or
+// the standard input a stdin listener reads ends
+func (s *Server) Serve() error {
+	return s.ServeContext(context.Background())
+}
+
+// ServeContext is Serve until the context is done, then the listeners are
+// closed along with every connection still open and the context's error is
+// returned. To let the clients finish sending, Close and Drain first.
+func (s *Server) ServeContext(ctx context.Context) error {
+	s.serving.Store(true)
+	errc := make(chan error, 1)
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+	for _, l := range s.listeners {
+		for _, acceptor := range l.acceptors {
+			go func(l *listener, acceptor net.Listener) {
+				errc <- s.serve(ctx, l, acceptor)
+			}(l, acceptor)
+		}
+		for _, pc := range l.packets {
+			go func(l *listener, pc net.PacketConn) {
+				errc <- s.servePackets(l, pc)
+			}(l, pc)
+		}
+		for _, t := range l.tails {
+			go func(l *listener, t *tailer) {
+				errc <- s.serveTail(l, t)
+			}(l, t)
+		}
+		for _, m := range l.mqtts {
+			go func(l *listener, m *mqttSubscriber) {
+				errc <- s.serveMQTT(l, m)
+			}(l, m)
+		}
+	}
+	err := <-errc
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Closes every listener, connections already accepted carry on
+func (s *Server) Close() error {
+	s.serving.Store(false)
+	var err error
+	for _, l := range s.listeners {
+		if cerr := l.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Gives the open connections until the timeout to finish sending, then
+// closes whatever is left. Returns how many had to be closed.
+func (s *Server) Drain(timeout time.Duration) int {
+	return s.inflight.drain(timeout)
+}
+
+// Returns how many lines or connections the saturation policies have turned
+// away since startup
+func (s *Server) Shed() uint64 {
+	return atomic.LoadUint64(&s.saturation.shed)
+}
+
+// lineStats counts the lines rejected since the last report by what was
+// wrong with them, beyond the stale, too long, rate limited and bad value
+// counters kept for their own report lines
+type lineStats struct {
+	// lines that didn't parse for their name, value or timestamp, or for
+	// anything else
+	badName, badValue, badTime, malformed uint64
+	// the bytes of the lines read, newlines included
+	read uint64
+}
+
+// Counts a line that didn't parse by what was wrong with it
+func (s *Server) countMalformed(err error) {
+	atomic.AddUint64(&s.malformed, 1)
+	switch {
+	case errors.Is(err, parser.ErrInvalidName):
+		atomic.AddUint64(&s.lines.badName, 1)
+	case errors.Is(err, parser.ErrInvalidValue):
+		atomic.AddUint64(&s.lines.badValue, 1)
+	case errors.Is(err, parser.ErrInvalidTime):
+		atomic.AddUint64(&s.lines.badTime, 1)
+	default:
+		atomic.AddUint64(&s.lines.malformed, 1)
+	}
+}
+
+// Writes the stats report lines and starts counting afresh
+func (s *Server) Report(w io.Writer) {
+	records := tally(&s.records, &s.totals.records)
+	old, future := tally(&s.tooOld, &s.totals.tooOld), tally(&s.tooNew, &s.totals.tooNew)
+	nonFinite, negative, clamped := tally(&s.values.nonFinite, &s.totals.nonFinite), tally(&s.values.negative, &s.totals.negative), atomic.SwapUint64(&s.values.clamped, 0)
+	throttled, dropped, closed := atomic.SwapUint64(&s.rates.throttled, 0), tally(&s.rates.dropped, &s.totals.rateDropped), atomic.SwapUint64(&s.rates.disconnected, 0)
+	tooLong := tally(&s.tooLong, &s.totals.tooLong)
+	badName, badValue, badTime := atomic.SwapUint64(&s.lines.badName, 0), atomic.SwapUint64(&s.lines.badValue, 0)+nonFinite+negative, atomic.SwapUint64(&s.lines.badTime, 0)
+	malformed, read := atomic.SwapUint64(&s.lines.malformed, 0), atomic.SwapUint64(&s.lines.read, 0)
+
+	fmt.Fprintf(w, "(10 sec): Record count %d\n", records)
+	rejected := badName + badValue + badTime + malformed + old + future + tooLong + dropped
+	fmt.Fprintf(w, "(10 sec): Lines accepted %d, rejected %d (bad name %d, bad value %d, bad timestamp %d, malformed %d, stale %d, future %d, too long %d, rate limited %d), bytes read %d\n",
+		records, rejected, badName, badValue, badTime, malformed, old, future, tooLong, dropped, read)
+	s.conns.report(w)
+	if len(s.listeners) > 1 {
+		for _, l := range s.listeners {
+			fmt.Fprintf(w, "(10 sec): Listener %s\n", l.report())
+		}
+	}
+	if old > 0 || future > 0 {
+		fmt.Fprintf(w, "(10 sec): Stale records dropped %d, older than %v %d, ahead by more than %v %d\n", old+future, s.MaxAge, old, s.MaxSkew, future)
+	}
+	if nonFinite > 0 || negative > 0 || clamped > 0 {
+		fmt.Fprintf(w, "(10 sec): Values rejected, not finite %d, negative %d, clamped %d\n", nonFinite, negative, clamped)
+	}
+	if denied, overCap := s.Access.Refused(); denied > 0 || overCap > 0 {
+		fmt.Fprintf(w, "(10 sec): Refused, denied %d, over the per host cap %d\n", denied, overCap)
+	}
+	if throttled > 0 || dropped > 0 || closed > 0 {
+		fmt.Fprintf(w, "(10 sec): Rate limited, lines throttled %d, lines dropped %d, connections closed %d\n", throttled, dropped, closed)
+	}
+	if d, ok := s.Store.(store.Dropper); ok {
+		if n := d.Dropped(); n > 0 {
+			fmt.Fprintf(w, "(10 sec): Store ingress full, records dropped %d\n", n)
+		}
+	}
+	if tooLong > 0 {
+		fmt.Fprintf(w, "(10 sec): Lines over the length limit discarded %d\n", tooLong)
+	}
+	if n := atomic.SwapUint64(&s.idleClosed, 0); n > 0 {
+		fmt.Fprintf(w, "(10 sec): Idle connections closed %d\n", n)
+	}
+	if n := s.Dedup.Dropped(); n > 0 {
+		atomic.AddUint64(&s.totals.duplicates, n)
+		fmt.Fprintf(w, "(10 sec): Duplicates suppressed %d\n", n)
+	}
+	if n := s.Sessions.Replayed(); n > 0 {
+		atomic.AddUint64(&s.totals.replayed, n)
+		fmt.Fprintf(w, "(10 sec): Replayed sequence numbers discarded %d\n", n)
+	}
+	s.Sessions.Purge()
+	s.Filter.Report(w)
+	s.Cluster.Report(w)
+	s.DeadLetters.Report(w)
+	s.Tenants.Report(w)
+	if n := s.Credentials.Purge(); n > 0 {
+		fmt.Fprintf(w, "(10 sec): Tenants deleted at the end of their grace period %d\n", n)
+	}
+	total := s.Panics()
+	if prev := atomic.SwapUint64(&s.panicsReported, total); total > prev {
+		fmt.Fprintf(w, "(10 sec): Panics %d, see the stack traces above\n", total-prev)
+	}
+	if busy, sampled := tally(&s.saturation.busyRejected, &s.totals.busy), tally(&s.saturation.sampleDropped, &s.totals.sampled); busy > 0 || sampled > 0 {
+		fmt.Fprintf(w, "(10 sec): Saturated, rejected busy %d, dropped by sampling %d\n", busy, sampled)
+	}
+}
+
+// Returns the intake applying the listener's saturation policy to one
+// connection
+func (s *Server) intake(l *listener, overCap bool) *intake {
+	return &intake{policy: l.saturation, rate: s.SampleRate, overCap: overCap, stats: &l.stats, dropped: &s.saturation, peer: l.format == "peer", listener: l.name, names: l.names}
+}
+
+type empty struct{}
+
+// slots caps the connections a listener handles at once. The connections
+// waiting for a slot are given one in the order they began to wait.
+type slots struct {
+	size int
+
+	mu      sync.Mutex
+	free    int
+	waiters []chan struct{}
+}
+
+func newSlots(n int) *slots {
+	return &slots{size: n, free: n}
+}
+
+// Takes a slot only if one is free right now and no one is waiting for it
+func (s *slots) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		return true
+	}
+	return false
+}
+
+// Waits for a slot, up to the timeout unless it is 0, false if none came
+// in time or the context was done first
+func (s *slots) acquire(ctx context.Context, timeout time.Duration) bool {
+	if s.tryAcquire() {
+		return true
+	}
+	s.mu.Lock()
+	granted := make(chan struct{})
+	s.waiters = append(s.waiters, granted)
+	s.mu.Unlock()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-granted:
+		return true
+	case <-expired:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.waiters {
+		if w == granted {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return false
+		}
+	}
+	// the slot was handed over as the wait ended, it goes to the next
+	s.releaseLocked()
+	return false
+}
+
+// Gives the slot to the connection waiting longest, or frees it
+func (s *slots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *slots) releaseLocked() {
+	// a slot taken away by resize while held isn't handed on
+	if s.free < 0 {
+		s.free++
+		return
+	}
+	if len(s.waiters) > 0 {
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+		return
+	}
+	s.free++
+}
+
+// Changes how many slots there are, returning how many there were. The
+// slots added go to those waiting, those taken away while held are gone once
+// released.
+func (s *slots) resize(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.size
+	s.size, s.free = n, s.free+n-old
+	for s.free > 0 && len(s.waiters) > 0 {
+		s.free--
+		close(s.waiters[0])
+		s.waiters = s.waiters[1:]
+	}
+	return old
+}
+
+// Returns the number of slots
+func (s *slots) cap() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Returns how many connections are waiting for a slot
+func (s *slots) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
+
+// Accepts connections on the listener until it is closed, handing each one
+// off to a connHandler once one of its slots is free. What happens while
+// all slots are taken depends on the listener's saturation policy. Under
+// the block policy with an accept wait the connections are accepted and
+// wait their turn for a slot, those still waiting after it are answered
+// ERR BUSY; without one the next connection is only accepted once there is
+// a slot.
+func (s *Server) serve(ctx context.Context, l *listener, acceptor net.Listener) error {
+	queue := l.saturation == SaturateBlock && l.acceptWait > 0
+	retry := time.Duration(0)
+	for {
+		// the slot is freed by the connections the context closes
+		if l.saturation == SaturateBlock && !queue {
+			l.slots.acquire(context.Background(), 0)
+		}
+		conn, err := acceptor.Accept()
+		if err != nil {
+			if l.saturation == SaturateBlock && !queue {
+				l.slots.release()
+			}
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, ErrInputEnded) {
+				return err
+			}
+			// out of file descriptors or the like, backing off while it lasts
+			retry = min(max(2*retry, acceptRetryMin), acceptRetryMax)
+			slog.Warn("accept failed", "listener", l.name, "err", err, "retry", retry)
+			select {
+			case <-time.After(retry):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		retry = 0
+
+		atomic.AddUint64(&l.stats.connections, 1)
+		switch {
+		case queue:
+			go s.queued(ctx, conn, l)
+		case l.saturation == SaturateBlock || l.slots.tryAcquire():
+			go s.connHandler(ctx, conn, l, false)
+		case l.saturation == SaturateReject:
+			s.saturation.reject()
+			go func() {
+				writeBusy(conn, "")
+				conn.Close()
+			}()
+		default:
+			// over the cap, admitted without a slot but only sampled
+			go s.connHandler(ctx, conn, l, true)
+		}
+	}
+}
+
+// Waits for a slot for the connection, turning it away with ERR BUSY if
+// none is free within the listener's accept wait
+func (s *Server) queued(ctx context.Context, conn net.Conn, l *listener) {
+	if !l.slots.acquire(ctx, l.acceptWait) {
+		if ctx.Err() == nil {
+			s.saturation.reject()
+			slog.Warn("client turned away", "listener", l.name, "remote", conn.RemoteAddr().String(), "reason", "no connection slot", "waited", l.acceptWait)
+			writeBusy(conn, "")
+		}
+		conn.Close()
+		return
+	}
+	s.connHandler(ctx, conn, l, false)
+}
+
+// Handles all the data incoming for the given connection, until the
+// context is done and the connection is closed under it
+func (s *Server) connHandler(ctx context.Context, conn net.Conn, l *listener, overCap bool) {
+	// everything logged about the connection names it by remote address
+	// and correlation ID
+	id := newCorrelationID()
+	remote := conn.RemoteAddr()
+	logger := connLogger(id, remote)
+	defer s.isolateConn(logger, func() { conn.Close() })
+	closing := context.AfterFunc(ctx, func() { conn.Close() })
+	defer closing()
+	// connections admitted over the cap don't hold a slot
+	if !overCap {
+		defer l.slots.release()
+	}
+	// the access lists are checked here rather than in the accept loop,
+	// with the PROXY protocol the address is only known once the header has
+	// been read
+	release, err := s.Access.admit(hostOf(remote))
+	if err != nil {
+		logger.Warn("client refused", "err", err)
+		if errors.Is(err, ErrBusy) {
+			writeBusy(conn, "")
+		}
+		conn.Close()
+		return
+	}
+	defer release()
+	s.inflight.add(conn)
+	defer s.inflight.done(conn)
+	s.conns.open(l, hostOf(remote))
+	defer s.conns.close(l, hostOf(remote))
+	in := s.intake(l, overCap)
+	lim := s.limiter(l)
+	stages := newStageLabels(l.name, "")
+	enterStage(stages.read)
+
+	// a client that stays silent for the idle timeout gives up its slot,
+	// line listeners need a complete line within it
+	var src io.Reader = conn
+	if l.idleTimeout > 0 {
+		conn.SetReadDeadline(s.inflight.readDeadline(l.idleTimeout))
+		if l.protobuf {
+			src = idleReader{conn: conn, idle: l.idleTimeout, tracker: &s.inflight}
+		}
+	}
+
+	// gzip, zstd and snappy compressed streams are detected from their first
+	// bytes
+	reader, releaseReader, err := newLineReader(src)
+	if err != nil {
+		if s.idleTimedOut(l, err) {
+			err = fmt.Errorf("idle for more than %v", l.idleTimeout)
+		}
+		logTermination(logger, err)
+		conn.Close()
+		return
+	}
+	defer releaseReader()
+
+	// tag everything from this connection with the verified client identity
+	client := clientCN(conn)
+	if client != "" {
+		logger.Info("client authenticated", "client", client)
+		stages = newStageLabels(l.name, client)
+		enterStage(stages.read)
+	}
+
+	if l.protobuf {
+		// batches are decoded and ingested as they are read
+		enterStage(stages.ingest)
+		limited := false
+		err := parser.ReadBatches(reader, func(m parser.Metric) {
+			if limited {
+				return
+			}
+			if err := lim.allow(); err != nil {
+				// closing fails the next read
+				if limited = lim.action == RateDisconnect; limited {
+					conn.Close()
+				}
+				return
+			}
+			m.Client, m.Tenant = client, l.tenant
+			s.ingest(&m, hostOf(remote), in)
+		})
+		if s.idleTimedOut(l, err) {
+			err = fmt.Errorf("idle for more than %v", l.idleTimeout)
+		}
+		if limited {
+			err = ErrRateExceeded
+		}
+		logTermination(logger, err)
+		conn.Close()
+		return
+	}
+
+	lineBuf := getLineBuffer()
+	defer putLineBuffer(lineBuf)
+
+	// control commands are only accepted before the first metric
+	var ack *acker
+	var seq *sequencer
+	var reply *replier
+	budget := errorBudget{limit: l.errorBudget, window: l.errorWindow}
+	handshake := true
+	// once the client asks for the correlation ID it is in every answer
+	answerID := ""
+	// the tenant the client authenticated as, or the listener's
+	tenant, authenticated := l.tenant, false
+
+	for {
+		// read the input
+		enterStage(stages.read)
+		if l.idleTimeout > 0 {
+			conn.SetReadDeadline(s.inflight.readDeadline(l.idleTimeout))
+		}
+		b, err := readLine(reader, l.maxLine, lineBuf)
+		atomic.AddUint64(&s.lines.read, uint64(len(b)))
+		// a line over the limit was discarded, it is rejected like a
+		// malformed one
+		var perr error
+		if errors.Is(err, parser.ErrTooLong) {
+			atomic.AddUint64(&s.tooLong, 1)
+			perr = err
+		} else if err != nil {
+			if s.idleTimedOut(l, err) {
+				err = fmt.Errorf("no complete line within %v", l.idleTimeout)
+			}
+			logTermination(logger, err)
+			conn.Close()
+			return
+		}
+
+		// trim off unnecessary chars, the line stays in the read buffer
+		line := bytes.Trim(b, "\r\n")
+		if len(line) == 0 && perr == nil {
+			logger.Info("client terminated", "reason", "empty input")
+			conn.Close()
+			return
+		}
+
+		if handshake {
+			if cmd, args, ok := parseCommand(string(line)); ok {
+				switch cmd {
+				case "ACK":
+					ack, err = newAcker(conn, args)
+				case "SEQ":
+					seq, err = newSequencer(conn, s.Sessions, client, args)
+				case "REPLY":
+					reply, err = newReplier(conn, args)
+				case "AUTH":
+					if len(args) != 1 {
+						err = fmt.Errorf("invalid command: AUTH takes one argument")
+					} else if l.format == "peer" {
+						// the peers forward with the cluster token, not a tenant's
+						if authenticated = s.Cluster.Authenticate(args[0]); !authenticated {
+							err = ErrUnauthenticated
+						}
+					} else if name, ok := s.Credentials.Authenticate(args[0]); ok {
+						tenant, authenticated = name, true
+						in.token = TokenID(args[0])
+						logger.Info("client authenticated", "tenant", tenant)
+						stages = newStageLabels(l.name, tenant)
+					} else {
+						err = ErrUnauthenticated
+					}
+				case "HINTS":
+					if len(args) != 0 {
+						err = fmt.Errorf("invalid command: HINTS takes no arguments")
+					} else {
+						s.inflight.hintable(conn)
+					}
+				case "ID":
+					var given string
+					if given, err = correlationCommand(id, args); err == nil {
+						if given != id {
+							logger.Info("client correlation ID", "given", given)
+							id, logger = given, connLogger(given, remote)
+						}
+						answerID = id
+						_, err = fmt.Fprintf(conn, "ID %s\n", id)
+					}
+				}
+				if err != nil {
+					logger.Warn("client terminated", "err", err)
+					if err == ErrUnauthenticated {
+						writeAuthError(conn)
+					}
+					conn.Close()
+					return
+				}
+				continue
+			}
+			handshake = false
+			if l.requireAuth && !authenticated {
+				logger.Warn("client terminated", "err", ErrUnauthenticated)
+				writeAuthError(conn)
+				conn.Close()
+				return
+			}
+			if ack != nil {
+				ack.id = answerID
+			}
+			if seq != nil {
+				seq.id = answerID
+			}
+		}
+
+		// numbered lines are applied once per session
+		var number uint64
+		if seq != nil && perr == nil {
+			if number, line, err = splitSequence(line); err != nil {
+				logger.Warn("client terminated", "err", err)
+				conn.Close()
+				return
+			}
+		}
+
+		// lines over the rate limits are held up, dropped or end the
+		// connection
+		var limited error
+		if perr == nil {
+			if limited = lim.allow(); limited != nil && lim.action == RateDisconnect {
+				logger.Warn("client terminated", "err", limited)
+				conn.Close()
+				return
+			}
+		}
+
+		// parse the metrics, in REPLY mode a bad line is only answered and
+		// otherwise it is skipped until the error budget runs out
+		enterStage(stages.parse)
+		var metrics []parser.Metric
+		if perr == nil && limited == nil {
+			metrics, perr = l.parse.Bytes(line)
+		}
+		if perr != nil {
+			if !errors.Is(perr, parser.ErrTooLong) {
+				s.countMalformed(perr)
+			}
+			logger.Warn("line rejected", "err", perr)
+			s.DeadLetters.record(string(line), perr, false, l.name, remote.String())
+			if reply == nil && budget.exhausted(s.now()) {
+				if budget.limit > 0 {
+					logger.Warn("client terminated", "reason", "error budget exhausted", "malformed", budget.limit, "within", budget.window)
+				}
+				conn.Close()
+				return
+			}
+		}
+
+		enterStage(stages.ingest)
+		// what became of the line, nil for a replay
+		var result error
+		apply := func() error {
+			// a dropped line may be resent
+			if limited != nil {
+				result = limited
+				return ErrBusy
+			}
+			result = perr
+			// a batch is rejected whole
+			if l.batch != "" && len(metrics) > 1 {
+				if err := s.checkBatch(metrics, l.names); err != nil {
+					logger.Debug("batch rejected", "err", err)
+					s.DeadLetters.record(string(line), err, true, l.name, remote.String())
+					result = err
+					return nil
+				}
+			}
+			// the line is only left to be resent if none of it got through
+			busy := 0
+			for i := range metrics {
+				metrics[i].Tenant = tenant
+				// a peer's lines carry the client they came in from
+				if !in.peer {
+					metrics[i].Client = client
+				}
+				err := s.ingest(&metrics[i], hostOf(remote), in)
+				if err != nil {
+					logger.Debug("metric rejected", "metric", metrics[i].Key(), "err", err)
+					s.DeadLetters.record(string(line), err, true, l.name, remote.String())
+				}
+				if err != nil && result == nil {
+					result = err
+				}
+				if errors.Is(err, ErrBusy) {
+					busy++
+					if in.policy == SaturateReject && reply == nil {
+						writeBusy(conn, answerID)
+					}
+				}
+			}
+			if busy > 0 && busy == len(metrics) {
+				return ErrBusy
+			}
+			return nil
+		}
+		if seq == nil || number == 0 {
+			apply()
+		} else if err := seq.apply(number, apply); err != nil && !errors.Is(err, ErrBusy) {
+			logger.Warn("client terminated", "err", err)
+			conn.Close()
+			return
+		}
+
+		if reply != nil {
+			if err := reply.result(result, reader.Buffered() == 0); err != nil {
+				logTermination(logger, err)
+				conn.Close()
+				return
+			}
+		}
+		if seq != nil {
+			if err := seq.flush(reader.Buffered() == 0); err != nil {
+				logTermination(logger, err)
+				conn.Close()
+				return
+			}
+		}
+		if ack != nil {
+			if err := ack.applied(reader.Buffered() == 0); err != nil {
+				logTermination(logger, err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Receives datagrams on the packet listener, each one may carry several
+// newline separated metric lines
+func (s *Server) servePackets(l *listener, pc net.PacketConn) error {
+	// there is no one to answer so rejecting just drops the metric
+	in := s.intake(l, false)
+	lim := s.limiter(l)
+	stages := newStageLabels(l.name, "")
+	buf := make([]byte, 64*1024)
+	for {
+		enterStage(stages.read)
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Warn("datagram read failed", "listener", l.name, "err", err)
+			continue
+		}
+		atomic.AddUint64(&s.lines.read, uint64(n))
+
+		s.packet(l, in, lim, buf[:n], from, stages)
+	}
+}
+
+// Ingests the lines of one datagram, a panic only loses the datagram
+func (s *Server) packet(l *listener, in *intake, lim *limiter, b []byte, from net.Addr, stages stageLabels) {
+	// each datagram is a batch of its own
+	id := newCorrelationID()
+	where := fmt.Sprintf("%s id=%s", from, id)
+	defer s.Isolate("packet ("+where+")", nil)
+	if !s.Access.allowed(hostOf(from)) {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		// there is no connection to close, lines over the rate are only
+		// dropped
+		if lim.allow() != nil {
+			continue
+		}
+		// a bad line only costs itself, there is no connection to drop
+		enterStage(stages.parse)
+		metrics, err := l.parse(line)
+		if err != nil {
+			s.countMalformed(err)
+			slog.Warn("line rejected", "conn", id, "remote", from.String(), "err", err)
+			s.DeadLetters.record(line, err, false, l.name, from.String())
+			continue
+		}
+		enterStage(stages.ingest)
+		if l.batch != "" && len(metrics) > 1 {
+			if err := s.checkBatch(metrics, l.names); err != nil {
+				slog.Debug("batch rejected", "conn", id, "remote", from.String(), "err", err)
+				s.DeadLetters.record(line, err, true, l.name, from.String())
+				continue
+			}
+		}
+		for i := range metrics {
+			metrics[i].Tenant = l.tenant
+			if err := s.ingest(&metrics[i], hostOf(from), in); err != nil {
+				slog.Debug("metric rejected", "conn", id, "remote", from.String(), "metric", metrics[i].Key(), "err", err)
+				s.DeadLetters.record(line, err, true, l.name, from.String())
+			}
+		}
+	}
+}
+
+// Ingest hands a metric through the acceptance rules to the store as a
+// listener would, waiting while the store is saturated. The host is the
+// metric's producer unless it has a client identity.
+func (s *Server) Ingest(metric *parser.Metric, host string) error {
+	in := &intake{policy: SaturateBlock, dropped: &s.saturation, listener: host}
+	return s.ingest(metric, host, in)
+}
+
+// Returns ErrTooOld or ErrTooNew if the timestamp is outside the acceptance
+// window at now
+func (s *Server) checkTime(t, now time.Time) error {
+	if t.Before(now.Add(-s.MaxAge)) {
+		return ErrTooOld
+	}
+	if t.After(now.Add(s.MaxSkew)) {
+		return ErrTooNew
+	}
+	return nil
+}
+
+// Applies the acceptance rules shared by every transport and hands the
+// metric over to the store. ErrNotFinite or ErrNegative is returned for a
+// value the value policy rejects, ErrStaleTimestamp for a metric
+// outside the acceptance window, ErrBusy if the saturation policy or the
+// tenant's rate turned it away and ErrOverQuota if the tenant may not add the
+// series.
+func (s *Server) ingest(metric *parser.Metric, host string, in *intake) error {
+	// scrub first so PII never reaches the capture file or the store
+	name := metric.Name
+	s.Scrub.apply(metric)
+	if metric.Name == "" {
+		return nil
+	}
+	if metric.Name != name && !in.names.Valid(metric.Name) {
+		atomic.AddUint64(&s.lines.badName, 1)
+		return ErrRewrittenName
+	}
+	s.Normalize.apply(metric)
+	if s.reserved(metric.Name) {
+		atomic.AddUint64(&s.lines.badName, 1)
+		return ErrReservedName
+	}
+	// names filtered out are dropped as if never sent
+	if !s.Filter.allowed(metric.Name) {
+		return nil
+	}
+	if err := s.checkValue(metric); err != nil {
+		return err
+	}
+	// each tenant's metrics are kept apart by a tenant tag
+	if err := tagTenant(metric); err != nil {
+		return err
+	}
+	// what a peer forwarded was attributed where it came in
+	if !in.peer {
+		s.Attribution.apply(metric, host, in)
+	}
+
+	// drop the record if its timestamp is outside the acceptance window
+	switch err := s.checkTime(metric.Time, s.now()); err {
+	case ErrTooOld:
+		atomic.AddUint64(&s.tooOld, 1)
+		return err
+	case ErrTooNew:
+		atomic.AddUint64(&s.tooNew, 1)
+		return err
+	}
+
+	// a retried line was already counted
+	if s.Dedup.duplicate(metric) {
+		return nil
+	}
+
+	// the tenant must be within its quotas
+	if err := s.Tenants.admit(metric); err != nil {
+		s.Dedup.forget(metric)
+		return err
+	}
+
+	// quarantined producers are captured for investigation, not aggregated
+	if !in.peer || metric.Producer == "" {
+		metric.Producer = host
+		if metric.Client != "" {
+			metric.Producer = metric.Client
+		}
+	}
+	if s.Quarantine.contains(host, metric.Client, in.token) {
+		if err := s.Quarantine.capture.write(metric.Producer, *metric); err != nil {
+			slog.Error("quarantine capture failed", "producer", metric.Producer, "err", err)
+		}
+		return nil
+	}
+
+	// a name another collector of the cluster owns is aggregated there,
+	// what a peer forwarded is aggregated here whoever owns it
+	if !in.peer {
+		if forwarded, err := s.Cluster.forward(*metric); forwarded {
+			if err != nil {
+				s.Dedup.forget(metric)
+			}
+			return err
+		}
+	}
+
+	// save the metric to the store
+	if err := in.deliver(s.Store, *metric); err != nil {
+		s.Dedup.forget(metric)
+		return err
+	}
+
+	if s.Relay != nil {
+		s.Relay(*metric)
+	}
+
+	// increment our raw 10 min counter
+	atomic.AddUint64(&s.records, 1)
+	if in.stats != nil {
+		atomic.AddUint64(&in.stats.records, 1)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestReportRejections(t *testing.T) {
+	s := New(&fullStore{})
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 1, ReusePort: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	conn, err := net.Dial("tcp", s.listeners[0].acceptors[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	now := time.Now().Unix()
+	lines := []string{
+		fmt.Sprintf("cpu\t1\t%d", now),
+		fmt.Sprintf("cpu load\t1\t%d", now),
+		fmt.Sprintf("cpu\tmany\t%d", now),
+		"cpu\t1\tyesterday",
+		"cpu",
+		fmt.Sprintf("cpu\t1\t%d", now-3600),
+		fmt.Sprintf("cpu\t1\t%d", now+3600),
+	}
+	sent := "REPLY\n" + strings.Join(lines, "\n") + "\n"
+	conn.Write([]byte(sent))
+	answers := bufio.NewScanner(conn)
+	for i := 0; i < len(lines) && answers.Scan(); i++ {
+	}
+
+	var report bytes.Buffer
+	s.Report(&report)
+	want := fmt.Sprintf("Lines accepted 1, rejected 6 (bad name 1, bad value 1, bad timestamp 1, malformed 1, stale 1, future 1, too long 0, rate limited 0), bytes read %d", len(sent))
+	if !strings.Contains(report.String(), want) {
+		t.Errorf("Report(); got %q, want %q", report.String(), want)
+	}
+}
+
+func TestConnectionCounts(t *testing.T) {
+	s := New(&fullStore{})
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 5, ReusePort: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+	addr := s.listeners[0].acceptors[0].Addr().String()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitActive := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.status().Connections != want && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitActive(2)
+	st := s.status()
+	if st.Connections != 2 || st.PeakConnections != 2 || st.ConnectionsByHost["127.0.0.1"] != 2 {
+		t.Errorf("status(); got %d connections, peak %d, by host %v, want 2 from 127.0.0.1", st.Connections, st.PeakConnections, st.ConnectionsByHost)
+	}
+
+	conns[0].Close()
+	waitActive(1)
+	var report bytes.Buffer
+	s.Report(&report)
+	if want := "Connections opened 2, closed 1, active 1, peak 2, from 1 hosts (127.0.0.1 1)"; !strings.Contains(report.String(), want) {
+		t.Errorf("Report(); got %q, want %q", report.String(), want)
+	}
+	st = s.status()
+	if l := st.Listeners[0]; l.PeakConnections != 2 || l.Closed != 1 || l.ActiveConnections != 1 {
+		t.Errorf("status() listener; got %+v, want peak 2, closed 1, active 1", l)
+	}
+}
+
+// emfileListener fails every accept as if out of file descriptors
+type emfileListener struct {
+	accepts atomic.Int64
+}
+
+func (e *emfileListener) Accept() (net.Conn, error) {
+	e.accepts.Add(1)
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+}
+
+func (e *emfileListener) Close() error   { return nil }
+func (e *emfileListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServeBacksOff(t *testing.T) {
+	s := New(&fullStore{})
+	acceptor := &emfileListener{}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := s.serve(ctx, &listener{name: "test", saturation: SaturateReject}, acceptor)
+	if err != context.DeadlineExceeded {
+		t.Errorf("serve() as the context ends; got %v, want its error", err)
+	}
+	// 5ms doubling up to 200ms is a handful of tries, not a busy loop
+	if n := acceptor.accepts.Load(); n > 10 {
+		t.Errorf("accepts in 200ms of EMFILE; got %d, want a few", n)
+	}
+}
+
+// readConn is a connection reading the lines it was given and discarding
+// the answers
+type readConn struct {
+	r *bytes.Reader
+}
+
+func (c *readConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *readConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *readConn) Close() error                { return nil }
+func (c *readConn) LocalAddr() net.Addr         { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8125} }
+func (c *readConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+func (c *readConn) SetDeadline(time.Time) error      { return nil }
+func (c *readConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *readConn) SetWriteDeadline(time.Time) error { return nil }
+
+// The connection handler's loop over a stream of tsv lines, from reading
+// each line to the store taking its metric
+func BenchmarkConnHandler(b *testing.B) {
+	s := New(store.NewStore(store.Options{}))
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "tsv", MaxConns: 1, ReusePort: 1}); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	l := s.listeners[0]
+	now := time.Now().UTC().Format(parser.ISO8601Format)
+	var lines bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		fmt.Fprintf(&lines, "cpu-%d\t0.75\t%s\n", i%100, now)
+	}
+	b.SetBytes(int64(lines.Len() / b.N))
+	b.ReportAllocs()
+	b.ResetTimer()
+	l.slots.acquire(context.Background(), 0)
+	s.connHandler(context.Background(), &readConn{r: bytes.NewReader(lines.Bytes())}, l, false)
+	b.StopTimer()
+	if got := atomic.LoadUint64(&s.records); got != uint64(b.N) {
+		b.Fatalf("ingested %d records; want %d", got, b.N)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// inflight tracks the connections being handled so they can be drained on
+// shutdown
+var inflight connTracker
+
+// connTracker is the set of open client connections
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	// those whose clients take rebalancing hints
+	hints map[net.Conn]struct{}
+	// set once draining starts, later connections get it straight away
+	deadline time.Time
+	wg       sync.WaitGroup
+}
+
+func (t *connTracker) add(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	if !t.deadline.IsZero() {
+		conn.SetReadDeadline(t.deadline)
+	}
+	t.wg.Add(1)
+}
+
+func (t *connTracker) done(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	delete(t.hints, conn)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// Gives the open connections until the timeout to finish sending, then
+// closes whatever is left. Returns how many had to be closed. Clients taking
+// hints are asked to reconnect first.
+func (t *connTracker) drain(timeout time.Duration) int {
+	t.rebalance(1, "")
+	deadline := time.Now().Add(timeout)
+	t.mu.Lock()
+	t.deadline = deadline
+	for conn := range t.conns {
+		conn.SetReadDeadline(deadline)
+	}
+	t.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return 0
+	case <-time.After(timeout + time.Second):
+	}
+
+	// the read deadline can be reset underneath us, e.g. while reading a
+	// PROXY header, so fall back to closing
+	t.mu.Lock()
+	n := len(t.conns)
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	<-drained
+	return n
+}
+
+// Returns the remote and local address of each connection being handled
+func (t *connTracker) list() [][2]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([][2]string, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, [2]string{conn.RemoteAddr().String(), conn.LocalAddr().String()})
+	}
+	return conns
+}
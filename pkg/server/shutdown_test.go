@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerDrain(t *testing.T) {
+	var tracker connTracker
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// a handler that reads until its connection fails
+	tracker.add(server)
+	go func() {
+		defer tracker.done(server)
+		io.Copy(io.Discard, server)
+	}()
+
+	start := time.Now()
+	if n := tracker.drain(50 * time.Millisecond); n != 0 {
+		t.Errorf("drain(); got %d closed, want the read deadline to end the handler", n)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("drain(); returned after %v, before the deadline", elapsed)
+	}
+
+	// connections arriving while draining get the deadline too
+	late, _ := net.Pipe()
+	tracker.add(late)
+	if _, err := late.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Read() on a late connection; got no error")
+	}
+	tracker.done(late)
+}
+
+func TestServeContext(t *testing.T) {
+	s := New(&fullStore{})
+	if err := s.Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0", Format: "statsd", MaxConns: 1, ReusePort: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.ServeContext(ctx) }()
+
+	conn, err := net.Dial("tcp", s.listeners[0].acceptors[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("a.b:1|c\n"))
+
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ServeContext(); got %v, want the context's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeContext(); still serving after the context was cancelled")
+	}
+	// the connection still open is closed under the client
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Read(); got nil error, want the connection closed")
+	}
+	if ready, _ := s.Ready(); ready {
+		t.Error("Ready(); got ready after the context was cancelled")
+	}
+}
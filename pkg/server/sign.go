@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Signer produces a signature over each flush emission so downstream
+// consumers can verify the aggregates weren't altered and came from us
+type Signer interface {
+	algorithm() string
+	// starts a signature, the emission is written to it as it streams past
+	digest() signatureDigest
+}
+
+type signatureDigest interface {
+	io.Writer
+	sum() []byte
+}
+
+// hmacSigner signs with HMAC-SHA256 using a shared secret
+type hmacSigner struct {
+	key []byte
+}
+
+func (s hmacSigner) algorithm() string { return "hmac-sha256" }
+
+func (s hmacSigner) digest() signatureDigest {
+	return hmacDigest{hmac.New(sha256.New, s.key)}
+}
+
+type hmacDigest struct {
+	hash.Hash
+}
+
+func (d hmacDigest) sum() []byte { return d.Sum(nil) }
+
+// ed25519Signer signs with an Ed25519 private key in its prehashed form,
+// Ed25519ph (RFC 8032), consumers only need the public half to verify
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+func (s ed25519Signer) algorithm() string { return "ed25519ph" }
+
+// Ed25519ph signs the SHA-512 of the emission, hashed as it streams past
+func (s ed25519Signer) digest() signatureDigest {
+	return ed25519Digest{key: s.key, Hash: sha512.New()}
+}
+
+type ed25519Digest struct {
+	key ed25519.PrivateKey
+	hash.Hash
+}
+
+func (d ed25519Digest) sum() []byte {
+	sig, err := d.key.Sign(nil, d.Sum(nil), &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		// only a malformed key or digest fails, neither can be
+		panic(err)
+	}
+	return sig
+}
+
+// Loads the signing key for the algorithm. HMAC keys are the raw file
+// contents, Ed25519 keys are PKCS#8 PEM as written by
+// `openssl genpkey -algorithm ed25519`.
+func LoadSigner(alg, keyFile string) (Signer, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %v", err)
+	}
+	switch alg {
+	case "hmac", "hmac-sha256":
+		key := bytes.TrimSpace(b)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("empty HMAC key in %s", keyFile)
+		}
+		return hmacSigner{key}, nil
+	case "ed25519":
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in %s", keyFile)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Ed25519 key: %v", err)
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s does not contain an Ed25519 key", keyFile)
+		}
+		return ed25519Signer{edKey}, nil
+	}
+	return nil, fmt.Errorf("unknown signing algorithm %q", alg)
+}
+
+// Returns the trailer line emitted after a signed flush. It starts with '#'
+// which can never begin a metric name so consumers can tell it apart.
+func SignatureLine(s Signer, emission []byte) string {
+	d := s.digest()
+	d.Write(emission)
+	return signatureLine(s, d)
+}
+
+func signatureLine(s Signer, d signatureDigest) string {
+	sig := base64.StdEncoding.EncodeToString(d.sum())
+	return fmt.Sprintf("#signature\t%s\t%s\n", s.algorithm(), sig)
+}
+
+// SignedWriter passes a flush emission through to the underlying writer
+// while signing it, so large flushes can be streamed. Close appends the
+// signature line unless nothing was written.
+type SignedWriter struct {
+	w      io.Writer
+	signer Signer
+	digest signatureDigest
+	n      int
+}
+
+// Returns a writer signing everything written through it with s. A nil
+// signer passes the emission through unsigned.
+func NewSignedWriter(w io.Writer, s Signer) *SignedWriter {
+	sw := &SignedWriter{w: w, signer: s}
+	if s != nil {
+		sw.digest = s.digest()
+	}
+	return sw
+}
+
+func (sw *SignedWriter) Write(b []byte) (int, error) {
+	n, err := sw.w.Write(b)
+	if sw.digest != nil {
+		sw.digest.Write(b[:n])
+	}
+	sw.n += n
+	return n, err
+}
+
+// Writes the signature line, it does not close the underlying writer
+func (sw *SignedWriter) Close() error {
+	if sw.digest == nil || sw.n == 0 {
+		return nil
+	}
+	_, err := io.WriteString(sw.w, signatureLine(sw.signer, sw.digest))
+	return err
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSignatureLine(t *testing.T) {
+	emission := []byte("asdf \t 1.5\n")
+
+	h := hmacSigner{[]byte("secret")}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(emission)
+	want := "#signature\thmac-sha256\t" + base64.StdEncoding.EncodeToString(mac.Sum(nil)) + "\n"
+	if got := SignatureLine(h, emission); got != want {
+		t.Errorf("signatureLine(hmac); got %q, want %q", got, want)
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	fields := strings.Split(strings.TrimSpace(SignatureLine(ed25519Signer{priv}, emission)), "\t")
+	sig, _ := base64.StdEncoding.DecodeString(fields[2])
+	digest := sha512.Sum512(emission)
+	if fields[1] != "ed25519ph" || ed25519.VerifyWithOptions(pub, digest[:], sig, &ed25519.Options{Hash: crypto.SHA512}) != nil {
+		t.Errorf("signatureLine(ed25519); signature did not verify")
+	}
+
+	// streamed in pieces the signature is the same
+	var out strings.Builder
+	sw := NewSignedWriter(&out, h)
+	sw.Write(emission[:4])
+	sw.Write(emission[4:])
+	sw.Close()
+	if got := out.String(); got != string(emission)+want {
+		t.Errorf("SignedWriter(hmac); got %q, want %q", got, string(emission)+want)
+	}
+}
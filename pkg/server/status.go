@@ -0,0 +1,208 @@
+package server
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// statusTotals are the report's counters added up since startup, each
+// report moves what it counted over
+type statusTotals struct {
+	records, tooOld, tooNew, tooLong uint64
+	nonFinite, negative              uint64
+	rateDropped, busy, sampled       uint64
+	duplicates, replayed             uint64
+}
+
+// Returns the counter's count since the last report and moves it to the
+// total
+func tally(counter, total *uint64) uint64 {
+	n := atomic.SwapUint64(counter, 0)
+	atomic.AddUint64(total, n)
+	return n
+}
+
+// flushStatus is the last flush of a window
+type flushStatus struct {
+	At       time.Time `json:"at"`
+	Duration float64   `json:"duration_seconds"`
+	Metrics  int       `json:"metrics"`
+	Partial  []string  `json:"partial,omitempty"`
+}
+
+// flushes holds the last flush of each window by label
+type flushes struct {
+	mu   sync.Mutex
+	last map[string]flushStatus
+}
+
+// Flushed records a flush of the window, for the status document and, with
+// Telemetry, as a timing of the flush
+func (s *Server) Flushed(window string, at time.Time, took time.Duration, metrics int, partial []string) {
+	s.flushes.mu.Lock()
+	defer s.flushes.mu.Unlock()
+	if s.flushes.last == nil {
+		s.flushes.last = make(map[string]flushStatus)
+	}
+	s.flushes.last[window] = flushStatus{At: at.UTC(), Duration: took.Seconds(), Metrics: metrics, Partial: partial}
+	if s.Telemetry {
+		s.feed(parser.Metric{Name: s.telemetryPrefix() + "flush.seconds", Tags: "window=" + window, Type: parser.Timer, Value: took.Seconds(), Time: at})
+	}
+}
+
+// status is the document of GET /status, what the stderr report can't
+// show: totals since startup rather than since the last report, and the
+// state the pipeline is in
+type status struct {
+	Build       BuildInfo `json:"build"`
+	Started     time.Time `json:"started"`
+	Uptime      float64   `json:"uptime_seconds"`
+	Connections int64     `json:"connections"`
+	// the most connections open at once since startup, and those open by
+	// remote host
+	PeakConnections   int64            `json:"peak_connections"`
+	ConnectionsByHost map[string]int   `json:"connections_by_host"`
+	Listeners         []listenerStatus `json:"listeners"`
+	Lines             lineStatus       `json:"lines"`
+	// the updates queued ahead of the store, absent when nothing queues
+	Ingress *ingressStatus `json:"ingress,omitempty"`
+	// the series the window in progress holds, the first window when there
+	// are several
+	Series  int                    `json:"series"`
+	Flushes map[string]flushStatus `json:"flushes,omitempty"`
+	Panics  uint64                 `json:"panics"`
+	Runtime runtimeStatus          `json:"runtime"`
+}
+
+type listenerStatus struct {
+	Name              string `json:"name"`
+	ActiveConnections int64  `json:"active_connections"`
+	PeakConnections   int64  `json:"peak_connections"`
+	// connections accepted waiting for a slot
+	WaitingConnections int    `json:"waiting_connections"`
+	Connections        uint64 `json:"connections"`
+	Closed             uint64 `json:"closed_connections"`
+}
+
+// lineStatus counts the lines since startup, those rejected by reason. A
+// line holding several metrics is counted once for each.
+type lineStatus struct {
+	Accepted uint64            `json:"accepted"`
+	Rejected map[string]uint64 `json:"rejected"`
+}
+
+// runtimeStatus is the state of the Go runtime, for telling a leak of
+// goroutines or memory, or long GC pauses, from a slow pipeline
+type runtimeStatus struct {
+	Goroutines  int    `json:"goroutines"`
+	GOMAXPROCS  int    `json:"gomaxprocs"`
+	HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+	HeapSys     uint64 `json:"heap_sys_bytes"`
+	HeapObjects uint64 `json:"heap_objects"`
+	GCCycles    uint32 `json:"gc_cycles"`
+	// the time stopped for collections since startup, and for the last
+	GCPauseTotal float64 `json:"gc_pause_total_seconds"`
+	GCPauseLast  float64 `json:"gc_pause_last_seconds"`
+}
+
+// Returns the state of the runtime. Reading the memory stats stops the
+// world, briefly.
+func runtimeStats() runtimeStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	rt := runtimeStatus{
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapSys:      mem.HeapSys,
+		HeapObjects:  mem.HeapObjects,
+		GCCycles:     mem.NumGC,
+		GCPauseTotal: time.Duration(mem.PauseTotalNs).Seconds(),
+	}
+	if mem.NumGC > 0 {
+		rt.GCPauseLast = time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).Seconds()
+	}
+	return rt
+}
+
+type ingressStatus struct {
+	Queued   int `json:"queued"`
+	Capacity int `json:"capacity"`
+}
+
+// Returns the status document
+func (s *Server) status() status {
+	now := time.Now()
+	st := status{
+		Build:   s.Build,
+		Started: s.started.UTC(),
+		Uptime:  now.Sub(s.started).Seconds(),
+		Panics:  s.Panics(),
+		Runtime: runtimeStats(),
+	}
+	for _, l := range s.listeners {
+		active := atomic.LoadInt64(&l.stats.active)
+		st.Connections += active
+		st.Listeners = append(st.Listeners, listenerStatus{Name: l.name, ActiveConnections: active, PeakConnections: atomic.LoadInt64(&l.stats.peak), WaitingConnections: l.slots.waiting(),
+			Connections: atomic.LoadUint64(&l.stats.connections), Closed: atomic.LoadUint64(&l.stats.closed)})
+	}
+	st.ConnectionsByHost, st.PeakConnections = s.conns.byHost()
+	sort.Slice(st.Listeners, func(i, j int) bool { return st.Listeners[i].Name < st.Listeners[j].Name })
+
+	st.Lines = s.lineTotals()
+
+	if b, ok := s.Store.(store.Backlogger); ok {
+		if queued, capacity := b.Backlog(); capacity > 0 {
+			st.Ingress = &ingressStatus{Queued: queued, Capacity: capacity}
+		}
+	}
+	st.Series = len(s.Store.Snapshot())
+
+	s.flushes.mu.Lock()
+	if len(s.flushes.last) > 0 {
+		st.Flushes = make(map[string]flushStatus, len(s.flushes.last))
+		for window, f := range s.flushes.last {
+			st.Flushes[window] = f
+		}
+	}
+	s.flushes.mu.Unlock()
+	return st
+}
+
+// Returns the lines accepted and rejected since startup
+func (s *Server) lineTotals() lineStatus {
+	// what was counted since the last report is added to the totals
+	sum := func(counter, total *uint64) uint64 {
+		return atomic.LoadUint64(counter) + atomic.LoadUint64(total)
+	}
+	t := &s.totals
+	lines := lineStatus{
+		Accepted: sum(&s.records, &t.records),
+		Rejected: map[string]uint64{
+			"malformed":    atomic.LoadUint64(&s.malformed),
+			"too_long":     sum(&s.tooLong, &t.tooLong),
+			"too_old":      sum(&s.tooOld, &t.tooOld),
+			"too_new":      sum(&s.tooNew, &t.tooNew),
+			"not_finite":   sum(&s.values.nonFinite, &t.nonFinite),
+			"negative":     sum(&s.values.negative, &t.negative),
+			"rate_limited": sum(&s.rates.dropped, &t.rateDropped),
+			"busy":         sum(&s.saturation.busyRejected, &t.busy),
+			"sampled":      sum(&s.saturation.sampleDropped, &t.sampled),
+			"duplicate":    atomic.LoadUint64(&t.duplicates),
+			"replayed":     atomic.LoadUint64(&t.replayed),
+		},
+	}
+	if s.Dedup != nil {
+		lines.Rejected["duplicate"] += atomic.LoadUint64(&s.Dedup.dropped)
+	}
+	if s.Sessions != nil {
+		lines.Rejected["replayed"] += atomic.LoadUint64(&s.Sessions.replayed)
+	}
+	return lines
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+// ErrInputEnded is returned by Serve once the standard input read by a
+// stdin listener has ended, the collector's cue to shut down
+var ErrInputEnded = errors.New("the standard input ended")
+
+// stdinListener accepts the standard input as its one connection, so lines
+// piped in are handled exactly like a client's
+type stdinListener struct {
+	conn     *stdinConn
+	accepted sync.Once
+	closed   chan struct{}
+	close    sync.Once
+}
+
+// Returns the listener of the standard input, f in the tests
+func newStdinListener(f *os.File) *stdinListener {
+	return &stdinListener{conn: &stdinConn{File: f, done: make(chan struct{})}, closed: make(chan struct{})}
+}
+
+// Accept returns the standard input the first time, then waits for it to
+// end
+func (l *stdinListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.accepted.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	select {
+	case <-l.conn.done:
+		return nil, ErrInputEnded
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting, the standard input is still read to its end
+func (l *stdinListener) Close() error {
+	l.close.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *stdinListener) Addr() net.Addr {
+	return stdinAddr{}
+}
+
+// stdinConn is the standard input as a connection. What the client would
+// be answered is discarded, the standard output holds the report.
+type stdinConn struct {
+	*os.File
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *stdinConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *stdinConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.File.Close()
+}
+
+func (c *stdinConn) LocalAddr() net.Addr {
+	return stdinAddr{}
+}
+
+func (c *stdinConn) RemoteAddr() net.Addr {
+	return stdinAddr{}
+}
+
+// stdinAddr names the standard input, it is the producer of its metrics
+type stdinAddr struct{}
+
+func (stdinAddr) Network() string { return "stdin" }
+func (stdinAddr) String() string  { return "stdin" }
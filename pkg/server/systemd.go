@@ -0,0 +1,131 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed by systemd, see sd_listen_fds(3)
+const listenFDsStart = 3
+
+// activated holds the sockets inherited through systemd socket activation,
+// listeners take the one matching their address instead of binding a new one
+var activated = inheritSockets()
+
+// inheritedSockets are the listening sockets passed to the process. Restarts
+// don't drop connections because systemd keeps the sockets open in between.
+type inheritedSockets struct {
+	acceptors []inheritedSocket
+	packets   []inheritedSocket
+}
+
+type inheritedSocket struct {
+	// the FileDescriptorName= of the socket unit, if any
+	name     string
+	acceptor net.Listener
+	packet   net.PacketConn
+}
+
+func (s inheritedSocket) addr() net.Addr {
+	if s.acceptor != nil {
+		return s.acceptor.Addr()
+	}
+	return s.packet.LocalAddr()
+}
+
+// Picks up the sockets systemd passed in LISTEN_FDS. The variables are
+// unset so they don't leak into child processes.
+func inheritSockets() *inheritedSockets {
+	s := &inheritedSockets{}
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || n <= 0 {
+		return s
+	}
+
+	for i := 0; i < n; i++ {
+		sock := inheritedSocket{}
+		if i < len(names) {
+			sock.name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), "LISTEN_FD_"+strconv.Itoa(listenFDsStart+i))
+		if acceptor, err := net.FileListener(f); err == nil {
+			sock.acceptor = acceptor
+			s.acceptors = append(s.acceptors, sock)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			sock.packet = pc
+			s.packets = append(s.packets, sock)
+		} else {
+			slog.Warn("socket activation: not a socket", "fd", listenFDsStart+i)
+		}
+		f.Close()
+	}
+	return s
+}
+
+// Hands over the inherited socket for the config, if there is one
+func (s *inheritedSockets) take(cfg ListenerConfig) (net.Listener, net.PacketConn, bool) {
+	list := &s.acceptors
+	if cfg.Network == "udp" {
+		list = &s.packets
+	}
+	for i, sock := range *list {
+		if sock.name != cfg.String() && !sameAddr(sock.addr(), cfg.Address) {
+			continue
+		}
+		*list = append((*list)[:i], (*list)[i+1:]...)
+		return sock.acceptor, sock.packet, true
+	}
+	return nil, nil, false
+}
+
+// Closes the inherited sockets no listener claimed, call it once every
+// listener is open
+func CloseUnusedSockets() {
+	activated.closeUnused()
+}
+
+func (s *inheritedSockets) closeUnused() {
+	for _, sock := range append(s.acceptors, s.packets...) {
+		slog.Warn("socket activation: no listener for the socket, closing it", "network", sock.addr().Network(), "address", sock.addr().String())
+		if sock.acceptor != nil {
+			sock.acceptor.Close()
+		} else {
+			sock.packet.Close()
+		}
+	}
+	s.acceptors, s.packets = nil, nil
+}
+
+// Reports whether a bound socket address satisfies a configured one, an
+// unspecified host such as ":4268" matches any address on the port
+func sameAddr(bound net.Addr, address string) bool {
+	switch bound := bound.(type) {
+	case *net.UnixAddr:
+		return bound.Name == address
+	case *net.TCPAddr:
+		want, err := net.ResolveTCPAddr("tcp", address)
+		return err == nil && samePort(bound.IP, bound.Port, want.IP, want.Port)
+	case *net.UDPAddr:
+		want, err := net.ResolveUDPAddr("udp", address)
+		return err == nil && samePort(bound.IP, bound.Port, want.IP, want.Port)
+	}
+	return false
+}
+
+func samePort(ip net.IP, port int, wantIP net.IP, wantPort int) bool {
+	if port != wantPort {
+		return false
+	}
+	if len(wantIP) == 0 || wantIP.IsUnspecified() {
+		return len(ip) == 0 || ip.IsUnspecified()
+	}
+	return ip.Equal(wantIP)
+}
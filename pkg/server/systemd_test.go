@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+type sameAddrTestCase struct {
+	bound   net.Addr
+	address string
+	want    bool
+}
+
+var sameAddrTestCases = []sameAddrTestCase{
+	{&net.TCPAddr{IP: net.IPv6unspecified, Port: 4268}, ":4268", true},
+	{&net.TCPAddr{Port: 4268}, "0.0.0.0:4268", true},
+	{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4268}, "127.0.0.1:4268", true},
+	{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4268}, ":4268", false},
+	{&net.TCPAddr{IP: net.IPv6unspecified, Port: 4268}, ":4269", false},
+	{&net.UDPAddr{IP: net.IPv6unspecified, Port: 8125}, ":8125", true},
+	{&net.UnixAddr{Name: "/run/collector.sock", Net: "unix"}, "/run/collector.sock", true},
+	{&net.UnixAddr{Name: "/run/collector.sock", Net: "unix"}, "/tmp/collector.sock", false},
+}
+
+func TestSameAddr(t *testing.T) {
+	for _, tc := range sameAddrTestCases {
+		if got := sameAddr(tc.bound, tc.address); got != tc.want {
+			t.Errorf("sameAddr(%s, %s); got %v, want %v", tc.bound, tc.address, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// TailPoll is how often a tailed file is checked for new lines, and for
+// having been rotated or truncated
+var TailPoll = time.Second
+
+// tailer follows a file like tail -F. When the path is renamed away and a
+// new file takes its place, the rest of the old one is read before the new
+// one from its start; when the file is truncated it is read again from its
+// start. A file that doesn't exist yet is waited for.
+type tailer struct {
+	path string
+	// read the lines the file held when it was first opened, rather than
+	// only those appended since
+	fromStart bool
+	f         *os.File
+	r         *bufio.Reader
+	// the line read so far, and whether it is over the limit and skipped
+	pending []byte
+	long    bool
+	// the path was seen to hold a new file, read once the old one is done
+	rotated bool
+	// the path was opened, or tried, before
+	started bool
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newTailer(path string, fromStart bool) *tailer {
+	return &tailer{path: path, fromStart: fromStart, done: make(chan struct{})}
+}
+
+// Opens the file at the path, at its end when it is there from the start
+// unless reading from the start. Returns false when there is no file yet.
+func (t *tailer) open() bool {
+	first := !t.started
+	t.started = true
+	f, err := os.Open(t.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("tail: open failed", "err", err)
+		}
+		return false
+	}
+	if first && !t.fromStart {
+		f.Seek(0, io.SeekEnd)
+	}
+	t.f, t.pending, t.long, t.rotated = f, t.pending[:0], false, false
+	if t.r == nil {
+		t.r = bufio.NewReaderSize(f, 64*1024)
+	} else {
+		t.r.Reset(f)
+	}
+	return true
+}
+
+// Returns the next line without its newline, valid until the next call,
+// waiting for one to be appended. A line over max bytes is skipped and
+// parser.ErrTooLong returned in its place. Returns net.ErrClosed once the
+// tailer is closed.
+func (t *tailer) next(max int) ([]byte, error) {
+	for {
+		select {
+		case <-t.done:
+			return nil, t.stop()
+		default:
+		}
+		if t.f == nil && !t.open() {
+			if err := t.wait(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b, err := t.r.ReadSlice('\n')
+		if !t.long {
+			t.pending = append(t.pending, b...)
+			if len(t.pending) > max+1 {
+				t.pending, t.long = t.pending[:0], true
+			}
+		}
+		switch {
+		case err == nil:
+			line, long := t.pending, t.long
+			t.pending, t.long = t.pending[:0], false
+			if long || len(line)-1 > max {
+				return nil, parser.ErrTooLong
+			}
+			return line[:len(line)-1], nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case err != io.EOF:
+			return nil, err
+		}
+		if err := t.wait(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Waits for the file to grow. Once the old file of a rotation is read to
+// its end it switches to the new one, a truncated file is read again from
+// its start.
+func (t *tailer) wait() error {
+	if t.rotated {
+		// what the old file holds after its last newline is lost
+		t.f.Close()
+		t.f = nil
+		return nil
+	}
+	select {
+	case <-t.done:
+		return t.stop()
+	case <-time.After(TailPoll):
+	}
+	if t.f == nil {
+		return nil
+	}
+	current, err := t.f.Stat()
+	if err != nil {
+		return nil
+	}
+	if fi, err := os.Stat(t.path); err == nil && !os.SameFile(current, fi) {
+		// whatever was appended to the old file is read before switching
+		t.rotated = true
+		return nil
+	}
+	if pos, err := t.f.Seek(0, io.SeekCurrent); err == nil && current.Size() < pos {
+		t.f.Seek(0, io.SeekStart)
+		t.r.Reset(t.f)
+		t.pending, t.long = t.pending[:0], false
+	}
+	return nil
+}
+
+// Closes the file once the tailer is closed
+func (t *tailer) stop() error {
+	if t.f != nil {
+		t.f.Close()
+		t.f = nil
+	}
+	return net.ErrClosed
+}
+
+// Close stops the tailer before its next line
+func (t *tailer) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// Ingests the lines appended to the tailed file until the listener is
+// closed. Like datagrams, bad lines only cost themselves and lines over the
+// rate limit are dropped unless it throttles.
+func (s *Server) serveTail(l *listener, t *tailer) error {
+	in := s.intake(l, false)
+	lim := s.limiter(l)
+	stages := newStageLabels(l.name, "")
+	for {
+		enterStage(stages.read)
+		line, err := t.next(l.maxLine)
+		if errors.Is(err, parser.ErrTooLong) {
+			atomic.AddUint64(&s.tooLong, 1)
+			s.DeadLetters.record(string(line), err, false, l.name, t.path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.lines.read, uint64(len(line))+1)
+		s.sourceLine(l, in, lim, string(line), t.path, stages)
+	}
+}
+
+// Ingests one line of a source without a client, the path of a tailed file
+// or the topic of an MQTT message, a panic only loses the line
+func (s *Server) sourceLine(l *listener, in *intake, lim *limiter, line, source string, stages stageLabels) {
+	defer s.Isolate(l.network+" ("+source+")", nil)
+	line = strings.TrimRight(line, "\r")
+	if line == "" || lim.allow() != nil {
+		return
+	}
+	enterStage(stages.parse)
+	metrics, err := l.parse(line)
+	if err != nil {
+		s.countMalformed(err)
+		slog.Warn("line rejected", "source", source, "err", err)
+		s.DeadLetters.record(line, err, false, l.name, source)
+		return
+	}
+	enterStage(stages.ingest)
+	if l.batch != "" && len(metrics) > 1 {
+		if err := s.checkBatch(metrics, l.names); err != nil {
+			slog.Debug("batch rejected", "source", source, "err", err)
+			s.DeadLetters.record(line, err, true, l.name, source)
+			return
+		}
+	}
+	for i := range metrics {
+		metrics[i].Tenant = l.tenant
+		if err := s.ingest(&metrics[i], source, in); err != nil {
+			s.DeadLetters.record(line, err, true, l.name, source)
+		}
+	}
+}
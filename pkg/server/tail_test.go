@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestTailer(t *testing.T) {
+	defer func(poll time.Duration) { TailPoll = poll }(TailPoll)
+	TailPoll = time.Millisecond
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	write := func(name, s string) {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+	tail := newTailer(path, false)
+	defer tail.Close()
+	next := func(want string) {
+		t.Helper()
+		line, err := tail.next(16)
+		if err != nil || string(line) != want {
+			t.Fatalf("next(); got %q, %v, want %q", line, err, want)
+		}
+	}
+
+	// the lines there before are skipped, a line is only read once complete
+	write(path, "old\n")
+	tail.open()
+	write(path, "one\ntw")
+	next("one")
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		write(path, "o\n")
+	}()
+	next("two")
+
+	// over the limit
+	write(path, "0123456789abcdefghij\nthree\n")
+	if _, err := tail.next(16); !errors.Is(err, parser.ErrTooLong) {
+		t.Errorf("next() of a long line; got %v, want %v", err, parser.ErrTooLong)
+	}
+	next("three")
+
+	// rotated, the rest of the old file comes first
+	os.Rename(path, path+".1")
+	write(path+".1", "four\n")
+	write(path, "five\n")
+	next("four")
+	next("five")
+
+	// truncated
+	os.Truncate(path, 0)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		write(path, "six\n")
+	}()
+	next("six")
+
+	tail.Close()
+	if _, err := tail.next(16); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("next() once closed; got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestTailerFromStart(t *testing.T) {
+	defer func(poll time.Duration) { TailPoll = poll }(TailPoll)
+	TailPoll = time.Millisecond
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	os.WriteFile(path, []byte("old\n"), 0o644)
+	tail := newTailer(path, true)
+	defer tail.Close()
+	if line, err := tail.next(16); err != nil || string(line) != "old" {
+		t.Errorf("next() from the start; got %q, %v", line, err)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// TelemetryPrefix is the default ReservedPrefix, the names of the
+// collector's own metrics start with it
+const TelemetryPrefix = "collector."
+
+// telemetry holds the totals fed to the store at the last tick, the
+// counters are fed as what they counted since
+type telemetry struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+// RecordTelemetry feeds the server's own counters to the store as metrics
+// under the ReservedPrefix: the connections open and the updates queued ahead
+// of the store as gauges, the lines accepted, rejected by reason, and the
+// panics since the last call as counters. The flushes' durations are fed
+// as they are recorded, see Flushed. Does nothing unless Telemetry is set.
+func (s *Server) RecordTelemetry() {
+	if !s.Telemetry {
+		return
+	}
+	now := time.Now()
+	prefix := s.telemetryPrefix()
+	var connections int64
+	for _, l := range s.listeners {
+		connections += atomic.LoadInt64(&l.stats.active)
+	}
+	s.feed(parser.Metric{Name: prefix + "connections", Type: parser.Gauge, Value: float64(connections), Time: now})
+	if b, ok := s.Store.(store.Backlogger); ok {
+		if queued, capacity := b.Backlog(); capacity > 0 {
+			s.feed(parser.Metric{Name: prefix + "ingress.queued", Type: parser.Gauge, Value: float64(queued), Time: now})
+		}
+	}
+
+	lines := s.lineTotals()
+	s.telemetry.mu.Lock()
+	defer s.telemetry.mu.Unlock()
+	if s.telemetry.last == nil {
+		s.telemetry.last = make(map[string]uint64)
+	}
+	// a counter is fed what it counted since the last tick, the accepted
+	// lines even when that is none
+	count := func(m parser.Metric, total uint64, always bool) {
+		n := total - s.telemetry.last[m.Key()]
+		s.telemetry.last[m.Key()] = total
+		if n > 0 || always {
+			m.Type, m.Value, m.Time = parser.Counter, float64(n), now
+			s.feed(m)
+		}
+	}
+	count(parser.Metric{Name: prefix + "lines.accepted"}, lines.Accepted, true)
+	for reason, total := range lines.Rejected {
+		count(parser.Metric{Name: prefix + "lines.rejected", Tags: "reason=" + reason}, total, false)
+	}
+	count(parser.Metric{Name: prefix + "panics"}, s.Panics(), false)
+}
+
+// Hands one of the collector's own metrics straight to the store, it isn't
+// a client's to be checked or counted
+func (s *Server) feed(m parser.Metric) {
+	m.Producer = "collector"
+	s.Store.Update(m)
+}
+
+// Returns the prefix the server's own metrics are fed under,
+// TelemetryPrefix when none is reserved
+func (s *Server) telemetryPrefix() string {
+	if s.ReservedPrefix == "" {
+		return TelemetryPrefix
+	}
+	return s.ReservedPrefix
+}
+
+// Returns whether the name is under the ReservedPrefix
+func (s *Server) reserved(name string) bool {
+	return s.ReservedPrefix != "" && strings.HasPrefix(name, s.ReservedPrefix)
+}
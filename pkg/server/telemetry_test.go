@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+func TestTelemetry(t *testing.T) {
+	agg := store.NewStore(store.Options{Shards: 4})
+	s := New(agg)
+	s.Telemetry = true
+	now := time.Now()
+	s.Ingest(&parser.Metric{Name: "cpu", Value: 1, Time: now}, "test")
+	s.Ingest(&parser.Metric{Name: "cpu", Value: 1, Time: now.Add(-time.Hour)}, "test")
+	if err := s.Ingest(&parser.Metric{Name: "collector.connections", Value: 1, Time: now}, "test"); !errors.Is(err, ErrReservedName) {
+		t.Errorf("a client's collector.connections; got %v, want %v", err, ErrReservedName)
+	}
+	s.RecordTelemetry()
+	s.Flushed("30s", now, time.Second, 1, nil)
+	// only what was counted since is fed the next time
+	s.Ingest(&parser.Metric{Name: "cpu", Value: 1, Time: now}, "test")
+	s.RecordTelemetry()
+
+	got := make(map[string]parser.Metric)
+	for _, m := range agg.Flush() {
+		got[m.Key()] = m
+	}
+	if m := got["collector.lines.accepted"]; m.Type != parser.Counter || m.Value != 2 || m.Count != 2 {
+		t.Errorf("collector.lines.accepted %+v; want 1 then 1", m)
+	}
+	if m := got["collector.lines.rejected{reason=too_old}"]; m.Value != 1 || m.Count != 1 {
+		t.Errorf("collector.lines.rejected{reason=too_old} %+v; want 1 once", m)
+	}
+	if _, ok := got["collector.lines.rejected{reason=malformed}"]; ok {
+		t.Errorf("a reason that counted nothing was fed")
+	}
+	if m := got["collector.flush.seconds{window=30s}"]; m.Type != parser.Timer || m.Mean != 1 {
+		t.Errorf("collector.flush.seconds{window=30s} %+v; want a timing of 1", m)
+	}
+	if m, ok := got["collector.connections"]; !ok || m.Type != parser.Gauge {
+		t.Errorf("collector.connections %+v; want a gauge", m)
+	}
+}
+
+func TestReservedPrefix(t *testing.T) {
+	agg := store.NewStore(store.Options{Shards: 4})
+	s := New(agg)
+	s.ReservedPrefix = "internal."
+	now := time.Now()
+	// reserved whether or not the server records its own metrics
+	err := s.Ingest(&parser.Metric{Name: "internal.connections", Value: 1, Time: now}, "test")
+	if !errors.Is(err, ErrReservedName) || replyReason(err) != "RESERVED" {
+		t.Errorf("a client's internal.connections; got %v, want %v", err, ErrReservedName)
+	}
+	if err := s.Ingest(&parser.Metric{Name: "collector.connections", Value: 1, Time: now}, "test"); err != nil {
+		t.Errorf("collector.connections under another prefix; got %v", err)
+	}
+	s.Telemetry = true
+	s.RecordTelemetry()
+	got := make(map[string]bool)
+	for _, m := range agg.Flush() {
+		got[m.Name] = true
+	}
+	if !got["internal.connections"] || !got["collector.connections"] {
+		t.Errorf("got %v, want the telemetry under internal. and the client's collector.connections", got)
+	}
+
+	s.ReservedPrefix = ""
+	if err := s.Ingest(&parser.Metric{Name: "internal.connections", Value: 1, Time: now}, "test"); err != nil {
+		t.Errorf("nothing reserved; got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// DefaultSeriesTTL is how long a series unseen still counts against its
+// tenant's series quota
+const DefaultSeriesTTL = 10 * time.Minute
+
+// Quota limits what one tenant may send, zero fields are unlimited
+type Quota struct {
+	// distinct series, by key, seen within the series TTL
+	Series int
+	// metrics per second, for the line formats that is lines. Up to a
+	// second's worth may come in a burst.
+	Rate float64
+}
+
+// TenantQuotas holds the tenants to their quotas and counts what each sent.
+// A tenant over its rate has metrics rejected as busy so clients back off
+// and resend them, one at its series quota can only send series it already
+// has.
+type TenantQuotas struct {
+	// the quota of tenants without one of their own
+	Default   Quota
+	quotas    map[string]Quota
+	seriesTTL time.Duration
+
+	mu    sync.Mutex
+	usage map[string]*tenantUsage
+	now   func() time.Time
+}
+
+// what a tenant sent, the counts are since the last report
+type tenantUsage struct {
+	// when each series was last seen
+	series map[string]time.Time
+	// nil when the tenant has no rate limit
+	rate *tokenBucket
+
+	records, rateLimited, seriesRefused uint64
+}
+
+// Returns the quotas giving every tenant the default unless it has its own
+func NewTenantQuotas(def Quota, quotas map[string]Quota, seriesTTL time.Duration) *TenantQuotas {
+	return &TenantQuotas{Default: def, quotas: quotas, seriesTTL: seriesTTL, usage: make(map[string]*tenantUsage), now: time.Now}
+}
+
+// Parses per tenant quotas, tenant:series=<n>:rate=<n> entries separated by
+// commas. A limit left out is the default's.
+func ParseQuotas(list string, def Quota) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		tenant, q := fields[0], def
+		if !validTenant(tenant) || len(fields) == 1 {
+			return nil, fmt.Errorf("%q: want tenant:series=<n>:rate=<n>", entry)
+		}
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			var err error
+			switch k {
+			case "series":
+				q.Series, err = strconv.Atoi(v)
+				if q.Series < 0 {
+					err = fmt.Errorf("negative")
+				}
+			case "rate":
+				q.Rate, err = strconv.ParseFloat(v, 64)
+				if q.Rate < 0 {
+					err = fmt.Errorf("negative")
+				}
+			default:
+				err = fmt.Errorf("unknown limit, want series or rate")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", tenant, f, err)
+			}
+		}
+		quotas[tenant] = q
+	}
+	return quotas, nil
+}
+
+// Reports whether the name can be a tenant, it must make a valid tag value
+func validTenant(name string) bool {
+	_, err := parser.CanonicalTags([][2]string{{"tenant", name}})
+	return err == nil
+}
+
+// Sets the metric's tenant tag, replacing any the client sent so no tenant
+// can write into another's series. Metrics without a tenant keep their tags.
+func tagTenant(m *parser.Metric) error {
+	if m.Tenant == "" {
+		return nil
+	}
+	tags, err := parser.SetTag(m.Tags, "tenant", m.Tenant)
+	if err != nil {
+		return err
+	}
+	m.Tags = tags
+	return nil
+}
+
+// Charges the tagged metric to its tenant's quotas, ErrRateLimited or
+// ErrTooManySeries is returned if it is over one of them. Metrics without a
+// tenant aren't limited, nor is anything with a nil TenantQuotas.
+func (t *TenantQuotas) admit(m *parser.Metric) error {
+	if t == nil || m.Tenant == "" {
+		return nil
+	}
+	q, ok := t.quotas[m.Tenant]
+	if !ok {
+		q = t.Default
+	}
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usage[m.Tenant]
+	if u == nil {
+		u = &tenantUsage{series: make(map[string]time.Time)}
+		if q.Rate > 0 {
+			u.rate = newTokenBucket(q.Rate, now)
+		}
+		t.usage[m.Tenant] = u
+	}
+
+	key := m.Key()
+	if _, seen := u.series[key]; !seen && q.Series > 0 && len(u.series) >= q.Series {
+		u.seriesRefused++
+		return ErrTooManySeries
+	}
+	if u.rate != nil && !u.rate.take(now) {
+		u.rateLimited++
+		return ErrRateLimited
+	}
+	u.series[key] = now
+	u.records++
+	return nil
+}
+
+// Writes a report line for each tenant that sent anything since the last
+// call, forgetting series past the TTL and tenants with none left
+func (t *TenantQuotas) Report(w io.Writer) {
+	if t == nil {
+		return
+	}
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.usage))
+	for name, u := range t.usage {
+		for key, seen := range u.series {
+			if now.Sub(seen) >= t.seriesTTL {
+				delete(u.series, key)
+			}
+		}
+		if len(u.series) == 0 && u.records == 0 && u.rateLimited == 0 && u.seriesRefused == 0 {
+			delete(t.usage, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := t.usage[name]
+		if u.records == 0 && u.rateLimited == 0 && u.seriesRefused == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "(10 sec): Tenant %s records %d, series %d, rate limited %d, new series refused %d\n", name, u.records, len(u.series), u.rateLimited, u.seriesRefused)
+		u.records, u.rateLimited, u.seriesRefused = 0, 0, 0
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestTenantQuotas(t *testing.T) {
+	def := Quota{Series: 2}
+	quotas, err := ParseQuotas("globex:rate=2, initech:series=0", def)
+	if err != nil {
+		t.Fatalf("ParseQuotas(); got error %v", err)
+	}
+	if quotas["globex"] != (Quota{Series: 2, Rate: 2}) || quotas["initech"] != (Quota{}) {
+		t.Errorf("ParseQuotas(); got %v", quotas)
+	}
+	for _, list := range []string{"acme", "acme:series=-1", "acme:cpu=1", "a=b:rate=1"} {
+		if _, err := ParseQuotas(list, def); err == nil {
+			t.Errorf("ParseQuotas(%s); got nil error", list)
+		}
+	}
+
+	now := time.Now()
+	q := NewTenantQuotas(def, quotas, time.Minute)
+	q.now = func() time.Time { return now }
+	send := func(tenant, name string) error {
+		m := parser.Metric{Name: name, Tenant: tenant, Tags: "tenant=spoofed"}
+		if err := tagTenant(&m); err != nil {
+			t.Fatalf("tagTenant(%s); got error %v", tenant, err)
+		}
+		if tenant != "" && m.Tags != "tenant="+tenant {
+			t.Errorf("tagTenant(%s); got tags %s", tenant, m.Tags)
+		}
+		return q.admit(&m)
+	}
+
+	// acme has the default two series
+	for _, name := range []string{"cpu", "mem", "cpu"} {
+		if err := send("acme", name); err != nil {
+			t.Errorf("admit(acme %s); got error %v", name, err)
+		}
+	}
+	if err := send("acme", "disk"); !errors.Is(err, ErrTooManySeries) {
+		t.Errorf("admit(acme disk); got %v, want ErrTooManySeries", err)
+	}
+	// globex may send two a second
+	for i, want := range []error{nil, nil, ErrRateLimited} {
+		if err := send("globex", "cpu"); err != want {
+			t.Errorf("admit(globex %d); got %v, want %v", i, err, want)
+		}
+	}
+	now = now.Add(500 * time.Millisecond)
+	if err := send("globex", "cpu"); err != nil {
+		t.Errorf("admit(globex) half a second later; got error %v", err)
+	}
+	// initech and metrics without a tenant are unlimited
+	for i := 0; i < 5; i++ {
+		if err := send("initech", strings.Repeat("x", i+1)); err != nil {
+			t.Errorf("admit(initech); got error %v", err)
+		}
+		if err := send("", strings.Repeat("x", i+1)); err != nil {
+			t.Errorf("admit(); got error %v", err)
+		}
+	}
+
+	var b bytes.Buffer
+	q.Report(&b)
+	want := "(10 sec): Tenant acme records 3, series 2, rate limited 0, new series refused 1\n" +
+		"(10 sec): Tenant globex records 3, series 1, rate limited 1, new series refused 0\n" +
+		"(10 sec): Tenant initech records 5, series 5, rate limited 0, new series refused 0\n"
+	if b.String() != want {
+		t.Errorf("Report(); got %q, want %q", b.String(), want)
+	}
+	// once the series expire acme may send new ones
+	now = now.Add(time.Minute)
+	b.Reset()
+	q.Report(&b)
+	if b.Len() != 0 {
+		t.Errorf("Report() with nothing sent; got %q", b.String())
+	}
+	if err := send("acme", "disk"); err != nil {
+		t.Errorf("admit(acme disk) once the series expired; got error %v", err)
+	}
+}
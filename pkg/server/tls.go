@@ -0,0 +1,182 @@
+//go:build !minimal
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long a client has to complete the TLS handshake before it is dropped
+const handshakeTimeout = 10 * time.Second
+
+// The handshakes a listener runs at once, those of the connections accepted
+// and waiting to be taken included. Past them no connection is accepted
+// until one ends, so a flood of slow clients waits in the kernel's backlog.
+const maxHandshakes = 256
+
+// Builds the server side TLS configuration from the PEM encoded certificate
+// and key files. Both files are required. When clientCAFile is set, clients
+// must present a certificate signed by one of the CAs it contains.
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both -tls-cert and -tls-key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading key pair: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Wraps the raw listener of a tls listener so Accept returns connections
+// that completed the handshake, closing it on failure
+func tlsListener(acceptor net.Listener, cfg ListenerConfig) (net.Listener, error) {
+	config, err := newTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+	if err != nil {
+		acceptor.Close()
+		return nil, err
+	}
+	return newHandshakeListener(acceptor, config), nil
+}
+
+// Returns the common name of the verified client certificate, or an empty
+// string when the connection is not TLS or no certificate was presented
+func clientCN(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// handshakeListener completes the TLS handshake for each accepted connection
+// before Accept returns it. This keeps slow or invalid clients out of the
+// connection slots entirely since the handshake happens in its own
+// goroutine rather than in the accept loop.
+type handshakeListener struct {
+	net.Listener
+	config *tls.Config
+	conns  chan net.Conn
+	// a token for every handshake in flight
+	pending chan struct{}
+	err     error
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Wraps the raw listener and starts accepting connections immediately
+func newHandshakeListener(l net.Listener, config *tls.Config) net.Listener {
+	hl := &handshakeListener{
+		Listener: l,
+		config:   config,
+		conns:    make(chan net.Conn),
+		pending:  make(chan struct{}, maxHandshakes),
+		done:     make(chan struct{}),
+	}
+	go hl.run()
+	return hl
+}
+
+// Accepts connections and starts their handshakes until the listener is
+// closed. Other accept failures are retried, backing off while they last.
+func (hl *handshakeListener) run() {
+	retry := time.Duration(0)
+	for {
+		select {
+		case hl.pending <- struct{}{}:
+		case <-hl.done:
+			return
+		}
+		raw, err := hl.Listener.Accept()
+		if err != nil {
+			<-hl.pending
+			if errors.Is(err, net.ErrClosed) {
+				hl.shutdown(err)
+				return
+			}
+			retry = min(max(2*retry, acceptRetryMin), acceptRetryMax)
+			slog.Warn("TLS accept failed", "addr", hl.Addr().String(), "err", err, "retry", retry)
+			select {
+			case <-time.After(retry):
+			case <-hl.done:
+				return
+			}
+			continue
+		}
+		retry = 0
+		go hl.handshake(raw)
+	}
+}
+
+func (hl *handshakeListener) handshake(raw net.Conn) {
+	defer func() { <-hl.pending }()
+	conn := tls.Server(raw, hl.config)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		slog.Warn("TLS handshake failed", "remote", raw.RemoteAddr().String(), "err", err)
+		raw.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case hl.conns <- conn:
+	case <-hl.done:
+		conn.Close()
+	}
+}
+
+// Accept waits for the next connection that has completed its handshake
+func (hl *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-hl.conns:
+		return conn, nil
+	case <-hl.done:
+		return nil, hl.err
+	}
+}
+
+// Close stops the listener and discards any pending handshakes
+func (hl *handshakeListener) Close() error {
+	return hl.shutdown(net.ErrClosed)
+}
+
+// Records the error Accept should report from now on and closes the
+// underlying listener, only the first call has any effect
+func (hl *handshakeListener) shutdown(reason error) error {
+	var err error
+	hl.once.Do(func() {
+		hl.err = reason
+		close(hl.done)
+		err = hl.Listener.Close()
+	})
+	return err
+}
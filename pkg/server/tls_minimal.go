@@ -0,0 +1,19 @@
+//go:build minimal
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// Minimal builds leave crypto/tls out, tls listeners fail to open
+func tlsListener(acceptor net.Listener, cfg ListenerConfig) (net.Listener, error) {
+	acceptor.Close()
+	return nil, fmt.Errorf("%s: tls listeners are not available in minimal builds", cfg)
+}
+
+// No connection is TLS so none has a client certificate
+func clientCN(conn net.Conn) string {
+	return ""
+}
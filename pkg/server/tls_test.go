@@ -0,0 +1,85 @@
+//go:build !minimal
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyListener fails its first accepts with EMFILE, then hands out pipes
+// whose clients never start the handshake
+type flakyListener struct {
+	mu       sync.Mutex
+	failures int
+	accepted int
+	clients  []net.Conn
+	closed   chan struct{}
+}
+
+func (f *flakyListener) Accept() (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	if f.failures > 0 {
+		f.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	server, client := net.Pipe()
+	f.accepted++
+	f.clients = append(f.clients, client)
+	return server, nil
+}
+
+func (f *flakyListener) Close() error {
+	close(f.closed)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.clients {
+		c.Close()
+	}
+	return nil
+}
+
+func (f *flakyListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestHandshakeListener(t *testing.T) {
+	raw := &flakyListener{failures: 3, closed: make(chan struct{})}
+	hl := newHandshakeListener(raw, &tls.Config{})
+
+	// the failures are retried, then accepting stops once the handshakes
+	// fill up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		raw.mu.Lock()
+		accepted, failures := raw.accepted, raw.failures
+		raw.mu.Unlock()
+		if accepted == maxHandshakes && failures == 0 {
+			break
+		}
+		if accepted > maxHandshakes || time.Now().After(deadline) {
+			t.Fatalf("accepted %d connections with %d failures left; want %d", accepted, failures, maxHandshakes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	raw.mu.Lock()
+	if raw.accepted != maxHandshakes {
+		t.Errorf("accepted %d connections with every handshake in flight; want %d", raw.accepted, maxHandshakes)
+	}
+	raw.mu.Unlock()
+
+	hl.Close()
+	if _, err := hl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after Close; got %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,105 @@
+//go:build !minimal
+
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// At most this many lines of a validation request are checked
+const maxValidateLines = 1000
+
+// lineResult is what would become of one line submitted for validation
+type lineResult struct {
+	Line     int    `json:"line"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+	// the metrics the line parses to, after scrubbing
+	Metrics []validatedMetric `json:"metrics,omitempty"`
+}
+
+type validatedMetric struct {
+	Key   string  `json:"key"`
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+	Time  string  `json:"time"`
+}
+
+// POST /api/v1/validate?format=<format> checks sample lines the way a
+// listener of the format (tsv by default) would, without ingesting them, so
+// a new producer can certify its output before going live. Each line is
+// parsed, scrubbed and checked against the acceptance window, dedup,
+// quarantine and saturation don't apply.
+func (a *apiServer) validate(w http.ResponseWriter, r *http.Request, _ apiClient) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tsv"
+	}
+	parse, ok := parser.Format(format, a.server.Parsing)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown format " + format})
+		return
+	}
+
+	var counts lineCounts
+	results := []lineResult{}
+	truncated := false
+	now := time.Now()
+	scanner := bufio.NewScanner(r.Body)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if len(results) == maxValidateLines {
+			truncated = true
+			break
+		}
+		result := a.server.validateLine(parse, line, now)
+		result.Line = n
+		if result.Accepted {
+			counts.Accepted++
+		} else {
+			counts.Rejected++
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "counts": counts, "lines": results})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"counts": counts, "lines": results, "truncated": truncated})
+}
+
+// Returns what ingesting the line at now would do, leaving everything as it
+// was
+func (s *Server) validateLine(parse parser.Func, line string, now time.Time) lineResult {
+	metrics, err := parse(line)
+	if err != nil {
+		return lineResult{Error: err.Error()}
+	}
+	result := lineResult{Accepted: true}
+	for _, m := range metrics {
+		s.Scrub.apply(&m)
+		if m.Name == "" {
+			continue
+		}
+		if _, err := s.Values.apply(&m); err != nil {
+			result.Accepted, result.Error = false, err.Error()
+		} else if err := s.checkTime(m.Time, now); err != nil {
+			result.Accepted, result.Error = false, err.Error()
+		}
+		result.Metrics = append(result.Metrics, validatedMetric{
+			Key:   m.Key(),
+			Type:  m.Type.String(),
+			Value: m.Value,
+			Time:  m.Time.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	return result
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// ValueAction decides what becomes of a value the ValuePolicy singles out
+type ValueAction int
+
+const (
+	// take the value as it is
+	ValueAccept ValueAction = iota
+	// reject the metric as invalid
+	ValueReject
+	// replace the value with the nearest one allowed
+	ValueClamp
+)
+
+// Parses the textual form of a value action as used in configuration
+func ParseValueAction(s string) (ValueAction, error) {
+	switch s {
+	case "accept":
+		return ValueAccept, nil
+	case "reject":
+		return ValueReject, nil
+	case "clamp":
+		return ValueClamp, nil
+	}
+	return 0, fmt.Errorf("unknown value action %q, want accept, reject or clamp", s)
+}
+
+func (a ValueAction) String() string {
+	switch a {
+	case ValueReject:
+		return "reject"
+	case ValueClamp:
+		return "clamp"
+	}
+	return "accept"
+}
+
+// ValuePolicy says what to do with the values strconv.ParseFloat takes but
+// an aggregate can't, NaN and the infinities poison a whole window's mean,
+// and optionally with negative values
+type ValuePolicy struct {
+	// a clamped infinity becomes the largest finite value of its sign, NaN
+	// has no nearest value and is always rejected unless accepted
+	NonFinite ValueAction
+	// a clamped negative value becomes 0
+	Negative ValueAction
+}
+
+// DefaultValuePolicy rejects NaN and the infinities and accepts negative
+// values
+var DefaultValuePolicy = ValuePolicy{NonFinite: ValueReject, Negative: ValueAccept}
+
+// valueStats count what the value policy rejected or clamped since the last
+// report
+type valueStats struct {
+	nonFinite, negative, clamped uint64
+}
+
+// Applies the policy to the metric, clamping its value in place. An error
+// wrapping ErrNotFinite or ErrNegative is returned for a rejected value.
+func (p ValuePolicy) apply(m *parser.Metric) (clamped bool, err error) {
+	if m.Type == parser.Set || m.Integer && m.IntValue >= 0 {
+		return false, nil
+	}
+	v := m.Value
+	switch {
+	case math.IsNaN(v) || math.IsInf(v, 0):
+		if p.NonFinite == ValueAccept {
+			return false, nil
+		}
+		if p.NonFinite == ValueReject || math.IsNaN(v) {
+			return false, fmt.Errorf("%w %v", ErrNotFinite, v)
+		}
+		v = math.Copysign(math.MaxFloat64, v)
+		if v < 0 && p.Negative != ValueAccept {
+			return p.negative(m)
+		}
+		m.Value, m.Mean = v, v
+		return true, nil
+	case v < 0:
+		return p.negative(m)
+	}
+	return false, nil
+}
+
+func (p ValuePolicy) negative(m *parser.Metric) (bool, error) {
+	switch p.Negative {
+	case ValueReject:
+		return false, fmt.Errorf("%w %v", ErrNegative, m.Value)
+	case ValueClamp:
+		m.Value, m.Mean = 0, 0
+		if m.Integer {
+			m.IntValue = 0
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Applies the server's value policy, counting what it rejects and clamps
+func (s *Server) checkValue(m *parser.Metric) error {
+	clamped, err := s.Values.apply(m)
+	switch {
+	case errors.Is(err, ErrNotFinite):
+		atomic.AddUint64(&s.values.nonFinite, 1)
+	case err != nil:
+		atomic.AddUint64(&s.values.negative, 1)
+	case clamped:
+		atomic.AddUint64(&s.values.clamped, 1)
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestValuePolicy(t *testing.T) {
+	clampAll := ValuePolicy{NonFinite: ValueClamp, Negative: ValueClamp}
+	for _, tc := range []struct {
+		policy  ValuePolicy
+		value   float64
+		want    float64
+		clamped bool
+		err     error
+	}{
+		{DefaultValuePolicy, 1.5, 1.5, false, nil},
+		{DefaultValuePolicy, -1.5, -1.5, false, nil},
+		{DefaultValuePolicy, math.NaN(), 0, false, ErrNotFinite},
+		{DefaultValuePolicy, math.Inf(1), 0, false, ErrNotFinite},
+		{ValuePolicy{}, math.Inf(-1), math.Inf(-1), false, nil},
+		{clampAll, math.Inf(1), math.MaxFloat64, true, nil},
+		{clampAll, math.NaN(), 0, false, ErrNotFinite},
+		{clampAll, math.Inf(-1), 0, true, nil},
+		{clampAll, -3, 0, true, nil},
+		{ValuePolicy{NonFinite: ValueClamp}, math.Inf(-1), -math.MaxFloat64, true, nil},
+		{ValuePolicy{Negative: ValueReject}, -3, 0, false, ErrNegative},
+	} {
+		m := parser.Metric{Name: "cpu", Value: tc.value, Mean: tc.value}
+		clamped, err := tc.policy.apply(&m)
+		if !errors.Is(err, tc.err) || clamped != tc.clamped {
+			t.Errorf("apply(%v) %+v; got %v %v, want %v %v", tc.value, tc.policy, clamped, err, tc.clamped, tc.err)
+			continue
+		}
+		if err == nil && m.Value != tc.want && !math.IsInf(tc.want, 0) {
+			t.Errorf("apply(%v) %+v; got value %v, want %v", tc.value, tc.policy, m.Value, tc.want)
+		}
+		if err != nil && !errors.Is(err, parser.ErrInvalidValue) {
+			t.Errorf("apply(%v); got %v, want it to wrap parser.ErrInvalidValue", tc.value, err)
+		}
+	}
+
+	// integers and sets are only checked for being negative
+	m := parser.Metric{Name: "cpu"}
+	m.SetInt(-4)
+	if clamped, err := clampAll.apply(&m); !clamped || err != nil || m.IntValue != 0 || m.Value != 0 {
+		t.Errorf("apply(-4i); got %v %v %d, want clamped to 0", clamped, err, m.IntValue)
+	}
+	set := parser.Metric{Name: "users", Type: parser.Set, Value: 1}
+	if _, err := (ValuePolicy{Negative: ValueReject}).apply(&set); err != nil {
+		t.Errorf("apply(set); got error %v", err)
+	}
+	for _, s := range []string{"accept", "reject", "clamp"} {
+		if _, err := ParseValueAction(s); err != nil {
+			t.Errorf("ParseValueAction(%s); got error %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// WarmUp holds back the reports of the windows ending within Period of
+// startup. The first window after a restart only covers part of its length,
+// so its counts and sums look like a drop to anything alerting on them.
+type WarmUp struct {
+	Period time.Duration
+	// report the windows marked partial instead of suppressing them
+	Mark  bool
+	start time.Time
+}
+
+// Starts a warm-up period now. The mode is suppress or mark.
+func NewWarmUp(period time.Duration, mode string) (*WarmUp, error) {
+	w := &WarmUp{Period: period, start: time.Now()}
+	switch mode {
+	case "", "suppress":
+	case "mark":
+		w.Mark = true
+	default:
+		return nil, fmt.Errorf("unknown warm-up mode %q, want suppress or mark", mode)
+	}
+	return w, nil
+}
+
+// Reports whether a window ending at t is still within the warm-up period
+func (w *WarmUp) Active(t time.Time) bool {
+	return w != nil && t.Sub(w.start) < w.Period
+}
+
+// Writes the line marking an emission as covering an incomplete window and
+// why: startup, warmup, shutdown, drain, overload, cardinality, signal or
+// replay. Like the signature it starts with a # so it can't be taken for a
+// metric.
+func WritePartial(w io.Writer, reasons ...string) error {
+	_, err := fmt.Fprintf(w, "#partial\t%s\n", strings.Join(reasons, ","))
+	return err
+}
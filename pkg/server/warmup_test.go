@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type warmUpTestCase struct {
+	mode   string
+	after  time.Duration
+	active bool
+	mark   bool
+	err    bool
+}
+
+var warmUpTestCases = []warmUpTestCase{
+	{"", time.Second, true, false, false},
+	{"suppress", time.Minute, false, false, false},
+	{"mark", time.Second, true, true, false},
+	{"mark", 2 * time.Minute, false, true, false},
+	{"drop", 0, false, false, true},
+}
+
+func TestWarmUp(t *testing.T) {
+	for _, tc := range warmUpTestCases {
+		w, err := NewWarmUp(time.Minute, tc.mode)
+		if (err != nil) != tc.err {
+			t.Errorf("NewWarmUp(%s); got error %v, want error %v", tc.mode, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := w.Active(w.start.Add(tc.after)); got != tc.active || w.Mark != tc.mark {
+			t.Errorf("NewWarmUp(%s).Active(+%v); got %v mark %v, want %v mark %v", tc.mode, tc.after, got, w.Mark, tc.active, tc.mark)
+		}
+	}
+
+	var nilWarmUp *WarmUp
+	if nilWarmUp.Active(time.Now()) {
+		t.Errorf("(*WarmUp)(nil).Active(); got true, want false")
+	}
+
+	var buf bytes.Buffer
+	WritePartial(&buf, "startup", "warmup")
+	if got, want := buf.String(), "#partial\tstartup,warmup\n"; got != want {
+		t.Errorf("WritePartial(startup, warmup); got %q, want %q", got, want)
+	}
+}
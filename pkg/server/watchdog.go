@@ -0,0 +1,86 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/store"
+)
+
+// Watchdog checks the store is still taking metrics by pinging it every
+// Timeout/2. A ping that takes longer than Timeout means the aggregation
+// path is stuck: every goroutine's stack is dumped to stderr and OnStuck, if
+// set, is called. The state shows on the admin /healthz.
+type Watchdog struct {
+	Store   store.Aggregator
+	Timeout time.Duration
+	// called once each time the store gets stuck, like exiting so a
+	// supervisor restarts the pipeline
+	OnStuck func()
+
+	mu       sync.Mutex
+	lastBeat time.Time
+	stuck    bool
+}
+
+// Returns a watchdog for the store, start it with Run
+func NewWatchdog(s store.Aggregator, timeout time.Duration) *Watchdog {
+	return &Watchdog{Store: s, Timeout: timeout, lastBeat: time.Now()}
+}
+
+// Pings the store until stop is closed
+func (w *Watchdog) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.Timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		done := make(chan struct{})
+		go func() {
+			w.Store.Ping()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(w.Timeout):
+			w.setStuck(true)
+			slog.Error("watchdog: the store has not answered, goroutines follow", "timeout", w.Timeout)
+			pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+			if w.OnStuck != nil {
+				w.OnStuck()
+			}
+			// only one ping in flight, wait for the stuck one
+			select {
+			case <-done:
+				slog.Info("watchdog: the store is answering again")
+			case <-stop:
+				return
+			}
+		}
+		w.setStuck(false)
+	}
+}
+
+func (w *Watchdog) setStuck(stuck bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stuck = stuck
+	if !stuck {
+		w.lastBeat = time.Now()
+	}
+}
+
+// Healthy reports whether the store answered its last ping, and when it
+// last did
+func (w *Watchdog) Healthy() (bool, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.stuck, w.lastBeat
+}
@@ -0,0 +1,57 @@
+//go:build !minimal
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stuckStore is an Aggregator whose pings wait for unstick
+type stuckStore struct {
+	fullStore
+	unstick chan struct{}
+}
+
+func (s *stuckStore) Ping() { <-s.unstick }
+
+func TestWatchdog(t *testing.T) {
+	s := &stuckStore{unstick: make(chan struct{})}
+	wd := NewWatchdog(s, 20*time.Millisecond)
+	called := make(chan struct{}, 1)
+	wd.OnStuck = func() { called <- struct{}{} }
+	stop := make(chan struct{})
+	defer close(stop)
+	go wd.Run(stop)
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatalf("Run(); OnStuck never called for a stuck store")
+	}
+	admin := NewAdminHandler(New(s), wd)
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz while stuck; got %d, want 503", rec.Code)
+	}
+
+	close(s.unstick)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if healthy, _ := wd.Healthy(); healthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Healthy(); still stuck after the store answered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz; got %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,40 @@
+package sink
+
+import "time"
+
+// backoff spaces out the retries of a sink whose endpoint is down, doubling
+// the wait from min up to max on every failure in a row
+type backoff struct {
+	min, max time.Duration
+	wait     time.Duration
+	until    time.Time
+}
+
+// Notes a failure at now and returns how long to wait before the next try
+func (b *backoff) fail(now time.Time) time.Duration {
+	b.wait = min(max(b.wait*2, b.min), b.max)
+	b.until = now.Add(b.wait)
+	return b.wait
+}
+
+// Like fail, but waits at least d when the endpoint asked for that long
+func (b *backoff) failFor(now time.Time, d time.Duration) time.Duration {
+	if wait := b.fail(now); wait >= d {
+		return wait
+	}
+	b.until = now.Add(d)
+	return d
+}
+
+// Notes a success, the next failure waits min again
+func (b *backoff) reset() {
+	b.wait, b.until = 0, time.Time{}
+}
+
+// Returns how long until the next try is due, 0 when it is
+func (b *backoff) left(now time.Time) time.Duration {
+	if now.Before(b.until) {
+		return b.until.Sub(now)
+	}
+	return 0
+}
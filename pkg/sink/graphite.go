@@ -0,0 +1,261 @@
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("graphite", OpenGraphite)
+}
+
+// bytes of lines a graphite sink writes at once while flushing a window
+const graphiteBatch = 64 << 10
+
+// the statistics a graphite sink can send for each metric, as a path
+// component after the metric's name
+var graphiteStats = map[string]func(m parser.Metric, o Options) string{
+	"mean":   func(m parser.Metric, o Options) string { return o.format(m.Mean) },
+	"min":    func(m parser.Metric, o Options) string { return o.format(m.Min) },
+	"max":    func(m parser.Metric, o Options) string { return o.format(m.Max) },
+	"count":  func(m parser.Metric, _ Options) string { return strconv.Itoa(m.Count) },
+	"stddev": func(m parser.Metric, o Options) string { return o.format(m.Stddev()) },
+	"sum": func(m parser.Metric, o Options) string {
+		if m.Integer {
+			return strconv.FormatInt(m.IntValue, 10)
+		}
+		return o.format(m.Value)
+	},
+}
+
+// Graphite is a sink sending every window to carbon in the plaintext
+// protocol, a line of path, value and unix timestamp per statistic of each
+// metric. Tags are sent the way graphite 1.1 takes them, as ;key=value
+// after the path. With several windows each is under its own label, like
+// collector.5m.cpu.mean.
+//
+// A window's lines are sent as it ends, or in batches as it is flushed when
+// it is large. When carbon can't be reached they are kept, up to a limit,
+// and sent with the next window once the wait of the backoff is over.
+// Resending lines carbon partly took is harmless, a point written twice for
+// the same timestamp keeps the last value.
+type Graphite struct {
+	address string
+	prefix  string
+	stats   []string
+	opts    Options
+	// stamp the points with the window's start rather than its end
+	start bool
+	// the most bytes of lines kept while carbon is unreachable
+	buffer  int
+	timeout time.Duration
+	backoff backoff
+
+	dial func() (net.Conn, error)
+	now  func() time.Time
+
+	conn    net.Conn
+	pending bytes.Buffer
+	dropped int
+	// why carbon is unreachable
+	err error
+}
+
+// Opens the sink of a URL like graphite://carbon:2003?prefix=collector,
+// its options are
+//
+//	prefix       prepended to every path, followed by a dot
+//	stats        the statistics sent per metric: mean, min, max, sum,
+//	             count and stddev (default mean,min,max,sum,count)
+//	timestamp    stamp points with the window's end (default) or start
+//	buffer       bytes of lines kept while carbon is down (default 8MiB)
+//	timeout      for connecting and each write (default 10s)
+//	backoff      first wait after a failure, doubled on every one in a
+//	             row (default 1s)
+//	max-backoff  longest wait between tries (default 1m)
+func OpenGraphite(u *url.URL, opts Options) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("want an address like graphite://carbon:2003")
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "2003")
+	}
+	g := &Graphite{
+		address: address,
+		stats:   []string{"mean", "min", "max", "sum", "count"},
+		opts:    opts,
+		buffer:  8 << 20,
+		timeout: 10 * time.Second,
+		backoff: backoff{min: time.Second, max: time.Minute},
+		now:     time.Now,
+	}
+	var err error
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "prefix":
+			g.prefix = strings.Trim(value, ".")
+		case "stats":
+			g.stats = strings.Split(value, ",")
+			for _, stat := range g.stats {
+				if _, ok := graphiteStats[stat]; !ok {
+					return nil, fmt.Errorf("unknown stat %q, want mean, min, max, sum, count or stddev", stat)
+				}
+			}
+		case "timestamp":
+			if value != "start" && value != "end" {
+				return nil, fmt.Errorf("timestamp must be start or end")
+			}
+			g.start = value == "start"
+		case "buffer":
+			if g.buffer, err = strconv.Atoi(value); err != nil || g.buffer < 0 {
+				return nil, fmt.Errorf("buffer must be 0 or more bytes")
+			}
+		case "timeout":
+			if g.timeout, err = time.ParseDuration(value); err != nil || g.timeout <= 0 {
+				return nil, fmt.Errorf("timeout must be a positive duration")
+			}
+		case "backoff":
+			if g.backoff.min, err = time.ParseDuration(value); err != nil || g.backoff.min <= 0 {
+				return nil, fmt.Errorf("backoff must be a positive duration")
+			}
+		case "max-backoff":
+			if g.backoff.max, err = time.ParseDuration(value); err != nil || g.backoff.max <= 0 {
+				return nil, fmt.Errorf("max-backoff must be a positive duration")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	g.backoff.max = max(g.backoff.max, g.backoff.min)
+	g.dial = func() (net.Conn, error) {
+		return net.DialTimeout("tcp", g.address, g.timeout)
+	}
+	return g, nil
+}
+
+// Flush adds the chunk's lines to those going out at the end of the window.
+// While carbon is unreachable lines past the buffer limit are dropped, and
+// End reports how many.
+func (g *Graphite) Flush(w Window, chunk []parser.Metric) error {
+	stamp := w.End
+	if g.start {
+		stamp = w.Start
+	}
+	ts := strconv.FormatInt(stamp.Unix(), 10)
+	var line []byte
+	for _, m := range chunk {
+		for _, stat := range g.stats {
+			line = g.appendPath(line[:0], w.Label, m, stat)
+			line = append(line, ' ')
+			line = append(line, graphiteStats[stat](m, g.opts)...)
+			line = append(line, ' ')
+			line = append(line, ts...)
+			line = append(line, '\n')
+			if g.backoff.wait > 0 && g.pending.Len()+len(line) > g.buffer {
+				if g.backoff.left(g.now()) > 0 || g.send() != nil {
+					g.dropped++
+					continue
+				}
+			}
+			g.pending.Write(line)
+		}
+	}
+	// while carbon is up a large window goes out as it is flushed, only
+	// what it can't take counts against the buffer
+	if g.backoff.wait == 0 && g.pending.Len() >= graphiteBatch {
+		g.send()
+	}
+	return nil
+}
+
+// Appends the path of a metric's statistic: prefix, window label, name and
+// stat joined by dots, then the tags. Spaces would end the path early and
+// become underscores, as do semicolons in tags.
+func (g *Graphite) appendPath(b []byte, label string, m parser.Metric, stat string) []byte {
+	if g.prefix != "" {
+		b = append(b, g.prefix...)
+		b = append(b, '.')
+	}
+	if label != "" {
+		b = append(b, label...)
+		b = append(b, '.')
+	}
+	b = appendSafe(b, m.Name, " ")
+	b = append(b, '.')
+	b = append(b, stat...)
+	if m.Tags != "" {
+		for _, kv := range strings.Split(m.Tags, ",") {
+			b = append(b, ';')
+			b = appendSafe(b, kv, " ;")
+		}
+	}
+	return b
+}
+
+func appendSafe(b []byte, s, unsafe string) []byte {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(unsafe, s[i]) >= 0 {
+			b = append(b, '_')
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return b
+}
+
+// End sends the lines of the window and of any windows carbon missed
+func (g *Graphite) End(w Window) error {
+	err := g.send()
+	if g.dropped > 0 {
+		err = errors.Join(err, fmt.Errorf("%d lines over the %d byte buffer dropped", g.dropped, g.buffer))
+		g.dropped = 0
+	}
+	return err
+}
+
+func (g *Graphite) send() error {
+	if g.pending.Len() == 0 {
+		return nil
+	}
+	now := g.now()
+	if wait := g.backoff.left(now); wait > 0 {
+		return fmt.Errorf("carbon unreachable, %v, %d bytes kept for the next try in %v", g.err, g.pending.Len(), wait.Round(time.Millisecond))
+	}
+	if g.conn == nil {
+		if g.conn, g.err = g.dial(); g.err != nil {
+			g.conn = nil
+			return fmt.Errorf("%v, retrying in %v", g.err, g.backoff.fail(now))
+		}
+	}
+	g.conn.SetWriteDeadline(now.Add(g.timeout))
+	if _, g.err = g.conn.Write(g.pending.Bytes()); g.err != nil {
+		// the connection is dialed again after the wait
+		g.conn.Close()
+		g.conn = nil
+		return fmt.Errorf("%v, retrying in %v", g.err, g.backoff.fail(now))
+	}
+	g.pending.Reset()
+	g.backoff.reset()
+	return nil
+}
+
+// Close makes a last attempt at sending what is kept, ignoring the backoff
+func (g *Graphite) Close() error {
+	g.backoff.reset()
+	err := g.send()
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package sink
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// carbonConn collects what a graphite sink writes, failing writes while down
+type carbonConn struct {
+	net.Conn
+	received *strings.Builder
+	down     *bool
+}
+
+func (c carbonConn) Write(p []byte) (int, error) {
+	if *c.down {
+		return 0, errors.New("broken pipe")
+	}
+	return c.received.Write(p)
+}
+
+func (c carbonConn) SetWriteDeadline(time.Time) error { return nil }
+func (c carbonConn) Close() error                     { return nil }
+
+func openGraphite(t *testing.T, spec string) *Graphite {
+	t.Helper()
+	u, _ := url.Parse(spec)
+	s, err := OpenGraphite(u, Options{})
+	if err != nil {
+		t.Fatalf("OpenGraphite(%s); got error %v", spec, err)
+	}
+	return s.(*Graphite)
+}
+
+func TestGraphite(t *testing.T) {
+	for _, spec := range []string{"graphite://", "graphite://carbon?stats=median", "graphite://carbon?timestamp=now", "graphite://carbon?color=blue"} {
+		u, _ := url.Parse(spec)
+		if _, err := OpenGraphite(u, Options{}); err == nil {
+			t.Errorf("OpenGraphite(%s); got nil error", spec)
+		}
+	}
+	if g := openGraphite(t, "graphite://carbon"); g.address != "carbon:2003" {
+		t.Errorf("OpenGraphite(graphite://carbon); got address %s, want the default port", g.address)
+	}
+
+	var received strings.Builder
+	down, dials := false, 0
+	now := time.Unix(1700000030, 0)
+	g := openGraphite(t, "graphite://carbon:2003?prefix=collector.&stats=mean,count&timestamp=start&buffer=80")
+	g.now = func() time.Time { return now }
+	g.dial = func() (net.Conn, error) {
+		dials++
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return carbonConn{received: &received, down: &down}, nil
+	}
+
+	w := Window{Start: now.Add(-30 * time.Second), End: now}
+	g.Flush(w, []parser.Metric{{Name: "cpu", Mean: 1.5, Count: 2, Tags: "host=a b,region=eu;west"}})
+	if err := g.End(w); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+	want := "collector.cpu.mean;host=a_b;region=eu_west 1.5 1700000000\n" +
+		"collector.cpu.count;host=a_b;region=eu_west 2 1700000000\n"
+	if received.String() != want {
+		t.Errorf("End(); got %q, want %q", received.String(), want)
+	}
+
+	// carbon restarting: the window is kept, the next tries back off and
+	// lines past the buffer are dropped
+	received.Reset()
+	down = true
+	g.Flush(w, []parser.Metric{{Name: "mem", Mean: 7, Count: 1}})
+	if err := g.End(w); err == nil || g.backoff.wait != time.Second {
+		t.Errorf("End() with carbon down; got %v waiting %v, want an error and a 1s backoff", err, g.backoff.wait)
+	}
+	now = now.Add(500 * time.Millisecond)
+	g.Flush(w, []parser.Metric{{Name: "disk", Mean: 1, Count: 1}})
+	if err := g.End(w); err == nil || !strings.Contains(err.Error(), "2 lines over the 80 byte buffer dropped") || dials != 1 {
+		t.Errorf("End() within the backoff; got %v after %d dials, want 2 lines dropped and no new dial", err, dials)
+	}
+	now = now.Add(time.Second)
+	if err := g.End(w); err == nil || g.backoff.wait != 2*time.Second || dials != 2 {
+		t.Errorf("End() after the backoff; got %v waiting %v after %d dials, want the wait doubled", err, g.backoff.wait, dials)
+	}
+
+	down = false
+	now = now.Add(2 * time.Second)
+	if err := g.End(w); err != nil || received.String() != "collector.mem.mean 7 1700000000\ncollector.mem.count 1 1700000000\n" {
+		t.Errorf("End() once carbon is back; got %v sending %q", err, received.String())
+	}
+	if g.backoff.wait != 0 {
+		t.Errorf("End() once carbon is back; got a %v backoff, want it reset", g.backoff.wait)
+	}
+}
@@ -0,0 +1,539 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("history", OpenHistory)
+}
+
+// the names of the segments of an hour and of a compacted day
+const (
+	historyHour = "20060102T15"
+	historyDay  = "20060102"
+	hourExt     = ".ndjson"
+	dayExt      = ".ndjson.gz"
+)
+
+// how often the history is compacted and its retention applied
+const historyMaintenance = time.Hour
+
+// History is a sink keeping every window flushed on disk, so the windows
+// can be queried after a restart, see Query. The store is a directory of
+// segments of JSON lines, a jsonRecord per metric, one per hour of the
+// windows' starts like 20240102T15.ndjson. Once a day is over by
+// compact-after its hours are compacted into one gzipped segment like
+// 20240102.ndjson.gz, corrections arriving later are merged in by the next
+// compaction. Segments past the retention are removed.
+//
+// With rollups the segments past the retention are downsampled instead,
+// rewritten with a record per metric and bucket of each tier's resolution
+// like 20240102.5m.ndjson.gz, and removed past the last tier.
+//
+// With raw=true the number of metrics accepted under each name is recorded
+// too, a historyRaw per name for the time between windows.
+type History struct {
+	dir          string
+	retention    time.Duration
+	compactAfter time.Duration
+	raw          bool
+	rollups      []rollupTier
+	now          func() time.Time
+
+	// the lines of the window being flushed by segment
+	pending map[string]*bytes.Buffer
+	// held while the segments are written, compacted or read
+	mu         sync.Mutex
+	maintained time.Time
+
+	rawMu     sync.Mutex
+	rawCounts map[string]int
+	rawSince  time.Time
+}
+
+// historyRaw is the record of the metrics accepted under a name between
+// two windows
+type historyRaw struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Raw   int       `json:"raw"`
+	// the resolution it was rolled up to
+	Resolution string `json:"resolution,omitempty"`
+}
+
+// Opens the sink of a URL like history:///var/lib/collector/history, its
+// options are
+//
+//	retention      how long windows are kept (default 168h, 0 for ever)
+//	compact-after  how long after a day ends its hours are compacted
+//	               (default 1h)
+//	raw            record the metrics accepted under each name between
+//	               windows (default false)
+//	rollups        the resolutions windows past the retention are
+//	               downsampled to and how long each is kept, like
+//	               5m:168h,1h:2160h (default none)
+func OpenHistory(u *url.URL, opts Options) (Sink, error) {
+	dir := u.Path
+	if u.Opaque != "" {
+		dir = u.Opaque
+	}
+	if dir == "" {
+		return nil, errors.New("want a directory like history:///var/lib/collector/history")
+	}
+	h := &History{dir: dir, retention: 7 * 24 * time.Hour, compactAfter: time.Hour, now: time.Now,
+		pending: make(map[string]*bytes.Buffer), rawCounts: make(map[string]int)}
+	var err error
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "retention":
+			if h.retention, err = time.ParseDuration(value); err != nil || h.retention < 0 {
+				return nil, fmt.Errorf("retention must be a duration, 0 to keep everything")
+			}
+		case "compact-after":
+			if h.compactAfter, err = time.ParseDuration(value); err != nil || h.compactAfter < 0 {
+				return nil, fmt.Errorf("compact-after must be a duration")
+			}
+		case "raw":
+			if h.raw, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("raw must be a boolean")
+			}
+		case "rollups":
+			if h.rollups, err = parseRollups(value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if len(h.rollups) > 0 && (h.retention == 0 || h.rollups[0].keep <= h.retention) {
+		return nil, fmt.Errorf("rollups must be kept longer than the retention")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	h.rawSince = h.now()
+	return h, nil
+}
+
+// Flush adds the metrics to the lines of their window's segment
+func (h *History) Flush(w Window, chunk []parser.Metric) error {
+	buf := h.buffer(w.Start)
+	for _, m := range chunk {
+		b, err := marshalRecord(w, m)
+		if err != nil {
+			continue
+		}
+		buf.Write(append(b, '\n'))
+	}
+	return nil
+}
+
+// Relay counts a metric just accepted, with raw=true
+func (h *History) Relay(m parser.Metric) {
+	if !h.raw {
+		return
+	}
+	h.rawMu.Lock()
+	h.rawCounts[m.Name]++
+	h.rawMu.Unlock()
+}
+
+// Returns the lines being added to the segment of the hour of t
+func (h *History) buffer(t time.Time) *bytes.Buffer {
+	name := t.UTC().Format(historyHour) + hourExt
+	buf := h.pending[name]
+	if buf == nil {
+		buf = new(bytes.Buffer)
+		h.pending[name] = buf
+	}
+	return buf
+}
+
+// End appends the window to its segments, then compacts and applies the
+// retention when it is time to
+func (h *History) End(w Window) error {
+	h.takeRaw()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.write()
+	if now := h.now(); now.Sub(h.maintained) >= historyMaintenance {
+		h.maintained = now
+		err = errors.Join(err, h.maintain(now))
+	}
+	return err
+}
+
+// Adds the raw counts to the pending lines and starts counting afresh
+func (h *History) takeRaw() {
+	h.rawMu.Lock()
+	counts, since := h.rawCounts, h.rawSince
+	h.rawCounts, h.rawSince = make(map[string]int), h.now()
+	h.rawMu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := h.buffer(since)
+	for _, name := range names {
+		b, _ := json.Marshal(historyRaw{Name: name, Start: since.UTC(), End: h.rawSince.UTC(), Raw: counts[name]})
+		buf.Write(append(b, '\n'))
+	}
+}
+
+// Appends the pending lines to their segments. Called with mu held.
+func (h *History) write() error {
+	var errs []error
+	for name, buf := range h.pending {
+		f, err := os.OpenFile(filepath.Join(h.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err == nil {
+			_, err = f.Write(buf.Bytes())
+			err = errors.Join(err, f.Close())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("history: %v, %d bytes lost", err, buf.Len()))
+		}
+		delete(h.pending, name)
+	}
+	return errors.Join(errs...)
+}
+
+// historySegment is a file of the history and the span it covers
+type historySegment struct {
+	name       string
+	start, end time.Time
+	compacted  bool
+	// the resolution it was rolled up to, 0 for the windows as flushed
+	res time.Duration
+}
+
+// Lists the segments in time order, skipping any other file
+func (h *History) segments() ([]historySegment, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []historySegment
+	for _, e := range entries {
+		name := e.Name()
+		if stamp, ok := strings.CutSuffix(name, dayExt); ok {
+			stamp, res, ok := cutResolution(stamp)
+			if t, err := time.Parse(historyDay, stamp); err == nil && ok {
+				segments = append(segments, historySegment{name: name, start: t, end: t.AddDate(0, 0, 1), compacted: true, res: res})
+			}
+		} else if stamp, ok := strings.CutSuffix(name, hourExt); ok {
+			stamp, res, ok := cutResolution(stamp)
+			if t, err := time.Parse(historyHour, stamp); err == nil && ok {
+				segments = append(segments, historySegment{name: name, start: t, end: t.Add(time.Hour), res: res})
+			}
+		}
+	}
+	// a day sorts before its first hour, its earlier compaction comes first
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].start.Before(segments[j].start) })
+	return segments, nil
+}
+
+// Splits the resolution off the stamp of a rolled up segment like
+// 20240102.5m, false if it isn't one
+func cutResolution(stamp string) (string, time.Duration, bool) {
+	stamp, suffix, ok := strings.Cut(stamp, ".")
+	if !ok {
+		return stamp, 0, true
+	}
+	res, err := time.ParseDuration(suffix)
+	return stamp, res, err == nil && res > 0
+}
+
+// Removes the segments past the retention, or past their last rollup,
+// compacts the hours of the days over by compact-after and rolls up the
+// segments due. Called with mu held.
+func (h *History) maintain(now time.Time) error {
+	segments, err := h.segments()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	// the segments rewritten as one, a day or an hour
+	type rewrite struct {
+		compacted bool
+		segments  []historySegment
+		res       time.Duration
+	}
+	rewrites := make(map[string]*rewrite)
+	for _, s := range segments {
+		res, keep := h.resolution(now, s)
+		if !keep {
+			errs = append(errs, os.Remove(filepath.Join(h.dir, s.name)))
+			continue
+		}
+		stamp, compacted := s.start.Format(historyHour), false
+		if day := s.start.Truncate(24 * time.Hour); s.compacted || !day.Add(24*time.Hour+h.compactAfter).After(now) {
+			stamp, compacted = day.Format(historyDay), true
+		}
+		rw := rewrites[stamp]
+		if rw == nil {
+			rw = &rewrite{compacted: compacted}
+			rewrites[stamp] = rw
+		}
+		rw.segments = append(rw.segments, s)
+		rw.res = max(rw.res, res)
+	}
+	for stamp, rw := range rewrites {
+		if s := rw.segments[0]; len(rw.segments) == 1 && s.compacted == rw.compacted && s.res == rw.res {
+			continue
+		}
+		errs = append(errs, h.compact(stamp, rw.compacted, rw.segments, rw.res))
+	}
+	return errors.Join(errs...)
+}
+
+// Rewrites the segments of a day or an hour, the earlier compaction first,
+// as one segment rolled up to res, gzipped for a day, and removes the others
+func (h *History) compact(stamp string, compacted bool, segments []historySegment, res time.Duration) error {
+	name := stamp
+	if res > 0 {
+		name += "." + formatResolution(res)
+	}
+	if compacted {
+		name += dayExt
+	} else {
+		name += hourExt
+	}
+	tmp, err := os.CreateTemp(h.dir, stamp+".compacting.*")
+	if err != nil {
+		return err
+	}
+	var w io.Writer = tmp
+	var zw *gzip.Writer
+	if compacted {
+		zw = gzip.NewWriter(tmp)
+		w = zw
+	}
+	if res > 0 {
+		err = h.rollUp(w, segments, res)
+	} else {
+		for _, s := range segments {
+			var r io.ReadCloser
+			if r, err = h.open(s); err != nil {
+				break
+			}
+			_, err = io.Copy(w, r)
+			r.Close()
+			if err != nil {
+				break
+			}
+		}
+	}
+	if zw != nil {
+		err = errors.Join(err, zw.Close())
+	}
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(h.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("history: compacting %s: %v", stamp, err)
+	}
+	var errs []error
+	for _, s := range segments {
+		if s.name != name {
+			errs = append(errs, os.Remove(filepath.Join(h.dir, s.name)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Opens a segment to read its lines, uncompressed
+func (h *History) open(s historySegment) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(h.dir, s.name))
+	if err != nil || !s.compacted {
+		return f, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// Query calls fn with each record whose window started from from until to,
+// of the metrics whose names match the path.Match pattern, all of them
+// when it is empty. The records are the JSON lines of the segments, in the
+// order they were written within each segment. Writes wait for the query.
+func (h *History) Query(from, to time.Time, pattern string, fn func(record []byte) error) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	segments, err := h.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if !s.end.After(from) || !s.start.Before(to) {
+			continue
+		}
+		r, err := h.open(s)
+		if err != nil {
+			return err
+		}
+		lines := bufio.NewScanner(r)
+		lines.Buffer(nil, 1<<20)
+		for lines.Scan() {
+			var key struct {
+				Name  string    `json:"name"`
+				Start time.Time `json:"start"`
+			}
+			if json.Unmarshal(lines.Bytes(), &key) != nil || key.Start.Before(from) || !key.Start.Before(to) {
+				continue
+			}
+			if ok, _ := path.Match(pattern, key.Name); pattern != "" && !ok {
+				continue
+			}
+			if err := fn(lines.Bytes()); err != nil {
+				r.Close()
+				return err
+			}
+		}
+		r.Close()
+		if err := lines.Err(); err != nil {
+			return fmt.Errorf("history: reading %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes the records of the metrics whose name or key matches the
+// path.Match pattern from every segment, rewriting those holding any, and
+// returns how many there were. A window flushed while it runs may still
+// hold them.
+func (h *History) Delete(pattern string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	segments, err := h.segments()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	var errs []error
+	for _, s := range segments {
+		n, err := h.deleteFrom(s, pattern)
+		deleted += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("history: deleting from %s: %v", s.name, err))
+		}
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// Rewrites the segment without the records matching the pattern, leaving
+// it as it was when there are none. Called with mu held.
+func (h *History) deleteFrom(s historySegment, pattern string) (int, error) {
+	r, err := h.open(s)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp(h.dir, s.name+".deleting.*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	var w io.Writer = tmp
+	var zw *gzip.Writer
+	if s.compacted {
+		zw = gzip.NewWriter(tmp)
+		w = zw
+	}
+
+	deleted := 0
+	lines := bufio.NewScanner(r)
+	lines.Buffer(nil, 1<<20)
+	for lines.Scan() {
+		if recordMatches(lines.Bytes(), pattern) {
+			deleted++
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", lines.Bytes()); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	err = lines.Err()
+	if zw != nil {
+		err = errors.Join(err, zw.Close())
+	}
+	err = errors.Join(err, tmp.Close())
+	if err != nil || deleted == 0 {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(h.dir, s.name)); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// Reports whether the name or the key of the record's metric matches the
+// pattern
+func recordMatches(record []byte, pattern string) bool {
+	var key struct {
+		Name string            `json:"name"`
+		Tags map[string]string `json:"tags"`
+	}
+	if json.Unmarshal(record, &key) != nil {
+		return false
+	}
+	if ok, _ := path.Match(pattern, key.Name); ok || len(key.Tags) == 0 {
+		return ok
+	}
+	pairs := make([][2]string, 0, len(key.Tags))
+	for k, v := range key.Tags {
+		pairs = append(pairs, [2]string{k, v})
+	}
+	tags, err := parser.CanonicalTags(pairs)
+	if err != nil {
+		return false
+	}
+	ok, _ := path.Match(pattern, key.Name+"{"+tags+"}")
+	return ok
+}
+
+// Close writes the raw counts still held
+func (h *History) Close() error {
+	h.takeRaw()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.write()
+}
@@ -0,0 +1,190 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func openHistory(t *testing.T, dir, options string, start time.Time) (*History, *time.Time) {
+	t.Helper()
+	u, _ := url.Parse("history://" + dir + options)
+	opened, err := OpenHistory(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := opened.(*History)
+	now := &start
+	h.now = func() time.Time { return *now }
+	h.rawSince = start
+	return h, now
+}
+
+// Returns the names of the records of the span, in the order queried
+func query(t *testing.T, h *History, from, to time.Time, pattern string) []string {
+	t.Helper()
+	var names []string
+	err := h.Query(from, to, pattern, func(record []byte) error {
+		var rec struct {
+			Name string
+			Raw  int
+		}
+		json.Unmarshal(record, &rec)
+		if rec.Raw > 0 {
+			rec.Name += "#raw"
+		}
+		names = append(names, rec.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Query(); got error %v", err)
+	}
+	return names
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	h, now := openHistory(t, dir, "?raw=true&retention=72h", day)
+	for hour := 0; hour < 48; hour += 12 {
+		start := day.Add(time.Duration(hour) * time.Hour)
+		*now = start.Add(time.Minute)
+		h.Relay(parser.Metric{Name: "cpu"})
+		w := Window{Start: start, End: *now}
+		h.Flush(w, []parser.Metric{{Name: "cpu", Value: 1, Count: 1}, {Name: "mem", Value: 2, Count: 1}})
+		if err := h.End(w); err != nil {
+			t.Fatalf("End(); got error %v", err)
+		}
+	}
+	// a correction to the first day, after it was compacted
+	h.Flush(Window{Start: day, End: day.Add(time.Minute), Correction: true}, []parser.Metric{{Name: "cpu", Value: 3, Count: 1}})
+	h.End(Window{})
+	h.Close()
+
+	// the metrics accepted are counted under the time since the last window
+	if got := query(t, h, day, day.Add(time.Hour), ""); strings.Join(got, " ") != "cpu mem cpu#raw cpu#raw cpu" {
+		t.Errorf("Query of the first hour; got %v, want the window and its correction", got)
+	}
+
+	// a restart finds the history, compacting the first day now its
+	// correction is in and the second once it is over
+	h, now = openHistory(t, dir, "?retention=72h", day.Add(49*time.Hour))
+	h.End(Window{})
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(files)
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	if strings.Join(files, " ") != "20240102.ndjson.gz 20240103.ndjson.gz" {
+		t.Errorf("history files %v; want the days compacted", files)
+	}
+	if got := query(t, h, day, day.AddDate(0, 0, 2), "c*"); strings.Join(got, " ") != "cpu cpu#raw cpu#raw cpu cpu#raw cpu cpu cpu#raw cpu" {
+		t.Errorf("Query of the days; got %v", got)
+	}
+
+	// past the retention the first day is removed
+	*now = day.Add(4*24*time.Hour + time.Minute)
+	h.maintained = time.Time{}
+	h.End(Window{})
+	if got := query(t, h, day, day.AddDate(0, 0, 2), "mem"); len(got) != 2 {
+		t.Errorf("Query after the retention; got %v, want the second day's", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "20240102.ndjson.gz")); !os.IsNotExist(err) {
+		t.Errorf("the first day is still there past the retention")
+	}
+}
+
+func TestHistoryDelete(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	h, now := openHistory(t, dir, "?retention=72h", day)
+	for _, start := range []time.Time{day, day.Add(25 * time.Hour)} {
+		*now = start.Add(time.Minute)
+		w := Window{Start: start, End: *now}
+		h.Flush(w, []parser.Metric{{Name: "cpu", Tags: "host=a", Count: 1}, {Name: "cpu", Tags: "host=b", Count: 1}, {Name: "mem", Count: 1}})
+		h.End(w)
+	}
+	// the first day is compacted, the second isn't
+	*now = day.Add(49 * time.Hour)
+	h.maintained = time.Time{}
+	h.End(Window{})
+
+	if n, err := h.Delete("cpu{host=a}"); err != nil || n != 2 {
+		t.Errorf("Delete(cpu{host=a}); got %d, %v, want a record each day", n, err)
+	}
+	if n, err := h.Delete("m*"); err != nil || n != 2 {
+		t.Errorf("Delete(m*); got %d, %v, want a record each day", n, err)
+	}
+	if got := query(t, h, day, day.AddDate(0, 0, 3), ""); strings.Join(got, " ") != "cpu cpu" {
+		t.Errorf("Query after the deletes; got %v, want cpu of host b each day", got)
+	}
+	if n, err := h.Delete("disk"); err != nil || n != 0 {
+		t.Errorf("Delete(disk); got %d, %v, want none", n, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 2 {
+		t.Errorf("history files %v; want the two segments alone", files)
+	}
+}
+
+func TestHistoryRollups(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	h, now := openHistory(t, dir, "?retention=24h&rollups=1h:72h", day)
+	for _, w := range []struct {
+		minute     int
+		value      float64
+		correction bool
+	}{{0, 1, false}, {30, 5, false}, {30, 3, true}, {60, 7, false}} {
+		start := day.Add(time.Duration(w.minute) * time.Minute)
+		*now = start.Add(30 * time.Minute)
+		win := Window{Start: start, End: *now, Label: "30m", Correction: w.correction}
+		h.Flush(win, []parser.Metric{{Name: "cpu", Value: w.value, Count: 1, Mean: w.value, Min: w.value, Max: w.value, Last: w.value}})
+		h.End(win)
+	}
+
+	// past the retention the day is rolled up to hours, the correction
+	// replacing its window
+	*now = day.Add(50 * time.Hour)
+	h.maintained = time.Time{}
+	h.End(Window{})
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "20240102.1h.ndjson.gz" {
+		t.Fatalf("history files %v; want the day rolled up", files)
+	}
+	var got []string
+	h.Query(day, day.Add(24*time.Hour), "", func(record []byte) error {
+		var rec rollupRecord
+		json.Unmarshal(record, &rec)
+		got = append(got, fmt.Sprintf("%s %s %d %g %g %g %g %s", rec.Start.Format("15:04"), rec.End.Format("15:04"), rec.Count, rec.Sum, rec.Min, rec.Max, rec.Last, rec.Resolution))
+		return nil
+	})
+	if want := "00:00 01:00 2 4 1 3 3 1h,01:00 02:00 1 7 7 7 7 1h"; strings.Join(got, ",") != want {
+		t.Errorf("Query of the rollup; got %q, want %q", strings.Join(got, ","), want)
+	}
+
+	// past the last rollup the day is removed
+	*now = day.Add(97 * time.Hour)
+	h.maintained = time.Time{}
+	h.End(Window{})
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("history files %v past the rollups; want none", files)
+	}
+}
+
+func TestOpenHistory(t *testing.T) {
+	for _, spec := range []string{"history://", "history:///h?retention=week", "history:///h?raw=maybe", "history:///h?nope=1",
+		"history:///h?rollups=7m:72h", "history:///h?rollups=1h:72h,5m:168h", "history:///h?retention=168h&rollups=1h:72h", "history:///h?retention=0&rollups=1h:72h"} {
+		u, _ := url.Parse(spec)
+		if _, err := OpenHistory(u, Options{}); err == nil {
+			t.Errorf("OpenHistory(%s); want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("influx", OpenInflux)
+}
+
+// Influx is a sink writing every window to InfluxDB through the v2 write
+// API. Each metric is a point of its name with its tags and the fields
+// mean, min, max, sum, count and stddev, stamped with the window's end. With
+// several windows each point is also tagged with its window's label.
+//
+// Points are posted in batches, see poster for how failures are retried.
+type Influx struct {
+	batch  int
+	poster *poster
+
+	// the batch being filled and its number of points
+	current bytes.Buffer
+	points  int
+}
+
+// Opens the sink of a URL like influx://influxdb:8086?org=acme&bucket=metrics,
+// its options are
+//
+//	org, bucket  where the points are written, both required
+//	token        API token, or the INFLUX_TOKEN environment variable
+//	tls          post over https (default false)
+//	batch        points per request (default 5000)
+//	buffer       bytes of batches kept while InfluxDB is failing (default 8MiB)
+//	timeout      for each request (default 10s)
+//	backoff      first wait after a failure, doubled on every one in a
+//	             row (default 1s)
+//	max-backoff  longest wait between tries (default 1m)
+func OpenInflux(u *url.URL, opts Options) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("want an address like influx://influxdb:8086")
+	}
+	s := &Influx{batch: 5000}
+	token := os.Getenv("INFLUX_TOKEN")
+	scheme := "http"
+	var org, bucket string
+	var write string
+	s.poster = newPoster("influxdb", func(_ string, batch []byte) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, write, bytes.NewReader(batch))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+		return req, nil
+	})
+	var err error
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "org":
+			org = value
+		case "bucket":
+			bucket = value
+		case "token":
+			token = value
+		case "tls":
+			if tls, err := strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("tls must be a boolean")
+			} else if tls {
+				scheme = "https"
+			}
+		case "batch":
+			if s.batch, err = strconv.Atoi(value); err != nil || s.batch < 1 {
+				return nil, fmt.Errorf("batch must be a positive number of points")
+			}
+		default:
+			if ok, err := s.poster.option(key, value); !ok {
+				return nil, fmt.Errorf("unknown option %q", key)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if org == "" || bucket == "" {
+		return nil, fmt.Errorf("org and bucket are required")
+	}
+	write = (&url.URL{
+		Scheme:   scheme,
+		Host:     u.Host,
+		Path:     "/api/v2/write",
+		RawQuery: url.Values{"org": {org}, "bucket": {bucket}, "precision": {"s"}}.Encode(),
+	}).String()
+	return s, nil
+}
+
+// Flush adds a point per metric to the batch, posting it once full
+func (s *Influx) Flush(w Window, chunk []parser.Metric) error {
+	ts := strconv.FormatInt(w.End.Unix(), 10)
+	for _, m := range chunk {
+		b := s.current.AvailableBuffer()
+		b = appendEscaped(b, m.Name, ", ")
+		if m.Tags != "" {
+			for _, kv := range strings.Split(m.Tags, ",") {
+				k, v, _ := strings.Cut(kv, "=")
+				b = append(b, ',')
+				b = appendEscaped(b, k, ",= ")
+				b = append(b, '=')
+				b = appendEscaped(b, v, ",= ")
+			}
+		}
+		if w.Label != "" {
+			b = append(b, ",window="...)
+			b = append(b, w.Label...)
+		}
+		b = append(b, " mean="...)
+		b = strconv.AppendFloat(b, m.Mean, 'g', -1, 64)
+		b = append(b, ",min="...)
+		b = strconv.AppendFloat(b, m.Min, 'g', -1, 64)
+		b = append(b, ",max="...)
+		b = strconv.AppendFloat(b, m.Max, 'g', -1, 64)
+		b = append(b, ",sum="...)
+		b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+		b = append(b, ",stddev="...)
+		b = strconv.AppendFloat(b, m.Stddev(), 'g', -1, 64)
+		b = append(b, ",count="...)
+		b = strconv.AppendInt(b, int64(m.Count), 10)
+		b = append(b, 'i', ' ')
+		b = append(b, ts...)
+		b = append(b, '\n')
+		s.current.Write(b)
+		if s.points++; s.points == s.batch {
+			s.enqueue()
+			s.poster.send(w.context())
+		}
+	}
+	return nil
+}
+
+// Backslash escapes the special characters of a line protocol name or tag
+func appendEscaped(b []byte, s, special string) []byte {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) >= 0 {
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// Moves the batch being filled to the poster's queue
+func (s *Influx) enqueue() {
+	if s.points > 0 {
+		s.poster.enqueue(bytes.Clone(s.current.Bytes()), s.points)
+	}
+	s.current.Reset()
+	s.points = 0
+}
+
+// End posts the rest of the window and any batches kept from before
+func (s *Influx) End(w Window) error {
+	s.enqueue()
+	return s.poster.end(w.context())
+}
+
+// Close makes a last attempt at posting what is kept, ignoring the backoff
+func (s *Influx) Close() error {
+	s.enqueue()
+	return s.poster.close()
+}
@@ -0,0 +1,116 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestInflux(t *testing.T) {
+	for _, spec := range []string{"influx://", "influx://influxdb:8086?org=acme", "influx://influxdb:8086?org=acme&bucket=m&batch=0"} {
+		u, _ := url.Parse(spec)
+		if _, err := OpenInflux(u, Options{}); err == nil {
+			t.Errorf("OpenInflux(%s); got nil error", spec)
+		}
+	}
+
+	var bodies []string
+	status := []int{http.StatusNoContent}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "metrics" || r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("POST %s with %q; want a write to the metrics bucket with the token", r.URL, r.Header.Get("Authorization"))
+		}
+		code := status[0]
+		if len(status) > 1 {
+			status = status[1:]
+		}
+		if code == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "5")
+		}
+		w.WriteHeader(code)
+		if code == http.StatusNoContent {
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse("influx://" + strings.TrimPrefix(srv.URL, "http://") + "?org=acme&bucket=metrics&token=secret&batch=2")
+	s, err := OpenInflux(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	influx := s.(*Influx)
+	now := time.Unix(1700000000, 0)
+	influx.poster.now = func() time.Time { return now }
+
+	w := Window{End: now}
+	chunk := []parser.Metric{
+		{Name: "cpu", Tags: "host=a b,region=eu", Value: 3, Mean: 1.5, Min: 1, Max: 2, Count: 2, M2: 0.5},
+		{Name: "disk,io", Value: 1, Mean: 1, Min: 1, Max: 1, Count: 1},
+		{Name: "mem", Value: 7, Mean: 7, Min: 7, Max: 7, Count: 1},
+	}
+	influx.Flush(w, chunk)
+	if err := influx.End(w); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+	want := []string{
+		"cpu,host=a\\ b,region=eu mean=1.5,min=1,max=2,sum=3,stddev=0.5,count=2i 1700000000\n" +
+			"disk\\,io mean=1,min=1,max=1,sum=1,stddev=0,count=1i 1700000000\n",
+		"mem mean=7,min=7,max=7,sum=7,stddev=0,count=1i 1700000000\n",
+	}
+	if len(bodies) != 2 || bodies[0] != want[0] || bodies[1] != want[1] {
+		t.Errorf("End(); got batches %q, want %q", bodies, want)
+	}
+
+	// a 429 keeps the batch until the server's Retry-After is over, a 400
+	// drops it
+	bodies = nil
+	status = []int{http.StatusTooManyRequests, http.StatusNoContent}
+	influx.Flush(w, chunk[2:])
+	if err := influx.End(w); err == nil || len(influx.poster.queue) != 1 || influx.poster.backoff.left(now) != 5*time.Second {
+		t.Errorf("End() on a 429; got %v with %d batches kept for %v, want 1 kept for 5s", err, len(influx.poster.queue), influx.poster.backoff.left(now))
+	}
+	now = now.Add(5 * time.Second)
+	if err := influx.End(w); err != nil || len(bodies) != 1 || len(influx.poster.queue) != 0 {
+		t.Errorf("End() after the Retry-After; got %v with %d posted, want the kept batch posted", err, len(bodies))
+	}
+	status = []int{http.StatusBadRequest}
+	influx.Flush(w, chunk[2:])
+	if err := influx.End(w); err == nil || len(influx.poster.queue) != 0 || influx.poster.backoff.wait != 0 {
+		t.Errorf("End() on a 400; got %v with %d batches kept, want the batch dropped without backing off", err, len(influx.poster.queue))
+	}
+}
+
+func TestInfluxCancelled(t *testing.T) {
+	// answers nothing until the test is over
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	u, _ := url.Parse("influx://" + strings.TrimPrefix(srv.URL, "http://") + "?org=acme&bucket=metrics")
+	s, err := OpenInflux(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := Window{End: time.Unix(1700000000, 0), Context: ctx}
+	s.Flush(w, []parser.Metric{{Name: "mem", Value: 7, Mean: 7, Min: 7, Max: 7, Count: 1}})
+	start := time.Now()
+	if err := s.(*Influx).End(w); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("End(); got %v after %v, want the request cancelled with the window's context", err, time.Since(start))
+	}
+}
@@ -0,0 +1,427 @@
+package sink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("kafka", OpenKafka)
+}
+
+// The Avro schema of the records of the avro format, for the consumers to
+// read them with. The records are bare, without a registry's header.
+const KafkaAvroSchema = `{"type":"record","name":"Aggregate","namespace":"collector","fields":[
+{"name":"name","type":"string"},
+{"name":"tags","type":{"type":"map","values":"string"}},
+{"name":"window","type":"string"},
+{"name":"start","type":{"type":"long","logicalType":"timestamp-millis"}},
+{"name":"end","type":{"type":"long","logicalType":"timestamp-millis"}},
+{"name":"count","type":"long"},
+{"name":"sum","type":"double"},
+{"name":"mean","type":"double"},
+{"name":"min","type":"double"},
+{"name":"max","type":"double"},
+{"name":"last","type":"double"},
+{"name":"stddev","type":"double"},
+{"name":"correction","type":"boolean"},
+{"name":"seq","type":"long","default":0}]}`
+
+// Kafka is a sink publishing a record per metric of every window to a
+// Kafka topic, keyed by the metric's name so Kafka's default partitioner
+// keeps each metric on one partition. With raw-topic set it also publishes
+// every metric as it is accepted, as a record of its own window of one.
+//
+// Records are JSON objects, see jsonRecord, or Avro as KafkaAvroSchema
+// describes. They are produced as each window ends, the failed ones are
+// counted and dropped rather than held up for the next window.
+type Kafka struct {
+	name     string
+	brokers  []string
+	topic    string
+	rawTopic string
+	avro     bool
+	acks     int16
+	clientID string
+	timeout  time.Duration
+	// the most bytes of records held between windows
+	buffer int
+
+	mu sync.Mutex
+	// the records waiting for the end of the window, by topic
+	pending map[string][]kafkaRecord
+	held    int
+	meta    *kafkaMeta
+	conns   map[string]*kafkaConn
+
+	delivered, failed atomic.Uint64
+}
+
+// Opens the sink of a URL like kafka://broker1:9092,broker2:9092/topic, its
+// options are
+//
+//	format     json (default) or avro
+//	raw-topic  publish every metric accepted to this topic too
+//	acks       all (default), 1 or 0 replicas the brokers wait for
+//	client-id  how the brokers know the producer (default collector)
+//	timeout    for connecting and each request (default 10s)
+//	buffer     bytes of records held for the end of a window (default 8MiB)
+func OpenKafka(u *url.URL, opts Options) (Sink, error) {
+	topic := strings.Trim(u.Path, "/")
+	if u.Host == "" || topic == "" {
+		return nil, fmt.Errorf("want brokers and a topic like kafka://broker:9092/metrics")
+	}
+	k := &Kafka{
+		name:     "kafka " + topic,
+		topic:    topic,
+		acks:     -1,
+		clientID: "collector",
+		timeout:  10 * time.Second,
+		buffer:   8 << 20,
+		pending:  make(map[string][]kafkaRecord),
+		conns:    make(map[string]*kafkaConn),
+	}
+	for _, b := range strings.Split(u.Host, ",") {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, "9092")
+		}
+		k.brokers = append(k.brokers, b)
+	}
+	var err error
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "format":
+			if value != "json" && value != "avro" {
+				return nil, fmt.Errorf("format must be json or avro")
+			}
+			k.avro = value == "avro"
+		case "raw-topic":
+			k.rawTopic = value
+		case "acks":
+			switch value {
+			case "all", "-1":
+				k.acks = -1
+			case "1":
+				k.acks = 1
+			case "0":
+				k.acks = 0
+			default:
+				return nil, fmt.Errorf("acks must be all, 1 or 0")
+			}
+		case "client-id":
+			k.clientID = value
+		case "timeout":
+			if k.timeout, err = time.ParseDuration(value); err != nil || k.timeout <= 0 {
+				return nil, fmt.Errorf("timeout must be a positive duration")
+			}
+		case "buffer":
+			if k.buffer, err = strconv.Atoi(value); err != nil || k.buffer < 0 {
+				return nil, fmt.Errorf("buffer must be 0 or more bytes")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return k, nil
+}
+
+// Returns the record value of a metric over the window, an error for
+// values JSON can't hold
+func (k *Kafka) record(w Window, m parser.Metric) ([]byte, error) {
+	if !k.avro {
+		return marshalRecord(w, m)
+	}
+	tags := tagMap(m.Tags)
+
+	var b []byte
+	b = appendAvroString(b, m.Name)
+	if len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b = binary.AppendVarint(b, int64(len(keys)))
+		for _, key := range keys {
+			b = appendAvroString(b, key)
+			b = appendAvroString(b, tags[key])
+		}
+	}
+	b = binary.AppendVarint(b, 0) // the end of the map
+	b = appendAvroString(b, w.Label)
+	b = binary.AppendVarint(b, w.Start.UnixMilli())
+	b = binary.AppendVarint(b, w.End.UnixMilli())
+	b = binary.AppendVarint(b, int64(m.Count))
+	for _, v := range []float64{m.Value, m.Mean, m.Min, m.Max, m.Last, m.Stddev()} {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	if w.Correction {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return binary.AppendVarint(b, int64(w.Seq)), nil
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// Holds the record of a metric for the topic, or counts it failed when it
+// can't be encoded or the buffer is full. Called with mu held.
+func (k *Kafka) hold(topic string, w Window, m parser.Metric) {
+	value, err := k.record(w, m)
+	if err != nil || k.held+len(value) > k.buffer {
+		k.failed.Add(1)
+		return
+	}
+	k.pending[topic] = append(k.pending[topic], kafkaRecord{key: []byte(m.Name), value: value, time: w.End.UnixMilli()})
+	k.held += len(value)
+}
+
+func (k *Kafka) Flush(w Window, chunk []parser.Metric) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, m := range chunk {
+		k.hold(k.topic, w, m)
+	}
+	return nil
+}
+
+// Relay holds a metric just accepted for the raw topic
+func (k *Kafka) Relay(m parser.Metric) {
+	if k.rawTopic == "" {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.hold(k.rawTopic, Window{Start: m.Time, End: m.Time}, m)
+}
+
+// End produces the records held, retrying those refused for a stale leader
+// once with fresh metadata, and returns why any failed
+func (k *Kafka) End(w Window) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.held == 0 {
+		return nil
+	}
+	pending := k.pending
+	k.pending = make(map[string][]kafkaRecord)
+	k.held = 0
+
+	var err error
+	for try := 0; try < 2 && len(pending) > 0; try++ {
+		if k.meta == nil {
+			if k.meta, err = k.metadata(); err != nil {
+				break
+			}
+		}
+		pending, err = k.produce(pending)
+		if err != nil {
+			// leaders may have moved
+			k.meta = nil
+		}
+	}
+	var lost int
+	for _, records := range pending {
+		lost += len(records)
+	}
+	if lost == 0 {
+		return nil
+	}
+	k.failed.Add(uint64(lost))
+	return fmt.Errorf("%d records lost: %w", lost, err)
+}
+
+// Asks the brokers in turn for the metadata of the topics. Called with mu
+// held.
+func (k *Kafka) metadata() (*kafkaMeta, error) {
+	topics := []string{k.topic}
+	if k.rawTopic != "" && k.rawTopic != k.topic {
+		topics = append(topics, k.rawTopic)
+	}
+	var errs []error
+	for _, b := range k.brokers {
+		c, err := k.conn(b)
+		if err == nil {
+			var meta *kafkaMeta
+			if meta, err = c.metadata(topics); err == nil {
+				return meta, nil
+			}
+			k.drop(b)
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Produces the records to the leaders of their partitions, returning those
+// worth retrying and the last error. Records refused for good are counted
+// failed. Called with mu held.
+func (k *Kafka) produce(pending map[string][]kafkaRecord) (map[string][]kafkaRecord, error) {
+	// the records of each partition of each topic, by leader
+	type partition struct {
+		topic   string
+		number  int32
+		records []kafkaRecord
+	}
+	byLeader := make(map[int32][]*partition)
+	for topic, records := range pending {
+		leaders := k.meta.leaders[topic]
+		parts := make(map[int32]*partition)
+		for _, r := range records {
+			n := kafkaPartition(r.key, len(leaders))
+			p := parts[n]
+			if p == nil {
+				p = &partition{topic: topic, number: n}
+				parts[n] = p
+				byLeader[leaders[n]] = append(byLeader[leaders[n]], p)
+			}
+			p.records = append(p.records, r)
+		}
+	}
+
+	retry := make(map[string][]kafkaRecord)
+	var last error
+	for leader, parts := range byLeader {
+		address, ok := k.meta.brokers[leader]
+		if !ok {
+			// no leader right now
+			for _, p := range parts {
+				retry[p.topic] = append(retry[p.topic], p.records...)
+			}
+			last = fmt.Errorf("kafka: no leader for %d partitions", len(parts))
+			continue
+		}
+
+		var e kafkaEncoder
+		e.int16(-1) // not transactional
+		e.int16(k.acks)
+		e.int32(int32(k.timeout / time.Millisecond))
+		topics := make(map[string][]*partition)
+		for _, p := range parts {
+			topics[p.topic] = append(topics[p.topic], p)
+		}
+		e.int32(int32(len(topics)))
+		for topic, ps := range topics {
+			e.string(topic)
+			e.int32(int32(len(ps)))
+			for _, p := range ps {
+				e.int32(p.number)
+				e.bytes(appendRecordBatch(nil, p.records))
+			}
+		}
+
+		c, err := k.conn(address)
+		var d *kafkaDecoder
+		if err == nil {
+			if d, err = c.request(kafkaProduce, 3, e, k.acks != 0); err != nil {
+				k.drop(address)
+			}
+		}
+		if err != nil {
+			for _, p := range parts {
+				retry[p.topic] = append(retry[p.topic], p.records...)
+			}
+			last = err
+			continue
+		}
+		if d == nil {
+			// acks=0, the brokers don't answer
+			for _, p := range parts {
+				k.delivered.Add(uint64(len(p.records)))
+			}
+			continue
+		}
+
+		for n := d.array(); n > 0; n-- {
+			topic := d.string()
+			for m := d.array(); m > 0; m-- {
+				number := d.int32()
+				code := d.int16()
+				d.int64() // base offset
+				d.int64() // log append time
+				for _, p := range topics[topic] {
+					if p.number != number {
+						continue
+					}
+					switch {
+					case code == 0:
+						k.delivered.Add(uint64(len(p.records)))
+					case kafkaRetriable[code]:
+						retry[topic] = append(retry[topic], p.records...)
+						last = fmt.Errorf("kafka: %s partition %d: error %d", topic, number, code)
+					default:
+						k.failed.Add(uint64(len(p.records)))
+						last = fmt.Errorf("kafka: %s partition %d: error %d, records dropped", topic, number, code)
+					}
+				}
+			}
+		}
+		if d.err != nil {
+			k.drop(address)
+			return retry, d.err
+		}
+	}
+	if len(retry) == 0 {
+		return nil, last
+	}
+	return retry, last
+}
+
+// Returns the connection to a broker, dialing it if need be. Called with mu
+// held.
+func (k *Kafka) conn(address string) (*kafkaConn, error) {
+	if c := k.conns[address]; c != nil {
+		return c, nil
+	}
+	c, err := dialKafka(address, k.clientID, k.timeout)
+	if err != nil {
+		return nil, err
+	}
+	k.conns[address] = c
+	return c, nil
+}
+
+// Closes the connection to a broker after an error, called with mu held
+func (k *Kafka) drop(address string) {
+	if c := k.conns[address]; c != nil {
+		c.Close()
+		delete(k.conns, address)
+	}
+}
+
+// Report writes the records delivered and failed since the last report
+func (k *Kafka) Report(w io.Writer) {
+	delivered, failed := k.delivered.Swap(0), k.failed.Swap(0)
+	if delivered > 0 || failed > 0 {
+		fmt.Fprintf(w, "(10 sec): Sink %s, records delivered %d, failed %d\n", k.name, delivered, failed)
+	}
+}
+
+// Close produces what is held and closes the connections to the brokers
+func (k *Kafka) Close() error {
+	err := k.End(Window{})
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for address := range k.conns {
+		k.drop(address)
+	}
+	return err
+}
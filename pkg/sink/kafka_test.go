@@ -0,0 +1,283 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestMurmur2(t *testing.T) {
+	// the cases of Kafka's own tests
+	for s, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := murmur2([]byte(s)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
+
+// fakeBroker is a single broker cluster with two partitions per topic. The
+// first produce to a partition is refused as sent to a stale leader.
+type fakeBroker struct {
+	t    *testing.T
+	port int32
+
+	mu       sync.Mutex
+	refused  map[int32]bool
+	metadata int
+	// the records produced, by topic then partition
+	records map[string]map[int32][]kafkaRecord
+}
+
+func newFakeBroker(t *testing.T) (*fakeBroker, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b := &fakeBroker{
+		t:       t,
+		port:    int32(l.Addr().(*net.TCPAddr).Port),
+		refused: make(map[int32]bool),
+		records: make(map[string]map[int32][]kafkaRecord),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b, l.Addr().String()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := &kafkaDecoder{b: req}
+		api, version, id := d.int16(), d.int16(), d.int32()
+		d.string()
+		var resp kafkaEncoder
+		resp.int32(0)
+		resp.int32(id)
+		b.mu.Lock()
+		switch {
+		case api == kafkaMetadata && version == 4:
+			b.metadata++
+			resp.int32(0)
+			resp.int32(1)
+			resp.int32(0)
+			resp.string("127.0.0.1")
+			resp.int32(b.port)
+			resp.int16(-1)
+			resp.int16(-1)
+			resp.int32(0)
+			n := d.array()
+			resp.int32(int32(n))
+			for ; n > 0; n-- {
+				resp.int16(0)
+				resp.string(d.string())
+				resp.int8(0)
+				resp.int32(2)
+				for p := int32(0); p < 2; p++ {
+					resp.int16(0)
+					resp.int32(p)
+					resp.int32(0)
+					resp.int32(1)
+					resp.int32(0)
+					resp.int32(1)
+					resp.int32(0)
+				}
+			}
+		case api == kafkaProduce && version == 3:
+			d.string()
+			if acks := d.int16(); acks != -1 {
+				b.t.Errorf("acks %d, want all", acks)
+			}
+			d.int32()
+			var topics kafkaEncoder
+			n := d.array()
+			topics.int32(int32(n))
+			for ; n > 0; n-- {
+				topic := d.string()
+				topics.string(topic)
+				m := d.array()
+				topics.int32(int32(m))
+				for ; m > 0; m-- {
+					p := d.int32()
+					batch := d.take(int(d.int32()))
+					topics.int32(p)
+					if !b.refused[p] {
+						b.refused[p] = true
+						topics.int16(6)
+					} else {
+						if b.records[topic] == nil {
+							b.records[topic] = make(map[int32][]kafkaRecord)
+						}
+						b.records[topic][p] = append(b.records[topic][p], b.decodeBatch(batch)...)
+						topics.int16(0)
+					}
+					topics.int64(0)
+					topics.int64(-1)
+				}
+			}
+			resp = append(resp, topics...)
+			resp.int32(0)
+		default:
+			b.t.Errorf("request %d v%d", api, version)
+		}
+		b.mu.Unlock()
+		binary.BigEndian.PutUint32(resp, uint32(len(resp)-4))
+		conn.Write(resp)
+	}
+}
+
+// Decodes the records of a v2 record batch, checking its length and crc
+func (b *fakeBroker) decodeBatch(batch []byte) []kafkaRecord {
+	if n := binary.BigEndian.Uint32(batch[8:]); int(n) != len(batch)-12 || batch[16] != 2 {
+		b.t.Fatalf("record batch of %d bytes says %d, magic %d", len(batch), n, batch[16])
+	}
+	if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], castagnoli) {
+		b.t.Fatalf("record batch crc %x is wrong", crc)
+	}
+	first := int64(binary.BigEndian.Uint64(batch[27:]))
+	rest := batch[61:]
+	varint := func() int64 {
+		v, n := binary.Varint(rest)
+		rest = rest[n:]
+		return v
+	}
+	var records []kafkaRecord
+	for len(rest) > 0 {
+		varint()
+		rest = rest[1:]
+		var r kafkaRecord
+		r.time = first + varint()
+		varint()
+		r.key = append([]byte(nil), rest[:varint()]...)
+		rest = rest[len(r.key):]
+		r.value = append([]byte(nil), rest[:varint()]...)
+		rest = rest[len(r.value):]
+		varint()
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestKafka(t *testing.T) {
+	broker, address := newFakeBroker(t)
+	u, _ := url.Parse("kafka://" + address + "/metrics?raw-topic=raw")
+	opened, err := OpenKafka(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := opened.(*Kafka)
+	defer k.Close()
+
+	end := time.Unix(1700000000, 0).UTC()
+	w := Window{Start: end.Add(-time.Minute), End: end}
+	chunk := []parser.Metric{
+		{Name: "cpu", Tags: "host=a", Value: 3, Mean: 1.5, Min: 1, Max: 2, Count: 2},
+		{Name: "mem", Value: 7, Mean: 7, Min: 7, Max: 7, Count: 1},
+		{Name: "net", Value: 1, Mean: 1, Min: 1, Max: 1, Count: 1},
+	}
+	k.Relay(parser.Metric{Name: "cpu", Value: 1, Mean: 1, Count: 1, Time: end})
+	k.Flush(w, chunk)
+	if err := k.End(w); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.metadata != 2 {
+		t.Errorf("metadata asked %d times, want again after a stale leader", broker.metadata)
+	}
+	for _, m := range chunk {
+		p := kafkaPartition([]byte(m.Name), 2)
+		var found bool
+		for _, r := range broker.records["metrics"][p] {
+			if string(r.key) != m.Name {
+				continue
+			}
+			found = true
+			var got jsonRecord
+			if err := json.Unmarshal(r.value, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != m.Name || got.Sum != m.Value || got.Count != m.Count || !got.End.Equal(end) || r.time != end.UnixMilli() {
+				t.Errorf("record %s; got %+v", r.value, got)
+			}
+		}
+		if !found {
+			t.Errorf("no record of %s on partition %d", m.Name, p)
+		}
+	}
+	if raw := broker.records["raw"][kafkaPartition([]byte("cpu"), 2)]; len(raw) != 1 {
+		t.Errorf("raw topic got %d records, want the one relayed", len(raw))
+	}
+
+	var report bytes.Buffer
+	k.Report(&report)
+	if want := "(10 sec): Sink kafka metrics, records delivered 4, failed 0\n"; report.String() != want {
+		t.Errorf("Report(); got %q, want %q", report.String(), want)
+	}
+}
+
+func TestKafkaAvro(t *testing.T) {
+	u, _ := url.Parse("kafka://b/metrics?format=avro")
+	opened, err := OpenKafka(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := opened.(*Kafka)
+	end := time.UnixMilli(1000)
+	b, _ := k.record(Window{Start: end.Add(-time.Second), End: end, Label: "1s", Seq: 3}, parser.Metric{Name: "cpu", Tags: "host=a", Value: 2, Count: 1})
+
+	want := []byte{6, 'c', 'p', 'u', 2, 8, 'h', 'o', 's', 't', 2, 'a', 0, 4, '1', 's', 0, 0xd0, 0x0f, 2}
+	if !bytes.HasPrefix(b, want) || len(b) != len(want)+6*8+2 || b[len(want)+7] != 0x40 || b[len(b)-1] != 6 {
+		t.Errorf("record(); got % x, want it to start % x then 6 doubles, false and the seq", b, want)
+	}
+}
+
+func TestOpenKafka(t *testing.T) {
+	for _, spec := range []string{"kafka://b", "kafka:///topic", "kafka://b/t?format=xml", "kafka://b/t?acks=2", "kafka://b/t?nope=1"} {
+		u, _ := url.Parse(spec)
+		if _, err := OpenKafka(u, Options{}); err == nil {
+			t.Errorf("OpenKafka(%s); want an error", spec)
+		}
+	}
+	u, _ := url.Parse("kafka://a,b:9093/t")
+	opened, err := OpenKafka(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(opened.(*Kafka).brokers, " "); got != "a:9092 b:9093" {
+		t.Errorf("brokers %s, want the default port filled in", got)
+	}
+}
@@ -0,0 +1,306 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// The parts of the Kafka protocol a producer needs: Metadata v4 to find the
+// partitions' leaders and Produce v3 carrying v2 record batches. Both are
+// spoken by every broker since Kafka 1.0, through 4.0.
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+)
+
+// the errors a produce is retried for once the metadata is refreshed:
+// unknown topic or partition, leader not available, not the leader, request
+// timed out and not enough replicas
+var kafkaRetriable = map[int16]bool{3: true, 5: true, 6: true, 7: true, 19: true, 20: true}
+
+// kafkaEncoder appends the big-endian fields of a request
+type kafkaEncoder []byte
+
+func (e *kafkaEncoder) int8(v int8)   { *e = append(*e, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { *e = binary.BigEndian.AppendUint16(*e, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { *e = binary.BigEndian.AppendUint32(*e, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { *e = binary.BigEndian.AppendUint64(*e, uint64(v)) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	*e = append(*e, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	*e = append(*e, b...)
+}
+
+// the zigzag varints of record batches
+func (e *kafkaEncoder) varint(v int64) { *e = binary.AppendVarint(*e, v) }
+
+// kafkaDecoder reads the fields of a response, the first short read makes
+// every later one zero and is kept in err
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		if d.err == nil {
+			d.err = errors.New("kafka: short response")
+		}
+		return make([]byte, max(n, 0))
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8   { return int8(d.take(1)[0]) }
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.take(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.take(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.take(8))) }
+
+// reads a string or a nullable string, null is ""
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// reads the length of an array, too long ones for what is left are an error
+func (d *kafkaDecoder) array() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.b) {
+		d.take(len(d.b) + 1)
+		return 0
+	}
+	return int(n)
+}
+
+// kafkaConn is a connection to a broker, requests wait for their response
+type kafkaConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	clientID string
+	timeout  time.Duration
+	// the correlation id of the last request
+	id int32
+}
+
+func dialKafka(address, clientID string, timeout time.Duration) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, r: bufio.NewReader(conn), clientID: clientID, timeout: timeout}, nil
+}
+
+// Sends a request of the api and version with the body, returning the body
+// of the response. Without a response, as for a produce with acks=0, it
+// returns nil.
+func (c *kafkaConn) request(api, version int16, body []byte, response bool) (*kafkaDecoder, error) {
+	c.id++
+	var e kafkaEncoder
+	e.int32(0)
+	e.int16(api)
+	e.int16(version)
+	e.int32(c.id)
+	e.string(c.clientID)
+	e = append(e, body...)
+	binary.BigEndian.PutUint32(e, uint32(len(e)-4))
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(e); err != nil {
+		return nil, err
+	}
+	if !response {
+		return nil, nil
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 64<<20 {
+		return nil, fmt.Errorf("kafka: response of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: b}
+	if id := d.int32(); id != c.id {
+		return nil, fmt.Errorf("kafka: response %d to request %d", id, c.id)
+	}
+	return d, nil
+}
+
+func (c *kafkaConn) Close() error { return c.conn.Close() }
+
+// kafkaMeta is what a Metadata response says of the topics
+type kafkaMeta struct {
+	// the address of each broker by node id
+	brokers map[int32]string
+	// the leader of each partition of each topic, by partition number
+	leaders map[string][]int32
+}
+
+// Asks for the metadata of the topics, which must all exist
+func (c *kafkaConn) metadata(topics []string) (*kafkaMeta, error) {
+	var e kafkaEncoder
+	e.int32(int32(len(topics)))
+	for _, t := range topics {
+		e.string(t)
+	}
+	e.int8(0) // don't create topics
+	d, err := c.request(kafkaMetadata, 4, e, true)
+	if err != nil {
+		return nil, err
+	}
+	meta := &kafkaMeta{brokers: make(map[int32]string), leaders: make(map[string][]int32)}
+	d.int32() // throttle time
+	for n := d.array(); n > 0; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		meta.brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	d.string() // cluster id
+	d.int32()  // controller
+	for n := d.array(); n > 0; n-- {
+		code := d.int16()
+		topic := d.string()
+		d.int8() // internal
+		var leaders []int32
+		for p := d.array(); p > 0; p-- {
+			d.int16() // the partition's error, its leader is -1 then
+			partition := d.int32()
+			leader := d.int32()
+			for r := d.array(); r > 0; r-- {
+				d.int32()
+			}
+			for r := d.array(); r > 0; r-- {
+				d.int32()
+			}
+			if int(partition) >= len(leaders) {
+				leaders = append(leaders, make([]int32, int(partition)+1-len(leaders))...)
+			}
+			leaders[partition] = leader
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("kafka: topic %s: error %d", topic, code)
+		}
+		meta.leaders[topic] = leaders
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	for _, t := range topics {
+		if len(meta.leaders[t]) == 0 {
+			return nil, fmt.Errorf("kafka: topic %s has no partitions", t)
+		}
+	}
+	return meta, nil
+}
+
+// kafkaRecord is a record waiting to be produced
+type kafkaRecord struct {
+	key, value []byte
+	// unix milliseconds
+	time int64
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Appends a v2 record batch of the records, uncompressed and without a
+// producer id
+func appendRecordBatch(b []byte, records []kafkaRecord) []byte {
+	first, last := records[0].time, records[0].time
+	for _, r := range records {
+		first, last = min(first, r.time), max(last, r.time)
+	}
+	e := kafkaEncoder(b)
+	start := len(e)
+	e.int64(0)  // base offset
+	e.int32(0)  // length, filled in below
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	e.int32(0)  // crc, filled in below
+	crcFrom := len(e)
+	e.int16(0) // attributes
+	e.int32(int32(len(records) - 1))
+	e.int64(first)
+	e.int64(last)
+	e.int64(-1) // producer id
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.int32(int32(len(records)))
+	for i, r := range records {
+		var rec kafkaEncoder
+		rec.int8(0) // attributes
+		rec.varint(r.time - first)
+		rec.varint(int64(i))
+		rec.varint(int64(len(r.key)))
+		rec = append(rec, r.key...)
+		rec.varint(int64(len(r.value)))
+		rec = append(rec, r.value...)
+		rec.varint(0) // headers
+		e.varint(int64(len(rec)))
+		e = append(e, rec...)
+	}
+	binary.BigEndian.PutUint32(e[start+8:], uint32(len(e)-start-12))
+	binary.BigEndian.PutUint32(e[crcFrom-4:], crc32.Checksum(e[crcFrom:], castagnoli))
+	return e
+}
+
+// The murmur2 hash Kafka's default partitioner picks a keyed record's
+// partition with, so the collector's records land where Java producers
+// would put them
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) & 3 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// Returns the partition of a key out of n, as Kafka's default partitioner
+func kafkaPartition(key []byte, n int) int32 {
+	return (murmur2(key) & 0x7fffffff) % int32(n)
+}
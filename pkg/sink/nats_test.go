@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// fakeNATS is a NATS server with a stream taking every subject but those
+// under nostream. The first message of each id gets an error in place of
+// its acknowledgement.
+type fakeNATS struct {
+	mu      sync.Mutex
+	connect string
+	// the subjects of the messages taken, by their id for JetStream ones
+	published []string
+	ids       map[string]int
+}
+
+func newFakeNATS(t *testing.T) (*fakeNATS, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f := &fakeNATS{ids: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, l.Addr().String()
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "INFO {\"headers\":true,\"max_payload\":1048576}\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		f.mu.Lock()
+		switch fields[0] {
+		case "CONNECT":
+			f.connect = strings.TrimSpace(line[8:])
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "PUB":
+			size, _ := strconv.Atoi(fields[2])
+			io.ReadFull(r, make([]byte, size+2))
+			f.published = append(f.published, fields[1])
+		case "HPUB":
+			size, _ := strconv.Atoi(fields[4])
+			msg := make([]byte, size+2)
+			io.ReadFull(r, msg)
+			_, id, _ := strings.Cut(string(msg), "Nats-Msg-Id: ")
+			id, _, _ = strings.Cut(id, "\r\n")
+			reply := fields[2]
+			switch {
+			case strings.HasPrefix(fields[1], "nostream."):
+				hdr := "NATS/1.0 503\r\n\r\n"
+				fmt.Fprintf(conn, "HMSG %s 1 %d %d\r\n%s\r\n", reply, len(hdr), len(hdr), hdr)
+			case f.ids[id] == 0:
+				f.ids[id]++
+				ack := `{"error":{"code":503,"description":"stream not ready"}}`
+				fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", reply, len(ack), ack)
+			default:
+				f.ids[id]++
+				f.published = append(f.published, fields[1])
+				ack := `{"stream":"METRICS","seq":1}`
+				fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", reply, len(ack), ack)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestNATS(t *testing.T) {
+	f, address := newFakeNATS(t)
+	u, _ := url.Parse("nats://me:secret@" + address + "?subject=metrics.<window>.<name>")
+	opened, err := OpenNATS(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := opened.(*NATS)
+	defer n.Close()
+
+	w := Window{Start: time.Unix(0, 0), End: time.Unix(60, 0), Label: "1m"}
+	n.Flush(w, []parser.Metric{{Name: "cpu", Count: 1}, {Name: "disk free", Count: 1}})
+	if err := n.End(w); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var connect natsConnect
+	json.Unmarshal([]byte(f.connect), &connect)
+	if connect.User != "me" || connect.Pass != "secret" {
+		t.Errorf("CONNECT %s; want the URL's user and password", f.connect)
+	}
+	if got := strings.Join(f.published, " "); got != "metrics.1m.cpu metrics.1m.disk_free" {
+		t.Errorf("published to %s", got)
+	}
+}
+
+func TestNATSJetStream(t *testing.T) {
+	f, address := newFakeNATS(t)
+	u, _ := url.Parse("nats://" + address + "?jetstream=true&subject=<name>")
+	opened, err := OpenNATS(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := opened.(*NATS)
+	defer n.Close()
+
+	w := Window{Start: time.Unix(0, 0), End: time.Unix(60, 0)}
+	n.Flush(w, []parser.Metric{{Name: "a", Count: 1}, {Name: "nostream.b", Count: 1}, {Name: "c", Count: 1}})
+	err = n.End(w)
+	if err == nil || !strings.Contains(err.Error(), "1 messages lost") {
+		t.Errorf("End(); got error %v, want the message no stream takes lost", err)
+	}
+
+	f.mu.Lock()
+	if got := strings.Join(f.published, " "); got != "a c" {
+		t.Errorf("published to %s, want each retried message once", got)
+	}
+	for id, tries := range f.ids {
+		if tries != 2 {
+			t.Errorf("message %s published %d times, want again under its id after the error", id, tries)
+		}
+	}
+	f.mu.Unlock()
+
+	var report bytes.Buffer
+	n.Report(&report)
+	if want := "(10 sec): Sink nats <name>, messages delivered 2, failed 1\n"; report.String() != want {
+		t.Errorf("Report(); got %q, want %q", report.String(), want)
+	}
+}
+
+func TestOpenNATS(t *testing.T) {
+	for _, spec := range []string{"nats://", "nats://n?subject=metrics.*", "nats://n?attempts=0", "nats://n?nope=1"} {
+		u, _ := url.Parse(spec)
+		if _, err := OpenNATS(u, Options{}); err == nil {
+			t.Errorf("OpenNATS(%s); want an error", spec)
+		}
+	}
+	u, _ := url.Parse("nats://s3cr3t@n")
+	opened, err := OpenNATS(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := opened.(*NATS); n.token != "s3cr3t" || n.address != "n:4222" {
+		t.Errorf("token %q at %s; want the user as token and the default port", n.token, n.address)
+	}
+}
@@ -0,0 +1,305 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("otlp", OpenOTLP)
+}
+
+// OTLP is a sink exporting every window to an OpenTelemetry collector as
+// OTLP metrics. Counters become delta sums, gauges and sets gauges, and
+// everything else a histogram data point carrying the count, sum, min and
+// max of the window. Each point spans the window and carries the metric's
+// tags, and with several windows its window's label, as attributes.
+// Corrections are left out, as deltas they would count twice.
+//
+// Requests go over OTLP/HTTP with protobuf bodies, or over gRPC. The
+// standard library only speaks HTTP/2 over TLS, so gRPC needs tls=true.
+// Requests are posted in batches, see poster for how failures are retried.
+type OTLP struct {
+	batch    int
+	resource []byte
+	poster   *poster
+
+	// the Metric messages of the request being filled and their number
+	current []byte
+	metrics int
+}
+
+// Opens the sink of a URL like otlp://otel-collector:4318, its options are
+//
+//	protocol     http (default) or grpc
+//	tls          connect over TLS (default false)
+//	resource     resource attributes like service.name=collector,env=prod
+//	             (default service.name=collector)
+//	header       extra request headers like authorization=Bearer%20x, may
+//	             be repeated
+//	batch        metrics per request (default 1000)
+//	buffer       bytes of requests kept while the collector is failing
+//	             (default 8MiB)
+//	timeout      for each request (default 10s)
+//	backoff      first wait after a failure, doubled on every one in a
+//	             row (default 1s)
+//	max-backoff  longest wait between tries (default 1m)
+func OpenOTLP(u *url.URL, opts Options) (Sink, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("want an address like otlp://otel-collector:4318")
+	}
+	q := u.Query()
+	grpc := false
+	switch q.Get("protocol") {
+	case "", "http":
+	case "grpc":
+		grpc = true
+	default:
+		return nil, fmt.Errorf("protocol must be http or grpc")
+	}
+	tls := false
+	if v := q.Get("tls"); v != "" {
+		var err error
+		if tls, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("tls must be a boolean")
+		}
+	}
+	if grpc && !tls {
+		return nil, fmt.Errorf("grpc needs tls=true, use the default http protocol on port 4318 for plaintext")
+	}
+
+	endpoint := url.URL{Scheme: "http", Host: u.Host, Path: "/v1/metrics"}
+	if tls {
+		endpoint.Scheme = "https"
+	}
+	if grpc {
+		endpoint.Path = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	}
+	if u.Port() == "" {
+		port := "4318"
+		if grpc {
+			port = "4317"
+		}
+		endpoint.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	s := &OTLP{batch: 1000}
+	headers := make(http.Header)
+	s.poster = newPoster("otlp collector", func(_ string, batch []byte) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(batch))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+		if grpc {
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("TE", "trailers")
+		} else {
+			req.Header.Set("Content-Type", "application/x-protobuf")
+		}
+		return req, nil
+	})
+	if grpc {
+		s.poster.accept = grpcStatus
+	}
+	resource := "service.name=collector"
+	var err error
+	for key, values := range q {
+		value := values[len(values)-1]
+		switch key {
+		case "protocol", "tls":
+		case "resource":
+			resource = value
+		case "header":
+			for _, h := range values {
+				k, v, ok := strings.Cut(h, "=")
+				if !ok || k == "" {
+					return nil, fmt.Errorf("header must be name=value, got %q", h)
+				}
+				headers.Add(k, v)
+			}
+		case "batch":
+			if s.batch, err = strconv.Atoi(value); err != nil || s.batch < 1 {
+				return nil, fmt.Errorf("batch must be a positive number of metrics")
+			}
+		default:
+			if ok, err := s.poster.option(key, value); !ok {
+				return nil, fmt.Errorf("unknown option %q", key)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, kv := range strings.Split(resource, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("resource attributes must be name=value, got %q", kv)
+		}
+		s.resource = appendProtoBytes(s.resource, 1, appendAttribute(nil, k, v))
+	}
+	return s, nil
+}
+
+// the gRPC status codes worth retrying: deadline exceeded, resource
+// exhausted, aborted and unavailable
+var grpcRetryable = map[string]bool{"4": true, "8": true, "10": true, "14": true}
+
+// Judges a gRPC response by its grpc-status, sent as a trailer or, when the
+// call failed before any message, a header
+func grpcStatus(resp *http.Response) (time.Duration, error) {
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	switch {
+	case status == "0":
+		return -1, nil
+	case status == "":
+		return -1, errors.New("grpc: response without a status, batch dropped")
+	case grpcRetryable[status]:
+		return 0, fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	return -1, fmt.Errorf("grpc status %s, batch dropped: %s", status, resp.Trailer.Get("Grpc-Message"))
+}
+
+// OTLP aggregation temporality of points covering one window each
+const otlpDelta = 1
+
+// Flush adds a metric with a data point of each metric to the request,
+// posting it once full
+func (s *OTLP) Flush(w Window, chunk []parser.Metric) error {
+	if w.Correction {
+		return nil
+	}
+	start, end := uint64(w.Start.UnixNano()), uint64(w.End.UnixNano())
+	for _, m := range chunk {
+		var attrs [][]byte
+		if m.Tags != "" {
+			for _, kv := range strings.Split(m.Tags, ",") {
+				k, v, _ := strings.Cut(kv, "=")
+				attrs = append(attrs, appendAttribute(nil, k, v))
+			}
+		}
+		if w.Label != "" {
+			attrs = append(attrs, appendAttribute(nil, "window", w.Label))
+		}
+
+		var metric []byte
+		metric = appendProtoString(metric, 1, m.Name)
+		switch m.Type {
+		case parser.Counter, parser.Gauge, parser.Set:
+			// the attributes are field 7 of a NumberDataPoint
+			var point []byte
+			for _, a := range attrs {
+				point = appendProtoBytes(point, 7, a)
+			}
+			point = appendFixed64(point, 2, start)
+			point = appendFixed64(point, 3, end)
+			switch m.Type {
+			case parser.Counter:
+				point = appendFixed64(point, 4, math.Float64bits(m.Value))
+				var sum []byte
+				sum = appendProtoBytes(sum, 1, point)
+				sum = appendVarint(sum, 2, otlpDelta)
+				sum = appendVarint(sum, 3, 1)
+				metric = appendProtoBytes(metric, 7, sum)
+			case parser.Gauge:
+				point = appendFixed64(point, 4, math.Float64bits(m.Last))
+				metric = appendProtoBytes(metric, 5, appendProtoBytes(nil, 1, point))
+			case parser.Set:
+				point = appendFixed64(point, 4, math.Float64bits(float64(m.Cardinality())))
+				metric = appendProtoBytes(metric, 5, appendProtoBytes(nil, 1, point))
+			}
+		default:
+			// the attributes are field 9 of a HistogramDataPoint, a single
+			// bucket holds every value
+			var point []byte
+			for _, a := range attrs {
+				point = appendProtoBytes(point, 9, a)
+			}
+			point = appendFixed64(point, 2, start)
+			point = appendFixed64(point, 3, end)
+			point = appendFixed64(point, 4, uint64(m.Count))
+			point = appendFixed64(point, 5, math.Float64bits(m.Value))
+			point = appendProtoBytes(point, 6, binary.LittleEndian.AppendUint64(nil, uint64(m.Count)))
+			point = appendFixed64(point, 11, math.Float64bits(m.Min))
+			point = appendFixed64(point, 12, math.Float64bits(m.Max))
+			var histogram []byte
+			histogram = appendProtoBytes(histogram, 1, point)
+			histogram = appendVarint(histogram, 2, otlpDelta)
+			metric = appendProtoBytes(metric, 9, histogram)
+		}
+		s.current = appendProtoBytes(s.current, 2, metric)
+		if s.metrics++; s.metrics == s.batch {
+			s.enqueue()
+			s.poster.send(w.context())
+		}
+	}
+	return nil
+}
+
+// Appends a KeyValue message of a string attribute
+func appendAttribute(b []byte, key, value string) []byte {
+	b = appendProtoString(b, 1, key)
+	return appendProtoBytes(b, 2, appendProtoString(nil, 1, value))
+}
+
+func appendFixed64(b []byte, field, v uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3|1)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendVarint(b []byte, field, v uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// Wraps the metrics being filled in a request onto the poster's queue
+func (s *OTLP) enqueue() {
+	if s.metrics > 0 {
+		var scope []byte
+		scope = appendProtoBytes(scope, 1, appendProtoString(nil, 1, "collector"))
+		scope = append(scope, s.current...)
+		var rm []byte
+		rm = appendProtoBytes(rm, 1, s.resource)
+		rm = appendProtoBytes(rm, 2, scope)
+		req := appendProtoBytes(nil, 1, rm)
+		if s.poster.accept != nil {
+			// gRPC frames the message: uncompressed, then its length
+			req = append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(req))), req...)
+		}
+		s.poster.enqueue(req, s.metrics)
+	}
+	s.current = s.current[:0]
+	s.metrics = 0
+}
+
+// End posts the rest of the window and any requests kept from before
+func (s *OTLP) End(w Window) error {
+	if w.Correction {
+		return nil
+	}
+	s.enqueue()
+	return s.poster.end(w.context())
+}
+
+// Close makes a last attempt at posting what is kept, ignoring the backoff
+func (s *OTLP) Close() error {
+	s.enqueue()
+	return s.poster.close()
+}
@@ -0,0 +1,149 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Decodes the attributes of a KeyValue list into k=v
+func decodeAttribute(t *testing.T, b []byte) string {
+	var key, value string
+	protoFields(t, b, func(field uint64, v []byte, _ uint64) {
+		if field == 1 {
+			key = string(v)
+		} else {
+			protoFields(t, v, func(_ uint64, s []byte, _ uint64) { value = string(s) })
+		}
+	})
+	return key + "=" + value
+}
+
+// Decodes an ExportMetricsServiceRequest into its resource attributes and a
+// line per data point of the metric's name, kind, attributes and values
+func decodeExport(t *testing.T, b []byte) (resource []string, lines []string) {
+	protoFields(t, b, func(_ uint64, rm []byte, _ uint64) {
+		protoFields(t, rm, func(field uint64, v []byte, _ uint64) {
+			if field == 1 {
+				protoFields(t, v, func(_ uint64, kv []byte, _ uint64) {
+					resource = append(resource, decodeAttribute(t, kv))
+				})
+				return
+			}
+			protoFields(t, v, func(field uint64, metric []byte, _ uint64) {
+				if field != 2 {
+					return
+				}
+				var name, line string
+				protoFields(t, metric, func(field uint64, data []byte, _ uint64) {
+					if field == 1 {
+						name = string(data)
+						return
+					}
+					line = map[uint64]string{5: "gauge", 7: "sum", 9: "histogram"}[field]
+					protoFields(t, data, func(f uint64, point []byte, n uint64) {
+						switch f {
+						case 2:
+							line += fmt.Sprintf(" temporality=%d", n)
+							return
+						case 3:
+							line += fmt.Sprintf(" monotonic=%d", n)
+							return
+						}
+						protoFields(t, point, func(f uint64, p []byte, n uint64) {
+							switch {
+							case (field == 9 && f == 9) || (field != 9 && f == 7):
+								line += " " + decodeAttribute(t, p)
+							case f == 4 && field != 9:
+								line += fmt.Sprintf(" value=%g", math.Float64frombits(n))
+							case f == 4:
+								line += fmt.Sprintf(" count=%d", n)
+							case f == 5:
+								line += fmt.Sprintf(" sum=%g", math.Float64frombits(n))
+							case f == 11:
+								line += fmt.Sprintf(" min=%g", math.Float64frombits(n))
+							case f == 12:
+								line += fmt.Sprintf(" max=%g", math.Float64frombits(n))
+							}
+						})
+					})
+				})
+				lines = append(lines, name+" "+line)
+			})
+		})
+	})
+	return resource, lines
+}
+
+func TestOTLP(t *testing.T) {
+	var resource []string
+	var requests [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer x" {
+			t.Errorf("POST %s; want protobuf to /v1/metrics with the extra header", r.URL)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var lines []string
+		resource, lines = decodeExport(t, body)
+		requests = append(requests, lines)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse("otlp://" + strings.TrimPrefix(srv.URL, "http://") + "?resource=service.name=edge,env=prod&header=Authorization=Bearer%20x&batch=2")
+	opened, err := OpenOTLP(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := opened.(*OTLP)
+	end := time.Unix(1700000000, 0)
+	w := Window{Start: end.Add(-time.Minute), End: end, Label: "1m"}
+	s.Flush(w, []parser.Metric{
+		{Name: "hits", Type: parser.Counter, Tags: "host=a", Value: 5, Count: 5},
+		{Name: "temp", Type: parser.Gauge, Value: 40, Last: 21, Count: 2},
+		{Name: "users", Type: parser.Set, Members: map[string]struct{}{"x": {}, "y": {}}},
+		{Name: "latency", Value: 6, Min: 1, Max: 5, Count: 2},
+	})
+	s.Flush(Window{Correction: true}, []parser.Metric{{Name: "hits", Type: parser.Counter, Value: 1}})
+	if err := s.End(w); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+
+	if strings.Join(resource, ",") != "service.name=edge,env=prod" {
+		t.Errorf("resource; got %v", resource)
+	}
+	want := []string{
+		"hits sum host=a window=1m value=5 temporality=1 monotonic=1",
+		"temp gauge window=1m value=21",
+		"users gauge window=1m value=2",
+		"latency histogram window=1m count=2 sum=6 min=1 max=5 temporality=1",
+	}
+	if len(requests) != 2 {
+		t.Fatalf("End(); got %d requests, want one per 2 metrics", len(requests))
+	}
+	if got := strings.Join(append(requests[0], requests[1]...), "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("exported; got\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestOpenOTLP(t *testing.T) {
+	for _, spec := range []string{"otlp://", "otlp://c?protocol=grpc", "otlp://c?protocol=udp", "otlp://c?resource=env", "otlp://c?nope=1"} {
+		u, _ := url.Parse(spec)
+		if _, err := OpenOTLP(u, Options{}); err == nil {
+			t.Errorf("OpenOTLP(%s); want an error", spec)
+		}
+	}
+	u, _ := url.Parse("otlp://c?protocol=grpc&tls=true")
+	if _, err := OpenOTLP(u, Options{}); err != nil {
+		t.Errorf("OpenOTLP(%s); got error %v", u, err)
+	}
+}
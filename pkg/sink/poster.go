@@ -0,0 +1,169 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// poster posts the batches of a sink writing over HTTP, in order. A batch
+// turned down with 429 or a 5xx is kept, up to a limit, and posted again
+// once the wait of the backoff, or of the server's Retry-After, is over. Any
+// other error drops the batch, it would only fail again.
+type poster struct {
+	// names the endpoint in errors
+	name string
+	// the most bytes of batches kept while the endpoint is failing
+	buffer  int
+	client  *http.Client
+	backoff backoff
+	now     func() time.Time
+	// returns the request posting a batch, named by its key for the sinks
+	// storing each batch under its own name
+	request func(key string, batch []byte) (*http.Request, error)
+	// when set, judges the response of a 2xx in place of the status code,
+	// returning as post does
+	accept func(resp *http.Response) (time.Duration, error)
+
+	// batches waiting to be posted and their size in bytes
+	queue   []keyedBatch
+	queued  int
+	dropped int
+	err     error
+}
+
+// keyedBatch is a batch waiting to be posted and its key
+type keyedBatch struct {
+	key  string
+	data []byte
+}
+
+func newPoster(name string, request func(key string, batch []byte) (*http.Request, error)) *poster {
+	return &poster{
+		name:    name,
+		buffer:  8 << 20,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: backoff{min: time.Second, max: time.Minute},
+		now:     time.Now,
+		request: request,
+	}
+}
+
+// Parses the options every poster takes, returning false for any other
+func (p *poster) option(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "buffer":
+		if p.buffer, err = strconv.Atoi(value); err != nil || p.buffer < 0 {
+			return true, fmt.Errorf("buffer must be 0 or more bytes")
+		}
+	case "timeout":
+		if p.client.Timeout, err = time.ParseDuration(value); err != nil || p.client.Timeout <= 0 {
+			return true, fmt.Errorf("timeout must be a positive duration")
+		}
+	case "backoff":
+		if p.backoff.min, err = time.ParseDuration(value); err != nil || p.backoff.min <= 0 {
+			return true, fmt.Errorf("backoff must be a positive duration")
+		}
+		p.backoff.max = max(p.backoff.max, p.backoff.min)
+	case "max-backoff":
+		if p.backoff.max, err = time.ParseDuration(value); err != nil || p.backoff.max <= 0 {
+			return true, fmt.Errorf("max-backoff must be a positive duration")
+		}
+		p.backoff.max = max(p.backoff.max, p.backoff.min)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Queues a batch of n points, or drops it while the endpoint is failing and
+// the queue is over the buffer limit. The batch becomes the poster's.
+func (p *poster) enqueue(batch []byte, n int) {
+	p.enqueueKey("", batch, n)
+}
+
+// Like enqueue but names the batch by a key for the request
+func (p *poster) enqueueKey(key string, batch []byte, n int) {
+	if p.backoff.wait > 0 && p.queued+len(batch) > p.buffer {
+		p.dropped += n
+		return
+	}
+	p.queue = append(p.queue, keyedBatch{key, batch})
+	p.queued += len(batch)
+}
+
+// Posts the queued batches, returning what failed and how many points were
+// dropped since the last call
+func (p *poster) end(ctx context.Context) error {
+	err := p.send(ctx)
+	if p.dropped > 0 {
+		err = errors.Join(err, fmt.Errorf("%d points dropped", p.dropped))
+		p.dropped = 0
+	}
+	return err
+}
+
+// Posts the queued batches in order until one fails or the context is done
+func (p *poster) send(ctx context.Context) error {
+	var errs []error
+	for len(p.queue) > 0 {
+		now := p.now()
+		if wait := p.backoff.left(now); wait > 0 {
+			errs = append(errs, fmt.Errorf("%s unavailable, %v, %d batches kept for the next try in %v", p.name, p.err, len(p.queue), wait.Round(time.Millisecond)))
+			break
+		}
+		retry, err := p.post(ctx, p.queue[0])
+		if err != nil && retry >= 0 {
+			p.err = err
+			errs = append(errs, fmt.Errorf("%v, retrying in %v", err, p.backoff.failFor(now, retry)))
+			break
+		}
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			p.backoff.reset()
+		}
+		p.queued -= len(p.queue[0].data)
+		p.queue = p.queue[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// Posts a batch. A failure worth retrying returns how long the server asked
+// to wait, 0 when it didn't, any other returns -1.
+func (p *poster) post(ctx context.Context, batch keyedBatch) (time.Duration, error) {
+	req, err := p.request(batch.key, batch.data)
+	if err != nil {
+		return -1, err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode/100 == 2 && p.accept != nil:
+		return p.accept(resp)
+	case resp.StatusCode/100 == 2:
+		return -1, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(secs) * time.Second, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return -1, fmt.Errorf("%s, batch dropped: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+// Makes a last attempt at posting what is kept, ignoring the backoff
+func (p *poster) close() error {
+	p.backoff.reset()
+	return p.send(context.Background())
+}
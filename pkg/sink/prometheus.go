@@ -0,0 +1,244 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("prometheus", OpenPrometheus)
+}
+
+// Prometheus is a sink serving the last complete window in the Prometheus
+// text format, for a Prometheus server to scrape. Each metric is a summary
+// whose _sum and _count keep adding up the windows, with the -percentiles
+// of the last window as its quantiles, followed by _mean, _min and _max
+// gauges of the last window.
+//
+// Only the metrics of the last window are served, a series missing from a
+// window starts its _sum and _count again from 0 when it comes back, which
+// Prometheus takes as a counter reset. Corrections are left out, a scrape
+// can't amend the past.
+type Prometheus struct {
+	prefix string
+	opts   Options
+	srv    *http.Server
+
+	mu sync.Mutex
+	// the series served, by window label then key
+	served map[string]map[string]*promSeries
+	// the series of the windows being flushed
+	next map[string]map[string]*promSeries
+}
+
+// promSeries is a metric of the last window with its running totals
+type promSeries struct {
+	m          parser.Metric
+	name       string
+	labels     string
+	sum, count float64
+}
+
+// Opens the sink of a URL like prometheus://:9102, serving the metrics on
+// the address. Its options are
+//
+//	path    the path the metrics are served on (default /metrics)
+//	prefix  prepended to every metric name
+func OpenPrometheus(u *url.URL, opts Options) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("want an address like prometheus://:9102")
+	}
+	p := &Prometheus{opts: opts, served: make(map[string]map[string]*promSeries), next: make(map[string]map[string]*promSeries)}
+	path := "/metrics"
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "path":
+			path = value
+		case "prefix":
+			p.prefix = promName(value)
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET "+path, p)
+	p.srv = &http.Server{Handler: mux, ErrorLog: slog.NewLogLogger(slog.Default().With("sink", "prometheus").Handler(), slog.LevelWarn)}
+	go p.srv.Serve(ln)
+	return p, nil
+}
+
+func (p *Prometheus) Flush(w Window, chunk []parser.Metric) error {
+	if w.Correction {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := p.next[w.Label]
+	if next == nil {
+		next = make(map[string]*promSeries)
+		p.next[w.Label] = next
+	}
+	served := p.served[w.Label]
+	for _, m := range chunk {
+		key := m.Key()
+		s := &promSeries{m: m, name: p.prefix + promName(m.Name), labels: promLabels(m.Tags, w.Label)}
+		// the chunk is only lent, the members and producers aren't served
+		s.m.Members, s.m.Uniques, s.m.Producers = nil, nil, nil
+		if m.Digest != nil {
+			s.m.Digest = m.Digest.Clone()
+		}
+		if prev, ok := served[key]; ok {
+			s.sum, s.count = prev.sum, prev.count
+		}
+		s.sum += m.Value
+		s.count += float64(m.Count)
+		next[key] = s
+	}
+	return nil
+}
+
+// End serves the window in place of the one before
+func (p *Prometheus) End(w Window) error {
+	if w.Correction {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.served[w.Label] = p.next[w.Label]
+	delete(p.next, w.Label)
+	return nil
+}
+
+// ServeHTTP writes the last window of every label, grouped into families
+func (p *Prometheus) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	var series []*promSeries
+	for _, window := range p.served {
+		for _, s := range window {
+			series = append(series, s)
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(rw)
+	defer b.Flush()
+	for i := 0; i < len(series); {
+		name := series[i].name
+		j := i
+		for j < len(series) && series[j].name == name {
+			j++
+		}
+		family := series[i:j]
+		fmt.Fprintf(b, "# TYPE %s summary\n", name)
+		for _, s := range family {
+			if s.m.Digest != nil {
+				for _, pct := range p.opts.Percentiles {
+					q := strconv.FormatFloat(pct/100, 'g', -1, 64)
+					fmt.Fprintf(b, "%s%s %s\n", name, withLabel(s.labels, "quantile", q), p.opts.format(s.m.Quantile(pct/100)))
+				}
+			}
+			fmt.Fprintf(b, "%s_sum%s %s\n", name, s.labels, p.opts.format(s.sum))
+			fmt.Fprintf(b, "%s_count%s %s\n", name, s.labels, p.opts.format(s.count))
+		}
+		for _, gauge := range []struct {
+			suffix string
+			value  func(m parser.Metric) float64
+		}{
+			{"_mean", func(m parser.Metric) float64 { return m.Mean }},
+			{"_min", func(m parser.Metric) float64 { return m.Min }},
+			{"_max", func(m parser.Metric) float64 { return m.Max }},
+		} {
+			fmt.Fprintf(b, "# TYPE %s%s gauge\n", name, gauge.suffix)
+			for _, s := range family {
+				fmt.Fprintf(b, "%s%s%s %s\n", name, gauge.suffix, s.labels, p.opts.format(gauge.value(s.m)))
+			}
+		}
+		i = j
+	}
+}
+
+// Returns s with the characters a Prometheus name can't have replaced by
+// underscores, and an underscore in front of a leading digit
+func promName(s string) string {
+	b := make([]byte, 0, len(s)+1)
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		b = append(b, '_')
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':') {
+			c = '_'
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns the tags, and the window when there are several, as label names
+// and values
+func promLabelPairs(tags, window string) [][2]string {
+	var pairs [][2]string
+	if tags != "" {
+		for _, kv := range strings.Split(tags, ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			pairs = append(pairs, [2]string{promName(k), v})
+		}
+	}
+	if window != "" {
+		pairs = append(pairs, [2]string{"window", window})
+	}
+	return pairs
+}
+
+// Returns the tags, and the window when there are several, as a label set
+func promLabels(tags, window string) string {
+	pairs := promLabelPairs(tags, window)
+	if len(pairs) == 0 {
+		return ""
+	}
+	labels := make([]string, len(pairs))
+	for i, p := range pairs {
+		labels[i] = p[0] + `="` + promEscaper.Replace(p[1]) + `"`
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+// Close stops serving
+func (p *Prometheus) Close() error {
+	return p.srv.Shutdown(context.Background())
+}
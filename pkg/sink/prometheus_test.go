@@ -0,0 +1,57 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestPrometheus(t *testing.T) {
+	u, _ := url.Parse("prometheus://127.0.0.1:0?prefix=collector_")
+	s, err := OpenPrometheus(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	p := s.(*Prometheus)
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	w := Window{Label: "1m"}
+	p.Flush(w, []parser.Metric{
+		{Name: "api-latency", Tags: `path=/a"b`, Value: 3, Mean: 1.5, Min: 1, Max: 2, Count: 2},
+		{Name: "9lives", Value: 1, Mean: 1, Min: 1, Max: 1, Count: 1},
+	})
+	if got := scrape(); got != "" {
+		t.Errorf("scrape before the window ended; got %q, want nothing", got)
+	}
+	p.End(w)
+	// the totals add up over the windows, a correction isn't served
+	p.Flush(w, []parser.Metric{{Name: "api-latency", Tags: `path=/a"b`, Value: 5, Mean: 5, Min: 5, Max: 5, Count: 1}})
+	p.Flush(Window{Label: "1m", Correction: true}, []parser.Metric{{Name: "late", Count: 1}})
+	p.End(w)
+
+	want := `# TYPE collector_api_latency summary
+collector_api_latency_sum{path="/a\"b",window="1m"} 8
+collector_api_latency_count{path="/a\"b",window="1m"} 3
+# TYPE collector_api_latency_mean gauge
+collector_api_latency_mean{path="/a\"b",window="1m"} 5
+# TYPE collector_api_latency_min gauge
+collector_api_latency_min{path="/a\"b",window="1m"} 5
+# TYPE collector_api_latency_max gauge
+collector_api_latency_max{path="/a\"b",window="1m"} 5
+`
+	if got := scrape(); got != want {
+		t.Errorf("scrape; got\n%s\nwant\n%s", got, want)
+	}
+	if got := promName("9lives.total"); got != "_9lives_total" {
+		t.Errorf("promName(9lives.total); got %s, want _9lives_total", got)
+	}
+}
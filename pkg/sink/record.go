@@ -0,0 +1,51 @@
+package sink
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// jsonRecord is the JSON object a message sink publishes for a metric over
+// a window
+type jsonRecord struct {
+	Name       string            `json:"name"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Window     string            `json:"window,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Count      int               `json:"count"`
+	Sum        float64           `json:"sum"`
+	Mean       float64           `json:"mean"`
+	Min        float64           `json:"min"`
+	Max        float64           `json:"max"`
+	Last       float64           `json:"last"`
+	Stddev     float64           `json:"stddev"`
+	Correction bool              `json:"correction,omitempty"`
+	Seq        uint64            `json:"seq,omitempty"`
+}
+
+// Returns the JSON record of a metric over the window, an error for values
+// JSON can't hold
+func marshalRecord(w Window, m parser.Metric) ([]byte, error) {
+	return json.Marshal(jsonRecord{
+		Name: m.Name, Tags: tagMap(m.Tags), Window: w.Label, Start: w.Start, End: w.End,
+		Count: m.Count, Sum: m.Value, Mean: m.Mean, Min: m.Min, Max: m.Max,
+		Last: m.Last, Stddev: m.Stddev(), Correction: w.Correction, Seq: w.Seq,
+	})
+}
+
+// Returns canonical tags as a map, nil when there are none
+func tagMap(tags string) map[string]string {
+	if tags == "" {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(tags, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,140 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/snappy"
+)
+
+// Decodes the fields of a protobuf message, only the wire types a
+// WriteRequest uses
+func protoFields(t *testing.T, b []byte, fn func(field uint64, v []byte, n uint64)) {
+	t.Helper()
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			fn(tag>>3, nil, v)
+			b = b[n:]
+		case 1:
+			fn(tag>>3, nil, binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			fn(tag>>3, b[n:n+int(l)], 0)
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+}
+
+// Decodes a WriteRequest into a line per sample of its labels, value and
+// timestamp
+func decodeWriteRequest(t *testing.T, b []byte) []string {
+	var lines []string
+	protoFields(t, b, func(_ uint64, series []byte, _ uint64) {
+		var labels []string
+		var sample string
+		protoFields(t, series, func(field uint64, v []byte, _ uint64) {
+			if field == 1 {
+				var name, value string
+				protoFields(t, v, func(field uint64, s []byte, _ uint64) {
+					if field == 1 {
+						name = string(s)
+					} else {
+						value = string(s)
+					}
+				})
+				labels = append(labels, name+"="+value)
+			} else {
+				protoFields(t, v, func(field uint64, _ []byte, n uint64) {
+					if field == 1 {
+						sample += fmt.Sprint(math.Float64frombits(n))
+					} else {
+						sample += fmt.Sprintf(" @%d", n)
+					}
+				})
+			}
+		})
+		if !sort.StringsAreSorted(labels) {
+			t.Errorf("labels %v; want them sorted", labels)
+		}
+		lines = append(lines, strings.Join(labels, ",")+" "+sample)
+	})
+	return lines
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var requests [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if r.URL.Path != "/api/v1/push" || r.Header.Get("Content-Encoding") != "snappy" || user != "me" || password != "secret" || r.Header.Get("X-Scope-OrgID") != "acme" {
+			t.Errorf("POST %s as %s:%s; want a snappy push with basic auth and the tenant", r.URL, user, password)
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Fatalf("snappy.Decode(); got error %v", err)
+		}
+		requests = append(requests, decodeWriteRequest(t, req))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse("remote-write://me:secret@" + strings.TrimPrefix(srv.URL, "http://") + "?tenant=acme&prefix=collector_&batch=1")
+	opened, err := OpenRemoteWrite(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := opened.(*RemoteWrite)
+	end := time.UnixMilli(1700000000000)
+	w := Window{Start: end.Add(-time.Minute), End: end}
+	chunk := []parser.Metric{
+		{Name: "cpu", Tags: "host=a", Value: 3, Mean: 1.5, Min: 1, Max: 2, Count: 2},
+		{Name: "mem", Value: 7, Mean: 7, Min: 7, Max: 7, Count: 1},
+	}
+	s.Flush(w, chunk)
+	s.Flush(Window{Correction: true}, chunk)
+	if err := s.End(w); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+	w.End = end.Add(time.Minute)
+	s.Flush(w, chunk[:1])
+	if err := s.End(w); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("End(); got %d requests, want one per metric", len(requests))
+	}
+	want := []string{
+		"__name__=collector_cpu_sum,host=a 3 @1700000000000",
+		"__name__=collector_cpu_count,host=a 2 @1700000000000",
+		"__name__=collector_cpu_mean,host=a 1.5 @1700000000000",
+		"__name__=collector_cpu_min,host=a 1 @1700000000000",
+		"__name__=collector_cpu_max,host=a 2 @1700000000000",
+	}
+	if strings.Join(requests[0], "\n") != strings.Join(want, "\n") {
+		t.Errorf("first request; got\n%s\nwant\n%s", strings.Join(requests[0], "\n"), strings.Join(want, "\n"))
+	}
+	// the sum and count go on adding up
+	if got := requests[2][:2]; got[0] != "__name__=collector_cpu_sum,host=a 6 @1700000060000" || got[1] != "__name__=collector_cpu_count,host=a 4 @1700000060000" {
+		t.Errorf("second window; got %v, want the totals of both windows", got)
+	}
+}
@@ -0,0 +1,196 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rollupTier is a resolution the history's windows are downsampled to once
+// they are past the retention, and how long they are kept at it
+type rollupTier struct {
+	res, keep time.Duration
+}
+
+// Parses the rollups option, tiers like 5m:168h,1h:2160h, each coarser and
+// kept longer than the one before. A resolution divides a day, a bucket
+// never straddles two segments.
+func parseRollups(s string) ([]rollupTier, error) {
+	var tiers []rollupTier
+	for _, spec := range strings.Split(s, ",") {
+		res, keep, ok := strings.Cut(spec, ":")
+		t := rollupTier{}
+		var err error
+		if t.res, err = time.ParseDuration(res); !ok || err != nil || t.res <= 0 || (24*time.Hour)%t.res != 0 {
+			return nil, fmt.Errorf("rollups want resolution:keep tiers like 5m:168h,1h:2160h, a resolution dividing a day")
+		}
+		if t.keep, err = time.ParseDuration(keep); err != nil || t.keep <= 0 {
+			return nil, fmt.Errorf("rollups want resolution:keep tiers like 5m:168h,1h:2160h")
+		}
+		if n := len(tiers); n > 0 && (t.res <= tiers[n-1].res || t.keep <= tiers[n-1].keep) {
+			return nil, fmt.Errorf("each rollup must be coarser and kept longer than the one before")
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, nil
+}
+
+// Returns the resolution as it goes in segment names, 5m rather than 5m0s
+func formatResolution(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// Returns the resolution a segment is kept at by now, false once it is past
+// every tier and removed
+func (h *History) resolution(now time.Time, s historySegment) (time.Duration, bool) {
+	if h.retention == 0 || !s.end.Before(now.Add(-h.retention)) {
+		return s.res, true
+	}
+	for _, t := range h.rollups {
+		if !s.end.Before(now.Add(-t.keep)) {
+			return max(s.res, t.res), true
+		}
+	}
+	return 0, false
+}
+
+// rollupRecord is a line of the history being rolled up, a window's
+// jsonRecord or the historyRaw of a name
+type rollupRecord struct {
+	jsonRecord
+	Raw int `json:"raw,omitempty"`
+	// the resolution of a record rolled up already
+	Resolution string `json:"resolution,omitempty"`
+}
+
+// the records of a bucket merged, and the second moment of their values
+type rollupBucket struct {
+	rec  rollupRecord
+	key  string
+	last time.Time
+	m2   float64
+}
+
+// Writes the records of the segments downsampled to res: the windows of a
+// metric starting within a bucket of res are merged into one record of the
+// bucket, its counts and sums added, its last the latest window's. Of the
+// windows of the same start the last written, a correction, replaces the
+// others. A correction arriving after its window was rolled up is added to
+// the bucket.
+func (h *History) rollUp(w io.Writer, segments []historySegment, res time.Duration) error {
+	windows := make(map[string]rollupRecord)
+	var order []string
+	for _, s := range segments {
+		r, err := h.open(s)
+		if err != nil {
+			return err
+		}
+		lines := bufio.NewScanner(r)
+		lines.Buffer(nil, 1<<20)
+		for lines.Scan() {
+			var rec rollupRecord
+			if json.Unmarshal(lines.Bytes(), &rec) != nil {
+				continue
+			}
+			tags, _ := json.Marshal(rec.Tags)
+			key := fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%d", rec.Name, tags, rec.Window, rec.Resolution, rec.Start.UnixNano())
+			if rec.Raw > 0 {
+				// the raw counts of a name cover distinct spans, all add up
+				key = fmt.Sprintf("%s\x00raw\x00%d", key, len(order))
+			}
+			if _, ok := windows[key]; !ok {
+				order = append(order, key)
+			}
+			windows[key] = rec
+		}
+		r.Close()
+		if err := lines.Err(); err != nil {
+			return fmt.Errorf("reading %s: %v", s.name, err)
+		}
+	}
+
+	buckets := make(map[string]*rollupBucket)
+	for _, key := range order {
+		rec := windows[key]
+		start := rec.Start.Truncate(res)
+		tags, _ := json.Marshal(rec.Tags)
+		bkey := fmt.Sprintf("%s\x00%s\x00%s\x00%t\x00%d", rec.Name, tags, rec.Window, rec.Raw > 0, start.UnixNano())
+		b, ok := buckets[bkey]
+		if !ok {
+			b = &rollupBucket{key: bkey, rec: rec, last: rec.Start, m2: rec.Stddev * rec.Stddev * float64(rec.Count)}
+			b.rec.Start, b.rec.End = start.UTC(), start.Add(res).UTC()
+			b.rec.Correction, b.rec.Seq = false, 0
+			b.rec.Resolution = formatResolution(res)
+			buckets[bkey] = b
+			continue
+		}
+		b.merge(rec)
+	}
+
+	sorted := make([]*rollupBucket, 0, len(buckets))
+	for _, b := range buckets {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].rec.Start.Equal(sorted[j].rec.Start) {
+			return sorted[i].rec.Start.Before(sorted[j].rec.Start)
+		}
+		return sorted[i].key < sorted[j].key
+	})
+	bw := bufio.NewWriter(w)
+	for _, b := range sorted {
+		var line []byte
+		var err error
+		if b.rec.Raw > 0 {
+			line, err = json.Marshal(historyRaw{Name: b.rec.Name, Start: b.rec.Start, End: b.rec.End, Raw: b.rec.Raw, Resolution: b.rec.Resolution})
+		} else {
+			if b.rec.Count > 0 {
+				b.rec.Stddev = math.Sqrt(b.m2 / float64(b.rec.Count))
+			}
+			line, err = json.Marshal(b.rec)
+		}
+		if err != nil {
+			continue
+		}
+		bw.Write(append(line, '\n'))
+	}
+	return bw.Flush()
+}
+
+// Adds a window to the bucket, merging the means and deviations as Chan et
+// al. do
+func (b *rollupBucket) merge(rec rollupRecord) {
+	if rec.Raw > 0 {
+		b.rec.Raw += rec.Raw
+		return
+	}
+	if rec.Count == 0 {
+		return
+	}
+	if b.rec.Count == 0 {
+		b.rec.Min, b.rec.Max = rec.Min, rec.Max
+	}
+	n := b.rec.Count + rec.Count
+	delta := rec.Mean - b.rec.Mean
+	b.m2 += rec.Stddev*rec.Stddev*float64(rec.Count) + delta*delta*float64(b.rec.Count)*float64(rec.Count)/float64(n)
+	b.rec.Mean += delta * float64(rec.Count) / float64(n)
+	b.rec.Count = n
+	b.rec.Sum += rec.Sum
+	b.rec.Min = min(b.rec.Min, rec.Min)
+	b.rec.Max = max(b.rec.Max, rec.Max)
+	if !rec.Start.Before(b.last) {
+		b.rec.Last, b.last = rec.Last, rec.Start
+	}
+}
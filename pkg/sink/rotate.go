@@ -0,0 +1,262 @@
+package sink
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the timestamp a rotated file's name ends with, sorting in time order
+const rotatedLayout = "20060102T150405"
+
+// rotatingFile is the writer of a file stream that is rotated by size or
+// time. Rotation happens between windows, a window's report is never split
+// across files. The rotated file is renamed after the time of its
+// rotation, like report.tsv.20240102T150405, and optionally gzipped in the
+// background.
+type rotatingFile struct {
+	path string
+	// rotate once the file reaches maxSize bytes, or as every interval
+	// starts, never when 0
+	maxSize int64
+	every   time.Duration
+	// how many rotated files are kept, all when 0
+	keep int
+	gzip bool
+	now  func() time.Time
+
+	f    *os.File
+	size int64
+	// the start of the interval the file covers
+	period time.Time
+	// the gzips in progress
+	compressing sync.WaitGroup
+	mu          sync.Mutex
+	// why the last gzip failed
+	err error
+}
+
+// Parses the rotation options of a file URL, returning nil when it asks for
+// no rotation
+func openRotatingFile(path string, options map[string][]string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, now: time.Now}
+	var err error
+	for key, values := range options {
+		value := values[len(values)-1]
+		switch key {
+		case "max-size":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("max-size must be a positive number of bytes")
+			}
+			r.maxSize = int64(n)
+		case "rotate":
+			if r.every, err = time.ParseDuration(value); err != nil || r.every <= 0 {
+				return nil, fmt.Errorf("rotate must be a positive duration")
+			}
+		case "keep":
+			if r.keep, err = strconv.Atoi(value); err != nil || r.keep < 0 {
+				return nil, fmt.Errorf("keep must be 0 or more files")
+			}
+		case "gzip":
+			if r.gzip, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("gzip must be a boolean")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if r.maxSize == 0 && r.every == 0 {
+		if r.keep > 0 || r.gzip {
+			return nil, errors.New("keep and gzip need max-size or rotate")
+		}
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Write opens the file if need be, rotating first what an earlier run left
+// from a past interval
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) open() error {
+	now := r.now()
+	if r.every > 0 {
+		r.period = now.Truncate(r.every)
+		if fi, err := os.Stat(r.path); err == nil && fi.Size() > 0 && fi.ModTime().Before(r.period) {
+			if err := r.rename(fi.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Rotates the file if it is due, called between windows
+func (r *rotatingFile) rotate() error {
+	if r.f == nil {
+		return r.gzipErr()
+	}
+	now := r.now()
+	if !(r.maxSize > 0 && r.size >= r.maxSize) && !(r.every > 0 && !now.Before(r.period.Add(r.every))) {
+		return r.gzipErr()
+	}
+	err := r.f.Close()
+	r.f = nil
+	if err == nil {
+		err = r.rename(now)
+	}
+	return errors.Join(err, r.gzipErr())
+}
+
+// Renames the file after the time, then gzips it and removes the files over
+// the number kept
+func (r *rotatingFile) rename(t time.Time) error {
+	rotated := r.path + "." + t.UTC().Format(rotatedLayout)
+	if _, err := os.Stat(rotated); err == nil {
+		// rotated twice within a second
+		rotated += t.UTC().Format(".000000000")
+	}
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	if !r.gzip {
+		return r.prune()
+	}
+	r.compressing.Add(1)
+	go func() {
+		defer r.compressing.Done()
+		err := compressFile(rotated)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.err = errors.Join(err, r.prune())
+	}()
+	return nil
+}
+
+// Returns and clears why the last gzip failed
+func (r *rotatingFile) gzipErr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.err
+	r.err = nil
+	return err
+}
+
+// Replaces a file with its gzip
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	err = errors.Join(err, zw.Close(), out.Close())
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Removes the oldest rotated files over the number kept
+func (r *rotatingFile) prune() error {
+	if r.keep == 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, m := range matches {
+		stamp := m[len(r.path)+1:]
+		if len(stamp) < len(rotatedLayout) {
+			continue
+		}
+		if _, err := time.Parse(rotatedLayout, stamp[:len(rotatedLayout)]); err != nil {
+			continue
+		}
+		// a file being gzipped is counted once, as its gzip
+		if strings.HasSuffix(m, ".gz") || !r.gzip {
+			rotated = append(rotated, m)
+		}
+	}
+	sort.Strings(rotated)
+	var errs []error
+	for len(rotated) > r.keep {
+		errs = append(errs, os.Remove(rotated[0]))
+		rotated = rotated[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the file and waits for the gzips in progress
+func (r *rotatingFile) Close() error {
+	var err error
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	r.compressing.Wait()
+	return errors.Join(err, r.gzipErr())
+}
+
+// logFile is a rotating file written a record at a time, rotating after
+// any write that makes it due
+type logFile struct {
+	*rotatingFile
+}
+
+// OpenLogFile returns the writer of a log file taking the rotation options
+// of a file stream. Without rotation it is appended to as it is.
+func OpenLogFile(path string, options map[string][]string) (io.WriteCloser, error) {
+	r, err := openRotatingFile(path, options)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	}
+	return logFile{r}, nil
+}
+
+func (l logFile) Write(p []byte) (int, error) {
+	n, err := l.rotatingFile.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, l.rotate()
+}
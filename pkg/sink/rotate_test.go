@@ -0,0 +1,137 @@
+package sink
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the rotated files next to path, oldest first
+func rotated(t *testing.T, path string) []string {
+	t.Helper()
+	matches, _ := filepath.Glob(path + ".*")
+	sort.Strings(matches)
+	return matches
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.tsv")
+	r, err := openRotatingFile(path, map[string][]string{"max-size": {"10"}, "keep": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	s := NewStream(path, Options{}, func() (io.WriteCloser, error) { return r, nil })
+
+	for i := 0; i < 4; i++ {
+		// a window over the limit is written whole, then rotated
+		s.Write([]byte("a window\n"))
+		s.Write([]byte("of lines\n"))
+		if err := s.End(Window{}); err != nil {
+			t.Fatalf("End(); got error %v", err)
+		}
+		now = now.Add(time.Second)
+	}
+	s.Write([]byte("small\n"))
+	s.End(Window{})
+	s.Close()
+
+	files := rotated(t, path)
+	if len(files) != 2 || !strings.HasSuffix(files[1], ".20240102T150408") {
+		t.Errorf("rotated files %v; want the last 2 kept", files)
+	}
+	if b, _ := os.ReadFile(files[1]); string(b) != "a window\nof lines\n" {
+		t.Errorf("rotated file holds %q; want a whole window", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "small\n" {
+		t.Errorf("file holds %q; want what followed the rotation", b)
+	}
+}
+
+func TestRotateByTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.tsv")
+	// left by an earlier run the day before
+	os.WriteFile(path, []byte("yesterday\n"), 0o644)
+	yesterday := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(path, yesterday, yesterday)
+
+	r, err := openRotatingFile(path, map[string][]string{"rotate": {"24h"}, "gzip": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	s := NewStream(path, Options{}, func() (io.WriteCloser, error) { return r, nil })
+
+	s.Write([]byte("today\n"))
+	s.End(Window{})
+	now = now.Add(2 * time.Hour)
+	s.Write([]byte("late today\n"))
+	s.End(Window{})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close(); got error %v", err)
+	}
+
+	files := rotated(t, path)
+	if len(files) != 2 || !strings.HasSuffix(files[0], ".20240101T120000.gz") || !strings.HasSuffix(files[1], ".20240103T010000.gz") {
+		t.Fatalf("rotated files %v; want yesterday's and today's gzipped", files)
+	}
+	f, _ := os.Open(files[1])
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != "today\nlate today\n" {
+		t.Errorf("today's file holds %q", b)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the file is still there after rotating, want it opened on the next write")
+	}
+}
+
+func TestOpenRotatingFile(t *testing.T) {
+	for _, options := range []map[string][]string{
+		{"max-size": {"0"}},
+		{"rotate": {"soon"}},
+		{"gzip": {"true"}},
+		{"nope": {"1"}},
+	} {
+		if _, err := openRotatingFile("f", options); err == nil {
+			t.Errorf("openRotatingFile(%v); want an error", options)
+		}
+	}
+	if r, err := openRotatingFile("f", nil); r != nil || err != nil {
+		t.Errorf("openRotatingFile without options; got %v, %v, want a plain file", r, err)
+	}
+}
+
+func TestOpenLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collector.log")
+	f, err := OpenLogFile(path, map[string][]string{"max-size": {"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a log file rotates after the record that makes it due
+	f.Write([]byte("a record\n"))
+	f.Write([]byte("another record\n"))
+	f.Write([]byte("last\n"))
+	f.Close()
+
+	files := rotated(t, path)
+	if len(files) != 1 {
+		t.Fatalf("rotated files %v; want 1", files)
+	}
+	if b, _ := os.ReadFile(files[0]); string(b) != "a record\nanother record\n" {
+		t.Errorf("rotated file holds %q; want the records up to the limit", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "last\n" {
+		t.Errorf("file holds %q; want the record after the rotation", b)
+	}
+}
@@ -0,0 +1,318 @@
+//go:build !minimal
+
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("s3", OpenS3)
+}
+
+// S3 is a sink archiving every window to S3 or S3 compatible storage, such
+// as MinIO or R2, as a gzipped object of JSON lines, a jsonRecord per
+// metric. Objects are laid out by time for query engines to prune, like
+//
+//	prefix/aggregates/window=1m/year=2024/month=01/day=02/hour=15/20240102T150400Z-<instance>-<n>.ndjson.gz
+//
+// where the window component is only there with several windows and the
+// time is the window's start. Corrections go next to the window they amend
+// with a .correction before the extension. With raw=true every metric
+// accepted is archived too, under prefix/raw/ by the time of the window
+// that uploaded it.
+//
+// The credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN. Uploads are retried, see poster.
+type S3 struct {
+	prefix   string
+	raw      bool
+	instance string
+	poster   *poster
+
+	// the object of the window being flushed
+	current  bytes.Buffer
+	gz       *gzip.Writer
+	window   Window
+	metrics  int
+	uploaded int
+
+	// the object of the metrics relayed since the last window
+	rawMu      sync.Mutex
+	rawCurrent bytes.Buffer
+	rawGz      *gzip.Writer
+	rawMetrics int
+}
+
+// Opens the sink of a URL like s3://bucket/prefix, its options are
+//
+//	region         the bucket's region (default $AWS_REGION or us-east-1)
+//	endpoint       the storage's URL, like http://minio:9000, for other
+//	               than AWS
+//	path-style     put the bucket in the path rather than the host
+//	               (default true with an endpoint)
+//	storage-class  of the objects, like STANDARD_IA
+//	raw            archive every metric accepted too (default false)
+//	buffer         bytes of objects kept while the storage is failing
+//	               (default 64MiB)
+//	timeout        for each upload (default 1m)
+//	backoff        first wait after a failure, doubled on every one in a
+//	               row (default 1s)
+//	max-backoff    longest wait between tries (default 1m)
+func OpenS3(u *url.URL, opts Options) (Sink, error) {
+	bucket := u.Host
+	if bucket == "" {
+		return nil, fmt.Errorf("want a bucket like s3://bucket/prefix")
+	}
+	creds := s3Credentials{
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		region:    os.Getenv("AWS_REGION"),
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if creds.region == "" {
+		creds.region = "us-east-1"
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+	s := &S3{prefix: strings.Trim(u.Path, "/"), instance: hex.EncodeToString(id)}
+
+	var endpoint *url.URL
+	var pathStyle *bool
+	var storageClass string
+	s.poster = newPoster("object storage", func(key string, object []byte) (*http.Request, error) {
+		target := *endpoint
+		if *pathStyle {
+			target.Path = "/" + bucket + "/" + key
+		} else {
+			target.Host = bucket + "." + target.Host
+			target.Path = "/" + key
+		}
+		target.RawPath = s3Escape(target.Path)
+		req, err := http.NewRequest(http.MethodPut, target.String(), bytes.NewReader(object))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/gzip")
+		if storageClass != "" {
+			req.Header.Set("X-Amz-Storage-Class", storageClass)
+		}
+		creds.sign(req, object, time.Now())
+		return req, nil
+	})
+	s.poster.buffer = 64 << 20
+	s.poster.client.Timeout = time.Minute
+	var err error
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "region":
+			creds.region = value
+		case "endpoint":
+			if endpoint, err = url.Parse(value); err != nil || endpoint.Host == "" {
+				return nil, fmt.Errorf("endpoint must be a URL like http://minio:9000")
+			}
+		case "path-style":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("path-style must be a boolean")
+			}
+			pathStyle = &b
+		case "storage-class":
+			storageClass = value
+		case "raw":
+			if s.raw, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("raw must be a boolean")
+			}
+		default:
+			if ok, err := s.poster.option(key, value); !ok {
+				return nil, fmt.Errorf("unknown option %q", key)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if pathStyle == nil {
+		b := endpoint != nil
+		pathStyle = &b
+	}
+	if endpoint == nil {
+		endpoint = &url.URL{Scheme: "https", Host: "s3." + creds.region + ".amazonaws.com"}
+	}
+	return s, nil
+}
+
+// Flush adds the metrics to the window's object
+func (s *S3) Flush(w Window, chunk []parser.Metric) error {
+	if s.gz == nil {
+		s.window = w
+		s.gz = gzip.NewWriter(&s.current)
+	}
+	for _, m := range chunk {
+		b, err := marshalRecord(w, m)
+		if err != nil {
+			continue
+		}
+		s.gz.Write(append(b, '\n'))
+		s.metrics++
+	}
+	return nil
+}
+
+// Relay adds a metric just accepted to the raw object, with raw=true
+func (s *S3) Relay(m parser.Metric) {
+	if !s.raw {
+		return
+	}
+	b, err := marshalRecord(Window{Start: m.Time, End: m.Time}, m)
+	if err != nil {
+		return
+	}
+	s.rawMu.Lock()
+	defer s.rawMu.Unlock()
+	if s.rawGz == nil {
+		s.rawGz = gzip.NewWriter(&s.rawCurrent)
+	}
+	s.rawGz.Write(append(b, '\n'))
+	s.rawMetrics++
+}
+
+// End uploads the window's object, the raw one too if any metrics were
+// relayed, and any kept from before
+func (s *S3) End(w Window) error {
+	s.enqueue()
+	return s.poster.end(w.context())
+}
+
+// Queues the objects being filled for upload
+func (s *S3) enqueue() {
+	if s.gz != nil {
+		s.gz.Close()
+		kind := "aggregates"
+		if s.window.Label != "" {
+			kind += "/window=" + s.window.Label
+		}
+		ext := ".ndjson.gz"
+		if s.window.Correction {
+			ext = ".correction" + ext
+		}
+		s.poster.enqueueKey(s.key(kind, s.window.Start, ext), bytes.Clone(s.current.Bytes()), s.metrics)
+		s.current.Reset()
+		s.gz, s.metrics = nil, 0
+	}
+
+	s.rawMu.Lock()
+	defer s.rawMu.Unlock()
+	if s.rawGz != nil {
+		s.rawGz.Close()
+		s.poster.enqueueKey(s.key("raw", time.Now(), ".ndjson.gz"), bytes.Clone(s.rawCurrent.Bytes()), s.rawMetrics)
+		s.rawCurrent.Reset()
+		s.rawGz, s.rawMetrics = nil, 0
+	}
+}
+
+// Returns the key of an object of the kind starting at t
+func (s *S3) key(kind string, t time.Time, ext string) string {
+	t = t.UTC()
+	s.uploaded++
+	key := fmt.Sprintf("%s/year=%04d/month=%02d/day=%02d/hour=%02d/%s-%s-%d%s",
+		kind, t.Year(), t.Month(), t.Day(), t.Hour(), t.Format("20060102T150405Z"), s.instance, s.uploaded, ext)
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	return key
+}
+
+// Close makes a last attempt at uploading what is kept, ignoring the
+// backoff
+func (s *S3) Close() error {
+	s.enqueue()
+	return s.poster.close()
+}
+
+// s3Credentials signs requests with AWS signature version 4
+type s3Credentials struct {
+	accessKey, secretKey, token string
+	region                      string
+}
+
+// Signs the request with its body, every header set on it is signed along
+// with the host
+func (c s3Credentials) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	date := stamp[:8]
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, k := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", k, strings.TrimSpace(headers[k]))
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%x", signed, payload)
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		c.accessKey, scope, signed, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// Escapes a path as signature version 4 wants it, everything but the
+// unreserved characters and the slashes
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
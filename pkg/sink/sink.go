@@ -0,0 +1,221 @@
+// Package sink writes flushed windows out, to any number of sinks each
+// configured by a URL whose scheme picks its kind
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Window is the span of time a flush covers
+type Window struct {
+	Start, End time.Time
+	// why the window only covers part of its span, like startup or shutdown
+	Partial []string
+	// the metrics are late ones amending a window already flushed
+	Correction bool
+	// the window's length as -window gave it, only set when several windows
+	// are flushed to the sinks side by side
+	Label string
+	// the flush's number, counting up from 1 as the collector runs, and
+	// when it happened. The corrections of a flush share them.
+	Seq     uint64
+	Flushed time.Time
+	// cancels what the sinks are doing over the network for the window,
+	// like the requests of the HTTP sinks. Nothing is cancelled when nil.
+	Context context.Context
+}
+
+// Returns the window's context, the background one when it has none
+func (w Window) context() context.Context {
+	if w.Context == nil {
+		return context.Background()
+	}
+	return w.Context
+}
+
+// Sink takes the aggregates of every window flushed
+type Sink interface {
+	// Flush hands the sink the next chunk of a window's aggregates, in the
+	// report's order, by name unless -sort says otherwise. A window comes in as many chunks as it takes, each with the
+	// same Window. The chunk is only lent to the sink until it returns and
+	// must not be changed.
+	Flush(w Window, chunk []parser.Metric) error
+	// Close writes out anything the sink still holds and releases it
+	Close() error
+}
+
+// Ender is implemented by the sinks that need to know a window is complete,
+// to send a batch or close a file
+type Ender interface {
+	// called after the last chunk of the window, even when it had none
+	End(w Window) error
+}
+
+// Relayer is implemented by the sinks that forward every metric as it is
+// accepted, rather than the window's aggregates
+type Relayer interface {
+	// called from the goroutine of the connection that sent the metric, so
+	// it must be safe for concurrent use. The metric must not be kept.
+	Relay(m parser.Metric)
+}
+
+// Reporter is implemented by the sinks that keep counters, written with the
+// other "(10 sec):" lines
+type Reporter interface {
+	// writes the counters and starts them afresh, called from the
+	// reporting goroutine
+	Report(w io.Writer)
+}
+
+// Options are what the sinks share with the report
+type Options struct {
+	// writes the values of the text sinks: the streams, graphite, statsd
+	// and prometheus, so they match the report. The decimal point must be
+	// '.', whatever the locale. The shortest 'g' when nil.
+	FormatFloat func(float64) string
+	// the -percentiles reported of each metric's digest by the sinks
+	// sending summaries
+	Percentiles []float64
+}
+
+// Returns the value written the way the options say
+func (o Options) format(v float64) string {
+	if o.FormatFloat == nil {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return o.FormatFloat(v)
+}
+
+// Opener returns the sink the URL configures with the options
+type Opener func(u *url.URL, opts Options) (Sink, error)
+
+var openers = make(map[string]Opener)
+
+// Register makes the sinks of a URL scheme available to Open. It is meant
+// to be called from init functions and panics when the scheme is taken.
+func Register(scheme string, open Opener) {
+	if _, ok := openers[scheme]; ok {
+		panic("sink: scheme registered twice: " + scheme)
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns the registered URL schemes in order
+func Schemes() []string {
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the sink configured by a URL like graphite://host:2003, a
+// bare scheme such as stdout needs no more
+func Open(spec string, opts Options) (Sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" && u.Opaque == "" && u.Host == "" {
+		u.Scheme, u.Path = u.Path, ""
+	}
+	open, ok := openers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q, want one of %v", u.Scheme, Schemes())
+	}
+	s, err := open(u, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.Scheme, err)
+	}
+	return s, nil
+}
+
+// Fanout flushes every window to each of its sinks. A sink failing doesn't
+// hold up the others, it only misses the rest of the window.
+type Fanout struct {
+	sinks  []Sink
+	names  []string
+	failed []error
+}
+
+// Add appends a sink, named in the errors it returns
+func (f *Fanout) Add(name string, s Sink) {
+	f.sinks = append(f.sinks, s)
+	f.names = append(f.names, name)
+	f.failed = append(f.failed, nil)
+}
+
+// Len is the number of sinks, a nil Fanout has none
+func (f *Fanout) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.sinks)
+}
+
+// Flush hands the chunk to every sink that hasn't failed this window
+func (f *Fanout) Flush(w Window, chunk []parser.Metric) {
+	if f == nil {
+		return
+	}
+	for i, s := range f.sinks {
+		if f.failed[i] == nil {
+			f.failed[i] = s.Flush(w, chunk)
+		}
+	}
+}
+
+// End tells the sinks the window is complete and returns what failed during
+// it, each error prefixed by its sink's name
+func (f *Fanout) End(w Window) error {
+	if f == nil {
+		return nil
+	}
+	var errs []error
+	for i, s := range f.sinks {
+		if e, ok := s.(Ender); ok && f.failed[i] == nil {
+			f.failed[i] = e.End(w)
+		}
+		if f.failed[i] != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.names[i], f.failed[i]))
+			f.failed[i] = nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Report writes the counters of the sinks keeping any
+func (f *Fanout) Report(w io.Writer) {
+	if f == nil {
+		return
+	}
+	for _, s := range f.sinks {
+		if r, ok := s.(Reporter); ok {
+			r.Report(w)
+		}
+	}
+}
+
+// Close closes every sink
+func (f *Fanout) Close() error {
+	if f == nil {
+		return nil
+	}
+	var errs []error
+	for i, s := range f.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,173 @@
+package sink
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// memSink keeps what it is flushed, failing once it is given fail
+type memSink struct {
+	names  []string
+	ended  int
+	fail   error
+	closed bool
+}
+
+func (s *memSink) Flush(w Window, chunk []parser.Metric) error {
+	for _, m := range chunk {
+		s.names = append(s.names, m.Name)
+	}
+	return s.fail
+}
+
+func (s *memSink) End(w Window) error {
+	s.ended++
+	return nil
+}
+
+func (s *memSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestOpen(t *testing.T) {
+	var opened *url.URL
+	Register("mem", func(u *url.URL, _ Options) (Sink, error) {
+		opened = u
+		return &memSink{}, nil
+	})
+	if _, err := Open("mem://host:1234?prefix=collector", Options{}); err != nil || opened.Host != "host:1234" || opened.Query().Get("prefix") != "collector" {
+		t.Errorf("Open(mem://host:1234?prefix=collector); got %v opening %v", err, opened)
+	}
+	for _, spec := range []string{"stdout", "stderr", "file:///tmp/report.tsv", "tcp://localhost:2003", "udp://localhost:2003", "unix:///tmp/report.sock"} {
+		s, err := Open(spec, Options{})
+		if err != nil {
+			t.Errorf("Open(%s); got error %v", spec, err)
+		} else if _, ok := s.(*Stream); !ok {
+			t.Errorf("Open(%s); got %T, want a *Stream", spec, s)
+		}
+	}
+	for _, spec := range []string{"carrier-pigeon://coop", "file://", "tcp://"} {
+		if _, err := Open(spec, Options{}); err == nil {
+			t.Errorf("Open(%s); got nil error", spec)
+		}
+	}
+}
+
+func TestFanout(t *testing.T) {
+	var none *Fanout
+	none.Flush(Window{}, nil)
+	if none.Len() != 0 || none.End(Window{}) != nil || none.Close() != nil {
+		t.Errorf("nil Fanout; want it to do nothing")
+	}
+
+	ok, broken := &memSink{}, &memSink{fail: errors.New("connection refused")}
+	var f Fanout
+	f.Add("ok", ok)
+	f.Add("broken", broken)
+	w := Window{End: time.Now()}
+	f.Flush(w, []parser.Metric{{Name: "a"}})
+	f.Flush(w, []parser.Metric{{Name: "b"}})
+	err := f.End(w)
+	if err == nil || !strings.HasPrefix(err.Error(), "broken: ") {
+		t.Errorf("End(); got %v, want the broken sink's error", err)
+	}
+	if len(ok.names) != 2 || len(broken.names) != 1 || ok.ended != 1 || broken.ended != 0 {
+		t.Errorf("Flush(); got %v and %v, want the broken sink to miss the rest of the window", ok.names, broken.names)
+	}
+
+	// the next window is tried again
+	broken.fail = nil
+	f.Flush(w, []parser.Metric{{Name: "c"}})
+	if err := f.End(w); err != nil || len(broken.names) != 2 {
+		t.Errorf("End() of the next window; got %v with %v", err, broken.names)
+	}
+	if f.Close(); !ok.closed || !broken.closed {
+		t.Errorf("Close(); want every sink closed")
+	}
+}
+
+func TestStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.tsv")
+	s, err := Open("file://"+path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := parser.Metric{Name: "cpu", Value: 3, Mean: 1.5, Min: 1, Max: 2, Count: 2}
+	if err := s.Flush(Window{}, []parser.Metric{m}); err != nil {
+		t.Fatalf("Flush(); got error %v", err)
+	}
+	io.WriteString(s.(*Stream), "#window\t30s\n")
+	s.Close()
+	data, _ := os.ReadFile(path)
+	if want := "cpu\t1.5\t1\t2\t3\t2\n#window\t30s\n"; string(data) != want {
+		t.Errorf("file stream; got %q, want %q", data, want)
+	}
+
+	// a failing stream is skipped for the rest of the window while the
+	// others are still written
+	var good strings.Builder
+	failing := NewStream("failing", Options{}, func() (io.WriteCloser, error) { return nil, errors.New("no route to host") })
+	working := NewStream("working", Options{}, func() (io.WriteCloser, error) { return nopCloser{&good}, nil })
+	streams := Streams{failing, working}
+	io.WriteString(streams, "a\n")
+	io.WriteString(streams, "b\n")
+	if good.String() != "a\nb\n" || failing.Err() == nil || working.Err() != nil {
+		t.Errorf("Streams; got %q, want the working stream written and the failing one erring", good.String())
+	}
+	if failing.Err() != nil {
+		t.Errorf("Err(); want it cleared once returned")
+	}
+}
+
+func TestStreamHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.csv")
+	open := func() *Stream {
+		s, err := Open("file://"+path+"?max-size=1", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.(*Stream).Header = []byte("name,value\n")
+		return s.(*Stream)
+	}
+	s := open()
+	io.WriteString(s, "cpu,1\n")
+	s.Close()
+	// appending to the file doesn't repeat the header
+	s = open()
+	io.WriteString(s, "cpu,2\n")
+	s.End(Window{})
+	// the file rotated at the end of the window, the next starts over
+	io.WriteString(s, "cpu,3\n")
+	s.Close()
+
+	if data, _ := os.ReadFile(path); string(data) != "name,value\ncpu,3\n" {
+		t.Errorf("file stream; got %q, want a header after rotating", data)
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 1 {
+		t.Fatalf("rotated files %v", matches)
+	}
+	if data, _ := os.ReadFile(matches[0]); string(data) != "name,value\ncpu,1\ncpu,2\n" {
+		t.Errorf("rotated file; got %q, want one header", data)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	opts := Options{FormatFloat: func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }}
+	var b strings.Builder
+	s := NewStream("memory", opts, func() (io.WriteCloser, error) { return nopCloser{&b}, nil })
+	s.Flush(Window{}, []parser.Metric{{Name: "cpu", Value: 10, Mean: 10.0 / 3, Min: 1e-7, Max: 1e21, Count: 3}})
+	if want := "cpu\t3.33\t0.00\t1000000000000000000000.00\t10.00\t3\n"; b.String() != want {
+		t.Errorf("Flush(); got %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,238 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func init() {
+	Register("statsd", OpenStatsD)
+}
+
+// StatsD is a sink forwarding metrics to a downstream statsd daemon over
+// UDP, so the collector can sit in front of an existing statsd pipeline and
+// only pass on what it validated. It relays either every metric as it is
+// accepted, or each window's aggregates: counters as their sum, gauges as
+// their last value, sets as their members and everything else as its mean
+// sampled at 1/count, which keeps the count and sum downstream.
+//
+// Lines are packed into packets no bigger than the packet option. Relayed
+// lines go out once a packet is full and at the end of every window. Tags
+// are sent dogstatsd style, as |#key:value.
+type StatsD struct {
+	raw    bool
+	prefix string
+	tags   bool
+	packet int
+	opts   Options
+
+	mu      sync.Mutex
+	conn    net.Conn
+	dial    func() (net.Conn, error)
+	pending []byte
+	// packets lost since the last window and why
+	lost int
+	err  error
+}
+
+// Opens the sink of a URL like statsd://statsd:8125, its options are
+//
+//	mode    raw (default) relays every metric accepted, aggregate sends
+//	        each window's aggregates
+//	prefix  prepended to every name, followed by a dot
+//	tags    send tags, false for daemons that don't take them (default true)
+//	packet  the most bytes sent in a packet (default 1432)
+func OpenStatsD(u *url.URL, opts Options) (Sink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("want an address like statsd://statsd:8125")
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "8125")
+	}
+	s := &StatsD{raw: true, tags: true, packet: 1432, opts: opts}
+	var err error
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "mode":
+			if value != "raw" && value != "aggregate" {
+				return nil, fmt.Errorf("mode must be raw or aggregate")
+			}
+			s.raw = value == "raw"
+		case "prefix":
+			s.prefix = strings.Trim(value, ".")
+		case "tags":
+			if s.tags, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("tags must be a boolean")
+			}
+		case "packet":
+			if s.packet, err = strconv.Atoi(value); err != nil || s.packet < 64 {
+				return nil, fmt.Errorf("packet must be at least 64 bytes")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	s.dial = func() (net.Conn, error) {
+		return net.Dial("udp", address)
+	}
+	return s, nil
+}
+
+// Relay forwards a metric just accepted, in raw mode
+func (s *StatsD) Relay(m parser.Metric) {
+	if !s.raw {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.Type == parser.Set {
+		for member := range m.Members {
+			s.add(s.appendLine(nil, m.Name, member, "s", m.Tags, ""))
+		}
+		return
+	}
+	s.add(s.appendValue(nil, m, m.Value, ""))
+}
+
+// Flush sends the aggregates of the window, in aggregate mode. Corrections
+// are sent too, statsd only ever adds them up.
+func (s *StatsD) Flush(w Window, chunk []parser.Metric) error {
+	if s.raw {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range chunk {
+		switch m.Type {
+		case parser.Set:
+			// the members of a sketch are gone, its count is sent instead
+			if m.Uniques != nil {
+				s.add(s.appendLine(nil, m.Name, strconv.Itoa(m.Cardinality()), "g", m.Tags, w.Label))
+			}
+			for member := range m.Members {
+				s.add(s.appendLine(nil, m.Name, member, "s", m.Tags, w.Label))
+			}
+		case parser.Gauge:
+			s.add(s.appendValue(nil, m, m.Last, w.Label))
+		case parser.Counter:
+			s.add(s.appendValue(nil, m, m.Value, w.Label))
+		default:
+			s.add(s.appendValue(nil, m, m.Mean, w.Label))
+		}
+	}
+	return nil
+}
+
+// Appends the line of a value of the metric's type. A negative gauge is set
+// to zero first, statsd takes a signed gauge for a change to the last one.
+// A mean stands for count values through its sample rate.
+func (s *StatsD) appendValue(b []byte, m parser.Metric, v float64, label string) []byte {
+	switch m.Type {
+	case parser.Counter:
+		return s.appendLine(b, m.Name, s.opts.format(v), "c", m.Tags, label)
+	case parser.Gauge:
+		if v < 0 {
+			b = s.appendLine(b, m.Name, "0", "g", m.Tags, label)
+		}
+		return s.appendLine(b, m.Name, s.opts.format(v), "g", m.Tags, label)
+	}
+	typ := "ms"
+	if m.Count > 1 {
+		// the rate is exact whatever the values' precision
+		typ += "|@" + strconv.FormatFloat(1/float64(m.Count), 'g', -1, 64)
+	}
+	return s.appendLine(b, m.Name, s.opts.format(v), typ, m.Tags, label)
+}
+
+// Appends a line like name:value|type|#key:value, tags and the window's
+// label are only sent when tags are
+func (s *StatsD) appendLine(b []byte, name, value, typ, tags, label string) []byte {
+	if s.prefix != "" {
+		b = append(b, s.prefix...)
+		b = append(b, '.')
+	}
+	b = append(b, name...)
+	b = append(b, ':')
+	b = append(b, value...)
+	b = append(b, '|')
+	b = append(b, typ...)
+	if s.tags && (tags != "" || label != "") {
+		b = append(b, "|#"...)
+		if tags != "" {
+			b = append(b, strings.ReplaceAll(tags, "=", ":")...)
+		}
+		if label != "" {
+			if tags != "" {
+				b = append(b, ',')
+			}
+			b = append(b, "window:"...)
+			b = append(b, label...)
+		}
+	}
+	return append(b, '\n')
+}
+
+// Adds lines to the packet being filled, sending it first when they don't
+// fit. Called with mu held.
+func (s *StatsD) add(lines []byte) {
+	if len(s.pending) > 0 && len(s.pending)+len(lines) > s.packet {
+		s.send()
+	}
+	s.pending = append(s.pending, lines...)
+}
+
+// Sends the packet being filled, the trailing newline left out. Called with
+// mu held.
+func (s *StatsD) send() {
+	if len(s.pending) == 0 {
+		return
+	}
+	defer func() { s.pending = s.pending[:0] }()
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			s.lost++
+			s.err = err
+			return
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(s.pending[:len(s.pending)-1]); err != nil {
+		s.lost++
+		s.err = err
+	}
+}
+
+// End sends what is left of the window, returning why any packets were lost
+// since the last one
+func (s *StatsD) End(w Window) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send()
+	if s.lost == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%d packets lost: %w", s.lost, s.err)
+	s.lost, s.err = 0, nil
+	return err
+}
+
+func (s *StatsD) Close() error {
+	err := s.End(Window{})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		err = errors.Join(err, s.conn.Close())
+		s.conn = nil
+	}
+	return err
+}
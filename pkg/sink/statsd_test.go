@@ -0,0 +1,94 @@
+package sink
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Opens a statsd sink sending to a local UDP socket, returning a function
+// that reads the packets sent so far
+func openStatsD(t *testing.T, options string) (*StatsD, func() []string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	u, _ := url.Parse("statsd://" + pc.LocalAddr().String() + "?" + options)
+	opened, err := OpenStatsD(u, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { opened.Close() })
+	return opened.(*StatsD), func() []string {
+		var packets []string
+		buf := make([]byte, 2048)
+		for {
+			pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return packets
+			}
+			packets = append(packets, string(buf[:n]))
+		}
+	}
+}
+
+func TestStatsDRaw(t *testing.T) {
+	s, read := openStatsD(t, "prefix=edge&packet=64")
+	s.Relay(parser.Metric{Name: "hits", Type: parser.Counter, Value: 10, Tags: "host=a"})
+	s.Relay(parser.Metric{Name: "temp", Type: parser.Gauge, Value: -3})
+	s.Relay(parser.Metric{Name: "users", Type: parser.Set, Members: map[string]struct{}{"x": {}}})
+	s.Relay(parser.Metric{Name: "latency", Value: 12, Count: 1})
+	s.Flush(Window{}, []parser.Metric{{Name: "hits", Type: parser.Counter, Value: 10}})
+	if err := s.End(Window{}); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+
+	want := []string{
+		"edge.hits:10|c|#host:a\nedge.temp:0|g\nedge.temp:-3|g",
+		"edge.users:x|s\nedge.latency:12|ms",
+	}
+	if got := read(); strings.Join(got, "\n--\n") != strings.Join(want, "\n--\n") {
+		t.Errorf("packets; got %q, want %q", got, want)
+	}
+}
+
+func TestStatsDAggregate(t *testing.T) {
+	s, read := openStatsD(t, "mode=aggregate&tags=false")
+	s.Relay(parser.Metric{Name: "hits", Type: parser.Counter, Value: 10})
+	s.Flush(Window{Label: "1m"}, []parser.Metric{
+		{Name: "hits", Type: parser.Counter, Tags: "host=a", Value: 30, Count: 3},
+		{Name: "temp", Type: parser.Gauge, Value: 40, Last: 21, Count: 2},
+		{Name: "latency", Value: 12, Mean: 3, Count: 4},
+	})
+	if err := s.End(Window{}); err != nil {
+		t.Fatalf("End(); got error %v", err)
+	}
+
+	got := read()
+	if len(got) != 1 {
+		t.Fatalf("packets; got %q, want the window in one", got)
+	}
+	lines := strings.Split(got[0], "\n")
+	sort.Strings(lines)
+	want := []string{"hits:30|c", "latency:3|ms|@0.25", "temp:21|g"}
+	if strings.Join(lines, " ") != strings.Join(want, " ") {
+		t.Errorf("lines; got %q, want %q", lines, want)
+	}
+}
+
+func TestOpenStatsD(t *testing.T) {
+	for _, spec := range []string{"statsd://", "statsd://d?mode=fast", "statsd://d?packet=10", "statsd://d?nope=1"} {
+		u, _ := url.Parse(spec)
+		if _, err := OpenStatsD(u, Options{}); err == nil {
+			t.Errorf("OpenStatsD(%s); want an error", spec)
+		}
+	}
+}
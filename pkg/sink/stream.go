@@ -0,0 +1,198 @@
+package sink
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// DialTimeout bounds connecting the network streams
+var DialTimeout = 5 * time.Second
+
+func init() {
+	Register("stdout", func(_ *url.URL, opts Options) (Sink, error) {
+		return NewStream("stdout", opts, func() (io.WriteCloser, error) { return nopCloser{os.Stdout}, nil }), nil
+	})
+	Register("stderr", func(_ *url.URL, opts Options) (Sink, error) {
+		return NewStream("stderr", opts, func() (io.WriteCloser, error) { return nopCloser{os.Stderr}, nil }), nil
+	})
+	Register("file", func(u *url.URL, opts Options) (Sink, error) {
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, errors.New("want a path like file:///var/log/report.tsv")
+		}
+		r, err := openRotatingFile(path, u.Query())
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			return NewStream(path, opts, func() (io.WriteCloser, error) { return r, nil }), nil
+		}
+		return NewStream(path, opts, func() (io.WriteCloser, error) {
+			return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		}), nil
+	})
+	for _, network := range []string{"tcp", "udp", "unix"} {
+		Register(network, func(u *url.URL, opts Options) (Sink, error) {
+			address := u.Host
+			if network == "unix" {
+				address = u.Path
+			}
+			if address == "" {
+				return nil, fmt.Errorf("want an address like %s://host:port", network)
+			}
+			return NewStream(u.String(), opts, func() (io.WriteCloser, error) {
+				return net.DialTimeout(network, address, DialTimeout)
+			}), nil
+		})
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// Stream is a sink writing to a byte stream: stdout, a file or a network
+// connection. The collector writes its whole text report, signatures and
+// all, to its streams. Flushed on its own a stream writes a row per
+// aggregate of name, mean, min, max, sum and count.
+//
+// The stream is opened on the first write. After a write fails the rest of
+// the window is skipped, and a connection is dialed again for the next one.
+//
+// A file stream is rotated by size or time with the options
+//
+//	max-size  rotate once the file reaches this many bytes
+//	rotate    rotate as every interval of this duration starts, like 24h
+//	keep      how many rotated files are kept (default all)
+//	gzip      gzip the rotated files (default false)
+type Stream struct {
+	// written first whenever the stream is opened, unless it is a file
+	// that already has content, like the column names of the CSV report
+	Header []byte
+
+	name string
+	opts Options
+	open func() (io.WriteCloser, error)
+	w    io.WriteCloser
+	err  error
+	// the header is due before the next write
+	header bool
+}
+
+// Returns a stream writing to what open returns, named in its errors, its
+// rows written with the options
+func NewStream(name string, opts Options, open func() (io.WriteCloser, error)) *Stream {
+	return &Stream{name: name, opts: opts, open: open}
+}
+
+func (s *Stream) String() string {
+	return s.name
+}
+
+// Write writes to the stream unless it already failed this window. The
+// failure is kept for Err rather than returned, so one stream failing
+// doesn't stop the report going to the others.
+func (s *Stream) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return len(p), nil
+	}
+	if s.w == nil {
+		if s.w, s.err = s.open(); s.err != nil {
+			s.w = nil
+			return len(p), nil
+		}
+		s.header = len(s.Header) > 0 && empty(s.w)
+	}
+	if s.header {
+		if _, s.err = s.w.Write(s.Header); s.err == nil {
+			s.header = false
+		}
+	}
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+	if s.err != nil {
+		// a broken connection is dialed again, a file opened again
+		s.w.Close()
+		s.w = nil
+	}
+	return len(p), nil
+}
+
+// Reports whether a stream just opened starts out empty, a file appended
+// to may not
+func empty(w io.Writer) bool {
+	switch f := w.(type) {
+	case *os.File:
+		fi, err := f.Stat()
+		return err != nil || !fi.Mode().IsRegular() || fi.Size() == 0
+	case *rotatingFile:
+		if f.f == nil && f.open() != nil {
+			return true
+		}
+		return f.size == 0
+	}
+	return true
+}
+
+// End tells the stream the window is written, a rotating file rotates here
+// when due. It returns the window's error like Err.
+func (s *Stream) End(w Window) error {
+	if r, ok := s.w.(*rotatingFile); ok && s.err == nil {
+		open := r.f != nil
+		s.err = r.rotate()
+		// the next file starts with the header too
+		s.header = open && r.f == nil && len(s.Header) > 0
+	}
+	return s.Err()
+}
+
+// Err returns the error that failed the window's writes, if any, and clears
+// it for the next window
+func (s *Stream) Err() error {
+	err := s.err
+	s.err = nil
+	return err
+}
+
+func (s *Stream) Flush(w Window, chunk []parser.Metric) error {
+	b := bufio.NewWriter(s)
+	for _, m := range chunk {
+		fmt.Fprintf(b, "%s\t%s\t%s\t%s\t%s\t%d\n", m.Key(), s.opts.format(m.Mean), s.opts.format(m.Min), s.opts.format(m.Max), s.opts.format(m.Value), m.Count)
+	}
+	b.Flush()
+	if s.err != nil {
+		return s.Err()
+	}
+	return nil
+}
+
+func (s *Stream) Close() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
+
+// Streams is an io.Writer writing to each of the streams
+type Streams []*Stream
+
+func (ss Streams) Write(p []byte) (int, error) {
+	for _, s := range ss {
+		s.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,186 @@
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// StreamMagic starts every snappy framed stream, its stream identifier
+// chunk
+var StreamMagic = []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}
+
+// ErrFraming is returned for a stream that isn't snappy framed
+var ErrFraming = errors.New("snappy: corrupt stream")
+
+const (
+	chunkCompressed   = 0x00
+	chunkUncompressed = 0x01
+	chunkPadding      = 0xfe
+	chunkStreamID     = 0xff
+
+	// the most a chunk of the framing format holds once decoded
+	maxChunkLen = 1 << 16
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// The checksum of a chunk, CRC-32C masked so a stream holding its own
+// checksums doesn't confuse it
+func checksum(b []byte) uint32 {
+	c := crc32.Checksum(b, castagnoli)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+// Reader decodes the snappy framing format, the stream of checksummed
+// blocks snappy's command line tools and libraries write
+type Reader struct {
+	r   io.Reader
+	buf []byte
+	// what was decoded of the last chunk and not read yet
+	out, pending []byte
+	// the stream identifier came first
+	started bool
+	err     error
+}
+
+// NewReader returns a Reader of the framed stream r
+func NewReader(r io.Reader) *Reader {
+	z := &Reader{}
+	z.Reset(r)
+	return z
+}
+
+// Reset makes z read r, keeping its buffers
+func (z *Reader) Reset(r io.Reader) {
+	z.r, z.pending, z.started, z.err = r, nil, false, nil
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.pending) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.chunk()
+	}
+	n := copy(p, z.pending)
+	z.pending = z.pending[n:]
+	return n, nil
+}
+
+// Reads the next chunk, leaving what it decodes to pending
+func (z *Reader) chunk() error {
+	var header [4]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		if err == io.EOF && z.started {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	kind, n := header[0], int(header[1])|int(header[2])<<8|int(header[3])<<16
+	if !z.started && kind != chunkStreamID {
+		return ErrFraming
+	}
+	if cap(z.buf) < n {
+		z.buf = make([]byte, n)
+	}
+	body := z.buf[:n]
+	if _, err := io.ReadFull(z.r, body); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	switch {
+	case kind == chunkStreamID:
+		if string(body) != string(StreamMagic[4:]) {
+			return ErrFraming
+		}
+		z.started = true
+	case kind == chunkCompressed || kind == chunkUncompressed:
+		if n < 4 {
+			return ErrFraming
+		}
+		data := body[4:]
+		if kind == chunkCompressed {
+			size, k := binary.Uvarint(data)
+			if k <= 0 || size > maxChunkLen {
+				return ErrFraming
+			}
+			var err error
+			if data, err = Decode(z.out[:0], data); err != nil {
+				return err
+			}
+			z.out = data
+		} else if len(data) > maxChunkLen {
+			return ErrFraming
+		}
+		if checksum(data) != binary.LittleEndian.Uint32(body) {
+			return ErrFraming
+		}
+		z.pending = data
+	case kind >= 0x80:
+		// padding and the skippable chunks
+	default:
+		return ErrFraming
+	}
+	return nil
+}
+
+// Writer encodes the snappy framing format
+type Writer struct {
+	w   io.Writer
+	buf []byte
+	// what was written and not made a chunk yet
+	data    []byte
+	started bool
+}
+
+// NewWriter returns a Writer framing what is written to it to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write buffers p, writing the chunks it fills
+func (z *Writer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), maxChunkLen-len(z.data))
+		z.data = append(z.data, p[:k]...)
+		p = p[k:]
+		if len(z.data) == maxChunkLen {
+			if err := z.Flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes what is buffered as a chunk
+func (z *Writer) Flush() error {
+	buf := z.buf[:0]
+	if !z.started {
+		buf = append(buf, StreamMagic...)
+		z.started = true
+	}
+	if len(z.data) > 0 {
+		// a chunk that doesn't compress is sent as it is
+		kind, start := byte(chunkCompressed), len(buf)
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		buf = Encode(buf, z.data)
+		if len(buf)-start-8 >= len(z.data) {
+			kind, buf = chunkUncompressed, append(buf[:start+8], z.data...)
+		}
+		n := len(buf) - start - 4
+		buf[start], buf[start+1], buf[start+2], buf[start+3] = kind, byte(n), byte(n>>8), byte(n>>16)
+		binary.LittleEndian.PutUint32(buf[start+4:], checksum(z.data))
+		z.data = z.data[:0]
+	}
+	z.buf = buf
+	_, err := z.w.Write(buf)
+	return err
+}
+
+// Close flushes what is buffered, it doesn't close the underlying writer
+func (z *Writer) Close() error {
+	return z.Flush()
+}
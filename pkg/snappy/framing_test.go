@@ -0,0 +1,51 @@
+package snappy
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestFraming(t *testing.T) {
+	random := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(random)
+	in := append([]byte(strings.Repeat("cpu.load\t1.5\t2024-01-01T00:00:00Z\n", 5000)), random...)
+
+	var stream bytes.Buffer
+	w := NewWriter(&stream)
+	w.Write(in[:1000])
+	w.Flush()
+	w.Write(in[1000:])
+	w.Close()
+	if !bytes.HasPrefix(stream.Bytes(), StreamMagic) || stream.Len() > len(in)/2 {
+		t.Fatalf("Writer; got %d bytes, want a compressed stream", stream.Len())
+	}
+	// a padding chunk and a second stream identifier are skipped
+	framed := append(stream.Bytes(), chunkPadding, 2, 0, 0, 0, 0)
+	framed = append(framed, StreamMagic...)
+
+	r := NewReader(bytes.NewReader(framed))
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, in) {
+		t.Errorf("Reader; got %d bytes, error %v, want %d", len(got), err, len(in))
+	}
+	// and again once reset
+	r.Reset(bytes.NewReader(framed))
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, in) {
+		t.Errorf("Reader reset; got %d bytes, error %v, want %d", len(got), err, len(in))
+	}
+
+	corrupt := bytes.Clone(stream.Bytes())
+	corrupt[len(StreamMagic)+4]++
+	for name, in := range map[string][]byte{
+		"no stream identifier": stream.Bytes()[len(StreamMagic):],
+		"bad checksum":         corrupt,
+		"truncated":            stream.Bytes()[:stream.Len()-1],
+		"unskippable chunk":    append(bytes.Clone(StreamMagic), 0x02, 0, 0, 0),
+	} {
+		if _, err := io.ReadAll(NewReader(bytes.NewReader(in))); err == nil {
+			t.Errorf("Reader, %s; got nil error", name)
+		}
+	}
+}
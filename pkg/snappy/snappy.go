@@ -0,0 +1,169 @@
+// Package snappy encodes and decodes the snappy block format, as Prometheus
+// remote write and snappy framed streams use it
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// ErrCorrupt is returned for input that isn't a valid snappy block
+var ErrCorrupt = errors.New("snappy: corrupt input")
+
+// MaxDecodedLen bounds the length a block may claim to decode to, anything
+// bigger is treated as corrupt rather than allocated
+const MaxDecodedLen = 64 << 20
+
+const (
+	tagLiteral = 0
+	tagCopy1   = 1
+	tagCopy2   = 2
+	tagCopy4   = 3
+
+	// matches are only looked for this far back, so every copy fits the two
+	// byte offset
+	maxOffset = 1<<16 - 1
+	hashBits  = 14
+)
+
+// Encode appends the snappy block of src to dst
+func Encode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	if len(src) < 8 {
+		return appendLiteral(dst, src)
+	}
+	var table [1 << hashBits]int32
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		h := hash(binary.LittleEndian.Uint32(src[i:]))
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > maxOffset || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		n := 4
+		for i+n < len(src) && src[candidate+n] == src[i+n] {
+			n++
+		}
+		dst = appendLiteral(dst, src[literal:i])
+		dst = appendCopy(dst, i-candidate, n)
+		i += n
+		literal = i
+	}
+	return appendLiteral(dst, src[literal:])
+}
+
+func hash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - hashBits)
+}
+
+func appendLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// Appends copies of n bytes from offset back, 64 at most per copy
+func appendCopy(dst []byte, offset, n int) []byte {
+	for n > 0 {
+		l := min(n, 64)
+		// leave at least 4 for the last copy, a copy1 can't be shorter
+		if n-l > 0 && n-l < 4 {
+			l = n - 4
+		}
+		if l >= 4 && l <= 11 && offset < 1<<11 {
+			dst = append(dst, byte(offset>>8)<<5|byte(l-4)<<2|tagCopy1, byte(offset))
+		} else {
+			dst = append(dst, byte(l-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+		}
+		n -= l
+	}
+	return dst
+}
+
+// Decode appends the decoded block src to dst
+func Decode(dst, src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > MaxDecodedLen {
+		return nil, ErrCorrupt
+	}
+	src = src[n:]
+	start := len(dst)
+	dst = slices.Grow(dst, int(size))
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case tagLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, ErrCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || uint64(len(dst)-start+length) > size {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case tagCopy1:
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case tagCopy2:
+			if len(src) < 3 {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case tagCopy4:
+			if len(src) < 5 {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst)-start || uint64(len(dst)-start+length) > size {
+			return nil, ErrCorrupt
+		}
+		// copies may overlap what they write, so go byte by byte
+		from := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[from+i])
+		}
+	}
+	if uint64(len(dst)-start) != size {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,50 @@
+package snappy
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	// a literal, then a copy of 8 bytes from 4 back
+	want := []byte{12, 3 << 2, 'a', 'b', 'c', 'd', 4<<2 | tagCopy1, 4}
+	if got := Encode(nil, []byte("abcdabcdabcd")); !bytes.Equal(got, want) {
+		t.Errorf("Encode(abcdabcdabcd); got %v, want %v", got, want)
+	}
+
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, in := range [][]byte{
+		nil,
+		[]byte("short"),
+		[]byte(strings.Repeat("cpu.load\t1.5\t2024-01-01T00:00:00Z\n", 5000)),
+		random,
+		append(bytes.Repeat([]byte{0}, 70000), random[:300]...),
+	} {
+		enc := Encode(nil, in)
+		dec, err := Decode(nil, enc)
+		if err != nil || !bytes.Equal(dec, in) {
+			t.Errorf("Decode(Encode(%d bytes)); got %d bytes, error %v", len(in), len(dec), err)
+		}
+	}
+	repetitive := []byte(strings.Repeat("cpu.load\t1.5\n", 1000))
+	if enc := Encode(nil, repetitive); len(enc) > len(repetitive)/10 {
+		t.Errorf("Encode(%d repetitive bytes); got %d bytes, want it compressed", len(repetitive), len(enc))
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	for _, in := range [][]byte{
+		{},
+		{5, 3 << 2, 'a'},
+		{4, 4<<2 | tagCopy1, 1},
+		{8, 0, 'a', 4<<2 | tagCopy1, 2},
+		{0xff, 0xff, 0xff, 0xff, 0x7f},
+	} {
+		if _, err := Decode(nil, in); err != ErrCorrupt {
+			t.Errorf("Decode(%v); got %v, want ErrCorrupt", in, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// AnomalyThreshold is the -anomaly-threshold, how many standard deviations
+// from its trailing baseline a window's value must be to be flagged. 0
+// flags nothing and the reports carry no anomaly column.
+var AnomalyThreshold float64
+
+// AnomalyWindows is the -anomaly-windows the baseline covers, no window is
+// flagged before the metric has been seen in that many
+var AnomalyWindows = 20
+
+// Baseline is how the trailing baseline of a metric is kept
+type Baseline int
+
+const (
+	// the mean and standard deviation of the last AnomalyWindows windows
+	BaselineZScore Baseline = iota
+	// an exponentially weighted mean and variance, each window weighing
+	// as much as with a moving average of AnomalyWindows
+	BaselineEWMA
+)
+
+// AnomalyBaseline is the -anomaly-baseline
+var AnomalyBaseline Baseline
+
+// Parses the -anomaly-baseline flag: zscore or ewma
+func ParseBaseline(s string) (Baseline, error) {
+	switch s {
+	case "zscore":
+		return BaselineZScore, nil
+	case "ewma":
+		return BaselineEWMA, nil
+	}
+	return BaselineZScore, fmt.Errorf("unknown anomaly baseline %q, want zscore or ewma", s)
+}
+
+// Anomalies scores the value of every metric's window against the windows
+// before it. Like EWMA the baselines outlive the collection.
+type Anomalies struct {
+	every   time.Duration
+	mu      sync.Mutex
+	metrics map[string]*baseline
+}
+
+type baseline struct {
+	// the last values, a ring, for z-scores
+	values []float64
+	next   int
+	// the exponentially weighted mean and variance
+	mean, variance float64
+	// the windows seen, up to AnomalyWindows
+	n    int
+	seen time.Time
+}
+
+// Returns the baselines of a window flushed every every, nil when
+// AnomalyThreshold flags nothing
+func NewAnomalies(every time.Duration) *Anomalies {
+	if AnomalyThreshold <= 0 {
+		return nil
+	}
+	return &Anomalies{every: every, metrics: make(map[string]*baseline)}
+}
+
+// Check returns how many standard deviations the value of the key's window
+// is from its baseline, then folds it in. The score is 0 unless it is over
+// AnomalyThreshold. A metric that held still is measured against a
+// deviation of a millionth of its level, so any real change is flagged.
+func (a *Anomalies) Check(key string, v float64, now time.Time) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.metrics[key]
+	if !ok {
+		b = &baseline{values: make([]float64, 0, AnomalyWindows)}
+		a.metrics[key] = b
+	}
+	b.seen = now
+	var score float64
+	if b.n >= AnomalyWindows {
+		mean, sd := b.stats()
+		score = (v - mean) / max(sd, 1e-6*max(math.Abs(mean), 1))
+	}
+	b.add(v)
+	if math.Abs(score) < AnomalyThreshold {
+		return 0
+	}
+	return score
+}
+
+// Returns the mean and standard deviation of the baseline
+func (b *baseline) stats() (mean, sd float64) {
+	if AnomalyBaseline == BaselineEWMA {
+		return b.mean, math.Sqrt(b.variance)
+	}
+	for _, v := range b.values {
+		mean += v
+	}
+	mean /= float64(len(b.values))
+	var m2 float64
+	for _, v := range b.values {
+		m2 += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(m2 / float64(len(b.values)))
+}
+
+func (b *baseline) add(v float64) {
+	b.n = min(b.n+1, AnomalyWindows)
+	if AnomalyBaseline == BaselineEWMA {
+		if b.n == 1 {
+			b.mean = v
+			return
+		}
+		// West's incremental form of the exponentially weighted variance
+		alpha := 2 / float64(AnomalyWindows+1)
+		diff := v - b.mean
+		incr := alpha * diff
+		b.mean += incr
+		b.variance = (1 - alpha) * (b.variance + diff*incr)
+		return
+	}
+	if len(b.values) < AnomalyWindows {
+		b.values = append(b.values, v)
+		return
+	}
+	b.values[b.next] = v
+	b.next = (b.next + 1) % len(b.values)
+}
+
+// Forgets the metrics not seen for as many windows as a baseline covers, by
+// then it says nothing about the present
+func (a *Anomalies) Prune(now time.Time) int {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for key, b := range a.metrics {
+		if now.Sub(b.seen) > time.Duration(AnomalyWindows)*a.every {
+			delete(a.metrics, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Forgets the baselines of the metrics whose name or key matches the glob
+// pattern, returning how many there were
+func (a *Anomalies) Forget(pattern string) int {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for key := range a.metrics {
+		if keyMatches(pattern, key) {
+			delete(a.metrics, key)
+			n++
+		}
+	}
+	return n
+}
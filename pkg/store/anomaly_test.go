@@ -0,0 +1,50 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnomalies(t *testing.T) {
+	defer func(threshold float64, windows int, baseline Baseline) {
+		AnomalyThreshold, AnomalyWindows, AnomalyBaseline = threshold, windows, baseline
+	}(AnomalyThreshold, AnomalyWindows, AnomalyBaseline)
+	if NewAnomalies(time.Minute) != nil {
+		t.Error("NewAnomalies() without a threshold; want nil")
+	}
+
+	AnomalyThreshold, AnomalyWindows = 3, 10
+	for _, baseline := range []Baseline{BaselineZScore, BaselineEWMA} {
+		AnomalyBaseline = baseline
+		a := NewAnomalies(time.Minute)
+		now := time.Now()
+		// a baseline wobbling between 9 and 11
+		for i := 0; i < 10; i++ {
+			now = now.Add(time.Minute)
+			if score := a.Check("latency", float64(9+2*(i%2)), now); score != 0 {
+				t.Errorf("%d: Check() while the baseline fills; got %v", baseline, score)
+			}
+		}
+		if score := a.Check("latency", 10.5, now.Add(time.Minute)); score != 0 {
+			t.Errorf("%d: Check(10.5) within the band; got %v", baseline, score)
+		}
+		if score := a.Check("latency", 50, now.Add(2*time.Minute)); score < 3 {
+			t.Errorf("%d: Check(50) of a spike; got %v, want over 3", baseline, score)
+		}
+
+		// a metric that held still is flagged as soon as it moves
+		for i := 0; i < 10; i++ {
+			a.Check("queue", 4, now)
+		}
+		if score := a.Check("queue", 5, now); score == 0 {
+			t.Errorf("%d: Check(5) of a flat metric; got 0", baseline)
+		}
+
+		if n := a.Prune(now.Add(5 * time.Minute)); n != 0 {
+			t.Errorf("%d: Prune(+5m); got %d, want 0", baseline, n)
+		}
+		if n := a.Prune(now.Add(15 * time.Minute)); n != 2 {
+			t.Errorf("%d: Prune(+15m); got %d, want 2", baseline, n)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EWMA keeps exponentially weighted moving averages of every metric's
+// window mean across flushes, like the 1, 5 and 15 minute load averages.
+// Unlike the collection they survive the reset at the end of each window,
+// so a short spike is still visible in the next few reports.
+type EWMA struct {
+	periods []time.Duration
+	mu      sync.Mutex
+	avgs    map[string]*ewmaState
+}
+
+type ewmaState struct {
+	values []float64
+	seen   time.Time
+}
+
+// Returns an EWMA tracking one average per period
+func NewEWMA(periods []time.Duration) *EWMA {
+	return &EWMA{periods: periods, avgs: make(map[string]*ewmaState)}
+}
+
+// Folds the mean of a window that lasted elapsed into the name's averages
+// and returns them, one per period. The first window seeds the averages.
+func (e *EWMA) Update(name string, mean float64, elapsed time.Duration, now time.Time) []float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st, ok := e.avgs[name]
+	if !ok {
+		st = &ewmaState{values: make([]float64, len(e.periods))}
+		for i := range st.values {
+			st.values[i] = mean
+		}
+		e.avgs[name] = st
+	} else {
+		for i, p := range e.periods {
+			alpha := 1 - math.Exp(-elapsed.Seconds()/p.Seconds())
+			st.values[i] += alpha * (mean - st.values[i])
+		}
+	}
+	st.seen = now
+	return append([]float64(nil), st.values...)
+}
+
+// Forgets the metrics that have not been updated for the longest period,
+// by then their averages say nothing about the present
+func (e *EWMA) Prune(now time.Time) int {
+	var longest time.Duration
+	for _, p := range e.periods {
+		longest = max(longest, p)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for name, st := range e.avgs {
+		if now.Sub(st.seen) > longest {
+			delete(e.avgs, name)
+			n++
+		}
+	}
+	return n
+}
+
+// Forgets the averages of the metrics whose name or key matches the glob
+// pattern, returning how many there were
+func (e *EWMA) Forget(pattern string) int {
+	if e == nil {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for key := range e.avgs {
+		if keyMatches(pattern, key) {
+			delete(e.avgs, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Parses the comma separated -ewma periods, like 1m,5m,15m
+func ParseEWMAPeriods(list string) ([]time.Duration, error) {
+	var periods []time.Duration
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		p, err := time.ParseDuration(f)
+		if err != nil || p <= 0 {
+			return nil, fmt.Errorf("%s: want a positive duration", f)
+		}
+		periods = append(periods, p)
+	}
+	return periods, nil
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEWMA(t *testing.T) {
+	e := NewEWMA([]time.Duration{time.Minute, 15 * time.Minute})
+	now := time.Now()
+	if got := e.Update("cpu", 10, 30*time.Second, now); got[0] != 10 || got[1] != 10 {
+		t.Errorf("Update(cpu, 10) first; got %v, want [10 10]", got)
+	}
+
+	// a spike pulls the short average much further than the long one
+	now = now.Add(30 * time.Second)
+	got := e.Update("cpu", 110, 30*time.Second, now)
+	short := 10 + 100*(1-math.Exp(-0.5))
+	long := 10 + 100*(1-math.Exp(-30.0/900))
+	if math.Abs(got[0]-short) > 1e-9 || math.Abs(got[1]-long) > 1e-9 {
+		t.Errorf("Update(cpu, 110); got %v, want [%v %v]", got, short, long)
+	}
+
+	if n := e.Prune(now.Add(10 * time.Minute)); n != 0 {
+		t.Errorf("Prune(+10m); got %d pruned, want 0", n)
+	}
+	if n := e.Prune(now.Add(16 * time.Minute)); n != 1 {
+		t.Errorf("Prune(+16m); got %d pruned, want 1", n)
+	}
+
+	if _, err := ParseEWMAPeriods("1m,0s"); err == nil {
+		t.Errorf("ParseEWMAPeriods(1m,0s); got nil, want an error")
+	}
+	if ps, _ := ParseEWMAPeriods("1m, 5m,15m"); len(ps) != 3 || ps[2] != 15*time.Minute {
+		t.Errorf("ParseEWMAPeriods(1m, 5m,15m); got %v", ps)
+	}
+}
+
+func TestEWMAForget(t *testing.T) {
+	e := NewEWMA([]time.Duration{time.Minute})
+	now := time.Now()
+	e.Update("cpu{host=a}", 10, 30*time.Second, now)
+	e.Update("cpu{host=b}", 10, 30*time.Second, now)
+	e.Update("mem", 10, 30*time.Second, now)
+	// a name matches itself under every tagset
+	if n := e.Forget("cpu"); n != 2 {
+		t.Errorf("Forget(cpu); got %d, want 2", n)
+	}
+	// sent again, the average starts afresh
+	if got := e.Update("cpu{host=a}", 110, 30*time.Second, now); got[0] != 110 {
+		t.Errorf("Update(cpu) after Forget; got %v, want [110]", got)
+	}
+	var none *EWMA
+	if n := none.Forget("cpu"); n != 0 {
+		t.Errorf("Forget() without averages; got %d", n)
+	}
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Final is what an Expiry reports of a metric when it expires
+type Final int
+
+const (
+	// nothing, the metric is just dropped
+	FinalNone Final = iota
+	// a last observation of 0, so graphs of it fall back to the ground
+	FinalZero
+	// a last observation of the value it was last seen at
+	FinalLast
+)
+
+// Parses the -metric-ttl-final flag: none, zero or last
+func ParseFinal(s string) (Final, error) {
+	switch s {
+	case "none":
+		return FinalNone, nil
+	case "zero":
+		return FinalZero, nil
+	case "last":
+		return FinalLast, nil
+	}
+	return FinalNone, fmt.Errorf("unknown final value %q, want none, zero or last", s)
+}
+
+func (f Final) String() string {
+	switch f {
+	case FinalZero:
+		return "zero"
+	case FinalLast:
+		return "last"
+	}
+	return "none"
+}
+
+// Expiry is an Aggregator dropping the metrics not updated for a TTL from
+// its store, so a sliding window doesn't report a series gone quiet for its
+// whole span and the memory kept follows the active series. The metrics are
+// swept as the window is flushed, an expired one optionally reported once
+// more with its Final value. Like EWMA the times last seen outlive the
+// collection, a tumbling window's series get their final value after they
+// stop too.
+type Expiry struct {
+	agg   Aggregator
+	ttl   time.Duration
+	final Final
+	now   func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]expiring
+
+	expired atomic.Uint64
+}
+
+// what is kept of a metric until it expires
+type expiring struct {
+	name, tags string
+	typ        parser.Type
+	last       float64
+	at         time.Time
+}
+
+// Returns an Expiry of the metrics of agg not updated for ttl
+func NewExpiry(agg Aggregator, ttl time.Duration, final Final) *Expiry {
+	return &Expiry{agg: agg, ttl: ttl, final: final, now: time.Now, seen: make(map[string]expiring)}
+}
+
+// SetClock makes the TTL go by the clock rather than the wall clock
+func (e *Expiry) SetClock(c clock.Clock) {
+	e.now = c.Now
+}
+
+// Notes when the metric was updated and the value it was left at
+func (e *Expiry) touch(m parser.Metric) {
+	last := m.Last
+	if m.Count <= 1 {
+		last = m.Value
+	}
+	e.mu.Lock()
+	e.seen[m.Key()] = expiring{name: m.Name, tags: m.Tags, typ: m.Type, last: last, at: e.now()}
+	e.mu.Unlock()
+}
+
+// Deletes the metrics not updated for the TTL from the store, updating it
+// with their final values
+func (e *Expiry) sweep() {
+	now := e.now()
+	var keys []string
+	var finals []parser.Metric
+	e.mu.Lock()
+	for key, x := range e.seen {
+		if now.Sub(x.at) < e.ttl {
+			continue
+		}
+		delete(e.seen, key)
+		keys = append(keys, key)
+		// a set has no value to end on
+		if e.final != FinalNone && x.typ != parser.Set {
+			m := parser.Metric{Name: x.name, Tags: x.tags, Type: x.typ, Count: 1, Time: now}
+			if e.final == FinalLast {
+				m.Value = x.last
+			}
+			finals = append(finals, m)
+		}
+	}
+	e.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+	e.drop(keys)
+	e.expired.Add(uint64(len(keys)))
+	for _, m := range finals {
+		e.agg.Update(m)
+	}
+}
+
+func (e *Expiry) Update(m parser.Metric) {
+	e.touch(m)
+	e.agg.Update(m)
+}
+
+func (e *Expiry) TryUpdate(m parser.Metric) bool {
+	if !e.agg.TryUpdate(m) {
+		return false
+	}
+	e.touch(m)
+	return true
+}
+
+func (e *Expiry) Snapshot() []parser.Metric {
+	return e.agg.Snapshot()
+}
+
+func (e *Expiry) Flush() []parser.Metric {
+	e.sweep()
+	return e.agg.Flush()
+}
+
+func (e *Expiry) FlushSorted(size int, fn func(chunk []parser.Metric)) {
+	e.sweep()
+	e.agg.FlushSorted(size, fn)
+}
+
+func (e *Expiry) Remove(pattern string) int {
+	e.mu.Lock()
+	for key, x := range e.seen {
+		if matches(pattern, key, parser.Metric{Name: x.name}) {
+			delete(e.seen, key)
+		}
+	}
+	e.mu.Unlock()
+	return e.agg.Remove(pattern)
+}
+
+// Delete deletes the metrics of the keys from the store, through Remove
+// when it can't delete by key
+func (e *Expiry) Delete(keys ...string) int {
+	e.mu.Lock()
+	for _, key := range keys {
+		delete(e.seen, key)
+	}
+	e.mu.Unlock()
+	return e.drop(keys)
+}
+
+func (e *Expiry) drop(keys []string) int {
+	if d, ok := e.agg.(Deleter); ok {
+		return d.Delete(keys...)
+	}
+	n := 0
+	for _, key := range keys {
+		n += e.agg.Remove(key)
+	}
+	return n
+}
+
+func (e *Expiry) Ping() {
+	e.agg.Ping()
+}
+
+func (e *Expiry) Dropped() uint64 {
+	if d, ok := e.agg.(Dropper); ok {
+		return d.Dropped()
+	}
+	return 0
+}
+
+// Writes how many metrics expired since the last report, the window named
+// by label
+func (e *Expiry) Report(w io.Writer, label string) {
+	if e == nil {
+		return
+	}
+	if n := e.expired.Swap(0); n > 0 {
+		fmt.Fprintf(w, "(10 sec): Expired %d metrics unseen for %s from the %s window\n", n, e.ttl, label)
+	}
+}
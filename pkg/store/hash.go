@@ -0,0 +1,61 @@
+package store
+
+import (
+	"fmt"
+	"hash/fnv"
+	"hash/maphash"
+)
+
+// Hash maps a metric name onto a shard or partition. Implementations must
+// be safe for concurrent use and return the same value for the same name.
+type Hash interface {
+	Sum32(name string) uint32
+}
+
+// Returns the named Hash: fnv (FNV-1a, the default), fnv1 or maphash.
+// maphash is the fastest but seeded per process, so it is only suitable
+// where the result never leaves the process, like store sharding.
+func ParseHash(name string) (Hash, error) {
+	switch name {
+	case "fnv", "fnv1a":
+		return fnvHash{}, nil
+	case "fnv1":
+		return fnv1Hash{}, nil
+	case "maphash":
+		return maphashHash{maphash.MakeSeed()}, nil
+	}
+	return nil, fmt.Errorf("unknown hash %q, want fnv, fnv1 or maphash", name)
+}
+
+// Returns the hash, FNV-1a when it is nil
+func orFNV(h Hash) Hash {
+	if h == nil {
+		return fnvHash{}
+	}
+	return h
+}
+
+type fnvHash struct{}
+
+func (fnvHash) Sum32(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+type fnv1Hash struct{}
+
+func (fnv1Hash) Sum32(name string) uint32 {
+	h := fnv.New32()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+type maphashHash struct {
+	seed maphash.Seed
+}
+
+func (h maphashHash) Sum32(name string) uint32 {
+	sum := maphash.String(h.seed, name)
+	return uint32(sum ^ sum>>32)
+}
@@ -0,0 +1,46 @@
+package store
+
+import "fmt"
+
+// Overflow decides what becomes of a metric sent to a full ingress channel
+type Overflow int
+
+const (
+	// wait for room (the default)
+	OverflowBlock Overflow = iota
+	// drop the metric being sent
+	OverflowDropNewest
+	// drop the oldest metric queued to make room for it
+	OverflowDropOldest
+)
+
+// Parses the -ingress-overflow flag: block, drop-newest or drop-oldest
+func ParseOverflow(s string) (Overflow, error) {
+	switch s {
+	case "", "block":
+		return OverflowBlock, nil
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy %q, want block, drop-newest or drop-oldest", s)
+}
+
+// Dropper is implemented by the Aggregators that may drop metrics they were
+// given rather than wait
+type Dropper interface {
+	// returns how many metrics were dropped since the last call
+	Dropped() uint64
+}
+
+// Backlogger is implemented by the Aggregators queueing updates ahead of the
+// store
+type Backlogger interface {
+	// returns how many updates are queued and how many may be
+	Backlog() (queued, capacity int)
+}
+
+func (c *channelStore) Backlog() (queued, capacity int) {
+	return len(c.ingress), cap(c.ingress)
+}
@@ -0,0 +1,234 @@
+package store
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// CardinalityPolicy decides what a Limit does with a metric of a new name
+// once its window holds as many names as it may
+type CardinalityPolicy int
+
+const (
+	// the metric is dropped
+	CardinalityReject CardinalityPolicy = iota
+	// the name seen least recently is deleted from the window to make room
+	CardinalityEvict
+	// the metric is aggregated under OverflowName instead
+	CardinalityOverflow
+)
+
+// OverflowName is the name the metrics over the limit are aggregated under
+// by CardinalityOverflow, it doesn't count against the limit
+const OverflowName = "overflow"
+
+// Parses the -cardinality-policy flag: reject, evict-lru or overflow
+func ParseCardinalityPolicy(s string) (CardinalityPolicy, error) {
+	switch s {
+	case "reject":
+		return CardinalityReject, nil
+	case "evict-lru":
+		return CardinalityEvict, nil
+	case "overflow":
+		return CardinalityOverflow, nil
+	}
+	return CardinalityReject, fmt.Errorf("unknown cardinality policy %q, want reject, evict-lru or overflow", s)
+}
+
+func (p CardinalityPolicy) String() string {
+	switch p {
+	case CardinalityEvict:
+		return "evict-lru"
+	case CardinalityOverflow:
+		return "overflow"
+	}
+	return "reject"
+}
+
+// Deleter is implemented by the stores deleting metrics by their keys,
+// without the scan of the collection Remove does
+type Deleter interface {
+	// deletes the metrics of the keys, returning how many there were
+	Delete(keys ...string) int
+}
+
+// Limit is an Aggregator holding a window's store to a number of distinct
+// metric names, so a client making up a name per request can't take all
+// the memory. The names are counted afresh on every flush.
+type Limit struct {
+	agg    Aggregator
+	max    int
+	policy CardinalityPolicy
+	// called once a window, the first time a name is over the limit
+	OnHit func(names int, policy CardinalityPolicy)
+
+	mu sync.Mutex
+	// the names of the window, most recently seen at the front
+	names map[string]*list.Element
+	lru   *list.List
+	hit   bool
+
+	rejected, evicted, overflowed atomic.Uint64
+}
+
+// the keys a name was stored under, deleted along with it
+type limitEntry struct {
+	name string
+	keys map[string]struct{}
+}
+
+// Returns a Limit of max names in agg's window
+func NewLimit(agg Aggregator, max int, policy CardinalityPolicy) *Limit {
+	return &Limit{agg: agg, max: max, policy: policy, names: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Applies the policy to the metric, false if it is dropped
+func (l *Limit) admit(m *parser.Metric) bool {
+	if m.Name == OverflowName {
+		return true
+	}
+	l.mu.Lock()
+	key := m.Key()
+	if e, ok := l.names[m.Name]; ok {
+		l.lru.MoveToFront(e)
+		e.Value.(*limitEntry).keys[key] = struct{}{}
+		l.mu.Unlock()
+		return true
+	}
+	first := len(l.names) >= l.max && !l.hit
+	if len(l.names) >= l.max {
+		l.hit = true
+		switch l.policy {
+		case CardinalityReject:
+			l.rejected.Add(1)
+			l.mu.Unlock()
+			l.alarm(first)
+			return false
+		case CardinalityOverflow:
+			m.Name = OverflowName
+			l.overflowed.Add(1)
+			l.mu.Unlock()
+			l.alarm(first)
+			return true
+		case CardinalityEvict:
+			oldest := l.lru.Remove(l.lru.Back()).(*limitEntry)
+			delete(l.names, oldest.name)
+			l.delete(oldest)
+			l.evicted.Add(1)
+		}
+	}
+	l.names[m.Name] = l.lru.PushFront(&limitEntry{name: m.Name, keys: map[string]struct{}{key: {}}})
+	l.mu.Unlock()
+	l.alarm(first)
+	return true
+}
+
+// Deletes the metrics of an evicted name from the store
+func (l *Limit) delete(e *limitEntry) {
+	if d, ok := l.agg.(Deleter); ok {
+		keys := make([]string, 0, len(e.keys))
+		for key := range e.keys {
+			keys = append(keys, key)
+		}
+		d.Delete(keys...)
+		return
+	}
+	l.agg.Remove(e.name)
+}
+
+func (l *Limit) alarm(first bool) {
+	if first && l.OnHit != nil {
+		l.OnHit(l.max, l.policy)
+	}
+}
+
+// Forgets the names of the window, the next one starts empty
+func (l *Limit) reset() {
+	l.mu.Lock()
+	clear(l.names)
+	l.lru.Init()
+	l.hit = false
+	l.mu.Unlock()
+}
+
+func (l *Limit) Update(m parser.Metric) {
+	if l.admit(&m) {
+		l.agg.Update(m)
+	}
+}
+
+// TryUpdate counts the name against the limit even if the store turns the
+// metric away. A metric the policy drops is taken, there is no point in
+// waiting.
+func (l *Limit) TryUpdate(m parser.Metric) bool {
+	if !l.admit(&m) {
+		return true
+	}
+	return l.agg.TryUpdate(m)
+}
+
+func (l *Limit) Snapshot() []parser.Metric {
+	return l.agg.Snapshot()
+}
+
+func (l *Limit) Flush() []parser.Metric {
+	defer l.reset()
+	return l.agg.Flush()
+}
+
+func (l *Limit) FlushSorted(size int, fn func(chunk []parser.Metric)) {
+	l.reset()
+	l.agg.FlushSorted(size, fn)
+}
+
+// Remove also forgets the names matching the pattern, making room for new
+// ones
+func (l *Limit) Remove(pattern string) int {
+	l.mu.Lock()
+	for name, e := range l.names {
+		if ok, _ := path.Match(pattern, name); ok {
+			l.lru.Remove(e)
+			delete(l.names, name)
+		}
+	}
+	l.mu.Unlock()
+	return l.agg.Remove(pattern)
+}
+
+func (l *Limit) Ping() {
+	l.agg.Ping()
+}
+
+// Dropped is what the store dropped, the names over the limit aren't
+// counted
+func (l *Limit) Dropped() uint64 {
+	if d, ok := l.agg.(Dropper); ok {
+		return d.Dropped()
+	}
+	return 0
+}
+
+// Hit reports whether the window being filled went over the limit
+func (l *Limit) Hit() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.hit
+}
+
+// Writes what the policy did since the last report, the window named by
+// label
+func (l *Limit) Report(w io.Writer, label string) {
+	if l == nil {
+		return
+	}
+	rejected, evicted, overflowed := l.rejected.Swap(0), l.evicted.Swap(0), l.overflowed.Swap(0)
+	if rejected > 0 || evicted > 0 || overflowed > 0 {
+		fmt.Fprintf(w, "(10 sec): Cardinality limit of %d names hit in the %s window, new names rejected %d, evicted %d, aggregated as %s %d\n", l.max, label, rejected, evicted, OverflowName, overflowed)
+	}
+}
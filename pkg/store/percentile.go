@@ -0,0 +1,24 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parses the comma separated -percentiles list, like 50,95,99.9
+func ParsePercentiles(list string) ([]float64, error) {
+	var ps []float64
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(f, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("%s: want a percentile between 0 and 100", f)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
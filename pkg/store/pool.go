@@ -0,0 +1,133 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Pool is an Aggregator handing updates to a pool of workers, so the
+// goroutines ingesting metrics go back to reading as soon as the update is
+// queued and the store's work is spread over as many cores as there are
+// workers. A metric always goes to the same worker, picked by a hash of its
+// key, so the updates of one metric are applied in the order they came.
+//
+// Everything but the updates waits for the updates queued before it to be
+// applied, a flush doesn't leave them behind for the next window.
+type Pool struct {
+	agg    Aggregator
+	queues []chan poolItem
+	hash   Hash
+}
+
+// a metric to update, or a marker closed once the worker gets to it
+type poolItem struct {
+	m    parser.Metric
+	done chan struct{}
+}
+
+// Returns a Pool of the given number of workers, each queueing up to queue
+// metrics, feeding agg. Metrics are spread over the workers by the hash,
+// FNV-1a when it is nil.
+func NewPool(agg Aggregator, workers, queue int, hash Hash) *Pool {
+	p := &Pool{agg: agg, queues: make([]chan poolItem, workers), hash: orFNV(hash)}
+	for i := range p.queues {
+		p.queues[i] = make(chan poolItem, queue)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *Pool) work(queue chan poolItem) {
+	for item := range queue {
+		if item.done != nil {
+			close(item.done)
+			continue
+		}
+		p.agg.Update(item.m)
+	}
+}
+
+func (p *Pool) queue(m parser.Metric) chan poolItem {
+	return p.queues[p.hash.Sum32(m.Key())%uint32(len(p.queues))]
+}
+
+// Update queues the metric, waiting if its worker's queue is full
+func (p *Pool) Update(m parser.Metric) {
+	p.queue(m) <- poolItem{m: m}
+}
+
+// TryUpdate queues the metric unless its worker's queue is full
+func (p *Pool) TryUpdate(m parser.Metric) bool {
+	select {
+	case p.queue(m) <- poolItem{m: m}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sync returns once every update queued before the call has been applied.
+// A nil Pool has nothing queued.
+func (p *Pool) Sync() {
+	if p == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, queue := range p.queues {
+		done := make(chan struct{})
+		queue <- poolItem{done: done}
+		wg.Add(1)
+		go func() {
+			<-done
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) Snapshot() []parser.Metric {
+	p.Sync()
+	return p.agg.Snapshot()
+}
+
+func (p *Pool) Flush() []parser.Metric {
+	p.Sync()
+	return p.agg.Flush()
+}
+
+func (p *Pool) FlushSorted(size int, fn func(chunk []parser.Metric)) {
+	p.Sync()
+	p.agg.FlushSorted(size, fn)
+}
+
+func (p *Pool) Remove(pattern string) int {
+	p.Sync()
+	return p.agg.Remove(pattern)
+}
+
+// Ping also waits on the workers, a stuck one stalls it like a stuck store
+func (p *Pool) Ping() {
+	p.Sync()
+	p.agg.Ping()
+}
+
+// Dropped is what the store beneath dropped, the pool itself never drops
+func (p *Pool) Dropped() uint64 {
+	if d, ok := p.agg.(Dropper); ok {
+		return d.Dropped()
+	}
+	return 0
+}
+
+// Backlog adds up the workers' queues and any the store beneath has
+func (p *Pool) Backlog() (queued, capacity int) {
+	if b, ok := p.agg.(Backlogger); ok {
+		queued, capacity = b.Backlog()
+	}
+	for _, queue := range p.queues {
+		queued += len(queue)
+		capacity += cap(queue)
+	}
+	return queued, capacity
+}
@@ -0,0 +1,28 @@
+package store
+
+import "fmt"
+
+// ProducerCounts says which producer counts the reports carry
+type ProducerCounts int
+
+const (
+	// no counts, producers aren't tracked
+	NoProducerCounts ProducerCounts = iota
+	// the distinct producers contributing to the window
+	WindowProducerCounts
+	// those of the window and of each metric
+	MetricProducerCounts
+)
+
+// Parses the -producers flag: none, window or metric
+func ParseProducerCounts(s string) (ProducerCounts, error) {
+	switch s {
+	case "", "none":
+		return NoProducerCounts, nil
+	case "window":
+		return WindowProducerCounts, nil
+	case "metric":
+		return MetricProducerCounts, nil
+	}
+	return NoProducerCounts, fmt.Errorf("unknown producer count %q, want none, window or metric", s)
+}
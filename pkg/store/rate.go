@@ -0,0 +1,118 @@
+package store
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Rates turns the cumulative counters of -rate-metrics into the per second
+// rate they grew at since the window before, so emitters can send their raw
+// counters. Like EWMA the last values outlive the collection.
+type Rates struct {
+	every time.Duration
+	mu    sync.Mutex
+	last  map[string]rateState
+}
+
+type rateState struct {
+	value float64
+	at    time.Time
+}
+
+// Returns the rates of a window flushed every every
+func NewRates(every time.Duration) *Rates {
+	return &Rates{every: every, last: make(map[string]rateState)}
+}
+
+// Convert replaces the value of every cumulative counter in the chunk with
+// its rate, returning the chunk without the counters seen for the first
+// time, which only set where their rate starts from. A rate is
+// a gauge: its last value, mean, min and max are the rate and its sum the
+// increase. The time between the counters' timestamps is used, the window's
+// elapsed when they don't move.
+func (r *Rates) Convert(chunk []parser.Metric, elapsed time.Duration) []parser.Metric {
+	if r == nil {
+		return chunk
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := chunk[:0]
+	for _, m := range chunk {
+		if !m.Cumulative {
+			kept = append(kept, m)
+			continue
+		}
+		key := m.Key()
+		prev, ok := r.last[key]
+		r.last[key] = rateState{value: m.Last, at: m.Time}
+		if !ok {
+			continue
+		}
+		dt := m.Time.Sub(prev.at)
+		if dt <= 0 {
+			dt = elapsed
+		}
+		increase := counterIncrease(prev.value, m.Last)
+		rate := increase / dt.Seconds()
+		m.Type, m.Integer, m.Digest = parser.Gauge, false, nil
+		m.Value, m.Compensation, m.M2 = increase, 0, 0
+		m.Mean, m.Min, m.Max, m.Last = rate, rate, rate, rate
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+// Returns how much a counter grew from prev to cur. A counter that went
+// down wrapped if it was in the top tenth of the 32 or 64 bit range,
+// otherwise it was reset to 0 and counted up to cur since.
+func counterIncrease(prev, cur float64) float64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	for _, limit := range []float64{math.MaxUint32 + 1, math.MaxUint64 + 1} {
+		if prev < limit && prev >= 0.9*limit {
+			return limit - prev + cur
+		}
+	}
+	return cur
+}
+
+// Forgets the counters not seen for ten windows, a rate over that long says
+// little
+func (r *Rates) Prune(now time.Time) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for key, st := range r.last {
+		if now.Sub(st.at) > 10*r.every {
+			delete(r.last, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Forgets the counters whose name or key matches the glob pattern, so one
+// deleted and sent again starts its rate afresh. Returns how many there
+// were.
+func (r *Rates) Forget(pattern string) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for key := range r.last {
+		if keyMatches(pattern, key) {
+			delete(r.last, key)
+			n++
+		}
+	}
+	return n
+}
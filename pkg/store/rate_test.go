@@ -0,0 +1,54 @@
+package store
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestRates(t *testing.T) {
+	r := NewRates(10 * time.Second)
+	start := time.Unix(1714564800, 0)
+	counter := func(name string, v float64, at time.Time) parser.Metric {
+		return parser.Metric{Name: name, Type: parser.Gauge, Cumulative: true, Last: v, Value: v, Count: 1, Time: at}
+	}
+	// the first window only sets where the rate starts, other metrics pass
+	got := r.Convert([]parser.Metric{counter("bytes", 1000, start), {Name: "cpu", Mean: 3, Count: 1}}, 10*time.Second)
+	if len(got) != 1 || got[0].Name != "cpu" {
+		t.Fatalf("Convert() first window; got %v, want cpu alone", got)
+	}
+
+	tests := []struct {
+		value, rate float64
+	}{
+		{1500, 50},
+		// reset to 0 and counted up to 200
+		{200, 20},
+		{200 + 100, 10},
+	}
+	at := start
+	for _, tc := range tests {
+		at = at.Add(10 * time.Second)
+		got := r.Convert([]parser.Metric{counter("bytes", tc.value, at)}, 10*time.Second)
+		if len(got) != 1 || got[0].Last != tc.rate || got[0].Mean != tc.rate || got[0].Type != parser.Gauge {
+			t.Errorf("Convert(%v); got %v, want rate %v", tc.value, got, tc.rate)
+		}
+	}
+
+	// a 32 bit counter near its limit wrapped rather than reset
+	if got := counterIncrease(math.MaxUint32-99, 100); got != 200 {
+		t.Errorf("counterIncrease() over the 32 bit limit; got %v, want 200", got)
+	}
+	if got := counterIncrease(5000, 100); got != 100 {
+		t.Errorf("counterIncrease() of a reset; got %v, want 100", got)
+	}
+
+	if n := r.Prune(at.Add(time.Minute)); n != 0 {
+		t.Errorf("Prune(+1m); got %d, want 0", n)
+	}
+	if n := r.Prune(at.Add(2 * time.Minute)); n != 1 {
+		t.Errorf("Prune(+2m); got %d, want 1", n)
+	}
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Sliding is an Aggregator whose collection always covers the last span of
+// time instead of everything since the last flush. The span is a ring of
+// sub-buckets, the oldest is dropped as each new one starts, so a flush
+// reports the whole span without resetting it and there is no discontinuity
+// at the flush boundaries. Everything is under one lock, the sharded and
+// channel stores only apply to tumbling windows.
+type Sliding struct {
+	mu      sync.Mutex
+	buckets []*collection
+	// the bucket being filled and when it started
+	cur     int
+	started time.Time
+	width   time.Duration
+	now     func() time.Time
+	opts    Options
+}
+
+// Returns an empty Sliding covering span in n sub-buckets. One more bucket
+// is kept for the one being filled, so a flush as a bucket ends covers
+// exactly the span. The buckets keep the metrics by the options.
+func NewSliding(span time.Duration, n int, opts Options) *Sliding {
+	s := &Sliding{buckets: make([]*collection, n+1), width: span / time.Duration(n), now: time.Now, opts: opts}
+	for i := range s.buckets {
+		s.buckets[i] = newCollection(s.opts)
+	}
+	s.started = s.now()
+	return s
+}
+
+// SetClock makes the buckets go by the clock rather than the wall clock,
+// the bucket being filled starting now
+func (s *Sliding) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = c.Now
+	s.started = s.now()
+}
+
+// Starts a fresh bucket for every width that has passed, dropping the
+// oldest ones. The caller holds the lock.
+func (s *Sliding) advance() {
+	now := s.now()
+	for i := 0; i < len(s.buckets) && now.Sub(s.started) >= s.width; i++ {
+		s.cur = (s.cur + 1) % len(s.buckets)
+		s.buckets[s.cur] = newCollection(s.opts)
+		s.started = s.started.Add(s.width)
+	}
+	// idle for longer than the span, everything is gone
+	if now.Sub(s.started) >= s.width {
+		s.started = now
+	}
+}
+
+// Update adds the metric to the current bucket
+func (s *Sliding) Update(m parser.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	s.buckets[s.cur].update(m)
+}
+
+// TryUpdate is Update, the lock is never held for long
+func (s *Sliding) TryUpdate(m parser.Metric) bool {
+	s.Update(m)
+	return true
+}
+
+// Ping takes the lock
+func (s *Sliding) Ping() {
+	s.mu.Lock()
+	s.mu.Unlock()
+}
+
+// Merges the buckets into one collection covering the span. The buckets'
+// digests and sets are copied first since merging updates them in place.
+func (s *Sliding) merged() *collection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	all := newCollection(s.opts)
+	for _, b := range s.buckets {
+		for _, m := range b.snapshot() {
+			all.update(m)
+		}
+	}
+	return all
+}
+
+// Snapshot returns the collection covering the span
+func (s *Sliding) Snapshot() []parser.Metric {
+	return s.merged().snapshot()
+}
+
+// Flush is Snapshot, the span slides on by itself
+func (s *Sliding) Flush() []parser.Metric {
+	return s.Snapshot()
+}
+
+// FlushSorted streams the collection covering the span to fn in chunks
+// ordered by name, leaving it in place
+func (s *Sliding) FlushSorted(size int, fn func([]parser.Metric)) {
+	streamSorted([]map[string]parser.Metric{s.merged().data}, size, fn)
+}
+
+// Remove deletes the matching metrics from every bucket and returns how many
+// distinct ones were removed
+func (s *Sliding) Remove(pattern string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := make(map[string]bool)
+	for _, b := range s.buckets {
+		for key, m := range b.data {
+			if matches(pattern, key, m) {
+				removed[key] = true
+			}
+		}
+		b.remove(pattern)
+	}
+	return len(removed)
+}
+
+// Delete deletes the metrics of the keys from every bucket and returns how
+// many distinct ones there were
+func (s *Sliding) Delete(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, key := range keys {
+		found := false
+		for _, b := range s.buckets {
+			found = b.delete(key) > 0 || found
+		}
+		if found {
+			n++
+		}
+	}
+	return n
+}
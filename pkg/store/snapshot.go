@@ -0,0 +1,187 @@
+package store
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/hll"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/tdigest"
+)
+
+// Snapshotter is a store whose collection can be written out and read back,
+// to carry a window in progress over a restart or to another host
+type Snapshotter interface {
+	// writes a copy of the collection, leaving it in place
+	WriteSnapshot(w io.Writer) error
+	// merges a snapshot into the collection, returning how many metrics it
+	// held
+	Restore(r io.Reader) (int, error)
+}
+
+// the version of the snapshot encoding
+const snapshotVersion = 1
+
+// snapshotHeader starts a snapshot, a gob stream of a header then a record
+// per metric
+type snapshotHeader struct {
+	Version int
+	Taken   time.Time
+}
+
+// record is a metric as it is logged or snapshotted, gob can't encode the
+// sets' empty struct members
+type record struct {
+	Name, Tags                string
+	Type                      parser.Type
+	Time                      time.Time
+	Value, Mean, Min, Max, M2 float64
+	Compensation, Last        float64
+	Count                     int
+	Integer                   bool
+	IntValue                  int64
+	Digest                    *tdigest.TDigest
+	Members, Producers        []string
+	Unique, Cumulative        bool
+	Uniques                   *hll.Sketch
+	Client, Producer, Tenant  string
+	// in the log, the pattern of an admin delete rather than a metric, so
+	// a replay deletes what came before it too
+	Removed string
+}
+
+func newRecord(m parser.Metric) record {
+	rec := record{
+		Name: m.Name, Tags: m.Tags, Type: m.Type, Time: m.Time,
+		Value: m.Value, Mean: m.Mean, Min: m.Min, Max: m.Max, M2: m.M2,
+		Compensation: m.Compensation, Last: m.Last,
+		Count: m.Count, Integer: m.Integer, IntValue: m.IntValue, Digest: m.Digest,
+		Unique: m.Unique, Uniques: m.Uniques, Cumulative: m.Cumulative,
+		Client: m.Client, Producer: m.Producer, Tenant: m.Tenant,
+	}
+	for member := range m.Members {
+		rec.Members = append(rec.Members, member)
+	}
+	for producer := range m.Producers {
+		rec.Producers = append(rec.Producers, producer)
+	}
+	return rec
+}
+
+func (rec record) metric() parser.Metric {
+	m := parser.Metric{
+		Name: rec.Name, Tags: rec.Tags, Type: rec.Type, Time: rec.Time,
+		Value: rec.Value, Mean: rec.Mean, Min: rec.Min, Max: rec.Max, M2: rec.M2,
+		Compensation: rec.Compensation, Last: rec.Last,
+		Count: rec.Count, Integer: rec.Integer, IntValue: rec.IntValue, Digest: rec.Digest,
+		Unique: rec.Unique, Uniques: rec.Uniques, Cumulative: rec.Cumulative,
+		Client: rec.Client, Producer: rec.Producer, Tenant: rec.Tenant,
+	}
+	m.Members = set(rec.Members)
+	m.Producers = set(rec.Producers)
+	return m
+}
+
+func set(members []string) map[string]struct{} {
+	if members == nil {
+		return nil
+	}
+	s := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		s[member] = struct{}{}
+	}
+	return s
+}
+
+// Adds a metric read from a snapshot, as it was unless the collection
+// already holds its key
+func (s *collection) restore(m parser.Metric) {
+	if _, ok := s.data[m.Key()]; ok {
+		_ = s.update(m)
+		return
+	}
+	s.data[m.Key()] = m
+}
+
+// Writes the header and a record per metric of the batch
+func writeSnapshot(w io.Writer, batches func(fn func([]parser.Metric) error) error) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion, Taken: time.Now()}); err != nil {
+		return err
+	}
+	return batches(func(batch []parser.Metric) error {
+		for _, m := range batch {
+			if err := enc.Encode(newRecord(m)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reads a snapshot passing each metric to fn, returning how many were read
+func readSnapshot(r io.Reader, fn func(parser.Metric)) (int, error) {
+	dec := gob.NewDecoder(r)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("snapshot: %v", err)
+	}
+	if header.Version != snapshotVersion {
+		return 0, fmt.Errorf("snapshot: version %d, want %d", header.Version, snapshotVersion)
+	}
+	n := 0
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, fmt.Errorf("snapshot: %v", err)
+		}
+		fn(rec.metric())
+		n++
+	}
+}
+
+// WriteSnapshot writes a copy of the collection. Each shard is copied under
+// its own lock, like Snapshot, so the shards are not all of one instant.
+func (s *Store) WriteSnapshot(w io.Writer) error {
+	return writeSnapshot(w, func(fn func([]parser.Metric) error) error {
+		for i := range s.shards {
+			sh := &s.shards[i]
+			sh.mu.Lock()
+			batch := sh.snapshot()
+			sh.mu.Unlock()
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Restore merges a snapshot into the collection. A snapshot cut short
+// leaves the metrics read before the error merged.
+func (s *Store) Restore(r io.Reader) (int, error) {
+	return readSnapshot(r, func(m parser.Metric) {
+		sh := s.shard(m.Key())
+		sh.mu.Lock()
+		sh.restore(m)
+		sh.mu.Unlock()
+	})
+}
+
+func (c *channelStore) WriteSnapshot(w io.Writer) error {
+	return writeSnapshot(w, func(fn func([]parser.Metric) error) error {
+		return fn(c.Snapshot())
+	})
+}
+
+func (c *channelStore) Restore(r io.Reader) (int, error) {
+	return readSnapshot(r, func(m parser.Metric) {
+		c.do(func(s *collection) { s.restore(m) })
+	})
+}
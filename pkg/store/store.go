@@ -0,0 +1,528 @@
+// Package store aggregates metrics over the current collection window
+package store
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+	"github.com/jeffdupont/go-challenge/pkg/tdigest"
+)
+
+// collection holds all metric data for the current window keyed by name. It
+// is not safe for concurrent use on its own, the aggregator implementations
+// below decide how access to it is serialized.
+type collection struct {
+	data map[string]parser.Metric
+	// keep a t-digest of every distribution and the producers of every
+	// metric
+	digests, producers bool
+}
+
+// Initializes the collection for the metric data, kept by the options
+func newCollection(opts Options) *collection {
+	return &collection{data: make(map[string]parser.Metric), digests: len(opts.Percentiles) > 0, producers: opts.TrackProducers}
+}
+
+// Update checks to see if the metric key exists
+// and then updates the existing value before it is saved
+// back to the data store
+func (s *collection) update(m parser.Metric) error {
+	// a single observation, parsers leave the spread to us. A weighted one
+	// is that many samples of its value.
+	single := m.Count <= 1
+	v, weight := m.Value, max(m.Weight, 1)
+	if single {
+		m.Count = weight
+		m.Mean, m.Min, m.Max, m.M2 = m.Value, m.Value, m.Value, 0
+		m.Compensation = 0
+		m.Last = m.Value
+		m.Digest = nil
+		m.Producers = nil
+		if s.producers && m.Producer != "" {
+			m.Producers = map[string]struct{}{m.Producer: {}}
+		}
+		if weight > 1 {
+			m.Value *= float64(weight)
+			if m.Integer {
+				m.IntValue, m.Integer = mulInt64(m.IntValue, int64(weight))
+			}
+		}
+	}
+	m.Weight = 0
+
+	// check if the metric exists
+	key := m.Key()
+	if cm, ok := s.data[key]; ok {
+		// the first type seen in the window sticks, later observations are
+		// folded in the same way whatever they say
+		m.Type = cm.Type
+		switch m.Type {
+		case parser.Gauge:
+			// late arrivals don't overwrite a newer level
+			if m.Time.Before(cm.Time) {
+				m.Last, m.Time = cm.Last, cm.Time
+			}
+		case parser.Set:
+			if cm.Unique || m.Unique {
+				m.Unique = true
+				m.Uniques, m.Members = mergeUniques(cm, m), nil
+				break
+			}
+			if cm.Members == nil {
+				cm.Members = make(map[string]struct{})
+			}
+			for k := range m.Members {
+				cm.Members[k] = struct{}{}
+			}
+			m.Members = cm.Members
+		}
+		if m.Producers != nil {
+			if cm.Producers == nil {
+				cm.Producers = make(map[string]struct{})
+			}
+			for p := range m.Producers {
+				cm.Producers[p] = struct{}{}
+			}
+		}
+		m.Producers = cm.Producers
+		// integers sum exactly until they overflow, then carry on as floats
+		if m.Integer && cm.Integer {
+			m.IntValue, m.Integer = addInt64(cm.IntValue, m.IntValue)
+		} else {
+			m.Integer = false
+		}
+		m.Value, m.Compensation = compensatedAdd(cm.Value, cm.Compensation+m.Compensation, m.Value)
+		if m.Integer {
+			m.Value, m.Compensation = float64(m.IntValue), 0
+		}
+		// the parallel form of Welford's algorithm (Chan et al.) merges the
+		// squared deviations without revisiting any samples
+		n := cm.Count + m.Count
+		delta := m.Mean - cm.Mean
+		m.M2 = cm.M2 + m.M2 + delta*delta*float64(cm.Count)*float64(m.Count)/float64(n)
+		m.Min = math.Min(cm.Min, m.Min)
+		m.Max = math.Max(cm.Max, m.Max)
+		m.Count = n
+		m.Mean = m.Value / float64(m.Count)
+		// the sketch is updated in place, the stored metric owns it
+		if cm.Digest != nil {
+			if single {
+				cm.Digest.AddWeighted(v, float64(weight))
+			} else {
+				cm.Digest.Merge(m.Digest)
+			}
+		}
+		m.Digest = cm.Digest
+	} else if single && s.digests && m.Type.Distribution() {
+		m.Digest = tdigest.New(tdigest.DefaultCompression)
+		m.Digest.AddWeighted(v, float64(weight))
+	}
+	if m.Unique && m.Uniques == nil {
+		m.Uniques, m.Members = newUniques(m.Members), nil
+	}
+	s.data[key] = m
+	return nil
+}
+
+// Remove deletes every metric whose name, or key with its tags, matches the
+// glob pattern and returns how many were removed. A plain name matches
+// itself under every tagset.
+func (s *collection) remove(pattern string) int {
+	n := 0
+	for key, m := range s.data {
+		if matches(pattern, key, m) {
+			delete(s.data, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Deletes the metrics of the keys and returns how many there were
+func (s *collection) delete(keys ...string) int {
+	n := len(s.data)
+	for _, key := range keys {
+		delete(s.data, key)
+	}
+	return n - len(s.data)
+}
+
+func matches(pattern, key string, m parser.Metric) bool {
+	if ok, _ := path.Match(pattern, m.Name); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, key)
+	return ok
+}
+
+// matches for the state kept by key, its name being the key up to the tags
+func keyMatches(pattern, key string) bool {
+	name, _, _ := strings.Cut(key, "{")
+	return matches(pattern, key, parser.Metric{Name: name})
+}
+
+// Returns a copy of everything the collection holds
+func (s *collection) snapshot() []parser.Metric {
+	batch := make([]parser.Metric, 0, len(s.data))
+	for _, m := range s.data {
+		if m.Digest != nil {
+			m.Digest = m.Digest.Clone()
+		}
+		if m.Members != nil {
+			m.Members = maps.Clone(m.Members)
+		}
+		if m.Uniques != nil {
+			m.Uniques = m.Uniques.Clone()
+		}
+		if m.Producers != nil {
+			m.Producers = maps.Clone(m.Producers)
+		}
+		batch = append(batch, m)
+	}
+	return batch
+}
+
+// Empties the collection returning the map it held
+func (s *collection) swap() map[string]parser.Metric {
+	data := s.data
+	s.data = make(map[string]parser.Metric)
+	return data
+}
+
+// Empties the collection returning everything it held
+func (s *collection) drain() []parser.Metric {
+	batch := make([]parser.Metric, 0, len(s.data))
+	for _, m := range s.swap() {
+		batch = append(batch, m)
+	}
+	return batch
+}
+
+// Aggregator is the pipeline between the ingestion paths and the collection.
+// All methods are safe for concurrent use.
+type Aggregator interface {
+	// adds the metric to the current collection
+	Update(m parser.Metric)
+	// like Update but returns false instead of waiting when the store can't
+	// take the metric right away
+	TryUpdate(m parser.Metric) bool
+	// returns a copy of the current collection, leaving it in place
+	Snapshot() []parser.Metric
+	// returns the current collection and starts a new, empty one
+	Flush() []parser.Metric
+	// like Flush but passes the collection to fn in chunks of up to size
+	// metrics ordered by name, so a big window is never copied out whole.
+	// fn must not keep the chunk.
+	FlushSorted(size int, fn func(chunk []parser.Metric))
+	// deletes the metrics matching the glob pattern from the collection
+	Remove(pattern string) int
+	// returns once the store has taken every update sent before it, the
+	// watchdog's heartbeat
+	Ping()
+}
+
+// Options are how a store keeps its metrics. The zero Options keep no
+// digests or producers in a store of DefaultShards spread by FNV-1a, or
+// behind an unbuffered channel.
+type Options struct {
+	// the -percentiles reported for every metric. A t-digest is only kept
+	// per metric when there is at least one.
+	Percentiles []float64
+	// every metric keeps the set of distinct producers that sent it in the
+	// window, see parser.Metric.Producers
+	TrackProducers bool
+	// the -shards a sharded store is split into, DefaultShards when 0
+	Shards int
+	// the -hash the shards are picked by, FNV-1a when nil
+	Hash Hash
+	// how many metrics the channel store's ingress channel buffers, 0 for
+	// an unbuffered channel where every Update waits for the store's
+	// goroutine
+	IngressSize int
+	// what the channel store's Update does once the ingress channel is full
+	IngressOverflow Overflow
+}
+
+// Builds the Aggregator of the given kind, sharded or channel. The sharded
+// Store is the default, see store_test.go for the benchmarks comparing the two.
+func New(kind string, opts Options) (Aggregator, error) {
+	switch kind {
+	case "sharded":
+		return NewStore(opts), nil
+	case "channel":
+		return newChannelStore(opts), nil
+	}
+	return nil, fmt.Errorf("unknown store %q, want sharded or channel", kind)
+}
+
+// channelStore is the original design, every update is funnelled over a
+// channel to a single goroutine which owns the collection. The channel
+// buffers Options.IngressSize metrics and Options.IngressOverflow says what
+// happens once it is full.
+type channelStore struct {
+	ingress  chan parser.Metric
+	control  chan func(*collection)
+	overflow Overflow
+	// metrics dropped by the overflow policy since the last report
+	dropped uint64
+}
+
+func newChannelStore(opts Options) *channelStore {
+	c := &channelStore{
+		ingress:  make(chan parser.Metric, opts.IngressSize),
+		control:  make(chan func(*collection)),
+		overflow: opts.IngressOverflow,
+	}
+	go c.run(newCollection(opts))
+	return c
+}
+
+func (c *channelStore) run(s *collection) {
+	for {
+		select {
+		case m := <-c.ingress:
+			_ = s.update(m)
+		case fn := <-c.control:
+			// whatever was queued before the call is taken first, a flush
+			// must not leave metrics behind for the next window
+			for n := len(c.ingress); n > 0; n-- {
+				_ = s.update(<-c.ingress)
+			}
+			fn(s)
+		}
+	}
+}
+
+// Runs fn on the store's goroutine and waits for it to complete
+func (c *channelStore) do(fn func(*collection)) {
+	done := make(chan struct{})
+	c.control <- func(s *collection) {
+		fn(s)
+		close(done)
+	}
+	<-done
+}
+
+func (c *channelStore) Update(m parser.Metric) {
+	switch c.overflow {
+	case OverflowDropNewest:
+		if !c.TryUpdate(m) {
+			atomic.AddUint64(&c.dropped, 1)
+		}
+		return
+	case OverflowDropOldest:
+		for !c.TryUpdate(m) {
+			select {
+			case <-c.ingress:
+				atomic.AddUint64(&c.dropped, 1)
+			default:
+			}
+		}
+		return
+	}
+	c.ingress <- m
+}
+
+func (c *channelStore) Dropped() uint64 {
+	return atomic.SwapUint64(&c.dropped, 0)
+}
+
+func (c *channelStore) TryUpdate(m parser.Metric) bool {
+	select {
+	case c.ingress <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *channelStore) Ping() {
+	c.do(func(*collection) {})
+}
+
+func (c *channelStore) Snapshot() (batch []parser.Metric) {
+	c.do(func(s *collection) { batch = s.snapshot() })
+	return batch
+}
+
+func (c *channelStore) Flush() (batch []parser.Metric) {
+	c.do(func(s *collection) { batch = s.drain() })
+	return batch
+}
+
+func (c *channelStore) FlushSorted(size int, fn func([]parser.Metric)) {
+	var data map[string]parser.Metric
+	c.do(func(s *collection) { data = s.swap() })
+	streamSorted([]map[string]parser.Metric{data}, size, fn)
+}
+
+func (c *channelStore) Remove(pattern string) (n int) {
+	c.do(func(s *collection) { n = s.remove(pattern) })
+	return n
+}
+
+func (c *channelStore) Delete(keys ...string) (n int) {
+	c.do(func(s *collection) { n = s.delete(keys...) })
+	return n
+}
+
+// Number of shards used by the sharded store
+const DefaultShards = 32
+
+// Store is the concurrency-safe metric store. The collection is split into
+// independently locked shards keyed by a hash of the metric name, so
+// handlers updating different metrics rarely wait on each other and never
+// wait on a single goroutine.
+type Store struct {
+	shards []shard
+	hash   Hash
+}
+
+type shard struct {
+	mu sync.Mutex
+	*collection
+}
+
+// NewStore returns an empty Store of the options' shards spread by their
+// hash
+func NewStore(opts Options) *Store {
+	n := opts.Shards
+	if n == 0 {
+		n = DefaultShards
+	}
+	s := &Store{shards: make([]shard, n), hash: orFNV(opts.Hash)}
+	for i := range s.shards {
+		s.shards[i].collection = newCollection(opts)
+	}
+	return s
+}
+
+func (s *Store) shard(name string) *shard {
+	return &s.shards[s.hash.Sum32(name)%uint32(len(s.shards))]
+}
+
+// Update adds the metric to the current collection
+func (s *Store) Update(m parser.Metric) {
+	sh := s.shard(m.Key())
+	sh.mu.Lock()
+	_ = sh.collection.update(m)
+	sh.mu.Unlock()
+}
+
+// TryUpdate is Update, the Store never queues so it is never saturated
+func (s *Store) TryUpdate(m parser.Metric) bool {
+	s.Update(m)
+	return true
+}
+
+// Ping locks every shard in turn
+func (s *Store) Ping() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+		s.shards[i].mu.Unlock()
+	}
+}
+
+// Snapshot returns a copy of the current collection. Each shard is copied
+// under its own lock so updates to other shards carry on meanwhile.
+func (s *Store) Snapshot() []parser.Metric {
+	return s.each(func(c *collection) []parser.Metric { return c.snapshot() })
+}
+
+// Flush returns the current collection and starts a new, empty one
+func (s *Store) Flush() []parser.Metric {
+	return s.each(func(c *collection) []parser.Metric { return c.drain() })
+}
+
+// FlushSorted starts a new, empty collection and streams the old one to fn
+// in chunks ordered by name. Shards are only locked while their data is
+// swapped out.
+func (s *Store) FlushSorted(size int, fn func([]parser.Metric)) {
+	maps := make([]map[string]parser.Metric, len(s.shards))
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		maps[i] = sh.swap()
+		sh.mu.Unlock()
+	}
+	streamSorted(maps, size, fn)
+}
+
+func (s *Store) each(fn func(*collection) []parser.Metric) []parser.Metric {
+	var batch []parser.Metric
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		batch = append(batch, fn(sh.collection)...)
+		sh.mu.Unlock()
+	}
+	return batch
+}
+
+// Remove deletes the metrics matching the glob pattern and returns how many
+// were removed
+func (s *Store) Remove(pattern string) int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += sh.collection.remove(pattern)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// Delete deletes the metrics of the keys, locking only their shards
+func (s *Store) Delete(keys ...string) int {
+	n := 0
+	for _, key := range keys {
+		sh := s.shard(key)
+		sh.mu.Lock()
+		n += sh.collection.delete(key)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// Adds x to the sum s with Neumaier's variant of Kahan summation, c being
+// the rounding error carried from the earlier additions. Returns the sum
+// rounded to the nearest float64, which is what the report shows, and the
+// error it still leaves out. Once the sum is infinite or NaN there is nothing
+// left to compensate.
+func compensatedAdd(s, c, x float64) (sum, carry float64) {
+	t := s + x
+	if math.IsInf(t, 0) || math.IsNaN(t) {
+		return t, 0
+	}
+	if math.Abs(s) >= math.Abs(x) {
+		c += (s - t) + x
+	} else {
+		c += (x - t) + s
+	}
+	sum = t + c
+	return sum, c - (sum - t)
+}
+
+// Multiplies two int64s, ok is false when the product overflows
+func mulInt64(a, b int64) (product int64, ok bool) {
+	product = a * b
+	if a != 0 && product/a != b {
+		return 0, false
+	}
+	return product, true
+}
+
+// Adds two int64s, ok is false when the sum overflows
+func addInt64(a, b int64) (sum int64, ok bool) {
+	sum = a + b
+	if (a > 0 && b > 0 && sum < 0) || (a < 0 && b < 0 && sum >= 0) {
+		return 0, false
+	}
+	return sum, true
+}
@@ -0,0 +1,741 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+func TestAggregators(t *testing.T) {
+	for _, kind := range []string{"sharded", "channel"} {
+		agg, err := New(kind, Options{})
+		if err != nil {
+			t.Fatalf("newAggregator(%s); got error %v", kind, err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(v float64) {
+				defer wg.Done()
+				for _, name := range []string{"asdf", "qwer", "zxcv-1", "zxcv-2"} {
+					agg.Update(parser.Metric{Name: name, Value: v, Mean: v, Count: 1, Time: time.Now()})
+				}
+			}(float64(i))
+		}
+		wg.Wait()
+
+		if n := len(agg.Snapshot()); n != 4 {
+			t.Errorf("%s Snapshot(); got %d metrics, want 4", kind, n)
+		}
+		if n := len(agg.Snapshot()); n != 4 {
+			t.Errorf("%s Snapshot() after Snapshot; got %d metrics, want 4", kind, n)
+		}
+
+		if n := agg.Remove("zxcv-*"); n != 2 {
+			t.Errorf("%s Remove(zxcv-*); got %d, want 2", kind, n)
+		}
+
+		batch := agg.Flush()
+		sort.Slice(batch, func(i, j int) bool { return batch[i].Name < batch[j].Name })
+		if len(batch) != 2 || batch[0].Name != "asdf" || batch[1].Name != "qwer" {
+			t.Fatalf("%s Flush(); got %v, want asdf and qwer", kind, batch)
+		}
+		for _, m := range batch {
+			if m.Count != 4 || m.Mean != 1.5 {
+				t.Errorf("%s Flush() %s; got count %d mean %v, want 4 1.5", kind, m.Name, m.Count, m.Mean)
+			}
+			if m.Min != 0 || m.Max != 3 || m.Value != 6 || math.Abs(m.Stddev()-math.Sqrt(1.25)) > 1e-12 {
+				t.Errorf("%s Flush() %s; got min %v max %v sum %v stddev %v, want 0 3 6 %v", kind, m.Name, m.Min, m.Max, m.Value, m.Stddev(), math.Sqrt(1.25))
+			}
+		}
+		if batch := agg.Flush(); len(batch) != 0 {
+			t.Errorf("%s Flush() after flush; got %d metrics, want 0", kind, len(batch))
+		}
+	}
+}
+
+func TestFlushSorted(t *testing.T) {
+	for _, kind := range []string{"sharded", "channel"} {
+		agg, _ := New(kind, Options{})
+		for i := 99; i >= 0; i-- {
+			agg.Update(parser.Metric{Name: fmt.Sprintf("metric-%02d", i), Value: 1, Mean: 1, Count: 1})
+		}
+
+		var names []string
+		chunks := 0
+		agg.FlushSorted(8, func(chunk []parser.Metric) {
+			if len(chunk) > 8 {
+				t.Errorf("%s FlushSorted(8); got a chunk of %d", kind, len(chunk))
+			}
+			chunks++
+			for _, m := range chunk {
+				names = append(names, m.Name)
+			}
+		})
+		if len(names) != 100 || chunks != 13 || !sort.StringsAreSorted(names) {
+			t.Errorf("%s FlushSorted(8); got %d metrics in %d chunks, sorted %v", kind, len(names), chunks, sort.StringsAreSorted(names))
+		}
+		if batch := agg.Flush(); len(batch) != 0 {
+			t.Errorf("%s Flush() after FlushSorted; got %d metrics, want 0", kind, len(batch))
+		}
+	}
+}
+
+func TestFlushOrdered(t *testing.T) {
+	for _, tc := range []struct {
+		order string
+		want  string
+	}{{"name", "a b c d"}, {"count", "c a d b"}, {"mean", "b d c a"}} {
+		agg, _ := New("sharded", Options{})
+		// name, times updated and value
+		for _, u := range []struct {
+			name  string
+			times int
+			value float64
+		}{{"a", 2, 1}, {"b", 1, 9}, {"c", 3, 2}, {"d", 2, 9}} {
+			for i := 0; i < u.times; i++ {
+				agg.Update(parser.Metric{Name: u.name, Value: u.value, Mean: u.value, Count: 1})
+			}
+		}
+		order, err := ParseOrder(tc.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		FlushOrdered(agg, order, 3, func(chunk []parser.Metric) {
+			for _, m := range chunk {
+				names = append(names, m.Name)
+			}
+		})
+		if got := strings.Join(names, " "); got != tc.want {
+			t.Errorf("FlushOrdered(%s); got %s, want %s", tc.order, got, tc.want)
+		}
+	}
+	if _, err := ParseOrder("random"); err == nil {
+		t.Errorf("ParseOrder(random); got nil, want an error")
+	}
+}
+
+func TestIntegerSums(t *testing.T) {
+	// float64 can't hold 2^53+1, the integer sum must
+	c := newCollection(Options{})
+	for i := 0; i < 3; i++ {
+		m := parser.Metric{Name: "bytes-rx", Count: 1}
+		m.SetInt(9007199254740993)
+		c.update(m)
+	}
+	m := c.data["bytes-rx"]
+	if !m.Integer || m.IntValue != 3*9007199254740993 || m.Count != 3 {
+		t.Errorf("update(); got integer %v sum %d count %d", m.Integer, m.IntValue, m.Count)
+	}
+
+	// overflowing the sum falls back to a float
+	o := parser.Metric{Name: "bytes-rx", Count: 1}
+	o.SetInt(math.MaxInt64)
+	c.update(o)
+	if m := c.data["bytes-rx"]; m.Integer || m.Count != 4 {
+		t.Errorf("update() overflowing; got integer %v count %d, want a float", m.Integer, m.Count)
+	}
+}
+
+// The store benchmarks compare the channel funnel against the sharded store
+// with many handler goroutines updating concurrently. Run them across core
+// counts with:
+//
+//	go test -run XXX -bench Store -cpu 1,2,4,8
+func benchmarkStore(b *testing.B, kind string, cardinality int) {
+	agg, _ := New(kind, Options{})
+	benchmarkUpdates(b, agg, cardinality)
+}
+
+func benchmarkUpdates(b *testing.B, agg Aggregator, cardinality int) {
+	names := make([]string, cardinality)
+	for i := range names {
+		names[i] = fmt.Sprintf("metric-%d", i)
+	}
+	now := time.Now()
+
+	// simulate more connection handlers than cores
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			agg.Update(parser.Metric{Name: names[i%len(names)], Value: 1, Mean: 1, Count: 1, Time: now})
+			i++
+		}
+	})
+}
+
+func TestCompensatedSums(t *testing.T) {
+	c := newCollection(Options{})
+	c.update(parser.Metric{Name: "drift", Value: 1, Count: 1})
+	// each of these is lost to rounding when added to 1 on its own
+	for i := 0; i < 1000; i++ {
+		c.update(parser.Metric{Name: "drift", Value: 1e-17, Count: 1})
+	}
+	if m, want := c.data["drift"], 1+1e-14; math.Abs(m.Value-want) > 1e-16 {
+		t.Errorf("update(); got sum %.17g, want %.17g", m.Value, want)
+	}
+
+	// merged aggregates carry their errors along
+	other := newCollection(Options{})
+	other.update(parser.Metric{Name: "drift", Value: 1e-16, Count: 1})
+	other.update(parser.Metric{Name: "drift", Value: 1e-16, Count: 1})
+	c.update(other.data["drift"])
+	if m, want := c.data["drift"], 1+1.02e-14; math.Abs(m.Value-want) > 1e-16 || m.Count != 1003 {
+		t.Errorf("update(merged); got sum %.17g count %d, want %.17g 1003", m.Value, m.Count, want)
+	}
+
+	c.update(parser.Metric{Name: "huge", Value: math.MaxFloat64, Count: 1})
+	c.update(parser.Metric{Name: "huge", Value: math.MaxFloat64, Count: 1})
+	if m := c.data["huge"]; !math.IsInf(m.Value, 1) {
+		t.Errorf("update(overflowing); got sum %v, want +Inf", m.Value)
+	}
+}
+
+func TestTypes(t *testing.T) {
+	c := newCollection(Options{})
+	now := time.Now()
+	for i, v := range []float64{3, 1, 2} {
+		c.update(parser.Metric{Name: "queue", Type: parser.Gauge, Value: v, Count: 1, Time: now.Add(time.Duration(i) * time.Second)})
+	}
+	// arrives last but is older than every other level
+	c.update(parser.Metric{Name: "queue", Value: 9, Count: 1, Time: now})
+	if m := c.data["queue"]; m.Last != 2 || m.Type != parser.Gauge || m.Max != 9 {
+		t.Errorf("update(gauge); got last %v type %v max %v, want last 2 of a gauge, max 9", m.Last, m.Type, m.Max)
+	}
+
+	for _, u := range []string{"a", "b", "a"} {
+		c.update(parser.Metric{Name: "users", Type: parser.Set, Value: 1, Count: 1, Members: map[string]struct{}{u: {}}})
+	}
+	if m := c.data["users"]; len(m.Members) != 2 || m.Count != 3 {
+		t.Errorf("update(set); got %d members of %d, want 2 of 3", len(m.Members), m.Count)
+	}
+	snap := c.snapshot()
+	c.update(parser.Metric{Name: "users", Type: parser.Set, Value: 1, Count: 1, Members: map[string]struct{}{"c": {}}})
+	for _, m := range snap {
+		if m.Name == "users" && len(m.Members) != 2 {
+			t.Errorf("snapshot(); got %d members after a later update, want 2", len(m.Members))
+		}
+	}
+}
+
+func TestTee(t *testing.T) {
+	short, long := NewStore(Options{Shards: 4}), newChannelStore(Options{})
+	tee := Tee{short, long}
+	for i := 0; i < 3; i++ {
+		if !tee.TryUpdate(parser.Metric{Name: "cpu", Value: float64(i), Count: 1}) {
+			tee.Update(parser.Metric{Name: "cpu", Value: float64(i), Count: 1})
+		}
+	}
+	if got := tee.Flush(); len(got) != 1 || got[0].Count != 3 {
+		t.Errorf("Flush(); got %v, want cpu counted 3 times", got)
+	}
+	tee.Update(parser.Metric{Name: "cpu", Value: 3, Count: 1})
+	if got := long.Flush(); len(got) != 1 || got[0].Count != 4 {
+		t.Errorf("Flush() of the second store; got %v, want cpu counted 4 times", got)
+	}
+	tee.Update(parser.Metric{Name: "mem", Value: 1, Count: 1})
+	if n := tee.Remove("*"); n != 2 {
+		t.Errorf("Remove(*); got %d, want 2", n)
+	}
+}
+
+func TestSliding(t *testing.T) {
+	c := clock.NewManual(time.Now())
+	s := NewSliding(time.Minute, 6, Options{})
+	s.SetClock(c)
+
+	// one observation every 10 seconds, each in its own bucket
+	for i := 1; i <= 9; i++ {
+		s.Update(parser.Metric{Name: "cpu", Value: float64(i), Count: 1})
+		c.Advance(10 * time.Second)
+	}
+	// the last minute holds 4 to 9
+	got := s.Flush()
+	if len(got) != 1 || got[0].Count != 6 || got[0].Min != 4 || got[0].Mean != 6.5 {
+		t.Errorf("Flush(); got %v, want 6 values from 4 to 9", got)
+	}
+	// flushing leaves the span in place
+	if got := s.Snapshot(); len(got) != 1 || got[0].Count != 6 {
+		t.Errorf("Snapshot() after Flush(); got %v, want the same 6 values", got)
+	}
+
+	c.Advance(30 * time.Second)
+	if got := s.Snapshot(); got[0].Count != 3 {
+		t.Errorf("Snapshot() 30s later; got %d values, want 3", got[0].Count)
+	}
+	c.Advance(time.Hour)
+	if got := s.Snapshot(); len(got) != 0 {
+		t.Errorf("Snapshot() an hour later; got %v, want nothing", got)
+	}
+
+	s.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1})
+	c.Advance(10 * time.Second)
+	s.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1})
+	if n := s.Remove("cpu"); n != 1 {
+		t.Errorf("Remove(cpu); got %d, want 1", n)
+	}
+}
+
+func TestWatermarked(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	w := NewWatermarked(time.Minute, 2*time.Minute, Options{})
+	w.now = func() time.Time { return now }
+
+	w.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1, Time: start.Add(10 * time.Second)})
+	w.Update(parser.Metric{Name: "mem", Value: 5, Count: 1, Time: start.Add(20 * time.Second)})
+	now = start.Add(30 * time.Second)
+	if got := w.Flush(); len(got) != 0 {
+		t.Errorf("Flush() mid window; got %v, want nothing", got)
+	}
+
+	now = start.Add(time.Minute)
+	if got := w.Flush(); len(got) != 2 {
+		t.Errorf("Flush() as the window ends; got %v, want cpu and mem", got)
+	}
+	// 90 seconds behind, a correction to the first window
+	now = start.Add(100 * time.Second)
+	w.Update(parser.Metric{Name: "cpu", Value: 3, Count: 1, Time: start.Add(10 * time.Second)})
+	w.Update(parser.Metric{Name: "cpu", Value: 7, Count: 1, Time: now})
+	var windows []time.Time
+	var amended []parser.Metric
+	w.Corrections(0, func(window time.Time, chunk []parser.Metric) {
+		windows = append(windows, window)
+		amended = append(amended, chunk...)
+	})
+	if len(windows) != 1 || !windows[0].Equal(start) || len(amended) != 1 || amended[0].Count != 2 || amended[0].Mean != 2 {
+		t.Errorf("Corrections(); got %v %v, want cpu with 2 values in the first window", windows, amended)
+	}
+	w.Corrections(0, func(time.Time, []parser.Metric) { t.Error("Corrections() again; want nothing") })
+
+	// past the watermark
+	now = start.Add(4 * time.Minute)
+	w.Update(parser.Metric{Name: "cpu", Value: 9, Count: 1, Time: start.Add(10 * time.Second)})
+	if n := w.Late(); n != 1 {
+		t.Errorf("Late(); got %d, want 1", n)
+	}
+	// the second window was never flushed, it is flushed as it is forgotten
+	if got := w.Flush(); len(got) != 1 || got[0].Value != 7 {
+		t.Errorf("Flush() past the watermark; got %v, want the second window", got)
+	}
+	if len(w.windows) != 0 {
+		t.Errorf("windows past the watermark; got %d, want none", len(w.windows))
+	}
+
+	w.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1, Time: now})
+	w.Seal()
+	if got := w.Flush(); len(got) != 1 {
+		t.Errorf("Flush() after Seal(); got %v, want the open window", got)
+	}
+}
+
+func TestWatermarkedCloseWindows(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	w := NewWatermarked(30*time.Second, time.Minute, Options{})
+	w.now = func() time.Time { return now }
+
+	w.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1, Time: start.Add(5 * time.Second)})
+	w.Update(parser.Metric{Name: "cpu", Value: 9, Count: 1, Time: start.Add(40 * time.Second)})
+	// both windows end before the flush, they stay apart
+	now = start.Add(70 * time.Second)
+	closed := w.CloseWindows()
+	if len(closed) != 2 {
+		t.Fatalf("CloseWindows(); got %d windows, want 2", len(closed))
+	}
+	for i, want := range []float64{1, 9} {
+		c := closed[i]
+		if from := start.Add(time.Duration(i) * 30 * time.Second); !c.Start.Equal(from) || !c.End.Equal(from.Add(30*time.Second)) {
+			t.Errorf("window %d; got %v to %v, want %v to %v", i, c.Start, c.End, from, from.Add(30*time.Second))
+		}
+		var got []parser.Metric
+		c.FlushSorted(0, func(chunk []parser.Metric) { got = append(got, chunk...) })
+		if len(got) != 1 || got[0].Value != want {
+			t.Errorf("window %d; got %v, want cpu %v", i, got, want)
+		}
+	}
+	if closed := w.CloseWindows(); len(closed) != 0 {
+		t.Errorf("CloseWindows() again; got %d windows, want none", len(closed))
+	}
+}
+
+func TestTags(t *testing.T) {
+	c := newCollection(Options{})
+	c.update(parser.Metric{Name: "latency", Value: 1, Count: 1, Tags: "region=us-east"})
+	c.update(parser.Metric{Name: "latency", Value: 3, Count: 1, Tags: "region=us-east"})
+	c.update(parser.Metric{Name: "latency", Value: 5, Count: 1, Tags: "region=eu"})
+	c.update(parser.Metric{Name: "latency", Value: 7, Count: 1})
+	if m := c.data["latency{region=us-east}"]; m.Count != 2 || m.Mean != 2 {
+		t.Errorf("update(tagged); got count %d mean %v, want 2 2", m.Count, m.Mean)
+	}
+	if len(c.data) != 3 {
+		t.Errorf("update(tagged); got %d series, want 3", len(c.data))
+	}
+	if n := c.remove("latency{region=eu}"); n != 1 {
+		t.Errorf("remove(latency{region=eu}); got %d, want 1", n)
+	}
+	if n := c.remove("latency"); n != 2 {
+		t.Errorf("remove(latency); got %d, want every tagset", n)
+	}
+}
+
+func TestIngressOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		overflow Overflow
+		want     []string
+	}{
+		{OverflowDropNewest, []string{"a", "b"}},
+		{OverflowDropOldest, []string{"b", "c"}},
+	} {
+		// the store's goroutine only starts once the channel is full
+		c := &channelStore{ingress: make(chan parser.Metric, 2), control: make(chan func(*collection)), overflow: tc.overflow}
+		for _, name := range []string{"a", "b", "c"} {
+			c.Update(parser.Metric{Name: name, Value: 1, Count: 1})
+		}
+		if n := c.Dropped(); n != 1 {
+			t.Errorf("Dropped() %v; got %d, want 1", tc.overflow, n)
+		}
+		go c.run(newCollection(Options{}))
+		var got []string
+		for _, m := range c.Flush() {
+			got = append(got, m.Name)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("Flush() %v; got %v, want %v", tc.overflow, got, tc.want)
+		}
+	}
+	if _, err := ParseOverflow("drop"); err == nil {
+		t.Errorf("ParseOverflow(drop); got nil error")
+	}
+}
+
+func TestPool(t *testing.T) {
+	p := NewPool(NewStore(Options{Shards: 4}), 4, 16, nil)
+	now := time.Now()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1; i <= 100; i++ {
+				p.Update(parser.Metric{Name: fmt.Sprintf("load-%d", g), Value: float64(i), Count: 1, Time: now, Type: parser.Gauge})
+			}
+		}(g)
+	}
+	wg.Wait()
+	// the updates of one metric are applied in order, a gauge ends on the
+	// last value sent
+	got := p.Flush()
+	if len(got) != 4 {
+		t.Fatalf("Flush(); got %d metrics, want 4", len(got))
+	}
+	for _, m := range got {
+		if m.Count != 100 || m.Last != 100 {
+			t.Errorf("Flush() %s; got count %d last %v, want 100 100", m.Name, m.Count, m.Last)
+		}
+	}
+	var none *Pool
+	none.Sync()
+}
+
+func TestPercentiles(t *testing.T) {
+	c := newCollection(Options{Percentiles: []float64{50, 99}})
+	for i := 1; i <= 1000; i++ {
+		c.update(parser.Metric{Name: "latency", Value: float64(i), Count: 1})
+	}
+	snap := c.snapshot()[0]
+	for _, tc := range []struct{ q, want float64 }{{0.5, 500}, {0.99, 990}} {
+		if got := snap.Quantile(tc.q); math.Abs(got-tc.want) > 5 {
+			t.Errorf("Quantile(%v); got %v, want about %v", tc.q, got, tc.want)
+		}
+	}
+	// the snapshot must not share the live digest
+	if snap.Digest == c.data["latency"].Digest {
+		t.Errorf("snapshot(); shares the digest with the collection")
+	}
+
+	if _, err := ParsePercentiles("50,101"); err == nil {
+		t.Errorf("ParsePercentiles(50,101); got nil, want an error")
+	}
+	if ps, _ := ParsePercentiles(" 50, 99.9 "); len(ps) != 2 || ps[1] != 99.9 {
+		t.Errorf("ParsePercentiles( 50, 99.9 ); got %v, want [50 99.9]", ps)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	c := newCollection(Options{Percentiles: []float64{50}})
+	c.update(parser.Metric{Name: "latency", Value: 10, Count: 1, Weight: 3})
+	c.update(parser.Metric{Name: "latency", Value: 30, Count: 1})
+	c.update(parser.Metric{Name: "requests", Value: 2, Count: 1, Weight: 5, Integer: true, IntValue: 2})
+	got := make(map[string]parser.Metric)
+	for _, m := range c.snapshot() {
+		got[m.Name] = m
+	}
+	if m := got["latency"]; m.Count != 4 || m.Value != 60 || m.Mean != 15 || m.Min != 10 || m.Max != 30 || m.Digest.Count() != 4 {
+		t.Errorf("latency weighted 3 then 1; got count %d, sum %v, mean %v, digest of %v", m.Count, m.Value, m.Mean, m.Digest.Count())
+	}
+	if m := got["requests"]; m.Count != 5 || m.IntValue != 10 || !m.Integer || m.Weight != 0 {
+		t.Errorf("requests weighted 5; got %+v", m)
+	}
+}
+
+func TestProducers(t *testing.T) {
+	// merging sliding buckets unions the producers of each
+	now := time.Now()
+	s := NewSliding(time.Minute, 2, Options{TrackProducers: true})
+	s.now = func() time.Time { return now }
+	s.started = now
+	for _, p := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "web-1"} {
+		s.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1, Producer: p})
+		now = now.Add(10 * time.Second)
+	}
+	s.Update(parser.Metric{Name: "mem", Value: 1, Count: 1})
+	got := s.Snapshot()
+	sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+	if len(got[0].Producers) != 3 {
+		t.Errorf("Snapshot(); got producers %v, want 3", got[0].Producers)
+	}
+	if got[1].Producers != nil {
+		t.Errorf("Snapshot() without a producer; got producers %v", got[1].Producers)
+	}
+
+	for _, tc := range []struct {
+		s    string
+		want ProducerCounts
+	}{{"", NoProducerCounts}, {"window", WindowProducerCounts}, {"metric", MetricProducerCounts}} {
+		if got, err := ParseProducerCounts(tc.s); err != nil || got != tc.want {
+			t.Errorf("ParseProducerCounts(%q); got %v %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+	if _, err := ParseProducerCounts("host"); err == nil {
+		t.Errorf("ParseProducerCounts(host); got nil, want an error")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	opts := Options{Percentiles: []float64{50}, TrackProducers: true}
+	for _, kind := range []string{"sharded", "channel"} {
+		agg, _ := New(kind, opts)
+		for i := 1; i <= 100; i++ {
+			agg.Update(parser.Metric{Name: "latency", Value: float64(i), Count: 1, Producer: fmt.Sprint("web-", i%3)})
+		}
+		agg.Update(parser.Metric{Name: "users", Type: parser.Set, Members: map[string]struct{}{"ann": {}, "bob": {}}, Count: 1})
+		var buf bytes.Buffer
+		if err := agg.(Snapshotter).WriteSnapshot(&buf); err != nil {
+			t.Fatalf("%s: WriteSnapshot(); got error %v", kind, err)
+		}
+		if len(agg.Snapshot()) != 2 {
+			t.Errorf("%s: WriteSnapshot() emptied the collection", kind)
+		}
+
+		restored, _ := New(kind, opts)
+		restored.Update(parser.Metric{Name: "latency", Value: 1000, Count: 1})
+		if n, err := restored.(Snapshotter).Restore(bytes.NewReader(buf.Bytes())); err != nil || n != 2 {
+			t.Fatalf("%s: Restore(); got %d, %v, want 2 metrics", kind, n, err)
+		}
+		got := restored.Snapshot()
+		sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+		if latency := got[0]; latency.Count != 101 || latency.Value != 6050 || latency.Max != 1000 || len(latency.Producers) != 3 {
+			t.Errorf("%s: latency merged into; got %+v", kind, latency)
+		} else if q := latency.Quantile(0.5); math.Abs(q-51) > 2 {
+			t.Errorf("%s: median after the restore; got %v, want about 51", kind, q)
+		}
+		if users := got[1]; len(users.Members) != 2 || users.Type != parser.Set {
+			t.Errorf("%s: set restored; got %+v", kind, users)
+		}
+
+		if _, err := restored.(Snapshotter).Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-3])); err == nil {
+			t.Errorf("%s: Restore() of a snapshot cut short; want an error", kind)
+		}
+	}
+}
+
+func TestHashes(t *testing.T) {
+	for _, name := range []string{"fnv", "fnv1", "maphash"} {
+		h, err := ParseHash(name)
+		if err != nil {
+			t.Errorf("ParseHash(%s); got %v", name, err)
+			continue
+		}
+		// sequential names, the common pattern, should still spread evenly
+		counts := make([]int, DefaultShards)
+		for i := 0; i < 32000; i++ {
+			counts[h.Sum32(fmt.Sprintf("host-%d-cpu", i))%DefaultShards]++
+		}
+		for shard, n := range counts {
+			if n < 700 || n > 1300 {
+				t.Errorf("ParseHash(%s); shard %d got %d of 32000 names, want about 1000", name, shard, n)
+			}
+		}
+		if h.Sum32("a") != h.Sum32("a") {
+			t.Errorf("ParseHash(%s); Sum32 is not stable", name)
+		}
+	}
+	if _, err := ParseHash("crc"); err == nil {
+		t.Errorf("ParseHash(crc); got nil, want an error")
+	}
+}
+
+func BenchmarkStoreChannel(b *testing.B)    { benchmarkStore(b, "channel", 1000) }
+func BenchmarkStoreSharded(b *testing.B)    { benchmarkStore(b, "sharded", 1000) }
+func BenchmarkStoreChannelHot(b *testing.B) { benchmarkStore(b, "channel", 1) }
+func BenchmarkStoreShardedHot(b *testing.B) { benchmarkStore(b, "sharded", 1) }
+
+// Updates scale with the shard count until there are about as many shards
+// as cores updating, run with -cpu 8 or more to see it
+func BenchmarkStoreShards(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			benchmarkUpdates(b, NewStore(Options{Shards: n}), 1000)
+		})
+	}
+}
+
+// The pool only queues on the benchmark's goroutines, its workers apply the
+// updates
+func BenchmarkStorePool(b *testing.B) {
+	p := NewPool(NewStore(Options{}), 4, 1024, nil)
+	now := time.Now()
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			p.Update(parser.Metric{Name: fmt.Sprintf("metric-%d", i%1000), Value: 1, Mean: 1, Count: 1, Time: now})
+			i++
+		}
+	})
+	p.Sync()
+}
+
+func TestLimit(t *testing.T) {
+	names := func(batch []parser.Metric) string {
+		var got []string
+		for _, m := range batch {
+			got = append(got, fmt.Sprintf("%s:%d", m.Name, m.Count))
+		}
+		sort.Strings(got)
+		return strings.Join(got, ",")
+	}
+	tests := []struct {
+		policy CardinalityPolicy
+		want   string
+	}{
+		{CardinalityReject, "a:2,b:1"},
+		// a was seen last, b makes room for c
+		{CardinalityEvict, "a:2,c:1"},
+		{CardinalityOverflow, "a:2,b:1,overflow:1"},
+	}
+	for _, tc := range tests {
+		for _, agg := range []Aggregator{NewStore(Options{Shards: 4}), newChannelStore(Options{})} {
+			l := NewLimit(agg, 2, tc.policy)
+			var hits int
+			l.OnHit = func(int, CardinalityPolicy) { hits++ }
+			for _, name := range []string{"a", "b", "a", "c"} {
+				l.Update(parser.Metric{Name: name, Value: 1, Count: 1})
+			}
+			if !l.Hit() || hits != 1 {
+				t.Errorf("%v: Hit(); got %v after %d alarms, want true after 1", tc.policy, l.Hit(), hits)
+			}
+			var report bytes.Buffer
+			l.Report(&report, "30s")
+			if !strings.Contains(report.String(), "Cardinality limit of 2 names hit in the 30s window") {
+				t.Errorf("%v: Report(); got %q", tc.policy, report.String())
+			}
+			if got := names(l.Flush()); got != tc.want {
+				t.Errorf("%v: Flush(); got %s, want %s", tc.policy, got, tc.want)
+			}
+			// the next window counts afresh
+			if l.Hit() {
+				t.Errorf("%v: Hit() after Flush(); got true", tc.policy)
+			}
+			l.Update(parser.Metric{Name: "c", Value: 1, Count: 1})
+			l.Update(parser.Metric{Name: "d", Value: 1, Count: 1})
+			if got := names(l.Flush()); got != "c:1,d:1" {
+				t.Errorf("%v: Flush() of the next window; got %s", tc.policy, got)
+			}
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := clock.NewManual(time.Now())
+	s := NewSliding(10*time.Minute, 10, Options{})
+	s.SetClock(c)
+	e := NewExpiry(s, time.Minute, FinalLast)
+	e.SetClock(c)
+	e.Update(parser.Metric{Name: "cpu", Tags: "host=a", Value: 5, Count: 1})
+	e.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1})
+	c.Advance(30 * time.Second)
+	e.Update(parser.Metric{Name: "cpu", Value: 1, Count: 1})
+	c.Advance(40 * time.Second)
+
+	// cpu{host=a} is replaced by its last value, cpu untagged stays
+	got := map[string]string{}
+	for _, m := range e.Flush() {
+		got[m.Key()] = fmt.Sprintf("%d %g", m.Count, m.Last)
+	}
+	if got["cpu{host=a}"] != "1 5" || got["cpu"] != "2 1" || len(got) != 2 {
+		t.Errorf("Flush(); got %v, want cpu{host=a} ending on 5 and cpu twice", got)
+	}
+	var report bytes.Buffer
+	e.Report(&report, "10m")
+	if !strings.Contains(report.String(), "Expired 1 metrics unseen for 1m0s from the 10m window") {
+		t.Errorf("Report(); got %q", report.String())
+	}
+
+	// a tumbling window gets the final value after the series stops
+	e = NewExpiry(NewStore(Options{Shards: 4}), time.Minute, FinalZero)
+	e.SetClock(c)
+	e.Update(parser.Metric{Name: "mem", Value: 3, Count: 1})
+	e.Flush()
+	c.Advance(2 * time.Minute)
+	if got := e.Flush(); len(got) != 1 || got[0].Name != "mem" || got[0].Value != 0 {
+		t.Errorf("Flush() after the TTL; got %v, want mem at 0", got)
+	}
+	if got := e.Flush(); len(got) != 0 {
+		t.Errorf("Flush() after the final value; got %v, want nothing", got)
+	}
+}
+
+func TestUniques(t *testing.T) {
+	s := NewStore(Options{Shards: 4})
+	for i := 0; i < 10000; i++ {
+		member := fmt.Sprintf("user-%d", i%5000)
+		s.Update(parser.Metric{Name: "active-users", Type: parser.Set, Unique: true, Members: map[string]struct{}{member: {}}, Value: 1, Count: 1})
+	}
+	var snapshot bytes.Buffer
+	if err := s.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	got := s.Flush()
+	if len(got) != 1 || got[0].Members != nil || got[0].Count != 10000 {
+		t.Fatalf("Flush(); got %v, want one set of 10000 observations and no members", got)
+	}
+	if n := got[0].Cardinality(); math.Abs(float64(n)-5000) > 150 {
+		t.Errorf("Cardinality(); got %d, want about 5000", n)
+	}
+
+	// the sketch survives a snapshot and merges with what comes after
+	restored := NewStore(Options{Shards: 4})
+	if _, err := restored.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	restored.Update(parser.Metric{Name: "active-users", Type: parser.Set, Unique: true, Members: map[string]struct{}{"user-new": {}}, Value: 1, Count: 1})
+	if got := restored.Flush(); len(got) != 1 || got[0].Cardinality() <= 4850 || got[0].Count != 10001 {
+		t.Errorf("Flush() after Restore(); got %d members of %d observations", got[0].Cardinality(), got[0].Count)
+	}
+}
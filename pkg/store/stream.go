@@ -0,0 +1,136 @@
+package store
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Chunk size used when streaming a flush
+const DefaultChunkSize = 4096
+
+// Streams the metrics held in the maps to fn in chunks of up to size,
+// ordered by name across all of them. Each map's names are sorted on their
+// own and merged, so beyond the maps themselves only the sorted names and
+// one chunk are held. fn must not keep the chunk, it is reused.
+func streamSorted(maps []map[string]parser.Metric, size int, fn func([]parser.Metric)) {
+	if size < 1 {
+		size = DefaultChunkSize
+	}
+	h := make(cursors, 0, len(maps))
+	for _, m := range maps {
+		if len(m) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h = append(h, &cursor{data: m, names: names})
+	}
+	heap.Init(&h)
+
+	chunk := make([]parser.Metric, 0, size)
+	for h.Len() > 0 {
+		c := h[0]
+		chunk = append(chunk, c.data[c.names[0]])
+		// let go of the metric as soon as it is in a chunk
+		delete(c.data, c.names[0])
+		c.names = c.names[1:]
+		if len(c.names) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+		if len(chunk) == size {
+			fn(chunk)
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) > 0 {
+		fn(chunk)
+	}
+}
+
+// cursor walks one map in name order
+type cursor struct {
+	data  map[string]parser.Metric
+	names []string
+}
+
+// cursors is a min heap on each cursor's next name
+type cursors []*cursor
+
+func (h cursors) Len() int            { return len(h) }
+func (h cursors) Less(i, j int) bool  { return h[i].names[0] < h[j].names[0] }
+func (h cursors) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursors) Push(x interface{}) { *h = append(*h, x.(*cursor)) }
+func (h *cursors) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// Order is the order a flush is reported in
+type Order int
+
+const (
+	// by name, streamed a chunk at a time (the default)
+	OrderName Order = iota
+	// the most updated metrics first
+	OrderCount
+	// the highest means first
+	OrderMean
+)
+
+// Parses the -sort flag: name, count or mean
+func ParseOrder(s string) (Order, error) {
+	switch s {
+	case "", "name":
+		return OrderName, nil
+	case "count":
+		return OrderCount, nil
+	case "mean":
+		return OrderMean, nil
+	}
+	return OrderName, fmt.Errorf("unknown sort order %q, want name, count or mean", s)
+}
+
+// SortedFlusher streams a collection in name order: an Aggregator, or a
+// window closed on its own
+type SortedFlusher interface {
+	FlushSorted(size int, fn func(chunk []parser.Metric))
+}
+
+// FlushOrdered flushes the aggregator to fn in chunks of up to size in the
+// order. Ties are broken by name so the output is the same for the same
+// collection. Any order but by name holds the whole collection to sort it.
+func FlushOrdered(agg SortedFlusher, order Order, size int, fn func(chunk []parser.Metric)) {
+	if order == OrderName {
+		agg.FlushSorted(size, fn)
+		return
+	}
+	if size < 1 {
+		size = DefaultChunkSize
+	}
+	var all []parser.Metric
+	agg.FlushSorted(size, func(chunk []parser.Metric) {
+		all = append(all, chunk...)
+	})
+	// stable, the collection comes in name order
+	sort.SliceStable(all, func(i, j int) bool {
+		if order == OrderCount {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Mean > all[j].Mean
+	})
+	for len(all) > 0 {
+		n := min(size, len(all))
+		fn(all[:n])
+		all = all[n:]
+	}
+}
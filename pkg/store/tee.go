@@ -0,0 +1,79 @@
+package store
+
+import "github.com/jeffdupont/go-challenge/pkg/parser"
+
+// Tee is an Aggregator feeding every metric to each of its stores, like one
+// store per window when several windows are tracked side by side. Reads and
+// flushes only see the first store.
+type Tee []Aggregator
+
+// Update adds the metric to every store
+func (t Tee) Update(m parser.Metric) {
+	for _, a := range t {
+		a.Update(m)
+	}
+}
+
+// TryUpdate only applies back pressure from the first store. Once it has
+// taken the metric the others must too, or the windows would disagree.
+func (t Tee) TryUpdate(m parser.Metric) bool {
+	if !t[0].TryUpdate(m) {
+		return false
+	}
+	for _, a := range t[1:] {
+		a.Update(m)
+	}
+	return true
+}
+
+func (t Tee) Snapshot() []parser.Metric {
+	return t[0].Snapshot()
+}
+
+func (t Tee) Flush() []parser.Metric {
+	return t[0].Flush()
+}
+
+func (t Tee) FlushSorted(size int, fn func(chunk []parser.Metric)) {
+	t[0].FlushSorted(size, fn)
+}
+
+// Dropped adds up what the stores dropped, one metric may be counted by
+// each store that dropped it
+func (t Tee) Dropped() uint64 {
+	var n uint64
+	for _, a := range t {
+		if d, ok := a.(Dropper); ok {
+			n += d.Dropped()
+		}
+	}
+	return n
+}
+
+// Backlog adds up the queues of the stores
+func (t Tee) Backlog() (queued, capacity int) {
+	for _, a := range t {
+		if b, ok := a.(Backlogger); ok {
+			q, c := b.Backlog()
+			queued, capacity = queued+q, capacity+c
+		}
+	}
+	return queued, capacity
+}
+
+// Ping pings every store
+func (t Tee) Ping() {
+	for _, a := range t {
+		a.Ping()
+	}
+}
+
+// Remove deletes the matching metrics from every store and returns the most
+// any one of them held
+func (t Tee) Remove(pattern string) int {
+	most := 0
+	for _, a := range t {
+		most = max(most, a.Remove(pattern))
+	}
+	return most
+}
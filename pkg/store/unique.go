@@ -0,0 +1,35 @@
+package store
+
+import (
+	"github.com/jeffdupont/go-challenge/pkg/hll"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// UniquePrecision is the -unique-precision of the sketches counting the
+// members of -unique-metrics sets
+var UniquePrecision = hll.DefaultPrecision
+
+// Returns a sketch of the members
+func newUniques(members map[string]struct{}) *hll.Sketch {
+	u := hll.New(UniquePrecision)
+	for member := range members {
+		u.Add(member)
+	}
+	return u
+}
+
+// Folds the members of m into the sketch of cm, which is made from its
+// members if it only kept those so far. The stored metric owns the sketch.
+func mergeUniques(cm, m parser.Metric) *hll.Sketch {
+	u := cm.Uniques
+	if u == nil {
+		u = newUniques(cm.Members)
+	}
+	for member := range m.Members {
+		u.Add(member)
+	}
+	if m.Uniques != nil {
+		u.Merge(m.Uniques)
+	}
+	return u
+}
@@ -0,0 +1,538 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// WAL is an Aggregator writing every metric it feeds the stores to a log on
+// disk first, so a crash loses none of the windows in flight. Each metric
+// is written with its own write, the log survives the process dying; it is
+// synced to the disk every so often, or on every write, for the machine
+// dying.
+//
+// Removing metrics logs the pattern, a replay removes them from what it fed
+// the windows so far.
+//
+// The log is a directory of segments. Every window's flush starts a new
+// segment, and once every window has flushed past a segment it is removed.
+// The segment each window needs from is kept in a checkpoint file, so on
+// startup Replay feeds each window what it had not flushed.
+//
+// With a Cipher the records are encrypted in batches, sealed together as
+// the log is synced or every walSealSize bytes, so the process dying loses
+// up to a sync's worth of records too. A log written with one can only be
+// replayed with its keys, and one written without it only without, so
+// turning encryption on or off takes a clean shutdown first.
+//
+// Only tumbling windows can be logged: a sliding or watermarked window
+// keeps metrics past its flushes, they would be removed from the log while
+// still held.
+type WAL struct {
+	Aggregator
+	dir  string
+	sync time.Duration
+	keys Cipher
+
+	// held for reading by the updates and for writing while a window swaps
+	// out its collection, so every metric logged before the swap is in it
+	mu sync.RWMutex
+	// held while writing to the segment
+	writeMu sync.Mutex
+	f       *os.File
+	enc     *gob.Encoder
+	// what enc writes when the records are sealed, written out sealed as
+	// one batch of pending records
+	buf     bytes.Buffer
+	pending uint64
+	segment uint64
+	failed  atomic.Uint64
+	err     error
+	// why the last checkpoint failed
+	ckErr error
+
+	// the window stores and the first segment each needs, by label
+	ckMu        sync.Mutex
+	windows     map[string]Aggregator
+	checkpoints map[string]uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+const walCheckpoints = "checkpoint"
+
+// The most plaintext held before a batch of records is sealed between syncs
+const walSealSize = 64 << 10
+
+// Cipher encrypts the records of the log at rest, see server.Keyring
+type Cipher interface {
+	// Seal returns the plaintext as an encrypted record
+	Seal(plaintext []byte) []byte
+	// Open reads the next record Seal wrote, io.EOF once there are none
+	Open(r *bufio.Reader) ([]byte, error)
+}
+
+// Opens the log in the directory feeding agg, starting a segment after any
+// left by an earlier run. The log is synced every sync, on every write when
+// 0, and its records sealed with keys unless nil.
+func OpenWAL(dir string, sync time.Duration, agg Aggregator, keys Cipher) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &WAL{Aggregator: agg, dir: dir, sync: sync, keys: keys, windows: make(map[string]Aggregator),
+		checkpoints: make(map[string]uint64), done: make(chan struct{})}
+	data, err := os.ReadFile(filepath.Join(dir, walCheckpoints))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		label, n, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if w.checkpoints[label], err = strconv.ParseUint(n, 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed checkpoint %q", line)
+		}
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		w.segment = segments[len(segments)-1]
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	if sync > 0 {
+		w.wg.Add(1)
+		go w.syncer()
+	}
+	return w, nil
+}
+
+// Returns the path of a segment
+func (w *WAL) path(segment uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016d.wal", segment))
+}
+
+// Lists the segments in order
+func (w *WAL) segments() ([]uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(w.dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, m := range matches {
+		if n, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(m), ".wal"), 10, 64); err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// Closes the segment and starts the next. Called with no update in
+// progress.
+func (w *WAL) rotate() error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if w.f != nil {
+		w.seal()
+		w.f.Sync()
+		w.f.Close()
+	}
+	f, err := os.OpenFile(w.path(w.segment+1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		w.f, w.enc = nil, nil
+		return err
+	}
+	w.segment++
+	w.f, w.enc = f, gob.NewEncoder(f)
+	if w.keys != nil {
+		w.buf.Reset()
+		w.enc = gob.NewEncoder(&w.buf)
+	}
+	return nil
+}
+
+// Window registers the store of a window, by a label that stays the same
+// across restarts like its length, returning the store to flush it
+// through. Its flushes start a new segment and move its checkpoint.
+func (w *WAL) Window(label string, agg Aggregator) Aggregator {
+	w.ckMu.Lock()
+	defer w.ckMu.Unlock()
+	w.windows[label] = agg
+	return walWindow{Aggregator: agg, wal: w, label: label}
+}
+
+// Replay feeds each window the metrics logged since its last flush, from
+// the segments of an earlier run, returning how many metrics were logged.
+// It is called once the windows are registered and before any update.
+func (w *WAL) Replay() (int, error) {
+	segments, err := w.segments()
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, segment := range segments {
+		if segment >= w.segment {
+			break
+		}
+		var targets []Aggregator
+		w.ckMu.Lock()
+		for label, agg := range w.windows {
+			if w.checkpoints[label] <= segment {
+				targets = append(targets, agg)
+			}
+		}
+		w.ckMu.Unlock()
+		if len(targets) == 0 {
+			continue
+		}
+		n, err := replaySegment(w.path(segment), w.keys, targets)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Feeds the targets the records of a segment, and removes what was removed
+// after it was fed, stopping quietly at a record cut short by a crash
+func replaySegment(path string, keys Cipher, targets []Aggregator) (int, error) {
+	n := 0
+	err := readSegment(path, keys, func(rec record) error {
+		for _, agg := range targets {
+			if rec.Removed != "" {
+				agg.Remove(rec.Removed)
+			} else {
+				agg.Update(rec.metric())
+			}
+		}
+		if rec.Removed == "" {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Hands fn every record of a segment, opened with keys unless nil, up to a
+// record cut short by a crash
+func readSegment(path string, keys Cipher, fn func(rec record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if keys != nil {
+		r = &sealedReader{keys: keys, r: bufio.NewReader(f)}
+	}
+	dec := gob.NewDecoder(r)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// sealedReader reads the plaintext of the sealed records one after the
+// other, the gob stream they were cut from
+type sealedReader struct {
+	keys Cipher
+	r    *bufio.Reader
+	// what is left of the record being read
+	plaintext []byte
+}
+
+func (s *sealedReader) Read(p []byte) (int, error) {
+	for len(s.plaintext) == 0 {
+		var err error
+		if s.plaintext, err = s.keys.Open(s.r); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plaintext)
+	s.plaintext = s.plaintext[n:]
+	return n, nil
+}
+
+// DumpSegment writes every metric of the segment, opened with keys unless
+// nil, as a JSON line, and every removal as {"removed":"<pattern>"}, for
+// the -decrypt mode to show what a log holds
+func DumpSegment(path string, keys Cipher, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	return readSegment(path, keys, func(rec record) error {
+		if rec.Removed != "" {
+			return enc.Encode(map[string]string{"removed": rec.Removed})
+		}
+		m := rec.metric()
+		return enc.Encode(struct {
+			Name     string    `json:"name"`
+			Tags     string    `json:"tags,omitempty"`
+			Type     string    `json:"type"`
+			Time     time.Time `json:"time"`
+			Value    float64   `json:"value"`
+			Count    int       `json:"count"`
+			Client   string    `json:"client,omitempty"`
+			Producer string    `json:"producer,omitempty"`
+			Tenant   string    `json:"tenant,omitempty"`
+		}{m.Name, m.Tags, m.Type.String(), m.Time, m.Value, m.Count, m.Client, m.Producer, m.Tenant})
+	})
+}
+
+// Writes a metric to the segment, counting it failed when it can't be
+func (w *WAL) append(m parser.Metric) {
+	w.write(newRecord(m))
+}
+
+// Writes a record to the segment, counting it failed when it can't be
+func (w *WAL) write(rec record) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if w.enc == nil {
+		w.failed.Add(1)
+		return
+	}
+	if err := w.enc.Encode(&rec); err != nil {
+		w.failed.Add(1)
+		w.err = err
+		return
+	}
+	if w.keys != nil {
+		w.pending++
+		if w.sync > 0 && w.buf.Len() < walSealSize {
+			return
+		}
+		w.seal()
+	}
+	if w.sync == 0 {
+		if err := w.f.Sync(); err != nil {
+			w.failed.Add(1)
+			w.err = err
+		}
+	}
+}
+
+// Writes the pending records out sealed as one, counting them failed when
+// they can't be. Called with writeMu held.
+func (w *WAL) seal() {
+	if w.pending == 0 {
+		return
+	}
+	if _, err := w.f.Write(w.keys.Seal(w.buf.Bytes())); err != nil {
+		w.failed.Add(w.pending)
+		w.err = err
+	}
+	w.buf.Reset()
+	w.pending = 0
+}
+
+// Update logs the metric and adds it to the stores
+func (w *WAL) Update(m parser.Metric) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	w.append(m)
+	w.Aggregator.Update(m)
+}
+
+// Remove logs the pattern, so a replay removes the metrics logged before
+// it, and removes them from the stores
+func (w *WAL) Remove(pattern string) int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	w.write(record{Removed: pattern})
+	return w.Aggregator.Remove(pattern)
+}
+
+// Backlog is what the stores have queued, the log queues nothing
+func (w *WAL) Backlog() (queued, capacity int) {
+	if b, ok := w.Aggregator.(Backlogger); ok {
+		return b.Backlog()
+	}
+	return 0, 0
+}
+
+// TryUpdate logs the metric once the stores took it
+func (w *WAL) TryUpdate(m parser.Metric) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.Aggregator.TryUpdate(m) {
+		return false
+	}
+	w.append(m)
+	return true
+}
+
+// Syncs the segment every w.sync
+func (w *WAL) syncer() {
+	defer w.wg.Done()
+	t := time.NewTicker(w.sync)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.writeMu.Lock()
+			if w.f != nil {
+				w.seal()
+				if err := w.f.Sync(); err != nil {
+					w.err = err
+				}
+			}
+			w.writeMu.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Starts the flush of a window, holding the updates until release is
+// called once its collection is swapped out. Returns the segment started,
+// the first the window needs after the flush.
+func (w *WAL) startFlush() (release func(), segment uint64, err error) {
+	w.mu.Lock()
+	err = w.rotate()
+	var once sync.Once
+	return func() { once.Do(w.mu.Unlock) }, w.segment, err
+}
+
+// Moves the window's checkpoint to the segment started by its flush and
+// removes the segments no window needs any more
+func (w *WAL) checkpoint(label string, segment uint64) error {
+	w.ckMu.Lock()
+	defer w.ckMu.Unlock()
+	w.checkpoints[label] = segment
+	oldest := segment
+	var b strings.Builder
+	labels := make([]string, 0, len(w.windows))
+	for l := range w.windows {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		oldest = min(oldest, w.checkpoints[l])
+		fmt.Fprintf(&b, "%s\t%d\n", l, w.checkpoints[l])
+	}
+	path := filepath.Join(w.dir, walCheckpoints)
+	if err := os.WriteFile(path+".tmp", []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range segments {
+		if s < oldest {
+			errs = append(errs, os.Remove(w.path(s)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Report writes the metrics that couldn't be logged since the last report
+// and why the last one failed, and any checkpoint that failed
+func (w *WAL) Report(out io.Writer) {
+	if w == nil {
+		return
+	}
+	w.writeMu.Lock()
+	err, ckErr := w.err, w.ckErr
+	w.ckErr = nil
+	w.writeMu.Unlock()
+	if n := w.failed.Swap(0); n > 0 {
+		fmt.Fprintf(out, "(10 sec): WAL failed to log %d metrics, %v\n", n, err)
+	}
+	if ckErr != nil {
+		fmt.Fprintf(out, "(10 sec): WAL checkpoint failed, %v\n", ckErr)
+	}
+}
+
+// Close syncs and closes the segment. The segments are kept, a window not
+// flushed on the way out is replayed on the next start.
+func (w *WAL) Close() error {
+	if w == nil {
+		return nil
+	}
+	close(w.done)
+	w.wg.Wait()
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	w.seal()
+	err := errors.Join(w.f.Sync(), w.f.Close())
+	w.f, w.enc = nil, nil
+	return err
+}
+
+// walWindow is a window's store flushed through the log
+type walWindow struct {
+	Aggregator
+	wal   *WAL
+	label string
+}
+
+func (w walWindow) Flush() []parser.Metric {
+	release, segment, err := w.wal.startFlush()
+	batch := w.Aggregator.Flush()
+	release()
+	w.end(segment, err)
+	return batch
+}
+
+// FlushSorted holds the updates until the collection is swapped out, when
+// the first chunk comes, so the segments before the flush hold nothing
+// that is not in it
+func (w walWindow) FlushSorted(size int, fn func(chunk []parser.Metric)) {
+	release, segment, err := w.wal.startFlush()
+	w.Aggregator.FlushSorted(size, func(chunk []parser.Metric) {
+		release()
+		fn(chunk)
+	})
+	release()
+	w.end(segment, err)
+}
+
+// Checkpoints the window once flushed, unless the next segment couldn't be
+// started. A failure is kept for the report, the window stays in the log.
+func (w walWindow) end(segment uint64, err error) {
+	if err == nil {
+		err = w.wal.checkpoint(w.label, segment)
+	}
+	if err != nil {
+		w.wal.writeMu.Lock()
+		w.wal.ckErr = fmt.Errorf("the %s window stays in the log, %v", w.label, err)
+		w.wal.writeMu.Unlock()
+	}
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Opens the log over a store for each of the windows a and b
+func openWAL(t *testing.T, dir string) (*WAL, Aggregator, Aggregator) {
+	t.Helper()
+	a, b := NewStore(Options{Shards: 4}), NewStore(Options{Shards: 4})
+	wal, err := OpenWAL(dir, 0, Tee{a, b}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wal, wal.Window("a", a), wal.Window("b", b)
+}
+
+// Returns the count of every metric the window flushes
+func counts(agg Aggregator) map[string]int {
+	counts := make(map[string]int)
+	agg.FlushSorted(0, func(chunk []parser.Metric) {
+		for _, m := range chunk {
+			counts[m.Name] = m.Count
+		}
+	})
+	return counts
+}
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal, a, _ := openWAL(t, dir)
+	wal.Update(parser.Metric{Name: "cpu", Value: 1, Mean: 1, Count: 1})
+	wal.Update(parser.Metric{Name: "set", Type: parser.Set, Members: map[string]struct{}{"x": {}}, Count: 1})
+	if got := counts(a); got["cpu"] != 1 {
+		t.Fatalf("a flushed %v", got)
+	}
+	wal.Update(parser.Metric{Name: "cpu", Value: 2, Mean: 2, Count: 1})
+	// crash without closing, a last record cut short
+	f, _ := os.OpenFile(wal.path(wal.segment), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0x40, 0xff})
+	f.Close()
+
+	wal, a, b := openWAL(t, dir)
+	n, err := wal.Replay()
+	if err != nil || n != 3 {
+		t.Fatalf("Replay(); got %d, %v, want the 3 metrics logged", n, err)
+	}
+	if got := counts(a); len(got) != 1 || got["cpu"] != 1 {
+		t.Errorf("a after the replay %v; want only the metric since its flush", got)
+	}
+	if got := counts(b); len(got) != 2 || got["cpu"] != 2 {
+		t.Errorf("b after the replay %v; want everything, it never flushed", got)
+	}
+	// both windows flushed, only the segments started by their flushes are kept
+	segments, _ := wal.segments()
+	if len(segments) != 2 || segments[0] != wal.segment-1 {
+		t.Errorf("segments %v after every window flushed; want %d and %d", segments, wal.segment-1, wal.segment)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close(); got error %v", err)
+	}
+	wal, _, _ = openWAL(t, dir)
+	if n, _ := wal.Replay(); n != 0 {
+		t.Errorf("Replay() after flushing everything; got %d metrics", n)
+	}
+	wal.Close()
+}
+
+func TestWALRemove(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, _ := openWAL(t, dir)
+	wal.Update(parser.Metric{Name: "cpu", Value: 1, Mean: 1, Count: 1})
+	wal.Update(parser.Metric{Name: "mem", Value: 1, Mean: 1, Count: 1})
+	if n := wal.Remove("cpu"); n != 1 {
+		t.Errorf("Remove(cpu); got %d, want 1", n)
+	}
+	// logged again after the delete, it is kept
+	wal.Update(parser.Metric{Name: "cpu", Value: 2, Mean: 2, Count: 1})
+	wal.Close()
+
+	wal, a, _ := openWAL(t, dir)
+	defer wal.Close()
+	if n, err := wal.Replay(); err != nil || n != 3 {
+		t.Fatalf("Replay(); got %d, %v, want the 3 metrics logged", n, err)
+	}
+	var out bytes.Buffer
+	if err := DumpSegment(wal.path(wal.segment-1), nil, &out); err != nil || !strings.Contains(out.String(), `{"removed":"cpu"}`) {
+		t.Errorf("DumpSegment(); got %q %v, want the delete", out.String(), err)
+	}
+	if got := counts(a); len(got) != 2 || got["cpu"] != 1 || got["mem"] != 1 {
+		t.Errorf("a after the replay %v; want cpu only since the delete", got)
+	}
+}
+
+// xorCipher stands in for a keyring, a record is its length and the
+// plaintext xored
+type xorCipher struct{}
+
+func (xorCipher) Seal(plaintext []byte) []byte {
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(plaintext)))
+	for _, b := range plaintext {
+		record = append(record, b^0x5a)
+	}
+	return record
+}
+
+func (xorCipher) Open(r *bufio.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, binary.BigEndian.Uint32(n[:]))
+	if _, err := io.ReadFull(r, plaintext); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	for i := range plaintext {
+		plaintext[i] ^= 0x5a
+	}
+	return plaintext, nil
+}
+
+func TestWALSealed(t *testing.T) {
+	dir := t.TempDir()
+	a := NewStore(Options{Shards: 4})
+	// synced hourly, the records are sealed together as the log closes
+	wal, err := OpenWAL(dir, time.Hour, a, xorCipher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Window("a", a)
+	wal.Update(parser.Metric{Name: "cpu", Value: 1, Mean: 1, Count: 1, Tenant: "acme"})
+	wal.Update(parser.Metric{Name: "mem", Value: 2, Mean: 2, Count: 1, Tenant: "acme"})
+	wal.Close()
+	path := wal.path(wal.segment)
+	data, _ := os.ReadFile(path)
+	if len(data) == 0 || bytes.Contains(data, []byte("acme")) {
+		t.Errorf("segment %q; want it sealed", data)
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	if _, err := (xorCipher{}).Open(r); err != nil {
+		t.Errorf("Open(); got %v, want the batch", err)
+	}
+	if _, err := (xorCipher{}).Open(r); err != io.EOF {
+		t.Errorf("Open() past the batch; got %v, want io.EOF", err)
+	}
+
+	a = NewStore(Options{Shards: 4})
+	wal, err = OpenWAL(dir, 0, a, xorCipher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Window("a", a)
+	if n, err := wal.Replay(); err != nil || n != 2 {
+		t.Errorf("Replay(); got %d, %v, want the 2 metrics logged", n, err)
+	}
+	wal.Close()
+
+	var out bytes.Buffer
+	if err := DumpSegment(path, xorCipher{}, &out); err != nil || strings.Count(out.String(), `"tenant":"acme"`) != 2 {
+		t.Errorf("DumpSegment(); got %q %v", out.String(), err)
+	}
+}
+
+func TestWALConcurrentFlush(t *testing.T) {
+	dir := t.TempDir()
+	wal, a, _ := openWAL(t, dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				wal.Update(parser.Metric{Name: "cpu", Value: 1, Mean: 1, Count: 1})
+			}
+		}()
+	}
+	flushed := 0
+	for i := 0; i < 20; i++ {
+		flushed += counts(a)["cpu"]
+	}
+	wg.Wait()
+	wal.Close()
+
+	// whatever a didn't flush is replayed, nothing twice
+	_, a, _ = openWAL(t, dir)
+	wal2 := a.(walWindow).wal
+	if _, err := wal2.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if got := flushed + counts(a)["cpu"]; got != 2000 {
+		t.Errorf("flushed and replayed %d metrics, want 2000", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.wal")); len(matches) == 0 {
+		t.Errorf("no segments left")
+	}
+	wal2.Close()
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffdupont/go-challenge/pkg/clock"
+	"github.com/jeffdupont/go-challenge/pkg/parser"
+)
+
+// Corrector is implemented by the Aggregators that can amend windows they
+// have already flushed
+type Corrector interface {
+	// passes fn, window by window oldest first, the complete amended
+	// aggregates of every metric that changed in a flushed window since it
+	// was last reported. fn must not keep the chunk.
+	Corrections(size int, fn func(window time.Time, chunk []parser.Metric))
+}
+
+// Watermarked is an Aggregator of event time windows: metrics are placed by
+// their own timestamp, not when they arrive. A window is flushed once it
+// has ended but kept for the grace period after, late metrics still land in
+// it and are reported as Corrections. Past the grace period, the
+// watermark, a window is forgotten and metrics for it are dropped as late.
+type Watermarked struct {
+	mu      sync.Mutex
+	length  time.Duration
+	grace   time.Duration
+	windows map[time.Time]*eventWindow
+	now     func() time.Time
+	opts    Options
+	// flush every window, ended or not
+	sealed bool
+	// metrics that arrived after their window's grace period
+	late uint64
+}
+
+type eventWindow struct {
+	// everything in the window so far
+	all     *collection
+	flushed bool
+	// keys updated since the window was last reported
+	dirty map[string]bool
+}
+
+// Returns an empty Watermarked of windows of length kept for grace, keeping
+// the metrics by the options
+func NewWatermarked(length, grace time.Duration, opts Options) *Watermarked {
+	return &Watermarked{length: length, grace: grace, windows: make(map[time.Time]*eventWindow), now: time.Now, opts: opts}
+}
+
+// SetClock makes the watermark go by the clock rather than the wall clock
+func (w *Watermarked) SetClock(c clock.Clock) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.now = c.Now
+}
+
+// Update adds the metric to the window its timestamp falls in
+func (w *Watermarked) Update(m parser.Metric) {
+	start := m.Time.Truncate(w.length)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !start.Add(w.length + w.grace).After(w.now()) {
+		atomic.AddUint64(&w.late, 1)
+		return
+	}
+	win := w.windows[start]
+	if win == nil {
+		win = &eventWindow{all: newCollection(w.opts), dirty: make(map[string]bool)}
+		w.windows[start] = win
+	}
+	win.all.update(m)
+	if win.flushed {
+		win.dirty[m.Key()] = true
+	}
+}
+
+// TryUpdate is Update, the lock is never held for long
+func (w *Watermarked) TryUpdate(m parser.Metric) bool {
+	w.Update(m)
+	return true
+}
+
+// Late returns how many metrics were dropped for arriving past the
+// watermark since the last call
+func (w *Watermarked) Late() uint64 {
+	return atomic.SwapUint64(&w.late, 0)
+}
+
+// Ping takes the lock
+func (w *Watermarked) Ping() {
+	w.mu.Lock()
+	w.mu.Unlock()
+}
+
+// Snapshot returns the windows that have not been flushed yet
+func (w *Watermarked) Snapshot() []parser.Metric {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	open := newCollection(w.opts)
+	for _, win := range w.windows {
+		if !win.flushed {
+			for _, m := range win.all.snapshot() {
+				open.update(m)
+			}
+		}
+	}
+	return open.snapshot()
+}
+
+// ClosedWindow is one event time window that has ended, flushed on its own
+type ClosedWindow struct {
+	Start, End time.Time
+	c          *collection
+}
+
+// FlushSorted streams the window to fn in chunks ordered by name
+func (c ClosedWindow) FlushSorted(size int, fn func([]parser.Metric)) {
+	if c.c == nil {
+		return
+	}
+	streamSorted([]map[string]parser.Metric{c.c.data}, size, fn)
+}
+
+// CloseWindows marks every window that has ended as flushed and returns
+// them oldest first, each with its own metrics, and forgets the windows
+// past the watermark
+func (w *Watermarked) CloseWindows() []ClosedWindow {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	var closed []ClosedWindow
+	for start, win := range w.windows {
+		end := start.Add(w.length)
+		if !end.Add(w.grace).After(now) {
+			delete(w.windows, start)
+			if win.flushed {
+				continue
+			}
+		} else if (end.After(now) && !w.sealed) || win.flushed {
+			continue
+		}
+		win.flushed = true
+		// copied, the window goes on taking late metrics
+		c := newCollection(w.opts)
+		for _, m := range win.all.snapshot() {
+			c.data[m.Key()] = m
+		}
+		closed = append(closed, ClosedWindow{Start: start, End: end, c: c})
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].Start.Before(closed[j].Start) })
+	return closed
+}
+
+// Merges the windows that have ended
+func (w *Watermarked) closeWindows() *collection {
+	merged := newCollection(w.opts)
+	for _, c := range w.CloseWindows() {
+		for _, m := range c.c.snapshot() {
+			merged.update(m)
+		}
+	}
+	return merged
+}
+
+// Seal makes every later flush report the windows that have not ended yet
+// too, so nothing is held back at shutdown
+func (w *Watermarked) Seal() {
+	w.mu.Lock()
+	w.sealed = true
+	w.mu.Unlock()
+}
+
+// Flush returns the windows that have ended since the last flush merged,
+// CloseWindows keeps them apart
+func (w *Watermarked) Flush() []parser.Metric {
+	return w.closeWindows().snapshot()
+}
+
+// FlushSorted streams the windows that have ended since the last flush,
+// merged, to fn in chunks ordered by name
+func (w *Watermarked) FlushSorted(size int, fn func([]parser.Metric)) {
+	streamSorted([]map[string]parser.Metric{w.closeWindows().data}, size, fn)
+}
+
+// Corrections streams the amended metrics of the flushed windows
+func (w *Watermarked) Corrections(size int, fn func(window time.Time, chunk []parser.Metric)) {
+	type amended struct {
+		start time.Time
+		data  map[string]parser.Metric
+	}
+	var all []amended
+	w.mu.Lock()
+	for start, win := range w.windows {
+		if !win.flushed || len(win.dirty) == 0 {
+			continue
+		}
+		changed := newCollection(w.opts)
+		for key := range win.dirty {
+			if m, ok := win.all.data[key]; ok {
+				changed.data[key] = m
+			}
+		}
+		// copied, the window goes on taking late metrics
+		data := make(map[string]parser.Metric, len(changed.data))
+		for _, m := range changed.snapshot() {
+			data[m.Key()] = m
+		}
+		win.dirty = make(map[string]bool)
+		all = append(all, amended{start, data})
+	}
+	w.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].start.Before(all[j].start) })
+	for _, a := range all {
+		streamSorted([]map[string]parser.Metric{a.data}, size, func(chunk []parser.Metric) {
+			fn(a.start, chunk)
+		})
+	}
+}
+
+// Remove deletes the matching metrics from every window and returns how
+// many distinct ones were removed
+func (w *Watermarked) Remove(pattern string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	removed := make(map[string]bool)
+	for _, win := range w.windows {
+		for key, m := range win.all.data {
+			if matches(pattern, key, m) {
+				removed[key] = true
+				delete(win.dirty, key)
+			}
+		}
+		win.all.remove(pattern)
+	}
+	return len(removed)
+}
@@ -0,0 +1,186 @@
+// Package tdigest estimates quantiles of a stream without keeping the
+// samples, using Ted Dunning's merging t-digest. Accuracy is best at the
+// tails, which is where latency percentiles live.
+package tdigest
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// DefaultCompression bounds a digest to roughly this many centroids
+const DefaultCompression = 100
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest is a quantile sketch. It is not safe for concurrent use.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	// samples not yet merged into the centroids
+	buffer []centroid
+	count  float64
+	min    float64
+	max    float64
+}
+
+// Returns an empty digest. Higher compression is more accurate and larger.
+func New(compression float64) *TDigest {
+	if compression < 10 {
+		compression = 10
+	}
+	return &TDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+// Adds a sample
+func (t *TDigest) Add(x float64) {
+	t.AddWeighted(x, 1)
+}
+
+// Adds w samples of x at once
+func (t *TDigest) AddWeighted(x, w float64) {
+	if math.IsNaN(x) || !(w > 0) {
+		return
+	}
+	t.buffer = append(t.buffer, centroid{x, w})
+	t.count += w
+	t.min = math.Min(t.min, x)
+	t.max = math.Max(t.max, x)
+	if len(t.buffer) >= int(t.compression)*4 {
+		t.compress()
+	}
+}
+
+// Merges another digest into t, o is left untouched
+func (t *TDigest) Merge(o *TDigest) {
+	if o == nil || o.count == 0 {
+		return
+	}
+	t.buffer = append(t.buffer, o.centroids...)
+	t.buffer = append(t.buffer, o.buffer...)
+	t.count += o.count
+	t.min = math.Min(t.min, o.min)
+	t.max = math.Max(t.max, o.max)
+	t.compress()
+}
+
+// Returns a copy sharing nothing with t
+func (t *TDigest) Clone() *TDigest {
+	c := *t
+	c.centroids = append([]centroid(nil), t.centroids...)
+	c.buffer = append([]centroid(nil), t.buffer...)
+	return &c
+}
+
+// Count returns the number of samples added
+func (t *TDigest) Count() float64 {
+	return t.count
+}
+
+// Merges the buffered samples into the centroids. Neighbouring centroids
+// are combined while the k1 scale function says the result is small enough
+// for its quantile, so centroids stay tiny near 0 and 1.
+func (t *TDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	t.buffer = t.buffer[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, int(t.compression))
+	cur := all[0]
+	soFar := 0.0
+	kLower := t.k(0)
+	for _, c := range all[1:] {
+		if t.k((soFar+cur.weight+c.weight)/t.count)-kLower <= 1 {
+			cur.weight += c.weight
+			cur.mean += (c.mean - cur.mean) * c.weight / cur.weight
+			continue
+		}
+		merged = append(merged, cur)
+		soFar += cur.weight
+		kLower = t.k(soFar / t.count)
+		cur = c
+	}
+	t.centroids = append(merged, cur)
+}
+
+// The k1 scale function
+func (t *TDigest) k(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*math.Min(1, q)-1)
+}
+
+// Quantile estimates the value below which the fraction q of samples fall.
+// It returns NaN for an empty digest. Buffered samples are merged first so
+// it is not safe to call concurrently with anything else, Clone first.
+func (t *TDigest) Quantile(q float64) float64 {
+	t.compress()
+	n := len(t.centroids)
+	switch {
+	case n == 0:
+		return math.NaN()
+	case q <= 0:
+		return t.min
+	case q >= 1:
+		return t.max
+	case n == 1:
+		return t.centroids[0].mean
+	}
+
+	// each centroid's weight is spread evenly around its mean, so
+	// interpolate between the centres either side of the target rank
+	rank := q * t.count
+	first := t.centroids[0]
+	if rank < first.weight/2 {
+		return t.min + (first.mean-t.min)*rank/(first.weight/2)
+	}
+	cum := first.weight / 2
+	for i := 1; i < n; i++ {
+		prev, c := t.centroids[i-1], t.centroids[i]
+		step := (prev.weight + c.weight) / 2
+		if rank < cum+step {
+			return prev.mean + (c.mean-prev.mean)*(rank-cum)/step
+		}
+		cum += step
+	}
+	last := t.centroids[n-1]
+	return last.mean + (t.max-last.mean)*(rank-cum)/(last.weight/2)
+}
+
+// MarshalBinary encodes the digest as its compression, count, min and max
+// followed by the mean and weight of each centroid, buffered samples
+// included, as little-endian float64s
+func (t *TDigest) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 8*(4+2*(len(t.centroids)+len(t.buffer))))
+	for _, f := range []float64{t.compression, t.count, t.min, t.max} {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+	}
+	for _, c := range append(t.centroids[:len(t.centroids):len(t.centroids)], t.buffer...) {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c.mean))
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c.weight))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary restores a digest encoded by MarshalBinary
+func (t *TDigest) UnmarshalBinary(b []byte) error {
+	if len(b) < 32 || len(b)%16 != 0 {
+		return errors.New("tdigest: malformed encoding")
+	}
+	f := func(i int) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:])) }
+	*t = TDigest{compression: f(0), count: f(1), min: f(2), max: f(3)}
+	if t.compression < 10 {
+		return errors.New("tdigest: malformed encoding")
+	}
+	for i := 4; i < len(b)/8; i += 2 {
+		t.buffer = append(t.buffer, centroid{f(i), f(i + 1)})
+	}
+	t.compress()
+	return nil
+}
@@ -0,0 +1,71 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestQuantile(t *testing.T) {
+	d := New(DefaultCompression)
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(100000) {
+		d.Add(float64(i))
+	}
+	for _, q := range []float64{0.01, 0.5, 0.95, 0.99, 0.999} {
+		got, want := d.Quantile(q), q*100000
+		if math.Abs(got-want) > 100000*0.005 {
+			t.Errorf("Quantile(%v); got %v, want about %v", q, got, want)
+		}
+	}
+	if got := d.Quantile(0); got != 0 {
+		t.Errorf("Quantile(0); got %v, want the min", got)
+	}
+	if got := d.Quantile(1); got != 99999 {
+		t.Errorf("Quantile(1); got %v, want the max", got)
+	}
+	if len(d.centroids) > 2*DefaultCompression {
+		t.Errorf("centroids; got %d, want at most %d", len(d.centroids), 2*DefaultCompression)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(DefaultCompression), New(DefaultCompression)
+	for i := 0; i < 1000; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i + 1000))
+	}
+	a.Merge(b)
+	if a.Count() != 2000 {
+		t.Errorf("Count() after Merge; got %v, want 2000", a.Count())
+	}
+	if got := a.Quantile(0.5); math.Abs(got-1000) > 20 {
+		t.Errorf("Quantile(0.5) after Merge; got %v, want about 1000", got)
+	}
+	if got := New(DefaultCompression).Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("Quantile() of an empty digest; got %v, want NaN", got)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	d := New(DefaultCompression)
+	for i := 0; i < 1000; i++ {
+		d.Add(float64(i))
+	}
+	b, _ := d.MarshalBinary()
+	var got TDigest
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary(); got error %v", err)
+	}
+	for _, q := range []float64{0, 0.5, 0.99, 1} {
+		if got.Quantile(q) != d.Quantile(q) {
+			t.Errorf("Quantile(%v) after a round trip; got %v, want %v", q, got.Quantile(q), d.Quantile(q))
+		}
+	}
+	if got.Count() != 1000 {
+		t.Errorf("Count() after a round trip; got %v, want 1000", got.Count())
+	}
+	if err := got.UnmarshalBinary(b[:40]); err == nil {
+		t.Errorf("UnmarshalBinary() of a truncated encoding; want an error")
+	}
+}
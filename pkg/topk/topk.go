@@ -0,0 +1,176 @@
+// Package topk finds the heaviest keys of a stream in bounded memory with
+// the Space-Saving algorithm of Metwally, Agrawal and El Abbadi. A key
+// heavier than 1/capacity of the stream's total weight is always kept, and
+// what it had before it was is at most the Error reported.
+package topk
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// By is what the keys are ranked by
+type By int
+
+const (
+	// the observations of the key
+	ByCount By = iota
+	// the sum of its values, by magnitude so negative sums rank too
+	BySum
+	// the mean of its values. The keys are kept by their count, so the
+	// mean of a key seen once doesn't push out the traffic.
+	ByMean
+)
+
+// Parses the -top-by flag: count, sum or mean
+func ParseBy(s string) (By, error) {
+	switch s {
+	case "count":
+		return ByCount, nil
+	case "sum":
+		return BySum, nil
+	case "mean":
+		return ByMean, nil
+	}
+	return ByCount, fmt.Errorf("unknown ranking %q, want count, sum or mean", s)
+}
+
+func (b By) String() string {
+	switch b {
+	case BySum:
+		return "sum"
+	case ByMean:
+		return "mean"
+	}
+	return "count"
+}
+
+// Entry is a key of the top and what it was ranked by
+type Entry struct {
+	Key string
+	// what was seen of the key since the sketch kept it
+	Value float64
+	// how much of the count or sum the key may have had before, what the
+	// key it replaced weighed. Always 0 for ByMean, the mean only covers
+	// what was seen.
+	Error float64
+}
+
+type item struct {
+	key string
+	// what the key is kept by, and the part of it inherited from the key
+	// it replaced
+	weight, error float64
+	count         uint64
+	sum           float64
+	index         int
+}
+
+// Sketch keeps the capacity heaviest keys added. It is not safe for
+// concurrent use.
+type Sketch struct {
+	by       By
+	capacity int
+	items    map[string]*item
+	heap     minHeap
+}
+
+// Returns an empty sketch keeping up to capacity keys, a few times the
+// number of keys of the top asked for keeps its ranking accurate
+func New(capacity int, by By) *Sketch {
+	return &Sketch{by: by, capacity: max(capacity, 1), items: make(map[string]*item)}
+}
+
+// Adds count observations of the key summing to sum. Once the sketch is
+// full a new key takes the place of the lightest one, inheriting its weight.
+func (s *Sketch) Add(key string, count uint64, sum float64) {
+	w := float64(count)
+	if s.by == BySum {
+		w = math.Abs(sum)
+	}
+	if it, ok := s.items[key]; ok {
+		it.weight += w
+		it.count += count
+		it.sum += sum
+		heap.Fix(&s.heap, it.index)
+		return
+	}
+	if len(s.items) < s.capacity {
+		it := &item{key: key, weight: w, count: count, sum: sum}
+		s.items[key] = it
+		heap.Push(&s.heap, it)
+		return
+	}
+	it := s.heap[0]
+	delete(s.items, it.key)
+	it.key, it.error = key, it.weight
+	it.weight += w
+	it.count, it.sum = count, sum
+	s.items[key] = it
+	heap.Fix(&s.heap, 0)
+}
+
+// Returns the k heaviest keys, heaviest first, ties by key. By count and
+// sum the keys are ranked by their weight with what they inherited.
+func (s *Sketch) Top(k int) []Entry {
+	items := make([]*item, 0, len(s.items))
+	for _, it := range s.items {
+		items = append(items, it)
+	}
+	mean := func(it *item) float64 {
+		return it.sum / float64(max(it.count, 1))
+	}
+	sort.Slice(items, func(i, j int) bool {
+		ri, rj := items[i].weight, items[j].weight
+		if s.by == ByMean {
+			ri, rj = mean(items[i]), mean(items[j])
+		}
+		if ri != rj {
+			return ri > rj
+		}
+		return items[i].key < items[j].key
+	})
+	entries := make([]Entry, 0, min(k, len(items)))
+	for _, it := range items[:min(k, len(items))] {
+		e := Entry{Key: it.key, Value: float64(it.count), Error: it.error}
+		switch s.by {
+		case BySum:
+			e.Value = it.sum
+		case ByMean:
+			e.Value, e.Error = mean(it), 0
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Reset empties the sketch
+func (s *Sketch) Reset() {
+	clear(s.items)
+	s.heap = s.heap[:0]
+}
+
+// minHeap orders the items lightest first
+type minHeap []*item
+
+func (h minHeap) Len() int           { return len(h) }
+func (h minHeap) Less(i, j int) bool { return h[i].weight < h[j].weight }
+func (h minHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *minHeap) Push(x any) {
+	it := x.(*item)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *minHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
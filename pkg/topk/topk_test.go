@@ -0,0 +1,58 @@
+package topk
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestTop(t *testing.T) {
+	s := New(20, ByCount)
+	r := rand.New(rand.NewSource(1))
+	// three heavy keys among a thousand seen once or twice
+	for i := 0; i < 3000; i++ {
+		s.Add(fmt.Sprintf("noise-%d", r.Intn(1000)), 1, 1)
+		if i%3 == 0 {
+			s.Add("hot-a", 1, 1)
+		}
+		if i%5 == 0 {
+			s.Add("hot-b", 1, 1)
+		}
+		if i%10 == 0 {
+			s.Add("hot-c", 2, 2)
+		}
+	}
+	top := s.Top(3)
+	for i, want := range []string{"hot-a", "hot-b", "hot-c"} {
+		if i >= len(top) || top[i].Key != want {
+			t.Fatalf("Top(3); got %v, want hot-a, hot-b, hot-c", top)
+		}
+	}
+	// hot-a was kept from its first line, nothing of it was missed
+	if top[0].Value != 1000 || top[0].Error != 0 {
+		t.Errorf("Top(3) hot-a; got %v ±%v, want 1000 ±0", top[0].Value, top[0].Error)
+	}
+
+	s.Reset()
+	if got := s.Top(3); len(got) != 0 {
+		t.Errorf("Top() after Reset(); got %v", got)
+	}
+}
+
+func TestTopBy(t *testing.T) {
+	sums, means := New(10, BySum), New(10, ByMean)
+	for _, s := range []*Sketch{sums, means} {
+		s.Add("many-small", 100, 100)
+		s.Add("few-large", 2, 500)
+		s.Add("refunds", 10, -1000)
+	}
+	if got := sums.Top(2); got[0].Key != "refunds" || got[0].Value != -1000 || got[1].Key != "few-large" {
+		t.Errorf("Top() by sum; got %v, want refunds then few-large", got)
+	}
+	if got := means.Top(1); got[0].Key != "few-large" || got[0].Value != 250 {
+		t.Errorf("Top() by mean; got %v, want few-large 250", got)
+	}
+	if _, err := ParseBy("median"); err == nil {
+		t.Error("ParseBy(median); got nil error")
+	}
+}
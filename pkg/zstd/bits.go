@@ -0,0 +1,79 @@
+package zstd
+
+import "math/bits"
+
+// backward reads the bit streams of entropy coded data from their last
+// byte to their first, the order the encoder wrote them in. The last byte
+// holds a 1 marking where the stream starts. Reading past the first byte
+// reads zeros and leaves avail negative.
+type backward struct {
+	in  []byte
+	off int
+	// the bits loaded, the next ones read are the highest avail of them
+	value uint64
+	avail int
+}
+
+func (b *backward) init(in []byte) error {
+	if len(in) == 0 || in[len(in)-1] == 0 {
+		return ErrCorrupt
+	}
+	last := in[len(in)-1]
+	b.in, b.off, b.value = in, len(in)-1, uint64(last)
+	b.avail = 7 - bits.LeadingZeros8(last)
+	b.fill()
+	return nil
+}
+
+func (b *backward) fill() {
+	for b.avail <= 56 && b.off > 0 {
+		b.off--
+		b.value = b.value<<8 | uint64(b.in[b.off])
+		b.avail += 8
+	}
+}
+
+// Returns the next n bits without reading them, n at most 32
+func (b *backward) peek(n int) uint64 {
+	if b.avail < n {
+		b.fill()
+	}
+	mask := uint64(1)<<n - 1
+	switch {
+	case b.avail >= n:
+		return b.value >> (b.avail - n) & mask
+	case n-b.avail >= 64:
+		return 0
+	}
+	return b.value << (n - b.avail) & mask
+}
+
+func (b *backward) read(n int) uint64 {
+	v := b.peek(n)
+	b.avail -= n
+	return v
+}
+
+func (b *backward) skip(n int) {
+	b.avail -= n
+}
+
+// Returns whether more bits were read than the stream holds
+func (b *backward) overflow() bool {
+	return b.avail < 0
+}
+
+// Returns whether every bit of the stream was read, no more
+func (b *backward) finished() bool {
+	return b.avail == 0 && b.off == 0
+}
+
+// Returns the n bits at bit pos of in, read forward from the lowest bit of
+// each byte, zeros past its end. n is at most 32.
+func forward(in []byte, pos, n int) int {
+	var v uint64
+	for i, at := 0, pos/8; i < 8 && at+i < len(in); i++ {
+		v |= uint64(in[at+i]) << (8 * i)
+	}
+	return int(v >> (pos % 8) & (1<<n - 1))
+}
@@ -0,0 +1,335 @@
+package zstd
+
+import "encoding/binary"
+
+const (
+	literalsRaw        = 0
+	literalsRLE        = 1
+	literalsCompressed = 2
+	literalsTreeless   = 3
+
+	modePredefined = 0
+	modeRLE        = 1
+	modeCompressed = 2
+	modeRepeat     = 3
+)
+
+// the literal length, offset and match length codes of the sequences
+const (
+	literalLengths = iota
+	offsets
+	matchLengths
+)
+
+// what each code of the sequences may be at most, and how precise its table
+var (
+	maxSymbols = [3]int{35, 31, 52}
+	maxLogs    = [3]int{9, 8, 9}
+)
+
+// The tables sequences use when a block doesn't describe its own
+var predefined = func() (t [3]fseTable) {
+	for i, norm := range [3][]int16{
+		{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1},
+		{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1},
+		{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1},
+	} {
+		if err := t[i].build(norm, [3]int{6, 5, 6}[i]); err != nil {
+			panic(err)
+		}
+	}
+	return t
+}()
+
+// the lengths the codes past the first stand for, a base plus extra bits
+var (
+	literalLengthCodes = [36][2]uint32{
+		{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0},
+		{8, 0}, {9, 0}, {10, 0}, {11, 0}, {12, 0}, {13, 0}, {14, 0}, {15, 0},
+		{16, 1}, {18, 1}, {20, 1}, {22, 1}, {24, 2}, {28, 2}, {32, 3}, {40, 3},
+		{48, 4}, {64, 6}, {128, 7}, {256, 8}, {512, 9}, {1024, 10}, {2048, 11}, {4096, 12},
+		{8192, 13}, {16384, 14}, {32768, 15}, {65536, 16},
+	}
+	matchLengthCodes = [53][2]uint32{
+		{3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0}, {8, 0}, {9, 0}, {10, 0},
+		{11, 0}, {12, 0}, {13, 0}, {14, 0}, {15, 0}, {16, 0}, {17, 0}, {18, 0},
+		{19, 0}, {20, 0}, {21, 0}, {22, 0}, {23, 0}, {24, 0}, {25, 0}, {26, 0},
+		{27, 0}, {28, 0}, {29, 0}, {30, 0}, {31, 0}, {32, 0}, {33, 0}, {34, 0},
+		{35, 1}, {37, 1}, {39, 1}, {41, 1}, {43, 2}, {47, 2}, {51, 3}, {59, 3},
+		{67, 4}, {83, 4}, {99, 5}, {131, 7}, {259, 8}, {515, 9}, {1027, 10}, {2051, 11},
+		{4099, 12}, {8195, 13}, {16387, 14}, {32771, 15}, {65539, 16},
+	}
+)
+
+// Decodes a compressed block, its literals and then the sequences copying
+// them and matches to the content, which mustn't grow past limit
+func (z *Reader) compressed(b []byte, limit int) error {
+	lits, n, err := z.literals(b)
+	if err != nil {
+		return err
+	}
+	return z.sequences(b[n:], lits, limit)
+}
+
+// Decodes the literals section at the start of a block, returning the bytes
+// it took
+func (z *Reader) literals(b []byte) ([]byte, int, error) {
+	if len(b) == 0 {
+		return nil, 0, ErrCorrupt
+	}
+	kind, format := b[0]&3, b[0]>>2&3
+	if kind == literalsRaw || kind == literalsRLE {
+		var size, h int
+		switch format {
+		case 0, 2:
+			size, h = int(b[0]>>3), 1
+		case 1:
+			if len(b) < 2 {
+				return nil, 0, ErrCorrupt
+			}
+			size, h = int(b[0]>>4)|int(b[1])<<4, 2
+		case 3:
+			if len(b) < 3 {
+				return nil, 0, ErrCorrupt
+			}
+			size, h = int(b[0]>>4)|int(b[1])<<4|int(b[2])<<12, 3
+		}
+		if size > maxBlockSize {
+			return nil, 0, ErrCorrupt
+		}
+		if kind == literalsRaw {
+			if h+size > len(b) {
+				return nil, 0, ErrCorrupt
+			}
+			return b[h : h+size], h + size, nil
+		}
+		if h+1 > len(b) {
+			return nil, 0, ErrCorrupt
+		}
+		z.lits = z.lits[:0]
+		for i := 0; i < size; i++ {
+			z.lits = append(z.lits, b[h])
+		}
+		return z.lits, h + 1, nil
+	}
+
+	// Huffman coded, in one stream or four
+	var size, compressed, h int
+	streams := 4
+	switch format {
+	case 0, 1:
+		if len(b) < 3 {
+			return nil, 0, ErrCorrupt
+		}
+		c := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		size, compressed, h = c>>4&0x3ff, c>>14&0x3ff, 3
+		if format == 0 {
+			streams = 1
+		}
+	case 2:
+		if len(b) < 4 {
+			return nil, 0, ErrCorrupt
+		}
+		c := int(binary.LittleEndian.Uint32(b))
+		size, compressed, h = c>>4&0x3fff, c>>18&0x3fff, 4
+	case 3:
+		if len(b) < 5 {
+			return nil, 0, ErrCorrupt
+		}
+		c := int(binary.LittleEndian.Uint32(b)) | int(b[4])<<32
+		size, compressed, h = c>>4&0x3ffff, c>>22&0x3ffff, 5
+	}
+	if size > maxBlockSize || h+compressed > len(b) {
+		return nil, 0, ErrCorrupt
+	}
+	data := b[h : h+compressed]
+	if kind == literalsCompressed {
+		n, err := z.huffman.read(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		data, z.lastHuff = data[n:], true
+	} else if !z.lastHuff {
+		return nil, 0, ErrCorrupt
+	}
+	if cap(z.lits) < size {
+		z.lits = make([]byte, size)
+	}
+	lits := z.lits[:size]
+	if streams == 1 {
+		if err := z.huffman.decode(lits, data); err != nil {
+			return nil, 0, err
+		}
+		return lits, h + compressed, nil
+	}
+	// a jump table gives the sizes of the first three streams, each but the
+	// last decoding to a quarter of the literals rounded up
+	if len(data) < 6 {
+		return nil, 0, ErrCorrupt
+	}
+	quarter := (size + 3) / 4
+	if 3*quarter > size {
+		return nil, 0, ErrCorrupt
+	}
+	data, jumps := data[6:], data[:6]
+	for i := 0; i < 4; i++ {
+		n := len(data)
+		if i < 3 {
+			n = int(binary.LittleEndian.Uint16(jumps[2*i:]))
+		}
+		if n > len(data) {
+			return nil, 0, ErrCorrupt
+		}
+		to := min((i+1)*quarter, size)
+		if i == 3 {
+			to = size
+		}
+		if err := z.huffman.decode(lits[i*quarter:to], data[:n]); err != nil {
+			return nil, 0, err
+		}
+		data = data[n:]
+	}
+	return lits, h + compressed, nil
+}
+
+// Decodes the sequences section of a block, appending the literals and
+// matches they make to the content
+func (z *Reader) sequences(b []byte, lits []byte, limit int) error {
+	if len(b) == 0 {
+		return ErrCorrupt
+	}
+	var n, pos int
+	switch c := int(b[0]); {
+	case c == 0:
+		if len(b) != 1 || len(z.hist)+len(lits) > limit {
+			return ErrCorrupt
+		}
+		z.hist = append(z.hist, lits...)
+		return nil
+	case c < 128:
+		n, pos = c, 1
+	case c < 255:
+		if len(b) < 2 {
+			return ErrCorrupt
+		}
+		n, pos = (c-128)<<8+int(b[1]), 2
+	default:
+		if len(b) < 3 {
+			return ErrCorrupt
+		}
+		n, pos = int(b[1])+int(b[2])<<8+0x7f00, 3
+	}
+	if pos >= len(b) || b[pos]&3 != 0 {
+		return ErrCorrupt
+	}
+	modes := b[pos]
+	pos++
+	for i := literalLengths; i <= matchLengths; i++ {
+		k, err := z.table(i, int(modes>>(6-2*i)&3), b[pos:])
+		if err != nil {
+			return err
+		}
+		pos += k
+	}
+
+	var br backward
+	if err := br.init(b[pos:]); err != nil {
+		return err
+	}
+	var ll, of, ml fseState
+	ll.init(z.tables[literalLengths], &br)
+	of.init(z.tables[offsets], &br)
+	ml.init(z.tables[matchLengths], &br)
+	for i := 0; i < n; i++ {
+		ofCode, mlCode, llCode := int(of.symbol()), ml.symbol(), ll.symbol()
+		if int(mlCode) >= len(matchLengthCodes) || int(llCode) >= len(literalLengthCodes) || ofCode > maxSymbols[offsets] {
+			return ErrCorrupt
+		}
+		offset := 1<<ofCode + int(br.read(ofCode))
+		match := int(matchLengthCodes[mlCode][0] + uint32(br.read(int(matchLengthCodes[mlCode][1]))))
+		literal := int(literalLengthCodes[llCode][0] + uint32(br.read(int(literalLengthCodes[llCode][1]))))
+		if i < n-1 {
+			ll.update(&br)
+			ml.update(&br)
+			of.update(&br)
+		}
+		if br.overflow() || literal > len(lits) {
+			return ErrCorrupt
+		}
+		z.hist = append(z.hist, lits[:literal]...)
+		lits = lits[literal:]
+
+		// offsets 1 to 3 repeat the last three, shifted by one after no
+		// literals
+		if offset > 3 {
+			offset -= 3
+			z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+		} else {
+			if literal == 0 {
+				offset++
+			}
+			switch offset {
+			case 1:
+				offset = z.rep[0]
+			case 2:
+				offset = z.rep[1]
+				z.rep[0], z.rep[1] = offset, z.rep[0]
+			case 3:
+				offset = z.rep[2]
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			default:
+				offset = z.rep[0] - 1
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			}
+		}
+		if offset <= 0 || offset > len(z.hist) || len(z.hist)+match+len(lits) > limit {
+			return ErrCorrupt
+		}
+		from := len(z.hist) - offset
+		if offset >= match {
+			z.hist = append(z.hist, z.hist[from:from+match]...)
+		} else {
+			// the match overlaps what it writes
+			for j := 0; j < match; j++ {
+				z.hist = append(z.hist, z.hist[from+j])
+			}
+		}
+	}
+	if !br.finished() || len(z.hist)+len(lits) > limit {
+		return ErrCorrupt
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+// Sets the table of the codes of kind the mode says, returning the bytes
+// its description took
+func (z *Reader) table(kind, mode int, b []byte) (int, error) {
+	switch mode {
+	case modePredefined:
+		z.tables[kind] = &predefined[kind]
+		return 0, nil
+	case modeRLE:
+		if len(b) == 0 || int(b[0]) > maxSymbols[kind] {
+			return 0, ErrCorrupt
+		}
+		z.owned[kind].rle(b[0])
+		z.tables[kind] = &z.owned[kind]
+		return 1, nil
+	case modeCompressed:
+		norm, log, n, err := readCounts(b, z.norm, maxLogs[kind], maxSymbols[kind])
+		if err != nil {
+			return 0, err
+		}
+		z.norm = norm
+		if err := z.owned[kind].build(norm, log); err != nil {
+			return 0, err
+		}
+		z.tables[kind] = &z.owned[kind]
+		return n, nil
+	}
+	if z.tables[kind] == nil {
+		return 0, ErrCorrupt
+	}
+	return 0, nil
+}
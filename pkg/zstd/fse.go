@@ -0,0 +1,168 @@
+package zstd
+
+import "math/bits"
+
+// fseEntry is a state of a finite state entropy decoding table: the symbol
+// it decodes to, and the state after it, base plus the next bits read
+type fseEntry struct {
+	symbol uint8
+	bits   uint8
+	base   uint16
+}
+
+// fseTable decodes a finite state entropy stream
+type fseTable struct {
+	log     int
+	entries []fseEntry
+}
+
+// Reads the normalized counts of an FSE table description, at most
+// maxSymbol+1 of them with an accuracy log of at most maxLog, returning the
+// bytes it took
+func readCounts(in []byte, norm []int16, maxLog, maxSymbol int) ([]int16, int, int, error) {
+	if len(in) == 0 {
+		return nil, 0, 0, ErrCorrupt
+	}
+	log := int(in[0]&0xf) + 5
+	if log > maxLog {
+		return nil, 0, 0, ErrCorrupt
+	}
+	pos, end := 4, len(in)*8
+	remaining, threshold, nbBits := 1<<log+1, 1<<log, log+1
+	norm = norm[:0]
+	zero := false
+	for remaining > 1 {
+		if zero {
+			// runs of symbols with no probability are counted 2 bits at a
+			// time, 3 meaning more follow
+			n := 0
+			for {
+				if pos+2 > end {
+					return nil, 0, 0, ErrCorrupt
+				}
+				r := forward(in, pos, 2)
+				pos += 2
+				n += r
+				if r != 3 {
+					break
+				}
+			}
+			if len(norm)+n > maxSymbol {
+				return nil, 0, 0, ErrCorrupt
+			}
+			for ; n > 0; n-- {
+				norm = append(norm, 0)
+			}
+		}
+		if len(norm) > maxSymbol || pos > end {
+			return nil, 0, 0, ErrCorrupt
+		}
+		max := 2*threshold - 1 - remaining
+		count := forward(in, pos, nbBits-1)
+		if count < max {
+			pos += nbBits - 1
+		} else {
+			count = forward(in, pos, nbBits)
+			if count >= threshold {
+				count -= max
+			}
+			pos += nbBits
+		}
+		// -1 is a probability below 1
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		zero = count == 0
+		if remaining < 1 {
+			return nil, 0, 0, ErrCorrupt
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || pos > end {
+		return nil, 0, 0, ErrCorrupt
+	}
+	return norm, log, (pos + 7) / 8, nil
+}
+
+// Builds the decoding table of the normalized counts into t
+func (t *fseTable) build(norm []int16, log int) error {
+	size := 1 << log
+	if cap(t.entries) < size {
+		t.entries = make([]fseEntry, size)
+	}
+	t.log, t.entries = log, t.entries[:size]
+	var next [256]uint16
+	if len(norm) > len(next) {
+		return ErrCorrupt
+	}
+	// the symbols below 1 take the last states
+	high := size - 1
+	for s, c := range norm {
+		switch {
+		case c == -1:
+			if high < 0 {
+				return ErrCorrupt
+			}
+			t.entries[high].symbol = uint8(s)
+			high--
+			next[s] = 1
+		case c < -1:
+			return ErrCorrupt
+		default:
+			next[s] = uint16(c)
+		}
+	}
+	step, mask, pos := size>>1+size>>3+3, size-1, 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			t.entries[pos].symbol = uint8(s)
+			for pos = (pos + step) & mask; pos > high; pos = (pos + step) & mask {
+			}
+		}
+	}
+	if pos != 0 {
+		return ErrCorrupt
+	}
+	for i := range t.entries {
+		e := &t.entries[i]
+		n := next[e.symbol]
+		next[e.symbol]++
+		nb := log - (bits.Len16(n) - 1)
+		if n == 0 || nb < 0 {
+			return ErrCorrupt
+		}
+		e.bits, e.base = uint8(nb), uint16(int(n)<<nb-size)
+	}
+	return nil
+}
+
+// Makes t the table of a single symbol, which takes no bits
+func (t *fseTable) rle(symbol uint8) {
+	t.log, t.entries = 0, append(t.entries[:0], fseEntry{symbol: symbol})
+}
+
+// fseState is a decoder's position in a table
+type fseState struct {
+	t     *fseTable
+	state uint16
+}
+
+func (s *fseState) init(t *fseTable, br *backward) {
+	s.t, s.state = t, uint16(br.read(t.log))
+}
+
+func (s *fseState) symbol() uint8 {
+	return s.t.entries[s.state].symbol
+}
+
+func (s *fseState) update(br *backward) {
+	e := s.t.entries[s.state]
+	s.state = e.base + uint16(br.read(int(e.bits)))
+}
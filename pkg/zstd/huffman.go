@@ -0,0 +1,141 @@
+package zstd
+
+import "math/bits"
+
+// the longest Huffman code of literals
+const maxHuffmanBits = 11
+
+type huffmanEntry struct {
+	symbol uint8
+	bits   uint8
+}
+
+// huffmanTable decodes a literal from the next maxBits bits of a stream
+type huffmanTable struct {
+	maxBits int
+	entries []huffmanEntry
+	// the table decoding the weights of a compressed description
+	weights fseTable
+	norm    []int16
+}
+
+// Reads a Huffman tree description into t, returning the bytes it took
+func (t *huffmanTable) read(in []byte) (int, error) {
+	if len(in) == 0 {
+		return 0, ErrCorrupt
+	}
+	var weights [256]uint8
+	nw, n := 0, 0
+	if header := int(in[0]); header >= 128 {
+		// the weights as they are, 4 bits each
+		nw, n = header-127, 1+(header-126)/2
+		if n > len(in) {
+			return 0, ErrCorrupt
+		}
+		for i := 0; i < nw; i++ {
+			weights[i] = in[1+i/2] >> (4 * (1 - i%2)) & 0xf
+		}
+	} else {
+		// the weights FSE compressed, decoded by two interleaved states
+		n = 1 + header
+		if n > len(in) {
+			return 0, ErrCorrupt
+		}
+		data := in[1:n]
+		norm, log, k, err := readCounts(data, t.norm, 6, 255)
+		if err != nil {
+			return 0, err
+		}
+		t.norm = norm
+		if err := t.weights.build(norm, log); err != nil {
+			return 0, err
+		}
+		var br backward
+		if err := br.init(data[k:]); err != nil {
+			return 0, err
+		}
+		var s1, s2 fseState
+		s1.init(&t.weights, &br)
+		s2.init(&t.weights, &br)
+		for {
+			if nw > len(weights)-3 {
+				return 0, ErrCorrupt
+			}
+			weights[nw] = s1.symbol()
+			nw++
+			s1.update(&br)
+			if br.overflow() {
+				weights[nw] = s2.symbol()
+				nw++
+				break
+			}
+			weights[nw] = s2.symbol()
+			nw++
+			s2.update(&br)
+			if br.overflow() {
+				weights[nw] = s1.symbol()
+				nw++
+				break
+			}
+		}
+	}
+
+	// the last weight is what brings the total to a power of 2
+	total := 0
+	for _, w := range weights[:nw] {
+		if w > maxHuffmanBits {
+			return 0, ErrCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 || nw >= len(weights) {
+		return 0, ErrCorrupt
+	}
+	maxBits := bits.Len(uint(total))
+	rest := 1<<maxBits - total
+	if rest&(rest-1) != 0 || maxBits > maxHuffmanBits {
+		return 0, ErrCorrupt
+	}
+	weights[nw] = uint8(bits.Len(uint(rest)))
+	nw++
+
+	// each symbol takes 2^(weight-1) states, the lightest first
+	size := 1 << maxBits
+	if cap(t.entries) < size {
+		t.entries = make([]huffmanEntry, size)
+	}
+	t.maxBits, t.entries = maxBits, t.entries[:size]
+	pos := 0
+	for w := 1; w <= maxBits; w++ {
+		for s, sw := range weights[:nw] {
+			if int(sw) != w {
+				continue
+			}
+			e := huffmanEntry{symbol: uint8(s), bits: uint8(maxBits + 1 - w)}
+			for i := 0; i < 1<<(w-1); i++ {
+				t.entries[pos] = e
+				pos++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Decodes the stream in into every byte of dst
+func (t *huffmanTable) decode(dst, in []byte) error {
+	var br backward
+	if err := br.init(in); err != nil {
+		return err
+	}
+	for i := range dst {
+		e := t.entries[br.peek(t.maxBits)]
+		dst[i] = e.symbol
+		br.skip(int(e.bits))
+	}
+	if !br.finished() {
+		return ErrCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is the XXH64 hash of the content of a frame, with seed 0, whose
+// low 32 bits are the frame's checksum
+type xxhash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+func (h *xxhash64) reset() {
+	p1 := prime1
+	h.v = [4]uint64{p1 + prime2, prime2, 0, -p1}
+	h.total, h.n = 0, 0
+}
+
+func xxround(acc, in uint64) uint64 {
+	return bits.RotateLeft64(acc+in*prime2, 31) * prime1
+}
+
+func (h *xxhash64) write(b []byte) {
+	h.total += uint64(len(b))
+	if h.n > 0 {
+		k := copy(h.buf[h.n:], b)
+		h.n += k
+		b = b[k:]
+		if h.n < len(h.buf) {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		h.stripe(b)
+	}
+	h.n = copy(h.buf[:], b)
+}
+
+func (h *xxhash64) stripe(b []byte) {
+	for i := range h.v {
+		h.v[i] = xxround(h.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+	}
+}
+
+func (h *xxhash64) sum() uint64 {
+	var s uint64
+	if h.total >= 32 {
+		s = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) + bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			s = (s^xxround(0, v))*prime1 + prime4
+		}
+	} else {
+		s = h.v[2] + prime5
+	}
+	s += h.total
+	b := h.buf[:h.n]
+	for ; len(b) >= 8; b = b[8:] {
+		s ^= xxround(0, binary.LittleEndian.Uint64(b))
+		s = bits.RotateLeft64(s, 27)*prime1 + prime4
+	}
+	if len(b) >= 4 {
+		s ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		s = bits.RotateLeft64(s, 23)*prime2 + prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		s ^= uint64(c) * prime5
+		s = bits.RotateLeft64(s, 11) * prime1
+	}
+	s ^= s >> 33
+	s *= prime2
+	s ^= s >> 29
+	s *= prime3
+	s ^= s >> 32
+	return s
+}
@@ -0,0 +1,257 @@
+// Package zstd decodes Zstandard (RFC 8878) streams, as clients compress
+// what they send with. Frames with a dictionary aren't supported.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Magic starts every Zstandard frame
+var Magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// MaxWindowSize bounds the history a frame may need kept to decode it,
+// a frame wanting more is rejected rather than allocated
+const MaxWindowSize = 8 << 20
+
+var (
+	// ErrCorrupt is returned for input that isn't a valid Zstandard stream
+	ErrCorrupt = errors.New("zstd: corrupt input")
+	// ErrChecksum is returned for a frame whose content doesn't match its
+	// checksum
+	ErrChecksum = errors.New("zstd: checksum mismatch")
+	// ErrUnsupported is returned for frames needing a dictionary or a
+	// window over MaxWindowSize
+	ErrUnsupported = errors.New("zstd: unsupported frame")
+)
+
+const (
+	frameMagic     = 0xfd2fb528
+	skippableMagic = 0x184d2a50
+	maxBlockSize   = 128 << 10
+
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+)
+
+// Reader decodes the frames of a Zstandard stream one block at a time
+type Reader struct {
+	r   io.Reader
+	buf []byte
+	// the content of the frame, of which the last window bytes are kept
+	// for matches to refer to, and what wasn't read of it yet
+	hist    []byte
+	pending []byte
+	window  int
+	// the frame's content size when its header gives it, -1 otherwise,
+	// and how much was decoded
+	size, decoded int64
+	frames        int
+	inFrame       bool
+	checked       bool
+	hash          xxhash64
+	err           error
+
+	// the state carried from one compressed block of a frame to the next
+	rep      [3]int
+	huffman  huffmanTable
+	lastHuff bool
+	lits     []byte
+	tables   [3]*fseTable
+	owned    [3]fseTable
+	norm     []int16
+}
+
+// NewReader returns a Reader decoding r
+func NewReader(r io.Reader) *Reader {
+	z := &Reader{}
+	z.Reset(r)
+	return z
+}
+
+// Reset makes z read r, keeping its buffers
+func (z *Reader) Reset(r io.Reader) {
+	z.r, z.pending, z.frames, z.inFrame, z.err = r, nil, 0, false, nil
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.pending) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if z.inFrame {
+			z.err = z.block()
+		} else {
+			z.err = z.frame()
+		}
+	}
+	n := copy(p, z.pending)
+	z.pending = z.pending[n:]
+	return n, nil
+}
+
+// Reads the header of the next frame, skipping skippable ones
+func (z *Reader) frame() error {
+	var header [14]byte
+	if _, err := io.ReadFull(z.r, header[:4]); err != nil {
+		if err == io.EOF && z.frames > 0 {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	magic := binary.LittleEndian.Uint32(header[:])
+	if magic&0xfffffff0 == skippableMagic {
+		if _, err := io.ReadFull(z.r, header[:4]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		n := int64(binary.LittleEndian.Uint32(header[:]))
+		if k, _ := io.CopyN(io.Discard, z.r, n); k != n {
+			return io.ErrUnexpectedEOF
+		}
+		z.frames++
+		return nil
+	}
+	if magic != frameMagic {
+		return ErrCorrupt
+	}
+
+	if _, err := io.ReadFull(z.r, header[:1]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	desc := header[0]
+	sizeFlag, single, dictFlag := desc>>6, desc>>5&1 == 1, desc&3
+	if desc>>3&1 != 0 {
+		return ErrCorrupt
+	}
+	n := [4]int{0, 1, 2, 4}[dictFlag] + [4]int{0, 2, 4, 8}[sizeFlag]
+	if !single {
+		n++
+	} else if sizeFlag == 0 {
+		n++
+	}
+	rest := header[:n]
+	if _, err := io.ReadFull(z.r, rest); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if !single {
+		exp, mantissa := int(rest[0]>>3), int(rest[0]&7)
+		if exp > 31-10 {
+			return ErrUnsupported
+		}
+		base := 1 << (10 + exp)
+		z.window = base + base/8*mantissa
+		rest = rest[1:]
+	}
+	var dict uint32
+	switch dictFlag {
+	case 1:
+		dict = uint32(rest[0])
+	case 2:
+		dict = uint32(binary.LittleEndian.Uint16(rest))
+	case 3:
+		dict = binary.LittleEndian.Uint32(rest)
+	}
+	if dict != 0 {
+		return ErrUnsupported
+	}
+	rest = rest[[4]int{0, 1, 2, 4}[dictFlag]:]
+	z.size = -1
+	switch len(rest) {
+	case 1:
+		z.size = int64(rest[0])
+	case 2:
+		z.size = int64(binary.LittleEndian.Uint16(rest)) + 256
+	case 4:
+		z.size = int64(binary.LittleEndian.Uint32(rest))
+	case 8:
+		z.size = int64(binary.LittleEndian.Uint64(rest))
+	}
+	if single {
+		if z.size > MaxWindowSize {
+			return ErrUnsupported
+		}
+		z.window = int(z.size)
+	}
+	if z.window > MaxWindowSize {
+		return ErrUnsupported
+	}
+
+	z.frames++
+	z.inFrame, z.checked, z.decoded = true, desc>>2&1 == 1, 0
+	z.hist = z.hist[:0]
+	z.hash.reset()
+	z.rep = [3]int{1, 4, 8}
+	z.lastHuff = false
+	z.tables = [3]*fseTable{}
+	return nil
+}
+
+// Decodes the next block of the frame, leaving what it holds pending
+func (z *Reader) block() error {
+	var header [4]byte
+	if _, err := io.ReadFull(z.r, header[:3]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	h := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	last, kind, size := h&1 == 1, h>>1&3, h>>3
+	if size > min(z.window, maxBlockSize) {
+		return ErrCorrupt
+	}
+
+	// what is further back than the window can't be referred to any more
+	if len(z.hist) > z.window && len(z.hist)+maxBlockSize > cap(z.hist) {
+		z.hist = z.hist[:copy(z.hist, z.hist[len(z.hist)-z.window:])]
+	}
+	start := len(z.hist)
+	switch kind {
+	case blockRaw:
+		z.hist = append(z.hist, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.hist[start:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	case blockRLE:
+		if _, err := io.ReadFull(z.r, header[:1]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, header[0])
+		}
+	case blockCompressed:
+		if cap(z.buf) < size {
+			z.buf = make([]byte, size)
+		}
+		b := z.buf[:size]
+		if _, err := io.ReadFull(z.r, b); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if err := z.compressed(b, start+min(z.window, maxBlockSize)); err != nil {
+			return err
+		}
+	default:
+		return ErrCorrupt
+	}
+	z.pending = z.hist[start:]
+	z.decoded += int64(len(z.pending))
+	if z.checked {
+		z.hash.write(z.pending)
+	}
+
+	if !last {
+		return nil
+	}
+	z.inFrame = false
+	if z.size >= 0 && z.decoded != z.size {
+		return ErrCorrupt
+	}
+	if z.checked {
+		if _, err := io.ReadFull(z.r, header[:4]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if binary.LittleEndian.Uint32(header[:]) != uint32(z.hash.sum()) {
+			return ErrChecksum
+		}
+	}
+	return nil
+}
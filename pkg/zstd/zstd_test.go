@@ -0,0 +1,106 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// what the files in testdata were compressed from, by the zstd command
+func testContent() (lines, random []byte) {
+	var b strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "host%d.cpu.load\t%d\t%d\n", i%37, i*7919%1000, 1700000000+i)
+	}
+	random = make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	return []byte(b.String()), random
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReader(t *testing.T) {
+	lines, random := testContent()
+	skippable := binary.LittleEndian.AppendUint32(nil, skippableMagic+3)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 4)
+	skippable = append(skippable, "skip"...)
+	concatenated := append(readFile(t, "lines.19.zst"), skippable...)
+	concatenated = append(concatenated, readFile(t, "random.zst")...)
+
+	r := NewReader(nil)
+	for _, test := range []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"lines.3.zst", readFile(t, "lines.3.zst"), lines},
+		{"lines.19.zst", readFile(t, "lines.19.zst"), lines},
+		{"random.zst", readFile(t, "random.zst"), random},
+		{"frames", concatenated, append(bytes.Clone(lines), random...)},
+	} {
+		r.Reset(bytes.NewReader(test.in))
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s; got %d bytes, error %v, want %d", test.name, len(got), err, len(test.want))
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	in := readFile(t, "lines.3.zst")
+	checksum := bytes.Clone(in)
+	checksum[len(checksum)-1]++
+	window := bytes.Clone(in)
+	window[4] &^= 0x20 // not a single segment, the window descriptor follows
+	window = append(window[:5], append([]byte{0xff}, window[5:]...)...)
+	for name, test := range map[string]struct {
+		in   []byte
+		want error
+	}{
+		"empty":      {nil, io.ErrUnexpectedEOF},
+		"not zstd":   {[]byte("cpu.load\t1\n"), ErrCorrupt},
+		"checksum":   {checksum, ErrChecksum},
+		"truncated":  {in[:len(in)/2], io.ErrUnexpectedEOF},
+		"big window": {window, ErrUnsupported},
+	} {
+		if _, err := io.ReadAll(NewReader(bytes.NewReader(test.in))); !errors.Is(err, test.want) {
+			t.Errorf("%s; got error %v, want %v", name, err, test.want)
+		}
+	}
+
+	// corrupt input fails rather than panics
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		c := bytes.Clone(in)
+		for j := 0; j < 1+rnd.Intn(3); j++ {
+			c[rnd.Intn(len(c))] ^= byte(1 << rnd.Intn(8))
+		}
+		io.ReadAll(NewReader(bytes.NewReader(c)))
+	}
+}
+
+func TestXXHash(t *testing.T) {
+	for in, want := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"abc": 0x44bc2cf5ad770999,
+	} {
+		var h xxhash64
+		h.reset()
+		h.write([]byte(in))
+		if got := h.sum(); got != want {
+			t.Errorf("xxhash64(%q); got %#x, want %#x", in, got, want)
+		}
+	}
+}